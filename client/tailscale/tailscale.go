@@ -236,7 +236,27 @@ func Profile(ctx context.Context, pprofType string, sec int) ([]byte, error) {
 
 // BugReport logs and returns a log marker that can be shared by the user with support.
 func BugReport(ctx context.Context, note string) (string, error) {
-	body, err := send(ctx, "POST", "/localapi/v0/bugreport?note="+url.QueryEscape(note), 200, nil)
+	return BugReportWithOpts(ctx, BugReportOpts{Note: note})
+}
+
+// BugReportOpts are options for BugReportWithOpts.
+type BugReportOpts struct {
+	// Note is a note from the user to log along with the report.
+	Note string
+
+	// PingReferenceHosts is whether to also ping some well-known
+	// Internet hosts, such as 8.8.8.8 and 1.1.1.1, and log how that
+	// went, as a baseline of what's reachable.
+	PingReferenceHosts bool
+}
+
+// BugReportWithOpts is like BugReport, with options.
+func BugReportWithOpts(ctx context.Context, opts BugReportOpts) (string, error) {
+	q := url.Values{"note": {opts.Note}}
+	if opts.PingReferenceHosts {
+		q.Set("pingref", "true")
+	}
+	body, err := send(ctx, "POST", "/localapi/v0/bugreport?"+q.Encode(), 200, nil)
 	if err != nil {
 		return "", err
 	}
@@ -275,6 +295,127 @@ func status(ctx context.Context, queryString string) (*ipnstate.Status, error) {
 	return st, nil
 }
 
+// SSHServerStatus returns the state of the Tailscale SSH server.
+func SSHServerStatus(ctx context.Context) (*ipnstate.SSHServerStatus, error) {
+	body, err := get200(ctx, "/localapi/v0/ssh-server")
+	if err != nil {
+		return nil, err
+	}
+	st := new(ipnstate.SSHServerStatus)
+	if err := json.Unmarshal(body, st); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// WatchSSHServerEvents calls fn with each event of the Tailscale SSH
+// server, starting with the recent ones if recent is set, until ctx is
+// done or the connection to the daemon fails.
+func WatchSSHServerEvents(ctx context.Context, recent bool, fn func(ipnstate.SSHEvent)) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://local-tailscaled.sock/localapi/v0/ssh-server-events?recent="+strconv.FormatBool(recent), nil)
+	if err != nil {
+		return err
+	}
+	res, err := doLocalRequestNiceError(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(res.Body)
+		return bestError(fmt.Errorf("%v: %s", res.Status, bytes.TrimSpace(body)), body)
+	}
+	dec := json.NewDecoder(res.Body)
+	for {
+		var ev ipnstate.SSHEvent
+		if err := dec.Decode(&ev); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		fn(ev)
+	}
+}
+
+// TerminateSSHSession ends the active Tailscale SSH session with the
+// given ID, telling its user msg, or a generic message if msg is empty.
+func TerminateSSHSession(ctx context.Context, id, msg string) error {
+	v := url.Values{"id": {id}}
+	if msg != "" {
+		v.Set("message", msg)
+	}
+	_, err := send(ctx, "POST", "/localapi/v0/ssh-server-terminate?"+v.Encode(), http.StatusNoContent, nil)
+	return err
+}
+
+// CheckSSHPolicy reports which rule of the Tailscale SSH server's
+// policy would match a connection from the Tailscale IP src as sshUser,
+// offering pubKey (in authorized_keys format) if non-empty, and what
+// it'd do. No connection is made.
+func CheckSSHPolicy(ctx context.Context, sshUser, src, pubKey string) (*ipnstate.SSHPolicyCheck, error) {
+	v := url.Values{"user": {sshUser}, "src": {src}}
+	if pubKey != "" {
+		v.Set("pubkey", pubKey)
+	}
+	body, err := get200(ctx, "/localapi/v0/ssh-server-check?"+v.Encode())
+	if err != nil {
+		return nil, err
+	}
+	res := new(ipnstate.SSHPolicyCheck)
+	if err := json.Unmarshal(body, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// SSHServerRecordings returns the Tailscale SSH session recordings on
+// the node's disk that match f, oldest first.
+func SSHServerRecordings(ctx context.Context, f ipnstate.SSHRecordingFilter) ([]*ipnstate.SSHRecording, error) {
+	v := url.Values{}
+	if f.SessionID != "" {
+		v.Set("session", f.SessionID)
+	}
+	if f.User != "" {
+		v.Set("user", f.User)
+	}
+	if !f.Since.IsZero() {
+		v.Set("since", f.Since.Format(time.RFC3339))
+	}
+	if !f.Until.IsZero() {
+		v.Set("until", f.Until.Format(time.RFC3339))
+	}
+	body, err := get200(ctx, "/localapi/v0/ssh-server-recordings?"+v.Encode())
+	if err != nil {
+		return nil, err
+	}
+	var recs []*ipnstate.SSHRecording
+	if err := json.Unmarshal(body, &recs); err != nil {
+		return nil, err
+	}
+	return recs, nil
+}
+
+// SSHServerRecording returns the recording of the Tailscale SSH
+// session with the given ID, in asciinema's cast format. The caller
+// must close it.
+func SSHServerRecording(ctx context.Context, id string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://local-tailscaled.sock/localapi/v0/ssh-server-recording?id="+url.QueryEscape(id), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := doLocalRequestNiceError(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		return nil, bestError(fmt.Errorf("%v: %s", res.Status, bytes.TrimSpace(body)), body)
+	}
+	return res.Body, nil
+}
+
 // IDToken is a request to get an OIDC ID token for an audience.
 // The token can be presented to any resource provider which offers OIDC
 // Federation.
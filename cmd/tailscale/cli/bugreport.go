@@ -7,6 +7,7 @@
 import (
 	"context"
 	"errors"
+	"flag"
 
 	"github.com/peterbourgon/ff/v3/ffcli"
 	"tailscale.com/client/tailscale"
@@ -17,6 +18,15 @@
 	Exec:       runBugReport,
 	ShortHelp:  "Print a shareable identifier to help diagnose issues",
 	ShortUsage: "bugreport [note]",
+	FlagSet: (func() *flag.FlagSet {
+		fs := newFlagSet("bugreport")
+		fs.BoolVar(&bugReportArgs.pingRef, "ping-reference-hosts", false, "also ping some well-known Internet hosts (8.8.8.8, 1.1.1.1 and 2001:4860:4860::8888) for the report")
+		return fs
+	})(),
+}
+
+var bugReportArgs struct {
+	pingRef bool
 }
 
 func runBugReport(ctx context.Context, args []string) error {
@@ -28,7 +38,10 @@ func runBugReport(ctx context.Context, args []string) error {
 	default:
 		return errors.New("unknown argumets")
 	}
-	logMarker, err := tailscale.BugReport(ctx, note)
+	logMarker, err := tailscale.BugReportWithOpts(ctx, tailscale.BugReportOpts{
+		Note:               note,
+		PingReferenceHosts: bugReportArgs.pingRef,
+	})
 	if err != nil {
 		return err
 	}
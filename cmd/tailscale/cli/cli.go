@@ -161,6 +161,7 @@ func Run(args []string) (err error) {
 			pingCmd,
 			ncCmd,
 			sshCmd,
+			sshServerCmd,
 			versionCmd,
 			webCmd,
 			fileCmd,
@@ -954,3 +954,40 @@ func TestCleanUpArgs(t *testing.T) {
 		c.Assert(got, qt.DeepEquals, tt.want)
 	}
 }
+
+func TestPrintSSHServerStatus(t *testing.T) {
+	var buf bytes.Buffer
+	printSSHServerStatus(&buf, &ipnstate.SSHServerStatus{})
+	if got, want := buf.String(), "This tailscaled has no SSH server.\n"; got != want {
+		t.Errorf("unsupported: got %q; want %q", got, want)
+	}
+
+	buf.Reset()
+	printSSHServerStatus(&buf, &ipnstate.SSHServerStatus{
+		Supported:    true,
+		Enabled:      true,
+		PolicySource: "tailnet",
+		PolicyRules:  2,
+		HostKeys:     []string{"ssh-ed25519 SHA256:abc"},
+		Recording:    "disabled",
+		Sessions: []*ipnstate.SSHSessionStatus{{
+			ID:        "20220601T120000-0102030405",
+			Src:       netaddr.MustParseIPPort("100.64.0.2:41641"),
+			LoginName: "alice@example.com",
+			LocalUser: "root",
+		}},
+	})
+	got := buf.String()
+	for _, want := range []string{
+		"SSH server: enabled\n",
+		"Policy: from tailnet, 2 rules\n",
+		"Host key: ssh-ed25519 SHA256:abc\n",
+		"Recording: disabled\n",
+		"Active sessions: 1\n",
+		"  20220601T120000-0102030405  alice@example.com (100.64.0.2) as root, since ",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("missing %q in:\n%s", want, got)
+		}
+	}
+}
@@ -22,6 +22,7 @@
 	"tailscale.com/envknob"
 	"tailscale.com/ipn"
 	"tailscale.com/net/netcheck"
+	"tailscale.com/net/ping"
 	"tailscale.com/net/portmapper"
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/logger"
@@ -37,6 +38,7 @@
 		fs.StringVar(&netcheckArgs.format, "format", "", `output format; empty (for human-readable), "json" or "json-line"`)
 		fs.DurationVar(&netcheckArgs.every, "every", 0, "if non-zero, do an incremental report with the given frequency")
 		fs.BoolVar(&netcheckArgs.verbose, "verbose", false, "verbose logs")
+		fs.BoolVar(&netcheckArgs.icmp, "icmp", false, "also ping the local gateways, the nearest DERP region and some well-known hosts (human-readable format only)")
 		return fs
 	})(),
 }
@@ -45,6 +47,7 @@
 	format  string
 	every   time.Duration
 	verbose bool
+	icmp    bool
 }
 
 func runNetcheck(ctx context.Context, args []string) error {
@@ -87,6 +90,11 @@ func runNetcheck(ctx context.Context, args []string) error {
 		if err := printReport(dm, report); err != nil {
 			return err
 		}
+		if netcheckArgs.icmp && netcheckArgs.format == "" {
+			targets := append(ping.DERPTargets(dm.Regions[report.PreferredDERP]), ping.ReferenceTargets...)
+			d := ping.Diagnose(ctx, nil, targets, 0)
+			printf("\n%s", d)
+		}
 		if netcheckArgs.every == 0 {
 			return nil
 		}
@@ -16,9 +16,11 @@
 	"time"
 
 	"github.com/peterbourgon/ff/v3/ffcli"
+	"inet.af/netaddr"
 	"tailscale.com/client/tailscale"
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/net/ping"
 )
 
 var pingCmd = &ffcli.Command{
@@ -39,6 +41,11 @@
 By default, 'tailscale ping' stops after 10 pings or once a direct
 (non-DERP) path has been established, whichever comes first.
 
+With --icmp, it instead sends ICMP echo requests from this machine
+through the operating system's network stack (and so through the
+Tailscale tunnel), like the regular ping command does, and prints
+round-trip statistics at the end.
+
 The provided hostname must resolve to or be a Tailscale IP
 (e.g. 100.x.y.z) or a subnet IP advertised by a Tailscale
 relay node.
@@ -50,7 +57,9 @@
 		fs.BoolVar(&pingArgs.verbose, "verbose", false, "verbose output")
 		fs.BoolVar(&pingArgs.untilDirect, "until-direct", true, "stop once a direct path is established")
 		fs.BoolVar(&pingArgs.tsmp, "tsmp", false, "do a TSMP-level ping (through IP + wireguard, but not involving host OS stack)")
+		fs.BoolVar(&pingArgs.icmp, "icmp", false, "do an ICMP-level ping (through the host OS stack, like the ping command)")
 		fs.IntVar(&pingArgs.num, "c", 10, "max number of pings to send")
+		fs.DurationVar(&pingArgs.interval, "interval", time.Second, "time between ICMP pings (with --icmp)")
 		fs.DurationVar(&pingArgs.timeout, "timeout", 5*time.Second, "timeout before giving up on a ping")
 		return fs
 	})(),
@@ -61,6 +70,8 @@
 	untilDirect bool
 	verbose     bool
 	tsmp        bool
+	icmp        bool
+	interval    time.Duration
 	timeout     time.Duration
 }
 
@@ -107,6 +118,12 @@ func runPing(ctx context.Context, args []string) error {
 	if pingArgs.verbose && ip != hostOrIP {
 		log.Printf("lookup %q => %q", hostOrIP, ip)
 	}
+	if pingArgs.icmp {
+		if pingArgs.tsmp {
+			return errors.New("--icmp and --tsmp are mutually exclusive")
+		}
+		return runICMPPing(ctx, ip)
+	}
 
 	n := 0
 	anyPong := false
@@ -202,3 +219,118 @@ func tailscaleIPFromArg(ctx context.Context, hostOrIP string) (ip string, self b
 		return addrs[0], false, nil
 	}
 }
+
+// runICMPPing implements "tailscale ping --icmp", sending ICMP echo
+// requests to ipStr from this process, at most pingArgs.num of them,
+// each given up on after pingArgs.timeout.
+func runICMPPing(ctx context.Context, ipStr string) error {
+	ip, err := netaddr.ParseIP(ipStr)
+	if err != nil {
+		return err
+	}
+	if pingArgs.interval <= 0 {
+		return errors.New("--interval must be positive")
+	}
+	if pingArgs.timeout <= 0 {
+		return errors.New("--timeout must be positive")
+	}
+	if pingArgs.num <= 0 {
+		return errors.New("-c must be positive")
+	}
+	rep := ping.NewReport(ping.ClassPeer, ip)
+	if pingArgs.verbose {
+		log.Printf("pinging %v using %v", ip, rep.Method)
+	}
+
+	// The path to a peer is only looked up again after replies while
+	// waiting for it to become direct; otherwise it's shown once.
+	addr, peerKnown := pathToPeer(ctx, ip)
+	direct := addr != ""
+	recheckPath := peerKnown && pingArgs.untilDirect && !direct
+	if peerKnown && !recheckPath {
+		printf("pinging %v%s\n", ip, viaPath(addr))
+	}
+
+	// Unanswered probes back off, as in ping.Continuous, so a
+	// rate-limiting host isn't hammered.
+	pacer := &ping.Pacer{Interval: pingArgs.interval}
+	for rep.Sent < pingArgs.num {
+		if err := pacer.Wait(ctx); err != nil {
+			break // interrupted
+		}
+		pctx, cancel := context.WithTimeout(ctx, pingArgs.timeout)
+		rtt, err := ping.Ping(pctx, ping.ClassPeer, ip)
+		cancel()
+		if ctx.Err() != nil {
+			break
+		}
+		pacer.Observe(err)
+		rep.Add(ping.Result{IP: ip, RTT: rtt, Err: err})
+		if err != nil {
+			if errors.As(err, new(*ping.CapabilityError)) {
+				return err
+			}
+			printf("no reply from %v: %v\n", ip, err)
+			continue
+		}
+		via := ""
+		if recheckPath {
+			addr, _ = pathToPeer(ctx, ip)
+			direct = addr != ""
+			via = viaPath(addr)
+		}
+		printf("pong from %v%s in %v\n", ip, via, rtt.Round(100*time.Microsecond))
+		if direct && pingArgs.untilDirect {
+			break
+		}
+	}
+	printICMPPingStats(rep)
+	if ctx.Err() != nil {
+		return nil // interrupted on purpose
+	}
+	if rep.Received == 0 {
+		return errors.New("no reply")
+	}
+	if pingArgs.untilDirect && peerKnown && !direct {
+		return errors.New("direct connection not established")
+	}
+	return nil
+}
+
+// viaPath describes the path to a peer whose direct address is addr,
+// or that's reached over DERP if addr is empty.
+func viaPath(addr string) string {
+	if addr == "" {
+		return " via DERP"
+	}
+	return " via " + addr
+}
+
+// pathToPeer reports the current direct address used to reach the
+// Tailscale peer with IP ip, or the empty string if it's being reached
+// over DERP. known is false if ip doesn't belong to a peer (e.g. it's
+// a subnet-routed IP) or the status couldn't be fetched.
+func pathToPeer(ctx context.Context, ip netaddr.IP) (direct string, known bool) {
+	st, err := tailscale.Status(ctx)
+	if err != nil {
+		return "", false
+	}
+	for _, ps := range st.Peer {
+		for _, pip := range ps.TailscaleIPs {
+			if pip == ip {
+				return ps.CurAddr, true
+			}
+		}
+	}
+	return "", false
+}
+
+func printICMPPingStats(rep *ping.Report) {
+	printf("\n--- %v ping statistics ---\n", rep.IP)
+	printf("%d packets transmitted, %d received, %.1f%% packet loss\n", rep.Sent, rep.Received, rep.Loss*100)
+	if rep.Received > 0 {
+		ms := func(sec float64) float64 { return sec * 1000 }
+		printf("rtt min/avg/max/p95 = %.3f/%.3f/%.3f/%.3f ms\n",
+			ms(rep.MinLatencySeconds), ms(rep.MeanLatencySeconds), ms(rep.MaxLatencySeconds), ms(rep.P95LatencySeconds))
+	}
+}
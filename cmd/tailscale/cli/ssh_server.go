@@ -0,0 +1,414 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+	"tailscale.com/client/tailscale"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+)
+
+var sshServerCmd = &ffcli.Command{
+	Name:       "ssh-server",
+	ShortUsage: "ssh-server <enable|disable|status|events|terminate|check|recordings|replay> ...",
+	ShortHelp:  "Manage this machine's Tailscale SSH server",
+	Subcommands: []*ffcli.Command{
+		{
+			Name:       "enable",
+			ShortUsage: "ssh-server enable",
+			ShortHelp:  "Run the Tailscale SSH server",
+			Exec:       func(ctx context.Context, args []string) error { return runSSHServerSet(ctx, args, true) },
+		},
+		{
+			Name:       "disable",
+			ShortUsage: "ssh-server disable",
+			ShortHelp:  "Stop running the Tailscale SSH server",
+			Exec:       func(ctx context.Context, args []string) error { return runSSHServerSet(ctx, args, false) },
+		},
+		{
+			Name:       "status",
+			ShortUsage: "ssh-server status [--json]",
+			ShortHelp:  "Show the Tailscale SSH server's state",
+			Exec:       runSSHServerStatus,
+			FlagSet: (func() *flag.FlagSet {
+				fs := newFlagSet("status")
+				fs.BoolVar(&sshServerArgs.json, "json", false, "output in JSON format")
+				return fs
+			})(),
+		},
+		{
+			Name:       "events",
+			ShortUsage: "ssh-server events [--recent] [--json]",
+			ShortHelp:  "Print the Tailscale SSH server's audit events as they happen",
+			Exec:       runSSHServerEvents,
+			FlagSet: (func() *flag.FlagSet {
+				fs := newFlagSet("events")
+				fs.BoolVar(&sshServerArgs.recent, "recent", false, "start with the recent events")
+				fs.BoolVar(&sshServerArgs.json, "json", false, "output in JSON format, one event per line")
+				return fs
+			})(),
+		},
+		{
+			Name:       "terminate",
+			ShortUsage: "ssh-server terminate [--message=<text>] <session-id>",
+			ShortHelp:  "End an active SSH session",
+			LongHelp:   "End the active SSH session with the given ID, as shown by 'tailscale ssh-server status'. The connection's other sessions and forwards are left alone.",
+			Exec:       runSSHServerTerminate,
+			FlagSet: (func() *flag.FlagSet {
+				fs := newFlagSet("terminate")
+				fs.StringVar(&sshServerArgs.message, "message", "", "message to show the session's user; if empty, a generic one")
+				return fs
+			})(),
+		},
+		{
+			Name:       "check",
+			ShortUsage: "ssh-server check [--pubkey=<file>] [--json] <ssh-user> <src-ip>",
+			ShortHelp:  "Show what the SSH policy would do with a connection",
+			LongHelp:   "Evaluate the SSH policy for a connection from the Tailscale IP <src-ip> as <ssh-user>, offering the public key in --pubkey if set, and show which rule would match and what it'd do. No connection is made.",
+			Exec:       runSSHServerCheck,
+			FlagSet: (func() *flag.FlagSet {
+				fs := newFlagSet("check")
+				fs.StringVar(&sshServerArgs.pubKeyFile, "pubkey", "", "file of the public key the client would offer, like ~/.ssh/id_ed25519.pub")
+				fs.BoolVar(&sshServerArgs.json, "json", false, "output in JSON format")
+				return fs
+			})(),
+		},
+		{
+			Name:       "recordings",
+			ShortUsage: "ssh-server recordings [--session=<id>] [--user=<user>] [--since=<time>] [--until=<time>] [--json]",
+			ShortHelp:  "List the session recordings on this machine",
+			LongHelp:   "List the SSH session recordings on this machine's disk, oldest first. Times are RFC 3339, like 2022-06-01T15:04:05Z, or durations ago, like 24h.",
+			Exec:       runSSHServerRecordings,
+			FlagSet: (func() *flag.FlagSet {
+				fs := newFlagSet("recordings")
+				fs.StringVar(&sshServerArgs.session, "session", "", "only the recording of the session with this ID")
+				fs.StringVar(&sshServerArgs.user, "user", "", "only recordings of sessions by this login name or local user")
+				fs.StringVar(&sshServerArgs.since, "since", "", "only recordings of sessions started at or after this time")
+				fs.StringVar(&sshServerArgs.until, "until", "", "only recordings of sessions started before this time")
+				fs.BoolVar(&sshServerArgs.json, "json", false, "output in JSON format")
+				return fs
+			})(),
+		},
+		{
+			Name:       "replay",
+			ShortUsage: "ssh-server replay [--raw] <session-id>",
+			ShortHelp:  "Replay a session recording",
+			LongHelp:   "Replay the output of the recorded SSH session with the given ID, with its original timing, except that pauses are at most two seconds.",
+			Exec:       runSSHServerReplay,
+			FlagSet: (func() *flag.FlagSet {
+				fs := newFlagSet("replay")
+				fs.BoolVar(&sshServerArgs.raw, "raw", false, "print the recording in asciinema's cast format instead")
+				return fs
+			})(),
+		},
+	},
+	Exec: func(context.Context, []string) error {
+		return errors.New("ssh-server subcommand required; run 'tailscale ssh-server -h' for details")
+	},
+}
+
+var sshServerArgs struct {
+	json       bool
+	recent     bool
+	message    string
+	pubKeyFile string
+	session    string
+	user       string
+	since      string
+	until      string
+	raw        bool
+}
+
+func runSSHServerSet(ctx context.Context, args []string, run bool) error {
+	if len(args) > 0 {
+		return errors.New("unexpected arguments")
+	}
+	_, err := tailscale.EditPrefs(ctx, &ipn.MaskedPrefs{
+		Prefs: ipn.Prefs{
+			RunSSH: run,
+		},
+		RunSSHSet: true,
+	})
+	return err
+}
+
+func runSSHServerStatus(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("unexpected arguments")
+	}
+	st, err := tailscale.SSHServerStatus(ctx)
+	if err != nil {
+		return err
+	}
+	if sshServerArgs.json {
+		j, err := json.MarshalIndent(st, "", "  ")
+		if err != nil {
+			return err
+		}
+		printf("%s\n", j)
+		return nil
+	}
+	printSSHServerStatus(Stdout, st)
+	return nil
+}
+
+func printSSHServerStatus(w io.Writer, st *ipnstate.SSHServerStatus) {
+	if !st.Supported {
+		fmt.Fprintln(w, "This tailscaled has no SSH server.")
+		return
+	}
+	if st.Enabled {
+		fmt.Fprintln(w, "SSH server: enabled")
+	} else {
+		fmt.Fprintln(w, "SSH server: disabled")
+	}
+	if st.PolicySource != "" {
+		fmt.Fprintf(w, "Policy: from %s, %d rules\n", st.PolicySource, st.PolicyRules)
+	} else {
+		fmt.Fprintln(w, "Policy: none")
+	}
+	if st.HostKeysErr != "" {
+		fmt.Fprintf(w, "Host keys: %s\n", st.HostKeysErr)
+	}
+	for _, k := range st.HostKeys {
+		fmt.Fprintf(w, "Host key: %s\n", k)
+	}
+	fmt.Fprintf(w, "Recording: %s\n", st.Recording)
+	fmt.Fprintf(w, "Active sessions: %d\n", len(st.Sessions))
+	for _, s := range st.Sessions {
+		fmt.Fprintf(w, "  %s  %s (%v) as %s, since %s\n",
+			s.ID, s.LoginName, s.Src.IP(), s.LocalUser, s.Started.Local().Format(time.Stamp))
+	}
+}
+
+func runSSHServerEvents(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("unexpected arguments")
+	}
+	return tailscale.WatchSSHServerEvents(ctx, sshServerArgs.recent, func(ev ipnstate.SSHEvent) {
+		if sshServerArgs.json {
+			j, _ := json.Marshal(ev)
+			printf("%s\n", j)
+			return
+		}
+		outln(formatSSHEvent(ev))
+	})
+}
+
+func runSSHServerTerminate(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: tailscale ssh-server terminate [--message=<text>] <session-id>")
+	}
+	return tailscale.TerminateSSHSession(ctx, args[0], sshServerArgs.message)
+}
+
+func runSSHServerCheck(ctx context.Context, args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: tailscale ssh-server check [--pubkey=<file>] [--json] <ssh-user> <src-ip>")
+	}
+	var pubKey string
+	if sshServerArgs.pubKeyFile != "" {
+		b, err := os.ReadFile(sshServerArgs.pubKeyFile)
+		if err != nil {
+			return err
+		}
+		pubKey = string(b)
+	}
+	res, err := tailscale.CheckSSHPolicy(ctx, args[0], args[1], pubKey)
+	if err != nil {
+		return err
+	}
+	if sshServerArgs.json {
+		j, err := json.MarshalIndent(res, "", "  ")
+		if err != nil {
+			return err
+		}
+		printf("%s\n", j)
+		return nil
+	}
+	printSSHPolicyCheck(Stdout, res)
+	return nil
+}
+
+func printSSHPolicyCheck(w io.Writer, res *ipnstate.SSHPolicyCheck) {
+	if res.LoginName != "" {
+		fmt.Fprintf(w, "Login: %s\n", res.LoginName)
+	}
+	if res.Error != "" {
+		fmt.Fprintf(w, "Result: rejected: %s\n", res.Error)
+		return
+	}
+	fmt.Fprintf(w, "Rule: %d\n", res.Rule)
+	a := res.Action
+	switch {
+	case a == nil:
+	case a.Reject:
+		fmt.Fprintln(w, "Result: rejected by rule")
+	case a.Accept:
+		fmt.Fprintf(w, "Result: accepted as %s\n", res.LocalUser)
+	case a.HoldAndDelegate != "":
+		fmt.Fprintf(w, "Result: held, delegated to %s; would run as %s\n", a.HoldAndDelegate, res.LocalUser)
+	default:
+		fmt.Fprintln(w, "Result: no decision")
+	}
+	if a != nil && a.Message != "" {
+		fmt.Fprintf(w, "Message: %s\n", strings.TrimSpace(a.Message))
+	}
+}
+
+func runSSHServerRecordings(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("unexpected arguments")
+	}
+	f := ipnstate.SSHRecordingFilter{
+		SessionID: sshServerArgs.session,
+		User:      sshServerArgs.user,
+	}
+	var err error
+	if f.Since, err = parseTimeArg(sshServerArgs.since); err != nil {
+		return fmt.Errorf("--since: %w", err)
+	}
+	if f.Until, err = parseTimeArg(sshServerArgs.until); err != nil {
+		return fmt.Errorf("--until: %w", err)
+	}
+	recs, err := tailscale.SSHServerRecordings(ctx, f)
+	if err != nil {
+		return err
+	}
+	if sshServerArgs.json {
+		j, err := json.MarshalIndent(recs, "", "  ")
+		if err != nil {
+			return err
+		}
+		printf("%s\n", j)
+		return nil
+	}
+	for _, r := range recs {
+		who := r.LoginName
+		if who == "" {
+			who = "-"
+		}
+		what := "shell"
+		if r.Command != "" {
+			what = fmt.Sprintf("%q", r.Command)
+		}
+		printf("%s  %s  %s as %s: %s (%d bytes)\n", r.SessionID, r.Start.Local().Format(time.Stamp), who, r.LocalUser, what, r.Size)
+	}
+	return nil
+}
+
+// parseTimeArg parses v as an RFC 3339 time, or a duration ago. The
+// empty string is the zero time.
+func parseTimeArg(v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(v); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
+// maxReplayIdle is the longest pause "ssh-server replay" makes, however
+// long the recorded session sat idle.
+const maxReplayIdle = 2 * time.Second
+
+func runSSHServerReplay(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: tailscale ssh-server replay [--raw] <session-id>")
+	}
+	rc, err := tailscale.SSHServerRecording(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	if sshServerArgs.raw {
+		_, err := io.Copy(Stdout, rc)
+		return err
+	}
+	br := bufio.NewReader(rc)
+	if _, err := br.ReadBytes('\n'); err != nil { // the header
+		return err
+	}
+	var last float64
+	for {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			return nil
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+		var (
+			at   float64
+			dir  string
+			data string
+		)
+		if json.Unmarshal(line, &[]any{&at, &dir, &data}) != nil || dir != "o" {
+			continue
+		}
+		if d := time.Duration((at - last) * float64(time.Second)); d > 0 {
+			if d > maxReplayIdle {
+				d = maxReplayIdle
+			}
+			select {
+			case <-time.After(d):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		last = at
+		io.WriteString(Stdout, data)
+	}
+}
+
+// formatSSHEvent returns a one-line description of ev.
+func formatSSHEvent(ev ipnstate.SSHEvent) string {
+	who := ev.Src.IP().String()
+	if ev.LoginName != "" {
+		who = fmt.Sprintf("%s (%v)", ev.LoginName, ev.Src.IP())
+	}
+	at := ev.Time.Local().Format(time.Stamp)
+	switch ev.Type {
+	case ipnstate.SSHEventAuthAttempt:
+		auth := "none"
+		if ev.PubKey != "" {
+			auth = "public key " + ev.PubKey
+		}
+		return fmt.Sprintf("%s auth-attempt %s as %q: %s", at, who, ev.SSHUser, auth)
+	case ipnstate.SSHEventReject:
+		return fmt.Sprintf("%s reject %s as %q: %s", at, who, ev.SSHUser, ev.Reason)
+	case ipnstate.SSHEventAccept, ipnstate.SSHEventSessionStart, ipnstate.SSHEventSessionEnd:
+		return fmt.Sprintf("%s %s %s %s as %s", at, ev.Type, ev.SessionID, who, ev.LocalUser)
+	case ipnstate.SSHEventExec:
+		what := "shell"
+		switch {
+		case ev.Subsystem != "":
+			what = "subsystem " + ev.Subsystem
+		case ev.Command != "":
+			what = fmt.Sprintf("command %q", ev.Command)
+		}
+		return fmt.Sprintf("%s exec %s %s as %s: %s", at, ev.SessionID, who, ev.LocalUser, what)
+	case ipnstate.SSHEventForward:
+		return fmt.Sprintf("%s forward %s %s as %s to %s", at, ev.SessionID, who, ev.LocalUser, ev.ForwardTo)
+	case ipnstate.SSHEventForwardEnd:
+		return fmt.Sprintf("%s forward-end %s %s as %s to %s: %d bytes sent, %d received in %v", at, ev.SessionID, who, ev.LocalUser, ev.ForwardTo, ev.BytesSent, ev.BytesReceived, ev.Duration.Round(time.Millisecond))
+	case ipnstate.SSHEventUpload, ipnstate.SSHEventDownload:
+		return fmt.Sprintf("%s %s %s %s as %s: %s (%d bytes)", at, ev.Type, ev.SessionID, who, ev.LocalUser, ev.Path, ev.Size)
+	}
+	return fmt.Sprintf("%s %s %s as %q", at, ev.Type, who, ev.SSHUser)
+}
@@ -2,8 +2,8 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-//go:build linux || darwin
-// +build linux darwin
+//go:build linux || darwin || windows
+// +build linux darwin windows
 
 package main
 
@@ -31,11 +31,11 @@
 	"unsafe"
 
 	"github.com/creack/pty"
-	gossh "github.com/tailscale/golang-x-crypto/ssh"
 	"inet.af/netaddr"
 	"tailscale.com/net/interfaces"
 	"tailscale.com/net/tsaddr"
 	"tailscale.com/tempfork/gliderlabs/ssh"
+	gossh "tailscale.com/tempfork/golang-x-crypto/ssh"
 )
 
 var (
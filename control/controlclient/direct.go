@@ -70,7 +70,8 @@ type Direct struct {
 	keepSharerAndUserSplit bool
 	skipIPForwardingCheck  bool
 	pinger                 Pinger
-	popBrowser             func(url string) // or nil
+	popBrowser             func(url string)            // or nil
+	terminateSSHSession    func(sessionID, msg string) // or nil
 
 	mu             sync.Mutex        // mutex guards the following fields
 	serverKey      key.MachinePublic // original ("legacy") nacl crypto_box-based public key
@@ -107,6 +108,12 @@ type Options struct {
 	LinkMonitor          *monitor.Mon     // optional link monitor
 	PopBrowserURL        func(url string) // optional func to open browser
 
+	// TerminateSSHSession optionally specifies the func that ends
+	// the Tailscale SSH sessions MapResponse.SSHTerminateSessions
+	// asks to, with the given user-visible message.
+	// If nil, those requests are ignored.
+	TerminateSSHSession func(sessionID, msg string)
+
 	// KeepSharerAndUserSplit controls whether the client
 	// understands Node.Sharer. If false, the Sharer is mapped to the User.
 	KeepSharerAndUserSplit bool
@@ -202,6 +209,7 @@ func NewDirect(opts Options) (*Direct, error) {
 		skipIPForwardingCheck:  opts.SkipIPForwardingCheck,
 		pinger:                 opts.Pinger,
 		popBrowser:             opts.PopBrowserURL,
+		terminateSSHSession:    opts.TerminateSSHSession,
 	}
 	if opts.Hostinfo == nil {
 		c.SetHostinfo(hostinfo.New())
@@ -862,6 +870,17 @@ func (c *Direct) sendMapRequest(ctx context.Context, maxPolls int, cb func(*netm
 				c.logf("netmap: control says to open URL %v; no popBrowser func", u)
 			}
 		}
+		for _, t := range resp.SSHTerminateSessions {
+			if t == nil {
+				continue
+			}
+			if c.terminateSSHSession != nil {
+				c.logf("netmap: control says to end SSH session %v", t.SessionID)
+				go c.terminateSSHSession(t.SessionID, t.Message)
+			} else {
+				c.logf("netmap: control says to end SSH session %v; no terminateSSHSession func", t.SessionID)
+			}
+		}
 		if resp.ControlTime != nil && !resp.ControlTime.IsZero() {
 			c.logf.JSON(1, "controltime", resp.ControlTime.UTC())
 		}
@@ -40,6 +40,7 @@ type mapSession struct {
 	lastUserProfile        map[tailcfg.UserID]tailcfg.UserProfile
 	lastParsedPacketFilter []filter.Match
 	lastSSHPolicy          *tailcfg.SSHPolicy
+	lastSSHHostCerts       []string
 	collectServices        bool
 	previousPeers          []*tailcfg.Node // for delta-purposes
 	lastDomain             string
@@ -102,6 +103,9 @@ func (ms *mapSession) netmapForResponse(resp *tailcfg.MapResponse) *netmap.Netwo
 	if p := resp.SSHPolicy; p != nil {
 		ms.lastSSHPolicy = p
 	}
+	if c := resp.SSHHostCertificates; c != nil {
+		ms.lastSSHHostCerts = c
+	}
 
 	if v, ok := resp.CollectServices.Get(); ok {
 		ms.collectServices = v
@@ -114,19 +118,20 @@ func (ms *mapSession) netmapForResponse(resp *tailcfg.MapResponse) *netmap.Netwo
 	}
 
 	nm := &netmap.NetworkMap{
-		NodeKey:         ms.privateNodeKey.Public(),
-		PrivateKey:      ms.privateNodeKey,
-		MachineKey:      ms.machinePubKey,
-		Peers:           resp.Peers,
-		UserProfiles:    make(map[tailcfg.UserID]tailcfg.UserProfile),
-		Domain:          ms.lastDomain,
-		DNS:             *ms.lastDNSConfig,
-		PacketFilter:    ms.lastParsedPacketFilter,
-		SSHPolicy:       ms.lastSSHPolicy,
-		CollectServices: ms.collectServices,
-		DERPMap:         ms.lastDERPMap,
-		Debug:           resp.Debug,
-		ControlHealth:   ms.lastHealth,
+		NodeKey:             ms.privateNodeKey.Public(),
+		PrivateKey:          ms.privateNodeKey,
+		MachineKey:          ms.machinePubKey,
+		Peers:               resp.Peers,
+		UserProfiles:        make(map[tailcfg.UserID]tailcfg.UserProfile),
+		Domain:              ms.lastDomain,
+		DNS:                 *ms.lastDNSConfig,
+		PacketFilter:        ms.lastParsedPacketFilter,
+		SSHPolicy:           ms.lastSSHPolicy,
+		SSHHostCertificates: ms.lastSSHHostCerts,
+		CollectServices:     ms.collectServices,
+		DERPMap:             ms.lastDERPMap,
+		Debug:               resp.Debug,
+		ControlHealth:       ms.lastHealth,
 	}
 	ms.netMapBuilding = nm
 
@@ -71,6 +71,23 @@
 	// the Windows network adapter's "category" (public, private, domain).
 	// If it's unhealthy, the Windows firewall rules won't match.
 	SysNetworkCategory = Subsystem("network-category")
+
+	// SysSSHHostKeys is the name of the subsystem that loads or
+	// generates the Tailscale SSH server's host keys.
+	SysSSHHostKeys = Subsystem("ssh-host-keys")
+
+	// SysSSHPolicy is the name of the subsystem that loads the
+	// Tailscale SSH server's access policy.
+	SysSSHPolicy = Subsystem("ssh-policy")
+
+	// SysSSHRecording is the name of the subsystem that records
+	// Tailscale SSH sessions.
+	SysSSHRecording = Subsystem("ssh-recording")
+
+	// SysSSHDelegate is the name of the subsystem that asks the
+	// control plane whether to accept Tailscale SSH connections
+	// whose policy action is HoldAndDelegate.
+	SysSSHDelegate = Subsystem("ssh-delegate")
 )
 
 type watchHandle byte
@@ -126,6 +143,19 @@ func SetNetworkCategoryHealth(err error) { set(SysNetworkCategory, err) }
 
 func NetworkCategoryHealth() error { return get(SysNetworkCategory) }
 
+// SetSSHHostKeysHealth sets the state of loading the SSH server's host keys.
+func SetSSHHostKeysHealth(err error) { set(SysSSHHostKeys, err) }
+
+// SetSSHPolicyHealth sets the state of loading the SSH server's access policy.
+func SetSSHPolicyHealth(err error) { set(SysSSHPolicy, err) }
+
+// SetSSHRecordingHealth sets the state of SSH session recording.
+func SetSSHRecordingHealth(err error) { set(SysSSHRecording, err) }
+
+// SetSSHDelegateHealth sets the state of reaching the control plane
+// to decide on HoldAndDelegate SSH connections.
+func SetSSHDelegateHealth(err error) { set(SysSSHDelegate, err) }
+
 func RegisterDebugHandler(typ string, h http.Handler) {
 	mu.Lock()
 	defer mu.Unlock()
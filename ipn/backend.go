@@ -92,6 +92,12 @@ type Notify struct {
 	// macOS Network Extension.
 	LocalTCPPort *uint16 `json:",omitempty"`
 
+	// SSHSession, if non-nil, is a session-start or session-end
+	// event of the Tailscale SSH server, so GUIs can show who's
+	// connected to this machine. Its SessionID identifies the
+	// session in the SSH server's status.
+	SSHSession *ipnstate.SSHEvent `json:",omitempty"`
+
 	// type is mirrored in xcode/Shared/IPN.swift
 }
 
@@ -134,6 +140,9 @@ func (n Notify) String() string {
 	if n.LocalTCPPort != nil {
 		fmt.Fprintf(&sb, "tcpport=%v ", n.LocalTCPPort)
 	}
+	if n.SSHSession != nil {
+		fmt.Fprintf(&sb, "ssh=%s:%s ", n.SSHSession.Type, n.SSHSession.SessionID)
+	}
 	s := sb.String()
 	return s[0:len(s)-1] + "}"
 }
@@ -5,6 +5,7 @@
 package ipnlocal
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
@@ -77,10 +78,62 @@ func getControlDebugFlags() []string {
 type SSHServer interface {
 	HandleSSHConn(net.Conn) error
 
+	// Start makes the server accept connections. It's stopped
+	// until then. Start and Stop must not call into LocalBackend,
+	// as they're called with its mutex held.
+	Start()
+
+	// Stop makes the server refuse connections and ends the
+	// active ones, telling their users why. It may instead let
+	// them drain for a while; see Wait.
+	Stop()
+
+	// Wait waits for the connections that Stop is draining, if
+	// any, to end. It must not be called with LocalBackend's
+	// mutex held.
+	Wait()
+
 	// OnPolicyChange is called when the SSH access policy changes,
 	// so that existing sessions can be re-evaluated for validity
 	// and closed if they'd no longer be accepted.
 	OnPolicyChange()
+
+	// BugReport returns a human-readable summary of the SSH
+	// server's state, one item per line, for bug reports.
+	BugReport() string
+
+	// OpenPeerAgent connects to the SSH agent forwarded to the
+	// session that made the TCP connection from local port sport
+	// to peer's port dport, if that session's policy lets peers
+	// use its agent.
+	OpenPeerAgent(peer netaddr.IP, sport, dport uint16) (io.ReadWriteCloser, error)
+
+	// Status returns the SSH server's state.
+	Status() *ipnstate.SSHServerStatus
+
+	// SubscribeEvents calls fn with each SSH server event, in
+	// order and from a goroutine of its own, starting with the
+	// recent ones if recent is set, until unsubscribe is called.
+	// fn shouldn't block; events are dropped if it falls behind.
+	SubscribeEvents(recent bool, fn func(ipnstate.SSHEvent)) (unsubscribe func())
+
+	// TerminateSession ends the active session with the given ID,
+	// telling its user msg, or a generic message if msg is empty.
+	TerminateSession(id, msg string) error
+
+	// CheckPolicy evaluates the SSH policy for a hypothetical
+	// connection from src as sshUser, offering pubKey (in
+	// authorized_keys format) if non-empty, without making one.
+	CheckPolicy(sshUser string, src netaddr.IP, pubKey string) (*ipnstate.SSHPolicyCheck, error)
+
+	// Recordings returns the session recordings on the node's disk
+	// that match f, oldest first.
+	Recordings(f ipnstate.SSHRecordingFilter) ([]*ipnstate.SSHRecording, error)
+
+	// OpenRecording opens the recording of the session with the
+	// given ID, returning it in asciinema's cast format,
+	// decompressed if needed.
+	OpenRecording(id string) (io.ReadCloser, error)
 }
 
 type newSSHServerFunc func(logger.Logf, *LocalBackend) (SSHServer, error)
@@ -115,6 +168,7 @@ type LocalBackend struct {
 	backendLogID          string
 	unregisterLinkMon     func()
 	unregisterHealthWatch func()
+	unsubscribeSSHEvents  func()
 	portpoll              *portlist.Poller // may be nil
 	portpollOnce          sync.Once        // guards starting readPoller
 	gotPortPollRes        chan struct{}    // closed upon first readPoller result
@@ -245,6 +299,7 @@ func NewLocalBackend(logf logger.Logf, logid string, store ipn.StateStore, diale
 	b.unregisterLinkMon = linkMon.RegisterChangeCallback(b.linkChange)
 
 	b.unregisterHealthWatch = health.RegisterWatcher(b.onHealthChange)
+	b.unsubscribeSSHEvents = b.SubscribeSSHEvents(false, b.onSSHEvent)
 
 	wiredPeerAPIPort := false
 	if ig, ok := e.(wgengine.InternalsGetter); ok {
@@ -339,6 +394,14 @@ func (b *LocalBackend) onHealthChange(sys health.Subsystem, err error) {
 	}
 }
 
+// onSSHEvent tells the frontend when SSH sessions start and end.
+func (b *LocalBackend) onSSHEvent(ev ipnstate.SSHEvent) {
+	switch ev.Type {
+	case ipnstate.SSHEventSessionStart, ipnstate.SSHEventSessionEnd:
+		b.send(ipn.Notify{SSHSession: &ev})
+	}
+}
+
 // Shutdown halts the backend and all its sub-components. The backend
 // can no longer be used after Shutdown returns.
 func (b *LocalBackend) Shutdown() {
@@ -348,6 +411,11 @@ func (b *LocalBackend) Shutdown() {
 
 	b.unregisterLinkMon()
 	b.unregisterHealthWatch()
+	b.unsubscribeSSHEvents()
+	if b.sshServer != nil {
+		b.sshServer.Stop()
+		b.sshServer.Wait()
+	}
 	if cc != nil {
 		cc.Shutdown()
 	}
@@ -1033,6 +1101,7 @@ func (b *LocalBackend) Start(opts ipn.Options) error {
 		LinkMonitor:          b.e.GetLinkMonitor(),
 		Pinger:               b.e,
 		PopBrowserURL:        b.tellClientToBrowseToURL,
+		TerminateSSHSession:  b.terminateSSHSessionForControl,
 
 		// Don't warn about broken Linux IP forwarding when
 		// netstack is being used.
@@ -1639,9 +1708,17 @@ func (b *LocalBackend) loadStateLocked(key ipn.StateKey, prefs *ipn.Prefs) (err
 }
 
 // setAtomicValuesFromPrefs populates sshAtomicBool and containsViaIPFuncAtomic
-// from the prefs p, which may be nil.
+// from the prefs p, which may be nil. It also starts or stops the SSH
+// server if the prefs turn it on or off.
 func (b *LocalBackend) setAtomicValuesFromPrefs(p *ipn.Prefs) {
-	b.sshAtomicBool.Set(p != nil && p.RunSSH && canSSH)
+	runSSH := p != nil && p.RunSSH && canSSH
+	if b.sshAtomicBool.Swap(runSSH) && b.sshServer != nil {
+		if runSSH {
+			b.sshServer.Start()
+		} else {
+			b.sshServer.Stop()
+		}
+	}
 
 	if p == nil {
 		b.containsViaIPFuncAtomic.Store(tsaddr.NewContainsIPFunc(nil))
@@ -1802,6 +1879,10 @@ func (b *LocalBackend) checkPrefsLocked(p *ipn.Prefs) error {
 			if !envknob.UseWIPCode() {
 				return errors.New("The Tailscale SSH server is disabled on macOS tailscaled by default. To try, set env TAILSCALE_USE_WIP_CODE=1")
 			}
+		case "windows":
+			if !envknob.UseWIPCode() {
+				return errors.New("The Tailscale SSH server is disabled on Windows by default. To try, set env TAILSCALE_USE_WIP_CODE=1")
+			}
 		default:
 			return errors.New("The Tailscale SSH server is not supported on " + runtime.GOOS)
 		}
@@ -3323,6 +3404,160 @@ func (b *LocalBackend) DoNoiseRequest(req *http.Request) (*http.Response, error)
 	return cc.DoNoiseRequest(req)
 }
 
+// SSHBugReport returns a summary of the SSH server's state for bug
+// reports, or the empty string if there's no SSH server.
+func (b *LocalBackend) SSHBugReport() string {
+	if b.sshServer == nil {
+		return ""
+	}
+	return b.sshServer.BugReport()
+}
+
+// SSHServerStatus returns the state of the SSH server.
+func (b *LocalBackend) SSHServerStatus() *ipnstate.SSHServerStatus {
+	st := &ipnstate.SSHServerStatus{}
+	if b.sshServer != nil {
+		st = b.sshServer.Status()
+	}
+	st.Enabled = b.ShouldRunSSH()
+	return st
+}
+
+// TerminateSSHSession ends the active SSH session with the given ID,
+// telling its user msg, or a generic message if msg is empty.
+func (b *LocalBackend) TerminateSSHSession(id, msg string) error {
+	if b.sshServer == nil {
+		return errors.New("no SSH server")
+	}
+	return b.sshServer.TerminateSession(id, msg)
+}
+
+// CheckSSHPolicy reports which SSH policy rule would match a
+// connection from src as sshUser, offering pubKey if non-empty, and
+// what it'd do, without making one.
+func (b *LocalBackend) CheckSSHPolicy(sshUser string, src netaddr.IP, pubKey string) (*ipnstate.SSHPolicyCheck, error) {
+	if b.sshServer == nil {
+		return nil, errors.New("no SSH server")
+	}
+	return b.sshServer.CheckPolicy(sshUser, src, pubKey)
+}
+
+// SSHRecordings returns the SSH session recordings on the node's disk
+// that match f, oldest first.
+func (b *LocalBackend) SSHRecordings(f ipnstate.SSHRecordingFilter) ([]*ipnstate.SSHRecording, error) {
+	if b.sshServer == nil {
+		return nil, errors.New("no SSH server")
+	}
+	return b.sshServer.Recordings(f)
+}
+
+// OpenSSHRecording opens the recording of the SSH session with the
+// given ID, in asciinema's cast format.
+func (b *LocalBackend) OpenSSHRecording(id string) (io.ReadCloser, error) {
+	if b.sshServer == nil {
+		return nil, errors.New("no SSH server")
+	}
+	return b.sshServer.OpenRecording(id)
+}
+
+// terminateSSHSessionForControl ends the SSH session that control
+// asked to.
+func (b *LocalBackend) terminateSSHSessionForControl(id, msg string) {
+	if err := b.TerminateSSHSession(id, msg); err != nil {
+		b.logf("ssh: ending session %q for control: %v", id, err)
+	}
+}
+
+// SubscribeSSHEvents calls fn with each SSH server event, in order
+// and from a goroutine of its own, starting with the recent ones if
+// recent is set, until unsubscribe is called. It's how subsystems
+// learn of SSH authentication attempts, sessions and forwarded
+// connections. fn shouldn't block; events are dropped if it falls
+// behind.
+//
+// If there's no SSH server, fn is never called.
+func (b *LocalBackend) SubscribeSSHEvents(recent bool, fn func(ipnstate.SSHEvent)) (unsubscribe func()) {
+	if b.sshServer == nil {
+		return func() {}
+	}
+	return b.sshServer.SubscribeEvents(recent, fn)
+}
+
+// WatchSSHEvents calls fn with each SSH server event, starting with
+// the recent ones if recent is set, until ctx is done. Unlike with
+// SubscribeSSHEvents, fn is called from WatchSSHEvents's goroutine,
+// and may block.
+func (b *LocalBackend) WatchSSHEvents(ctx context.Context, recent bool, fn func(ipnstate.SSHEvent)) error {
+	if b.sshServer == nil {
+		return errors.New("no SSH server")
+	}
+	events := make(chan ipnstate.SSHEvent)
+	unsubscribe := b.sshServer.SubscribeEvents(recent, func(ev ipnstate.SSHEvent) {
+		select {
+		case events <- ev:
+		case <-ctx.Done():
+		}
+	})
+	defer unsubscribe()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case ev := <-events:
+			fn(ev)
+		}
+	}
+}
+
+// peerSSHAgentProto is the HTTP Upgrade protocol name for connections
+// to a peer's SSH agent over the peerapi.
+const peerSSHAgentProto = "ts-ssh-agent"
+
+// DialPeerSSHAgent connects to the SSH agent forwarded to the session
+// on peer that made the TCP connection from peer's port sport to this
+// node's port dport, via peer's peerapi.
+func (b *LocalBackend) DialPeerSSHAgent(ctx context.Context, peer netaddr.IP, sport, dport uint16) (io.ReadWriteCloser, error) {
+	n, _, ok := b.WhoIs(netaddr.IPPortFrom(peer, 0))
+	if !ok {
+		return nil, fmt.Errorf("unknown peer %v", peer)
+	}
+	base := peerAPIBase(b.NetMap(), n)
+	if base == "" {
+		return nil, fmt.Errorf("peer %v has no peerapi", peer)
+	}
+	u := fmt.Sprintf("%s/v0/ssh-agent?sport=%d&dport=%d", base, sport, dport)
+	req, err := http.NewRequestWithContext(ctx, "POST", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Connection", "upgrade")
+	req.Header.Set("Upgrade", peerSSHAgentProto)
+	res, err := b.Dialer().PeerAPIHTTPClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 1<<10))
+		res.Body.Close()
+		return nil, fmt.Errorf("peer %v: %v: %s", peer, res.Status, bytes.TrimSpace(body))
+	}
+	rwc, ok := res.Body.(io.ReadWriteCloser)
+	if !ok {
+		res.Body.Close()
+		return nil, errors.New("internal error: 101 response body not writable")
+	}
+	return rwc, nil
+}
+
+// DialPeerTCP connects to the TCP port ipp of a peer, as this node.
+// The SSH server uses it to proxy sessions to other nodes.
+func (b *LocalBackend) DialPeerTCP(ctx context.Context, ipp netaddr.IPPort) (net.Conn, error) {
+	if _, _, ok := b.WhoIs(netaddr.IPPortFrom(ipp.IP(), 0)); !ok {
+		return nil, fmt.Errorf("unknown peer %v", ipp.IP())
+	}
+	return b.Dialer().UserDial(ctx, "tcp", ipp.String())
+}
+
 func (b *LocalBackend) HandleSSHConn(c net.Conn) error {
 	if b.sshServer == nil {
 		return errors.New("no SSH server")
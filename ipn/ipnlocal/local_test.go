@@ -14,6 +14,7 @@
 
 	"inet.af/netaddr"
 	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/ipn/store/mem"
 	"tailscale.com/net/interfaces"
 	"tailscale.com/net/tsaddr"
@@ -637,3 +638,66 @@ type interfacePrefix struct {
 		})
 	}
 }
+
+func TestSSHSessionNotify(t *testing.T) {
+	eng, err := wgengine.NewFakeUserspaceEngine(logger.Discard, 0)
+	if err != nil {
+		t.Fatalf("NewFakeUserspaceEngine: %v", err)
+	}
+	t.Cleanup(eng.Close)
+	b, err := NewLocalBackend(logger.Discard, "logid", new(mem.Store), nil, eng, 0)
+	if err != nil {
+		t.Fatalf("NewLocalBackend: %v", err)
+	}
+	var got []ipnstate.SSHEventType
+	b.SetNotifyCallback(func(n ipn.Notify) {
+		if n.SSHSession != nil {
+			got = append(got, n.SSHSession.Type)
+		}
+	})
+	for _, typ := range []ipnstate.SSHEventType{
+		ipnstate.SSHEventAuthAttempt,
+		ipnstate.SSHEventAccept,
+		ipnstate.SSHEventSessionStart,
+		ipnstate.SSHEventForward,
+		ipnstate.SSHEventSessionEnd,
+		ipnstate.SSHEventReject,
+	} {
+		b.onSSHEvent(ipnstate.SSHEvent{Type: typ, SessionID: "id"})
+	}
+	want := []ipnstate.SSHEventType{ipnstate.SSHEventSessionStart, ipnstate.SSHEventSessionEnd}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("notified of %v; want %v", got, want)
+	}
+}
+
+// startStopSSHServer is an SSHServer that only records Start and Stop calls.
+type startStopSSHServer struct {
+	SSHServer
+	calls []string
+}
+
+func (s *startStopSSHServer) Start() { s.calls = append(s.calls, "start") }
+func (s *startStopSSHServer) Stop()  { s.calls = append(s.calls, "stop") }
+
+func TestSSHServerStartStop(t *testing.T) {
+	if !canSSH {
+		t.Skip("SSH administratively disabled")
+	}
+	srv := new(startStopSSHServer)
+	b := &LocalBackend{sshServer: srv}
+	for _, p := range []*ipn.Prefs{
+		{RunSSH: false},
+		{RunSSH: true},
+		{RunSSH: true},
+		nil,
+		{RunSSH: true},
+		{RunSSH: false},
+	} {
+		b.setAtomicValuesFromPrefs(p)
+	}
+	want := []string{"start", "stop", "start", "stop"}
+	if !reflect.DeepEqual(srv.calls, want) {
+		t.Errorf("calls = %q; want %q", srv.calls, want)
+	}
+}
@@ -548,6 +548,9 @@ func (h *peerAPIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	case "/v0/dnsfwd":
 		h.handleServeDNSFwd(w, r)
 		return
+	case "/v0/ssh-agent":
+		h.handleSSHAgent(w, r)
+		return
 	}
 	who := h.peerUser.DisplayName
 	fmt.Fprintf(w, `<html>
@@ -760,6 +763,59 @@ func approxSize(n int64) string {
 	return fmt.Sprintf("~%dMB", n>>20)
 }
 
+// handleSSHAgent connects the peer to the SSH agent forwarded to the
+// SSH session on this node that connected to it, if the session's
+// policy allows. See LocalBackend.DialPeerSSHAgent.
+func (h *peerAPIHandler) handleSSHAgent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" || r.Header.Get("Upgrade") != peerSSHAgentProto {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	srv := h.ps.b.sshServer
+	if srv == nil {
+		http.Error(w, "no SSH server", http.StatusNotFound)
+		return
+	}
+	sport, err1 := strconv.ParseUint(r.FormValue("sport"), 10, 16)
+	dport, err2 := strconv.ParseUint(r.FormValue("dport"), 10, 16)
+	if err1 != nil || err2 != nil {
+		http.Error(w, "bad sport or dport", http.StatusBadRequest)
+		return
+	}
+	agent, err := srv.OpenPeerAgent(h.remoteAddr.IP(), uint16(sport), uint16(dport))
+	if err != nil {
+		h.logf("ssh-agent: %v", err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	defer agent.Close()
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "can't hijack", http.StatusInternalServerError)
+		return
+	}
+	c, brw, err := hj.Hijack()
+	if err != nil {
+		h.logf("ssh-agent: hijack: %v", err)
+		return
+	}
+	defer c.Close()
+	fmt.Fprintf(brw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: %s\r\nConnection: Upgrade\r\n\r\n", peerSSHAgentProto)
+	if err := brw.Flush(); err != nil {
+		return
+	}
+	errc := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(agent, brw)
+		errc <- err
+	}()
+	go func() {
+		_, err := io.Copy(c, agent)
+		errc <- err
+	}()
+	<-errc
+}
+
 func (h *peerAPIHandler) handleServeGoroutines(w http.ResponseWriter, r *http.Request) {
 	if !h.canDebug() {
 		http.Error(w, "denied; no debug access", http.StatusForbidden)
@@ -2,8 +2,8 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-//go:build linux || (darwin && !ios)
-// +build linux darwin,!ios
+//go:build linux || (darwin && !ios) || windows
+// +build linux darwin,!ios windows
 
 package ipnlocal
 
@@ -20,21 +20,83 @@
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 
-	"github.com/tailscale/golang-x-crypto/ssh"
 	"tailscale.com/envknob"
+	"tailscale.com/tempfork/golang-x-crypto/ssh"
 )
 
 var useHostKeys = envknob.Bool("TS_USE_SYSTEM_SSH_HOST_KEYS")
 
+// hostKeyTypesEnv, if non-empty, is a comma-separated list of the SSH
+// host key types to offer, in order of preference, such as
+// "ed25519,ecdsa-p256,rsa-4096". See parseHostKeyTypes. Keys are
+// offered and advertised to peers in that order, though which one a
+// connection uses is up to the client's own preferences. Types that the
+// system's OpenSSH has no key of are generated.
+var hostKeyTypesEnv = envknob.String("TS_SSH_HOST_KEY_TYPES")
+
+// hostKeyType is a type of SSH host key, with the parameters to
+// generate one with.
+type hostKeyType struct {
+	name string // "rsa", "ecdsa" or "ed25519", as in OpenSSH's key file names
+	bits int    // RSA modulus or ECDSA curve size; 0 for ed25519
+}
+
 // keyTypes are the SSH key types that we either try to read from the
 // system's OpenSSH keys or try to generate for ourselves when not
-// running as root.
-var keyTypes = []string{"rsa", "ecdsa", "ed25519"}
+// running as root, unless hostKeyTypesEnv says otherwise.
+var keyTypes = []hostKeyType{{"rsa", 2048}, {"ecdsa", 256}, {"ed25519", 0}}
+
+// parseHostKeyTypes parses a comma-separated list of SSH host key
+// types: "ed25519", "ecdsa-p256", "ecdsa-p384", "ecdsa-p521", or
+// "rsa-N" for an N-bit RSA key, with N from 2048 to 8192. "ecdsa" and
+// "rsa" alone mean "ecdsa-p256" and "rsa-2048".
+func parseHostKeyTypes(s string) ([]hostKeyType, error) {
+	var ret []hostKeyType
+	seen := map[string]bool{}
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		name, param, _ := strings.Cut(f, "-")
+		t := hostKeyType{name: name}
+		switch {
+		case name == "ed25519" && param == "":
+		case name == "ecdsa" && (param == "" || param == "p256"):
+			t.bits = 256
+		case name == "ecdsa" && param == "p384":
+			t.bits = 384
+		case name == "ecdsa" && param == "p521":
+			t.bits = 521
+		case name == "rsa" && param == "":
+			t.bits = 2048
+		case name == "rsa":
+			n, err := strconv.Atoi(param)
+			if err != nil || n < 2048 || n > 8192 {
+				return nil, fmt.Errorf("invalid RSA key size %q", param)
+			}
+			t.bits = n
+		default:
+			return nil, fmt.Errorf("unknown host key type %q", f)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("more than one %s host key type", name)
+		}
+		seen[name] = true
+		ret = append(ret, t)
+	}
+	return ret, nil
+}
 
 func (b *LocalBackend) GetSSH_HostKeys() (keys []ssh.Signer, err error) {
+	if hostKeyTypesEnv != "" {
+		types, err := parseHostKeyTypes(hostKeyTypesEnv)
+		if err != nil {
+			return nil, fmt.Errorf("TS_SSH_HOST_KEY_TYPES: %w", err)
+		}
+		return b.getConfiguredSSH_HostKeys(types)
+	}
 	if os.Geteuid() == 0 {
 		keys, err = b.getSystemSSH_HostKeys()
 		if err != nil || len(keys) > 0 {
@@ -46,21 +108,88 @@ func (b *LocalBackend) GetSSH_HostKeys() (keys []ssh.Signer, err error) {
 	return b.getTailscaleSSH_HostKeys()
 }
 
-func (b *LocalBackend) getTailscaleSSH_HostKeys() (keys []ssh.Signer, err error) {
+// getConfiguredSSH_HostKeys returns a host key of each of types, in
+// order. When running as root, it uses the system's OpenSSH key of a
+// type if there is one, whatever its size. Otherwise it uses our own,
+// generating it if needed; a key we generated earlier is kept even if
+// its size is no longer the one asked for, so that clients' known
+// hosts stay valid. Keys of another size than asked for are logged.
+func (b *LocalBackend) getConfiguredSSH_HostKeys(types []hostKeyType) (keys []ssh.Signer, err error) {
+	var keyDir string
+	for _, typ := range types {
+		if os.Geteuid() == 0 {
+			signer, err := getSystemSSH_HostKey(typ.name)
+			if err != nil {
+				return nil, err
+			}
+			if signer != nil {
+				b.checkHostKeySize(signer, typ, "/etc/ssh")
+				keys = append(keys, signer)
+				continue
+			}
+		}
+		if keyDir == "" {
+			if keyDir, err = b.tailscaleSSHKeyDir(); err != nil {
+				return nil, err
+			}
+		}
+		signer, err := b.tailscaleSSH_HostKey(keyDir, typ)
+		if err != nil {
+			return nil, err
+		}
+		b.checkHostKeySize(signer, typ, keyDir)
+		keys = append(keys, signer)
+	}
+	return keys, nil
+}
+
+// checkHostKeySize logs a warning if the host key signer, from dir,
+// isn't of the size typ asks for, as when TS_SSH_HOST_KEY_TYPES
+// changed after it was generated. The key is still used; to get one
+// of the new size, it has to be removed.
+func (b *LocalBackend) checkHostKeySize(signer ssh.Signer, typ hostKeyType, dir string) {
+	if got := hostKeyBits(signer.PublicKey()); got != typ.bits {
+		b.logf("ssh: warning: %s host key in %s is %d bits, not the %d configured by TS_SSH_HOST_KEY_TYPES; remove it to use a new key of that size", typ.name, dir, got, typ.bits)
+	}
+}
+
+// hostKeyBits returns the RSA modulus or ECDSA curve size of pub, as in
+// hostKeyType.bits, or 0 for other keys.
+func hostKeyBits(pub ssh.PublicKey) int {
+	cpk, ok := pub.(ssh.CryptoPublicKey)
+	if !ok {
+		return 0
+	}
+	switch k := cpk.CryptoPublicKey().(type) {
+	case *rsa.PublicKey:
+		return k.N.BitLen()
+	case *ecdsa.PublicKey:
+		return k.Curve.Params().BitSize
+	}
+	return 0
+}
+
+// tailscaleSSHKeyDir returns the directory of the host keys we
+// generate, creating it if needed.
+func (b *LocalBackend) tailscaleSSHKeyDir() (string, error) {
 	root := b.TailscaleVarRoot()
 	if root == "" {
-		return nil, errors.New("no var root for ssh keys")
+		return "", errors.New("no var root for ssh keys")
 	}
 	keyDir := filepath.Join(root, "ssh")
 	if err := os.MkdirAll(keyDir, 0700); err != nil {
+		return "", err
+	}
+	return keyDir, nil
+}
+
+func (b *LocalBackend) getTailscaleSSH_HostKeys() (keys []ssh.Signer, err error) {
+	keyDir, err := b.tailscaleSSHKeyDir()
+	if err != nil {
 		return nil, err
 	}
 	for _, typ := range keyTypes {
-		hostKey, err := b.hostKeyFileOrCreate(keyDir, typ)
-		if err != nil {
-			return nil, err
-		}
-		signer, err := ssh.ParsePrivateKey(hostKey)
+		signer, err := b.tailscaleSSH_HostKey(keyDir, typ)
 		if err != nil {
 			return nil, err
 		}
@@ -69,13 +198,23 @@ func (b *LocalBackend) getTailscaleSSH_HostKeys() (keys []ssh.Signer, err error)
 	return keys, nil
 }
 
+// tailscaleSSH_HostKey returns our host key of type typ in keyDir,
+// generating it if needed.
+func (b *LocalBackend) tailscaleSSH_HostKey(keyDir string, typ hostKeyType) (ssh.Signer, error) {
+	hostKey, err := b.hostKeyFileOrCreate(keyDir, typ)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.ParsePrivateKey(hostKey)
+}
+
 var keyGenMu sync.Mutex
 
-func (b *LocalBackend) hostKeyFileOrCreate(keyDir, typ string) ([]byte, error) {
+func (b *LocalBackend) hostKeyFileOrCreate(keyDir string, typ hostKeyType) ([]byte, error) {
 	keyGenMu.Lock()
 	defer keyGenMu.Unlock()
 
-	path := filepath.Join(keyDir, "ssh_host_"+typ+"_key")
+	path := filepath.Join(keyDir, "ssh_host_"+typ.name+"_key")
 	v, err := ioutil.ReadFile(path)
 	if err == nil {
 		return v, nil
@@ -84,23 +223,26 @@ func (b *LocalBackend) hostKeyFileOrCreate(keyDir, typ string) ([]byte, error) {
 		return nil, err
 	}
 	var priv any
-	switch typ {
+	switch typ.name {
 	default:
-		return nil, fmt.Errorf("unsupported key type %q", typ)
+		return nil, fmt.Errorf("unsupported key type %q", typ.name)
 	case "ed25519":
 		_, priv, err = ed25519.GenerateKey(rand.Reader)
 	case "ecdsa":
-		// curve is arbitrary. We pick whatever will at
-		// least pacify clients as the actual encryption
-		// doesn't matter: it's all over WireGuard anyway.
+		// The curve is arbitrary unless configured. We pick
+		// whatever will at least pacify clients as the actual
+		// encryption doesn't matter: it's all over WireGuard anyway.
 		curve := elliptic.P256()
+		switch typ.bits {
+		case 384:
+			curve = elliptic.P384()
+		case 521:
+			curve = elliptic.P521()
+		}
 		priv, err = ecdsa.GenerateKey(curve, rand.Reader)
 	case "rsa":
-		// keySize is arbitrary. We pick whatever will at
-		// least pacify clients as the actual encryption
-		// doesn't matter: it's all over WireGuard anyway.
-		const keySize = 2048
-		priv, err = rsa.GenerateKey(rand.Reader, keySize)
+		// The key size is arbitrary unless configured, as above.
+		priv, err = rsa.GenerateKey(rand.Reader, typ.bits)
 	}
 	if err != nil {
 		return nil, err
@@ -117,22 +259,30 @@ func (b *LocalBackend) hostKeyFileOrCreate(keyDir, typ string) ([]byte, error) {
 func (b *LocalBackend) getSystemSSH_HostKeys() (ret []ssh.Signer, err error) {
 	// TODO(bradfitz): cache this?
 	for _, typ := range keyTypes {
-		hostKey, err := ioutil.ReadFile("/etc/ssh/ssh_host_" + typ + "_key")
-		if os.IsNotExist(err) {
-			continue
-		}
+		signer, err := getSystemSSH_HostKey(typ.name)
 		if err != nil {
 			return nil, err
 		}
-		signer, err := ssh.ParsePrivateKey(hostKey)
-		if err != nil {
-			return nil, err
+		if signer != nil {
+			ret = append(ret, signer)
 		}
-		ret = append(ret, signer)
 	}
 	return ret, nil
 }
 
+// getSystemSSH_HostKey returns the system's OpenSSH host key of type
+// name, or nil if it has none.
+func getSystemSSH_HostKey(name string) (ssh.Signer, error) {
+	hostKey, err := ioutil.ReadFile("/etc/ssh/ssh_host_" + name + "_key")
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ssh.ParsePrivateKey(hostKey)
+}
+
 func (b *LocalBackend) getSSHHostKeyPublicStrings() (ret []string) {
 	signers, _ := b.GetSSH_HostKeys()
 	for _, signer := range signers {
@@ -8,8 +8,14 @@
 package ipnlocal
 
 import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"fmt"
 	"reflect"
+	"strings"
 	"testing"
+
+	"tailscale.com/tempfork/golang-x-crypto/ssh"
 )
 
 func TestSSHKeyGen(t *testing.T) {
@@ -40,3 +46,81 @@ func TestSSHKeyGen(t *testing.T) {
 		t.Errorf("got different keys on second call")
 	}
 }
+
+func TestParseHostKeyTypes(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []hostKeyType
+		wantErr string
+	}{
+		{in: "ed25519", want: []hostKeyType{{"ed25519", 0}}},
+		{in: "ed25519, ecdsa-p256,rsa-4096", want: []hostKeyType{{"ed25519", 0}, {"ecdsa", 256}, {"rsa", 4096}}},
+		{in: "rsa,ecdsa", want: []hostKeyType{{"rsa", 2048}, {"ecdsa", 256}}},
+		{in: "ecdsa-p521", want: []hostKeyType{{"ecdsa", 521}}},
+		{in: "dsa", wantErr: "unknown host key type"},
+		{in: "ecdsa-p224", wantErr: "unknown host key type"},
+		{in: "rsa-1024", wantErr: "invalid RSA key size"},
+		{in: "rsa-2048,rsa-4096", wantErr: "more than one rsa"},
+		{in: "", wantErr: "unknown host key type"},
+	}
+	for _, tt := range tests {
+		got, err := parseHostKeyTypes(tt.in)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parseHostKeyTypes(%q) error = %v; want %q", tt.in, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseHostKeyTypes(%q) = %v, %v; want %v", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestSSHKeyGenSizes(t *testing.T) {
+	dir := t.TempDir()
+	lb := &LocalBackend{varRoot: dir}
+	keyDir, err := lb.tailscaleSSHKeyDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := lb.tailscaleSSH_HostKey(keyDir, hostKeyType{"ecdsa", 384})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := signer.PublicKey().Type(); got != "ecdsa-sha2-nistp384" {
+		t.Errorf("ecdsa key type = %q; want ecdsa-sha2-nistp384", got)
+	}
+	signer, err = lb.tailscaleSSH_HostKey(keyDir, hostKeyType{"rsa", 3072})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := signer.PublicKey().(ssh.CryptoPublicKey).CryptoPublicKey().(*rsa.PublicKey)
+	if got := pub.N.BitLen(); got != 3072 {
+		t.Errorf("RSA key size = %d; want 3072", got)
+	}
+
+	// A key generated earlier is kept whatever size is asked for.
+	signer, err = lb.tailscaleSSH_HostKey(keyDir, hostKeyType{"ecdsa", 521})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := signer.PublicKey().(ssh.CryptoPublicKey).CryptoPublicKey().(*ecdsa.PublicKey).Curve.Params().BitSize; got != 384 {
+		t.Errorf("ecdsa curve size = %d; want the existing key's 384", got)
+	}
+
+	// ... but it's warned about.
+	var logs []string
+	lb.logf = func(format string, args ...any) {
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}
+	lb.checkHostKeySize(signer, hostKeyType{"ecdsa", 521}, keyDir)
+	if len(logs) != 1 || !strings.Contains(logs[0], "384 bits, not the 521") {
+		t.Errorf("logs = %q; want a warning of the size mismatch", logs)
+	}
+	logs = nil
+	lb.checkHostKeySize(signer, hostKeyType{"ecdsa", 384}, keyDir)
+	if len(logs) != 0 {
+		t.Errorf("logs = %q; want none for a key of the configured size", logs)
+	}
+}
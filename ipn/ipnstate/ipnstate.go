@@ -531,6 +531,159 @@ func (pr *PingResult) ToPingResponse(pingType string) *tailcfg.PingResponse {
 	}
 }
 
+// SSHServerStatus is the state of the Tailscale SSH server, as
+// reported by "tailscale ssh-server status".
+type SSHServerStatus struct {
+	// Enabled is whether the SSH server is enabled by prefs and
+	// permitted to run.
+	Enabled bool
+
+	// Supported is whether this tailscaled has an SSH server.
+	// The fields below are only set if so.
+	Supported bool
+
+	// PolicySource is where the SSH policy comes from, such as
+	// "tailnet", or empty if there's no policy.
+	PolicySource string `json:",omitempty"`
+
+	// PolicyRules is the number of rules in the SSH policy.
+	PolicyRules int
+
+	// HostKeys are the server's host keys, and any host certificates
+	// for them, as "type fingerprint".
+	// They're only reported when there's a policy, as the first
+	// look generates them.
+	HostKeys []string `json:",omitempty"`
+
+	// HostKeysErr is the error getting the host keys, if any.
+	HostKeysErr string `json:",omitempty"`
+
+	// Recording describes whether and where sessions are recorded.
+	Recording string
+
+	// Sessions are the active sessions, oldest first.
+	Sessions []*SSHSessionStatus
+}
+
+// SSHSessionStatus is an active Tailscale SSH session.
+type SSHSessionStatus struct {
+	// ID is the session's ID, as also logged and sent to control.
+	ID string
+
+	Started   time.Time
+	Src       netaddr.IPPort // the Tailscale IP and port of the client
+	LoginName string         // of the user connecting
+	LocalUser string         // the local user the session runs as
+}
+
+// SSHPolicyCheck is the result of evaluating the SSH policy for a
+// hypothetical connection, as reported by "tailscale ssh-server check".
+type SSHPolicyCheck struct {
+	// Rule is the 1-based index of the policy rule that matched,
+	// or zero if none did.
+	Rule int
+
+	// Action is the matched rule's action, or nil if no rule matched.
+	// HoldAndDelegate URLs aren't followed.
+	Action *tailcfg.SSHAction `json:",omitempty"`
+
+	// LocalUser is the local user the connection would run as.
+	LocalUser string `json:",omitempty"`
+
+	// LoginName is the login of the user of the source node, if known.
+	LoginName string `json:",omitempty"`
+
+	// Error is why the connection would be rejected, if it would.
+	Error string `json:",omitempty"`
+}
+
+// SSHRecording is a Tailscale SSH session recording on the node's
+// disk, as listed by "tailscale ssh-server recordings".
+type SSHRecording struct {
+	SessionID  string
+	Start      time.Time
+	Size       int64 // of the file, as stored
+	Compressed bool  `json:",omitempty"` // whether it's gzipped
+
+	// The following are from the recording's header, if it has them.
+	LoginName string     `json:",omitempty"` // of the user who connected
+	SSHUser   string     `json:",omitempty"` // as requested by the client
+	LocalUser string     `json:",omitempty"` // the session ran as
+	SrcNodeIP netaddr.IP // the client's Tailscale IP
+	Command   string     `json:",omitempty"` // run by the session, if not a shell
+}
+
+// SSHRecordingFilter selects Tailscale SSH session recordings. Its
+// zero fields match all of them.
+type SSHRecordingFilter struct {
+	SessionID string
+	Since     time.Time // recordings started at or after
+	Until     time.Time // recordings started before
+	User      string    // login name or local user of the session
+}
+
+// SSHEventType is the type of an SSHEvent.
+type SSHEventType string
+
+const (
+	SSHEventAuthAttempt  SSHEventType = "auth-attempt"  // client offered credentials
+	SSHEventReject       SSHEventType = "reject"        // connection attempt rejected
+	SSHEventAccept       SSHEventType = "accept"        // connection attempt accepted
+	SSHEventSessionStart SSHEventType = "session-start" // accepted session started
+	SSHEventSessionEnd   SSHEventType = "session-end"   // session ended
+	SSHEventExec         SSHEventType = "exec"          // session's shell, command or subsystem started
+	SSHEventForward      SSHEventType = "forward"       // session's port forwarding opened
+	SSHEventForwardEnd   SSHEventType = "forward-end"   // session's forwarded TCP connection closed
+	SSHEventUpload       SSHEventType = "upload"        // file copied to the node
+	SSHEventDownload     SSHEventType = "download"      // file copied from the node
+)
+
+// SSHEvent is an event of the Tailscale SSH server, as published to
+// subscribers within tailscaled and tailed by "tailscale ssh-server
+// events". Each is also logged as a structured "SSHEvent" log
+// record, for auditing.
+type SSHEvent struct {
+	Time      time.Time
+	Type      SSHEventType
+	Src       netaddr.IPPort // the Tailscale IP and port of the client
+	SSHUser   string         // the requested SSH user
+	LoginName string         `json:",omitempty"` // of the user connecting, if known
+	LocalUser string         `json:",omitempty"` // for accepts, sessions, forwards and transfers
+	SessionID string         `json:",omitempty"` // for accepts, sessions, forwards and transfers
+	Reason    string         `json:",omitempty"` // for rejections
+
+	// Rule is the 1-based number of the SSH policy rule that
+	// accepted the connection, for accepts, sessions, execs,
+	// forwards and transfers.
+	Rule int `json:",omitempty"`
+
+	// PubKey is the fingerprint of the public key offered, for
+	// auth attempts, or empty for "none" auth.
+	PubKey string `json:",omitempty"`
+
+	// Command and Subsystem are what was started, for execs: the
+	// command run (the client's, or one forced by policy), or the
+	// subsystem served. Both are empty for a shell.
+	Command   string `json:",omitempty"`
+	Subsystem string `json:",omitempty"`
+
+	// ForwardTo is the host:port or Unix socket path forwarded to,
+	// for forwards and forward ends.
+	ForwardTo string `json:",omitempty"`
+
+	// BytesSent and BytesReceived are how many bytes were sent to,
+	// and received from, ForwardTo, and Duration how long the
+	// connection was open, for forward ends.
+	BytesSent     int64         `json:",omitempty"`
+	BytesReceived int64         `json:",omitempty"`
+	Duration      time.Duration `json:",omitempty"`
+
+	// Path and Size are the local path and size in bytes of the file
+	// copied, for uploads and downloads.
+	Path string `json:",omitempty"`
+	Size int64  `json:",omitempty"`
+}
+
 func SortPeers(peers []*PeerStatus) {
 	sort.Slice(peers, func(i, j int) bool { return sortKey(peers[i]) < sortKey(peers[j]) })
 }
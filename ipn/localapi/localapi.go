@@ -7,6 +7,7 @@
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
@@ -29,6 +30,7 @@
 	"tailscale.com/ipn/ipnlocal"
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/net/netutil"
+	"tailscale.com/net/ping"
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/logger"
 	"tailscale.com/util/clientmetric"
@@ -107,6 +109,18 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		h.serveProfile(w, r)
 	case "/localapi/v0/status":
 		h.serveStatus(w, r)
+	case "/localapi/v0/ssh-server":
+		h.serveSSHServer(w, r)
+	case "/localapi/v0/ssh-server-events":
+		h.serveSSHServerEvents(w, r)
+	case "/localapi/v0/ssh-server-terminate":
+		h.serveSSHServerTerminate(w, r)
+	case "/localapi/v0/ssh-server-check":
+		h.serveSSHServerCheck(w, r)
+	case "/localapi/v0/ssh-server-recordings":
+		h.serveSSHServerRecordings(w, r)
+	case "/localapi/v0/ssh-server-recording":
+		h.serveSSHServerRecording(w, r)
 	case "/localapi/v0/logout":
 		h.serveLogout(w, r)
 	case "/localapi/v0/prefs":
@@ -195,8 +209,50 @@ func (h *Handler) serveBugReport(w http.ResponseWriter, r *http.Request) {
 	if note := r.FormValue("note"); len(note) > 0 {
 		h.logf("user bugreport note: %s", note)
 	}
+	h.logBugReportSSH(logMarker)
 	w.Header().Set("Content-Type", "text/plain")
 	fmt.Fprintln(w, logMarker)
+	go h.logBugReportICMP(logMarker, defBool(r.FormValue("pingref"), false))
+}
+
+// logBugReportSSH logs the state of the SSH server, if any, tagged
+// with logMarker.
+func (h *Handler) logBugReportSSH(logMarker string) {
+	s := h.b.SSHBugReport()
+	if s == "" {
+		return
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(s, "\n"), "\n") {
+		h.logf("user bugreport %s: ssh: %s", logMarker, line)
+	}
+}
+
+// logBugReportICMP logs a summary of the ICMP reachability of the
+// local network's gateways and our home DERP region, and if pingRef,
+// the ping.ReferenceTargets, tagged with logMarker, so bug reports
+// include a baseline of what's reachable. The reference targets are
+// third parties' hosts, so they're only pinged when the user asks.
+func (h *Handler) logBugReportICMP(logMarker string, pingRef bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var derp []ping.DiagTarget
+	if dm := h.b.DERPMap(); dm != nil {
+		if st := h.b.StatusWithoutPeers(); st.Self != nil && st.Self.Relay != "" {
+			for _, r := range dm.Regions {
+				if r.RegionCode == st.Self.Relay {
+					derp = ping.DERPTargets(r)
+				}
+			}
+		}
+	}
+	targets := derp
+	if pingRef {
+		targets = append(targets, ping.ReferenceTargets...)
+	}
+	d := ping.Diagnose(ctx, nil, targets, 0)
+	for _, line := range strings.Split(strings.TrimSuffix(d.String(), "\n"), "\n") {
+		h.logf("user bugreport %s: %s", logMarker, line)
+	}
 }
 
 func (h *Handler) serveWhoIs(w http.ResponseWriter, r *http.Request) {
@@ -341,6 +397,163 @@ func (h *Handler) serveStatus(w http.ResponseWriter, r *http.Request) {
 	e.Encode(st)
 }
 
+func (h *Handler) serveSSHServer(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "ssh-server access denied", http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.SetIndent("", "\t")
+	e.Encode(h.b.SSHServerStatus())
+}
+
+// serveSSHServerEvents streams the SSH server's events as JSON, one
+// per line, until the client goes away. If the "recent" parameter is
+// true, it starts with the recent ones.
+func (h *Handler) serveSSHServerEvents(w http.ResponseWriter, r *http.Request) {
+	// The events say who logged in where, so treat them like
+	// the audit log they are.
+	if !h.PermitWrite {
+		http.Error(w, "ssh-server-events access denied", http.StatusForbidden)
+		return
+	}
+	if !h.b.SSHServerStatus().Supported {
+		http.Error(w, "no SSH server", http.StatusNotImplemented)
+		return
+	}
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	f.Flush()
+	e := json.NewEncoder(w)
+	h.b.WatchSSHEvents(r.Context(), defBool(r.FormValue("recent"), false), func(ev ipnstate.SSHEvent) {
+		e.Encode(ev)
+		f.Flush()
+	})
+}
+
+// serveSSHServerTerminate ends the active SSH session whose ID is the
+// "id" parameter, telling its user the "message" parameter, if any.
+func (h *Handler) serveSSHServerTerminate(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "ssh-server-terminate access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "want POST", 400)
+		return
+	}
+	id := r.FormValue("id")
+	if id == "" {
+		http.Error(w, "missing id", 400)
+		return
+	}
+	if err := h.b.TerminateSSHSession(id, r.FormValue("message")); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveSSHServerCheck reports which SSH policy rule would match a
+// connection from the "src" IP as the "user" parameter, offering the
+// "pubkey" parameter (in authorized_keys format) if set, without
+// making one.
+func (h *Handler) serveSSHServerCheck(w http.ResponseWriter, r *http.Request) {
+	// The result reveals the policy, so require write access like
+	// the other endpoints that do.
+	if !h.PermitWrite {
+		http.Error(w, "ssh-server-check access denied", http.StatusForbidden)
+		return
+	}
+	user := r.FormValue("user")
+	if user == "" {
+		http.Error(w, "missing user", 400)
+		return
+	}
+	src, err := netaddr.ParseIP(r.FormValue("src"))
+	if err != nil {
+		http.Error(w, "invalid src: "+err.Error(), 400)
+		return
+	}
+	res, err := h.b.CheckSSHPolicy(user, src, r.FormValue("pubkey"))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.SetIndent("", "\t")
+	e.Encode(res)
+}
+
+// serveSSHServerRecordings lists the SSH session recordings on the
+// node's disk, optionally only those of the "session" ID, started in
+// the "since" and "until" RFC 3339 times, or of the "user" login name
+// or local user.
+func (h *Handler) serveSSHServerRecordings(w http.ResponseWriter, r *http.Request) {
+	// Recordings are audit data.
+	if !h.PermitWrite {
+		http.Error(w, "ssh-server-recordings access denied", http.StatusForbidden)
+		return
+	}
+	f := ipnstate.SSHRecordingFilter{
+		SessionID: r.FormValue("session"),
+		User:      r.FormValue("user"),
+	}
+	for _, tv := range []struct {
+		name string
+		t    *time.Time
+	}{{"since", &f.Since}, {"until", &f.Until}} {
+		v := r.FormValue(tv.name)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(w, "invalid "+tv.name+": "+err.Error(), 400)
+			return
+		}
+		*tv.t = t
+	}
+	recs, err := h.b.SSHRecordings(f)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.SetIndent("", "\t")
+	e.Encode(recs)
+}
+
+// serveSSHServerRecording streams the recording of the SSH session
+// whose ID is the "id" parameter, in asciinema's cast format.
+func (h *Handler) serveSSHServerRecording(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "ssh-server-recording access denied", http.StatusForbidden)
+		return
+	}
+	id := r.FormValue("id")
+	if id == "" {
+		http.Error(w, "missing id", 400)
+		return
+	}
+	rc, err := h.b.OpenSSHRecording(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	defer rc.Close()
+	w.Header().Set("Content-Type", "application/x-asciicast")
+	io.Copy(w, rc)
+}
+
 func (h *Handler) serveLogout(w http.ResponseWriter, r *http.Request) {
 	if !h.PermitWrite {
 		http.Error(w, "logout access denied", http.StatusForbidden)
@@ -31,6 +31,31 @@ type Backoff struct {
 	// LogLongerThan sets the minimum time of a single backoff interval
 	// before we mention it in the log.
 	LogLongerThan time.Duration
+
+	// FullJitter, if true, makes each delay a uniformly random
+	// duration between zero and the capped backoff ("full jitter"),
+	// rather than between 0.5x and 1.5x of it. It spreads out the
+	// retries of many clients that started failing at once, such as
+	// nodes all polling the same endpoint.
+	FullJitter bool
+
+	// MaxElapsed, if non-zero, is how long BackOff may keep backing
+	// off from the first of a run of consecutive failures. Once it's
+	// passed, BackOff returns without sleeping and Exhausted
+	// reports true until the next success.
+	MaxElapsed time.Duration
+
+	// OnAttempt, if non-nil, is called by BackOff for each failure
+	// with the number of consecutive failures so far, the error,
+	// and how long BackOff is about to sleep (zero if it's
+	// exhausted).
+	OnAttempt func(attempt int, err error, delay time.Duration)
+
+	// timeNow is the function that acts like time.Now, or nil for
+	// time.Now. It's for use in unit tests.
+	timeNow func() time.Time
+
+	start time.Time // time of the first of the n consecutive failures
 }
 
 // NewBackoff returns a new Backoff timer with the provided name (for logging), logger,
@@ -45,6 +70,13 @@ func NewBackoff(name string, logf logger.Logf, maxBackoff time.Duration) *Backof
 	}
 }
 
+func (b *Backoff) now() time.Time {
+	if b.timeNow != nil {
+		return b.timeNow()
+	}
+	return time.Now()
+}
+
 // Backoff sleeps an increasing amount of time if err is non-nil.
 // and the context is not a
 // It resets the backoff schedule once err is nil.
@@ -60,15 +92,37 @@ func (b *Backoff) BackOff(ctx context.Context, err error) {
 	}
 
 	b.n++
+	if b.n == 1 {
+		b.start = b.now()
+	}
 	// n^2 backoff timer is a little smoother than the
 	// common choice of 2^n.
 	d := time.Duration(b.n*b.n) * 10 * time.Millisecond
 	if d > b.maxBackoff {
 		d = b.maxBackoff
 	}
-	// Randomize the delay between 0.5-1.5 x msec, in order
-	// to prevent accidental "thundering herd" problems.
-	d = time.Duration(float64(d) * (rand.Float64() + 0.5))
+	if b.FullJitter {
+		d = time.Duration(rand.Int63n(int64(d) + 1))
+	} else {
+		// Randomize the delay between 0.5-1.5 x msec, in order
+		// to prevent accidental "thundering herd" problems.
+		d = time.Duration(float64(d) * (rand.Float64() + 0.5))
+	}
+	if b.MaxElapsed > 0 {
+		left := b.MaxElapsed - b.now().Sub(b.start)
+		if left < 0 {
+			left = 0
+		}
+		if d > left {
+			d = left
+		}
+	}
+	if b.OnAttempt != nil {
+		b.OnAttempt(b.n, err, d)
+	}
+	if d <= 0 {
+		return
+	}
 
 	if d >= b.LogLongerThan {
 		b.logf("%s: [v1] backoff: %d msec", b.name, d.Milliseconds())
@@ -80,3 +134,9 @@ func (b *Backoff) BackOff(ctx context.Context, err error) {
 	case <-t.C:
 	}
 }
+
+// Exhausted reports whether MaxElapsed is set and has passed since the
+// first of the current run of consecutive failures.
+func (b *Backoff) Exhausted() bool {
+	return b.MaxElapsed > 0 && b.n > 0 && b.now().Sub(b.start) >= b.MaxElapsed
+}
@@ -0,0 +1,96 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package backoff
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"tailscale.com/types/logger"
+)
+
+// newTestBackoff returns a Backoff that doesn't sleep, recording the
+// delays it would have slept instead, with a clock that only moves
+// when advanced.
+func newTestBackoff(maxBackoff time.Duration) (b *Backoff, delays *[]time.Duration, now *time.Time) {
+	b = NewBackoff("test", logger.Discard, maxBackoff)
+	delays = new([]time.Duration)
+	now = new(time.Time)
+	*now = time.Unix(1000, 0)
+	b.timeNow = func() time.Time { return *now }
+	b.NewTimer = func(d time.Duration) *time.Timer {
+		*delays = append(*delays, d)
+		return time.NewTimer(0)
+	}
+	return b, delays, now
+}
+
+func TestBackoffFullJitter(t *testing.T) {
+	b, delays, _ := newTestBackoff(time.Second)
+	b.FullJitter = true
+	ctx := context.Background()
+	err := errors.New("fail")
+	for i := 0; i < 100; i++ {
+		b.BackOff(ctx, err)
+	}
+	for i, d := range *delays {
+		n := i + 1
+		max := time.Duration(n*n) * 10 * time.Millisecond
+		if max > time.Second {
+			max = time.Second
+		}
+		if d < 0 || d > max {
+			t.Errorf("delay %d = %v; want in [0, %v]", n, d, max)
+		}
+	}
+}
+
+func TestBackoffMaxElapsed(t *testing.T) {
+	b, delays, now := newTestBackoff(time.Second)
+	b.MaxElapsed = 10 * time.Second
+	var attempts []int
+	b.OnAttempt = func(attempt int, err error, d time.Duration) {
+		attempts = append(attempts, attempt)
+		if d > b.MaxElapsed {
+			t.Errorf("attempt %d: delay %v exceeds MaxElapsed", attempt, d)
+		}
+	}
+	ctx := context.Background()
+	err := errors.New("fail")
+
+	b.BackOff(ctx, err)
+	if b.Exhausted() {
+		t.Fatal("exhausted after one failure")
+	}
+	*now = now.Add(9 * time.Second)
+	b.BackOff(ctx, err)
+	if b.Exhausted() {
+		t.Fatal("exhausted before MaxElapsed")
+	}
+	*now = now.Add(time.Second)
+	if !b.Exhausted() {
+		t.Fatal("not exhausted after MaxElapsed")
+	}
+	nDelays := len(*delays)
+	b.BackOff(ctx, err)
+	if len(*delays) != nDelays {
+		t.Errorf("slept %v once exhausted", (*delays)[nDelays:])
+	}
+	if want := []int{1, 2, 3}; len(attempts) != len(want) || attempts[2] != 3 {
+		t.Errorf("attempts = %v; want %v", attempts, want)
+	}
+
+	// A success resets the budget.
+	b.BackOff(ctx, nil)
+	if b.Exhausted() {
+		t.Fatal("exhausted after success")
+	}
+	b.BackOff(ctx, err)
+	if b.Exhausted() {
+		t.Fatal("exhausted right after new failure")
+	}
+}
@@ -0,0 +1,294 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ping
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"sync"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+// Method is a way of sending pings.
+type Method uint8
+
+const (
+	MethodNone         Method = iota // no working method
+	MethodICMPDatagram               // unprivileged ICMP datagram socket
+	MethodICMPRaw                    // raw ICMP socket (root or CAP_NET_RAW)
+	MethodExec                       // the system's ping command
+	MethodTCP                        // a TCP connection attempt; not ICMP
+	MethodICMPAPI                    // the OS's ICMP API (Windows only)
+)
+
+func (m Method) String() string {
+	switch m {
+	case MethodICMPDatagram:
+		return "icmp-datagram"
+	case MethodICMPRaw:
+		return "icmp-raw"
+	case MethodExec:
+		return "exec"
+	case MethodTCP:
+		return "tcp"
+	case MethodICMPAPI:
+		return "icmp-api"
+	}
+	return "none"
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (m Method) MarshalText() ([]byte, error) { return []byte(m.String()), nil }
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (m *Method) UnmarshalText(b []byte) error {
+	for v := MethodNone; v <= MethodICMPAPI; v++ {
+		if v.String() == string(b) {
+			*m = v
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown ping method %q", b)
+}
+
+// FamilyCaps are the ways this process is able to send pings to one
+// address family.
+type FamilyCaps struct {
+	// Datagram is whether an unprivileged ICMP datagram socket
+	// could be opened. On Linux this is governed by the
+	// net.ipv4.ping_group_range sysctl.
+	Datagram bool
+
+	// Raw is whether a raw ICMP socket could be opened, which
+	// requires root or CAP_NET_RAW.
+	Raw bool
+
+	// API is whether the OS has an ICMP API that needs no
+	// privileges, like IcmpSendEcho2 on Windows.
+	API bool
+}
+
+// Capabilities are the ways this process is able to send pings.
+type Capabilities struct {
+	IPv4 FamilyCaps
+	IPv6 FamilyCaps
+
+	// PingBinary is the path of the ping command used by Exec,
+	// or empty if it wasn't found. If a SetCommandRunner func runs the
+	// command, it's the command's name.
+	PingBinary string
+
+	// AmbientCapsRaw is whether the ping command is run with
+	// CAP_NET_RAW as an ambient capability, because this process
+	// isn't root but has that capability.
+	AmbientCapsRaw bool
+}
+
+// Selection is the result of probing this process's capabilities:
+// which Method Ping uses for each address family, and why.
+type Selection struct {
+	IPv4 Method
+	IPv6 Method
+	Caps Capabilities
+}
+
+func (s Selection) String() string {
+	return fmt.Sprintf("ipv4=%v ipv6=%v", s.IPv4, s.IPv6)
+}
+
+// MethodFor returns the Method used for pings to ip.
+func (s Selection) MethodFor(ip netaddr.IP) Method {
+	if ip.Is4() || ip.Is4in6() {
+		return s.IPv4
+	}
+	return s.IPv6
+}
+
+var (
+	selOnce sync.Once
+	sel     Selection
+)
+
+// Selected returns the Methods Ping uses for each address family.
+//
+// The process's capabilities are probed the first time it's called,
+// and the result is cached for the life of the process.
+func Selected() Selection {
+	selOnce.Do(func() {
+		sel = probeCapabilities()
+		logSelection(sel)
+	})
+	return sel
+}
+
+// canListen reports whether an ICMP socket of the kind used by m can
+// be opened for the address family of ip.
+func canListen(m Method, ip netaddr.IP) bool {
+	c, err := listenICMP(m, ip, netaddr.IP{})
+	if err != nil {
+		return false
+	}
+	c.Close()
+	return true
+}
+
+func probeCapabilities() Selection {
+	var s Selection
+	v4, v6 := netaddr.IPv4(127, 0, 0, 1), netaddr.IPv6Unspecified()
+	s.Caps.IPv4 = FamilyCaps{
+		Datagram: canListen(MethodICMPDatagram, v4),
+		Raw:      canListen(MethodICMPRaw, v4),
+		API:      haveICMPAPI(v4),
+	}
+	s.Caps.IPv6 = FamilyCaps{
+		Datagram: canListen(MethodICMPDatagram, v6),
+		Raw:      canListen(MethodICMPRaw, v6),
+		API:      haveICMPAPI(v6),
+	}
+	name, _ := pingArgs(runtime.GOOS, v4, nil)
+	if getCommandRunner() != nil {
+		s.Caps.PingBinary = name
+	} else if p, err := exec.LookPath(name); err == nil {
+		s.Caps.PingBinary = p
+	}
+	s.Caps.AmbientCapsRaw = wantAmbientCapsRaw()
+	s.IPv4 = chooseMethod(s.Caps.IPv4, s.Caps.PingBinary != "")
+	s.IPv6 = chooseMethod(s.Caps.IPv6, s.Caps.PingBinary != "")
+	return s
+}
+
+// chooseMethod returns the preferred Method given one address
+// family's capabilities and whether the ping command exists.
+//
+// Datagram sockets are preferred over raw ones because the kernel
+// only delivers our own replies to them, and both are preferred over
+// running a child process per probe. If none of those are possible,
+// as in minimal containers without a ping command, it's MethodTCP,
+// which only probes that allow it use. An OS ICMP API is preferred over all of them, since it's how
+// the OS intends pings to be sent.
+func chooseMethod(fc FamilyCaps, haveBinary bool) Method {
+	switch {
+	case fc.API:
+		return MethodICMPAPI
+	case fc.Datagram:
+		return MethodICMPDatagram
+	case fc.Raw:
+		return MethodICMPRaw
+	case haveBinary:
+		return MethodExec
+	}
+	return MethodTCP
+}
+
+var errNoMethod = errors.New("ping: no usable ping method")
+
+// CapabilityError describes why this process can't send ICMP pings
+// for one or both address families, and so can only send TCP probes,
+// for callers that allow them (see Options.AllowTCP). It's meant to be
+// shown to users, so they can fix their setup.
+type CapabilityError struct {
+	IPv4 bool // whether IPv4 pings are unavailable
+	IPv6 bool // whether IPv6 pings are unavailable
+	Caps Capabilities
+}
+
+func (e *CapabilityError) Error() string {
+	fam := "IPv4"
+	switch {
+	case e.IPv4 && e.IPv6:
+		fam = "IPv4 or IPv6"
+	case e.IPv6:
+		fam = "IPv6"
+	}
+	var fix string
+	switch runtime.GOOS {
+	case "linux", "android":
+		fix = "; add the process's group to the net.ipv4.ping_group_range sysctl, grant it CAP_NET_RAW, or install ping"
+	case "windows":
+		// Windows always has ping.exe.
+	default:
+		fix = "; run it as root or install ping"
+	}
+	return fmt.Sprintf("ping: can't send %s pings: no ICMP socket permitted and no ping command found%s", fam, fix)
+}
+
+// Err returns a *CapabilityError if s can only send TCP probes for
+// either address family, or else nil.
+func (s Selection) Err() error {
+	if s.IPv4 != MethodTCP && s.IPv6 != MethodTCP {
+		return nil
+	}
+	return &CapabilityError{
+		IPv4: s.IPv4 == MethodTCP,
+		IPv6: s.IPv6 == MethodTCP,
+		Caps: s.Caps,
+	}
+}
+
+// Ping pings ip once using the best Method available to this process
+// (see Selected) and reports the round-trip time. If the process can't
+// send pings to ip's address family, it fails with a *CapabilityError.
+//
+// The class is only used for metrics.
+func Ping(ctx context.Context, class Class, ip netaddr.IP) (time.Duration, error) {
+	return PingWith(ctx, class, ip, nil)
+}
+
+// PingWith is like Ping but with options. A nil opts is equivalent
+// to calling Ping.
+//
+// If opts asks for a timestamp or record-route probe, it's sent as by
+// PingPath, and only its round-trip time is reported.
+func PingWith(ctx context.Context, class Class, ip netaddr.IP, opts *Options) (time.Duration, error) {
+	if opts.wantsPath() {
+		pi, err := PingPath(ctx, class, ip, opts)
+		return pi.RTT, err
+	}
+	s := Selected()
+	m := s.MethodFor(ip)
+	if m == MethodTCP && !opts.allowTCP() {
+		return 0, s.errFor(ip)
+	}
+	return pingMethod(ctx, m, class, ip, opts)
+}
+
+// errFor returns the *CapabilityError for ip's address family, for a
+// probe of ip that may not be sent over TCP.
+func (s Selection) errFor(ip netaddr.IP) error {
+	return &CapabilityError{IPv4: ip.Is4(), IPv6: ip.Is6(), Caps: s.Caps}
+}
+
+// pingMethod pings ip once using m, recording metrics for class.
+// TCP probes are recorded as such, rather than as ping replies.
+func pingMethod(ctx context.Context, m Method, class Class, ip netaddr.IP, opts *Options) (time.Duration, error) {
+	if m == MethodTCP {
+		metricsFor(class).tcpSent.Add(1)
+		d, err := pingTCP(ctx, ip, opts)
+		recordTCPResult(class, err)
+		logProbe(class, m, ip, d, err)
+		return d, err
+	}
+	metricSent(class).Add(1)
+	var d time.Duration
+	var err error
+	switch m {
+	case MethodICMPDatagram, MethodICMPRaw:
+		d, err = pingNative(ctx, m, ip, opts)
+	case MethodExec:
+		d, err = runExec(ctx, ip, opts)
+	case MethodICMPAPI:
+		d, err = pingICMPAPI(ctx, ip, opts)
+	default:
+		err = errNoMethod
+	}
+	recordResult(class, d, err)
+	logProbe(class, m, ip, d, err)
+	return d, err
+}
@@ -0,0 +1,105 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ping
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+func TestChooseMethod(t *testing.T) {
+	tests := []struct {
+		fc         FamilyCaps
+		haveBinary bool
+		want       Method
+	}{
+		{FamilyCaps{API: true, Raw: true}, true, MethodICMPAPI},
+		{FamilyCaps{Datagram: true, Raw: true}, true, MethodICMPDatagram},
+		{FamilyCaps{Raw: true}, true, MethodICMPRaw},
+		{FamilyCaps{}, true, MethodExec},
+		{FamilyCaps{}, false, MethodTCP},
+	}
+	for _, tt := range tests {
+		if got := chooseMethod(tt.fc, tt.haveBinary); got != tt.want {
+			t.Errorf("chooseMethod(%+v, %v) = %v; want %v", tt.fc, tt.haveBinary, got, tt.want)
+		}
+	}
+}
+
+func TestSelectionMethodFor(t *testing.T) {
+	s := Selection{IPv4: MethodICMPRaw, IPv6: MethodExec}
+	if got := s.MethodFor(netaddr.MustParseIP("1.2.3.4")); got != MethodICMPRaw {
+		t.Errorf("v4 = %v", got)
+	}
+	if got := s.MethodFor(netaddr.MustParseIP("::ffff:1.2.3.4")); got != MethodICMPRaw {
+		t.Errorf("v4-in-v6 = %v", got)
+	}
+	if got := s.MethodFor(netaddr.MustParseIP("fd7a:115c:a1e0::1")); got != MethodExec {
+		t.Errorf("v6 = %v", got)
+	}
+}
+
+func TestPingNativeLoopback(t *testing.T) {
+	lo := netaddr.IPv4(127, 0, 0, 1)
+	for _, m := range []Method{MethodICMPDatagram, MethodICMPRaw} {
+		t.Run(m.String(), func(t *testing.T) {
+			if !canListen(m, lo) {
+				t.Skipf("can't open %v socket", m)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			d, err := pingNative(ctx, m, lo, &Options{Source: lo, DSCP: 46})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d <= 0 || d > time.Second {
+				t.Errorf("implausible RTT %v", d)
+			}
+		})
+	}
+}
+
+func TestSelectionErr(t *testing.T) {
+	if err := (Selection{IPv4: MethodICMPRaw, IPv6: MethodExec}).Err(); err != nil {
+		t.Errorf("Err = %v; want nil", err)
+	}
+	err := (Selection{IPv4: MethodICMPDatagram, IPv6: MethodTCP}).Err()
+	ce, ok := err.(*CapabilityError)
+	if !ok {
+		t.Fatalf("Err = %#v; want *CapabilityError", err)
+	}
+	if ce.IPv4 || !ce.IPv6 {
+		t.Errorf("Err = %+v; want only IPv6 unavailable", ce)
+	}
+	if !strings.Contains(err.Error(), "IPv6 pings") {
+		t.Errorf("Err = %q; want it to mention IPv6", err)
+	}
+}
+
+func TestTCPOnlyWithAllowTCP(t *testing.T) {
+	Selected() // probe the real capabilities first, so they don't replace ours
+	defer func(s Selection) { sel = s }(sel)
+	sel = Selection{IPv4: MethodTCP, IPv6: MethodTCP}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	lo := netaddr.IPv4(127, 0, 0, 1)
+	for name, f := range map[string]func() (time.Duration, error){
+		"Ping": func() (time.Duration, error) { return Ping(ctx, ClassOther, lo) },
+		"Exec": func() (time.Duration, error) { return Exec(ctx, ClassOther, lo) },
+	} {
+		if _, err := f(); !errors.As(err, new(*CapabilityError)) {
+			t.Errorf("%s = %v; want a *CapabilityError rather than a TCP probe", name, err)
+		}
+	}
+	if _, err := PingWith(ctx, ClassOther, lo, &Options{AllowTCP: true}); err != nil {
+		t.Errorf("PingWith with AllowTCP: %v", err)
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ping
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/syncs"
+)
+
+const (
+	// DefaultBurstCount and DefaultBurstInterval are the number and
+	// spacing of the probes Burst sends by default.
+	DefaultBurstCount    = 20
+	DefaultBurstInterval = 50 * time.Millisecond
+
+	// MaxBurstCount and MinBurstInterval bound what callers of
+	// Burst may ask for, so it can't be used to flood a host.
+	MaxBurstCount    = 100
+	MinBurstInterval = 10 * time.Millisecond
+
+	// maxBurstDuration bounds how long a burst may take to send.
+	maxBurstDuration = 10 * time.Second
+)
+
+// burstSem permits one burst at a time per process.
+var burstSem = syncs.NewSemaphore(1)
+
+var errBurstInProgress = errors.New("ping: another burst is in progress")
+
+// Burst sends count probes to ip, one every interval without waiting
+// for replies, and returns a Report of the loss and latency seen. It's
+// meant for quick link quality tests, like the CLI's network
+// diagnostics. Zero values of count and interval mean
+// DefaultBurstCount and DefaultBurstInterval.
+//
+// To keep it from being used to flood a host, count may be at most
+// MaxBurstCount, interval must be at least MinBurstInterval, the
+// probes must take no more than 10 seconds to send, ip must be a
+// unicast address, and only one burst may run at a time in the
+// process. Requests beyond those limits return an error without
+// sending anything.
+//
+// If ctx is done before the burst is over, Burst returns the Report
+// of the probes sent so far along with ctx's error.
+//
+// The class is only used for metrics.
+func Burst(ctx context.Context, class Class, ip netaddr.IP, count int, interval time.Duration) (*Report, error) {
+	if count == 0 {
+		count = DefaultBurstCount
+	}
+	if interval == 0 {
+		interval = DefaultBurstInterval
+	}
+	switch {
+	case count < 0 || count > MaxBurstCount:
+		return nil, fmt.Errorf("ping: burst count %d not in range 1-%d", count, MaxBurstCount)
+	case interval < MinBurstInterval:
+		return nil, fmt.Errorf("ping: burst interval %v less than %v", interval, MinBurstInterval)
+	case time.Duration(count-1)*interval > maxBurstDuration:
+		return nil, fmt.Errorf("ping: burst of %d probes every %v would take longer than %v", count, interval, maxBurstDuration)
+	case !ip.IsValid() || ip.IsUnspecified() || ip.IsMulticast() || ip == netaddr.IPv4(255, 255, 255, 255):
+		return nil, fmt.Errorf("ping: can't burst to non-unicast address %v", ip)
+	}
+	if !burstSem.TryAcquire() {
+		return nil, errBurstInProgress
+	}
+	defer burstSem.Release()
+
+	res := make([]Result, count)
+	var wg sync.WaitGroup
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	sent := 0
+send:
+	for i := range res {
+		if i > 0 {
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				break send
+			}
+		}
+		sent++
+		res[i].IP = ip
+		wg.Add(1)
+		go func(r *Result) {
+			defer wg.Done()
+			r.RTT, r.Err = Ping(ctx, class, r.IP)
+		}(&res[i])
+	}
+	wg.Wait()
+
+	rep := NewReport(class, ip)
+	for _, r := range res[:sent] {
+		rep.Add(r)
+	}
+	return rep, ctx.Err()
+}
@@ -0,0 +1,70 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ping
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+func TestBurstLimits(t *testing.T) {
+	ctx := context.Background()
+	ip := netaddr.MustParseIP("100.64.0.1")
+	tests := []struct {
+		name     string
+		ip       netaddr.IP
+		count    int
+		interval time.Duration
+	}{
+		{"too-many", ip, MaxBurstCount + 1, 0},
+		{"negative", ip, -1, 0},
+		{"too-fast", ip, 0, time.Millisecond},
+		{"too-long", ip, MaxBurstCount, time.Second},
+		{"zero-ip", netaddr.IP{}, 0, 0},
+		{"unspecified", netaddr.IPv4(0, 0, 0, 0), 0, 0},
+		{"multicast", netaddr.MustParseIP("ff02::1"), 0, 0},
+		{"broadcast", netaddr.IPv4(255, 255, 255, 255), 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rep, err := Burst(ctx, ClassOther, tt.ip, tt.count, tt.interval); err == nil {
+				t.Errorf("Burst = %+v; want error", rep)
+			}
+		})
+	}
+
+	if !burstSem.TryAcquire() {
+		t.Fatal("burst semaphore unexpectedly held")
+	}
+	_, err := Burst(ctx, ClassOther, ip, 1, 0)
+	burstSem.Release()
+	if err != errBurstInProgress {
+		t.Errorf("concurrent Burst = %v; want %v", err, errBurstInProgress)
+	}
+}
+
+func TestBurstLoopback(t *testing.T) {
+	lo := netaddr.IPv4(127, 0, 0, 1)
+	if Selected().MethodFor(lo) == MethodNone {
+		t.Skip("no way to ping")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	rep, err := Burst(ctx, ClassOther, lo, 5, MinBurstInterval)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Sent != 5 || len(rep.Probes) != 5 {
+		t.Fatalf("sent %d, %d probes; want 5", rep.Sent, len(rep.Probes))
+	}
+	for i, p := range rep.Probes {
+		if p.Seq != i+1 {
+			t.Errorf("probe %d has seq %d", i, p.Seq)
+		}
+	}
+}
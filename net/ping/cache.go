@@ -0,0 +1,158 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ping
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+const (
+	// DefaultCacheTTL is how long a Cache reuses a result by
+	// default.
+	DefaultCacheTTL = time.Second
+
+	// maxCacheEntries is the most results a Cache holds. Once it's
+	// full, probes go uncached until results expire.
+	maxCacheEntries = 256
+)
+
+// Cache shares the results of recent probes among callers that probe
+// the same target with the same Options within a short time of each
+// other, such as when several subsystems check the same gateway or
+// DERP server at once, so that coordinated diagnostics don't multiply
+// probe traffic on constrained links.
+//
+// Callers that ask while a matching probe is in flight wait for it
+// rather than sending their own. Failed probes are cached too, except
+// those cut short by the context of the caller that sent them.
+//
+// It's safe for concurrent use. The zero value is not usable; use
+// NewCache.
+type Cache struct {
+	ttl time.Duration
+
+	// ping sends a probe. It's PingWith, except in tests.
+	ping func(ctx context.Context, class Class, ip netaddr.IP, opts *Options) (time.Duration, error)
+
+	mu      sync.Mutex
+	entries map[cacheKey]*cacheEntry
+}
+
+type cacheKey struct {
+	ip   netaddr.IP
+	opts Options
+}
+
+type cacheEntry struct {
+	done chan struct{} // closed when the probe finishes
+
+	// The following are only valid once done is closed.
+	at  time.Time // when the probe finished
+	rtt time.Duration
+	err error
+}
+
+// NewCache returns a Cache that reuses results for ttl, or for
+// DefaultCacheTTL if ttl is zero.
+func NewCache(ttl time.Duration) *Cache {
+	if ttl <= 0 {
+		ttl = DefaultCacheTTL
+	}
+	return &Cache{
+		ttl:     ttl,
+		ping:    PingWith,
+		entries: make(map[cacheKey]*cacheEntry),
+	}
+}
+
+// Ping is like PingWith, but returns the result of a matching probe
+// sent by another caller in the last TTL (or still in flight) instead
+// of sending a new one, if there was one.
+//
+// Only probes actually sent count towards the metrics of their class.
+func (c *Cache) Ping(ctx context.Context, class Class, ip netaddr.IP, opts *Options) (time.Duration, error) {
+	key := cacheKey{ip: ip}
+	if opts != nil {
+		key.opts = *opts
+	}
+	for {
+		e, leader := c.entry(key)
+		if leader {
+			return c.probe(ctx, key, e, class, opts)
+		}
+		select {
+		case <-e.done:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+		if !isContextErr(e.err) {
+			return e.rtt, e.err
+		}
+		// The leader gave up; try again, perhaps as the leader.
+	}
+}
+
+// entry returns the usable entry for key, creating it if there isn't
+// one, in which case leader is true and the caller must send the
+// probe.
+func (c *Cache) entry(key cacheKey) (e *cacheEntry, leader bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if e := c.entries[key]; e != nil && !c.expired(e, now) {
+		return e, false
+	}
+	e = &cacheEntry{done: make(chan struct{})}
+	if len(c.entries) >= maxCacheEntries {
+		for k, old := range c.entries {
+			if c.expired(old, now) {
+				delete(c.entries, k)
+			}
+		}
+	}
+	if len(c.entries) < maxCacheEntries {
+		c.entries[key] = e
+	}
+	return e, true
+}
+
+// expired reports whether e is a finished probe older than the TTL.
+// c.mu must be held.
+func (c *Cache) expired(e *cacheEntry, now time.Time) bool {
+	select {
+	case <-e.done:
+		return now.Sub(e.at) >= c.ttl
+	default:
+		return false
+	}
+}
+
+// probe sends the probe for e, which was added for key, and
+// publishes its result.
+func (c *Cache) probe(ctx context.Context, key cacheKey, e *cacheEntry, class Class, opts *Options) (time.Duration, error) {
+	rtt, err := c.ping(ctx, class, key.ip, opts)
+	c.mu.Lock()
+	e.at, e.rtt, e.err = time.Now(), rtt, err
+	if err != nil && ctx.Err() != nil {
+		// Don't make others share our impatience.
+		e.err = ctx.Err()
+		if c.entries[key] == e {
+			delete(c.entries, key)
+		}
+	}
+	close(e.done)
+	c.mu.Unlock()
+	return rtt, err
+}
+
+// isContextErr reports whether err is one of the errors returned by
+// a done context.
+func isContextErr(err error) bool {
+	return err == context.Canceled || err == context.DeadlineExceeded
+}
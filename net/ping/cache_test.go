@@ -0,0 +1,130 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ping
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+func TestCache(t *testing.T) {
+	c := NewCache(time.Hour)
+	var sent int32
+	c.ping = func(ctx context.Context, class Class, ip netaddr.IP, opts *Options) (time.Duration, error) {
+		atomic.AddInt32(&sent, 1)
+		if ip.Is6() {
+			return 0, errors.New("timeout")
+		}
+		return time.Millisecond, nil
+	}
+	ctx := context.Background()
+	v4 := netaddr.MustParseIP("192.168.1.1")
+	v6 := netaddr.MustParseIP("fe80::1")
+
+	for i := 0; i < 3; i++ {
+		if d, err := c.Ping(ctx, ClassGateway, v4, nil); d != time.Millisecond || err != nil {
+			t.Fatalf("Ping = %v, %v", d, err)
+		}
+	}
+	if got := atomic.LoadInt32(&sent); got != 1 {
+		t.Errorf("sent %d probes; want 1", got)
+	}
+
+	// Different options are a different probe, but nil and
+	// zero options are the same.
+	c.Ping(ctx, ClassGateway, v4, &Options{})
+	c.Ping(ctx, ClassGateway, v4, &Options{DSCP: 46})
+	c.Ping(ctx, ClassGateway, v4, &Options{DSCP: 46})
+	if got := atomic.LoadInt32(&sent); got != 2 {
+		t.Errorf("sent %d probes; want 2", got)
+	}
+
+	// Failures are cached too.
+	for i := 0; i < 2; i++ {
+		if _, err := c.Ping(ctx, ClassGateway, v6, nil); err == nil {
+			t.Fatal("Ping succeeded")
+		}
+	}
+	if got := atomic.LoadInt32(&sent); got != 3 {
+		t.Errorf("sent %d probes; want 3", got)
+	}
+}
+
+func TestCacheExpiry(t *testing.T) {
+	c := NewCache(time.Nanosecond)
+	var sent int32
+	c.ping = func(ctx context.Context, class Class, ip netaddr.IP, opts *Options) (time.Duration, error) {
+		atomic.AddInt32(&sent, 1)
+		return time.Millisecond, nil
+	}
+	ip := netaddr.MustParseIP("192.168.1.1")
+	c.Ping(context.Background(), ClassGateway, ip, nil)
+	time.Sleep(time.Millisecond)
+	c.Ping(context.Background(), ClassGateway, ip, nil)
+	if got := atomic.LoadInt32(&sent); got != 2 {
+		t.Errorf("sent %d probes; want 2", got)
+	}
+}
+
+func TestCacheInFlight(t *testing.T) {
+	c := NewCache(time.Hour)
+	release := make(chan struct{})
+	var sent int32
+	c.ping = func(ctx context.Context, class Class, ip netaddr.IP, opts *Options) (time.Duration, error) {
+		n := atomic.AddInt32(&sent, 1)
+		if n > 1 {
+			return time.Millisecond, nil
+		}
+		select {
+		case <-release:
+			return time.Millisecond, nil
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+	ip := netaddr.MustParseIP("192.168.1.1")
+
+	// The first caller gives up; the others mustn't share its
+	// context's error, and one of them probes again.
+	leaderCtx, cancel := context.WithCancel(context.Background())
+	leaderDone := make(chan error, 1)
+	go func() {
+		_, err := c.Ping(leaderCtx, ClassGateway, ip, nil)
+		leaderDone <- err
+	}()
+	for atomic.LoadInt32(&sent) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	var wg sync.WaitGroup
+	errs := make([]error, 5)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = c.Ping(context.Background(), ClassGateway, ip, nil)
+		}(i)
+	}
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	if err := <-leaderDone; err != context.Canceled {
+		t.Errorf("leader err = %v; want context.Canceled", err)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("caller %d: %v", i, err)
+		}
+	}
+	if got := atomic.LoadInt32(&sent); got != 2 {
+		t.Errorf("sent %d probes; want 2", got)
+	}
+	close(release)
+}
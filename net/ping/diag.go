@@ -0,0 +1,192 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ping
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/tailcfg"
+)
+
+const (
+	// DefaultDiagProbes is the number of probes Diagnose sends to
+	// each target by default.
+	DefaultDiagProbes = 3
+
+	// diagSpacing is the time between Diagnose's probes of a
+	// target. They don't wait for each other's replies.
+	diagSpacing = 250 * time.Millisecond
+)
+
+// DiagTarget is a host probed by Diagnose.
+type DiagTarget struct {
+	Name  string // short description, like "gateway" or "derp-nyc"
+	Class Class
+	Host  string // host name or IP address
+}
+
+// ReferenceTargets are well-known, highly available Internet hosts to
+// pass to Diagnose as a baseline, to tell problems reaching Tailscale's
+// infrastructure apart from problems reaching anything. As they're
+// third parties, they're only probed when the user asks.
+var ReferenceTargets = []DiagTarget{
+	{Name: "ref-google", Host: "8.8.8.8"},
+	{Name: "ref-cloudflare", Host: "1.1.1.1"},
+	{Name: "ref-google-v6", Host: "2001:4860:4860::8888"},
+}
+
+// DERPTargets returns DiagTargets for the nodes of DERP region r.
+// It returns nil if r is nil.
+func DERPTargets(r *tailcfg.DERPRegion) []DiagTarget {
+	if r == nil {
+		return nil
+	}
+	var ret []DiagTarget
+	for _, n := range r.Nodes {
+		if n.STUNOnly {
+			continue
+		}
+		name := "derp-" + r.RegionCode
+		if len(r.Nodes) > 1 {
+			name = "derp-" + n.Name
+		}
+		host := n.HostName
+		if ip, err := netaddr.ParseIP(n.IPv4); err == nil {
+			host = ip.String()
+		}
+		ret = append(ret, DiagTarget{Name: name, Class: ClassDERP, Host: host})
+	}
+	return ret
+}
+
+// DiagResult is the outcome of probing one DiagTarget.
+type DiagResult struct {
+	Name string
+	Host string `json:",omitempty"` // if a host name, rather than an IP
+
+	// Report summarizes the probes. It's nil if the host couldn't
+	// be resolved.
+	Report *Report `json:",omitempty"`
+
+	// Err is why the host couldn't be resolved, if it couldn't.
+	Err string `json:",omitempty"`
+}
+
+// Diagnostics is a compact summary of the ICMP reachability of the
+// local network's gateways, DERP servers and reference hosts, for
+// inclusion in netcheck reports and bug reports.
+type Diagnostics struct {
+	// Selection is which Method was used for each address family,
+	// like "ipv4=icmp-raw ipv6=icmp-datagram".
+	Selection string
+
+	// Results are the outcomes for each target: the default
+	// gateways first, then the targets given to Diagnose.
+	Results []DiagResult
+}
+
+// Diagnose probes this machine's default gateways, then targets, each
+// probes times (or DefaultDiagProbes times if probes is zero), and
+// summarizes the results. Host names are resolved with r, or the system
+// resolver if r is nil.
+//
+// All probes run in parallel, so it takes a little over three
+// seconds when some go unanswered.
+func Diagnose(ctx context.Context, r Resolver, targets []DiagTarget, probes int) *Diagnostics {
+	if probes <= 0 {
+		probes = DefaultDiagProbes
+	}
+	var all []DiagTarget
+	gws, _ := DefaultGateways()
+	for _, gw := range gws {
+		all = append(all, DiagTarget{Name: "gateway", Class: ClassGateway, Host: gw.IP.String()})
+	}
+	all = append(all, targets...)
+
+	d := &Diagnostics{
+		Selection: Selected().String(),
+		Results:   make([]DiagResult, len(all)),
+	}
+	var wg sync.WaitGroup
+	for i, t := range all {
+		wg.Add(1)
+		go func(t DiagTarget, dr *DiagResult) {
+			defer wg.Done()
+			diagnoseTarget(ctx, r, t, probes, dr)
+		}(t, &d.Results[i])
+	}
+	wg.Wait()
+	return d
+}
+
+// diagnoseTarget probes t and fills in dr.
+func diagnoseTarget(ctx context.Context, r Resolver, t DiagTarget, probes int, dr *DiagResult) {
+	dr.Name = t.Name
+	ips, err := ResolveHost(ctx, r, t.Host)
+	if err != nil {
+		dr.Host = t.Host
+		dr.Err = err.Error()
+		return
+	}
+	ip := ips[0]
+	if ip.String() != t.Host {
+		dr.Host = t.Host
+	}
+	res := make([]Result, probes)
+	var wg sync.WaitGroup
+	for i := range res {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			res[i].IP = ip
+			select {
+			case <-time.After(time.Duration(i) * diagSpacing):
+			case <-ctx.Done():
+				res[i].Err = ctx.Err()
+				return
+			}
+			// Where pings can't be sent, TCP probes at least
+			// tell reachable hosts apart; Selection says which.
+			res[i].RTT, res[i].Err = PingWith(ctx, t.Class, ip, &Options{AllowTCP: true})
+		}(i)
+	}
+	wg.Wait()
+	rep := NewReport(t.Class, ip)
+	for _, r := range res {
+		rep.Add(r)
+	}
+	rep.Probes = nil // keep it compact
+	dr.Report = rep
+}
+
+// String returns d as an indented multi-line text section.
+func (d *Diagnostics) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "ICMP (%s):\n", d.Selection)
+	for _, r := range d.Results {
+		rep := r.Report
+		switch {
+		case rep == nil:
+			fmt.Fprintf(&sb, "\t* %s %s: %s\n", r.Name, r.Host, r.Err)
+			continue
+		case r.Host != "":
+			fmt.Fprintf(&sb, "\t* %s %s (%v)", r.Name, r.Host, rep.IP)
+		default:
+			fmt.Fprintf(&sb, "\t* %s %v", r.Name, rep.IP)
+		}
+		if rep.Received == 0 {
+			fmt.Fprintf(&sb, ": no replies to %d probes\n", rep.Sent)
+			continue
+		}
+		p50 := time.Duration(rep.P50LatencySeconds * float64(time.Second))
+		fmt.Fprintf(&sb, ": %v median, %.0f%% loss\n", p50.Round(10*time.Microsecond), rep.Loss*100)
+	}
+	return sb.String()
+}
@@ -0,0 +1,64 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ping
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/tailcfg"
+)
+
+func TestDERPTargets(t *testing.T) {
+	if got := DERPTargets(nil); got != nil {
+		t.Errorf("DERPTargets(nil) = %v; want nil", got)
+	}
+	r := &tailcfg.DERPRegion{
+		RegionCode: "nyc",
+		Nodes: []*tailcfg.DERPNode{
+			{Name: "1a", HostName: "derp1.example.com", IPv4: "192.0.2.1"},
+			{Name: "1b", HostName: "derp1b.example.com"},
+			{Name: "1c", HostName: "stun.example.com", STUNOnly: true},
+		},
+	}
+	want := []DiagTarget{
+		{Name: "derp-1a", Class: ClassDERP, Host: "192.0.2.1"},
+		{Name: "derp-1b", Class: ClassDERP, Host: "derp1b.example.com"},
+	}
+	if got := DERPTargets(r); !reflect.DeepEqual(got, want) {
+		t.Errorf("DERPTargets = %+v; want %+v", got, want)
+	}
+}
+
+func TestDiagnosticsString(t *testing.T) {
+	gw := NewReport(ClassGateway, netaddr.MustParseIP("192.168.1.1"))
+	gw.Add(Result{RTT: 1200 * time.Microsecond})
+	gw.Add(Result{Err: errors.New("timeout")})
+	ref := NewReport(ClassOther, netaddr.MustParseIP("8.8.8.8"))
+	ref.Add(Result{Err: errors.New("timeout")})
+	derp := NewReport(ClassDERP, netaddr.MustParseIP("192.0.2.1"))
+	derp.Add(Result{RTT: 15 * time.Millisecond})
+
+	d := &Diagnostics{
+		Selection: "ipv4=icmp-raw ipv6=icmp-raw",
+		Results: []DiagResult{
+			{Name: "gateway", Report: gw},
+			{Name: "derp-nyc", Host: "derp1.example.com", Report: derp},
+			{Name: "derp-sfo", Host: "derp2.example.com", Err: "resolving: no such host"},
+			{Name: "ref-google", Report: ref},
+		},
+	}
+	want := "ICMP (ipv4=icmp-raw ipv6=icmp-raw):\n" +
+		"\t* gateway 192.168.1.1: 1.2ms median, 50% loss\n" +
+		"\t* derp-nyc derp1.example.com (192.0.2.1): 15ms median, 0% loss\n" +
+		"\t* derp-sfo derp2.example.com: resolving: no such host\n" +
+		"\t* ref-google 8.8.8.8: no replies to 1 probes\n"
+	if got := d.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ping
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"inet.af/netaddr"
+)
+
+// DualStackResult is the outcome of probing a host over both IPv4 and
+// IPv6, so a broken path over one family isn't hidden by a working
+// one over the other.
+type DualStackResult struct {
+	IPv4 *Result // nil if the host has no IPv4 address
+	IPv6 *Result // nil if the host has no IPv6 address
+}
+
+func (r DualStackResult) String() string {
+	var sb strings.Builder
+	for i, f := range []struct {
+		name string
+		res  *Result
+	}{{"ipv4", r.IPv4}, {"ipv6", r.IPv6}} {
+		if i > 0 {
+			sb.WriteByte(' ')
+		}
+		switch {
+		case f.res == nil:
+			fmt.Fprintf(&sb, "%s=none", f.name)
+		case f.res.Err != nil:
+			fmt.Fprintf(&sb, "%s=%v(%v)", f.name, f.res.IP, f.res.Err)
+		default:
+			fmt.Fprintf(&sb, "%s=%v(%v)", f.name, f.res.IP, f.res.RTT)
+		}
+	}
+	return sb.String()
+}
+
+// splitFamilies returns the first IPv4 and the first IPv6 address
+// among addrs. Either is the zero IP if there's no such address.
+// IPv4-mapped IPv6 addresses count as IPv4.
+func splitFamilies(addrs []netaddr.IP) (v4, v6 netaddr.IP) {
+	for _, ip := range addrs {
+		switch {
+		case ip.Is4() || ip.Is4in6():
+			if v4.IsZero() {
+				v4 = ip.Unmap()
+			}
+		case ip.Is6():
+			if v6.IsZero() {
+				v6 = ip
+			}
+		}
+	}
+	return v4, v6
+}
+
+// DualStack pings a host with the given addresses once over each
+// address family it has an address in, in parallel, and reports the
+// result for each family. Only the first address of each family is
+// probed.
+//
+// The class is only used for metrics.
+func DualStack(ctx context.Context, class Class, addrs []netaddr.IP) DualStackResult {
+	var ret DualStackResult
+	v4, v6 := splitFamilies(addrs)
+	var wg sync.WaitGroup
+	probe := func(ip netaddr.IP, dst **Result) {
+		if ip.IsZero() {
+			return
+		}
+		res := &Result{IP: ip}
+		*dst = res
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res.RTT, res.Err = Ping(ctx, class, ip)
+		}()
+	}
+	probe(v4, &ret.IPv4)
+	probe(v6, &ret.IPv6)
+	wg.Wait()
+	return ret
+}
@@ -0,0 +1,51 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ping
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+func TestSplitFamilies(t *testing.T) {
+	ips := func(ss ...string) (ret []netaddr.IP) {
+		for _, s := range ss {
+			ret = append(ret, netaddr.MustParseIP(s))
+		}
+		return ret
+	}
+	tests := []struct {
+		in     []netaddr.IP
+		v4, v6 string
+	}{
+		{nil, "zero IP", "zero IP"},
+		{ips("1.2.3.4", "2001:db8::1", "5.6.7.8"), "1.2.3.4", "2001:db8::1"},
+		{ips("2001:db8::1", "2001:db8::2"), "zero IP", "2001:db8::1"},
+		{ips("::ffff:1.2.3.4", "2001:db8::1"), "1.2.3.4", "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		v4, v6 := splitFamilies(tt.in)
+		if v4.String() != tt.v4 || v6.String() != tt.v6 {
+			t.Errorf("splitFamilies(%v) = %v, %v; want %v, %v", tt.in, v4, v6, tt.v4, tt.v6)
+		}
+	}
+}
+
+func TestDualStackResultString(t *testing.T) {
+	r := DualStackResult{
+		IPv4: &Result{IP: netaddr.MustParseIP("1.2.3.4"), RTT: 12 * time.Millisecond},
+		IPv6: &Result{IP: netaddr.MustParseIP("2001:db8::1"), Err: errors.New("timeout")},
+	}
+	if got, want := r.String(), "ipv4=1.2.3.4(12ms) ipv6=2001:db8::1(timeout)"; got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+	r.IPv6 = nil
+	if got, want := r.String(), "ipv4=1.2.3.4(12ms) ipv6=none"; got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+}
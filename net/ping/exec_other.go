@@ -0,0 +1,18 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build windows || js || plan9
+// +build windows js plan9
+
+package ping
+
+import "os/exec"
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup kills the started cmd. The ping commands of these
+// platforms don't spawn children of their own.
+func killProcessGroup(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
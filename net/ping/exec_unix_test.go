@@ -0,0 +1,78 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !windows && !js && !plan9
+// +build !windows,!js,!plan9
+
+package ping
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+func TestRunExecDeadline(t *testing.T) {
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("no /bin/sh")
+	}
+	if _, err := os.Stat("/bin/sleep"); err != nil {
+		t.Skip("no /bin/sleep")
+	}
+	// A ping that hangs, and leaves a child behind that'd keep
+	// hanging if only ping itself were killed.
+	dir := t.TempDir()
+	pidFile := filepath.Join(dir, "child.pid")
+	script := "#!/bin/sh\n/bin/sleep 60 &\necho $! > " + pidFile + "\n/bin/sleep 60\n"
+	if err := os.WriteFile(filepath.Join(dir, "ping"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir)
+	defer func(d time.Duration) { execDeadline = d }(execDeadline)
+	execDeadline = 500 * time.Millisecond
+
+	t0 := time.Now()
+	_, err := runExec(context.Background(), netaddr.MustParseIP("192.0.2.1"), nil)
+	if elapsed := time.Since(t0); elapsed > 10*time.Second {
+		t.Errorf("runExec took %v", elapsed)
+	}
+	if err == nil {
+		t.Fatal("runExec succeeded")
+	}
+	var te interface{ Timeout() bool }
+	if !errors.As(err, &te) || !te.Timeout() {
+		t.Errorf("err = %v; want a timeout", err)
+	}
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("err = %v; want os.ErrDeadlineExceeded", err)
+	}
+
+	b, err := os.ReadFile(pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; syscall.Kill(pid, 0) == nil; i++ {
+		// It's dead, but may not have been reaped by its
+		// (reparented) parent yet.
+		if b, _ := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat"); strings.Contains(string(b), ") Z ") {
+			break
+		}
+		if i == 50 {
+			t.Fatalf("child %d still running", pid)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ping
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/net/interfaces"
+)
+
+// Gateway is a default gateway of this machine.
+type Gateway struct {
+	// IP is the gateway's address. IPv6 link-local addresses
+	// have Interface as their zone.
+	IP netaddr.IP
+
+	// Interface is the name of the network interface the gateway
+	// is reached over, if known.
+	Interface string
+}
+
+func (g Gateway) String() string {
+	if g.Interface == "" || g.IP.Zone() != "" {
+		return g.IP.String()
+	}
+	return fmt.Sprintf("%v%%%s", g.IP, g.Interface)
+}
+
+// DefaultGateways returns this machine's IPv4 and IPv6 default
+// gateways, from the routing table.
+//
+// On Linux it returns all of them. Elsewhere it only returns the
+// IPv4 gateway of the default route, and only if it has a private
+// address, as is typical of home and office networks.
+func DefaultGateways() ([]Gateway, error) {
+	return defaultGateways()
+}
+
+// likelyGateways returns the IPv4 gateway of the default route if it
+// has a private address, using package interfaces.
+func likelyGateways() ([]Gateway, error) {
+	ip, _, ok := interfaces.LikelyHomeRouterIP()
+	if !ok {
+		return nil, nil
+	}
+	ifName, _ := interfaces.DefaultRouteInterface()
+	return []Gateway{{IP: ip, Interface: ifName}}, nil
+}
+
+// GatewayResult is the outcome of probing a Gateway.
+type GatewayResult struct {
+	Gateway
+
+	// RTT is the round-trip time of an ICMP echo to the gateway,
+	// valid if Err is nil.
+	RTT time.Duration
+	Err error
+
+	// HardwareAddr is the link-layer address with which the
+	// gateway answered an ARP or NDP probe, if it did. Gateways
+	// are only probed that way if they don't answer pings, which
+	// many home routers don't.
+	HardwareAddr net.HardwareAddr
+}
+
+// Reachable reports whether the gateway answered either probe.
+func (r GatewayResult) Reachable() bool {
+	return r.Err == nil || r.HardwareAddr != nil
+}
+
+// LocalNetwork is a verdict on whether the local network (the one
+// between this machine and its default gateways) is working, for
+// connectivity triage.
+type LocalNetwork struct {
+	// Gateways are the results of probing each default gateway.
+	Gateways []GatewayResult
+
+	// Err, if non-nil, is why the gateways couldn't be discovered.
+	Err error
+}
+
+// OK reports whether the local network is working: whether any of
+// its default gateways answered.
+func (ln *LocalNetwork) OK() bool {
+	for _, g := range ln.Gateways {
+		if g.Reachable() {
+			return true
+		}
+	}
+	return false
+}
+
+func (ln *LocalNetwork) String() string {
+	var sb strings.Builder
+	if ln.OK() {
+		sb.WriteString("local network OK")
+	} else {
+		sb.WriteString("local network broken")
+	}
+	switch {
+	case ln.Err != nil:
+		fmt.Fprintf(&sb, ": %v", ln.Err)
+	case len(ln.Gateways) == 0:
+		sb.WriteString(": no default gateway")
+	}
+	for i, g := range ln.Gateways {
+		if i == 0 {
+			sb.WriteString(": ")
+		} else {
+			sb.WriteString(", ")
+		}
+		fmt.Fprintf(&sb, "gateway %v ", g.Gateway)
+		switch {
+		case g.Err == nil:
+			fmt.Fprintf(&sb, "in %v", g.RTT.Round(time.Microsecond))
+		case g.HardwareAddr != nil:
+			fmt.Fprintf(&sb, "at %v (no ping reply)", g.HardwareAddr)
+		default:
+			fmt.Fprintf(&sb, "unreachable (%v)", g.Err)
+		}
+	}
+	return sb.String()
+}
+
+// CheckLocalNetwork discovers this machine's default gateways and
+// probes them in parallel, first with an ICMP echo and then, if that
+// goes unanswered, with an ARP or NDP probe.
+func CheckLocalNetwork(ctx context.Context) *LocalNetwork {
+	gws, err := DefaultGateways()
+	if err != nil {
+		return &LocalNetwork{Err: err}
+	}
+	ln := &LocalNetwork{Gateways: make([]GatewayResult, len(gws))}
+	var wg sync.WaitGroup
+	for i, gw := range gws {
+		ln.Gateways[i].Gateway = gw
+		wg.Add(1)
+		go func(r *GatewayResult) {
+			defer wg.Done()
+			r.RTT, r.Err = PingWith(ctx, ClassGateway, r.IP, &Options{Interface: r.Interface})
+			if r.Err == nil || r.Interface == "" || ctx.Err() != nil {
+				return
+			}
+			if hw, _, err := Neighbor(ctx, ClassGateway, r.IP, r.Interface); err == nil {
+				r.HardwareAddr = hw
+			}
+		}(&ln.Gateways[i])
+	}
+	wg.Wait()
+	return ln
+}
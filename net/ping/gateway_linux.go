@@ -0,0 +1,90 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ping
+
+import (
+	"encoding/hex"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+	"inet.af/netaddr"
+	"tailscale.com/util/lineread"
+)
+
+func defaultGateways() ([]Gateway, error) {
+	var gws []Gateway
+	err := lineread.File("/proc/net/route", func(line []byte) error {
+		if gw, ok := parseProcNetRouteLine(string(line)); ok {
+			gws = append(gws, gw)
+		}
+		return nil
+	})
+	if err != nil {
+		// Android apps can't read /proc/net/route.
+		return likelyGateways()
+	}
+	// The IPv6 routing table may not exist if IPv6 is disabled.
+	lineread.File("/proc/net/ipv6_route", func(line []byte) error {
+		if gw, ok := parseProcNetIPv6RouteLine(string(line)); ok {
+			gws = append(gws, gw)
+		}
+		return nil
+	})
+	return gws, nil
+}
+
+// parseProcNetRouteLine parses a line of /proc/net/route, like
+//
+//	eth0	00000000	0101A8C0	0003	0	0	0	00000000	0	0	0
+//
+// and returns its gateway if it's a default route.
+func parseProcNetRouteLine(line string) (gw Gateway, ok bool) {
+	f := strings.Fields(line)
+	if len(f) < 8 || f[1] != "00000000" || f[7] != "00000000" {
+		return gw, false
+	}
+	flags, err := strconv.ParseUint(f[3], 16, 16)
+	if err != nil || flags&(unix.RTF_UP|unix.RTF_GATEWAY) != unix.RTF_UP|unix.RTF_GATEWAY {
+		return gw, false
+	}
+	// The address is in host (little-endian) byte order.
+	v, err := strconv.ParseUint(f[2], 16, 32)
+	if err != nil || v == 0 {
+		return gw, false
+	}
+	ip := netaddr.IPv4(byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+	return Gateway{IP: ip, Interface: f[0]}, true
+}
+
+// parseProcNetIPv6RouteLine parses a line of /proc/net/ipv6_route,
+// like
+//
+//	00000000000000000000000000000000 00 00000000000000000000000000000000 00 fe80000000000000022a6afffe3fd9c1 00000400 00000002 00000000 00000003 eth0
+//
+// and returns its gateway if it's a default route.
+func parseProcNetIPv6RouteLine(line string) (gw Gateway, ok bool) {
+	f := strings.Fields(line)
+	if len(f) < 10 || f[1] != "00" || strings.Trim(f[0], "0") != "" {
+		return gw, false
+	}
+	flags, err := strconv.ParseUint(f[8], 16, 32)
+	if err != nil || flags&(unix.RTF_UP|unix.RTF_GATEWAY) != unix.RTF_UP|unix.RTF_GATEWAY {
+		return gw, false
+	}
+	var a [16]byte
+	if n, err := hex.Decode(a[:], []byte(f[4])); err != nil || n != 16 {
+		return gw, false
+	}
+	ip := netaddr.IPFrom16(a)
+	if ip.IsUnspecified() {
+		return gw, false
+	}
+	ifName := f[9]
+	if ip.IsLinkLocalUnicast() {
+		ip = ip.WithZone(ifName)
+	}
+	return Gateway{IP: ip, Interface: ifName}, true
+}
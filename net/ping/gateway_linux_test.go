@@ -0,0 +1,55 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ping
+
+import (
+	"testing"
+)
+
+func TestParseProcNetRouteLine(t *testing.T) {
+	tests := []struct {
+		line string
+		want string // gateway, or empty if none
+	}{
+		{"Iface\tDestination\tGateway \tFlags\tRefCnt\tUse\tMetric\tMask\t\tMTU\tWindow\tIRTT", ""},
+		{"eth0\t00000000\t0101A8C0\t0003\t0\t0\t0\t00000000\t0\t0\t0", "192.168.1.1%eth0"},
+		{"eth0\t0001A8C0\t00000000\t0001\t0\t0\t0\t00FFFFFF\t0\t0\t0", ""},
+		{"eth0\t00000000\t0101A8C0\t0001\t0\t0\t0\t00000000\t0\t0\t0", ""}, // not RTF_GATEWAY
+		{"wg0\t00000000\t00000000\t0001\t0\t0\t0\t00000000\t0\t0\t0", ""},
+	}
+	for _, tt := range tests {
+		gw, ok := parseProcNetRouteLine(tt.line)
+		got := ""
+		if ok {
+			got = gw.String()
+		}
+		if got != tt.want {
+			t.Errorf("parseProcNetRouteLine(%q) = %q; want %q", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestParseProcNetIPv6RouteLine(t *testing.T) {
+	tests := []struct {
+		line string
+		want string // gateway, or empty if none
+	}{
+		{"00000000000000000000000000000000 00 00000000000000000000000000000000 00 fe80000000000000022a6afffe3fd9c1 00000400 00000002 00000000 00000003     eth0", "fe80::22a:6aff:fe3f:d9c1%eth0"},
+		{"00000000000000000000000000000000 00 00000000000000000000000000000000 00 fd000000000000000000000000000001 00000400 00000002 00000000 00000003     eth0", "fd00::1%eth0"},
+		{"fd000000000000000000000000000000 40 00000000000000000000000000000000 00 00000000000000000000000000000000 00000100 00000001 00000000 00000001     eth0", ""},
+		// The unreachable default route on lo.
+		{"00000000000000000000000000000000 00 00000000000000000000000000000000 00 00000000000000000000000000000000 ffffffff 00000001 00000000 00200200       lo", ""},
+	}
+	for _, tt := range tests {
+		gw, ok := parseProcNetIPv6RouteLine(tt.line)
+		got := ""
+		if ok {
+			got = gw.String()
+		}
+		if got != tt.want {
+			t.Errorf("parseProcNetIPv6RouteLine(%q) = %q; want %q", tt.line, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ping
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+func TestLocalNetworkVerdict(t *testing.T) {
+	gw4 := Gateway{IP: netaddr.MustParseIP("192.168.1.1"), Interface: "eth0"}
+	gw6 := Gateway{IP: netaddr.MustParseIP("fe80::1%eth0"), Interface: "eth0"}
+	errTimeout := errors.New("timeout")
+	hw := net.HardwareAddr{0, 1, 2, 3, 4, 5}
+	tests := []struct {
+		ln     LocalNetwork
+		wantOK bool
+		want   string
+	}{
+		{
+			LocalNetwork{},
+			false, "local network broken: no default gateway",
+		},
+		{
+			LocalNetwork{Err: errors.New("no routing table")},
+			false, "local network broken: no routing table",
+		},
+		{
+			LocalNetwork{Gateways: []GatewayResult{
+				{Gateway: gw4, RTT: 1500 * time.Microsecond},
+				{Gateway: gw6, Err: errTimeout},
+			}},
+			true, "local network OK: gateway 192.168.1.1%eth0 in 1.5ms, gateway fe80::1%eth0 unreachable (timeout)",
+		},
+		{
+			LocalNetwork{Gateways: []GatewayResult{
+				{Gateway: gw4, Err: errTimeout, HardwareAddr: hw},
+			}},
+			true, "local network OK: gateway 192.168.1.1%eth0 at 00:01:02:03:04:05 (no ping reply)",
+		},
+		{
+			LocalNetwork{Gateways: []GatewayResult{
+				{Gateway: gw4, Err: errTimeout},
+			}},
+			false, "local network broken: gateway 192.168.1.1%eth0 unreachable (timeout)",
+		},
+	}
+	for _, tt := range tests {
+		if got := tt.ln.OK(); got != tt.wantOK {
+			t.Errorf("OK() = %v; want %v for %+v", got, tt.wantOK, tt.ln)
+		}
+		if got := tt.ln.String(); got != tt.want {
+			t.Errorf("String() = %q; want %q", got, tt.want)
+		}
+	}
+}
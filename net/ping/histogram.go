@@ -0,0 +1,148 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ping
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Histogram tracks the round-trip times of recent probes over a
+// rolling window and answers percentile queries about them.
+//
+// It's meant to be fed the results of repeated probes of a single
+// target (such as a DERP region or a peer endpoint) so callers don't
+// each need their own ad-hoc latency math.
+//
+// It's safe for concurrent use. The zero value is not usable; use
+// NewHistogram.
+type Histogram struct {
+	window time.Duration
+	max    int
+
+	mu      sync.Mutex
+	samples []rttSample // oldest first
+}
+
+type rttSample struct {
+	at  time.Time
+	rtt time.Duration
+}
+
+// NewHistogram returns a Histogram that remembers samples for up to
+// window, and at most maxSamples of them. Zero values for either
+// mean no limit of that kind.
+func NewHistogram(window time.Duration, maxSamples int) *Histogram {
+	return &Histogram{
+		window: window,
+		max:    maxSamples,
+	}
+}
+
+// Add records a probe that completed at time now with round-trip
+// time rtt. Samples must be added in chronological order.
+func (h *Histogram) Add(now time.Time, rtt time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.samples = append(h.samples, rttSample{now, rtt})
+	h.expireLocked(now)
+}
+
+// expireLocked drops samples that are too old or too many.
+func (h *Histogram) expireLocked(now time.Time) {
+	drop := 0
+	if h.max > 0 && len(h.samples) > h.max {
+		drop = len(h.samples) - h.max
+	}
+	if h.window > 0 {
+		cutoff := now.Add(-h.window)
+		for drop < len(h.samples) && h.samples[drop].at.Before(cutoff) {
+			drop++
+		}
+	}
+	if drop > 0 {
+		n := copy(h.samples, h.samples[drop:])
+		h.samples = h.samples[:n]
+	}
+}
+
+// Len reports the number of samples in the window as of now.
+func (h *Histogram) Len(now time.Time) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.expireLocked(now)
+	return len(h.samples)
+}
+
+// Percentile returns the p'th percentile (0 <= p <= 100) round-trip
+// time of the samples in the window as of now, using the
+// nearest-rank method. It reports false if there are no samples.
+func (h *Histogram) Percentile(now time.Time, p float64) (time.Duration, bool) {
+	st := h.Stats(now)
+	if st.Count == 0 {
+		return 0, false
+	}
+	return percentile(st.sorted, p), true
+}
+
+// HistogramStats is a summary of the samples in a Histogram.
+type HistogramStats struct {
+	Count int
+	Min   time.Duration
+	Max   time.Duration
+	Mean  time.Duration
+	P50   time.Duration
+	P95   time.Duration
+
+	sorted []time.Duration
+}
+
+// Stats returns a summary of the samples in the window as of now.
+// All durations are zero if there are no samples.
+func (h *Histogram) Stats(now time.Time) HistogramStats {
+	h.mu.Lock()
+	h.expireLocked(now)
+	sorted := make([]time.Duration, len(h.samples))
+	for i, s := range h.samples {
+		sorted[i] = s.rtt
+	}
+	h.mu.Unlock()
+
+	st := HistogramStats{Count: len(sorted), sorted: sorted}
+	if len(sorted) == 0 {
+		return st
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	var sum time.Duration
+	for _, d := range sorted {
+		sum += d
+	}
+	st.Min = sorted[0]
+	st.Max = sorted[len(sorted)-1]
+	st.Mean = sum / time.Duration(len(sorted))
+	st.P50 = percentile(sorted, 50)
+	st.P95 = percentile(sorted, 95)
+	return st
+}
+
+// percentile returns the p'th percentile of sorted, which must be
+// non-empty and in ascending order.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if p <= 0 {
+		return sorted[0]
+	}
+	if p >= 100 {
+		return sorted[len(sorted)-1]
+	}
+	// Nearest rank: the smallest value such that at least p
+	// percent of the samples are less than or equal to it.
+	rank := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return sorted[rank]
+}
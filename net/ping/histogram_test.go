@@ -0,0 +1,62 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ping
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHistogram(t *testing.T) {
+	t0 := time.Unix(1000, 0)
+	h := NewHistogram(time.Minute, 0)
+	if _, ok := h.Percentile(t0, 50); ok {
+		t.Fatal("Percentile on empty histogram reported ok")
+	}
+	for i := 1; i <= 100; i++ {
+		h.Add(t0.Add(time.Duration(i)*time.Second/10), time.Duration(i)*time.Millisecond)
+	}
+	now := t0.Add(10 * time.Second)
+	st := h.Stats(now)
+	if st.Count != 100 {
+		t.Errorf("Count = %v; want 100", st.Count)
+	}
+	if st.Min != time.Millisecond || st.Max != 100*time.Millisecond {
+		t.Errorf("Min, Max = %v, %v; want 1ms, 100ms", st.Min, st.Max)
+	}
+	if st.P50 != 50*time.Millisecond {
+		t.Errorf("P50 = %v; want 50ms", st.P50)
+	}
+	if st.P95 != 95*time.Millisecond {
+		t.Errorf("P95 = %v; want 95ms", st.P95)
+	}
+	if want := 50500 * time.Microsecond; st.Mean != want {
+		t.Errorf("Mean = %v; want %v", st.Mean, want)
+	}
+
+	// Slide the window so only the last 26 samples (at or after t0+7.5s) remain.
+	now = t0.Add(time.Minute + 7500*time.Millisecond)
+	if got := h.Len(now); got != 26 {
+		t.Errorf("Len after expiry = %v; want 26", got)
+	}
+	if got, _ := h.Percentile(now, 0); got != 75*time.Millisecond {
+		t.Errorf("min after expiry = %v; want 75ms", got)
+	}
+}
+
+func TestHistogramMaxSamples(t *testing.T) {
+	t0 := time.Unix(1000, 0)
+	h := NewHistogram(0, 3)
+	for i, ms := range []int{50, 10, 20, 30} {
+		h.Add(t0.Add(time.Duration(i)*time.Second), time.Duration(ms)*time.Millisecond)
+	}
+	st := h.Stats(t0.Add(time.Hour))
+	if st.Count != 3 || st.Max != 30*time.Millisecond {
+		t.Errorf("got Count=%v Max=%v; want 3, 30ms", st.Count, st.Max)
+	}
+	if got, _ := h.Percentile(t0, 100); got != 30*time.Millisecond {
+		t.Errorf("p100 = %v; want 30ms", got)
+	}
+}
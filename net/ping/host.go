@@ -0,0 +1,67 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ping
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"inet.af/netaddr"
+)
+
+// A Resolver looks up the IP addresses of a host name, such as with
+// MagicDNS or the bootstrap DNS resolver.
+type Resolver func(ctx context.Context, host string) ([]netaddr.IP, error)
+
+// systemResolver is the Resolver used when callers don't give one.
+func systemResolver(ctx context.Context, host string) ([]netaddr.IP, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]netaddr.IP, 0, len(addrs))
+	for _, a := range addrs {
+		if ip, ok := netaddr.FromStdIPRaw(a.IP); ok {
+			ips = append(ips, ip.Unmap().WithZone(a.Zone))
+		}
+	}
+	return ips, nil
+}
+
+// ResolveHost returns the IP addresses of host, which may be either a
+// host name or an IP address literal. Host names are looked up with
+// r, or with the system resolver if r is nil.
+func ResolveHost(ctx context.Context, r Resolver, host string) ([]netaddr.IP, error) {
+	if ip, err := netaddr.ParseIP(host); err == nil {
+		return []netaddr.IP{ip}, nil
+	}
+	if r == nil {
+		r = systemResolver
+	}
+	ips, err := r(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("resolving %q: %w", host, err)
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("resolving %q: no addresses", host)
+	}
+	return ips, nil
+}
+
+// PingHost is like Ping but takes a host name or IP address literal,
+// resolving host names with r (or the system resolver if r is nil).
+// It pings the first address returned, which is reported in the
+// Result. If host can't be resolved, the Result's IP is zero and its
+// Err says why.
+func PingHost(ctx context.Context, r Resolver, class Class, host string) Result {
+	ips, err := ResolveHost(ctx, r, host)
+	if err != nil {
+		return Result{Err: err}
+	}
+	res := Result{IP: ips[0]}
+	res.RTT, res.Err = Ping(ctx, class, res.IP)
+	return res
+}
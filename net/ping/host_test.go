@@ -0,0 +1,50 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ping
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+func TestResolveHost(t *testing.T) {
+	ctx := context.Background()
+	derp := []netaddr.IP{netaddr.MustParseIP("192.0.2.10"), netaddr.MustParseIP("2001:db8::10")}
+	var looked []string
+	r := func(ctx context.Context, host string) ([]netaddr.IP, error) {
+		looked = append(looked, host)
+		switch host {
+		case "derp1.example.com":
+			return derp, nil
+		case "empty.example.com":
+			return nil, nil
+		}
+		return nil, errors.New("no such host")
+	}
+
+	ips, err := ResolveHost(ctx, r, "derp1.example.com")
+	if err != nil || !reflect.DeepEqual(ips, derp) {
+		t.Errorf("ResolveHost(name) = %v, %v; want %v", ips, err, derp)
+	}
+	ips, err = ResolveHost(ctx, r, "fe80::1%eth0")
+	if want := []netaddr.IP{netaddr.MustParseIP("fe80::1%eth0")}; err != nil || !reflect.DeepEqual(ips, want) {
+		t.Errorf("ResolveHost(literal) = %v, %v; want %v", ips, err, want)
+	}
+	if _, err := ResolveHost(ctx, r, "empty.example.com"); err == nil {
+		t.Error("ResolveHost with no addresses succeeded")
+	}
+	if want := []string{"derp1.example.com", "empty.example.com"}; !reflect.DeepEqual(looked, want) {
+		t.Errorf("looked up %q; want %q", looked, want)
+	}
+
+	res := PingHost(ctx, r, ClassDERP, "nonexistent.example.com")
+	if res.Err == nil || !res.IP.IsZero() {
+		t.Errorf("PingHost of unresolvable host = %+v; want error and zero IP", res)
+	}
+}
@@ -0,0 +1,22 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !windows
+// +build !windows
+
+package ping
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+func haveICMPAPI(netaddr.IP) bool { return false }
+
+func pingICMPAPI(context.Context, netaddr.IP, *Options) (time.Duration, error) {
+	return 0, errors.New("ICMP API only supported on Windows")
+}
@@ -0,0 +1,208 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ping
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+	"inet.af/netaddr"
+)
+
+var (
+	iphlpapi            = windows.NewLazySystemDLL("iphlpapi.dll")
+	procIcmpCreateFile  = iphlpapi.NewProc("IcmpCreateFile")
+	procIcmp6CreateFile = iphlpapi.NewProc("Icmp6CreateFile")
+	procIcmpCloseHandle = iphlpapi.NewProc("IcmpCloseHandle")
+	procIcmpSendEcho2Ex = iphlpapi.NewProc("IcmpSendEcho2Ex")
+	procIcmp6SendEcho2  = iphlpapi.NewProc("Icmp6SendEcho2")
+)
+
+// ipOptionInformation is the Windows IP_OPTION_INFORMATION struct.
+type ipOptionInformation struct {
+	TTL         uint8
+	TOS         uint8
+	Flags       uint8
+	OptionsSize uint8
+	OptionsData *byte
+}
+
+// icmpEchoReply is the Windows ICMP_ECHO_REPLY struct.
+type icmpEchoReply struct {
+	Address       uint32 // in network byte order
+	Status        uint32
+	RoundTripTime uint32 // in milliseconds
+	DataSize      uint16
+	Reserved      uint16
+	Data          *byte
+	Options       ipOptionInformation
+}
+
+// icmpv6EchoReplyStatusOffset is the offset of the Status field in
+// the Windows ICMPV6_ECHO_REPLY struct, after its packed 26-byte
+// IPV6_ADDRESS_EX and padding. RoundTripTime (in milliseconds)
+// follows it.
+const icmpv6EchoReplyStatusOffset = 28
+
+// icmpStatusError is an IP_STATUS code other than IP_SUCCESS,
+// returned by the ICMP API.
+type icmpStatusError uint32
+
+func (e icmpStatusError) Error() string {
+	switch e {
+	case 11002:
+		return "destination network unreachable"
+	case 11003:
+		return "destination host unreachable"
+	case 11004:
+		return "destination protocol unreachable"
+	case 11005:
+		return "destination port unreachable"
+	case 11009:
+		return "packet too big"
+	case 11010:
+		return "request timed out"
+	case 11013:
+		return "TTL expired in transit"
+	case 11018:
+		return "bad destination"
+	}
+	return fmt.Sprintf("ICMP error status %d", uint32(e))
+}
+
+// Timeout reports whether e is IP_REQ_TIMED_OUT.
+func (e icmpStatusError) Timeout() bool { return e == 11010 }
+
+// isIPStatus reports whether errno is in the range of IP_STATUS codes,
+// which the ICMP API reports as its last error when it got no reply.
+func isIPStatus(errno windows.Errno) bool {
+	return errno >= 11000 && errno <= 11050
+}
+
+// haveICMPAPI reports whether the Windows ICMP API can be used for
+// pings to the address family of ip.
+func haveICMPAPI(ip netaddr.IP) bool {
+	if ip.Is6() {
+		return procIcmp6CreateFile.Find() == nil && procIcmp6SendEcho2.Find() == nil
+	}
+	return procIcmpCreateFile.Find() == nil && procIcmpSendEcho2Ex.Find() == nil
+}
+
+// pingICMPAPI sends a single ICMP echo request to ip using the
+// Windows IP Helper API (IcmpSendEcho2Ex or Icmp6SendEcho2) and waits
+// for the reply. Unlike running ping.exe, this needs no output
+// parsing, which varies with the system's locale, and reports why a
+// probe failed.
+//
+// The call can't be interrupted, so ctx is only used for its
+// deadline.
+func pingICMPAPI(ctx context.Context, ip netaddr.IP, opts *Options) (time.Duration, error) {
+	timeout := nativeTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+		if timeout <= 0 {
+			return 0, context.DeadlineExceeded
+		}
+	}
+	timeoutMS := uintptr(timeout / time.Millisecond)
+	if timeoutMS == 0 {
+		timeoutMS = 1
+	}
+
+	createProc := procIcmpCreateFile
+	if ip.Is6() {
+		createProc = procIcmp6CreateFile
+	}
+	h, _, err := createProc.Call()
+	if windows.Handle(h) == windows.InvalidHandle {
+		return 0, fmt.Errorf("%s: %w", createProc.Name, err)
+	}
+	defer procIcmpCloseHandle.Call(h)
+
+	data := []byte("tailscale-ping")
+	reqOpts := ipOptionInformation{TTL: 128, TOS: uint8(opts.tos())}
+	var reply [1500]byte
+
+	src := opts.source()
+	t0 := time.Now()
+	var n uintptr
+	if ip.Is6() {
+		var srcSA windows.RawSockaddrInet6
+		srcSA.Family = windows.AF_INET6
+		if !src.IsZero() {
+			srcSA.Addr = src.As16()
+		}
+		dstSA := windows.RawSockaddrInet6{
+			Family: windows.AF_INET6,
+			Addr:   ip.As16(),
+		}
+		n, _, err = procIcmp6SendEcho2.Call(
+			h,
+			0, // no event; synchronous
+			0, // no APC routine
+			0, // no APC context
+			uintptr(unsafe.Pointer(&srcSA)),
+			uintptr(unsafe.Pointer(&dstSA)),
+			uintptr(unsafe.Pointer(&data[0])),
+			uintptr(len(data)),
+			uintptr(unsafe.Pointer(&reqOpts)),
+			uintptr(unsafe.Pointer(&reply[0])),
+			uintptr(len(reply)),
+			timeoutMS)
+	} else {
+		var srcAddr, dstAddr uint32
+		if !src.IsZero() {
+			a := src.As4()
+			srcAddr = binary.LittleEndian.Uint32(a[:])
+		}
+		a := ip.As4()
+		dstAddr = binary.LittleEndian.Uint32(a[:])
+		n, _, err = procIcmpSendEcho2Ex.Call(
+			h,
+			0, // no event; synchronous
+			0, // no APC routine
+			0, // no APC context
+			uintptr(srcAddr),
+			uintptr(dstAddr),
+			uintptr(unsafe.Pointer(&data[0])),
+			uintptr(len(data)),
+			uintptr(unsafe.Pointer(&reqOpts)),
+			uintptr(unsafe.Pointer(&reply[0])),
+			uintptr(len(reply)),
+			timeoutMS)
+	}
+	elapsed := time.Since(t0)
+	if n == 0 {
+		var errno windows.Errno
+		if errors.As(err, &errno) && isIPStatus(errno) {
+			return 0, icmpStatusError(errno)
+		}
+		return 0, err
+	}
+
+	var status, rttMS uint32
+	if ip.Is6() {
+		status = binary.LittleEndian.Uint32(reply[icmpv6EchoReplyStatusOffset:])
+		rttMS = binary.LittleEndian.Uint32(reply[icmpv6EchoReplyStatusOffset+4:])
+	} else {
+		r := (*icmpEchoReply)(unsafe.Pointer(&reply[0]))
+		status, rttMS = r.Status, r.RoundTripTime
+	}
+	if status != 0 {
+		return 0, icmpStatusError(status)
+	}
+	if rttMS == 0 {
+		// Windows only reports whole milliseconds; for
+		// sub-millisecond replies our own clock is better
+		// than zero.
+		return elapsed, nil
+	}
+	return time.Duration(rttMS) * time.Millisecond, nil
+}
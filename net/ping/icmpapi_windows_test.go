@@ -0,0 +1,41 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ping
+
+import (
+	"context"
+	"testing"
+	"time"
+	"unsafe"
+
+	"inet.af/netaddr"
+)
+
+func TestICMPEchoReplySize(t *testing.T) {
+	// Per ipexport.h.
+	want := uintptr(28)
+	if unsafe.Sizeof(uintptr(0)) == 8 {
+		want = 40
+	}
+	if got := unsafe.Sizeof(icmpEchoReply{}); got != want {
+		t.Errorf("sizeof ICMP_ECHO_REPLY = %d; want %d", got, want)
+	}
+}
+
+func TestPingICMPAPILoopback(t *testing.T) {
+	lo := netaddr.IPv4(127, 0, 0, 1)
+	if !haveICMPAPI(lo) {
+		t.Skip("no ICMP API")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	d, err := pingICMPAPI(ctx, lo, &Options{DSCP: 46})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d <= 0 || d > time.Second {
+		t.Errorf("implausible RTT %v", d)
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ping
+
+import (
+	"bytes"
+	"sync"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/types/logger"
+)
+
+var (
+	logfMu sync.Mutex
+	logf   logger.Logf = logger.Discard
+)
+
+// SetLogf sets where the package logs which Method Selected chose and
+// why, and the outcome of each probe, so problems in the field can be
+// debugged without strace. Probe outcomes are logged as structured
+// JSON records of type "ping_probe" (see logger.Logf.JSON); failures
+// at verbosity level 1 and successes at level 2.
+//
+// The logs are rate limited. SetLogf should be called before the
+// first probe, or the Method selection won't be logged. A nil logf
+// disables logging, which is the default.
+func SetLogf(f logger.Logf) {
+	if f == nil {
+		f = logger.Discard
+	} else {
+		f = logger.RateLimitedFn(f, time.Second, 10, 10)
+	}
+	logfMu.Lock()
+	defer logfMu.Unlock()
+	logf = f
+}
+
+func getLogf() logger.Logf {
+	logfMu.Lock()
+	defer logfMu.Unlock()
+	return logf
+}
+
+// probeLog is the record logged for each probe.
+type probeLog struct {
+	IP             netaddr.IP
+	Class          Class
+	Method         Method
+	LatencySeconds float64 `json:",omitempty"`
+	Err            string  `json:",omitempty"`
+
+	// Output is the first line of the ping command's output when
+	// it failed, which usually says why (e.g. "ping: socket:
+	// Operation not permitted").
+	Output string `json:",omitempty"`
+}
+
+// logProbe logs the outcome of a probe of ip using m.
+func logProbe(class Class, m Method, ip netaddr.IP, d time.Duration, err error) {
+	rec := probeLog{IP: ip, Class: class, Method: m}
+	level := 2
+	if err != nil {
+		level = 1
+		rec.Err = err.Error()
+		if ee, ok := err.(*execError); ok {
+			rec.Output = ee.firstLine
+		}
+	} else {
+		rec.LatencySeconds = d.Seconds()
+	}
+	getLogf().JSON(level, "ping_probe", rec)
+}
+
+// logSelection logs the Methods chosen by probeCapabilities.
+func logSelection(s Selection) {
+	c := s.Caps
+	getLogf()("ping: using %v; ipv4 datagram=%v raw=%v api=%v; ipv6 datagram=%v raw=%v api=%v; binary=%q ambient-caps=%v",
+		s, c.IPv4.Datagram, c.IPv4.Raw, c.IPv4.API, c.IPv6.Datagram, c.IPv6.Raw, c.IPv6.API, c.PingBinary, c.AmbientCapsRaw)
+}
+
+// execError is an error from running the ping command, along with
+// the first line of what it printed.
+type execError struct {
+	err       error
+	firstLine string
+}
+
+func (e *execError) Error() string { return e.err.Error() }
+func (e *execError) Unwrap() error { return e.err }
+
+// knownOutputPrefixes are the starts of the lines that ping commands
+// print whether or not they got a reply, which say nothing about why
+// a probe failed.
+var knownOutputPrefixes = []string{
+	"PING ",              // Unix header
+	"Pinging ",           // Windows header
+	"---",                // Unix statistics header
+	"Ping statistics",    // Windows statistics header
+	"Packets: ",          // Windows statistics
+	"Approximate round",  // Windows statistics
+	"round-trip ",        // BSD and busybox statistics
+	"rtt ",               // iputils statistics
+	"Request timed out.", // Windows timeout
+}
+
+// firstLine returns the first non-empty line of out that isn't one of
+// the ping command's usual header or statistics lines, trimmed of
+// surrounding space and truncated to a reasonable length for a log.
+func firstLine(out []byte) string {
+	for len(out) > 0 {
+		var line []byte
+		line, out, _ = bytes.Cut(out, []byte{'\n'})
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || isKnownOutput(line) {
+			continue
+		}
+		const max = 200
+		if len(line) > max {
+			line = line[:max]
+		}
+		return string(line)
+	}
+	return ""
+}
+
+func isKnownOutput(line []byte) bool {
+	if bytes.Contains(line, []byte("packets transmitted")) {
+		return true
+	}
+	for _, p := range knownOutputPrefixes {
+		if bytes.HasPrefix(line, []byte(p)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,76 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ping
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+func TestFirstLine(t *testing.T) {
+	tests := []struct {
+		out  string
+		want string
+	}{
+		{"", ""},
+		{"ping: socket: Operation not permitted\n", "ping: socket: Operation not permitted"},
+		{
+			"PING 100.64.0.1 (100.64.0.1) 56(84) bytes of data.\n" +
+				"From 192.168.1.1 icmp_seq=1 Destination Host Unreachable\n" +
+				"\n--- 100.64.0.1 ping statistics ---\n" +
+				"1 packets transmitted, 0 received, +1 errors, 100% packet loss, time 0ms\n",
+			"From 192.168.1.1 icmp_seq=1 Destination Host Unreachable",
+		},
+		{
+			"PING 100.64.0.1 (100.64.0.1) 56(84) bytes of data.\n\n" +
+				"--- 100.64.0.1 ping statistics ---\n" +
+				"1 packets transmitted, 0 received, 100% packet loss, time 0ms\n",
+			"",
+		},
+		{
+			"\r\nPinging 100.64.0.1 with 32 bytes of data:\r\nRequest timed out.\r\n\r\n" +
+				"Ping statistics for 100.64.0.1:\r\n    Packets: Sent = 1, Received = 0, Lost = 1 (100% loss),\r\n",
+			"",
+		},
+		{strings.Repeat("x", 300), strings.Repeat("x", 200)},
+	}
+	for _, tt := range tests {
+		if got := firstLine([]byte(tt.out)); got != tt.want {
+			t.Errorf("firstLine(%q) = %q; want %q", tt.out, got, tt.want)
+		}
+	}
+}
+
+func TestLogProbe(t *testing.T) {
+	var logs []string
+	SetLogf(func(format string, args ...any) {
+		logs = append(logs, fmt.Sprintf(format, args...))
+	})
+	defer SetLogf(nil)
+
+	ip := netaddr.MustParseIP("100.64.0.1")
+	logProbe(ClassPeer, MethodICMPRaw, ip, 1500*time.Microsecond, nil)
+	logProbe(ClassGateway, MethodExec, ip, 0, &execError{
+		err:       errors.New("exit status 2"),
+		firstLine: "ping: socket: Operation not permitted",
+	})
+	want := []string{
+		`[v` + "\x00" + `JSON]2{"ping_probe":{"IP":"100.64.0.1","Class":"peer","Method":"icmp-raw","LatencySeconds":0.0015}}`,
+		`[v` + "\x00" + `JSON]1{"ping_probe":{"IP":"100.64.0.1","Class":"gateway","Method":"exec","Err":"exit status 2","Output":"ping: socket: Operation not permitted"}}`,
+	}
+	if len(logs) != len(want) {
+		t.Fatalf("got %d logs %q; want %d", len(logs), logs, len(want))
+	}
+	for i := range want {
+		if logs[i] != want[i] {
+			t.Errorf("log %d = %q; want %q", i, logs[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ping
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultLossWindows are the windows over which callers typically
+// report loss: the last 10 seconds, minute and 5 minutes.
+var DefaultLossWindows = []time.Duration{10 * time.Second, time.Minute, 5 * time.Minute}
+
+// LossTracker tracks whether recent probes of a single target were
+// answered and reports packet loss over sliding windows of time, for
+// health reporting and for picking between exit nodes.
+//
+// It's safe for concurrent use. The zero value is not usable; use
+// NewLossTracker.
+type LossTracker struct {
+	window time.Duration
+	max    int
+
+	mu      sync.Mutex
+	samples []lossSample // oldest first
+}
+
+type lossSample struct {
+	at   time.Time
+	lost bool
+}
+
+// NewLossTracker returns a LossTracker that remembers probe outcomes
+// for up to window, the longest window callers will ask about, and
+// at most maxSamples of them. Zero values for either mean no limit
+// of that kind.
+func NewLossTracker(window time.Duration, maxSamples int) *LossTracker {
+	return &LossTracker{
+		window: window,
+		max:    maxSamples,
+	}
+}
+
+// Add records the outcome of a probe that completed at time now;
+// a non-nil err means it went unanswered. Outcomes must be added in
+// chronological order.
+func (t *LossTracker) Add(now time.Time, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.samples = append(t.samples, lossSample{now, err != nil})
+	t.expireLocked(now)
+}
+
+// expireLocked drops samples that are too old or too many.
+func (t *LossTracker) expireLocked(now time.Time) {
+	drop := 0
+	if t.max > 0 && len(t.samples) > t.max {
+		drop = len(t.samples) - t.max
+	}
+	if t.window > 0 {
+		cutoff := now.Add(-t.window)
+		for drop < len(t.samples) && t.samples[drop].at.Before(cutoff) {
+			drop++
+		}
+	}
+	if drop > 0 {
+		n := copy(t.samples, t.samples[drop:])
+		t.samples = t.samples[:n]
+	}
+}
+
+// Loss returns the fraction of probes, from 0 to 1, that went
+// unanswered in the window before now, and the number of probes in
+// it. Windows longer than the tracker's are treated as the tracker's.
+// The loss is zero if there were no probes.
+func (t *LossTracker) Loss(now time.Time, window time.Duration) (loss float64, n int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.expireLocked(now)
+	cutoff := now.Add(-window)
+	lost := 0
+	for i := len(t.samples) - 1; i >= 0; i-- {
+		s := t.samples[i]
+		if s.at.Before(cutoff) {
+			break
+		}
+		n++
+		if s.lost {
+			lost++
+		}
+	}
+	if n == 0 {
+		return 0, 0
+	}
+	return float64(lost) / float64(n), n
+}
@@ -0,0 +1,68 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ping
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLossTracker(t *testing.T) {
+	t0 := time.Unix(1000, 0)
+	lt := NewLossTracker(5*time.Minute, 0)
+	if loss, n := lt.Loss(t0, time.Minute); loss != 0 || n != 0 {
+		t.Fatalf("empty tracker Loss = %v, %v; want 0, 0", loss, n)
+	}
+
+	// One probe a second for 10 minutes: all answered for the
+	// first 9, then every other one lost, then all lost for the
+	// last 10 seconds.
+	errTimeout := errors.New("timeout")
+	for i := 1; i <= 600; i++ {
+		var err error
+		switch {
+		case i > 590:
+			err = errTimeout
+		case i > 540 && i%2 == 0:
+			err = errTimeout
+		}
+		lt.Add(t0.Add(time.Duration(i)*time.Second), err)
+	}
+	now := t0.Add(600 * time.Second)
+	tests := []struct {
+		window   time.Duration
+		wantLoss float64
+		wantN    int
+	}{
+		{10 * time.Second, 1, 11},          // 590 through 600
+		{time.Minute, 35.0 / 61, 61},       // 540 through 600
+		{5 * time.Minute, 35.0 / 301, 301}, // 300 through 600
+		{time.Hour, 35.0 / 301, 301},       // clamped to the tracker's window
+		{time.Nanosecond, 1, 1},            // just the last probe
+		{-time.Second, 0, 0},               // nothing
+	}
+	for _, tt := range tests {
+		loss, n := lt.Loss(now, tt.window)
+		if loss != tt.wantLoss || n != tt.wantN {
+			t.Errorf("Loss(%v) = %v, %v; want %v, %v", tt.window, loss, n, tt.wantLoss, tt.wantN)
+		}
+	}
+}
+
+func TestLossTrackerMaxSamples(t *testing.T) {
+	t0 := time.Unix(1000, 0)
+	lt := NewLossTracker(0, 4)
+	for i, lost := range []bool{true, true, false, false, true, false} {
+		var err error
+		if lost {
+			err = errors.New("timeout")
+		}
+		lt.Add(t0.Add(time.Duration(i)*time.Second), err)
+	}
+	if loss, n := lt.Loss(t0.Add(time.Hour), 2*time.Hour); loss != 0.25 || n != 4 {
+		t.Errorf("Loss = %v, %v; want 0.25, 4", loss, n)
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ping
+
+import (
+	"fmt"
+	"time"
+
+	"tailscale.com/util/clientmetric"
+)
+
+// rttBuckets are the upper bounds of the RTT histogram buckets
+// published for each Class. A final, unbounded bucket catches
+// everything slower than the last one.
+var rttBuckets = [...]time.Duration{
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	1 * time.Second,
+}
+
+// classMetrics are the metrics for probes of one Class.
+//
+// TCP probes (MethodTCP) are counted apart, in the tcp fields, as
+// their results aren't pings': a host that answers a TCP connection
+// might not answer pings, and the other way around.
+type classMetrics struct {
+	// sent counts the number of probes sent.
+	sent *clientmetric.Metric
+
+	// ok counts the number of probes that got a reply.
+	ok *clientmetric.Metric
+
+	// fail counts the number of probes that got no reply
+	// or couldn't be sent.
+	fail *clientmetric.Metric
+
+	// rtt counts successful probes by round-trip time. rtt[i]
+	// counts replies faster than rttBuckets[i] (and not faster
+	// than rttBuckets[i-1]); the final element counts the rest.
+	rtt [len(rttBuckets) + 1]*clientmetric.Metric
+
+	// tcpSent, tcpOK and tcpFail are like sent, ok and fail, for
+	// TCP probes.
+	tcpSent *clientmetric.Metric
+	tcpOK   *clientmetric.Metric
+	tcpFail *clientmetric.Metric
+}
+
+var metrics [numClasses]classMetrics
+
+func init() {
+	for c := Class(0); c < numClasses; c++ {
+		m := &metrics[c]
+		prefix := "ping_" + c.String() + "_"
+		m.sent = clientmetric.NewCounter(prefix + "sent")
+		m.ok = clientmetric.NewCounter(prefix + "ok")
+		m.fail = clientmetric.NewCounter(prefix + "fail")
+		for i, d := range rttBuckets {
+			m.rtt[i] = clientmetric.NewCounter(prefix + "rtt_lt_" + bucketName(d))
+		}
+		m.rtt[len(rttBuckets)] = clientmetric.NewCounter(prefix + "rtt_ge_" + bucketName(rttBuckets[len(rttBuckets)-1]))
+		m.tcpSent = clientmetric.NewCounter(prefix + "tcp_sent")
+		m.tcpOK = clientmetric.NewCounter(prefix + "tcp_ok")
+		m.tcpFail = clientmetric.NewCounter(prefix + "tcp_fail")
+	}
+}
+
+// bucketName returns d formatted for use in a metric name,
+// such as "250ms" or "1s".
+func bucketName(d time.Duration) string {
+	if d%time.Second == 0 {
+		return fmt.Sprintf("%ds", d/time.Second)
+	}
+	return fmt.Sprintf("%dms", d/time.Millisecond)
+}
+
+// rttBucket returns the index into classMetrics.rtt for a reply
+// that took d.
+func rttBucket(d time.Duration) int {
+	for i, max := range rttBuckets {
+		if d < max {
+			return i
+		}
+	}
+	return len(rttBuckets)
+}
+
+func metricsFor(c Class) *classMetrics {
+	if c >= numClasses {
+		c = ClassOther
+	}
+	return &metrics[c]
+}
+
+func metricSent(c Class) *clientmetric.Metric { return metricsFor(c).sent }
+
+// recordResult updates the metrics for a probe of class c that
+// finished after d with the given error.
+func recordResult(c Class, d time.Duration, err error) {
+	m := metricsFor(c)
+	if err != nil {
+		m.fail.Add(1)
+		return
+	}
+	m.ok.Add(1)
+	m.rtt[rttBucket(d)].Add(1)
+}
+
+// recordTCPResult is like recordResult, for a TCP probe.
+func recordTCPResult(c Class, err error) {
+	m := metricsFor(c)
+	if err != nil {
+		m.tcpFail.Add(1)
+		return
+	}
+	m.tcpOK.Add(1)
+}
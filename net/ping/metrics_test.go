@@ -0,0 +1,86 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ping
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRTTBucket(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want int
+	}{
+		{0, 0},
+		{9 * time.Millisecond, 0},
+		{10 * time.Millisecond, 1},
+		{30 * time.Millisecond, 2},
+		{999 * time.Millisecond, 6},
+		{time.Second, 7},
+		{time.Hour, 7},
+	}
+	for _, tt := range tests {
+		if got := rttBucket(tt.d); got != tt.want {
+			t.Errorf("rttBucket(%v) = %v; want %v", tt.d, got, tt.want)
+		}
+	}
+}
+
+func TestMetricNames(t *testing.T) {
+	m := metricsFor(ClassDERP)
+	if got, want := m.sent.Name(), "ping_derp_sent"; got != want {
+		t.Errorf("sent = %q; want %q", got, want)
+	}
+	if got, want := m.rtt[0].Name(), "ping_derp_rtt_lt_10ms"; got != want {
+		t.Errorf("rtt[0] = %q; want %q", got, want)
+	}
+	if got, want := m.rtt[len(m.rtt)-1].Name(), "ping_derp_rtt_ge_1s"; got != want {
+		t.Errorf("rtt[last] = %q; want %q", got, want)
+	}
+	if metricsFor(Class(200)) != metricsFor(ClassOther) {
+		t.Error("unknown class not mapped to ClassOther")
+	}
+}
+
+func TestRecordResult(t *testing.T) {
+	m := metricsFor(ClassGateway)
+	ok0, fail0, rtt0 := m.ok.Value(), m.fail.Value(), m.rtt[3].Value()
+
+	recordResult(ClassGateway, 60*time.Millisecond, nil)
+	recordResult(ClassGateway, 3*time.Second, errors.New("timeout"))
+
+	if got := m.ok.Value() - ok0; got != 1 {
+		t.Errorf("ok delta = %v; want 1", got)
+	}
+	if got := m.fail.Value() - fail0; got != 1 {
+		t.Errorf("fail delta = %v; want 1", got)
+	}
+	if got := m.rtt[3].Value() - rtt0; got != 1 {
+		t.Errorf("rtt[3] delta = %v; want 1", got)
+	}
+}
+
+func TestRecordTCPResult(t *testing.T) {
+	m := metricsFor(ClassPeer)
+	ok0, tcpOK0, tcpFail0 := m.ok.Value(), m.tcpOK.Value(), m.tcpFail.Value()
+
+	recordTCPResult(ClassPeer, nil)
+	recordTCPResult(ClassPeer, errors.New("timeout"))
+
+	if got := m.tcpOK.Value() - tcpOK0; got != 1 {
+		t.Errorf("tcp_ok delta = %v; want 1", got)
+	}
+	if got := m.tcpFail.Value() - tcpFail0; got != 1 {
+		t.Errorf("tcp_fail delta = %v; want 1", got)
+	}
+	if got := m.ok.Value() - ok0; got != 0 {
+		t.Errorf("ok delta = %v; want 0, as TCP probes aren't ping replies", got)
+	}
+	if got, want := m.tcpSent.Name(), "ping_peer_tcp_sent"; got != want {
+		t.Errorf("tcpSent = %q; want %q", got, want)
+	}
+}
@@ -0,0 +1,306 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ping
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/types/logger"
+)
+
+const (
+	// DefaultMonitorInterval is how often a Monitor probes each
+	// target by default.
+	DefaultMonitorInterval = 30 * time.Second
+
+	// monitorWindow is how long a Monitor keeps RTT and loss
+	// samples for each target's statistics.
+	monitorWindow = 5 * time.Minute
+
+	// monitorMaxSamples bounds the samples kept per target.
+	monitorMaxSamples = 100
+
+	// unreachableAfter is the number of consecutive unanswered
+	// probes after which a Monitor considers a target unreachable,
+	// so a single lost packet doesn't look like an outage.
+	unreachableAfter = 3
+)
+
+// Target is a host watched by a Monitor.
+type Target struct {
+	IP    netaddr.IP
+	Class Class
+	Opts  *Options // optional
+}
+
+// TargetStatus is the latest known state of a Monitor's Target.
+type TargetStatus struct {
+	Target
+
+	// Reachable is whether the target is answering probes. A
+	// target starts out reachable and becomes unreachable after
+	// several consecutive unanswered probes.
+	Reachable bool
+
+	LastProbe time.Time // when it was last probed; zero if never
+	LastReply time.Time // when it last answered; zero if never
+
+	// Stats summarizes the RTTs of its recent replies.
+	Stats HistogramStats
+
+	// Loss is the fraction of its recent probes, from 0 to 1, that
+	// went unanswered.
+	Loss float64
+}
+
+// ReachabilityFunc is the type of a Monitor callback, called when a
+// target becomes unreachable or reachable again.
+type ReachabilityFunc func(TargetStatus)
+
+// targetState is a Monitor's state for one Target.
+type targetState struct {
+	Target
+	hist      *Histogram
+	loss      *LossTracker
+	reachable bool
+	failures  int // consecutive unanswered probes
+	lastProbe time.Time
+	lastReply time.Time
+}
+
+func (ts *targetState) status(now time.Time) TargetStatus {
+	loss, _ := ts.loss.Loss(now, monitorWindow)
+	return TargetStatus{
+		Target:    ts.Target,
+		Reachable: ts.reachable,
+		LastProbe: ts.lastProbe,
+		LastReply: ts.lastReply,
+		Stats:     ts.hist.Stats(now),
+		Loss:      loss,
+	}
+}
+
+// Monitor periodically probes a set of targets (such as the default
+// gateway, DERP servers and peers) and tracks whether each is
+// reachable and how quickly it answers.
+type Monitor struct {
+	logf     logger.Logf
+	interval time.Duration
+	pacer    Pacer
+	stop     chan struct{} // closed on Close
+
+	// ping sends a probe. It's PingWith, except in tests.
+	ping func(ctx context.Context, class Class, ip netaddr.IP, opts *Options) (time.Duration, error)
+
+	mu         sync.Mutex // guards all following fields
+	targets    map[netaddr.IP]*targetState
+	cbs        map[*callbackHandle]ReachabilityFunc
+	started    bool
+	closed     bool
+	goroutines sync.WaitGroup
+}
+
+// An allocated callbackHandle's address is the Monitor.cbs map key.
+type callbackHandle byte
+
+// NewMonitor returns a new Monitor that probes its targets every
+// interval, or DefaultMonitorInterval if interval is zero.
+// The returned monitor is inactive until it's started by the Start
+// method. Use SetTargets to tell it what to probe.
+func NewMonitor(logf logger.Logf, interval time.Duration) *Monitor {
+	if interval <= 0 {
+		interval = DefaultMonitorInterval
+	}
+	return &Monitor{
+		logf:     logger.WithPrefix(logf, "ping-monitor: "),
+		interval: interval,
+		stop:     make(chan struct{}),
+		ping:     PingWith,
+		targets:  map[netaddr.IP]*targetState{},
+		cbs:      map[*callbackHandle]ReachabilityFunc{},
+	}
+}
+
+// SetTargets replaces the set of targets m probes. The state of
+// targets that remain in the set is retained.
+func (m *Monitor) SetTargets(targets []Target) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	old := m.targets
+	m.targets = make(map[netaddr.IP]*targetState, len(targets))
+	for _, t := range targets {
+		if ts, ok := old[t.IP]; ok {
+			ts.Target = t
+			m.targets[t.IP] = ts
+			continue
+		}
+		m.targets[t.IP] = &targetState{
+			Target:    t,
+			hist:      NewHistogram(monitorWindow, monitorMaxSamples),
+			loss:      NewLossTracker(monitorWindow, monitorMaxSamples),
+			reachable: true,
+		}
+	}
+}
+
+// Status returns the status of each of m's targets, sorted by IP.
+func (m *Monitor) Status() []TargetStatus {
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ret := make([]TargetStatus, 0, len(m.targets))
+	for _, ts := range m.targets {
+		ret = append(ret, ts.status(now))
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].IP.Less(ret[j].IP) })
+	return ret
+}
+
+// RegisterChangeCallback adds callback to the set of parties to be
+// notified when a target becomes unreachable or reachable again.
+// Callbacks are run on the monitor's goroutine and must not block.
+// To remove this callback, call unregister.
+func (m *Monitor) RegisterChangeCallback(callback ReachabilityFunc) (unregister func()) {
+	handle := new(callbackHandle)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cbs[handle] = callback
+	return func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		delete(m.cbs, handle)
+	}
+}
+
+// Start starts the monitor.
+// A monitor can only be started & closed once.
+func (m *Monitor) Start() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.started || m.closed {
+		return
+	}
+	m.started = true
+	m.goroutines.Add(1)
+	go m.run()
+}
+
+// Close stops the monitor and waits for in-flight probes to finish.
+func (m *Monitor) Close() error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil
+	}
+	m.closed = true
+	close(m.stop)
+	m.mu.Unlock()
+
+	m.goroutines.Wait()
+	return nil
+}
+
+func (m *Monitor) run() {
+	defer m.goroutines.Done()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-m.stop
+		cancel()
+	}()
+
+	t := time.NewTicker(m.interval)
+	defer t.Stop()
+	for {
+		m.probeAll(ctx)
+		select {
+		case <-t.C:
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+// probeAll probes each target once, in parallel, and waits for the
+// results.
+func (m *Monitor) probeAll(ctx context.Context) {
+	m.mu.Lock()
+	targets := make([]Target, 0, len(m.targets))
+	for _, ts := range m.targets {
+		targets = append(targets, ts.Target)
+	}
+	m.mu.Unlock()
+
+	sem := make(chan struct{}, maxParallel)
+	var wg sync.WaitGroup
+	for _, t := range targets {
+		if err := m.pacer.Wait(ctx); err != nil {
+			break
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(t Target) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			rtt, err := m.ping(ctx, t.Class, t.IP, t.Opts)
+			if ctx.Err() != nil {
+				return
+			}
+			m.pacer.Observe(err)
+			m.record(t, time.Now(), rtt, err)
+		}(t)
+	}
+	wg.Wait()
+}
+
+// record updates the state of target t with the outcome of a probe
+// that finished at now, and runs callbacks if its reachability
+// changed.
+func (m *Monitor) record(t Target, now time.Time, rtt time.Duration, err error) {
+	m.mu.Lock()
+	ts, ok := m.targets[t.IP]
+	if !ok {
+		// Removed by SetTargets while being probed.
+		m.mu.Unlock()
+		return
+	}
+	wasReachable := ts.reachable
+	ts.lastProbe = now
+	ts.loss.Add(now, err)
+	if err == nil {
+		ts.failures = 0
+		ts.reachable = true
+		ts.lastReply = now
+		ts.hist.Add(now, rtt)
+	} else {
+		ts.failures++
+		if ts.failures >= unreachableAfter {
+			ts.reachable = false
+		}
+	}
+	if ts.reachable == wasReachable {
+		m.mu.Unlock()
+		return
+	}
+	st := ts.status(now)
+	cbs := make([]ReachabilityFunc, 0, len(m.cbs))
+	for _, cb := range m.cbs {
+		cbs = append(cbs, cb)
+	}
+	m.mu.Unlock()
+
+	if st.Reachable {
+		m.logf("%v %v reachable again", t.Class, t.IP)
+	} else {
+		m.logf("%v %v unreachable: %v", t.Class, t.IP, err)
+	}
+	for _, cb := range cbs {
+		cb(st)
+	}
+}
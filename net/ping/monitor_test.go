@@ -0,0 +1,117 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ping
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+func TestMonitorReachability(t *testing.T) {
+	gw := netaddr.MustParseIP("192.168.1.1")
+	derp := netaddr.MustParseIP("10.0.0.1")
+
+	var mu sync.Mutex
+	down := map[netaddr.IP]bool{}
+	m := NewMonitor(t.Logf, time.Hour)
+	m.pacer.Interval = time.Nanosecond
+	m.ping = func(ctx context.Context, class Class, ip netaddr.IP, opts *Options) (time.Duration, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if down[ip] {
+			return 0, errors.New("timeout")
+		}
+		return 5 * time.Millisecond, nil
+	}
+	m.SetTargets([]Target{
+		{IP: gw, Class: ClassGateway},
+		{IP: derp, Class: ClassDERP},
+	})
+
+	var changes []TargetStatus
+	unregister := m.RegisterChangeCallback(func(st TargetStatus) {
+		changes = append(changes, st)
+	})
+	defer unregister()
+
+	ctx := context.Background()
+	m.probeAll(ctx)
+	if len(changes) != 0 {
+		t.Fatalf("got changes %v with all targets up", changes)
+	}
+
+	mu.Lock()
+	down[gw] = true
+	mu.Unlock()
+	for i := 0; i < unreachableAfter-1; i++ {
+		m.probeAll(ctx)
+	}
+	if len(changes) != 0 {
+		t.Fatalf("got changes %v before %d failures", changes, unreachableAfter)
+	}
+	m.probeAll(ctx)
+	if len(changes) != 1 || changes[0].IP != gw || changes[0].Reachable {
+		t.Fatalf("changes = %+v; want gateway unreachable", changes)
+	}
+
+	mu.Lock()
+	down[gw] = false
+	mu.Unlock()
+	m.probeAll(ctx)
+	if len(changes) != 2 || changes[1].IP != gw || !changes[1].Reachable {
+		t.Fatalf("changes = %+v; want gateway reachable again", changes)
+	}
+
+	st := m.Status()
+	if len(st) != 2 || st[0].IP != derp || st[1].IP != gw {
+		t.Fatalf("Status = %+v; want derp, gateway", st)
+	}
+	if got, want := st[0].Stats.Count, unreachableAfter+2; got != want {
+		t.Errorf("derp samples = %d; want %d", got, want)
+	}
+	if got, want := st[1].Stats.Count, 2; got != want {
+		t.Errorf("gateway samples = %d; want %d", got, want)
+	}
+	if got, want := st[1].Loss, float64(unreachableAfter)/float64(unreachableAfter+2); got != want {
+		t.Errorf("gateway loss = %v; want %v", got, want)
+	}
+
+	// Removing a target drops its state.
+	m.SetTargets([]Target{{IP: derp, Class: ClassDERP}})
+	if st := m.Status(); len(st) != 1 || st[0].Stats.Count != unreachableAfter+2 {
+		t.Errorf("after SetTargets, Status = %+v", st)
+	}
+}
+
+func TestMonitorStartClose(t *testing.T) {
+	m := NewMonitor(t.Logf, time.Hour)
+	probed := make(chan netaddr.IP, 1)
+	m.ping = func(ctx context.Context, class Class, ip netaddr.IP, opts *Options) (time.Duration, error) {
+		probed <- ip
+		return time.Millisecond, nil
+	}
+	ip := netaddr.MustParseIP("127.0.0.1")
+	m.SetTargets([]Target{{IP: ip}})
+	m.Start()
+	select {
+	case got := <-probed:
+		if got != ip {
+			t.Errorf("probed %v; want %v", got, ip)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for probe")
+	}
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Close(); err != nil {
+		t.Fatalf("second Close: %v", err)
+	}
+}
@@ -0,0 +1,284 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ping
+
+import (
+	"context"
+	crand "crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"inet.af/netaddr"
+)
+
+// nativeTimeout is how long a native probe waits for a reply when
+// its context has no deadline. It matches the timeout given to the
+// ping command by Exec.
+const nativeTimeout = 3 * time.Second
+
+const (
+	protoICMPv4 = 1  // IANA protocol number of ICMP
+	protoICMPv6 = 58 // IANA protocol number of ICMPv6
+)
+
+// protectSocket, if non-nil, is called on each ICMP socket before
+// it's used. It's set on Android to keep probes out of the tunnel.
+var protectSocket func(net.PacketConn) error
+
+// icmpConn is an ICMP socket opened by listenICMP.
+type icmpConn struct {
+	net.PacketConn
+
+	// stamped is whether the kernel attaches receive timestamps
+	// to the packets read from the socket.
+	stamped bool
+
+	// wantIPOpts is whether readMessage should save the IPv4
+	// options of the packets it reads in ipOpts, which requires a
+	// raw socket.
+	wantIPOpts bool
+	ipOpts     []byte
+}
+
+// listenICMP opens an ICMP socket of the kind used by m for the
+// address family of ip, bound to src if it's non-zero. IPv4-mapped
+// IPv6 addresses count as IPv4.
+func listenICMP(m Method, ip, src netaddr.IP) (*icmpConn, error) {
+	ip, src = ip.Unmap(), src.Unmap()
+	laddr := netaddr.IPv4(0, 0, 0, 0)
+	if ip.Is6() {
+		laddr = netaddr.IPv6Unspecified()
+	}
+	if !src.IsZero() {
+		if src.Is4() != ip.Is4() {
+			return nil, fmt.Errorf("source %v and destination %v are of different address families", src, ip)
+		}
+		laddr = src
+	}
+	var pc net.PacketConn
+	var err error
+	switch m {
+	case MethodICMPDatagram:
+		pc, err = listenDatagramICMP(laddr)
+	case MethodICMPRaw:
+		network := "ip4:icmp"
+		if ip.Is6() {
+			network = "ip6:ipv6-icmp"
+		}
+		pc, err = net.ListenPacket(network, laddr.String())
+	default:
+		return nil, fmt.Errorf("ping method %v doesn't use sockets", m)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if protectSocket != nil {
+		if err := protectSocket(pc); err != nil {
+			pc.Close()
+			return nil, err
+		}
+	}
+	c := &icmpConn{PacketConn: pc}
+	c.stamped = enableRxTimestamps(pc) == nil
+	return c, nil
+}
+
+// setTOS sets the IPv4 TOS or IPv6 Traffic Class byte (depending on
+// the address family of ip) of packets sent on c.
+func (c *icmpConn) setTOS(ip netaddr.IP, tos int) error {
+	if ip.Is4() {
+		return ipv4.NewPacketConn(c.PacketConn).SetTOS(tos)
+	}
+	return ipv6.NewPacketConn(c.PacketConn).SetTrafficClass(tos)
+}
+
+// readMessage reads the next ICMP message from c into b. It returns
+// the message's length, its sender, and when it was received: by the
+// kernel's clock if the socket has receive timestamps, or else as
+// soon as it was read.
+func (c *icmpConn) readMessage(b []byte) (n int, from net.Addr, at time.Time, err error) {
+	if !c.stamped && !c.wantIPOpts {
+		n, from, err = c.ReadFrom(b)
+		return n, from, time.Now(), err
+	}
+	var oob [128]byte
+	var oobn int
+	switch pc := c.PacketConn.(type) {
+	case *net.UDPConn:
+		n, oobn, _, from, err = pc.ReadMsgUDP(b, oob[:])
+	case *net.IPConn:
+		n, oobn, _, from, err = pc.ReadMsgIP(b, oob[:])
+		// Unlike ReadFrom, ReadMsgIP doesn't strip the IPv4
+		// header that raw IPv4 sockets deliver.
+		if err == nil && n > 0 && b[0]>>4 == 4 {
+			if hl := int(b[0]&0x0f) * 4; hl <= n {
+				if c.wantIPOpts && hl >= ipv4.HeaderLen {
+					c.ipOpts = append(c.ipOpts[:0], b[ipv4.HeaderLen:hl]...)
+				}
+				n = copy(b, b[hl:n])
+			}
+		}
+	default:
+		n, from, err = c.ReadFrom(b)
+	}
+	at = time.Now()
+	if ts, ok := rxTimestamp(oob[:oobn]); ok {
+		at = ts
+	}
+	return n, from, at, err
+}
+
+// pingNative sends a single ICMP echo request to ip over a socket of
+// the kind used by m and waits for the matching reply.
+func pingNative(ctx context.Context, m Method, ip netaddr.IP, opts *Options) (time.Duration, error) {
+	pi, err := probeNative(ctx, m, ip, opts)
+	return pi.RTT, err
+}
+
+// probeNative is pingNative, but also sends the timestamp and
+// record-route probes of PingPath and reports what they learned.
+func probeNative(ctx context.Context, m Method, ip netaddr.IP, opts *Options) (pi PathInfo, err error) {
+	ip = ip.Unmap() // an IPv4-mapped address is pinged over IPv4
+	c, err := listenICMP(m, ip, opts.source())
+	if err != nil {
+		return pi, err
+	}
+	defer c.Close()
+	if tos := opts.tos(); tos != 0 {
+		if err := c.setTOS(ip, tos); err != nil {
+			return pi, fmt.Errorf("setting DSCP: %w", err)
+		}
+	}
+	if opts != nil && opts.RecordRoute {
+		if err := setIPOptions(c.PacketConn, recordRouteOption()); err != nil {
+			return pi, fmt.Errorf("setting record-route option: %w", err)
+		}
+		c.wantIPOpts = true
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(nativeTimeout)
+	}
+	if err := c.SetDeadline(deadline); err != nil {
+		return pi, err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// Unblock the read below.
+			c.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	var rnd [4]byte
+	if _, err := crand.Read(rnd[:]); err != nil {
+		return pi, err
+	}
+	// For datagram sockets the kernel overwrites the ID with the
+	// socket's local port and only hands us replies to our own
+	// requests, so only the sequence number needs to match.
+	id := int(binary.BigEndian.Uint16(rnd[:2]))
+	seq := int(binary.BigEndian.Uint16(rnd[2:]))
+
+	var typ, replyType icmp.Type = ipv4.ICMPTypeEcho, ipv4.ICMPTypeEchoReply
+	proto := protoICMPv4
+	if ip.Is6() {
+		typ, replyType = ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply
+		proto = protoICMPv6
+	}
+	var body icmp.MessageBody = &icmp.Echo{ID: id, Seq: seq, Data: []byte("tailscale-ping")}
+	timestamp := opts != nil && opts.Timestamp
+	if timestamp {
+		typ, replyType = ipv4.ICMPTypeTimestamp, ipv4.ICMPTypeTimestampReply
+		body = &icmp.RawBody{Data: timestampRequest(id, seq, time.Now())}
+	}
+	req, err := (&icmp.Message{Type: typ, Body: body}).Marshal(nil)
+	if err != nil {
+		return pi, err
+	}
+
+	var dst net.Addr = &net.IPAddr{IP: ip.IPAddr().IP, Zone: ip.Zone()}
+	if m == MethodICMPDatagram {
+		dst = &net.UDPAddr{IP: ip.IPAddr().IP, Zone: ip.Zone()}
+	}
+
+	t0 := time.Now()
+	if _, err := c.WriteTo(req, dst); err != nil {
+		return pi, err
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, from, at, err := c.readMessage(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return pi, ctx.Err()
+			}
+			return pi, err
+		}
+		d := at.Sub(t0)
+		if now := time.Since(t0); d <= 0 || d > now {
+			// The kernel's wall clock timestamp disagrees
+			// with our monotonic one, probably because the
+			// clock was stepped. Use ours.
+			d = now
+		}
+		if !sameIP(from, ip) {
+			continue
+		}
+		msg, err := icmp.ParseMessage(proto, buf[:n])
+		if err != nil || msg.Type != replyType {
+			continue
+		}
+		var gotID, gotSeq int
+		switch b := msg.Body.(type) {
+		case *icmp.Echo:
+			gotID, gotSeq = b.ID, b.Seq
+		case *icmp.RawBody:
+			ts, ok := parseTimestampReply(b.Data)
+			if !ok {
+				continue
+			}
+			gotID, gotSeq = ts.id, ts.seq
+			pi.Timestamps = &ts.ICMPTimestamps
+		default:
+			continue
+		}
+		if gotSeq != seq || (m == MethodICMPRaw && gotID != id) {
+			pi.Timestamps = nil
+			continue
+		}
+		pi.RTT = d
+		if c.wantIPOpts {
+			pi.Route = parseRecordRoute(c.ipOpts)
+		}
+		return pi, nil
+	}
+}
+
+// sameIP reports whether addr, as returned by an ICMP socket's
+// ReadFrom, has the IP address ip, with IPv4-mapped IPv6 addresses
+// matching the IPv4 ones they map.
+func sameIP(addr net.Addr, ip netaddr.IP) bool {
+	var got net.IP
+	switch a := addr.(type) {
+	case *net.IPAddr:
+		got = a.IP
+	case *net.UDPAddr:
+		got = a.IP
+	default:
+		return false
+	}
+	gotIP, ok := netaddr.FromStdIP(got)
+	return ok && gotIP.Unmap() == ip.Unmap().WithZone("")
+}
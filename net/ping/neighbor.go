@@ -0,0 +1,192 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ping
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv6"
+	"inet.af/netaddr"
+)
+
+// errNeighborUnsupported is returned by Neighbor for IPv4 targets on
+// platforms without ARP probe support.
+var errNeighborUnsupported = errors.New("ping: ARP probes not supported on this platform")
+
+// Neighbor checks whether ip, a host on the network directly
+// attached to the interface named ifName (typically the default
+// gateway), is reachable at the link layer. It sends an ARP request
+// for IPv4 targets or an NDP neighbor solicitation for IPv6 ones and
+// reports the hardware address that answered and how long it took.
+//
+// Unlike an ICMP echo, this works even when the target drops echo
+// requests, which many home routers do. It requires the same
+// privileges as a raw ICMP socket (root or CAP_NET_RAW), and ARP
+// probes are currently only supported on Linux.
+//
+// The class is only used for metrics.
+func Neighbor(ctx context.Context, class Class, ip netaddr.IP, ifName string) (net.HardwareAddr, time.Duration, error) {
+	ifc, err := net.InterfaceByName(ifName)
+	if err != nil {
+		return nil, 0, err
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, nativeTimeout)
+		defer cancel()
+	}
+	metricSent(class).Add(1)
+	var hw net.HardwareAddr
+	var d time.Duration
+	if ip.Is4() {
+		hw, d, err = arpProbe(ctx, ifc, ip)
+	} else {
+		hw, d, err = ndpProbe(ctx, ifc, ip)
+	}
+	recordResult(class, d, err)
+	return hw, d, err
+}
+
+// interfaceIPv4 returns the IPv4 address of ifc on the same subnet as
+// ip, or else its first IPv4 address.
+func interfaceIPv4(ifc *net.Interface, ip netaddr.IP) (netaddr.IP, error) {
+	addrs, err := ifc.Addrs()
+	if err != nil {
+		return netaddr.IP{}, err
+	}
+	var first netaddr.IP
+	for _, a := range addrs {
+		ipn, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		pfx, ok := netaddr.FromStdIPNet(ipn)
+		if !ok || !pfx.IP().Is4() {
+			continue
+		}
+		if pfx.Contains(ip) {
+			return pfx.IP(), nil
+		}
+		if first.IsZero() {
+			first = pfx.IP()
+		}
+	}
+	if first.IsZero() {
+		return netaddr.IP{}, fmt.Errorf("interface %s has no IPv4 address", ifc.Name)
+	}
+	return first, nil
+}
+
+// solicitedNodeMulticast returns the solicited-node multicast address
+// for ip, per RFC 4291 section 2.7.1.
+func solicitedNodeMulticast(ip netaddr.IP) netaddr.IP {
+	a := ip.As16()
+	return netaddr.IPFrom16([16]byte{
+		0: 0xff, 1: 0x02,
+		11: 0x01, 12: 0xff,
+		13: a[13], 14: a[14], 15: a[15],
+	})
+}
+
+// ndpProbe sends an NDP neighbor solicitation for ip out of ifc and
+// waits for the matching neighbor advertisement.
+func ndpProbe(ctx context.Context, ifc *net.Interface, ip netaddr.IP) (net.HardwareAddr, time.Duration, error) {
+	c, err := icmp.ListenPacket("ip6:ipv6-icmp", "::")
+	if err != nil {
+		return nil, 0, err
+	}
+	defer c.Close()
+	pc := c.IPv6PacketConn()
+	// RFC 4861 requires a hop limit of 255 so receivers know the
+	// message wasn't forwarded.
+	if err := pc.SetMulticastHopLimit(255); err != nil {
+		return nil, 0, err
+	}
+	if err := pc.SetHopLimit(255); err != nil {
+		return nil, 0, err
+	}
+	if err := pc.SetMulticastInterface(ifc); err != nil {
+		return nil, 0, err
+	}
+	var f ipv6.ICMPFilter
+	f.SetAll(true)
+	f.Accept(ipv6.ICMPTypeNeighborAdvertisement)
+	pc.SetICMPFilter(&f) // best effort; we filter below regardless
+
+	deadline, _ := ctx.Deadline()
+	if err := c.SetDeadline(deadline); err != nil {
+		return nil, 0, err
+	}
+
+	target := ip.As16()
+	body := make([]byte, 4, 4+16+8)
+	body = append(body, target[:]...)
+	if len(ifc.HardwareAddr) == 6 {
+		// Source link-layer address option, so the target
+		// can answer without soliciting us in turn.
+		body = append(body, 1, 1)
+		body = append(body, ifc.HardwareAddr...)
+	}
+	req, err := (&icmp.Message{
+		Type: ipv6.ICMPTypeNeighborSolicitation,
+		Body: &icmp.RawBody{Data: body},
+	}).Marshal(nil) // the kernel fills in the checksum
+	if err != nil {
+		return nil, 0, err
+	}
+	dst := &net.IPAddr{IP: solicitedNodeMulticast(ip).IPAddr().IP, Zone: ifc.Name}
+
+	t0 := time.Now()
+	if _, err := c.WriteTo(req, dst); err != nil {
+		return nil, 0, err
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := c.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, 0, ctx.Err()
+			}
+			return nil, 0, err
+		}
+		d := time.Since(t0)
+		msg, err := icmp.ParseMessage(protoICMPv6, buf[:n])
+		if err != nil || msg.Type != ipv6.ICMPTypeNeighborAdvertisement {
+			continue
+		}
+		rb, ok := msg.Body.(*icmp.RawBody)
+		if !ok || len(rb.Data) < 20 {
+			continue
+		}
+		var got [16]byte
+		copy(got[:], rb.Data[4:20])
+		if got != target {
+			continue
+		}
+		return targetLinkLayerAddr(rb.Data[20:]), d, nil
+	}
+}
+
+// targetLinkLayerAddr returns the address in the target link-layer
+// address option among the NDP options in opts, or nil if there
+// isn't one.
+func targetLinkLayerAddr(opts []byte) net.HardwareAddr {
+	for len(opts) >= 8 {
+		typ, n := opts[0], int(opts[1])*8
+		if n == 0 || n > len(opts) {
+			return nil
+		}
+		if typ == 2 {
+			return net.HardwareAddr(append([]byte(nil), opts[2:8]...))
+		}
+		opts = opts[n:]
+	}
+	return nil
+}
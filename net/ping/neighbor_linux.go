@@ -0,0 +1,140 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ping
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"inet.af/netaddr"
+)
+
+// htons converts v to network byte order.
+func htons(v uint16) uint16 { return v<<8 | v>>8 }
+
+// arpProbe broadcasts an ARP request for ip out of ifc and waits for
+// the matching reply.
+func arpProbe(ctx context.Context, ifc *net.Interface, ip netaddr.IP) (net.HardwareAddr, time.Duration, error) {
+	if len(ifc.HardwareAddr) != 6 {
+		return nil, 0, errNeighborUnsupported
+	}
+	src, err := interfaceIPv4(ifc, ip)
+	if err != nil {
+		return nil, 0, err
+	}
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_DGRAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, int(htons(unix.ETH_P_ARP)))
+	if err != nil {
+		return nil, 0, os.NewSyscallError("socket", err)
+	}
+	// Wrap the socket in an *os.File so reads can use the runtime
+	// poller and deadlines.
+	f := os.NewFile(uintptr(fd), "arp")
+	defer f.Close()
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return nil, 0, err
+	}
+	sa := &unix.SockaddrLinklayer{
+		Protocol: htons(unix.ETH_P_ARP),
+		Ifindex:  ifc.Index,
+	}
+	if err := unix.Bind(fd, sa); err != nil {
+		return nil, 0, os.NewSyscallError("bind", err)
+	}
+	deadline, _ := ctx.Deadline()
+	if err := f.SetDeadline(deadline); err != nil {
+		return nil, 0, err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			f.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	req := arpRequest(ifc.HardwareAddr, src, ip)
+	bcast := &unix.SockaddrLinklayer{
+		Protocol: htons(unix.ETH_P_ARP),
+		Ifindex:  ifc.Index,
+		Halen:    6,
+		Addr:     [8]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+	}
+	t0 := time.Now()
+	var serr error
+	if err := rc.Write(func(fd uintptr) bool {
+		serr = unix.Sendto(int(fd), req, 0, bcast)
+		return serr != unix.EAGAIN
+	}); err != nil {
+		return nil, 0, err
+	}
+	if serr != nil {
+		return nil, 0, os.NewSyscallError("sendto", serr)
+	}
+
+	buf := make([]byte, 128)
+	for {
+		n, err := f.Read(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, 0, ctx.Err()
+			}
+			return nil, 0, err
+		}
+		if hw, ok := parseARPReply(buf[:n], ip); ok {
+			return hw, time.Since(t0), nil
+		}
+	}
+}
+
+// ARP packet layout for Ethernet and IPv4 (RFC 826).
+const (
+	arpLen        = 28
+	arpOpRequest  = 1
+	arpOpReply    = 2
+	arpHTEthernet = 1
+)
+
+// arpRequest returns an ARP request asking who has target, from the
+// host with hardware address hw and IPv4 address src.
+func arpRequest(hw net.HardwareAddr, src, target netaddr.IP) []byte {
+	b := make([]byte, arpLen)
+	binary.BigEndian.PutUint16(b[0:], arpHTEthernet)
+	binary.BigEndian.PutUint16(b[2:], unix.ETH_P_IP)
+	b[4] = 6 // hardware address length
+	b[5] = 4 // protocol address length
+	binary.BigEndian.PutUint16(b[6:], arpOpRequest)
+	copy(b[8:14], hw)
+	s4 := src.As4()
+	copy(b[14:18], s4[:])
+	// b[18:24], the target hardware address, is left zero.
+	t4 := target.As4()
+	copy(b[24:28], t4[:])
+	return b
+}
+
+// parseARPReply parses b as an ARP packet and, if it's a reply from
+// ip, returns the sender's hardware address.
+func parseARPReply(b []byte, ip netaddr.IP) (hw net.HardwareAddr, ok bool) {
+	if len(b) < arpLen ||
+		binary.BigEndian.Uint16(b[0:]) != arpHTEthernet ||
+		binary.BigEndian.Uint16(b[2:]) != unix.ETH_P_IP ||
+		b[4] != 6 || b[5] != 4 ||
+		binary.BigEndian.Uint16(b[6:]) != arpOpReply {
+		return nil, false
+	}
+	ip4 := ip.As4()
+	if !bytes.Equal(b[14:18], ip4[:]) {
+		return nil, false
+	}
+	return net.HardwareAddr(append([]byte(nil), b[8:14]...)), true
+}
@@ -0,0 +1,41 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ping
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+func TestARPRoundTrip(t *testing.T) {
+	hw := net.HardwareAddr{0x02, 0, 0, 0, 0, 1}
+	src := netaddr.MustParseIP("192.168.1.10")
+	gw := netaddr.MustParseIP("192.168.1.1")
+
+	req := arpRequest(hw, src, gw)
+	if _, ok := parseARPReply(req, gw); ok {
+		t.Fatal("parsed request as reply")
+	}
+
+	// Turn the request into the reply gw would send.
+	gwHW := net.HardwareAddr{0x02, 0, 0, 0, 0, 0xfe}
+	reply := append([]byte(nil), req...)
+	reply[7] = arpOpReply
+	copy(reply[8:14], gwHW)
+	copy(reply[14:18], gw.IPAddr().IP.To4())
+	copy(reply[18:24], hw)
+	copy(reply[24:28], src.IPAddr().IP.To4())
+
+	got, ok := parseARPReply(reply, gw)
+	if !ok || !bytes.Equal(got, gwHW) {
+		t.Fatalf("parseARPReply = %v, %v; want %v, true", got, ok, gwHW)
+	}
+	if _, ok := parseARPReply(reply, src); ok {
+		t.Error("matched reply from wrong IP")
+	}
+}
@@ -0,0 +1,20 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package ping
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+func arpProbe(ctx context.Context, ifc *net.Interface, ip netaddr.IP) (net.HardwareAddr, time.Duration, error) {
+	return nil, 0, errNeighborUnsupported
+}
@@ -0,0 +1,37 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ping
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+func TestSolicitedNodeMulticast(t *testing.T) {
+	got := solicitedNodeMulticast(netaddr.MustParseIP("fe80::2aa:ff:fe28:9c5a"))
+	if want := netaddr.MustParseIP("ff02::1:ff28:9c5a"); got != want {
+		t.Errorf("got %v; want %v", got, want)
+	}
+}
+
+func TestTargetLinkLayerAddr(t *testing.T) {
+	hw := net.HardwareAddr{0x02, 0, 0, 0, 0, 0xfe}
+	opts := []byte{
+		14, 1, 0, 0, 0, 0, 0, 0, // nonce option, skipped
+		2, 1, 0x02, 0, 0, 0, 0, 0xfe,
+	}
+	if got := targetLinkLayerAddr(opts); !bytes.Equal(got, hw) {
+		t.Errorf("got %v; want %v", got, hw)
+	}
+	if got := targetLinkLayerAddr(opts[:8]); got != nil {
+		t.Errorf("without option: got %v; want nil", got)
+	}
+	if got := targetLinkLayerAddr([]byte{2, 0, 1, 2, 3, 4, 5, 6}); got != nil {
+		t.Errorf("zero-length option: got %v; want nil", got)
+	}
+}
@@ -0,0 +1,43 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ping
+
+import (
+	"context"
+	"net/netip"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/util/netconv"
+)
+
+// This file has net/netip variants of the package's netaddr-based
+// API, for callers that have moved off inet.af/netaddr. They're
+// adapters for now; the netaddr versions will go away once the rest
+// of the tree has moved over.
+
+// PingAddr is like Ping but takes a netip.Addr.
+func PingAddr(ctx context.Context, class Class, ip netip.Addr) (time.Duration, error) {
+	return Ping(ctx, class, netconv.AsIP(ip))
+}
+
+// PingAddrWith is like PingWith but takes a netip.Addr.
+func PingAddrWith(ctx context.Context, class Class, ip netip.Addr, opts *Options) (time.Duration, error) {
+	return PingWith(ctx, class, netconv.AsIP(ip), opts)
+}
+
+// PingManyAddrs is like PingMany but takes netip.Addrs.
+func PingManyAddrs(ctx context.Context, p *Pacer, class Class, ips []netip.Addr) []Result {
+	conv := make([]netaddr.IP, len(ips))
+	for i, ip := range ips {
+		conv[i] = netconv.AsIP(ip)
+	}
+	return PingMany(ctx, p, class, conv)
+}
+
+// Addr returns r.IP as a netip.Addr.
+func (r Result) Addr() netip.Addr {
+	return netconv.AsAddr(r.IP)
+}
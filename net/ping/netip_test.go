@@ -0,0 +1,51 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ping
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+func TestResultAddr(t *testing.T) {
+	tests := []struct {
+		ip   netaddr.IP
+		want netip.Addr
+	}{
+		{netaddr.MustParseIP("100.64.1.2"), netip.MustParseAddr("100.64.1.2")},
+		{netaddr.MustParseIP("fe80::1%eth0"), netip.MustParseAddr("fe80::1%eth0")},
+		{netaddr.IP{}, netip.Addr{}},
+	}
+	for _, tt := range tests {
+		if got := (Result{IP: tt.ip}).Addr(); got != tt.want {
+			t.Errorf("Result{IP: %v}.Addr() = %v; want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestSameIP(t *testing.T) {
+	v4 := netaddr.IPv4(192, 0, 2, 1)
+	mapped := netaddr.IPv6Raw(v4.As16())
+	tests := []struct {
+		addr net.Addr
+		ip   netaddr.IP
+		want bool
+	}{
+		{&net.IPAddr{IP: net.IPv4(192, 0, 2, 1)}, v4, true},
+		{&net.IPAddr{IP: net.IPv4(192, 0, 2, 1)}, mapped, true},
+		{&net.UDPAddr{IP: mapped.IPAddr().IP}, v4, true},
+		{&net.IPAddr{IP: net.IPv4(192, 0, 2, 2)}, mapped, false},
+		{&net.IPAddr{IP: net.ParseIP("fe80::1"), Zone: "eth0"}, netaddr.MustParseIP("fe80::1%eth0"), true},
+		{&net.TCPAddr{IP: net.IPv4(192, 0, 2, 1)}, v4, false},
+	}
+	for _, tt := range tests {
+		if got := sameIP(tt.addr, tt.ip); got != tt.want {
+			t.Errorf("sameIP(%v, %v) = %v; want %v", tt.addr, tt.ip, got, tt.want)
+		}
+	}
+}
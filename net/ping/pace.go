@@ -0,0 +1,200 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ping
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+// Default pacing parameters. Linux limits outgoing ICMP error and
+// echo reply messages to 1000/s (net.ipv4.icmp_msgs_per_sec) with
+// small bursts, and many routers are far stricter about answering
+// echo requests addressed to themselves. Sending well below those
+// rates keeps diagnostic tooling from measuring its own rate limits.
+const (
+	DefaultPaceInterval = 50 * time.Millisecond
+	DefaultMaxBackoff   = 5 * time.Second
+)
+
+// A Pacer spaces out probes so that callers sending many of them,
+// continuously or in parallel, don't trip kernel or network ICMP rate
+// limits and then misreport the resulting drops as packet loss.
+//
+// Besides enforcing a minimum gap between probes, a Pacer backs off
+// when probes go unanswered, since rate-limited replies look exactly
+// like loss, and recovers once replies resume.
+//
+// The zero value is ready to use with the default parameters.
+// A Pacer is safe for concurrent use.
+type Pacer struct {
+	// Interval is the minimum time between any two probes sent
+	// through the Pacer. If zero, DefaultPaceInterval is used.
+	Interval time.Duration
+
+	// MaxBackoff caps the extra delay added after unanswered
+	// probes. If zero, DefaultMaxBackoff is used.
+	MaxBackoff time.Duration
+
+	mu      sync.Mutex
+	next    time.Time     // earliest time the next probe may be sent
+	backoff time.Duration // extra delay due to recent failures
+}
+
+func (p *Pacer) interval() time.Duration {
+	if p.Interval > 0 {
+		return p.Interval
+	}
+	return DefaultPaceInterval
+}
+
+func (p *Pacer) maxBackoff() time.Duration {
+	if p.MaxBackoff > 0 {
+		return p.MaxBackoff
+	}
+	return DefaultMaxBackoff
+}
+
+// Wait blocks until the caller may send its next probe or ctx is
+// done, in which case it returns ctx's error.
+func (p *Pacer) Wait(ctx context.Context) error {
+	d := p.reserve(time.Now())
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// reserve claims the next send slot and returns how long from now
+// the caller must wait for it.
+func (p *Pacer) reserve(now time.Time) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	at := p.next
+	if at.Before(now) {
+		at = now
+	}
+	p.next = at.Add(p.interval() + p.backoff)
+	return at.Sub(now)
+}
+
+// Observe informs p of the outcome of a probe it paced. Each
+// unanswered probe doubles the backoff (up to MaxBackoff) and each
+// answered one halves it.
+func (p *Pacer) Observe(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err == nil {
+		p.backoff /= 2
+		if p.backoff < p.interval() {
+			p.backoff = 0
+		}
+		return
+	}
+	if p.backoff == 0 {
+		p.backoff = p.interval()
+	} else {
+		p.backoff *= 2
+	}
+	if max := p.maxBackoff(); p.backoff > max {
+		p.backoff = max
+	}
+}
+
+// Backoff returns the extra delay p currently adds between probes
+// because of recent unanswered ones.
+func (p *Pacer) Backoff() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.backoff
+}
+
+// Result is the outcome of a single probe.
+type Result struct {
+	IP  netaddr.IP
+	RTT time.Duration // valid if Err is nil
+	Err error
+}
+
+// maxParallel is the maximum number of probes PingMany runs at once.
+const maxParallel = 10
+
+// PingMany pings each of ips once, in parallel, pacing the probes
+// with p (which may be nil to use a default Pacer). The results are
+// in the same order as ips.
+func PingMany(ctx context.Context, p *Pacer, class Class, ips []netaddr.IP) []Result {
+	if p == nil {
+		p = new(Pacer)
+	}
+	return pingPaced(ctx, p, class, ips, true)
+}
+
+// pingPaced is PingMany with a non-nil p. If observe is false,
+// unanswered probes don't make p back off, for when most are
+// expected to go unanswered.
+func pingPaced(ctx context.Context, p *Pacer, class Class, ips []netaddr.IP, observe bool) []Result {
+	res := make([]Result, len(ips))
+	sem := make(chan struct{}, maxParallel)
+	var wg sync.WaitGroup
+	for i, ip := range ips {
+		res[i].IP = ip
+		if err := p.Wait(ctx); err != nil {
+			res[i].Err = err
+			continue
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(r *Result) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			r.RTT, r.Err = Ping(ctx, class, r.IP)
+			if observe {
+				p.Observe(r.Err)
+			}
+		}(&res[i])
+	}
+	wg.Wait()
+	return res
+}
+
+// Continuous pings ip every interval and calls fn with each result.
+// It returns ctx's error once ctx is done.
+//
+// If probes go unanswered, the time between them grows (up to
+// DefaultMaxBackoff extra) so a rate-limiting host or network isn't
+// hammered. If p is non-nil, probes are additionally paced by p,
+// which may be shared with other callers.
+func Continuous(ctx context.Context, p *Pacer, class Class, ip netaddr.IP, interval time.Duration, fn func(Result)) error {
+	own := &Pacer{Interval: interval}
+	for {
+		if err := own.Wait(ctx); err != nil {
+			return err
+		}
+		if p != nil {
+			if err := p.Wait(ctx); err != nil {
+				return err
+			}
+		}
+		rtt, err := Ping(ctx, class, ip)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		own.Observe(err)
+		if p != nil {
+			p.Observe(err)
+		}
+		fn(Result{IP: ip, RTT: rtt, Err: err})
+	}
+}
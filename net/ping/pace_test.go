@@ -0,0 +1,62 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ping
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPacerReserve(t *testing.T) {
+	p := &Pacer{Interval: 100 * time.Millisecond}
+	now := time.Unix(1000, 0)
+	for i, want := range []time.Duration{0, 100 * time.Millisecond, 200 * time.Millisecond} {
+		if got := p.reserve(now); got != want {
+			t.Errorf("reserve #%d = %v; want %v", i, got, want)
+		}
+	}
+	// Once idle long enough, no wait.
+	if got := p.reserve(now.Add(time.Second)); got != 0 {
+		t.Errorf("reserve after idle = %v; want 0", got)
+	}
+}
+
+func TestPacerBackoff(t *testing.T) {
+	p := &Pacer{Interval: 100 * time.Millisecond, MaxBackoff: 500 * time.Millisecond}
+	errTimeout := errors.New("timeout")
+	for _, want := range []time.Duration{100, 200, 400, 500, 500} {
+		p.Observe(errTimeout)
+		if got := p.Backoff(); got != want*time.Millisecond {
+			t.Fatalf("backoff = %v; want %vms", got, want)
+		}
+	}
+	for _, want := range []time.Duration{250, 125, 0} {
+		p.Observe(nil)
+		if got := p.Backoff(); got != want*time.Millisecond {
+			t.Fatalf("backoff = %v; want %vms", got, want)
+		}
+	}
+
+	p.Observe(errTimeout)
+	now := time.Unix(1000, 0)
+	p.reserve(now)
+	if got, want := p.reserve(now), 200*time.Millisecond; got != want {
+		t.Errorf("reserve with backoff = %v; want %v", got, want)
+	}
+}
+
+func TestPacerWaitCanceled(t *testing.T) {
+	p := &Pacer{Interval: time.Hour}
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := p.Wait(ctx); err != nil {
+		t.Fatalf("first Wait: %v", err)
+	}
+	cancel()
+	if err := p.Wait(ctx); err != context.Canceled {
+		t.Fatalf("second Wait = %v; want context.Canceled", err)
+	}
+}
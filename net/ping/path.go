@@ -0,0 +1,166 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ping
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+// PathInfo is what a probe sent by PingPath learned about the path
+// to its target.
+type PathInfo struct {
+	// RTT is the round-trip time of the probe.
+	RTT time.Duration
+
+	// Route is the addresses recorded by routers on the way to the
+	// target and back, in order, if Options.RecordRoute was set.
+	// It's at most nine long, so on longer paths it may not reach
+	// the target, let alone come back.
+	Route []netaddr.IP
+
+	// Timestamps are from the target's reply, if Options.Timestamp
+	// was set.
+	Timestamps *ICMPTimestamps
+}
+
+// ICMPTimestamps are the times in an ICMP timestamp reply, in
+// milliseconds since midnight UTC (RFC 792). A time with its high bit
+// set is in a unit of the sender's choosing, which usually means its
+// clock isn't synchronized to UTC.
+type ICMPTimestamps struct {
+	Originate uint32 // when we sent the request, by our clock
+	Receive   uint32 // when the target received it, by its clock
+	Transmit  uint32 // when the target replied, by its clock
+}
+
+var (
+	errPathIPv6   = errors.New("ping: timestamp and record-route probes are IPv4-only")
+	errPathNoRaw  = errors.New("ping: timestamp and record-route probes need a raw ICMP socket")
+	errPathNoOpts = errors.New("ping: PingPath needs Options.Timestamp or Options.RecordRoute")
+)
+
+// PingPath sends a single ICMP timestamp request or record-route
+// probe to ip, as asked for by opts, and reports what it learned
+// about the path, for advanced path debugging.
+//
+// These probes are IPv4-only and are only sent by the native backend
+// over a raw ICMP socket, which generally requires root or
+// CAP_NET_RAW; otherwise PingPath returns an error without probing.
+// Many routers drop packets with IP options and many hosts don't
+// answer timestamp requests, so a lost probe says little about
+// whether the path works.
+//
+// The class is only used for metrics.
+func PingPath(ctx context.Context, class Class, ip netaddr.IP, opts *Options) (PathInfo, error) {
+	if !opts.wantsPath() {
+		return PathInfo{}, errPathNoOpts
+	}
+	if !ip.Is4() {
+		return PathInfo{}, errPathIPv6
+	}
+	if !Selected().Caps.IPv4.Raw {
+		return PathInfo{}, errPathNoRaw
+	}
+	metricSent(class).Add(1)
+	pi, err := probeNative(ctx, MethodICMPRaw, ip, opts)
+	recordResult(class, pi.RTT, err)
+	logProbe(class, MethodICMPRaw, ip, pi.RTT, err)
+	return pi, err
+}
+
+const (
+	ipOptEOL         = 0 // end of option list
+	ipOptNOP         = 1 // no operation
+	ipOptRecordRoute = 7
+
+	// recordRouteSlots is how many addresses fit in a record-route
+	// option, whose length is a byte and which must leave room in
+	// the 40 bytes of options for the 3 byte option header.
+	recordRouteSlots = 9
+)
+
+// recordRouteOption returns an empty IPv4 record-route option with
+// room for recordRouteSlots addresses, padded to a multiple of 4
+// bytes.
+func recordRouteOption() []byte {
+	b := make([]byte, 40)
+	b[0] = ipOptRecordRoute
+	b[1] = 3 + 4*recordRouteSlots
+	b[2] = 4 // pointer to the first empty slot, 1-based
+	return b
+}
+
+// parseRecordRoute returns the addresses recorded in the
+// record-route option among the IPv4 options opts, if any.
+func parseRecordRoute(opts []byte) []netaddr.IP {
+	for len(opts) > 0 {
+		switch opts[0] {
+		case ipOptEOL:
+			return nil
+		case ipOptNOP:
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || int(opts[1]) < 2 || int(opts[1]) > len(opts) {
+			return nil
+		}
+		opt := opts[:opts[1]]
+		opts = opts[opts[1]:]
+		if opt[0] != ipOptRecordRoute || len(opt) < 3 {
+			continue
+		}
+		end := int(opt[2]) - 1 // the pointer is 1-based
+		if end > len(opt) {
+			end = len(opt)
+		}
+		var ips []netaddr.IP
+		for i := 3; i+4 <= end; i += 4 {
+			ips = append(ips, netaddr.IPv4(opt[i], opt[i+1], opt[i+2], opt[i+3]))
+		}
+		return ips
+	}
+	return nil
+}
+
+// timestampRequest returns the body of an ICMP timestamp request
+// sent at now.
+func timestampRequest(id, seq int, now time.Time) []byte {
+	b := make([]byte, 16)
+	binary.BigEndian.PutUint16(b[0:], uint16(id))
+	binary.BigEndian.PutUint16(b[2:], uint16(seq))
+	binary.BigEndian.PutUint32(b[4:], msSinceMidnightUTC(now))
+	return b
+}
+
+// msSinceMidnightUTC returns the ICMP timestamp for t.
+func msSinceMidnightUTC(t time.Time) uint32 {
+	t = t.UTC()
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	return uint32(t.Sub(midnight) / time.Millisecond)
+}
+
+// timestampReply is a parsed ICMP timestamp reply body.
+type timestampReply struct {
+	id, seq int
+	ICMPTimestamps
+}
+
+// parseTimestampReply parses the body of an ICMP timestamp reply.
+func parseTimestampReply(b []byte) (r timestampReply, ok bool) {
+	if len(b) < 16 {
+		return r, false
+	}
+	r.id = int(binary.BigEndian.Uint16(b[0:]))
+	r.seq = int(binary.BigEndian.Uint16(b[2:]))
+	r.Originate = binary.BigEndian.Uint32(b[4:])
+	r.Receive = binary.BigEndian.Uint32(b[8:])
+	r.Transmit = binary.BigEndian.Uint32(b[12:])
+	return r, true
+}
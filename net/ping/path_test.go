@@ -0,0 +1,72 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ping
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+func TestParseRecordRoute(t *testing.T) {
+	full := recordRouteOption()
+	full[2] = 4 + 4*2
+	copy(full[3:], []byte{10, 0, 0, 1, 192, 0, 2, 1})
+
+	tests := []struct {
+		name string
+		opts []byte
+		want []netaddr.IP
+	}{
+		{"none", nil, nil},
+		{"empty", recordRouteOption(), nil},
+		{"two", full, []netaddr.IP{netaddr.IPv4(10, 0, 0, 1), netaddr.IPv4(192, 0, 2, 1)}},
+		{"after-nop", append([]byte{ipOptNOP}, full[:39]...), []netaddr.IP{netaddr.IPv4(10, 0, 0, 1), netaddr.IPv4(192, 0, 2, 1)}},
+		{"truncated", full[:5], nil},
+		{"other-option", []byte{68, 4, 5, 0}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseRecordRoute(tt.opts); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTimestampRequest(t *testing.T) {
+	now := time.Date(2022, 6, 1, 1, 2, 3, 4e6, time.UTC)
+	b := timestampRequest(0x1234, 0x5678, now)
+	r, ok := parseTimestampReply(b)
+	if !ok {
+		t.Fatal("can't parse request as reply")
+	}
+	want := timestampReply{
+		id:             0x1234,
+		seq:            0x5678,
+		ICMPTimestamps: ICMPTimestamps{Originate: 3723004},
+	}
+	if r != want {
+		t.Errorf("got %+v; want %+v", r, want)
+	}
+	if _, ok := parseTimestampReply(b[:15]); ok {
+		t.Error("parsed short reply")
+	}
+}
+
+func TestPingPathErrors(t *testing.T) {
+	ctx := context.Background()
+	v4 := netaddr.MustParseIP("192.0.2.1")
+	if _, err := PingPath(ctx, ClassOther, v4, nil); err != errPathNoOpts {
+		t.Errorf("nil opts: err = %v; want %v", err, errPathNoOpts)
+	}
+	v6 := netaddr.MustParseIP("2001:db8::1")
+	if _, err := PingPath(ctx, ClassOther, v6, &Options{Timestamp: true}); err != errPathIPv6 {
+		t.Errorf("IPv6: err = %v; want %v", err, errPathIPv6)
+	}
+}
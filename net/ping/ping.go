@@ -0,0 +1,397 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package ping sends ICMP echo requests ("pings") to hosts and reports
+// whether and how quickly they answered.
+//
+// It's used in userspace/netstack mode, where the host's network
+// stack isn't answering pings for us. Depending on the platform and
+// what the process is permitted to do (see Selected), it sends pings
+// using the OS's ICMP API on Windows, over an unprivileged ICMP
+// datagram socket or a raw ICMP socket, or by running the system's
+// ping command. If it can do none of those, diagnostics that ask for it
+// (see Options.AllowTCP) time TCP connection attempts instead.
+package ping
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/net/interfaces"
+	"tailscale.com/version/distro"
+)
+
+// Class is the kind of host being probed. It's only used to bucket
+// metrics, so operators can tell the health of the local network
+// (gateway) apart from the paths to DERP servers and peers.
+type Class uint8
+
+const (
+	ClassOther   Class = iota // none of the below; e.g. a subnet-routed host
+	ClassGateway              // the default gateway of the local network
+	ClassDERP                 // a DERP server
+	ClassPeer                 // a Tailscale peer
+
+	numClasses = iota
+)
+
+func (c Class) String() string {
+	switch c {
+	case ClassGateway:
+		return "gateway"
+	case ClassDERP:
+		return "derp"
+	case ClassPeer:
+		return "peer"
+	}
+	return "other"
+}
+
+// setAmbientCapsRaw is non-nil on Linux, to run ping with CAP_NET_RAW
+// from tailscaled's binary.
+var setAmbientCapsRaw func(*exec.Cmd)
+
+// havePermittedCapNetRaw is non-nil on Linux and reports whether
+// CAP_NET_RAW is in the process's permitted set.
+var havePermittedCapNetRaw func() bool
+
+var isSynology = runtime.GOOS == "linux" && distro.Get() == distro.Synology
+
+var (
+	ambientCapsOnce sync.Once
+	ambientCaps     bool
+)
+
+// wantAmbientCapsRaw reports whether child ping processes need to be
+// given CAP_NET_RAW as an ambient capability.
+//
+// That's the case when tailscaled runs as non-root but was granted
+// the capability, either with file capabilities on its binary (as
+// Synology DSM7 and QNAP packages do, as well as other non-root
+// packagings) or with systemd's AmbientCapabilities. A setuid or
+// file-capability ping binary wouldn't need this, but one that relies
+// on inheriting capabilities from its parent does.
+func wantAmbientCapsRaw() bool {
+	ambientCapsOnce.Do(func() {
+		ambientCaps = setAmbientCapsRaw != nil &&
+			havePermittedCapNetRaw != nil &&
+			os.Getuid() != 0 &&
+			havePermittedCapNetRaw()
+	})
+	return ambientCaps
+}
+
+// Options are optional parameters for PingWith.
+type Options struct {
+	// Source, if non-zero, is the local address to send probes
+	// from. It must be of the same address family as the target.
+	Source netaddr.IP
+
+	// Interface, if non-empty, is the name of the network
+	// interface to send probes over. It's only honored by the
+	// ping command on platforms whose ping can bind to an
+	// interface (Linux, Android and macOS); everywhere else, and
+	// for native sockets, probes are bound to Source instead, so
+	// callers should set both.
+	Interface string
+
+	// DSCP, if non-zero, is the Differentiated Services Code
+	// Point (0-63) to mark probes with, so callers can see how a
+	// path treats traffic of a particular class, such as
+	// Expedited Forwarding (46) for latency-sensitive traffic.
+	// It's not supported by the ping command on Windows.
+	DSCP uint8
+
+	// Timestamp, if true, sends an ICMP timestamp request rather
+	// than an echo request, so the target reports when it received
+	// the probe and when it replied, by its own clock. See PingPath.
+	Timestamp bool
+
+	// RecordRoute, if true, sends the probe with the IPv4
+	// record-route option, asking each router on the way to the
+	// target and back (up to nine in all) to record its address.
+	// See PingPath.
+	RecordRoute bool
+
+	// AllowTCP, if true, lets the probe be a TCP connection attempt
+	// (MethodTCP) if the process can't send pings. That's only for
+	// diagnostics: a TCP probe isn't a ping, and a refused connection
+	// counts as an answer. Without it, PingWith fails with a
+	// *CapabilityError instead.
+	AllowTCP bool
+}
+
+// wantsPath reports whether opts asks for a probe only PingPath can
+// send.
+func (o *Options) wantsPath() bool {
+	return o != nil && (o.Timestamp || o.RecordRoute)
+}
+
+// tos returns the IPv4 TOS or IPv6 Traffic Class byte carrying the
+// DSCP in opts, or zero if none.
+func (o *Options) tos() int {
+	if o == nil {
+		return 0
+	}
+	return int(o.DSCP&0x3f) << 2
+}
+
+func (o *Options) source() netaddr.IP {
+	if o == nil {
+		return netaddr.IP{}
+	}
+	return o.Source
+}
+
+func (o *Options) allowTCP() bool {
+	return o != nil && o.AllowTCP
+}
+
+func (o *Options) iface() string {
+	if o == nil {
+		return ""
+	}
+	return o.Interface
+}
+
+// ViaTailscale returns Options to probe dst over this machine's
+// Tailscale interface (e.g. tailscale0 or utun3), from its Tailscale
+// address of the same family as dst. Probing with them verifies
+// in-tunnel ICMP reachability separately from the physical path.
+//
+// It returns an error if there's no Tailscale interface or it has
+// no address of the right family.
+func ViaTailscale(dst netaddr.IP) (*Options, error) {
+	ips, ifc, err := interfaces.Tailscale()
+	if err != nil {
+		return nil, err
+	}
+	if ifc == nil {
+		return nil, errors.New("no Tailscale interface found")
+	}
+	for _, ip := range ips {
+		if ip.Is4() == dst.Is4() {
+			return &Options{Source: ip, Interface: ifc.Name}, nil
+		}
+	}
+	return nil, fmt.Errorf("Tailscale interface %s has no address of the same family as %v", ifc.Name, dst)
+}
+
+// Exec pings ip once by running the system's ping command and
+// reports how long it took to get a reply. The command gives up
+// after about 3 seconds without one.
+//
+// The returned duration is the wall time of the child process, so
+// it includes the cost of starting ping in addition to the network
+// round trip. Most callers should use Ping instead, which only falls
+// back to running ping when the process can't send ICMP itself.
+//
+// If there's no ping command, as in many minimal containers, Exec
+// uses whichever Method Ping would instead, and like Ping, fails with
+// a *CapabilityError if that's MethodTCP.
+//
+// The class is only used for metrics.
+func Exec(ctx context.Context, class Class, ip netaddr.IP) (time.Duration, error) {
+	m := MethodExec
+	s := Selected()
+	if s.Caps.PingBinary == "" {
+		m = s.MethodFor(ip)
+	}
+	if m == MethodTCP {
+		return 0, s.errFor(ip)
+	}
+	return pingMethod(ctx, m, class, ip, nil)
+}
+
+var (
+	commandRunnerMu sync.Mutex
+	commandRunner   func(ctx context.Context, name string, args []string) error
+)
+
+// SetCommandRunner registers a func that runs the ping command on
+// behalf of Exec (and Ping, when it falls back to the command),
+// instead of the process running it directly.
+//
+// This is for sandboxed platforms where tailscaled may not exec
+// programs itself, such as macOS network extensions or snap
+// confinement, and must ask a broker to do it. The func must run the
+// named program with args, return a nil error only if it exited
+// successfully, and kill it if ctx is done first. The ping command
+// is then assumed to exist even if it isn't found in the process's
+// PATH.
+//
+// It must be called before the first probe. A nil func restores the
+// default of running the command directly.
+func SetCommandRunner(f func(ctx context.Context, name string, args []string) error) {
+	commandRunnerMu.Lock()
+	defer commandRunnerMu.Unlock()
+	commandRunner = f
+}
+
+func getCommandRunner() func(ctx context.Context, name string, args []string) error {
+	commandRunnerMu.Lock()
+	defer commandRunnerMu.Unlock()
+	return commandRunner
+}
+
+// execDeadline is how long runExec lets the ping command run before
+// killing it. The command itself gives up after about 3 seconds, but
+// it can hang well past that, such as on unreachable multicast routes
+// or in broken network namespaces. It's a var for tests.
+var execDeadline = 5 * time.Second
+
+// execTimeoutError is the error from runExec when the ping command
+// didn't exit by execDeadline and was killed.
+type execTimeoutError struct{}
+
+func (execTimeoutError) Error() string {
+	return fmt.Sprintf("ping command didn't exit within %v", execDeadline)
+}
+
+// Timeout reports true, so execTimeoutError classifies as a timeout
+// like the native backends' timeouts do.
+func (execTimeoutError) Timeout() bool { return true }
+
+// Is makes errors.Is(err, os.ErrDeadlineExceeded) true, as it is for
+// timeouts of the native backends.
+func (execTimeoutError) Is(target error) bool { return target == os.ErrDeadlineExceeded }
+
+// runExec runs the system's ping command once against ip, killing it
+// (and anything it started) if it's still running after execDeadline
+// or when ctx is done.
+func runExec(ctx context.Context, ip netaddr.IP, opts *Options) (time.Duration, error) {
+	parent := ctx
+	ctx, cancel := context.WithTimeout(ctx, execDeadline)
+	defer cancel()
+	// execErr returns err, or a better one if ctx expired.
+	execErr := func(err error) error {
+		if ctx.Err() == nil {
+			return err
+		}
+		if parent.Err() != nil {
+			return parent.Err()
+		}
+		return execTimeoutError{}
+	}
+
+	if run := getCommandRunner(); run != nil {
+		name, args := pingArgs(runtime.GOOS, ip, opts)
+		t0 := time.Now()
+		err := run(ctx, name, args)
+		d := time.Since(t0)
+		if err != nil {
+			return d, execErr(err)
+		}
+		return d, nil
+	}
+
+	cmd := pingCommand(ip, opts)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	t0 := time.Now()
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		killProcessGroup(cmd)
+		<-done
+		err = execErr(nil)
+	}
+	d := time.Since(t0)
+	if err != nil {
+		return d, &execError{err: err, firstLine: firstLine(out.Bytes())}
+	}
+	return d, nil
+}
+
+// pingCommand returns the command to ping ip once on the current
+// platform, in its own process group where there are such things.
+func pingCommand(ip netaddr.IP, opts *Options) *exec.Cmd {
+	name, args := pingArgs(runtime.GOOS, ip, opts)
+	cmd := exec.Command(name, args...)
+	if runtime.GOOS == "linux" && wantAmbientCapsRaw() {
+		// We run as non-root (e.g. on DSM7) and need to pass
+		// CAP_NET_RAW along since we have it.
+		setAmbientCapsRaw(cmd)
+	}
+	setProcessGroup(cmd)
+	return cmd
+}
+
+// pingArgs returns the command name and arguments to ping ip once on
+// goos, waiting about 3 seconds for a reply.
+func pingArgs(goos string, ip netaddr.IP, opts *Options) (name string, args []string) {
+	src, ifc := opts.source(), opts.iface()
+	switch goos {
+	case "windows":
+		args = []string{"-n", "1", "-w", "3000"}
+		if !src.IsZero() {
+			args = append(args, "-S", src.String())
+		}
+		return "ping", append(args, ip.String())
+	case "darwin":
+		// Note: 2000 ms is actually 1 second + 2,000
+		// milliseconds extra for 3 seconds total.
+		// See https://github.com/tailscale/tailscale/pull/3753 for details.
+		args = []string{"-c", "1", "-W", "2000"}
+		if ifc != "" {
+			args = append(args, "-b", ifc)
+		}
+		if tos := opts.tos(); tos != 0 {
+			args = append(args, "-z", strconv.Itoa(tos))
+		}
+		if !src.IsZero() {
+			args = append(args, "-S", src.String())
+		}
+		return "ping", append(args, ip.String())
+	case "android":
+		name = "/system/bin/ping"
+		if ip.Is6() {
+			name = "/system/bin/ping6"
+		}
+		args = []string{"-c", "1", "-w", "3"}
+	case "linux":
+		name = "ping"
+		if isSynology {
+			name = "/bin/ping"
+		}
+		args = []string{"-c", "1", "-W", "3"}
+	default:
+		name = "ping"
+		args = []string{"-c", "1", "-W", "3"}
+		if !src.IsZero() {
+			args = append(args, "-S", src.String())
+		}
+		if tos := opts.tos(); tos != 0 {
+			args = append(args, "-z", strconv.Itoa(tos))
+		}
+		return name, append(args, ip.String())
+	}
+	if tos := opts.tos(); tos != 0 {
+		args = append(args, "-Q", strconv.Itoa(tos))
+	}
+	// Linux and Android (iputils, toybox and busybox) ping take
+	// either an interface name or a source address for -I.
+	if ifc != "" {
+		args = append(args, "-I", ifc)
+	} else if !src.IsZero() {
+		args = append(args, "-I", src.String())
+	}
+	return name, append(args, ip.String())
+}
@@ -0,0 +1,35 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ping
+
+import (
+	"os/exec"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+func init() {
+	setAmbientCapsRaw = func(cmd *exec.Cmd) {
+		if cmd.SysProcAttr == nil {
+			cmd.SysProcAttr = new(syscall.SysProcAttr)
+		}
+		cmd.SysProcAttr.AmbientCaps = []uintptr{unix.CAP_NET_RAW}
+	}
+	havePermittedCapNetRaw = linuxHavePermittedCapNetRaw
+}
+
+// linuxHavePermittedCapNetRaw reports whether CAP_NET_RAW is in the
+// process's permitted capability set, which is what's required to
+// raise it as an ambient capability for child processes.
+func linuxHavePermittedCapNetRaw() bool {
+	hdr := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	var data [2]unix.CapUserData
+	if err := unix.Capget(&hdr, &data[0]); err != nil {
+		return false
+	}
+	const bit = unix.CAP_NET_RAW
+	return data[bit/32].Permitted&(1<<(bit%32)) != 0
+}
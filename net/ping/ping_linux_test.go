@@ -0,0 +1,58 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ping
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+func TestHavePermittedCapNetRaw(t *testing.T) {
+	got := linuxHavePermittedCapNetRaw()
+	t.Logf("CAP_NET_RAW permitted: %v", got)
+	if os.Getuid() == 0 && !got {
+		// Root normally has every capability, but not in
+		// some restricted containers.
+		t.Skip("running as root without CAP_NET_RAW")
+	}
+	if os.Getuid() == 0 && wantAmbientCapsRaw() {
+		t.Error("wantAmbientCapsRaw = true for root")
+	}
+}
+
+func TestRxTimestamps(t *testing.T) {
+	lo := netaddr.IPv4(127, 0, 0, 1)
+	for _, m := range []Method{MethodICMPDatagram, MethodICMPRaw} {
+		c, err := listenICMP(m, lo, netaddr.IP{})
+		if err != nil {
+			t.Logf("skipping %v: %v", m, err)
+			continue
+		}
+		if !c.stamped {
+			t.Errorf("%v socket lacks receive timestamps", m)
+		}
+		c.Close()
+	}
+}
+
+func TestPingNativeMapped(t *testing.T) {
+	// An IPv4-mapped address is pinged over IPv4, and its reply,
+	// from the plain IPv4 address, is matched to the request.
+	mapped := netaddr.IPv6Raw(netaddr.IPv4(127, 0, 0, 1).As16())
+	for _, m := range []Method{MethodICMPDatagram, MethodICMPRaw} {
+		c, err := listenICMP(m, mapped, mapped)
+		if err != nil {
+			t.Logf("skipping %v: %v", m, err)
+			continue
+		}
+		c.Close()
+		if _, err := pingNative(context.Background(), m, mapped, nil); err != nil {
+			t.Errorf("%v: %v", m, err)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ping
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"runtime"
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+func TestPingArgs(t *testing.T) {
+	v4 := netaddr.MustParseIP("100.101.102.103")
+	v6 := netaddr.MustParseIP("fd7a:115c:a1e0::1")
+	src := netaddr.MustParseIP("100.64.0.1")
+	tsOpts := &Options{Source: src, Interface: "tailscale0"}
+	tests := []struct {
+		goos     string
+		ip       netaddr.IP
+		opts     *Options
+		wantName string
+		wantArgs []string
+	}{
+		{"linux", v4, nil, "ping", []string{"-c", "1", "-W", "3", "100.101.102.103"}},
+		{"linux", v4, tsOpts, "ping", []string{"-c", "1", "-W", "3", "-I", "tailscale0", "100.101.102.103"}},
+		{"linux", v4, &Options{Source: src}, "ping", []string{"-c", "1", "-W", "3", "-I", "100.64.0.1", "100.101.102.103"}},
+		{"android", v6, nil, "/system/bin/ping6", []string{"-c", "1", "-w", "3", "fd7a:115c:a1e0::1"}},
+		{"darwin", v4, nil, "ping", []string{"-c", "1", "-W", "2000", "100.101.102.103"}},
+		{"darwin", v4, &Options{Source: src, Interface: "utun3"}, "ping", []string{"-c", "1", "-W", "2000", "-b", "utun3", "-S", "100.64.0.1", "100.101.102.103"}},
+		{"windows", v4, tsOpts, "ping", []string{"-n", "1", "-w", "3000", "-S", "100.64.0.1", "100.101.102.103"}},
+		{"freebsd", v4, tsOpts, "ping", []string{"-c", "1", "-W", "3", "-S", "100.64.0.1", "100.101.102.103"}},
+		{"linux", v4, &Options{DSCP: 46}, "ping", []string{"-c", "1", "-W", "3", "-Q", "184", "100.101.102.103"}},
+		{"darwin", v4, &Options{DSCP: 46}, "ping", []string{"-c", "1", "-W", "2000", "-z", "184", "100.101.102.103"}},
+		{"windows", v4, &Options{DSCP: 46}, "ping", []string{"-n", "1", "-w", "3000", "100.101.102.103"}},
+	}
+	for _, tt := range tests {
+		name, args := pingArgs(tt.goos, tt.ip, tt.opts)
+		if name != tt.wantName || !reflect.DeepEqual(args, tt.wantArgs) {
+			t.Errorf("pingArgs(%q, %v, %+v) = %q, %q; want %q, %q", tt.goos, tt.ip, tt.opts, name, args, tt.wantName, tt.wantArgs)
+		}
+	}
+}
+
+func TestSetCommandRunner(t *testing.T) {
+	ip := netaddr.MustParseIP("100.101.102.103")
+	var gotName string
+	var gotArgs []string
+	errExit := errors.New("exit status 1")
+	fail := false
+	SetCommandRunner(func(ctx context.Context, name string, args []string) error {
+		gotName, gotArgs = name, args
+		if fail {
+			return errExit
+		}
+		return nil
+	})
+	defer SetCommandRunner(nil)
+
+	// Call runExec rather than Exec, which doesn't run the command
+	// if Selected found no ping command before the runner was set.
+	if _, err := runExec(context.Background(), ip, nil); err != nil {
+		t.Fatalf("runExec: %v", err)
+	}
+	wantName, wantArgs := pingArgs(runtime.GOOS, ip, nil)
+	if gotName != wantName || !reflect.DeepEqual(gotArgs, wantArgs) {
+		t.Errorf("ran %q %q; want %q %q", gotName, gotArgs, wantName, wantArgs)
+	}
+
+	fail = true
+	if _, err := runExec(context.Background(), ip, nil); err != errExit {
+		t.Errorf("runExec = %v; want %v", err, errExit)
+	}
+}
+
+func TestRunExecCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	SetCommandRunner(func(ctx context.Context, name string, args []string) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	defer SetCommandRunner(nil)
+	_, err := runExec(ctx, netaddr.MustParseIP("192.0.2.1"), nil)
+	if err != context.Canceled {
+		t.Errorf("err = %v; want context.Canceled", err)
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ping
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+// Ranked is how well one candidate address did in Rank.
+type Ranked struct {
+	IP       netaddr.IP
+	Sent     int           // number of probes sent
+	Received int           // number of probes that got a reply
+	RTT      time.Duration // median RTT of the replies; zero if none
+}
+
+// Loss returns the fraction of r's probes that went unanswered.
+func (r Ranked) Loss() float64 {
+	if r.Sent == 0 {
+		return 1
+	}
+	return float64(r.Sent-r.Received) / float64(r.Sent)
+}
+
+// Rank probes each of candidates, which are alternative addresses for
+// the same host (such as a DERP server's IPs or a peer's endpoints),
+// the given number of times and returns them best first.
+//
+// Candidates are ordered by loss, then by median RTT. Ties keep the
+// order of candidates, so callers can pass them in order of
+// preference. Candidates that never replied are last.
+//
+// The probes of each round are sent in parallel and paced with p,
+// which may be nil to use a default Pacer. The class is only used for
+// metrics.
+func Rank(ctx context.Context, p *Pacer, class Class, candidates []netaddr.IP, probes int) []Ranked {
+	if p == nil {
+		p = new(Pacer)
+	}
+	if probes < 1 {
+		probes = 1
+	}
+	rtts := make([][]time.Duration, len(candidates))
+	ret := make([]Ranked, len(candidates))
+	for i, ip := range candidates {
+		ret[i].IP = ip
+	}
+	for n := 0; n < probes && ctx.Err() == nil; n++ {
+		for i, res := range PingMany(ctx, p, class, candidates) {
+			if ctx.Err() != nil {
+				// Don't count probes cut short as lost.
+				break
+			}
+			ret[i].Sent++
+			if res.Err == nil {
+				ret[i].Received++
+				rtts[i] = append(rtts[i], res.RTT)
+			}
+		}
+	}
+	for i := range ret {
+		if len(rtts[i]) > 0 {
+			sort.Slice(rtts[i], func(a, b int) bool { return rtts[i][a] < rtts[i][b] })
+			ret[i].RTT = percentile(rtts[i], 50)
+		}
+	}
+	sortRanked(ret)
+	return ret
+}
+
+// sortRanked sorts rs best first, as documented on Rank.
+func sortRanked(rs []Ranked) {
+	sort.SliceStable(rs, func(i, j int) bool {
+		a, b := rs[i], rs[j]
+		if (a.Received == 0) != (b.Received == 0) {
+			return b.Received == 0
+		}
+		if la, lb := a.Loss(), b.Loss(); la != lb {
+			return la < lb
+		}
+		return a.RTT < b.RTT
+	})
+}
@@ -0,0 +1,48 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ping
+
+import (
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+func TestSortRanked(t *testing.T) {
+	ms := time.Millisecond
+	rs := []Ranked{
+		{IP: netaddr.MustParseIP("10.0.0.1"), Sent: 4, Received: 0},
+		{IP: netaddr.MustParseIP("10.0.0.2"), Sent: 4, Received: 3, RTT: 5 * ms},
+		{IP: netaddr.MustParseIP("10.0.0.3"), Sent: 4, Received: 4, RTT: 50 * ms},
+		{IP: netaddr.MustParseIP("10.0.0.4"), Sent: 4, Received: 4, RTT: 20 * ms},
+		{IP: netaddr.MustParseIP("10.0.0.5"), Sent: 4, Received: 4, RTT: 20 * ms},
+		{IP: netaddr.MustParseIP("10.0.0.6"), Sent: 0},
+	}
+	sortRanked(rs)
+	want := []string{"10.0.0.4", "10.0.0.5", "10.0.0.3", "10.0.0.2", "10.0.0.1", "10.0.0.6"}
+	for i, r := range rs {
+		if r.IP.String() != want[i] {
+			t.Errorf("rank %d = %v; want %v", i, r.IP, want[i])
+		}
+	}
+}
+
+func TestRankedLoss(t *testing.T) {
+	tests := []struct {
+		r    Ranked
+		want float64
+	}{
+		{Ranked{}, 1},
+		{Ranked{Sent: 4}, 1},
+		{Ranked{Sent: 4, Received: 3}, 0.25},
+		{Ranked{Sent: 4, Received: 4}, 0},
+	}
+	for _, tt := range tests {
+		if got := tt.r.Loss(); got != tt.want {
+			t.Errorf("%+v.Loss() = %v; want %v", tt.r, got, tt.want)
+		}
+	}
+}
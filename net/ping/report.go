@@ -0,0 +1,111 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ping
+
+import (
+	"sort"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+// MarshalText implements encoding.TextMarshaler.
+func (c Class) MarshalText() ([]byte, error) { return []byte(c.String()), nil }
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+// Unknown names decode as ClassOther.
+func (c *Class) UnmarshalText(b []byte) error {
+	for v := Class(0); v < numClasses; v++ {
+		if v.String() == string(b) {
+			*c = v
+			return nil
+		}
+	}
+	*c = ClassOther
+	return nil
+}
+
+// ProbeReport is the outcome of a single probe, in a form suitable
+// for JSON output (e.g. from the LocalAPI or the CLI).
+type ProbeReport struct {
+	// Seq is the probe's position in its run, starting at 1.
+	Seq int
+
+	// LatencySeconds is the round-trip time, if the probe got a
+	// reply.
+	LatencySeconds float64 `json:",omitempty"`
+
+	// Err is why the probe failed, if it did.
+	Err string `json:",omitempty"`
+}
+
+// Report summarizes one or more probes of a single target, in a form
+// suitable for JSON output (e.g. from the LocalAPI or the CLI).
+//
+// Use NewReport and Add to build one from Results.
+type Report struct {
+	IP     netaddr.IP // the probed address
+	Class  Class      // the kind of target, as a string like "gateway"
+	Method Method     // how the probes were sent, as a string like "icmp-raw"
+
+	Sent     int // number of probes sent
+	Received int // number of probes that got a reply
+
+	// Loss is the fraction of probes without a reply, from 0 to 1.
+	Loss float64
+
+	// The following summarize the latencies of the probes that
+	// got replies. They're omitted if none did.
+	MinLatencySeconds  float64 `json:",omitempty"`
+	MeanLatencySeconds float64 `json:",omitempty"`
+	MaxLatencySeconds  float64 `json:",omitempty"`
+	P50LatencySeconds  float64 `json:",omitempty"`
+	P95LatencySeconds  float64 `json:",omitempty"`
+
+	// Probes are the individual probe outcomes, in order.
+	Probes []ProbeReport `json:",omitempty"`
+
+	rtts []time.Duration // latencies of replies, sorted
+}
+
+// NewReport returns an empty Report for probes of ip, which is of the
+// given class, sent using the Method that Ping selects for it.
+func NewReport(class Class, ip netaddr.IP) *Report {
+	return &Report{
+		IP:     ip,
+		Class:  class,
+		Method: Selected().MethodFor(ip),
+	}
+}
+
+// Add adds the outcome of another probe to r and updates its summary.
+func (r *Report) Add(res Result) {
+	r.Sent++
+	pr := ProbeReport{Seq: r.Sent}
+	if res.Err != nil {
+		pr.Err = res.Err.Error()
+	} else {
+		r.Received++
+		pr.LatencySeconds = res.RTT.Seconds()
+		i := sort.Search(len(r.rtts), func(i int) bool { return r.rtts[i] > res.RTT })
+		r.rtts = append(r.rtts, 0)
+		copy(r.rtts[i+1:], r.rtts[i:])
+		r.rtts[i] = res.RTT
+	}
+	r.Probes = append(r.Probes, pr)
+	r.Loss = float64(r.Sent-r.Received) / float64(r.Sent)
+	if len(r.rtts) == 0 {
+		return
+	}
+	var sum time.Duration
+	for _, d := range r.rtts {
+		sum += d
+	}
+	r.MinLatencySeconds = r.rtts[0].Seconds()
+	r.MaxLatencySeconds = r.rtts[len(r.rtts)-1].Seconds()
+	r.MeanLatencySeconds = (sum / time.Duration(len(r.rtts))).Seconds()
+	r.P50LatencySeconds = percentile(r.rtts, 50).Seconds()
+	r.P95LatencySeconds = percentile(r.rtts, 95).Seconds()
+}
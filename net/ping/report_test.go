@@ -0,0 +1,56 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ping
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+func TestReportJSON(t *testing.T) {
+	ip := netaddr.MustParseIP("100.101.102.103")
+	r := &Report{IP: ip, Class: ClassPeer, Method: MethodICMPRaw}
+	r.Add(Result{IP: ip, RTT: 30 * time.Millisecond})
+	r.Add(Result{IP: ip, Err: errors.New("timeout")})
+	r.Add(Result{IP: ip, RTT: 10 * time.Millisecond})
+	r.Add(Result{IP: ip, RTT: 20 * time.Millisecond})
+
+	got, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const want = `{"IP":"100.101.102.103","Class":"peer","Method":"icmp-raw","Sent":4,"Received":3,"Loss":0.25,` +
+		`"MinLatencySeconds":0.01,"MeanLatencySeconds":0.02,"MaxLatencySeconds":0.03,"P50LatencySeconds":0.02,"P95LatencySeconds":0.03,` +
+		`"Probes":[{"Seq":1,"LatencySeconds":0.03},{"Seq":2,"Err":"timeout"},{"Seq":3,"LatencySeconds":0.01},{"Seq":4,"LatencySeconds":0.02}]}`
+	if string(got) != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	var back Report
+	if err := json.Unmarshal(got, &back); err != nil {
+		t.Fatal(err)
+	}
+	if back.IP != ip || back.Class != ClassPeer || back.Method != MethodICMPRaw || back.Received != 3 || len(back.Probes) != 4 {
+		t.Errorf("round trip = %+v", back)
+	}
+}
+
+func TestReportAllLost(t *testing.T) {
+	ip := netaddr.MustParseIP("192.168.1.1")
+	r := &Report{IP: ip, Class: ClassGateway, Method: MethodExec}
+	r.Add(Result{IP: ip, Err: errors.New("timeout")})
+	got, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const want = `{"IP":"192.168.1.1","Class":"gateway","Method":"exec","Sent":1,"Received":0,"Loss":1,"Probes":[{"Seq":1,"Err":"timeout"}]}`
+	if string(got) != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ping
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"tailscale.com/util/endian"
+)
+
+// enableRxTimestamps asks the kernel to attach a nanosecond receive
+// timestamp (SO_TIMESTAMPNS) to each packet read from pc, so RTTs
+// don't include the time it took us to get scheduled and read the
+// reply.
+func enableRxTimestamps(pc net.PacketConn) error {
+	sc, ok := pc.(syscall.Conn)
+	if !ok {
+		return errors.New("not a syscall.Conn")
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	if err := rc.Control(func(fd uintptr) {
+		serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_TIMESTAMPNS, 1)
+	}); err != nil {
+		return err
+	}
+	return serr
+}
+
+// rxTimestamp returns the receive timestamp in the control messages
+// oob, if any.
+func rxTimestamp(oob []byte) (time.Time, bool) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return time.Time{}, false
+	}
+	for _, m := range msgs {
+		if m.Header.Level != unix.SOL_SOCKET || m.Header.Type != unix.SCM_TIMESTAMPNS {
+			continue
+		}
+		// A struct timespec: two longs, of 4 or 8 bytes.
+		switch d := m.Data; len(d) {
+		case 16:
+			return time.Unix(int64(endian.Native.Uint64(d)), int64(endian.Native.Uint64(d[8:]))), true
+		case 8:
+			return time.Unix(int64(int32(endian.Native.Uint32(d))), int64(int32(endian.Native.Uint32(d[4:])))), true
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,26 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package ping
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// enableRxTimestamps returns an error: kernel receive timestamps
+// aren't supported on this platform, so RTTs are timed in userspace.
+//
+// That includes Windows. There, probes normally use MethodICMPAPI,
+// whose RTTs the OS measures, though only to the millisecond; the raw
+// sockets of MethodICMPRaw don't use SIO_TIMESTAMPING.
+func enableRxTimestamps(pc net.PacketConn) error {
+	return errors.New("kernel receive timestamps not supported")
+}
+
+func rxTimestamp(oob []byte) (time.Time, bool) { return time.Time{}, false }
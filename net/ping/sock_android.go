@@ -0,0 +1,43 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ping
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+
+	"tailscale.com/net/netns"
+	"tailscale.com/types/logger"
+)
+
+func init() {
+	protectSocket = protectAndroidSocket
+}
+
+// protectAndroidSocket keeps pc's traffic out of the Tailscale tunnel.
+//
+// The Android app is a VpnService, so sockets it creates are routed
+// into the tunnel unless they're protected, like netns does for the
+// sockets it's used for. Android permits apps to open ICMP datagram
+// sockets (their group is in net.ipv4.ping_group_range), so with this
+// Ping doesn't need /system/bin/ping, which some Android builds don't
+// let apps run.
+func protectAndroidSocket(pc net.PacketConn) error {
+	sc, ok := pc.(syscall.Conn)
+	if !ok {
+		return fmt.Errorf("can't protect %T", pc)
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	lc := netns.Listener(logger.Discard)
+	if lc.Control == nil {
+		return nil
+	}
+	la := pc.LocalAddr()
+	return lc.Control(la.Network(), la.String(), rc)
+}
@@ -0,0 +1,78 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !windows && !js && !plan9
+// +build !windows,!js,!plan9
+
+package ping
+
+import (
+	"errors"
+	"net"
+	"os"
+	"runtime"
+	"syscall"
+
+	"inet.af/netaddr"
+)
+
+// ipStripHdr is the IP_STRIPHDR socket option, which makes macOS
+// strip the IPv4 header from packets read from datagram ICMP sockets
+// like Linux does.
+const ipStripHdr = 0x17
+
+// listenDatagramICMP opens an unprivileged ICMP datagram socket bound
+// to laddr, which determines its address family.
+//
+// On Linux it's permitted by the net.ipv4.ping_group_range sysctl;
+// macOS permits it for everyone.
+func listenDatagramICMP(laddr netaddr.IP) (net.PacketConn, error) {
+	var family, proto int
+	var sa syscall.Sockaddr
+	if laddr.Is6() {
+		family, proto = syscall.AF_INET6, protoICMPv6
+		sa = &syscall.SockaddrInet6{Addr: laddr.As16()}
+	} else {
+		family, proto = syscall.AF_INET, protoICMPv4
+		sa = &syscall.SockaddrInet4{Addr: laddr.As4()}
+	}
+	s, err := syscall.Socket(family, syscall.SOCK_DGRAM, proto)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	syscall.CloseOnExec(s)
+	if (runtime.GOOS == "darwin" || runtime.GOOS == "ios") && family == syscall.AF_INET {
+		if err := syscall.SetsockoptInt(s, syscall.IPPROTO_IP, ipStripHdr, 1); err != nil {
+			syscall.Close(s)
+			return nil, os.NewSyscallError("setsockopt", err)
+		}
+	}
+	if err := syscall.Bind(s, sa); err != nil {
+		syscall.Close(s)
+		return nil, os.NewSyscallError("bind", err)
+	}
+	f := os.NewFile(uintptr(s), "datagram-oriented icmp")
+	defer f.Close()
+	return net.FilePacketConn(f)
+}
+
+// setIPOptions sets the IPv4 options (IP_OPTIONS) sent with each
+// packet on pc.
+func setIPOptions(pc net.PacketConn, opts []byte) error {
+	sc, ok := pc.(syscall.Conn)
+	if !ok {
+		return errors.New("not a syscall.Conn")
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	if err := rc.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptString(int(fd), syscall.IPPROTO_IP, syscall.IP_OPTIONS, string(opts))
+	}); err != nil {
+		return err
+	}
+	return os.NewSyscallError("setsockopt", serr)
+}
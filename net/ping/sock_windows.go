@@ -0,0 +1,29 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ping
+
+import (
+	"errors"
+	"net"
+
+	"golang.org/x/sys/windows"
+	"inet.af/netaddr"
+)
+
+func init() {
+	errConnRefused = windows.WSAECONNREFUSED
+}
+
+// listenDatagramICMP returns an error: Windows has no unprivileged
+// ICMP datagram sockets.
+func listenDatagramICMP(laddr netaddr.IP) (net.PacketConn, error) {
+	return nil, errors.New("ICMP datagram sockets not supported on Windows")
+}
+
+// setIPOptions returns an error: Windows raw sockets don't give us
+// the IP header of replies, so record-route probes aren't supported.
+func setIPOptions(pc net.PacketConn, opts []byte) error {
+	return errors.New("IPv4 options not supported on Windows")
+}
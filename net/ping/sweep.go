@@ -0,0 +1,164 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ping
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+
+	"inet.af/netaddr"
+	"tailscale.com/syncs"
+)
+
+const (
+	// DefaultSweepSize is how many addresses Sweep probes by
+	// default.
+	DefaultSweepSize = 32
+
+	// MaxSweepSize bounds how many addresses callers of Sweep may
+	// ask to probe, so it can't be used to scan a network.
+	MaxSweepSize = 256
+)
+
+// sweepSem permits one sweep at a time per process.
+var sweepSem = syncs.NewSemaphore(1)
+
+var errSweepInProgress = errors.New("ping: another sweep is in progress")
+
+// SweepResult is the outcome of a Sweep.
+type SweepResult struct {
+	Prefix netaddr.IPPrefix
+
+	// Results are the outcomes of probing each sampled address, in
+	// address order.
+	Results []Result
+}
+
+// Answered returns the number of probes that were answered.
+func (r *SweepResult) Answered() int {
+	n := 0
+	for _, res := range r.Results {
+		if res.Err == nil {
+			n++
+		}
+	}
+	return n
+}
+
+// Reachability returns the fraction of the sampled addresses, from 0
+// to 1, that answered. It's zero if none were probed.
+func (r *SweepResult) Reachability() float64 {
+	if len(r.Results) == 0 {
+		return 0
+	}
+	return float64(r.Answered()) / float64(len(r.Results))
+}
+
+func (r *SweepResult) String() string {
+	return fmt.Sprintf("%v: %d of %d sampled addresses answered (%.0f%%)",
+		r.Prefix, r.Answered(), len(r.Results), r.Reachability()*100)
+}
+
+// Sweep probes a sample of n addresses in pfx, such as a subnet route
+// advertised by this node, and reports how many answered, so subnet
+// router operators can check that the LAN side actually answers. If
+// pfx has no more than n usable addresses, they're all probed. A zero
+// n means DefaultSweepSize.
+//
+// The network and broadcast addresses of IPv4 prefixes aren't probed.
+// Prefixes of more than 2^63 addresses, which only IPv6 has, are only
+// sampled from their first 2^63. Random addresses in a big IPv6
+// prefix rarely have hosts, so sweeps of those say little.
+//
+// To keep it from being used to scan networks, n may be at most
+// MaxSweepSize, probes are sent at most one every
+// DefaultPaceInterval, and only one sweep may run at a time in the
+// process. Requests beyond those limits return an error without
+// sending anything. Unlike PingMany, unanswered probes don't slow a
+// sweep down further, since most addresses usually don't answer.
+//
+// If ctx is done before the sweep is over, Sweep returns the results
+// so far along with ctx's error.
+//
+// The class is only used for metrics.
+func Sweep(ctx context.Context, class Class, pfx netaddr.IPPrefix, n int) (*SweepResult, error) {
+	if n == 0 {
+		n = DefaultSweepSize
+	}
+	switch {
+	case n < 0 || n > MaxSweepSize:
+		return nil, fmt.Errorf("ping: sweep size %d not in range 1-%d", n, MaxSweepSize)
+	case !pfx.IsValid():
+		return nil, fmt.Errorf("ping: invalid prefix %v", pfx)
+	case pfx.IP().IsMulticast():
+		return nil, fmt.Errorf("ping: can't sweep multicast prefix %v", pfx)
+	}
+	if !sweepSem.TryAcquire() {
+		return nil, errSweepInProgress
+	}
+	defer sweepSem.Release()
+
+	pfx = pfx.Masked()
+	ips := sweepSample(pfx, n)
+	res := pingPaced(ctx, new(Pacer), class, ips, false)
+	return &SweepResult{Prefix: pfx, Results: res}, ctx.Err()
+}
+
+// sweepSample returns up to n distinct usable addresses in the
+// masked prefix pfx, in order, chosen at random if there are more.
+func sweepSample(pfx netaddr.IPPrefix, n int) []netaddr.IP {
+	hostBits := int(pfx.IP().BitLen()) - int(pfx.Bits())
+	if hostBits > 63 {
+		hostBits = 63
+	}
+	size := uint64(1) << hostBits
+	lo, hi := uint64(0), size-1 // offsets of the usable addresses
+	if hostBits >= 2 {
+		lo = 1 // IPv4 network address, or IPv6 subnet-router anycast
+		if pfx.IP().Is4() {
+			hi-- // broadcast address
+		}
+	}
+
+	var offs []uint64
+	if count := hi - lo + 1; count <= uint64(n) {
+		for off := lo; off <= hi; off++ {
+			offs = append(offs, off)
+		}
+	} else {
+		seen := make(map[uint64]bool, n)
+		for len(offs) < n {
+			off := lo + uint64(rand.Int63n(int64(count)))
+			if !seen[off] {
+				seen[off] = true
+				offs = append(offs, off)
+			}
+		}
+		sort.Slice(offs, func(i, j int) bool { return offs[i] < offs[j] })
+	}
+
+	ips := make([]netaddr.IP, len(offs))
+	for i, off := range offs {
+		ips[i] = addOffset(pfx.IP(), off)
+	}
+	return ips
+}
+
+// addOffset returns the address off addresses after ip, which must
+// have at least as many trailing zero bits as off has bits.
+func addOffset(ip netaddr.IP, off uint64) netaddr.IP {
+	if ip.Is4() {
+		b := ip.As4()
+		binary.BigEndian.PutUint32(b[:], binary.BigEndian.Uint32(b[:])|uint32(off))
+		return netaddr.IPFrom4(b)
+	}
+	b := ip.As16()
+	binary.BigEndian.PutUint64(b[8:], binary.BigEndian.Uint64(b[8:])|off)
+	return netaddr.IPv6Raw(b)
+}
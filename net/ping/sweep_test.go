@@ -0,0 +1,97 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ping
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+func TestSweepSample(t *testing.T) {
+	tests := []struct {
+		pfx        string
+		n          int
+		wantLen    int
+		first, end string // bounds of the usable addresses, inclusive
+	}{
+		{"192.168.1.0/24", 300, 254, "192.168.1.1", "192.168.1.254"},
+		{"192.168.1.0/24", 10, 10, "192.168.1.1", "192.168.1.254"},
+		{"10.0.0.0/8", 256, 256, "10.0.0.1", "10.255.255.254"},
+		{"192.168.1.4/30", 10, 2, "192.168.1.5", "192.168.1.6"},
+		{"192.168.1.4/31", 10, 2, "192.168.1.4", "192.168.1.5"},
+		{"192.168.1.4/32", 10, 1, "192.168.1.4", "192.168.1.4"},
+		{"fd00::/120", 500, 255, "fd00::1", "fd00::ff"},
+		{"fd00::/64", 20, 20, "fd00::1", "fd00::7fff:ffff:ffff:ffff"},
+		{"fd00::/48", 20, 20, "fd00::1", "fd00::7fff:ffff:ffff:ffff"},
+	}
+	for _, tt := range tests {
+		pfx := netaddr.MustParseIPPrefix(tt.pfx)
+		first, end := netaddr.MustParseIP(tt.first), netaddr.MustParseIP(tt.end)
+		ips := sweepSample(pfx, tt.n)
+		if len(ips) != tt.wantLen {
+			t.Errorf("%v, %d: got %d addresses; want %d", pfx, tt.n, len(ips), tt.wantLen)
+			continue
+		}
+		for i, ip := range ips {
+			if ip.Less(first) || end.Less(ip) {
+				t.Errorf("%v, %d: address %v not in %v-%v", pfx, tt.n, ip, first, end)
+			}
+			if i > 0 && !ips[i-1].Less(ip) {
+				t.Errorf("%v, %d: addresses %v, %v not distinct and in order", pfx, tt.n, ips[i-1], ip)
+			}
+		}
+		if len(ips) < tt.n && (ips[0] != first || ips[len(ips)-1] != end) {
+			t.Errorf("%v, %d: got %v-%v; want all of %v-%v", pfx, tt.n, ips[0], ips[len(ips)-1], first, end)
+		}
+	}
+}
+
+func TestSweepErrors(t *testing.T) {
+	ctx := context.Background()
+	for _, tt := range []struct {
+		pfx netaddr.IPPrefix
+		n   int
+	}{
+		{netaddr.MustParseIPPrefix("192.168.1.0/24"), MaxSweepSize + 1},
+		{netaddr.MustParseIPPrefix("192.168.1.0/24"), -1},
+		{netaddr.MustParseIPPrefix("224.0.0.0/24"), 0},
+		{netaddr.IPPrefix{}, 0},
+	} {
+		if _, err := Sweep(ctx, ClassOther, tt.pfx, tt.n); err == nil {
+			t.Errorf("Sweep(%v, %d) succeeded", tt.pfx, tt.n)
+		}
+	}
+
+	sweepSem.Acquire()
+	defer sweepSem.Release()
+	_, err := Sweep(ctx, ClassOther, netaddr.MustParseIPPrefix("192.168.1.0/24"), 0)
+	if err != errSweepInProgress {
+		t.Errorf("concurrent Sweep: err = %v; want %v", err, errSweepInProgress)
+	}
+}
+
+func TestSweepResult(t *testing.T) {
+	r := &SweepResult{
+		Prefix: netaddr.MustParseIPPrefix("192.168.1.0/24"),
+		Results: []Result{
+			{IP: netaddr.MustParseIP("192.168.1.1")},
+			{IP: netaddr.MustParseIP("192.168.1.2"), Err: errors.New("timeout")},
+			{IP: netaddr.MustParseIP("192.168.1.3"), Err: errors.New("timeout")},
+			{IP: netaddr.MustParseIP("192.168.1.4"), Err: errors.New("timeout")},
+		},
+	}
+	if got, want := r.Reachability(), 0.25; got != want {
+		t.Errorf("Reachability = %v; want %v", got, want)
+	}
+	if got, want := r.String(), "192.168.1.0/24: 1 of 4 sampled addresses answered (25%)"; got != want {
+		t.Errorf("String = %q; want %q", got, want)
+	}
+	if got := (&SweepResult{}).Reachability(); got != 0 {
+		t.Errorf("empty Reachability = %v; want 0", got)
+	}
+}
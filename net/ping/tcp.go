@@ -0,0 +1,46 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ping
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+// tcpProbePort is the port TCP probes connect to. Either a completed
+// handshake or a refusal shows that the host is up, so it doesn't
+// matter whether anything listens on it.
+const tcpProbePort = 443
+
+// errConnRefused is the error of a connection refused with a RST. On
+// Windows, it's WSAECONNREFUSED, which syscall.ECONNREFUSED isn't.
+var errConnRefused error = syscall.ECONNREFUSED
+
+// pingTCP approximates a ping of ip by timing a TCP connection
+// attempt to it. It needs no privileges or ping command, but hosts
+// that silently drop connections to tcpProbePort look unreachable.
+func pingTCP(ctx context.Context, ip netaddr.IP, opts *Options) (time.Duration, error) {
+	d := net.Dialer{Timeout: nativeTimeout}
+	if src := opts.source(); !src.IsZero() {
+		d.LocalAddr = &net.TCPAddr{IP: src.IPAddr().IP}
+	}
+	t0 := time.Now()
+	c, err := d.DialContext(ctx, "tcp", netaddr.IPPortFrom(ip, tcpProbePort).String())
+	rtt := time.Since(t0)
+	if err == nil {
+		c.Close()
+		return rtt, nil
+	}
+	if errors.Is(err, errConnRefused) {
+		// The host answered with a RST.
+		return rtt, nil
+	}
+	return 0, err
+}
@@ -0,0 +1,28 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ping
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+func TestPingTCPLoopback(t *testing.T) {
+	// Whether or not anything listens on tcpProbePort, loopback
+	// either accepts or refuses the connection, which both count
+	// as a reply.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	d, err := pingTCP(ctx, netaddr.IPv4(127, 0, 0, 1), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d <= 0 || d > time.Second {
+		t.Errorf("implausible RTT %v", d)
+	}
+}
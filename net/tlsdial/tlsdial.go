@@ -37,6 +37,10 @@
 // Config returns a tls.Config for connecting to a server.
 // If base is non-nil, it's cloned as the base config before
 // being configured and returned.
+//
+// The host may be empty if the caller sets the ServerName before
+// use, as http.Transport does for each host it connects to. Certs are
+// verified against the ServerName actually used.
 func Config(host string, base *tls.Config) *tls.Config {
 	var conf *tls.Config
 	if base == nil {
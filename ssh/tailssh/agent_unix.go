@@ -0,0 +1,48 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux || (darwin && !ios)
+// +build linux darwin,!ios
+
+package tailssh
+
+import (
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+
+	"tailscale.com/tempfork/gliderlabs/ssh"
+)
+
+// newUserAgentListener returns a new agent socket that lu can use.
+func (ss *sshSession) newUserAgentListener(lu *user.User) (net.Listener, error) {
+	ln, err := ssh.NewAgentListener()
+	if err != nil {
+		return nil, err
+	}
+	uid, err := strconv.ParseUint(lu.Uid, 10, 32)
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	gid, err := strconv.ParseUint(lu.Gid, 10, 32)
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	socket := ln.Addr().String()
+	dir := filepath.Dir(socket)
+	// Make sure the socket is accessible by the user.
+	if err := os.Chown(socket, int(uid), int(gid)); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	if err := os.Chmod(dir, 0755); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
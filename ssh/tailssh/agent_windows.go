@@ -0,0 +1,132 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tailssh
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"os"
+	"os/user"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// newUserAgentListener returns a new agent named pipe that only lu and
+// LocalSystem can use. Windows' OpenSSH clients expect SSH_AUTH_SOCK to
+// name a pipe rather than a Unix socket.
+func (ss *sshSession) newUserAgentListener(lu *user.User) (net.Listener, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return nil, err
+	}
+	// lu.Uid is the user's SID on Windows.
+	sd, err := windows.SecurityDescriptorFromString("D:P(A;;GA;;;SY)(A;;GA;;;" + lu.Uid + ")")
+	if err != nil {
+		return nil, err
+	}
+	ln := &pipeListener{
+		name: `\\.\pipe\tailscale-ssh-agent-` + hex.EncodeToString(b[:]),
+		sa: &windows.SecurityAttributes{
+			Length:             uint32(unsafe.Sizeof(windows.SecurityAttributes{})),
+			SecurityDescriptor: sd,
+		},
+	}
+	return ln, nil
+}
+
+// pipeListener is a net.Listener for a named pipe. Each Accept creates
+// a new instance of the pipe and waits for a client to open it.
+type pipeListener struct {
+	name string
+	sa   *windows.SecurityAttributes
+
+	mu      sync.Mutex
+	created bool           // whether the pipe's first instance has been created
+	pending windows.Handle // the instance Accept is waiting on, or 0
+	closed  bool
+}
+
+func (ln *pipeListener) Accept() (net.Conn, error) {
+	ln.mu.Lock()
+	if ln.closed {
+		ln.mu.Unlock()
+		return nil, net.ErrClosed
+	}
+	name, err := windows.UTF16PtrFromString(ln.name)
+	if err != nil {
+		ln.mu.Unlock()
+		return nil, err
+	}
+	flags := uint32(windows.PIPE_ACCESS_DUPLEX)
+	if !ln.created {
+		// Fail, rather than share it, if someone else has the name.
+		flags |= windows.FILE_FLAG_FIRST_PIPE_INSTANCE
+	}
+	h, err := windows.CreateNamedPipe(name, flags,
+		windows.PIPE_TYPE_BYTE|windows.PIPE_READMODE_BYTE|windows.PIPE_WAIT|windows.PIPE_REJECT_REMOTE_CLIENTS,
+		windows.PIPE_UNLIMITED_INSTANCES, 64<<10, 64<<10, 0, ln.sa)
+	if err != nil {
+		ln.mu.Unlock()
+		return nil, err
+	}
+	ln.created = true
+	ln.pending = h
+	ln.mu.Unlock()
+
+	err = windows.ConnectNamedPipe(h, nil)
+	if err == windows.ERROR_PIPE_CONNECTED {
+		err = nil // the client opened it before we waited
+	}
+	ln.mu.Lock()
+	ln.pending = 0
+	if err == nil && ln.closed {
+		err = net.ErrClosed // it was Close connecting to wake us up
+	}
+	ln.mu.Unlock()
+	if err != nil {
+		windows.CloseHandle(h)
+		return nil, err
+	}
+	return pipeConn{os.NewFile(uintptr(h), ln.name), ln.Addr()}, nil
+}
+
+// Close stops ln accepting connections. It connects to the pipe
+// instance Accept is waiting on, if any, as that's the way to wake it.
+func (ln *pipeListener) Close() error {
+	ln.mu.Lock()
+	if ln.closed {
+		ln.mu.Unlock()
+		return nil
+	}
+	ln.closed = true
+	pending := ln.pending
+	ln.mu.Unlock()
+	if pending != 0 {
+		if f, err := os.OpenFile(ln.name, os.O_RDWR, 0); err == nil {
+			f.Close()
+		}
+	}
+	return nil
+}
+
+func (ln *pipeListener) Addr() net.Addr { return pipeAddr(ln.name) }
+
+// pipeAddr is the net.Addr of a named pipe, which is its name.
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return "pipe" }
+func (a pipeAddr) String() string  { return string(a) }
+
+// pipeConn is a connection accepted by a pipeListener.
+type pipeConn struct {
+	*os.File
+	addr net.Addr
+}
+
+func (c pipeConn) LocalAddr() net.Addr  { return c.addr }
+func (c pipeConn) RemoteAddr() net.Addr { return c.addr }
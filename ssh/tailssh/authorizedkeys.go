@@ -0,0 +1,104 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux || (darwin && !ios) || windows
+// +build linux darwin,!ios windows
+
+package tailssh
+
+// This file implements reading local users' ~/.ssh/authorized_keys
+// files, for principals whose PubKeys include authorizedKeysSource.
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+
+	gossh "tailscale.com/tempfork/golang-x-crypto/ssh"
+)
+
+// authorizedKeysSource is the SSHPrincipal.PubKeys element that stands
+// for the keys in the local user's ~/.ssh/authorized_keys file.
+const authorizedKeysSource = "authorized_keys"
+
+// maxAuthorizedKeysSize is how much of an authorized_keys file is read.
+const maxAuthorizedKeysSize = 1 << 20
+
+// readAuthorizedKeys returns the public keys in localUser's
+// ~/.ssh/authorized_keys file.
+func readAuthorizedKeys(localUser string) ([]string, error) {
+	lu, err := lookupLocalUser(localUser)
+	if err != nil {
+		return nil, err
+	}
+	return authorizedKeysOf(lu)
+}
+
+// authorizedKeysOf returns the public keys in lu's
+// ~/.ssh/authorized_keys file, as its lines that have one.
+//
+// tailscaled reads it as root, so like OpenSSH with StrictModes, it
+// refuses to if the file, its directory, or the home directory could
+// have been written by users other than lu and root. It doesn't follow
+// symlinks, only reads the first maxAuthorizedKeysSize bytes, and
+// skips the lines that don't parse.
+func authorizedKeysOf(lu *user.User) ([]string, error) {
+	if lu.HomeDir == "" {
+		return nil, errors.New("no home directory")
+	}
+	dir := filepath.Join(lu.HomeDir, ".ssh")
+	path := filepath.Join(dir, "authorized_keys")
+	var fi os.FileInfo
+	for _, p := range []string{lu.HomeDir, dir, path} {
+		var err error
+		fi, err = os.Lstat(p)
+		if err != nil {
+			return nil, err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return nil, fmt.Errorf("%s is a symlink", p)
+		}
+		if err := checkKeyFileOwner(p, fi, lu); err != nil {
+			return nil, err
+		}
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	ofi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !ofi.Mode().IsRegular() || !os.SameFile(fi, ofi) {
+		return nil, fmt.Errorf("%s isn't the regular file checked", path)
+	}
+	b, err := io.ReadAll(io.LimitReader(f, maxAuthorizedKeysSize))
+	if err != nil {
+		return nil, err
+	}
+	return parseAuthorizedKeys(b), nil
+}
+
+// parseAuthorizedKeys returns the lines of b, the contents of an
+// authorized_keys file, that have a key, with their options, skipping
+// comments and the lines that don't parse.
+func parseAuthorizedKeys(b []byte) []string {
+	var keys []string
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if _, _, _, _, err := gossh.ParseAuthorizedKey([]byte(line)); err == nil {
+			keys = append(keys, line)
+		}
+	}
+	return keys
+}
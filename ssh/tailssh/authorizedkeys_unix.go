@@ -0,0 +1,33 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux || (darwin && !ios)
+// +build linux darwin,!ios
+
+package tailssh
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// checkKeyFileOwner returns an error unless the file or directory at
+// path, whose Lstat result is fi, is owned by lu or root and isn't
+// writable by its group or others.
+func checkKeyFileOwner(path string, fi os.FileInfo, lu *user.User) error {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fmt.Errorf("%s: unknown owner", path)
+	}
+	if uid := strconv.FormatUint(uint64(st.Uid), 10); uid != lu.Uid && uid != "0" {
+		return fmt.Errorf("%s: bad ownership", path)
+	}
+	if fi.Mode().Perm()&0022 != 0 {
+		return fmt.Errorf("%s: writable by group or others", path)
+	}
+	return nil
+}
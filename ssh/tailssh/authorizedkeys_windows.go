@@ -0,0 +1,34 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tailssh
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+
+	"golang.org/x/sys/windows"
+)
+
+// checkKeyFileOwner returns an error unless the file or directory at
+// path is owned by lu, LocalSystem or the Administrators group. Unlike
+// on Unix, its ACL isn't checked.
+func checkKeyFileOwner(path string, _ os.FileInfo, lu *user.User) error {
+	sd, err := windows.GetNamedSecurityInfo(path, windows.SE_FILE_OBJECT, windows.OWNER_SECURITY_INFORMATION)
+	if err != nil {
+		return err
+	}
+	owner, _, err := sd.Owner()
+	if err != nil {
+		return err
+	}
+	// lu.Uid is the user's SID on Windows.
+	if owner.String() == lu.Uid ||
+		owner.IsWellKnown(windows.WinLocalSystemSid) ||
+		owner.IsWellKnown(windows.WinBuiltinAdministratorsSid) {
+		return nil
+	}
+	return fmt.Errorf("%s: bad ownership", path)
+}
@@ -0,0 +1,137 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux || (darwin && !ios) || windows
+// +build linux darwin,!ios windows
+
+package tailssh
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/util/netconv"
+)
+
+// maxRecentRejections is how many rejected connection attempts the
+// server remembers for bug reports.
+const maxRecentRejections = 10
+
+// rejection is a rejected SSH connection attempt.
+type rejection struct {
+	at      time.Time
+	src     netip.AddrPort
+	sshUser string
+	reason  string
+}
+
+// noteRejection records that a connection attempt from src as sshUser
+// was rejected for reason, for bug reports and event watchers.
+func (srv *server) noteRejection(src netip.AddrPort, sshUser, reason string) {
+	now := srv.now()
+	srv.publishEvent(ipnstate.SSHEvent{
+		Time:    now,
+		Type:    ipnstate.SSHEventReject,
+		Src:     netconv.AsIPPort(src),
+		SSHUser: sshUser,
+		Reason:  reason,
+	})
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if len(srv.recentRejections) == maxRecentRejections {
+		copy(srv.recentRejections, srv.recentRejections[1:])
+		srv.recentRejections = srv.recentRejections[:maxRecentRejections-1]
+	}
+	srv.recentRejections = append(srv.recentRejections, rejection{
+		at:      now,
+		src:     src,
+		sshUser: sshUser,
+		reason:  reason,
+	})
+}
+
+// BugReport returns a summary of the server's state for bug reports:
+// its policy, active sessions, recording and host keys, and recently
+// rejected connection attempts.
+func (srv *server) BugReport() string {
+	var b strings.Builder
+	st := srv.Status()
+	if st.PolicySource != "" {
+		fmt.Fprintf(&b, "policy: from %s, %d rules\n", st.PolicySource, st.PolicyRules)
+	} else {
+		b.WriteString("policy: none\n")
+	}
+	fmt.Fprintf(&b, "active sessions: %d\n", len(st.Sessions))
+	fmt.Fprintf(&b, "recording: %s\n", st.Recording)
+	if st.HostKeysErr != "" {
+		fmt.Fprintf(&b, "host keys: %s\n", st.HostKeysErr)
+	}
+	for _, k := range st.HostKeys {
+		fmt.Fprintf(&b, "host key: %s\n", k)
+	}
+
+	srv.mu.Lock()
+	rejections := append([]rejection(nil), srv.recentRejections...)
+	srv.mu.Unlock()
+	for _, r := range rejections {
+		fmt.Fprintf(&b, "rejected %s: %v as %q: %s\n",
+			r.at.UTC().Format(time.RFC3339), r.src.Addr(), r.sshUser, r.reason)
+	}
+	return b.String()
+}
+
+// recordingStatus describes whether sessions are recorded, and if so,
+// how much is recorded so far.
+func (srv *server) recordingStatus() string {
+	if !recordSSH && !srv.policyRecords() {
+		return "disabled"
+	}
+	if recordingStoreURL != "" {
+		store, err := srv.recordingStore()
+		if err != nil {
+			return fmt.Sprintf("enabled, but: %v", err)
+		}
+		return fmt.Sprintf("enabled, to %s", store)
+	}
+	dir, err := srv.recordingsDir()
+	if err != nil {
+		return fmt.Sprintf("enabled, but: %v", err)
+	}
+	des, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return fmt.Sprintf("enabled, to %s (empty)", dir)
+	}
+	if err != nil {
+		return fmt.Sprintf("enabled, to %s: %v", dir, err)
+	}
+	var n int
+	var size int64
+	for _, de := range des {
+		if fi, err := de.Info(); err == nil && fi.Mode().IsRegular() {
+			n++
+			size += fi.Size()
+		}
+	}
+	return fmt.Sprintf("enabled, to %s (%d files, %d bytes)", dir, n, size)
+}
+
+// policyRecords reports whether any rule of the current policy records
+// the sessions it accepts. Actions served by HoldAndDelegate URLs
+// aren't known until they're fetched, so they don't count.
+func (srv *server) policyRecords() bool {
+	pol, ok := srv.sshPolicy()
+	if !ok {
+		return false
+	}
+	for _, r := range pol.Rules {
+		if r != nil && r.Action != nil && r.Action.Record {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,103 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tailssh
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+	"tailscale.com/envknob"
+	"tailscale.com/tailcfg"
+)
+
+// sessionCgroupRoot, if non-empty, is the cgroup under which sessions
+// with SSHAction.SessionLimits get a cgroup each, instead of
+// defaultSessionCgroupRoot.
+var sessionCgroupRoot = envknob.String("TS_SSH_CGROUP_ROOT")
+
+// defaultSessionCgroupRoot is a child of the root cgroup, which
+// systemd enables the cpu, memory and pids controllers in.
+const defaultSessionCgroupRoot = "/sys/fs/cgroup/tailscale-ssh"
+
+// cgroupCPUPeriod is the period, in microseconds, of the CPU time
+// quotas of session cgroups. It's the kernel's default.
+const cgroupCPUPeriod = 100000
+
+// cgroupFile is a cgroup interface file and what to write to it.
+type cgroupFile struct {
+	name  string // like "pids.max"
+	value string
+}
+
+// cgroupLimitFiles returns the interface files that set lim for a
+// cgroup, in the order to write them.
+func cgroupLimitFiles(lim *tailcfg.SSHSessionLimits) []cgroupFile {
+	var files []cgroupFile
+	if lim.CPUPercent > 0 {
+		quota := lim.CPUPercent * cgroupCPUPeriod / 100
+		files = append(files, cgroupFile{"cpu.max", fmt.Sprintf("%d %d", quota, cgroupCPUPeriod)})
+	}
+	if lim.MemoryMax > 0 {
+		files = append(files, cgroupFile{"memory.max", strconv.FormatInt(lim.MemoryMax, 10)})
+	}
+	if lim.PidsMax > 0 {
+		files = append(files, cgroupFile{"pids.max", strconv.Itoa(lim.PidsMax)})
+	}
+	return files
+}
+
+// newSessionCgroup makes a cgroup v2 named id for a session's processes,
+// limited to lim, and returns its directory. The incubator joins it
+// with joinCgroup; the caller removes it once the session is over.
+func newSessionCgroup(id string, lim *tailcfg.SSHSessionLimits) (dir string, err error) {
+	root := sessionCgroupRoot
+	if root == "" {
+		root = defaultSessionCgroupRoot
+	}
+	var st unix.Statfs_t
+	if err := unix.Statfs(filepath.Dir(root), &st); err != nil {
+		return "", err
+	}
+	if st.Type != unix.CGROUP2_SUPER_MAGIC {
+		return "", fmt.Errorf("%s isn't in a cgroup v2 hierarchy", root)
+	}
+	if err := os.Mkdir(root, 0755); err != nil && !os.IsExist(err) {
+		return "", err
+	}
+	files := cgroupLimitFiles(lim)
+	var ctrls []string
+	for _, f := range files {
+		ctrl, _, _ := strings.Cut(f.name, ".")
+		ctrls = append(ctrls, "+"+ctrl)
+	}
+	if len(ctrls) > 0 {
+		// The session cgroups can only use the controllers that
+		// their parent enables for its children.
+		if err := os.WriteFile(filepath.Join(root, "cgroup.subtree_control"), []byte(strings.Join(ctrls, " ")), 0); err != nil {
+			return "", fmt.Errorf("enabling controllers %v: %w", ctrls, err)
+		}
+	}
+	dir = filepath.Join(root, id)
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return "", err
+	}
+	for _, f := range files {
+		if err := os.WriteFile(filepath.Join(dir, f.name), []byte(f.value), 0); err != nil {
+			os.Remove(dir)
+			return "", err
+		}
+	}
+	return dir, nil
+}
+
+// joinCgroup moves the process pid into the cgroup in dir. The
+// processes it starts afterwards are in it too.
+func joinCgroup(dir string, pid int) error {
+	return os.WriteFile(filepath.Join(dir, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0)
+}
@@ -0,0 +1,120 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tailssh
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"tailscale.com/tailcfg"
+)
+
+func TestCgroupLimitFiles(t *testing.T) {
+	tests := []struct {
+		lim  tailcfg.SSHSessionLimits
+		want []cgroupFile
+	}{
+		{tailcfg.SSHSessionLimits{}, nil},
+		{
+			tailcfg.SSHSessionLimits{CPUPercent: 50, MemoryMax: 1 << 30, PidsMax: 100},
+			[]cgroupFile{
+				{"cpu.max", "50000 100000"},
+				{"memory.max", "1073741824"},
+				{"pids.max", "100"},
+			},
+		},
+		{
+			tailcfg.SSHSessionLimits{CPUPercent: 200},
+			[]cgroupFile{{"cpu.max", "200000 100000"}},
+		},
+	}
+	for _, tt := range tests {
+		if got := cgroupLimitFiles(&tt.lim); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("cgroupLimitFiles(%+v) = %v; want %v", tt.lim, got, tt.want)
+		}
+	}
+}
+
+func TestHarnessSessionLimits(t *testing.T) {
+	root := fmt.Sprintf("/sys/fs/cgroup/tailscale-ssh-test-%d", os.Getpid())
+	defer func(v string) { sessionCgroupRoot = v }(sessionCgroupRoot)
+	sessionCgroupRoot = root
+	probe, err := newSessionCgroup("probe", &tailcfg.SSHSessionLimits{PidsMax: 10})
+	if err != nil {
+		t.Skipf("can't make cgroups: %v", err)
+	}
+	os.Remove(probe)
+	defer os.Remove(root)
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := newSSHHarness(t, nil)
+	h.srv.tailscaledPath = exe
+	h.lb.setPolicy(&tailcfg.SSHPolicy{Rules: []*tailcfg.SSHRule{
+		h.acceptRule(&tailcfg.SSHAction{
+			Accept:        true,
+			SessionLimits: &tailcfg.SSHSessionLimits{PidsMax: 10},
+		}),
+	}})
+	c := h.mustDial()
+	out, _, err := run(t, c, "cat /proc/self/cgroup; cat /sys/fs/cgroup$(cut -d: -f3 /proc/self/cgroup)/pids.max")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Fields(out)
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "0::/"+filepath.Base(root)+"/") || lines[1] != "10" {
+		t.Errorf("got %q; want the session in a cgroup of its own with pids.max 10", out)
+	}
+
+	// Starting a login session, as logind and pam_systemd do, moves
+	// the incubator into the session's scope, but the session's
+	// command still runs in its cgroup.
+	scope := root + "-scope"
+	if err := os.Mkdir(scope, 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(scope)
+	s, err := c.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.Setenv("TS_TEST_LOGIN_SESSION_CGROUP", scope); err != nil {
+		t.Fatal(err)
+	}
+	b, err := s.Output("cat /proc/self/cgroup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(string(b)); !strings.HasPrefix(got, "0::/"+filepath.Base(root)+"/") {
+		t.Errorf("with a login session, cgroup = %q; want the session's own", got)
+	}
+
+	// The sessions' cgroups are removed once they're over.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		des, _ := os.ReadDir(root)
+		var left []string
+		for _, de := range des {
+			if de.IsDir() {
+				left = append(left, de.Name())
+			}
+		}
+		if len(left) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("session cgroups %v left behind", left)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
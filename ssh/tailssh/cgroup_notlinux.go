@@ -0,0 +1,24 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build (darwin && !ios) || windows
+// +build darwin,!ios windows
+
+package tailssh
+
+import (
+	"errors"
+
+	"tailscale.com/tailcfg"
+)
+
+var errSessionLimitsUnsupported = errors.New("session limits aren't supported on this platform")
+
+func newSessionCgroup(id string, lim *tailcfg.SSHSessionLimits) (dir string, err error) {
+	return "", errSessionLimitsUnsupported
+}
+
+func joinCgroup(dir string, pid int) error {
+	return errSessionLimitsUnsupported
+}
@@ -0,0 +1,142 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux || (darwin && !ios) || windows
+// +build linux darwin,!ios windows
+
+package tailssh
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// SSHAction.EphemeralUser modes.
+const (
+	ephemeralUserPerSession = "session"
+	ephemeralUserPerUser    = "user"
+)
+
+// ephemeralUserComment is the comment (GECOS field) of ephemeral
+// users, so that admins can tell them apart from others.
+const ephemeralUserComment = "Tailscale SSH ephemeral user"
+
+// createEphemeralUser makes a local user named name, with a home
+// directory. See createEphemeralUserLinux.
+var createEphemeralUser = func(name string) error {
+	return errors.New("ephemeral users aren't supported on this platform")
+}
+
+// removeEphemeralUser kills the processes of the local user named name
+// and removes them, with their home directory. See
+// removeEphemeralUserLinux.
+var removeEphemeralUser = func(name string) error {
+	return errors.New("ephemeral users aren't supported on this platform")
+}
+
+// listEphemeralUsers returns the names of the local users that
+// createEphemeralUser made, whether by this process or an earlier one.
+// See listEphemeralUsersLinux.
+var listEphemeralUsers = func() ([]string, error) {
+	return nil, nil
+}
+
+// ephemeralUserName returns the name of the ephemeral local user for
+// the session sessionID of the connection ci, in the given
+// SSHAction.EphemeralUser mode, or the empty string for an unknown one.
+// Names are at most 24 bytes, within the usual limit of 32.
+func ephemeralUserName(mode string, ci *sshConnInfo, sessionID string) string {
+	switch mode {
+	case ephemeralUserPerSession:
+		return "ts-" + shortHash(sessionID, 12)
+	case ephemeralUserPerUser:
+		who := ci.uprof.LoginName
+		if len(ci.node.Tags) > 0 {
+			who = strings.Join(ci.node.Tags, ",")
+		}
+		// The login name's local part, in the characters that
+		// useradd accepts everywhere, followed by a hash of all
+		// of it so that users with the same local part differ.
+		local, _, _ := strings.Cut(who, "@")
+		local = strings.TrimPrefix(local, "tag:")
+		var b strings.Builder
+		for _, r := range strings.ToLower(local) {
+			if b.Len() == 12 {
+				break
+			}
+			if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '_' || r == '-' {
+				b.WriteRune(r)
+			}
+		}
+		return "ts-" + b.String() + "-" + shortHash(who, 8)
+	}
+	return ""
+}
+
+// shortHash returns the first n hex digits of s's SHA-256 hash.
+func shortHash(s string, n int) string {
+	h := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(h[:])[:n]
+}
+
+// acquireEphemeralUser makes sure that the ephemeral local user named
+// name exists, creating it if it doesn't, until release is called as
+// often as acquireEphemeralUser was. The last release removes it.
+func (srv *server) acquireEphemeralUser(name string) (release func(), err error) {
+	if srv.isConnChild {
+		// The parent tailscaled would have to count the users
+		// across connections.
+		return nil, errors.New("ephemeral users unsupported for isolated SSH connections")
+	}
+	srv.ephemeralUsersMu.Lock()
+	defer srv.ephemeralUsersMu.Unlock()
+	if srv.ephemeralUsers[name] == 0 {
+		if err := createEphemeralUser(name); err != nil {
+			return nil, fmt.Errorf("creating ephemeral user %q: %w", name, err)
+		}
+		srv.logf("ssh: created ephemeral user %q", name)
+	}
+	mapSet(&srv.ephemeralUsers, name, srv.ephemeralUsers[name]+1)
+	return func() {
+		srv.ephemeralUsersMu.Lock()
+		defer srv.ephemeralUsersMu.Unlock()
+		if n := srv.ephemeralUsers[name] - 1; n > 0 {
+			srv.ephemeralUsers[name] = n
+			return
+		}
+		delete(srv.ephemeralUsers, name)
+		if err := removeEphemeralUser(name); err != nil {
+			srv.logf("ssh: removing ephemeral user %q: %v", name, err)
+			return
+		}
+		srv.logf("ssh: removed ephemeral user %q", name)
+	}, nil
+}
+
+// removeStaleEphemeralUsers removes the ephemeral users that no session
+// of this process uses, as left behind by an earlier tailscaled that
+// crashed or was restarted with sessions open. Otherwise, creating them
+// again would fail for as long as they're there.
+func (srv *server) removeStaleEphemeralUsers() {
+	names, err := listEphemeralUsers()
+	if err != nil {
+		srv.logf("ssh: listing ephemeral users: %v", err)
+		return
+	}
+	srv.ephemeralUsersMu.Lock()
+	defer srv.ephemeralUsersMu.Unlock()
+	for _, name := range names {
+		if srv.ephemeralUsers[name] > 0 {
+			continue
+		}
+		if err := removeEphemeralUser(name); err != nil {
+			srv.logf("ssh: removing stale ephemeral user %q: %v", name, err)
+			continue
+		}
+		srv.logf("ssh: removed stale ephemeral user %q", name)
+	}
+}
@@ -0,0 +1,206 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux || (darwin && !ios) || windows
+// +build linux darwin,!ios windows
+
+package tailssh
+
+import (
+	"sort"
+	"sync"
+
+	"tailscale.com/ipn/ipnstate"
+	gossh "tailscale.com/tempfork/golang-x-crypto/ssh"
+	"tailscale.com/util/netconv"
+)
+
+// maxRecentEvents is how many events the server remembers to send
+// new subscribers that ask for them.
+const maxRecentEvents = 50
+
+// eventSubscriberBuffer is how many events may be queued for a
+// subscriber before further events are dropped. It must be at least
+// maxRecentEvents.
+const eventSubscriberBuffer = 2 * maxRecentEvents
+
+// eventSubscriber is a subscriber to the server's events.
+type eventSubscriber struct {
+	ch   chan ipnstate.SSHEvent
+	done chan struct{} // closed on unsubscribe
+}
+
+// publishEvent sends ev to the event subscribers and remembers it for
+// future ones. If ev.Time is zero, it's set to now.
+func (srv *server) publishEvent(ev ipnstate.SSHEvent) {
+	if ev.Time.IsZero() {
+		ev.Time = srv.now()
+	}
+	if srv.onEvent != nil {
+		srv.onEvent(ev)
+	}
+	if !srv.isConnChild {
+		// Connection child processes' events are logged and
+		// counted by tailscaled, which they send them to.
+		srv.logf.JSON(1, "SSHEvent", ev)
+		countEvent(ev)
+	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if len(srv.recentEvents) == maxRecentEvents {
+		copy(srv.recentEvents, srv.recentEvents[1:])
+		srv.recentEvents = srv.recentEvents[:maxRecentEvents-1]
+	}
+	srv.recentEvents = append(srv.recentEvents, ev)
+	for sub := range srv.eventSubscribers {
+		select {
+		case sub.ch <- ev:
+		default:
+			srv.logf("ssh: event subscriber too slow; dropping %s event", ev.Type)
+		}
+	}
+}
+
+// countEvent updates the metrics that count events like ev.
+func countEvent(ev ipnstate.SSHEvent) {
+	switch ev.Type {
+	case ipnstate.SSHEventSessionStart:
+		metricSessions.Add(1)
+		metricActiveSessions.Add(1)
+	case ipnstate.SSHEventSessionEnd:
+		metricActiveSessions.Add(-1)
+	case ipnstate.SSHEventReject:
+		metricRejections.Add(1)
+	case ipnstate.SSHEventForward:
+		metricForwards.Add(1)
+	case ipnstate.SSHEventForwardEnd:
+		metricForwardBytes.Add(ev.BytesSent + ev.BytesReceived)
+	}
+}
+
+// SubscribeEvents implements ipnlocal.SSHServer. It calls fn with each
+// event, in order and from a goroutine of its own, starting with the
+// recently published ones if recent is set, until unsubscribe is
+// called. fn shouldn't take long, as events published while it runs
+// are queued, and dropped if too many are.
+func (srv *server) SubscribeEvents(recent bool, fn func(ipnstate.SSHEvent)) (unsubscribe func()) {
+	sub := &eventSubscriber{
+		ch:   make(chan ipnstate.SSHEvent, eventSubscriberBuffer),
+		done: make(chan struct{}),
+	}
+	srv.mu.Lock()
+	if recent {
+		for _, ev := range srv.recentEvents {
+			sub.ch <- ev
+		}
+	}
+	mapSet(&srv.eventSubscribers, sub, true)
+	srv.mu.Unlock()
+
+	go func() {
+		for {
+			select {
+			case <-sub.done:
+				return
+			case ev := <-sub.ch:
+				fn(ev)
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			srv.mu.Lock()
+			defer srv.mu.Unlock()
+			delete(srv.eventSubscribers, sub)
+			close(sub.done)
+		})
+	}
+}
+
+// sessionEvent returns an event of type typ about ss.
+func (ss *sshSession) sessionEvent(typ ipnstate.SSHEventType) ipnstate.SSHEvent {
+	ev := ipnstate.SSHEvent{
+		Type:      typ,
+		Src:       netconv.AsIPPort(ss.connInfo.src),
+		SSHUser:   ss.connInfo.sshUser,
+		SessionID: ss.sharedID,
+		Rule:      ss.connInfo.rule,
+	}
+	if ss.connInfo.uprof != nil {
+		ev.LoginName = ss.connInfo.uprof.LoginName
+	}
+	if ss.localUser != nil {
+		ev.LocalUser = ss.localUser.Username
+	}
+	return ev
+}
+
+// execEvent returns the exec event of ss, for when its shell, command
+// or subsystem starts.
+func (ss *sshSession) execEvent() ipnstate.SSHEvent {
+	ev := ss.sessionEvent(ipnstate.SSHEventExec)
+	ev.Command = ss.command()
+	ev.Subsystem = ss.subsystem()
+	return ev
+}
+
+// Status implements ipnlocal.SSHServer.
+func (srv *server) Status() *ipnstate.SSHServerStatus {
+	st := &ipnstate.SSHServerStatus{
+		Supported: true,
+		Recording: srv.recordingStatus(),
+	}
+	pol, source, ok := srv.sshPolicyAndSource()
+	if ok {
+		st.PolicySource = source
+		st.PolicyRules = len(pol.Rules)
+
+		// Only look at the host keys if SSH is in use, as the first
+		// look generates them.
+		keys, err := srv.lb.GetSSH_HostKeys()
+		if err != nil {
+			st.HostKeysErr = err.Error()
+		}
+		for _, k := range keys {
+			pub := k.PublicKey()
+			st.HostKeys = append(st.HostKeys, pub.Type()+" "+gossh.FingerprintSHA256(pub))
+		}
+		for _, k := range srv.hostCertSigners(keys) {
+			pub := k.PublicKey()
+			st.HostKeys = append(st.HostKeys, pub.Type()+" "+gossh.FingerprintSHA256(pub))
+		}
+	}
+
+	srv.mu.Lock()
+	for id, ev := range srv.connChildSessions {
+		st.Sessions = append(st.Sessions, &ipnstate.SSHSessionStatus{
+			ID:        id,
+			Started:   ev.Time,
+			Src:       ev.Src,
+			LoginName: ev.LoginName,
+			LocalUser: ev.LocalUser,
+		})
+	}
+	for _, ss := range srv.activeSessionBySharedID {
+		ev := ss.sessionEvent("")
+		st.Sessions = append(st.Sessions, &ipnstate.SSHSessionStatus{
+			ID:        ss.sharedID,
+			Started:   ss.connInfo.now,
+			Src:       ev.Src,
+			LoginName: ev.LoginName,
+			LocalUser: ev.LocalUser,
+		})
+	}
+	srv.mu.Unlock()
+	sort.Slice(st.Sessions, func(i, j int) bool {
+		si, sj := st.Sessions[i], st.Sessions[j]
+		if !si.Started.Equal(sj.Started) {
+			return si.Started.Before(sj.Started)
+		}
+		return si.ID < sj.ID
+	})
+	return st
+}
@@ -0,0 +1,2808 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux || darwin
+// +build linux darwin
+
+package tailssh
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"os/user"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"inet.af/netaddr"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+	gossh "tailscale.com/tempfork/golang-x-crypto/ssh"
+	"tailscale.com/tstest"
+	"tailscale.com/types/netmap"
+	"tailscale.com/util/netconv"
+)
+
+// This file has a harness for end-to-end tests of the SSH server. It
+// runs the server against a fake LocalBackend, with a synthetic netmap
+// and SSH policy, and drives it with a real SSH client over a
+// loopback connection.
+
+var (
+	testSelfIP = netip.MustParseAddr("100.64.0.1")
+	testPeerIP = netip.MustParseAddr("100.64.0.2")
+)
+
+// testPeer is a Tailscale identity that connections can come from.
+type testPeer struct {
+	node  *tailcfg.Node
+	uprof tailcfg.UserProfile
+}
+
+// testBackend is a fake ipnLocalBackend.
+type testBackend struct {
+	hostKeys []gossh.Signer
+	varRoot  string
+
+	mu    sync.Mutex
+	nm    *netmap.NetworkMap
+	peers map[netip.Addr]testPeer
+	noise http.Handler // serves DoNoiseRequest, if non-nil
+
+	// dialPeerAgent, if non-nil, implements DialPeerSSHAgent.
+	dialPeerAgent func(ctx context.Context, peer netaddr.IP, sport, dport uint16) (io.ReadWriteCloser, error)
+
+	// dialPeerTCP, if non-nil, implements DialPeerTCP.
+	dialPeerTCP func(ctx context.Context, ipp netaddr.IPPort) (net.Conn, error)
+}
+
+func (b *testBackend) GetSSH_HostKeys() ([]gossh.Signer, error) { return b.hostKeys, nil }
+func (b *testBackend) TailscaleVarRoot() string                 { return b.varRoot }
+
+func (b *testBackend) NetMap() *netmap.NetworkMap {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.nm
+}
+
+func (b *testBackend) WhoIs(ipp netaddr.IPPort) (*tailcfg.Node, tailcfg.UserProfile, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	p, ok := b.peers[netconv.AsAddr(ipp.IP())]
+	return p.node, p.uprof, ok
+}
+
+func (b *testBackend) DoNoiseRequest(req *http.Request) (*http.Response, error) {
+	b.mu.Lock()
+	h := b.noise
+	b.mu.Unlock()
+	if h == nil {
+		return nil, errors.New("no noise handler")
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec.Result(), nil
+}
+
+func (b *testBackend) DialPeerSSHAgent(ctx context.Context, peer netaddr.IP, sport, dport uint16) (io.ReadWriteCloser, error) {
+	b.mu.Lock()
+	f := b.dialPeerAgent
+	b.mu.Unlock()
+	if f == nil {
+		return nil, errors.New("no peer agents")
+	}
+	return f(ctx, peer, sport, dport)
+}
+
+func (b *testBackend) DialPeerTCP(ctx context.Context, ipp netaddr.IPPort) (net.Conn, error) {
+	b.mu.Lock()
+	f := b.dialPeerTCP
+	b.mu.Unlock()
+	if f == nil {
+		return nil, errors.New("no peers to dial")
+	}
+	return f(ctx, ipp)
+}
+
+// setPolicy replaces the SSH policy in the netmap.
+func (b *testBackend) setPolicy(pol *tailcfg.SSHPolicy) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	nm := *b.nm
+	nm.SSHPolicy = pol
+	b.nm = &nm
+}
+
+// sshHarness is an SSH server under test.
+type sshHarness struct {
+	t         *testing.T
+	srv       *server
+	lb        *testBackend
+	localUser *user.User
+}
+
+// newSSHHarness returns a harness whose server has the SSH policy pol.
+// Connections from testPeerIP are from the user "alice@example.com".
+func newSSHHarness(t *testing.T, pol *tailcfg.SSHPolicy) *sshHarness {
+	t.Helper()
+	u, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := gossh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb := &testBackend{
+		hostKeys: []gossh.Signer{signer},
+		varRoot:  t.TempDir(),
+		nm: &netmap.NetworkMap{
+			SelfNode: &tailcfg.Node{
+				ID:        1,
+				StableID:  "self",
+				Addresses: []netaddr.IPPrefix{netaddr.IPPrefixFrom(netconv.AsIP(testSelfIP), 32)},
+			},
+			SSHPolicy: pol,
+		},
+		peers: map[netip.Addr]testPeer{
+			testPeerIP: {
+				node:  &tailcfg.Node{ID: 2, StableID: "peer"},
+				uprof: tailcfg.UserProfile{ID: 2, LoginName: "alice@example.com"},
+			},
+		},
+	}
+	// Sessions may log after the test is over.
+	lt := tstest.NewLogLineTracker(t.Logf, nil)
+	t.Cleanup(lt.Close)
+	srv := &server{lb: lb, logf: lt.Logf}
+	srv.Start()
+	return &sshHarness{
+		t:         t,
+		srv:       srv,
+		lb:        lb,
+		localUser: u,
+	}
+}
+
+// acceptRule returns a rule that lets alice in as the test's local
+// user with action a.
+func (h *sshHarness) acceptRule(a *tailcfg.SSHAction) *tailcfg.SSHRule {
+	return &tailcfg.SSHRule{
+		Principals: []*tailcfg.SSHPrincipal{{UserLogin: "alice@example.com"}},
+		SSHUsers:   map[string]string{"*": h.localUser.Username},
+		Action:     a,
+	}
+}
+
+// connPair returns the two ends of a loopback TCP connection. Unlike
+// net.Pipe's, its writes are buffered, as both sides of an SSH
+// connection start by writing.
+func connPair(t *testing.T) (c, s net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	c, err = net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err = ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, s
+}
+
+// serveConn returns the client end of a new connection to the server
+// from the Tailscale IP from.
+func (h *sshHarness) serveConn(from netip.Addr) net.Conn {
+	c, s := connPair(h.t)
+	sc := addrConn{
+		Conn:   s,
+		local:  net.TCPAddrFromAddrPort(netip.AddrPortFrom(testSelfIP, 22)),
+		remote: net.TCPAddrFromAddrPort(netip.AddrPortFrom(from, 41641)),
+	}
+	go func() {
+		if err := h.srv.HandleSSHConn(sc); err != nil {
+			h.srv.logf("HandleSSHConn: %v", err)
+			sc.Close()
+		}
+	}()
+	return c
+}
+
+// dial connects an SSH client to the server as if from the Tailscale
+// IP from, authenticating with auth (just "none" if empty).
+func (h *sshHarness) dial(from netip.Addr, auth ...gossh.AuthMethod) (*gossh.Client, error) {
+	c := h.serveConn(from)
+	cc, chans, reqs, err := gossh.NewClientConn(c, "test", &gossh.ClientConfig{
+		User:            "testuser",
+		Auth:            auth,
+		HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+		Timeout:         10 * time.Second,
+	})
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	client := gossh.NewClient(cc, chans, reqs)
+	h.t.Cleanup(func() { client.Close() })
+	return client, nil
+}
+
+// mustDial is like dial but fails the test on error.
+func (h *sshHarness) mustDial(auth ...gossh.AuthMethod) *gossh.Client {
+	h.t.Helper()
+	c, err := h.dial(testPeerIP, auth...)
+	if err != nil {
+		h.t.Fatalf("dial: %v", err)
+	}
+	return c
+}
+
+// ptyOutput runs cmd in s, which has a PTY, and returns its output.
+// It holds stdin open meanwhile, as the server hangs up the PTY on
+// stdin EOF.
+func ptyOutput(t *testing.T, s *gossh.Session, cmd string) (string, error) {
+	t.Helper()
+	stdin, err := s.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdin.Close()
+	out, err := s.Output(cmd)
+	return string(out), err
+}
+
+// run runs cmd in a new session on c and returns its stdout and
+// stderr.
+func run(t *testing.T, c *gossh.Client, cmd string) (stdout, stderr string, err error) {
+	t.Helper()
+	s, err := c.NewSession()
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	defer s.Close()
+	var outBuf, errBuf bytes.Buffer
+	s.Stdout = &outBuf
+	s.Stderr = &errBuf
+	err = s.Run(cmd)
+	return outBuf.String(), errBuf.String(), err
+}
+
+func exitStatus(err error) int {
+	var ee *gossh.ExitError
+	if errors.As(err, &ee) {
+		return ee.ExitStatus()
+	}
+	if err != nil {
+		return -1
+	}
+	return 0
+}
+
+func TestHarnessExec(t *testing.T) {
+	h := newSSHHarness(t, nil)
+	h.lb.setPolicy(&tailcfg.SSHPolicy{Rules: []*tailcfg.SSHRule{
+		h.acceptRule(&tailcfg.SSHAction{Accept: true}),
+	}})
+	c := h.mustDial()
+
+	out, _, err := run(t, c, "echo hello; echo oops >&2; exit 3")
+	if got := exitStatus(err); got != 3 {
+		t.Errorf("exit status = %v (%v); want 3", got, err)
+	}
+	if out != "hello\n" {
+		t.Errorf("stdout = %q; want %q", out, "hello\n")
+	}
+
+	out, _, err = run(t, c, "echo $USER $SSH_CONNECTION")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := fmt.Sprintf("%s %v 41641 %v 22\n", h.localUser.Username, testPeerIP, testSelfIP)
+	if out != want {
+		t.Errorf("stdout = %q; want %q", out, want)
+	}
+}
+
+func TestHarnessExitSignal(t *testing.T) {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, viaIncubator := range []bool{false, true} {
+		t.Run(fmt.Sprintf("incubator=%v", viaIncubator), func(t *testing.T) {
+			if viaIncubator && runtime.GOOS != "linux" {
+				t.Skip("the incubator can only die from its command's signal on Linux")
+			}
+			h := newSSHHarness(t, nil)
+			if viaIncubator {
+				h.srv.tailscaledPath = exe
+			}
+			h.lb.setPolicy(&tailcfg.SSHPolicy{Rules: []*tailcfg.SSHRule{
+				h.acceptRule(&tailcfg.SSHAction{Accept: true}),
+			}})
+			c := h.mustDial()
+
+			_, _, err := run(t, c, "kill -TERM $$")
+			var ee *gossh.ExitError
+			if !errors.As(err, &ee) || ee.Signal() != "TERM" {
+				t.Errorf("err = %v; want exit-signal TERM", err)
+			}
+			_, _, err = run(t, c, "exit 3")
+			if got := exitStatus(err); got != 3 {
+				t.Errorf("exit status = %v (%v); want 3", got, err)
+			}
+		})
+	}
+}
+
+// TestHarnessEndIncubator tests that an incubator that's told to end
+// its session ends the session's command too, rather than being killed
+// and leaving it behind.
+func TestHarnessEndIncubator(t *testing.T) {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newSSHHarness(t, nil)
+	h.srv.tailscaledPath = exe
+	h.lb.setPolicy(&tailcfg.SSHPolicy{Rules: []*tailcfg.SSHRule{
+		h.acceptRule(&tailcfg.SSHAction{Accept: true}),
+	}})
+	c := h.mustDial()
+	s, err := c.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	stdout, err := s.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start("echo $$; exec sleep 30"); err != nil {
+		t.Fatal(err)
+	}
+	var pid int
+	if _, err := fmt.Fscan(stdout, &pid); err != nil {
+		t.Fatal(err)
+	}
+
+	h.srv.Stop()
+	waitErr := make(chan error, 1)
+	go func() { waitErr <- s.Wait() }()
+	select {
+	case <-waitErr:
+	case <-time.After(10 * time.Second):
+		t.Fatal("session still running after Stop")
+	}
+	for deadline := time.Now().Add(5 * time.Second); syscall.Kill(pid, 0) == nil; {
+		if time.Now().After(deadline) {
+			syscall.Kill(pid, syscall.SIGKILL)
+			t.Fatalf("the session's command, pid %d, outlived it", pid)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHarnessUmaskAndUlimits(t *testing.T) {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newSSHHarness(t, nil)
+	h.srv.tailscaledPath = exe
+	h.lb.setPolicy(&tailcfg.SSHPolicy{Rules: []*tailcfg.SSHRule{
+		h.acceptRule(&tailcfg.SSHAction{
+			Accept:  true,
+			Umask:   "027",
+			Ulimits: map[string]string{"nofile": "100:200", "core": "0"},
+		}),
+	}})
+	c := h.mustDial()
+	out, _, err := run(t, c, "umask; ulimit -Sn; ulimit -Hn; ulimit -Hc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Fields(out), []string{"0027", "100", "200", "0"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q; want %q", got, want)
+	}
+}
+
+func TestHarnessOpenSSHGlobalRequests(t *testing.T) {
+	h := newSSHHarness(t, nil)
+	h.lb.setPolicy(&tailcfg.SSHPolicy{Rules: []*tailcfg.SSHRule{
+		h.acceptRule(&tailcfg.SSHAction{Accept: true}),
+	}})
+	c := h.mustDial()
+
+	// Keepalives get a reply, if a failure one, as from OpenSSH.
+	if ok, _, err := c.SendRequest("keepalive@openssh.com", true, nil); err != nil || ok {
+		t.Errorf("keepalive = %v, %v; want false, nil", ok, err)
+	}
+
+	s, err := c.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if ok, _, err := c.SendRequest("no-more-sessions@openssh.com", true, nil); err != nil || !ok {
+		t.Fatalf("no-more-sessions = %v, %v; want true, nil", ok, err)
+	}
+	if s2, err := c.NewSession(); err == nil {
+		s2.Close()
+		t.Error("new session opened after no-more-sessions")
+	}
+	// The session that was already open still works.
+	if out, err := s.Output("echo still-here"); err != nil || !strings.Contains(string(out), "still-here") {
+		t.Errorf("existing session = %q, %v", out, err)
+	}
+}
+
+func TestHarnessBanner(t *testing.T) {
+	defer func(v string) { bannerFile = v }(bannerFile)
+	bannerFile = filepath.Join(t.TempDir(), "banner")
+	if err := os.WriteFile(bannerFile, []byte("local notice\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	h := newSSHHarness(t, nil)
+	rules := []*tailcfg.SSHRule{h.acceptRule(&tailcfg.SSHAction{Accept: true})}
+
+	banner := func() string {
+		t.Helper()
+		var got string
+		cc, chans, reqs, err := gossh.NewClientConn(h.serveConn(testPeerIP), "test", &gossh.ClientConfig{
+			User:            "testuser",
+			HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+			BannerCallback: func(msg string) error {
+				got = msg
+				return nil
+			},
+			Timeout: 10 * time.Second,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		gossh.NewClient(cc, chans, reqs).Close()
+		return got
+	}
+
+	h.lb.setPolicy(&tailcfg.SSHPolicy{Rules: rules})
+	if got := banner(); got != "local notice\n" {
+		t.Errorf("banner = %q; want the local one", got)
+	}
+	h.lb.setPolicy(&tailcfg.SSHPolicy{Rules: rules, Banner: "policy notice\n"})
+	if got := banner(); got != "policy notice\n" {
+		t.Errorf("banner = %q; want the policy's", got)
+	}
+}
+
+func TestHarnessReject(t *testing.T) {
+	h := newSSHHarness(t, &tailcfg.SSHPolicy{})
+
+	// No rule matches, so the session is refused.
+	c := h.mustDial()
+	out, _, err := run(t, c, "echo hello")
+	if got := exitStatus(err); got != 1 {
+		t.Errorf("exit status = %v (%v); want 1", got, err)
+	}
+	if out != "" {
+		t.Errorf("stdout = %q; want nothing", out)
+	}
+
+	// Non-Tailscale addresses are refused too.
+	h.lb.setPolicy(&tailcfg.SSHPolicy{Rules: []*tailcfg.SSHRule{
+		h.acceptRule(&tailcfg.SSHAction{Accept: true}),
+	}})
+	c, err = h.dial(netip.MustParseAddr("192.168.0.2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := run(t, c, "true"); exitStatus(err) != 1 {
+		t.Errorf("from non-Tailscale IP: %v; want exit status 1", err)
+	}
+}
+
+func TestHarnessPubKeyAuth(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := gossh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newSSHHarness(t, nil)
+	r := h.acceptRule(&tailcfg.SSHAction{Accept: true})
+	r.Principals[0].PubKeys = []string{string(gossh.MarshalAuthorizedKey(signer.PublicKey()))}
+	h.lb.setPolicy(&tailcfg.SSHPolicy{Rules: []*tailcfg.SSHRule{r}})
+
+	if _, err := h.dial(testPeerIP); err == nil {
+		t.Error("dial without a key succeeded")
+	}
+
+	_, otherPriv, _ := ed25519.GenerateKey(rand.Reader)
+	other, _ := gossh.NewSignerFromKey(otherPriv)
+	if _, err := h.dial(testPeerIP, gossh.PublicKeys(other)); err == nil {
+		t.Error("dial with the wrong key succeeded")
+	}
+
+	c := h.mustDial(gossh.PublicKeys(signer))
+	if out, _, err := run(t, c, "echo ok"); err != nil || out != "ok\n" {
+		t.Errorf("run = %q, %v", out, err)
+	}
+}
+
+// skSigner is a gossh.Signer for an sk-ssh-ed25519@openssh.com key,
+// signing as a FIDO2 security key would, with the given flags.
+type skSigner struct {
+	priv  ed25519.PrivateKey
+	pub   gossh.PublicKey
+	flags byte
+}
+
+func newSKSigner(t *testing.T) *skSigner {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk, err := gossh.ParsePublicKey(gossh.Marshal(struct {
+		Type        string
+		Key         []byte
+		Application string
+	}{gossh.KeyAlgoSKED25519, pub, "ssh:"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &skSigner{priv: priv, pub: pk, flags: skFlagUserPresent}
+}
+
+func (s *skSigner) PublicKey() gossh.PublicKey { return s.pub }
+
+func (s *skSigner) Sign(_ io.Reader, data []byte) (*gossh.Signature, error) {
+	const counter = 1
+	flags := s.flags
+	appDigest := sha256.Sum256([]byte("ssh:"))
+	dataDigest := sha256.Sum256(data)
+	signed := gossh.Marshal(struct {
+		AppDigest  []byte `ssh:"rest"`
+		Flags      byte
+		Counter    uint32
+		DataDigest []byte `ssh:"rest"`
+	}{appDigest[:], flags, counter, dataDigest[:]})
+	return &gossh.Signature{
+		Format: gossh.KeyAlgoSKED25519,
+		Blob:   ed25519.Sign(s.priv, signed),
+		Rest: gossh.Marshal(struct {
+			Flags   byte
+			Counter uint32
+		}{flags, counter}),
+	}, nil
+}
+
+func TestHarnessSecurityKeyAuth(t *testing.T) {
+	signer := newSKSigner(t)
+	authKey := strings.TrimSpace(string(gossh.MarshalAuthorizedKey(signer.PublicKey())))
+	h := newSSHHarness(t, nil)
+	tests := []struct {
+		key   string
+		flags byte
+		want  bool
+	}{
+		{authKey, skFlagUserPresent, true},
+		{authKey, 0, false}, // touch required
+		{"no-touch-required " + authKey, 0, true},
+		{"verify-required " + authKey, skFlagUserPresent, false},
+		{"verify-required " + authKey, skFlagUserPresent | skFlagUserVerified, true},
+		{"no-touch-required,verify-required " + authKey, skFlagUserVerified, true},
+	}
+	for _, tt := range tests {
+		r := h.acceptRule(&tailcfg.SSHAction{Accept: true})
+		r.Principals[0].PubKeys = []string{tt.key}
+		h.lb.setPolicy(&tailcfg.SSHPolicy{Rules: []*tailcfg.SSHRule{r}})
+		signer.flags = tt.flags
+		c, err := h.dial(testPeerIP, gossh.PublicKeys(signer))
+		if !tt.want {
+			if err == nil {
+				t.Errorf("dial with %q and flags %#x succeeded", tt.key, tt.flags)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("dial with %q and flags %#x: %v", tt.key, tt.flags, err)
+			continue
+		}
+		if out, _, err := run(t, c, "echo ok"); err != nil || out != "ok\n" {
+			t.Errorf("run = %q, %v", out, err)
+		}
+	}
+}
+
+func TestHarnessPubKeyAlgorithms(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edSigner, err := gossh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	skSigner := newSKSigner(t)
+	h := newSSHHarness(t, nil)
+	r := h.acceptRule(&tailcfg.SSHAction{Accept: true})
+	r.Principals[0].PubKeys = []string{
+		string(gossh.MarshalAuthorizedKey(edSigner.PublicKey())),
+		string(gossh.MarshalAuthorizedKey(skSigner.PublicKey())),
+	}
+	h.lb.setPolicy(&tailcfg.SSHPolicy{
+		Rules:            []*tailcfg.SSHRule{r},
+		PubKeyAlgorithms: []string{gossh.KeyAlgoSKED25519},
+	})
+
+	if _, err := h.dial(testPeerIP, gossh.PublicKeys(edSigner)); err == nil {
+		t.Error("dial with a disallowed key type succeeded")
+	}
+	h.srv.mu.Lock()
+	var reason string
+	if n := len(h.srv.recentRejections); n > 0 {
+		reason = h.srv.recentRejections[n-1].reason
+	}
+	h.srv.mu.Unlock()
+	if !strings.Contains(reason, "public key algorithm ssh-ed25519 not allowed") {
+		t.Errorf("rejection reason = %q", reason)
+	}
+
+	c := h.mustDial(gossh.PublicKeys(skSigner))
+	if out, _, err := run(t, c, "echo ok"); err != nil || out != "ok\n" {
+		t.Errorf("run = %q, %v", out, err)
+	}
+
+	// Nor can clients get around the restriction by offering no key.
+	if _, err := h.dial(testPeerIP); err == nil {
+		t.Error("dial with no key succeeded")
+	}
+	noAnswers := func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+		return make([]string, len(questions)), nil
+	}
+	if _, err := h.dial(testPeerIP, gossh.KeyboardInteractive(noAnswers)); err == nil {
+		t.Error("dial with keyboard-interactive auth succeeded")
+	}
+	if got := h.srv.authBanner(nil); !strings.Contains(got, "only accepts public keys using: "+gossh.KeyAlgoSKED25519) {
+		t.Errorf("banner = %q", got)
+	}
+}
+
+func TestHarnessPubKeySignatureAlgorithms(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := gossh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newSSHHarness(t, nil)
+	r := h.acceptRule(&tailcfg.SSHAction{Accept: true})
+	r.Principals[0].PubKeys = []string{string(gossh.MarshalAuthorizedKey(signer.PublicKey()))}
+	h.lb.setPolicy(&tailcfg.SSHPolicy{
+		Rules:            []*tailcfg.SSHRule{r},
+		PubKeyAlgorithms: []string{gossh.KeyAlgoRSASHA256},
+	})
+
+	// Without server-sig-algs, which the server doesn't send, Go's
+	// client signs with SHA-1.
+	if _, err := h.dial(testPeerIP, gossh.PublicKeys(signer)); err == nil {
+		t.Error("dial signing with ssh-rsa succeeded")
+	}
+	c := h.mustDial(gossh.PublicKeys(rsaSHA256Signer{signer.(gossh.AlgorithmSigner)}))
+	if out, _, err := run(t, c, "echo ok"); err != nil || out != "ok\n" {
+		t.Errorf("run = %q, %v", out, err)
+	}
+}
+
+// rsaSHA256Signer is an RSA signer that Go's SSH client signs with
+// rsa-sha2-256.
+type rsaSHA256Signer struct {
+	gossh.AlgorithmSigner
+}
+
+func (s rsaSHA256Signer) PublicKey() gossh.PublicKey {
+	return rsaSHA256Key{s.AlgorithmSigner.PublicKey()}
+}
+
+// rsaSHA256Key is an RSA public key that claims to be of type
+// rsa-sha2-256, as the client picks the algorithm to sign with by it.
+type rsaSHA256Key struct {
+	gossh.PublicKey
+}
+
+func (rsaSHA256Key) Type() string { return gossh.KeyAlgoRSASHA256 }
+
+func TestHarnessPubKeyOptions(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := gossh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newSSHHarness(t, nil)
+	r := h.acceptRule(&tailcfg.SSHAction{Accept: true, AllowLocalPortForwarding: true})
+	r.Principals[0].PubKeys = []string{`command="echo forced",no-port-forwarding ` + string(gossh.MarshalAuthorizedKey(signer.PublicKey()))}
+	h.lb.setPolicy(&tailcfg.SSHPolicy{Rules: []*tailcfg.SSHRule{r}})
+
+	c := h.mustDial(gossh.PublicKeys(signer))
+	if out, _, err := run(t, c, "echo asked"); err != nil || out != "forced\n" {
+		t.Errorf("run = %q, %v; want the key's command", out, err)
+	}
+
+	// The key's no-port-forwarding overrides the action's permission.
+	s, err := c.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	stdout, err := s.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start("ignored"); err != nil {
+		t.Fatal(err)
+	}
+	if line, err := bufio.NewReader(stdout).ReadString('\n'); err != nil || line != "forced\n" {
+		t.Fatalf("session output = %q, %v", line, err)
+	}
+	if fc, err := c.Dial("tcp", "127.0.0.1:1"); err == nil {
+		fc.Close()
+		t.Error("forwarding succeeded for a no-port-forwarding key; want refused")
+	}
+}
+
+func TestHarnessHoldAndDelegate(t *testing.T) {
+	h := newSSHHarness(t, nil)
+	h.lb.setPolicy(&tailcfg.SSHPolicy{Rules: []*tailcfg.SSHRule{
+		h.acceptRule(&tailcfg.SSHAction{
+			Message:         "waiting for approval\n",
+			HoldAndDelegate: "https://unused/ssh-action/$SRC_NODE_ID/$SRC_NODE_IP",
+		}),
+	}})
+	var gotPath string
+	h.lb.noise = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		json.NewEncoder(w).Encode(&tailcfg.SSHAction{Accept: true, Message: "approved\n"})
+	})
+
+	c := h.mustDial()
+	out, stderr, err := run(t, c, "echo ok")
+	if err != nil || out != "ok\n" {
+		t.Errorf("run = %q, %v", out, err)
+	}
+	if want := "waiting for approval\r\napproved\r\n"; !strings.HasPrefix(stderr, want) {
+		t.Errorf("stderr = %q; want prefix %q", stderr, want)
+	}
+	if want := "/ssh-action/2/" + testPeerIP.String(); gotPath != want {
+		t.Errorf("delegate path = %q; want %q", gotPath, want)
+	}
+}
+
+func TestHarnessHoldAndDelegatePOST(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := gossh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newSSHHarness(t, nil)
+	h.lb.setPolicy(&tailcfg.SSHPolicy{Rules: []*tailcfg.SSHRule{
+		h.acceptRule(&tailcfg.SSHAction{
+			HoldAndDelegate:     "https://unused/ssh-action/$SRC_NODE_ID",
+			HoldAndDelegatePOST: true,
+		}),
+	}})
+	var gotMethod, gotPath string
+	var got tailcfg.SSHDelegateRequest
+	h.lb.noise = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotMethod, gotPath = r.Method, r.URL.Path
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(&tailcfg.SSHAction{Accept: true})
+	})
+
+	c := h.mustDial(gossh.PublicKeys(signer))
+	if out, _, err := run(t, c, "echo ok"); err != nil || out != "ok\n" {
+		t.Errorf("run = %q, %v", out, err)
+	}
+	if gotMethod != "POST" || gotPath != "/ssh-action/2" {
+		t.Errorf("delegate request = %s %s; want POST /ssh-action/2", gotMethod, gotPath)
+	}
+	if got.SrcNode == nil || got.SrcNode.StableID != "peer" {
+		t.Errorf("SrcNode = %+v; want the peer", got.SrcNode)
+	}
+	if got.User.LoginName != "alice@example.com" || got.DstNodeID != 1 || got.SrcAddr.IP() != netconv.AsIP(testPeerIP) {
+		t.Errorf("User, DstNodeID, SrcAddr = %q, %v, %v", got.User.LoginName, got.DstNodeID, got.SrcAddr)
+	}
+	if want := gossh.FingerprintSHA256(signer.PublicKey()); got.PubKeyFingerprint != want {
+		t.Errorf("PubKeyFingerprint = %q; want %q", got.PubKeyFingerprint, want)
+	}
+	if got.LocalUser != h.localUser.Username || got.Command != "echo ok" || got.SessionID == "" {
+		t.Errorf("LocalUser, Command, SessionID = %q, %q, %q", got.LocalUser, got.Command, got.SessionID)
+	}
+}
+
+func TestHarnessPTY(t *testing.T) {
+	h := newSSHHarness(t, nil)
+	h.lb.setPolicy(&tailcfg.SSHPolicy{Rules: []*tailcfg.SSHRule{
+		h.acceptRule(&tailcfg.SSHAction{Accept: true}),
+	}})
+	c := h.mustDial()
+	s, err := c.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.RequestPty("xterm-test", 40, 80, gossh.TerminalModes{gossh.ECHO: 0}); err != nil {
+		t.Fatal(err)
+	}
+	out, err := ptyOutput(t, s, `echo "$TERM $(stty size)"; test -t 0 && echo tty`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "xterm-test 40 80\r\ntty\r\n"; !strings.HasSuffix(out, want) {
+		t.Errorf("output = %q; want suffix %q", out, want)
+	}
+}
+
+func TestHarnessBreak(t *testing.T) {
+	h := newSSHHarness(t, nil)
+	h.lb.setPolicy(&tailcfg.SSHPolicy{Rules: []*tailcfg.SSHRule{
+		h.acceptRule(&tailcfg.SSHAction{Accept: true}),
+	}})
+	c := h.mustDial()
+
+	// breakOutput runs cmd in a pty, sends a break once it has printed
+	// "ready", and returns what it prints after that.
+	breakOutput := func(cmd string) string {
+		t.Helper()
+		s, err := c.NewSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		if err := s.RequestPty("xterm", 24, 80, gossh.TerminalModes{gossh.ECHO: 0}); err != nil {
+			t.Fatal(err)
+		}
+		stdout, err := s.StdoutPipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Start(cmd); err != nil {
+			t.Fatal(err)
+		}
+		br := bufio.NewReader(stdout)
+		for {
+			line, err := br.ReadString('\n')
+			if err != nil {
+				t.Fatalf("waiting for ready: %v", err)
+			}
+			if strings.HasPrefix(line, "ready") {
+				break
+			}
+		}
+		ok, err := s.SendRequest("break", true, gossh.Marshal(struct{ Ms uint32 }{500}))
+		if err != nil || !ok {
+			t.Fatalf("break = %v, %v", ok, err)
+		}
+		out, _ := io.ReadAll(br)
+		return string(out)
+	}
+
+	// With BRKINT, a break interrupts the foreground process group.
+	out := breakOutput("stty brkint; trap 'echo interrupted; exit 0' INT; echo ready; sleep 10")
+	if !strings.Contains(out, "interrupted") {
+		t.Errorf("output = %q; want it interrupted", out)
+	}
+
+	// Otherwise, it's read as a NUL byte.
+	out = breakOutput("stty raw -brkint -ignbrk -parmrk; echo ready; head -c1 | od -An -tx1")
+	if !strings.Contains(out, "00") {
+		t.Errorf("output = %q; want a NUL byte read", out)
+	}
+}
+
+func TestHarnessLocalPortForwarding(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+
+	for _, allow := range []bool{false, true} {
+		t.Run(fmt.Sprintf("allow=%v", allow), func(t *testing.T) {
+			h := newSSHHarness(t, nil)
+			h.lb.setPolicy(&tailcfg.SSHPolicy{Rules: []*tailcfg.SSHRule{
+				h.acceptRule(&tailcfg.SSHAction{Accept: true, AllowLocalPortForwarding: allow}),
+			}})
+			c := h.mustDial()
+
+			// Forwarding is only allowed alongside an accepted
+			// session, so start one and wait for it to run.
+			s, err := c.NewSession()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			stdout, err := s.StdoutPipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Start("echo started; sleep 30"); err != nil {
+				t.Fatal(err)
+			}
+			if line, err := bufio.NewReader(stdout).ReadString('\n'); err != nil || line != "started\n" {
+				t.Fatalf("session output = %q, %v", line, err)
+			}
+
+			fc, err := c.Dial("tcp", ln.Addr().String())
+			if !allow {
+				if err == nil {
+					fc.Close()
+					t.Fatal("forwarding succeeded; want refused")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer fc.Close()
+			if _, err := io.WriteString(fc, "ping"); err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, 4)
+			if _, err := io.ReadFull(fc, buf); err != nil || string(buf) != "ping" {
+				t.Errorf("echo = %q, %v", buf, err)
+			}
+			fc.Close()
+
+			// The forward's end is audited once both directions are
+			// done, which is after Close returns.
+			var forwards []string
+			var end *ipnstate.SSHEvent
+			for i := 0; i < 500 && end == nil; i++ {
+				h.srv.mu.Lock()
+				events := append([]ipnstate.SSHEvent(nil), h.srv.recentEvents...)
+				h.srv.mu.Unlock()
+				forwards = nil
+				for _, ev := range events {
+					ev := ev
+					switch ev.Type {
+					case ipnstate.SSHEventForward:
+						forwards = append(forwards, ev.ForwardTo)
+					case ipnstate.SSHEventForwardEnd:
+						end = &ev
+					}
+				}
+				if end == nil {
+					time.Sleep(10 * time.Millisecond)
+				}
+			}
+			if len(forwards) != 1 || forwards[0] != ln.Addr().String() {
+				t.Errorf("forward events to %q; want one to %v", forwards, ln.Addr())
+			}
+			if end == nil {
+				t.Fatal("no forward-end event")
+			}
+			if end.ForwardTo != ln.Addr().String() || end.BytesSent != 4 || end.BytesReceived != 4 || end.SessionID == "" {
+				t.Errorf("forward-end event = %+v; want 4 bytes each way to %v in a session", end, ln.Addr())
+			}
+		})
+	}
+}
+
+func TestHarnessDynamicPortForwarding(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	for _, dynamic := range []bool{false, true} {
+		t.Run(fmt.Sprintf("dynamic=%v", dynamic), func(t *testing.T) {
+			h := newSSHHarness(t, nil)
+			h.lb.setPolicy(&tailcfg.SSHPolicy{Rules: []*tailcfg.SSHRule{
+				h.acceptRule(&tailcfg.SSHAction{
+					Accept:                          true,
+					AllowLocalPortForwarding:        true,
+					AllowDynamicPortForwarding:      dynamic,
+					LocalPortForwardingDestinations: []string{"127.0.0.1:" + port},
+				}),
+			}})
+			c := h.mustDial()
+			s, err := c.NewSession()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			stdout, err := s.StdoutPipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Start("echo started; sleep 30"); err != nil {
+				t.Fatal(err)
+			}
+			if line, err := bufio.NewReader(stdout).ReadString('\n'); err != nil || line != "started\n" {
+				t.Fatalf("session output = %q, %v", line, err)
+			}
+
+			// As a SOCKS client would, ask for the destination by
+			// name, which only resolves to an allowed one.
+			fc, err := c.Dial("tcp", net.JoinHostPort("localhost", port))
+			if !dynamic {
+				if err == nil {
+					fc.Close()
+					t.Fatal("forwarding by name succeeded; want refused")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer fc.Close()
+			if _, err := io.WriteString(fc, "ping"); err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, 4)
+			if _, err := io.ReadFull(fc, buf); err != nil || string(buf) != "ping" {
+				t.Errorf("echo = %q, %v", buf, err)
+			}
+		})
+	}
+}
+
+func TestHarnessForwardRevoked(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+
+	h := newSSHHarness(t, nil)
+	h.lb.setPolicy(&tailcfg.SSHPolicy{Rules: []*tailcfg.SSHRule{
+		h.acceptRule(&tailcfg.SSHAction{Accept: true, AllowLocalPortForwarding: true}),
+	}})
+	c := h.mustDial()
+	s, err := c.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	stdout, err := s.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start("echo started; sleep 30"); err != nil {
+		t.Fatal(err)
+	}
+	if line, err := bufio.NewReader(stdout).ReadString('\n'); err != nil || line != "started\n" {
+		t.Fatalf("session output = %q, %v", line, err)
+	}
+	fc, err := c.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fc.Close()
+	if _, err := io.WriteString(fc, "ping"); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(fc, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("echo = %q, %v", buf, err)
+	}
+
+	// The new policy still accepts the session, but not its forwards.
+	h.lb.setPolicy(&tailcfg.SSHPolicy{Rules: []*tailcfg.SSHRule{
+		h.acceptRule(&tailcfg.SSHAction{Accept: true}),
+	}})
+	h.srv.OnPolicyChange()
+	if n, err := fc.Read(buf); err != io.EOF {
+		t.Errorf("read from revoked forward = %d, %v; want EOF", n, err)
+	}
+	if fc, err := c.Dial("tcp", ln.Addr().String()); err == nil {
+		fc.Close()
+		t.Error("forwarding succeeded after being revoked; want refused")
+	}
+	h.srv.mu.Lock()
+	n := len(h.srv.activeSessionBySharedID)
+	h.srv.mu.Unlock()
+	if n != 1 {
+		t.Errorf("%d active sessions; want the one still allowed", n)
+	}
+}
+
+// TestHarnessRevalidateClientIdentity tests that sessions are checked
+// against the policy again as their client, not as the server, whose
+// owner here differs from the client.
+func TestHarnessRevalidateClientIdentity(t *testing.T) {
+	h := newSSHHarness(t, nil)
+	h.lb.peers[testSelfIP] = testPeer{
+		node:  &tailcfg.Node{ID: 1, StableID: "self"},
+		uprof: tailcfg.UserProfile{ID: 3, LoginName: "owner@example.com"},
+	}
+	ownerRule := h.acceptRule(&tailcfg.SSHAction{Accept: true})
+	ownerRule.Principals = []*tailcfg.SSHPrincipal{{UserLogin: "owner@example.com"}}
+	onlyAlice := func(checkPeriod time.Duration) {
+		h.lb.setPolicy(&tailcfg.SSHPolicy{Rules: []*tailcfg.SSHRule{
+			h.acceptRule(&tailcfg.SSHAction{Accept: true, CheckPeriod: checkPeriod}),
+		}})
+	}
+	onlyOwner := func() {
+		h.lb.setPolicy(&tailcfg.SSHPolicy{Rules: []*tailcfg.SSHRule{ownerRule}})
+	}
+	start := func() (stderr *bytes.Buffer, done chan error) {
+		t.Helper()
+		s, err := h.mustDial().NewSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Close() })
+		stderr = new(bytes.Buffer)
+		s.Stderr = stderr
+		stdout, err := s.StdoutPipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Start("echo started; sleep 30"); err != nil {
+			t.Fatal(err)
+		}
+		if line, err := bufio.NewReader(stdout).ReadString('\n'); err != nil || line != "started\n" {
+			t.Fatalf("session output = %q, %v", line, err)
+		}
+		done = make(chan error, 1)
+		go func() { done <- s.Wait() }()
+		return stderr, done
+	}
+	wantEnded := func(done chan error, stderr *bytes.Buffer, why string) {
+		t.Helper()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("session outlived alice's access")
+		}
+		if !strings.Contains(stderr.String(), why) {
+			t.Errorf("stderr = %q; want %q", stderr, why)
+		}
+	}
+
+	// On policy changes.
+	onlyAlice(0)
+	stderr, done := start()
+	h.srv.OnPolicyChange()
+	select {
+	case err := <-done:
+		t.Fatalf("session allowed to alice ended on a policy change: %v, %q", err, stderr)
+	case <-time.After(200 * time.Millisecond):
+	}
+	onlyOwner()
+	h.srv.OnPolicyChange()
+	wantEnded(done, stderr, "Access revoked")
+
+	// On periodic checks.
+	onlyAlice(100 * time.Millisecond)
+	stderr, done = start()
+	select {
+	case err := <-done:
+		t.Fatalf("session allowed to alice ended on a periodic check: %v, %q", err, stderr)
+	case <-time.After(500 * time.Millisecond):
+	}
+	onlyOwner()
+	wantEnded(done, stderr, "Re-authorization failed")
+}
+
+func TestHarnessBackgroundChildHoldsOutput(t *testing.T) {
+	h := newSSHHarness(t, nil)
+	h.lb.setPolicy(&tailcfg.SSHPolicy{Rules: []*tailcfg.SSHRule{
+		h.acceptRule(&tailcfg.SSHAction{Accept: true}),
+	}})
+	c := h.mustDial()
+
+	// The background sleep keeps the session's stdout and stderr open
+	// after the shell exits.
+	start := time.Now()
+	out, _, err := run(t, c, "sleep 30 & echo done")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "done\n" {
+		t.Errorf("stdout = %q; want %q", out, "done\n")
+	}
+	if d := time.Since(start); d > outputDrainTimeout+5*time.Second {
+		t.Errorf("session took %v to end; want about %v", d, outputDrainTimeout)
+	}
+}
+
+func TestHarnessRecording(t *testing.T) {
+	h := newSSHHarness(t, nil)
+	h.lb.setPolicy(&tailcfg.SSHPolicy{Rules: []*tailcfg.SSHRule{
+		h.acceptRule(&tailcfg.SSHAction{Accept: true, Record: true}),
+	}})
+	c := h.mustDial()
+	s, err := c.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.RequestPty("xterm", 24, 80, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ptyOutput(t, s, "echo recorded-output"); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(h.lb.varRoot, "ssh-sessions", "*.cast"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("recordings = %q, %v; want one", files, err)
+	}
+	b, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, rest, _ := strings.Cut(string(b), "\n")
+	var hdr struct {
+		Version   int
+		Width     int
+		Height    int
+		SessionID string
+		SrcNode   tailcfg.StableNodeID
+		SrcNodeIP string
+		LoginName string
+		SSHUser   string
+		LocalUser string
+	}
+	if err := json.Unmarshal([]byte(header), &hdr); err != nil {
+		t.Fatalf("header %q: %v", header, err)
+	}
+	if hdr.Version != 2 || hdr.Width != 80 || hdr.Height != 24 {
+		t.Errorf("header = %+v", hdr)
+	}
+	if hdr.SessionID == "" || hdr.SrcNode != "peer" || hdr.SrcNodeIP != testPeerIP.String() ||
+		hdr.LoginName != "alice@example.com" || hdr.LocalUser != h.localUser.Username {
+		t.Errorf("header identity = %+v", hdr)
+	}
+	if !strings.Contains(rest, `"o","recorded-output`) {
+		t.Errorf("recording lacks output: %q", rest)
+	}
+	if st := h.srv.recordingStatus(); !strings.HasPrefix(st, "enabled") {
+		t.Errorf("recordingStatus = %q; want enabled", st)
+	}
+
+	// Rules that don't ask for recording don't get it.
+	h.lb.setPolicy(&tailcfg.SSHPolicy{Rules: []*tailcfg.SSHRule{
+		h.acceptRule(&tailcfg.SSHAction{Accept: true}),
+	}})
+	s2, err := h.mustDial().NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+	if err := s2.RequestPty("xterm", 24, 80, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ptyOutput(t, s2, "echo unrecorded-output"); err != nil {
+		t.Fatal(err)
+	}
+	files, err = filepath.Glob(filepath.Join(h.lb.varRoot, "ssh-sessions", "*.cast"))
+	if err != nil || len(files) != 1 {
+		t.Errorf("recordings = %q, %v; want still one", files, err)
+	}
+	if st := h.srv.recordingStatus(); st != "disabled" {
+		t.Errorf("recordingStatus = %q; want disabled", st)
+	}
+}
+
+func TestHarnessRecordingNonPty(t *testing.T) {
+	h := newSSHHarness(t, nil)
+	h.lb.setPolicy(&tailcfg.SSHPolicy{Rules: []*tailcfg.SSHRule{
+		h.acceptRule(&tailcfg.SSHAction{Accept: true, Record: true, AllowLocalPortForwarding: true}),
+	}})
+	c := h.mustDial()
+	if out, _, err := run(t, c, "echo to-stdout; echo to-stderr >&2"); err != nil || out != "to-stdout\n" {
+		t.Fatalf("run = %q, %v", out, err)
+	}
+
+	var b []byte
+	for i := 0; i < 50; i++ {
+		// The recording is written as the session ends.
+		files, _ := filepath.Glob(filepath.Join(h.lb.varRoot, "ssh-sessions", "*.cast"))
+		if len(files) == 1 {
+			b, _ = os.ReadFile(files[0])
+			if bytes.Contains(b, []byte("to-stderr")) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	for _, want := range []string{`"o","to-stdout\n"`, `"o","to-stderr\n"`} {
+		if !bytes.Contains(b, []byte(want)) {
+			t.Errorf("recording lacks %s:\n%s", want, b)
+		}
+	}
+
+	// Forwarded connections can't be recorded, so they're refused.
+	s, err := c.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	stdout, err := s.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start("echo started; sleep 30"); err != nil {
+		t.Fatal(err)
+	}
+	if line, err := bufio.NewReader(stdout).ReadString('\n'); err != nil || line != "started\n" {
+		t.Fatalf("session output = %q, %v", line, err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if fc, err := c.Dial("tcp", ln.Addr().String()); err == nil {
+		fc.Close()
+		t.Error("forwarding succeeded in a recorded session; want refused")
+	}
+}
+
+func TestHarnessJump(t *testing.T) {
+	// The target only lets the jump host in, identified by its
+	// Tailscale IP, testSelfIP.
+	target := newSSHHarness(t, nil)
+	targetIP := netip.MustParseAddr("100.64.0.3")
+	target.lb.peers[testSelfIP] = testPeer{
+		node:  &tailcfg.Node{ID: 1, StableID: "self"},
+		uprof: tailcfg.UserProfile{ID: 3, LoginName: "tagged-devices"},
+	}
+	target.lb.setPolicy(&tailcfg.SSHPolicy{Rules: []*tailcfg.SSHRule{{
+		Principals: []*tailcfg.SSHPrincipal{{NodeIP: testSelfIP.String()}},
+		SSHUsers:   map[string]string{"*": "="},
+		Action:     &tailcfg.SSHAction{Accept: true},
+	}}})
+
+	h := newSSHHarness(t, nil)
+	h.lb.nm.Peers = []*tailcfg.Node{{
+		ID:        3,
+		Name:      "target.example.ts.net.",
+		Addresses: []netaddr.IPPrefix{netaddr.IPPrefixFrom(netconv.AsIP(targetIP), 32)},
+	}}
+	h.lb.setPolicy(&tailcfg.SSHPolicy{Rules: []*tailcfg.SSHRule{
+		h.acceptRule(&tailcfg.SSHAction{Accept: true, JumpTo: "target"}),
+	}})
+	var dialed netaddr.IPPort
+	h.lb.dialPeerTCP = func(ctx context.Context, ipp netaddr.IPPort) (net.Conn, error) {
+		dialed = ipp
+		return target.serveConn(testSelfIP), nil
+	}
+
+	c := h.mustDial()
+	out, stderr, err := run(t, c, "echo $USER $SSH_CONNECTION; echo oops >&2; exit 3")
+	if got := exitStatus(err); got != 3 {
+		t.Errorf("exit status = %v (%v); want 3", got, err)
+	}
+	want := fmt.Sprintf("%s %v 41641 %v 22\n", h.localUser.Username, testSelfIP, testSelfIP)
+	if out != want {
+		t.Errorf("stdout = %q; want %q", out, want)
+	}
+	if !strings.HasSuffix(stderr, "oops\n") {
+		t.Errorf("stderr = %q; want suffix %q", stderr, "oops\n")
+	}
+	if want := netaddr.IPPortFrom(netconv.AsIP(targetIP), 22); dialed != want {
+		t.Errorf("dialed %v; want %v", dialed, want)
+	}
+
+	// Once the target stops letting the jump host in, jumps fail.
+	target.lb.setPolicy(&tailcfg.SSHPolicy{})
+	if _, _, err := run(t, c, "true"); exitStatus(err) != 1 {
+		t.Errorf("after revocation: %v; want exit status 1", err)
+	}
+}
+
+func TestResolveJumpTarget(t *testing.T) {
+	nm := &netmap.NetworkMap{Peers: []*tailcfg.Node{{
+		Name: "target.example.ts.net.",
+		Addresses: []netaddr.IPPrefix{
+			netaddr.MustParseIPPrefix("fd7a:115c:a1e0::3/128"),
+			netaddr.MustParseIPPrefix("100.64.0.3/32"),
+		},
+	}}}
+	tests := []struct {
+		target string
+		want   string // or empty for an error
+	}{
+		{"target", "100.64.0.3:22"},
+		{"TARGET.example.ts.net", "100.64.0.3:22"},
+		{"target.example.ts.net.:2222", "100.64.0.3:2222"},
+		{"100.64.0.3", "100.64.0.3:22"},
+		{"[fd7a:115c:a1e0::3]:22", "[fd7a:115c:a1e0::3]:22"},
+		{"other", ""},
+		{"100.64.0.4", ""},
+		{"target:ssh", ""},
+	}
+	for _, tt := range tests {
+		got, err := resolveJumpTarget(nm, tt.target)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("%q: got %v; want error", tt.target, got)
+			}
+			continue
+		}
+		if err != nil || got.String() != tt.want {
+			t.Errorf("%q: got %v, %v; want %v", tt.target, got, err, tt.want)
+		}
+	}
+}
+
+func TestHarnessPlayback(t *testing.T) {
+	h := newSSHHarness(t, nil)
+	h.lb.setPolicy(&tailcfg.SSHPolicy{Rules: []*tailcfg.SSHRule{
+		h.acceptRule(&tailcfg.SSHAction{Accept: true, Record: true}),
+	}})
+	c := h.mustDial()
+	s, err := c.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RequestPty("xterm", 24, 80, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ptyOutput(t, s, "echo recorded-output"); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	var id string
+	h.srv.mu.Lock()
+	for _, ev := range h.srv.recentEvents {
+		if ev.Type == ipnstate.SSHEventSessionStart {
+			id = ev.SessionID
+		}
+	}
+	h.srv.mu.Unlock()
+
+	recs, err := h.srv.Recordings(ipnstate.SSHRecordingFilter{User: "alice@example.com"})
+	if err != nil || len(recs) != 1 {
+		t.Fatalf("Recordings = %+v, %v; want one", recs, err)
+	}
+	if r := recs[0]; r.SessionID != id || r.LocalUser != h.localUser.Username || r.Size == 0 {
+		t.Errorf("recording = %+v; want session %s as %s", r, id, h.localUser.Username)
+	}
+	if recs, err := h.srv.Recordings(ipnstate.SSHRecordingFilter{User: "bob@example.com"}); err != nil || len(recs) != 0 {
+		t.Errorf("Recordings of bob = %+v, %v; want none", recs, err)
+	}
+	if recs, err := h.srv.Recordings(ipnstate.SSHRecordingFilter{Since: time.Now().Add(time.Minute)}); err != nil || len(recs) != 0 {
+		t.Errorf("Recordings since later = %+v, %v; want none", recs, err)
+	}
+	rc, err := h.srv.OpenRecording(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cast, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil || !strings.Contains(string(cast), "recorded-output") {
+		t.Errorf("OpenRecording = %q, %v; want the recorded output", cast, err)
+	}
+
+	// subsystem returns the output of the subsystem sub. The client
+	// can't see subsystems' exit statuses, so it's just the output.
+	subsystem := func(sub string) (stdout, stderr string) {
+		s, err := c.NewSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		so, _ := s.StdoutPipe()
+		se, _ := s.StderrPipe()
+		if err := s.RequestSubsystem(sub); err != nil {
+			t.Fatal(err)
+		}
+		errc := make(chan []byte)
+		go func() {
+			b, _ := io.ReadAll(se)
+			errc <- b
+		}()
+		out, _ := io.ReadAll(so)
+		return string(out), string(<-errc)
+	}
+	playback := func(id string) (stdout, stderr string) {
+		return subsystem(playbackSubsystem + " " + id)
+	}
+
+	// Playback isn't allowed by default.
+	if out, stderr := playback(id); out != "" || stderr != "Recording playback not allowed.\r\n" {
+		t.Errorf("playback without permission = %q, %q", out, stderr)
+	}
+
+	h.lb.setPolicy(&tailcfg.SSHPolicy{Rules: []*tailcfg.SSHRule{
+		h.acceptRule(&tailcfg.SSHAction{Accept: true, AllowRecordingPlayback: true}),
+	}})
+	out, stderr := playback(id)
+	if !strings.Contains(out, "recorded-output") {
+		t.Errorf("playback = %q, %q; want it to contain the recorded output", out, stderr)
+	}
+	for _, id := range []string{"20220101T000000-0000000000", "../*"} {
+		if out, stderr := playback(id); out != "" || !strings.HasPrefix(stderr, "No recording") {
+			t.Errorf("playback of %q = %q, %q; want no recording", id, out, stderr)
+		}
+	}
+
+	// Other subsystems are refused.
+	if out, stderr := subsystem("nope"); out != "" || stderr != "Unsupported subsystem \"nope\".\r\n" {
+		t.Errorf("unknown subsystem = %q, %q", out, stderr)
+	}
+}
+
+func TestHarnessGzipRecording(t *testing.T) {
+	defer func(v bool) { recordGzip = v }(recordGzip)
+	recordGzip = true
+	h := newSSHHarness(t, nil)
+	h.lb.setPolicy(&tailcfg.SSHPolicy{Rules: []*tailcfg.SSHRule{
+		h.acceptRule(&tailcfg.SSHAction{Accept: true, Record: true, AllowRecordingPlayback: true}),
+	}})
+	c := h.mustDial()
+	s, err := c.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RequestPty("xterm", 24, 80, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ptyOutput(t, s, "echo recorded-output"); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	files, err := filepath.Glob(filepath.Join(h.lb.varRoot, "ssh-sessions", "*.cast.gz"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("recordings = %q, %v; want one", files, err)
+	}
+	readAll := func() ([]byte, error) {
+		r, err := openRecording(files[0])
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	}
+	// The gzip stream is only complete once the session's cleanup
+	// closes the recording.
+	var b []byte
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		b, err = readAll()
+		if err == nil || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `"o","recorded-output`) {
+		t.Errorf("recording lacks output: %q", b)
+	}
+
+	var id string
+	h.srv.mu.Lock()
+	for _, ev := range h.srv.recentEvents {
+		if ev.Type == ipnstate.SSHEventSessionStart {
+			id = ev.SessionID
+		}
+	}
+	h.srv.mu.Unlock()
+	s, err = c.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	so, _ := s.StdoutPipe()
+	if err := s.RequestSubsystem(playbackSubsystem + " " + id); err != nil {
+		t.Fatal(err)
+	}
+	out, _ := io.ReadAll(so)
+	if !strings.Contains(string(out), "recorded-output") {
+		t.Errorf("playback = %q; want it to contain the recorded output", out)
+	}
+}
+
+func TestHarnessRecordingDir(t *testing.T) {
+	h := newSSHHarness(t, nil)
+	polDir := filepath.Join(t.TempDir(), "audit")
+	h.lb.setPolicy(&tailcfg.SSHPolicy{
+		Rules: []*tailcfg.SSHRule{
+			h.acceptRule(&tailcfg.SSHAction{Accept: true, Record: true}),
+		},
+		RecordingDir: polDir,
+	})
+	record := func(cmd string) {
+		t.Helper()
+		s, err := h.mustDial().NewSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		if err := s.RequestPty("xterm", 24, 80, nil); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ptyOutput(t, s, cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	countIn := func(dir string) int {
+		t.Helper()
+		files, err := filepath.Glob(filepath.Join(dir, "*.cast"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(files)
+	}
+
+	record("echo to-policy-dir")
+	if n := countIn(polDir); n != 1 {
+		t.Errorf("recordings in policy dir = %d; want 1", n)
+	}
+	if n := countIn(filepath.Join(h.lb.varRoot, "ssh-sessions")); n != 0 {
+		t.Errorf("recordings in var root = %d; want 0", n)
+	}
+	if recs, err := h.srv.Recordings(ipnstate.SSHRecordingFilter{}); err != nil || len(recs) != 1 {
+		t.Errorf("Recordings = %v, %v; want one", recs, err)
+	}
+
+	// The local setting takes precedence over the policy.
+	defer func(v string) { recordingDir = v }(recordingDir)
+	localDir := filepath.Join(t.TempDir(), "local")
+	recordingDir = localDir
+	record("echo to-local-dir")
+	if n := countIn(localDir); n != 1 {
+		t.Errorf("recordings in local dir = %d; want 1", n)
+	}
+	if n := countIn(polDir); n != 1 {
+		t.Errorf("recordings in policy dir = %d; want still 1", n)
+	}
+
+	recordingDir = "relative"
+	if _, err := h.srv.recordingsDir(); err == nil {
+		t.Error("recordingsDir accepted a relative path")
+	}
+}
+
+func TestHarnessSFTP(t *testing.T) {
+	defer func(v bool) { recordSSH = v }(recordSSH)
+	recordSSH = true
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := newSSHHarness(t, nil)
+	h.srv.tailscaledPath = exe // for the incubator's SFTP server
+	h.lb.setPolicy(&tailcfg.SSHPolicy{Rules: []*tailcfg.SSHRule{
+		h.acceptRule(&tailcfg.SSHAction{Accept: true, Record: true}),
+	}})
+	c := h.mustDial()
+	s, err := c.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	w, _ := s.StdinPipe()
+	r, _ := s.StdoutPipe()
+	if err := s.RequestSubsystem("sftp"); err != nil {
+		t.Fatal(err)
+	}
+	sc, err := sftp.NewClientPipe(r, w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	dir := t.TempDir()
+	f, err := sc.Create(filepath.Join(dir, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(f, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if err := sc.Rename(filepath.Join(dir, "a"), filepath.Join(dir, "b")); err != nil {
+		t.Fatal(err)
+	}
+	sc.Close()
+	if b, err := os.ReadFile(filepath.Join(dir, "b")); err != nil || string(b) != "hello" {
+		t.Fatalf("uploaded file = %q, %v", b, err)
+	}
+
+	var b []byte
+	for i := 0; i < 50; i++ {
+		// The recording is written as the session ends.
+		files, _ := filepath.Glob(filepath.Join(h.lb.varRoot, "ssh-sessions", "*.cast"))
+		if len(files) == 1 {
+			b, _ = os.ReadFile(files[0])
+			if bytes.Contains(b, []byte("rename")) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	for _, want := range []string{
+		fmt.Sprintf(`"i","open %s/a (read,write,create,truncate)\n"`, dir),
+		fmt.Sprintf(`"i","rename %s/a %s/b\n"`, dir, dir),
+	} {
+		if !strings.Contains(string(b), want) {
+			t.Errorf("recording lacks %s:\n%s", want, b)
+		}
+	}
+}
+
+func TestHarnessSCP(t *testing.T) {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newSSHHarness(t, nil)
+	h.srv.tailscaledPath = exe // for the incubator's scp
+	h.lb.setPolicy(&tailcfg.SSHPolicy{Rules: []*tailcfg.SSHRule{
+		h.acceptRule(&tailcfg.SSHAction{Accept: true}),
+	}})
+	events := make(chan ipnstate.SSHEvent, 20)
+	defer h.srv.SubscribeEvents(false, func(ev ipnstate.SSHEvent) {
+		if ev.Type == ipnstate.SSHEventUpload || ev.Type == ipnstate.SSHEventDownload {
+			events <- ev
+		}
+	})()
+	c := h.mustDial()
+	dir := t.TempDir()
+
+	// scp runs the scp command on c, talking its protocol as the
+	// client with talk.
+	scp := func(cmd string, talk func(r *bufio.Reader, w io.Writer) error) {
+		t.Helper()
+		s, err := c.NewSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		w, _ := s.StdinPipe()
+		r, _ := s.StdoutPipe()
+		var stderr bytes.Buffer
+		s.Stderr = &stderr
+		if err := s.Start(cmd); err != nil {
+			t.Fatal(err)
+		}
+		if err := talk(bufio.NewReader(r), w); err != nil {
+			t.Fatalf("%s: %v", cmd, err)
+		}
+		w.Close()
+		if err := s.Wait(); err != nil {
+			t.Fatalf("%s: %v; stderr: %s", cmd, err, stderr.Bytes())
+		}
+	}
+	expect := func(r *bufio.Reader, want string) error {
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(r, got); err != nil {
+			return err
+		}
+		if string(got) != want {
+			return fmt.Errorf("got %q; want %q", got, want)
+		}
+		return nil
+	}
+
+	// Upload a directory with a file in it.
+	scp("scp -r -t -- "+dir, func(r *bufio.Reader, w io.Writer) error {
+		for _, step := range []struct{ send, want string }{
+			{"", "\x00"},
+			{"D0755 0 sub\n", "\x00"},
+			{"C0640 5 a file\n", "\x00"},
+			{"hello\x00", "\x00"},
+			{"E\n", "\x00"},
+		} {
+			io.WriteString(w, step.send)
+			if err := expect(r, step.want); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	path := filepath.Join(dir, "sub", "a file")
+	if b, err := os.ReadFile(path); err != nil || string(b) != "hello" {
+		t.Fatalf("uploaded file = %q, %v", b, err)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0640 {
+		t.Errorf("uploaded file mode = %v, %v; want 0640", fi.Mode(), err)
+	}
+
+	// Download it.
+	scp(fmt.Sprintf("scp -f '%s'", path), func(r *bufio.Reader, w io.Writer) error {
+		io.WriteString(w, "\x00")
+		if err := expect(r, "C0640 5 a file\n"); err != nil {
+			return err
+		}
+		io.WriteString(w, "\x00")
+		if err := expect(r, "hello\x00"); err != nil {
+			return err
+		}
+		io.WriteString(w, "\x00")
+		return nil
+	})
+
+	for _, want := range []ipnstate.SSHEventType{ipnstate.SSHEventUpload, ipnstate.SSHEventDownload} {
+		select {
+		case ev := <-events:
+			if ev.Type != want || ev.Path != path || ev.Size != 5 {
+				t.Errorf("event = %+v; want %s of %s", ev, want, path)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no %s event", want)
+		}
+	}
+}
+
+func TestHarnessStreamLocalForwarding(t *testing.T) {
+	dir := t.TempDir()
+	echoSock := filepath.Join(dir, "echo.sock")
+	ln, err := net.Listen("unix", echoSock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	ping := func(c net.Conn) {
+		t.Helper()
+		defer c.Close()
+		if _, err := io.WriteString(c, "ping"); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "ping" {
+			t.Errorf("echo = %q, %v", buf, err)
+		}
+	}
+
+	h := newSSHHarness(t, nil)
+	h.lb.setPolicy(&tailcfg.SSHPolicy{Rules: []*tailcfg.SSHRule{
+		h.acceptRule(&tailcfg.SSHAction{
+			Accept:                     true,
+			AllowStreamLocalForwarding: true,
+			StreamLocalForwardingPaths: []string{echoSock, filepath.Join(dir, "fwd-*")},
+		}),
+	}})
+	c := h.mustDial()
+
+	// Forwarding is only allowed alongside an accepted session.
+	s, err := c.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	stdout, err := s.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start("echo started; sleep 30"); err != nil {
+		t.Fatal(err)
+	}
+	if line, err := bufio.NewReader(stdout).ReadString('\n'); err != nil || line != "started\n" {
+		t.Fatalf("session output = %q, %v", line, err)
+	}
+
+	// To the node's socket, as with "ssh -L".
+	fc, err := c.Dial("unix", echoSock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ping(fc)
+	if fc, err := c.Dial("unix", filepath.Join(dir, "other.sock")); err == nil {
+		fc.Close()
+		t.Error("forwarding to a path not allowed succeeded")
+	}
+
+	// From a socket on the node, as with "ssh -R".
+	fwdSock := filepath.Join(dir, "fwd-1")
+	rln, err := c.ListenUnix(fwdSock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := rln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	if fi, err := os.Stat(fwdSock); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("forwarded socket mode = %v, %v; want 0600", fi.Mode(), err)
+	}
+	lc, err := net.Dial("unix", fwdSock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ping(lc)
+	if rln, err := c.ListenUnix(filepath.Join(dir, "other.sock")); err == nil {
+		rln.Close()
+		t.Error("listening on a path not allowed succeeded")
+	}
+	if err := rln.Close(); err != nil {
+		t.Errorf("canceling forward: %v", err)
+	}
+}
+
+func TestStreamLocalAsUser(t *testing.T) {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss := &sshSession{
+		srv:       &server{tailscaledPath: exe},
+		localUser: u,
+		logf:      t.Logf,
+	}
+	sock := filepath.Join(t.TempDir(), "fwd.sock")
+
+	f, err := ss.streamLocalAsUser(context.Background(), streamLocalListen, sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.FileListener(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if fi, err := os.Stat(sock); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("socket mode = %v, %v; want 0600", fi.Mode(), err)
+	}
+	go func() {
+		c, err := ln.Accept()
+		if err == nil {
+			io.WriteString(c, "hi")
+			c.Close()
+		}
+	}()
+
+	f, err = ss.streamLocalAsUser(context.Background(), streamLocalDial, sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := net.FileConn(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := io.ReadAll(c); err != nil || string(got) != "hi" {
+		t.Errorf("read %q, %v; want %q", got, err, "hi")
+	}
+	c.Close()
+
+	if _, err := ss.streamLocalAsUser(context.Background(), streamLocalUnlink, sock); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(sock); !os.IsNotExist(err) {
+		t.Errorf("socket still there after unlink: %v", err)
+	}
+	regular := filepath.Join(t.TempDir(), "regular")
+	if err := os.WriteFile(regular, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ss.streamLocalAsUser(context.Background(), streamLocalUnlink, regular); err == nil {
+		t.Errorf("unlinking a regular file succeeded")
+	}
+}
+
+func TestHarnessAcceptEnv(t *testing.T) {
+	tests := []struct {
+		acceptEnv []string
+		want      string
+	}{
+		{nil, "x-y-z"},
+		{[]string{"LC_*", "FOO"}, "x-y-"},
+		{[]string{}, "--"},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.acceptEnv), func(t *testing.T) {
+			h := newSSHHarness(t, nil)
+			h.lb.setPolicy(&tailcfg.SSHPolicy{Rules: []*tailcfg.SSHRule{
+				h.acceptRule(&tailcfg.SSHAction{Accept: true, AcceptEnv: tt.acceptEnv}),
+			}})
+			s, err := h.mustDial().NewSession()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			for _, kv := range [][2]string{{"LC_ALL", "x"}, {"FOO", "y"}, {"BAR", "z"}} {
+				if err := s.Setenv(kv[0], kv[1]); err != nil {
+					t.Fatal(err)
+				}
+			}
+			out, err := s.Output(`echo "$LC_ALL-$FOO-$BAR"`)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.TrimSpace(string(out)); got != tt.want {
+				t.Errorf("got %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHarnessIdentityEnv(t *testing.T) {
+	h := newSSHHarness(t, nil)
+	h.lb.mu.Lock()
+	h.lb.peers[testPeerIP].node.Name = "peer.example.ts.net."
+	h.lb.mu.Unlock()
+	h.lb.setPolicy(&tailcfg.SSHPolicy{Rules: []*tailcfg.SSHRule{
+		h.acceptRule(&tailcfg.SSHAction{Accept: true}),
+	}})
+	s, err := h.mustDial().NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	// Clients can't pass for someone else.
+	if err := s.Setenv("TAILSCALE_USER", "mallory@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	out, err := s.Output(`echo "$TAILSCALE_USER|$TAILSCALE_TAGS|$TAILSCALE_NODE|$TAILSCALE_SRC_IP|${SSH_CONNECTION%% *}"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "alice@example.com||peer.example.ts.net|100.64.0.2|100.64.0.2"
+	if got := strings.TrimSpace(string(out)); got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+}
+
+func TestHarnessHostCertificate(t *testing.T) {
+	_, caPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := gossh.NewSignerFromKey(caPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newSSHHarness(t, nil)
+	h.lb.setPolicy(&tailcfg.SSHPolicy{Rules: []*tailcfg.SSHRule{
+		h.acceptRule(&tailcfg.SSHAction{Accept: true}),
+	}})
+	now := time.Now()
+	newCert := func(pub gossh.PublicKey, certType uint32, validBefore time.Time) string {
+		cert := &gossh.Certificate{
+			Key:         pub,
+			KeyId:       "test",
+			CertType:    certType,
+			ValidAfter:  uint64(now.Add(-time.Hour).Unix()),
+			ValidBefore: uint64(validBefore.Unix()),
+		}
+		if err := cert.SignCert(rand.Reader, ca); err != nil {
+			t.Fatal(err)
+		}
+		return string(gossh.MarshalAuthorizedKey(cert))
+	}
+	_, otherPriv, _ := ed25519.GenerateKey(rand.Reader)
+	other, _ := gossh.NewSignerFromKey(otherPriv)
+	hostPub := h.lb.hostKeys[0].PublicKey()
+	h.lb.mu.Lock()
+	h.lb.nm.SSHHostCertificates = []string{
+		newCert(hostPub, gossh.HostCert, now.Add(-time.Minute)),        // expired
+		newCert(hostPub, gossh.UserCert, now.Add(time.Hour)),           // not a host cert
+		newCert(other.PublicKey(), gossh.HostCert, now.Add(time.Hour)), // not our key
+		"garbage",
+		newCert(hostPub, gossh.HostCert, now.Add(time.Hour)),
+	}
+	h.lb.mu.Unlock()
+
+	if got := h.srv.hostCertSigners(h.lb.hostKeys); len(got) != 1 {
+		t.Fatalf("got %d cert signers; want 1", len(got))
+	}
+
+	// A client that only trusts the CA can connect.
+	checker := &gossh.CertChecker{
+		IsHostAuthority: func(auth gossh.PublicKey, _ string) bool {
+			return bytes.Equal(auth.Marshal(), ca.PublicKey().Marshal())
+		},
+	}
+	c := h.serveConn(testPeerIP)
+	cc, chans, reqs, err := gossh.NewClientConn(c, "test:22", &gossh.ClientConfig{
+		User:              "testuser",
+		HostKeyCallback:   checker.CheckHostKey,
+		HostKeyAlgorithms: []string{gossh.CertAlgoED25519v01},
+		Timeout:           10 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := gossh.NewClient(cc, chans, reqs)
+	defer client.Close()
+	if out, _, err := run(t, client, "echo hi"); err != nil || !strings.HasSuffix(out, "hi\n") {
+		t.Errorf("run = %q, %v", out, err)
+	}
+}
+
+func TestHarnessInteractiveAuth(t *testing.T) {
+	h := newSSHHarness(t, nil)
+	h.lb.setPolicy(&tailcfg.SSHPolicy{Rules: []*tailcfg.SSHRule{
+		h.acceptRule(&tailcfg.SSHAction{
+			Message:         "MFA required\n",
+			HoldAndDelegate: "https://unused/mfa/$SRC_NODE_ID",
+			InteractiveAuth: true,
+		}),
+	}})
+	h.lb.noise = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var a *tailcfg.SSHAction
+		switch r.URL.Path {
+		case "/mfa/2":
+			a = &tailcfg.SSHAction{Prompt: "Code: ", HoldAndDelegate: "https://unused/check?code=$PROMPT_RESPONSE"}
+		case "/check":
+			if r.FormValue("code") == "123 456" {
+				a = &tailcfg.SSHAction{Accept: true, Message: "approved\n"}
+			} else {
+				a = &tailcfg.SSHAction{Reject: true, Message: "wrong code\n"}
+			}
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(a)
+	})
+
+	// Clients that can't do keyboard-interactive auth can't get in.
+	if c, err := h.dial(testPeerIP); err == nil {
+		c.Close()
+		t.Fatal("dial with only none auth succeeded")
+	}
+
+	for _, code := range []string{"123 456", "000"} {
+		var instructions, questions []string
+		c, err := h.dial(testPeerIP, gossh.KeyboardInteractive(func(_, instruction string, qs []string, echos []bool) ([]string, error) {
+			instructions = append(instructions, instruction)
+			questions = append(questions, qs...)
+			answers := make([]string, len(qs))
+			for i := range qs {
+				if echos[i] {
+					t.Errorf("question %q echoes", qs[i])
+				}
+				answers[i] = code
+			}
+			return answers, nil
+		}))
+		want := []string{"MFA required\n", "", "approved\n"}
+		if code != "123 456" {
+			if err == nil {
+				c.Close()
+				t.Fatalf("dial with code %q succeeded", code)
+			}
+			want = []string{"MFA required\n", "", "wrong code\n"}
+		} else {
+			if err != nil {
+				t.Fatalf("dial with code %q: %v", code, err)
+			}
+			out, stderr, err := run(t, c, "echo ok")
+			if err != nil || out != "ok\n" {
+				t.Errorf("run = %q, %v", out, err)
+			}
+			if strings.Contains(stderr, "approved") {
+				t.Errorf("stderr = %q; want the message only shown once", stderr)
+			}
+		}
+		if !reflect.DeepEqual(instructions, want) || !reflect.DeepEqual(questions, []string{"Code: "}) {
+			t.Errorf("code %q: instructions %q, questions %q", code, instructions, questions)
+		}
+	}
+}
+
+func TestHarnessForceCommand(t *testing.T) {
+	h := newSSHHarness(t, nil)
+	h.lb.setPolicy(&tailcfg.SSHPolicy{Rules: []*tailcfg.SSHRule{
+		h.acceptRule(&tailcfg.SSHAction{
+			Accept:       true,
+			ForceCommand: `echo "forced:$SSH_ORIGINAL_COMMAND"`,
+		}),
+	}})
+	c := h.mustDial()
+
+	tests := []struct {
+		name      string
+		cmd       string
+		subsystem string // requested instead of cmd, if non-empty
+		want      string
+	}{
+		{name: "command", cmd: "rm -rf /tmp/nope", want: "forced:rm -rf /tmp/nope"},
+		{name: "sftp", subsystem: "sftp", want: "forced:sftp"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := c.NewSession()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			// The client can't spoof the original command.
+			if err := s.Setenv("SSH_ORIGINAL_COMMAND", "spoofed"); err != nil {
+				t.Fatal(err)
+			}
+			so, err := s.StdoutPipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.subsystem != "" {
+				err = s.RequestSubsystem(tt.subsystem)
+			} else {
+				err = s.Start(tt.cmd)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			out, err := io.ReadAll(so)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.TrimSpace(string(out)); got != tt.want {
+				t.Errorf("got %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHarnessSFTPOnly(t *testing.T) {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newSSHHarness(t, nil)
+	h.srv.tailscaledPath = exe // for the incubator's SFTP server
+	h.lb.setPolicy(&tailcfg.SSHPolicy{Rules: []*tailcfg.SSHRule{
+		h.acceptRule(&tailcfg.SSHAction{Accept: true, SFTPOnly: true}),
+	}})
+	c := h.mustDial()
+
+	s, err := c.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stderr bytes.Buffer
+	s.Stderr = &stderr
+	out, err := s.Output("echo hi")
+	s.Close()
+	if ee, ok := err.(*gossh.ExitError); !ok || ee.ExitStatus() != 1 {
+		t.Errorf("command err = %v; want exit status 1", err)
+	}
+	if len(out) != 0 || stderr.String() != "This account is restricted to SFTP.\r\n" {
+		t.Errorf("command output = %q, %q", out, stderr.String())
+	}
+
+	s, err = c.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	w, _ := s.StdinPipe()
+	r, _ := s.StdoutPipe()
+	if err := s.RequestSubsystem("sftp"); err != nil {
+		t.Fatal(err)
+	}
+	sc, err := sftp.NewClientPipe(r, w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+	if _, err := sc.Getwd(); err != nil {
+		t.Errorf("SFTP Getwd: %v", err)
+	}
+}
+
+func TestHarnessRequireLocalGroup(t *testing.T) {
+	u, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := user.LookupGroupId(u.Gid)
+	if err != nil {
+		t.Skipf("looking up primary group: %v", err)
+	}
+	tests := []struct {
+		group      string
+		wantStatus int
+	}{
+		{g.Name, 0},
+		{"tailscale-ssh-test-no-such-group", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.group, func(t *testing.T) {
+			h := newSSHHarness(t, nil)
+			h.lb.setPolicy(&tailcfg.SSHPolicy{Rules: []*tailcfg.SSHRule{
+				h.acceptRule(&tailcfg.SSHAction{Accept: true, RequireLocalGroup: tt.group}),
+			}})
+			out, stderr, err := run(t, h.mustDial(), "echo hi")
+			if got := exitStatus(err); got != tt.wantStatus {
+				t.Fatalf("exit status = %d (%v); want %d", got, err, tt.wantStatus)
+			}
+			if tt.wantStatus == 0 && out != "hi\n" {
+				t.Errorf("stdout = %q", out)
+			}
+			if tt.wantStatus != 0 && !strings.Contains(stderr, "Access denied") {
+				t.Errorf("stderr = %q; want access denied", stderr)
+			}
+		})
+	}
+}
+
+// outputWatcher collects what's read from a reader, to wait for.
+type outputWatcher struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func watchOutput(r io.Reader) *outputWatcher {
+	w := new(outputWatcher)
+	go func() {
+		b := make([]byte, 1024)
+		for {
+			n, err := r.Read(b)
+			w.mu.Lock()
+			w.buf.Write(b[:n])
+			w.mu.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return w
+}
+
+func (w *outputWatcher) String() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.String()
+}
+
+// waitFor waits for the output to contain want.
+func (w *outputWatcher) waitFor(t *testing.T, want string) {
+	t.Helper()
+	for i := 0; i < 1000; i++ {
+		if strings.Contains(w.String(), want) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timeout waiting for %q in output %q", want, w.String())
+}
+
+func TestHarnessSessionJoin(t *testing.T) {
+	h := newSSHHarness(t, nil)
+	h.lb.setPolicy(&tailcfg.SSHPolicy{Rules: []*tailcfg.SSHRule{
+		h.acceptRule(&tailcfg.SSHAction{Accept: true}),
+	}})
+	c := h.mustDial()
+
+	// The session to join echoes what's typed into it.
+	s, err := c.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.RequestPty("xterm", 24, 80, nil); err != nil {
+		t.Fatal(err)
+	}
+	in, _ := s.StdinPipe()
+	out, _ := s.StdoutPipe()
+	if err := s.Start("cat"); err != nil {
+		t.Fatal(err)
+	}
+	owner := watchOutput(out)
+	io.WriteString(in, "ready\n")
+	owner.waitFor(t, "ready")
+	var id string
+	h.srv.mu.Lock()
+	for sid := range h.srv.activeSessionBySharedID {
+		id = sid
+	}
+	h.srv.mu.Unlock()
+
+	// join starts joining the session on a new connection, returning
+	// the joiner's input and output.
+	join := func(sub string) (io.WriteCloser, *outputWatcher, *outputWatcher) {
+		t.Helper()
+		js, err := h.mustDial().NewSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { js.Close() })
+		jin, _ := js.StdinPipe()
+		jout, _ := js.StdoutPipe()
+		jerr, _ := js.StderrPipe()
+		if err := js.RequestSubsystem(sub); err != nil {
+			t.Fatal(err)
+		}
+		return jin, watchOutput(jout), watchOutput(jerr)
+	}
+
+	// Joining isn't allowed by default.
+	_, _, stderr := join(joinSubsystem + " " + id)
+	stderr.waitFor(t, "Joining sessions not allowed.")
+
+	h.lb.setPolicy(&tailcfg.SSHPolicy{Rules: []*tailcfg.SSHRule{
+		h.acceptRule(&tailcfg.SSHAction{Accept: true, AllowSessionJoin: true}),
+	}})
+	_, _, stderr = join(joinSubsystem + " " + id + " rw")
+	stderr.waitFor(t, "Joining sessions read-write not allowed.")
+	_, _, stderr = join(joinSubsystem + " 20220101T000000-0000000000")
+	stderr.waitFor(t, "No active session")
+
+	// Nor can another local user's session be joined.
+	const otherID = "20220101T000000-1111111111"
+	h.srv.mu.Lock()
+	h.srv.activeSessionBySharedID[otherID] = &sshSession{
+		sharedID:  otherID,
+		localUser: &user.User{Uid: "4242424", Username: "someone-else"},
+	}
+	h.srv.mu.Unlock()
+	_, _, stderr = join(joinSubsystem + " " + otherID)
+	stderr.waitFor(t, "is another local user's.")
+	h.srv.mu.Lock()
+	delete(h.srv.activeSessionBySharedID, otherID)
+	h.srv.mu.Unlock()
+
+	// A read-only watcher sees the session's output, and its user is
+	// told it joined, but what it types is ignored.
+	roIn, roOut, _ := join(joinSubsystem + " " + id)
+	owner.waitFor(t, "[alice@example.com joined this session read-only.]")
+	io.WriteString(roIn, "ignored\n")
+	io.WriteString(in, "hello\n")
+	roOut.waitFor(t, "hello")
+
+	// A read-write one can also type into it.
+	h.lb.setPolicy(&tailcfg.SSHPolicy{Rules: []*tailcfg.SSHRule{
+		h.acceptRule(&tailcfg.SSHAction{Accept: true, AllowSessionJoin: true, AllowSessionJoinWrite: true}),
+	}})
+	rwIn, _, _ := join(joinSubsystem + " " + id + " rw")
+	owner.waitFor(t, "[alice@example.com joined this session read-write.]")
+	io.WriteString(rwIn, "typed\n")
+	owner.waitFor(t, "typed")
+	roOut.waitFor(t, "typed")
+	if strings.Contains(owner.String(), "ignored") {
+		t.Errorf("read-only watcher's input reached the session: %q", owner.String())
+	}
+
+	// Watchers are told when the session ends.
+	s.Close()
+	roOut.waitFor(t, "[The session ended")
+}
+
+func TestHarnessCheckPolicy(t *testing.T) {
+	h := newSSHHarness(t, nil)
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := gossh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authKey := string(gossh.MarshalAuthorizedKey(signer.PublicKey()))
+	keyRule := h.acceptRule(&tailcfg.SSHAction{Accept: true})
+	keyRule.Principals[0].PubKeys = []string{authKey}
+	h.lb.setPolicy(&tailcfg.SSHPolicy{Rules: []*tailcfg.SSHRule{
+		{
+			Principals: []*tailcfg.SSHPrincipal{{Any: true}},
+			SSHUsers:   map[string]string{"root": "root"},
+			Action:     &tailcfg.SSHAction{Reject: true, Message: "no root"},
+		},
+		keyRule,
+	}})
+	peer := netconv.AsIP(testPeerIP)
+
+	res, err := h.srv.CheckPolicy("root", peer, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Rule != 1 || res.Action == nil || !res.Action.Reject {
+		t.Errorf("root: got %+v; want reject by rule 1", res)
+	}
+
+	res, err = h.srv.CheckPolicy("alice", peer, authKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Rule != 2 || res.Action == nil || !res.Action.Accept || res.LocalUser != h.localUser.Username {
+		t.Errorf("with key: got %+v; want accept by rule 2 as %s", res, h.localUser.Username)
+	}
+	if res.LoginName != "alice@example.com" {
+		t.Errorf("LoginName = %q; want alice@example.com", res.LoginName)
+	}
+
+	res, err = h.srv.CheckPolicy("alice", peer, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Rule != 0 || res.Error == "" {
+		t.Errorf("without key: got %+v; want no match", res)
+	}
+
+	if _, err := h.srv.CheckPolicy("alice", peer, "not a key"); err == nil {
+		t.Error("bad key: got nil error")
+	}
+	if res, err := h.srv.CheckPolicy("alice", netaddr.MustParseIP("100.64.0.99"), ""); err != nil || res.Error == "" {
+		t.Errorf("unknown peer: got %+v, %v; want rejection", res, err)
+	}
+}
+
+func TestHarnessDebugPolicyFileReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.json")
+	writePolicy := func(s string) {
+		t.Helper()
+		// Replace the file like an editor would.
+		tmp := path + ".tmp"
+		if err := os.WriteFile(tmp, []byte(s), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writePolicy(`{"rules": []}`)
+	defer func(old string) { debugPolicyFile = old }(debugPolicyFile)
+	debugPolicyFile = path
+
+	h := newSSHHarness(t, nil)
+	defer h.srv.Stop()
+	waitRules := func(want int, wantOK bool) {
+		t.Helper()
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			pol, ok := h.srv.sshPolicy()
+			if ok == wantOK && (!ok || len(pol.Rules) == want) {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("policy never had %d rules (ok=%v); last got ok=%v, %+v", want, wantOK, ok, pol)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitRules(0, true)
+
+	writePolicy(`{"rules": [{"principals": [{"any": true}], "sshUsers": {"*": "ubuntu"}, "action": {"accept": true}}]}`)
+	waitRules(1, true)
+
+	writePolicy(`{"rules": [{"principals": [{"any": true}], "action": {"accept": true}}]}`)
+	waitRules(0, false)
+}
+
+func TestHarnessStopDrain(t *testing.T) {
+	defer func(p, m string) { drainPeriodEnv, drainMessage = p, m }(drainPeriodEnv, drainMessage)
+	drainPeriodEnv, drainMessage = "1s", "Back in five minutes."
+
+	h := newSSHHarness(t, nil)
+	h.lb.setPolicy(&tailcfg.SSHPolicy{Rules: []*tailcfg.SSHRule{
+		h.acceptRule(&tailcfg.SSHAction{Accept: true}),
+	}})
+	c := h.mustDial()
+	s, err := c.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	var stderr bytes.Buffer
+	s.Stderr = &stderr
+	stdout, err := s.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start("echo ready; sleep 30"); err != nil {
+		t.Fatal(err)
+	}
+	if line, err := bufio.NewReader(stdout).ReadString('\n'); err != nil || line != "ready\n" {
+		t.Fatalf("got %q, %v; want ready", line, err)
+	}
+
+	start := time.Now()
+	h.srv.Stop()
+
+	// The connection is draining, so it can't start new sessions.
+	if _, _, err := run(t, c, "true"); exitStatus(err) != 1 {
+		t.Errorf("new session while draining: got %v; want exit status 1", err)
+	}
+	if _, err := h.dial(testPeerIP); err == nil {
+		t.Error("new connection while draining: got nil error")
+	}
+
+	s.Wait()
+	if d := time.Since(start); d < time.Second {
+		t.Errorf("session ended after %v; want it to last the drain period", d)
+	}
+	for _, want := range []string{"this session will end in 1s", "Back in five minutes.", "Tailscale SSH was turned off"} {
+		if !strings.Contains(stderr.String(), want) {
+			t.Errorf("stderr = %q; want %q", stderr.String(), want)
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		h.srv.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Wait didn't return after the drain")
+	}
+}
+
+func TestHarnessMaxConns(t *testing.T) {
+	defer func(n int, d time.Duration) { maxConns, connSlotWait = n, d }(maxConns, connSlotWait)
+	maxConns, connSlotWait = 1, 100*time.Millisecond
+
+	h := newSSHHarness(t, nil)
+	h.lb.setPolicy(&tailcfg.SSHPolicy{Rules: []*tailcfg.SSHRule{
+		h.acceptRule(&tailcfg.SSHAction{Accept: true}),
+	}})
+	c := h.mustDial()
+
+	// With no slot free, a connection is refused before the SSH
+	// version exchange, with a message.
+	b, _ := io.ReadAll(h.serveConn(testPeerIP))
+	if got := string(b); !strings.Contains(got, "too many connections") || strings.Contains(got, "SSH-") {
+		t.Errorf("refused connection got %q", got)
+	}
+	h.srv.mu.Lock()
+	if rs := h.srv.recentRejections; len(rs) != 1 || rs[0].reason != errTooManyConns.Error() {
+		t.Errorf("rejections = %+v", rs)
+	}
+	h.srv.mu.Unlock()
+
+	// One that waits gets the slot when it's freed.
+	connSlotWait = 10 * time.Second
+	errc := make(chan error, 1)
+	go func() {
+		c2, err := h.dial(testPeerIP)
+		if err == nil {
+			_, _, err = run(t, c2, "true")
+			c2.Close()
+		}
+		errc <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	c.Close()
+	if err := <-errc; err != nil {
+		t.Errorf("waiting connection: %v", err)
+	}
+}
+
+func TestHarnessCheckPeriod(t *testing.T) {
+	h := newSSHHarness(t, nil)
+	h.lb.setPolicy(&tailcfg.SSHPolicy{Rules: []*tailcfg.SSHRule{
+		h.acceptRule(&tailcfg.SSHAction{HoldAndDelegate: "https://unused/ssh-action"}),
+	}})
+	var mu sync.Mutex
+	checks := 0
+	h.lb.noise = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		checks++
+		// Accept the session and its first re-authorization, then
+		// refuse.
+		if checks > 2 {
+			json.NewEncoder(w).Encode(&tailcfg.SSHAction{Reject: true})
+			return
+		}
+		json.NewEncoder(w).Encode(&tailcfg.SSHAction{Accept: true, CheckPeriod: 200 * time.Millisecond})
+	})
+
+	c := h.mustDial()
+	start := time.Now()
+	_, stderr, err := run(t, c, "sleep 10")
+	if err == nil {
+		t.Fatal("session outlived its re-authorization")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("session took %v to end", d)
+	}
+	if !strings.Contains(stderr, "Re-authorization failed") {
+		t.Errorf("stderr = %q; want re-authorization failure", stderr)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if checks != 3 {
+		t.Errorf("delegate asked %d times; want 3", checks)
+	}
+}
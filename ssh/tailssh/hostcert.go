@@ -0,0 +1,83 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux || (darwin && !ios) || windows
+// +build linux darwin,!ios windows
+
+package tailssh
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	gossh "tailscale.com/tempfork/golang-x-crypto/ssh"
+)
+
+// hostCertSigners returns signers that present the host certificates
+// control issued for keys, the node's host keys, so clients that trust
+// the tailnet's host CA can verify the node without prompting. Those
+// that aren't currently valid host certificates for one of keys are
+// logged and skipped.
+func (srv *server) hostCertSigners(keys []gossh.Signer) []gossh.Signer {
+	nm := srv.lb.NetMap()
+	if nm == nil {
+		return nil
+	}
+	var signers []gossh.Signer
+	for _, s := range nm.SSHHostCertificates {
+		cert, err := parseHostCert(s, srv.now())
+		if err != nil {
+			srv.logf("ignoring SSH host certificate: %v", err)
+			continue
+		}
+		signer := signerForKey(keys, cert.Key)
+		if signer == nil {
+			srv.logf("ignoring SSH host certificate for %s: not one of the host keys", gossh.FingerprintSHA256(cert.Key))
+			continue
+		}
+		cs, err := gossh.NewCertSigner(cert, signer)
+		if err != nil {
+			srv.logf("ignoring SSH host certificate for %s: %v", gossh.FingerprintSHA256(cert.Key), err)
+			continue
+		}
+		signers = append(signers, cs)
+	}
+	return signers
+}
+
+// parseHostCert parses s, an SSH certificate in authorized_keys format,
+// and checks that it's a host certificate valid at now.
+func parseHostCert(s string, now time.Time) (*gossh.Certificate, error) {
+	pub, _, _, _, err := gossh.ParseAuthorizedKey([]byte(s))
+	if err != nil {
+		return nil, err
+	}
+	cert, ok := pub.(*gossh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%s key isn't a certificate", pub.Type())
+	}
+	if cert.CertType != gossh.HostCert {
+		return nil, fmt.Errorf("certificate %q isn't a host certificate", cert.KeyId)
+	}
+	unix := now.Unix()
+	if after := int64(cert.ValidAfter); unix < after {
+		return nil, fmt.Errorf("certificate %q isn't valid until %v", cert.KeyId, time.Unix(after, 0))
+	}
+	if before := int64(cert.ValidBefore); cert.ValidBefore != gossh.CertTimeInfinity && unix >= before {
+		return nil, fmt.Errorf("certificate %q expired at %v", cert.KeyId, time.Unix(before, 0))
+	}
+	return cert, nil
+}
+
+// signerForKey returns the signer in keys for pub, or nil if there
+// isn't one.
+func signerForKey(keys []gossh.Signer, pub gossh.PublicKey) gossh.Signer {
+	for _, k := range keys {
+		if bytes.Equal(k.PublicKey().Marshal(), pub.Marshal()) {
+			return k
+		}
+	}
+	return nil
+}
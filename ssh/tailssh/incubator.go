@@ -17,28 +17,37 @@
 	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"log"
 	"log/syslog"
 	"os"
 	"os/exec"
+	"os/signal"
 	"os/user"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/creack/pty"
 	"github.com/u-root/u-root/pkg/termios"
 	gossh "golang.org/x/crypto/ssh"
 	"golang.org/x/sys/unix"
 	"tailscale.com/cmd/tailscaled/childproc"
+	"tailscale.com/envknob"
 	"tailscale.com/tempfork/gliderlabs/ssh"
 	"tailscale.com/types/logger"
 )
 
 func init() {
-	childproc.Add("ssh", beIncubator)
+	childproc.Add("ssh", func(args []string) error {
+		err := beIncubator(args)
+		if ee, ok := err.(*exec.ExitError); ok {
+			exitLike(ee.ProcessState)
+		}
+		return err
+	})
 }
 
 var ptyName = func(f *os.File) (string, error) {
@@ -53,11 +62,48 @@ func init() {
 	return nil, nil
 }
 
+// havePAM reports whether this binary was built with PAM support, in
+// which case maybeStartPAMSession is implemented.
+var havePAM = false
+
+// maybeStartPAMSession runs the account and session modules of the PAM
+// service for localUser, refusing the login if they do. On success, it
+// returns the environment variables the modules set and, if it opened
+// a session, a close func that must be called as root to close it.
+// See startPAMSessionLinux.
+var maybeStartPAMSession = func(logf logger.Logf, service, localUser, remoteUser, remoteHost, tty string) (env []string, close func() error, err error) {
+	return nil, nil, nil
+}
+
+// pamService returns the PAM service whose modules apply to sessions,
+// or the empty string if PAM isn't used. Like OpenSSH, it uses the
+// "sshd" service by default, so that limits.conf, pam_mkhomedir and
+// the like apply to Tailscale SSH sessions as they do to OpenSSH's.
+func pamService() string {
+	if !havePAM || os.Geteuid() != 0 {
+		return ""
+	}
+	s := envknob.String("TS_SSH_PAM_SERVICE")
+	if s == "" {
+		s = "sshd"
+	}
+	if s == "none" {
+		return ""
+	}
+	if _, err := os.Stat(filepath.Join("/etc/pam.d", s)); err != nil {
+		// Without its config, PAM would use the "other" service's,
+		// which usually denies everything.
+		return ""
+	}
+	return s
+}
+
 // newIncubatorCommand returns a new exec.Cmd configured with
 // `tailscaled be-child ssh` as the entrypoint.
 //
 // If ss.srv.tailscaledPath is empty, this method is equivalent to
-// exec.CommandContext.
+// exec.CommandContext. Otherwise ctx doesn't kill the incubator:
+// killProcessOnContextDone ends it, letting it close its sessions.
 func (ss *sshSession) newIncubatorCommand(ctx context.Context, name string, args []string) *exec.Cmd {
 	if ss.srv.tailscaledPath == "" {
 		return exec.CommandContext(ctx, name, args...)
@@ -75,17 +121,34 @@ func (ss *sshSession) newIncubatorCommand(ctx context.Context, name string, args
 		"--uid=" + lu.Uid,
 		"--local-user=" + lu.Username,
 		"--remote-user=" + remoteUser,
-		"--remote-ip=" + ci.src.IP().String(),
+		"--remote-ip=" + ci.src.Addr().String(),
 		"--cmd=" + name,
 		"--has-tty=false", // updated in-place by startWithPTY
 		"--tty-name=",     // updated in-place by startWithPTY
 	}
+	if svc := pamService(); svc != "" {
+		incubatorArgs = append(incubatorArgs, "--pam-service="+svc)
+	}
+	if ss.cgroupDir != "" {
+		incubatorArgs = append(incubatorArgs, "--cgroup="+ss.cgroupDir)
+	}
+	if a := ss.action; a.Umask != "" {
+		incubatorArgs = append(incubatorArgs, "--umask="+a.Umask)
+	}
+	if a := ss.action; len(a.Ulimits) > 0 {
+		incubatorArgs = append(incubatorArgs, "--ulimits="+ulimitsArg(a.Ulimits))
+	}
+	if ss.subsystem() == sftpSubsystem {
+		incubatorArgs = append(incubatorArgs, "--sftp")
+	} else if _, ok := ss.scpArgs(); ok {
+		incubatorArgs = append(incubatorArgs, "--scp")
+	}
 	if len(args) > 0 {
 		incubatorArgs = append(incubatorArgs, "--")
 		incubatorArgs = append(incubatorArgs, args...)
 	}
 
-	return exec.CommandContext(ctx, ss.srv.tailscaledPath, incubatorArgs...)
+	return exec.Command(ss.srv.tailscaledPath, incubatorArgs...)
 }
 
 const debugIncubator = false
@@ -108,12 +171,24 @@ func beIncubator(args []string) error {
 		ttyName    = flags.String("tty-name", "", "the tty name (pts/3)")
 		hasTTY     = flags.Bool("has-tty", false, "is the output attached to a tty")
 		cmdName    = flags.String("cmd", "", "the cmd to launch")
+		sftpMode   = flags.Bool("sftp", false, "serve SFTP on stdin and stdout instead of launching cmd")
+		scpMode    = flags.Bool("scp", false, "serve scp with the args on stdin and stdout, reporting copies on fd 3, instead of launching cmd")
+		pamSvc     = flags.String("pam-service", "", "the PAM service to run the account and session modules of, if any")
+		cgroupDir  = flags.String("cgroup", "", "the cgroup directory to join before starting anything, if any")
+		umask      = flags.String("umask", "", "the umask to set, in octal, if any")
+		ulimits    = flags.String("ulimits", "", "comma-separated resource limits to set, as name=soft:hard")
 	)
 	if err := flags.Parse(args); err != nil {
 		return err
 	}
 	cmdArgs := flags.Args()
 
+	// tailscaled ends sessions with SIGTERM. Rather than dying from
+	// it, or from a SIGHUP, the incubator ends its command and closes
+	// the login or PAM session.
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGTERM, syscall.SIGHUP)
+
 	logf := logger.Discard
 	if debugIncubator {
 		// We don't own stdout or stderr, so the only place we can log is syslog.
@@ -122,28 +197,116 @@ func beIncubator(args []string) error {
 		}
 	}
 
+	joinSessionCgroup := func() {
+		if *cgroupDir == "" {
+			return
+		}
+		if err := joinCgroup(*cgroupDir, os.Getpid()); err != nil {
+			logf("cgroup: %v", err)
+			fmt.Fprintf(os.Stderr, "Can't apply this session's resource limits.\r\n")
+			os.Exit(1)
+		}
+	}
+	// Before PAM modules or anything else can start processes outside
+	// of it.
+	joinSessionCgroup()
+
 	euid := uint64(os.Geteuid())
-	// Inform the system that we are about to log someone in.
-	// We can only do this if we are running as root.
-	// This is best effort to still allow running on machines where
-	// we don't support starting session, e.g. darwin.
-	sessionCloser, err := maybeStartLoginSession(logf, uint32(*uid), *localUser, *remoteUser, *remoteIP, *ttyName)
-	if err == nil && sessionCloser != nil {
-		defer sessionCloser()
-	}
-	if euid != *uid {
+	var pamEnv []string
+	var pamClose func() error
+	if *pamSvc != "" {
+		var err error
+		pamEnv, pamClose, err = maybeStartPAMSession(logf, *pamSvc, *localUser, *remoteUser, *remoteIP, *ttyName)
+		if err != nil {
+			logf("pam: %v", err)
+			fmt.Fprintf(os.Stderr, "Login refused by PAM.\r\n")
+			os.Exit(1)
+		}
+	}
+	if pamClose == nil {
+		// Inform the system that we are about to log someone in.
+		// We can only do this if we are running as root.
+		// This is best effort to still allow running on machines where
+		// we don't support starting session, e.g. darwin.
+		// With a PAM session, pam_systemd does this instead.
+		sessionCloser, err := maybeStartLoginSession(logf, uint32(*uid), *localUser, *remoteUser, *remoteIP, *ttyName)
+		if err == nil && sessionCloser != nil {
+			defer sessionCloser()
+		}
+	}
+	// Starting a login session, with logind or pam_systemd, moves the
+	// process into the session's scope, out of the session cgroup, so
+	// join it again.
+	joinSessionCgroup()
+	// To close a PAM session once cmd exits, the incubator has to
+	// stay root, and only cmd runs as the user. SFTP and scp are then
+	// served by another incubator, as the user.
+	runAsUser := pamClose != nil
+	if runAsUser {
+		defer func() {
+			if err := pamClose(); err != nil {
+				logf("pam: %v", err)
+			}
+		}()
+	}
+	// After PAM, whose modules may set them too, and while still
+	// root, to be able to raise hard limits.
+	if err := setUmaskAndUlimits(*umask, *ulimits); err != nil {
+		logf("%v", err)
+		fmt.Fprintf(os.Stderr, "Can't apply this session's umask or ulimits.\r\n")
+		os.Exit(1)
+	}
+	if euid != *uid && !runAsUser {
 		// Switch users if required before starting the desired process.
-		if err := syscall.Setuid(int(*uid)); err != nil {
+		if err := dropPrivileges(*uid); err != nil {
 			logf(err.Error())
 			os.Exit(1)
 		}
 	}
 
-	cmd := exec.Command(*cmdName, cmdArgs...)
+	var cmd *exec.Cmd
+	switch {
+	case (*sftpMode || *scpMode) && runAsUser:
+		exe, err := os.Executable()
+		if err != nil {
+			return err
+		}
+		childArgs := []string{"be-child", "ssh", "--uid=" + strconv.FormatUint(*uid, 10), "--local-user=" + *localUser}
+		if *sftpMode {
+			childArgs = append(childArgs, "--sftp")
+		} else {
+			childArgs = append(childArgs, "--scp", "--")
+			childArgs = append(childArgs, cmdArgs...)
+		}
+		cmd = exec.Command(exe, childArgs...)
+		if *scpMode {
+			cmd.ExtraFiles = []*os.File{os.NewFile(3, "scp-report")}
+		}
+	case *sftpMode, *scpMode:
+		// Served here, with nothing to close afterwards, so the
+		// signals can kill the incubator again.
+		signal.Stop(sigc)
+		select {
+		case <-sigc:
+			os.Exit(1)
+		default:
+		}
+		if *sftpMode {
+			return serveSFTP()
+		}
+		if err := serveSCP(cmdArgs, os.NewFile(3, "scp-report")); err != nil {
+			// The client has been told what went wrong.
+			os.Exit(1)
+		}
+		return nil
+	default:
+		cmd = exec.Command(*cmdName, cmdArgs...)
+	}
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
-	cmd.Env = os.Environ()
+	cmd.Env = append(os.Environ(), pamEnv...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{}
 
 	if *hasTTY {
 		// If we were launched with a tty then we should
@@ -153,11 +316,163 @@ func beIncubator(args []string) error {
 		// also passes the ctty.
 		// However, we can not do this if never had a tty to
 		// begin with.
-		cmd.SysProcAttr = &syscall.SysProcAttr{
-			Foreground: true,
+		cmd.SysProcAttr.Foreground = true
+	}
+	if runAsUser && euid != *uid {
+		cred, err := userCredential(*uid)
+		if err != nil {
+			logf(err.Error())
+			os.Exit(1)
+		}
+		cmd.SysProcAttr.Credential = cred
+	}
+	select {
+	case <-sigc:
+		return errors.New("session ended before it started")
+	default:
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go endOnSignal(cmd.Process, *hasTTY, sigc, done)
+	return cmd.Wait()
+}
+
+// incubatorHangupTimeout is how long the incubator's command has to
+// exit after a hangup, before it's killed. It's well within the time
+// tailscaled gives the incubator, incubatorTermTimeout.
+const incubatorHangupTimeout = 2 * time.Second
+
+// endOnSignal ends the incubator's command p once a signal arrives on
+// sigc, unless done is closed first. Like a hangup of its tty, it sends
+// SIGHUP, to p's process group if p has the tty, then kills what's
+// left after incubatorHangupTimeout.
+func endOnSignal(p *os.Process, hasTTY bool, sigc <-chan os.Signal, done <-chan struct{}) {
+	select {
+	case <-sigc:
+	case <-done:
+		return
+	}
+	pid := p.Pid
+	if hasTTY {
+		pid = -pid // p leads its foreground process group
+	}
+	unix.Kill(pid, unix.SIGHUP)
+	unix.Kill(pid, unix.SIGCONT) // in case it's stopped
+	select {
+	case <-time.After(incubatorHangupTimeout):
+		unix.Kill(pid, unix.SIGKILL)
+	case <-done:
+	}
+}
+
+// resetSignal restores the default action of sig, which the Go runtime
+// doesn't otherwise allow, so that the process dies from it. See
+// resetSignalLinux.
+var resetSignal = func(sig syscall.Signal) error {
+	return errors.New("unsupported")
+}
+
+// exitLike exits the incubator as its command, whose state is ps,
+// did, so that tailscaled sees the command's exit status or signal as
+// the incubator's. Whether the command dumped core isn't passed on, as
+// the incubator mustn't dump core itself. Where the incubator can't die
+// from the signal, it exits with 128 plus its number, as shells do.
+func exitLike(ps *os.ProcessState) {
+	ws, ok := ps.Sys().(syscall.WaitStatus)
+	if !ok || !ws.Signaled() {
+		code := ps.ExitCode()
+		if code < 0 {
+			code = 1
+		}
+		os.Exit(code)
+	}
+	sig := ws.Signal()
+	if resetSignal(sig) == nil {
+		unix.Setrlimit(unix.RLIMIT_CORE, &unix.Rlimit{})
+		unix.Kill(os.Getpid(), sig)
+		time.Sleep(time.Second) // for it to be delivered
+	}
+	os.Exit(128 + int(sig))
+}
+
+// rfc4254Signals are the signals RFC 4254 section 6.10 names.
+var rfc4254Signals = map[syscall.Signal]ssh.Signal{
+	syscall.SIGABRT: ssh.SIGABRT,
+	syscall.SIGALRM: ssh.SIGALRM,
+	syscall.SIGFPE:  ssh.SIGFPE,
+	syscall.SIGHUP:  ssh.SIGHUP,
+	syscall.SIGILL:  ssh.SIGILL,
+	syscall.SIGINT:  ssh.SIGINT,
+	syscall.SIGKILL: ssh.SIGKILL,
+	syscall.SIGPIPE: ssh.SIGPIPE,
+	syscall.SIGQUIT: ssh.SIGQUIT,
+	syscall.SIGSEGV: ssh.SIGSEGV,
+	syscall.SIGTERM: ssh.SIGTERM,
+	syscall.SIGUSR1: ssh.SIGUSR1,
+	syscall.SIGUSR2: ssh.SIGUSR2,
+}
+
+// exitSignal reports the signal that terminated the process whose
+// state is ps, if any, and whether it dumped core. Signals RFC 4254
+// doesn't name are reported as OpenSSH reports them.
+func exitSignal(ps *os.ProcessState) (sig ssh.Signal, coreDumped, ok bool) {
+	ws, ok := ps.Sys().(syscall.WaitStatus)
+	if !ok || !ws.Signaled() {
+		return "", false, false
+	}
+	sig, ok = rfc4254Signals[ws.Signal()]
+	if !ok {
+		sig = "SIG@openssh.com"
+	}
+	return sig, ws.CoreDump(), true
+}
+
+// rlimitResources maps the names of ulimitResources to their
+// setrlimit resources.
+var rlimitResources = map[string]int{
+	"nofile": unix.RLIMIT_NOFILE,
+	"nproc":  unix.RLIMIT_NPROC,
+	"core":   unix.RLIMIT_CORE,
+}
+
+// setUmaskAndUlimits sets the incubator's umask and resource limits,
+// which its children inherit, from its --umask and --ulimits flags.
+func setUmaskAndUlimits(umask, ulimits string) error {
+	if umask != "" {
+		m, err := parseUmask(umask)
+		if err != nil {
+			return err
+		}
+		syscall.Umask(int(m))
+	}
+	if ulimits == "" {
+		return nil
+	}
+	for _, kv := range strings.Split(ulimits, ",") {
+		name, v, _ := strings.Cut(kv, "=")
+		res, ok := rlimitResources[name]
+		if !ok {
+			return fmt.Errorf("unknown ulimit %q", name)
+		}
+		soft, hard, err := parseUlimit(v)
+		if err != nil {
+			return fmt.Errorf("ulimit %s: %w", name, err)
+		}
+		rl := unix.Rlimit{Cur: soft, Max: hard}
+		if rl.Cur == rlimUnlimited {
+			rl.Cur = unix.RLIM_INFINITY
+		}
+		if rl.Max == rlimUnlimited {
+			rl.Max = unix.RLIM_INFINITY
+		}
+		if err := unix.Setrlimit(res, &rl); err != nil {
+			return fmt.Errorf("setting ulimit %s: %w", name, err)
 		}
 	}
-	return cmd.Run()
+	return nil
 }
 
 // launchProcess launches an incubator process for the provided session.
@@ -166,23 +481,25 @@ func beIncubator(args []string) error {
 //
 // It sets ss.cmd, stdin, stdout, and stderr.
 func (ss *sshSession) launchProcess(ctx context.Context) error {
-	shell := loginShell(ss.localUser.Uid)
+	if a := ss.action; (a.Umask != "" || len(a.Ulimits) > 0) && ss.srv.tailscaledPath == "" {
+		return errors.New("umask and ulimits need the incubator")
+	}
+	shell := loginShell(ss.localUser)
 	var args []string
-	if rawCmd := ss.RawCommand(); rawCmd != "" {
+	scpArgs, isSCP := ss.scpArgs()
+	if isSCP {
+		shell, args = "scp", scpArgs
+	} else if rawCmd := ss.command(); rawCmd != "" {
 		args = append(args, "-c", rawCmd)
-	} else {
+	} else if ss.subsystem() != sftpSubsystem {
 		args = append(args, "-l") // login shell
 	}
 
-	ci := ss.connInfo
 	cmd := ss.newIncubatorCommand(ctx, shell, args)
 	cmd.Dir = ss.localUser.HomeDir
 	cmd.Env = append(cmd.Env, envForUser(ss.localUser)...)
-	cmd.Env = append(cmd.Env, ss.Environ()...)
-	cmd.Env = append(cmd.Env,
-		fmt.Sprintf("SSH_CLIENT=%s %d %d", ci.src.IP(), ci.src.Port(), ci.dst.Port()),
-		fmt.Sprintf("SSH_CONNECTION=%s %d %s %d", ci.src.IP(), ci.src.Port(), ci.dst.IP(), ci.dst.Port()),
-	)
+	cmd.Env = append(cmd.Env, ss.clientEnv()...)
+	cmd.Env = append(cmd.Env, ss.connEnv()...)
 
 	ss.cmd = cmd
 
@@ -191,6 +508,29 @@ func (ss *sshSession) launchProcess(ctx context.Context) error {
 	}
 
 	ptyReq, winCh, isPty := ss.Pty()
+	if ss.subsystem() == sftpSubsystem {
+		if ss.srv.tailscaledPath == "" {
+			return errors.New("SFTP needs the incubator")
+		}
+		ss.logf("starting SFTP server: %+v", cmd.Args)
+		return ss.startWithStdPipes()
+	}
+	if isSCP {
+		r, w, err := os.Pipe()
+		if err != nil {
+			return err
+		}
+		cmd.ExtraFiles = []*os.File{w} // fd 3, for the transfer reports
+		ss.logf("starting scp: %+v", cmd.Args)
+		err = ss.startWithStdPipes()
+		w.Close()
+		if err != nil {
+			r.Close()
+			return err
+		}
+		go ss.logSCPTransfers(r)
+		return nil
+	}
 	if !isPty {
 		ss.logf("starting non-pty command: %+v", cmd.Args)
 		return ss.startWithStdPipes()
@@ -202,6 +542,7 @@ func (ss *sshSession) launchProcess(ctx context.Context) error {
 		return err
 	}
 	go resizeWindow(pty, winCh)
+	go ss.handleBreaks(pty)
 	ss.stdout = pty // no stderr for a pty
 	ss.stdin = pty
 	return nil
@@ -216,6 +557,68 @@ func resizeWindow(f *os.File, winCh <-chan ssh.Window) {
 	}
 }
 
+// handleBreaks delivers the client's break requests to the pty f until
+// the session ends.
+func (ss *sshSession) handleBreaks(f *os.File) {
+	breakCh := make(chan bool)
+	ss.Break(breakCh)
+	defer func() {
+		// The request loop sends on breakCh holding the lock that
+		// Break needs, so keep receiving until it's unregistered.
+		done := make(chan struct{})
+		go func() {
+			ss.Break(nil)
+			close(done)
+		}()
+		for {
+			select {
+			case <-breakCh:
+			case <-done:
+				return
+			}
+		}
+	}()
+	for {
+		select {
+		case <-breakCh:
+			ss.vlogf("break")
+			if err := sendPTYBreak(f); err != nil {
+				ss.logf("break: %v", err)
+			}
+		case <-ss.ctx.Done():
+			return
+		}
+	}
+}
+
+// sendPTYBreak has the pty whose master is f receive a break, as a
+// serial line would: depending on the terminal's settings, it's ignored
+// (IGNBRK), sends SIGINT to the foreground process group (BRKINT), or
+// is read as a NUL byte, marked as a break with PARMRK. Ptys ignore
+// tcsendbreak, so it's done by hand.
+func sendPTYBreak(f *os.File) error {
+	fd := int(f.Fd())
+	tios, err := termios.GTTY(fd)
+	if err != nil {
+		return err
+	}
+	switch {
+	case tios.Opts["ignbrk"]:
+		return nil
+	case tios.Opts["brkint"]:
+		pgrp, err := unix.IoctlGetInt(fd, unix.TIOCGPGRP)
+		if err != nil {
+			return err
+		}
+		return unix.Kill(-pgrp, unix.SIGINT)
+	case tios.Opts["parmrk"]:
+		_, err = f.Write([]byte{0377, 0, 0})
+	default:
+		_, err = f.Write([]byte{0})
+	}
+	return err
+}
+
 // opcodeShortName is a mapping of SSH opcode
 // to mnemonic names expected by the termios packaage.
 // These are meant to be platform independent.
@@ -379,53 +782,93 @@ func (ss *sshSession) startWithPTY() (ptyFile *os.File, err error) {
 	return ptyFile, nil
 }
 
-// startWithStdPipes starts cmd with os.Pipe for Stdin, Stdout and Stderr.
-func (ss *sshSession) startWithStdPipes() (err error) {
-	var stdin io.WriteCloser
-	var stdout, stderr io.ReadCloser
-	defer func() {
-		if err != nil {
-			for _, c := range []io.Closer{stdin, stdout, stderr} {
-				if c != nil {
-					c.Close()
-				}
-			}
-		}
-	}()
-	cmd := ss.cmd
-	if cmd == nil {
-		return errors.New("nil cmd")
+// userCredential returns the credential of the user with the given
+// uid, for running a process as them.
+func userCredential(uid uint64) (*syscall.Credential, error) {
+	u, err := user.LookupId(strconv.FormatUint(uid, 10))
+	if err != nil {
+		return nil, err
 	}
-	stdin, err = cmd.StdinPipe()
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	stdout, err = cmd.StdoutPipe()
+	cred := &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+	gids, err := userGroupIDs(u)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	stderr, err = cmd.StderrPipe()
+	for _, g := range gids {
+		if id, err := strconv.ParseUint(g, 10, 32); err == nil {
+			cred.Groups = append(cred.Groups, uint32(id))
+		}
+	}
+	return cred, nil
+}
+
+// userGroupIDs returns the IDs of the groups that u is a member of,
+// like initgroups(3) finds them. It asks id(1), which goes through NSS
+// (or Directory Services, on macOS), as os/user without cgo only reads
+// /etc/group, and so misses the groups of LDAP users and the like.
+func userGroupIDs(u *user.User) ([]string, error) {
+	out, err := exec.Command("id", "-G", u.Username).Output()
+	if err == nil {
+		if gids := strings.Fields(string(out)); len(gids) > 0 {
+			return gids, nil
+		}
+	}
+	return u.GroupIds()
+}
+
+// dropPrivileges makes the process run as the user with the given uid,
+// with their primary group and all of their supplementary ones, as
+// OpenSSH's sshd does for its sessions.
+func dropPrivileges(uid uint64) error {
+	cred, err := userCredential(uid)
 	if err != nil {
 		return err
 	}
-	if err := cmd.Start(); err != nil {
-		return err
+	groups := make([]int, len(cred.Groups))
+	for i, g := range cred.Groups {
+		groups[i] = int(g)
+	}
+	// In this order, as only root can change its groups, and its
+	// gid only while it still has its uid.
+	if err := syscall.Setgroups(groups); err != nil {
+		return fmt.Errorf("setgroups: %w", err)
+	}
+	if err := syscall.Setgid(int(cred.Gid)); err != nil {
+		return fmt.Errorf("setgid: %w", err)
+	}
+	if err := syscall.Setuid(int(cred.Uid)); err != nil {
+		return fmt.Errorf("setuid: %w", err)
+	}
+	return nil
+}
+
+// canRunAs returns an error if this process can't start processes as
+// lu.
+func canRunAs(lu *user.User) error {
+	if euid := os.Geteuid(); euid != 0 && lu.Uid != fmt.Sprint(euid) {
+		return fmt.Errorf("can't switch to user %q from process euid %v", lu.Username, euid)
 	}
-	ss.stdin = stdin
-	ss.stdout = stdout
-	ss.stderr = stderr
 	return nil
 }
 
-func loginShell(uid string) string {
+// loginShell returns u's login shell.
+func loginShell(u *user.User) string {
 	switch runtime.GOOS {
 	case "linux":
-		out, _ := exec.Command("getent", "passwd", uid).Output()
+		out, _ := exec.Command("getent", "passwd", u.Uid).Output()
 		// out is "root:x:0:0:root:/root:/bin/bash"
 		f := strings.SplitN(string(out), ":", 10)
 		if len(f) > 6 {
 			return strings.TrimSpace(f[6]) // shell
 		}
+	case "darwin":
+		if sh := directoryServicesAttrs(u.Username)["UserShell"]; filepath.IsAbs(sh) {
+			return sh
+		}
 	}
 	if e := os.Getenv("SHELL"); e != "" {
 		return e
@@ -433,9 +876,94 @@ func loginShell(uid string) string {
 	return "/bin/bash"
 }
 
+// lookupLocalUser looks up the local user named name. On macOS, it
+// takes the home directory from Directory Services, as the one that
+// user.Lookup finds can be stale or missing for mobile and network
+// (like Active Directory) accounts, and falls back to Directory
+// Services altogether for accounts user.Lookup doesn't find.
+func lookupLocalUser(name string) (*user.User, error) {
+	u, err := user.Lookup(name)
+	if runtime.GOOS != "darwin" {
+		return u, err
+	}
+	attrs := directoryServicesAttrs(name)
+	if err != nil {
+		if du := directoryServicesUser(name, attrs); du != nil {
+			return du, nil
+		}
+		return nil, err
+	}
+	if home := attrs["NFSHomeDirectory"]; filepath.IsAbs(home) {
+		u.HomeDir = home
+	}
+	return u, nil
+}
+
+// directoryServicesUser returns the user named name with the Directory
+// Services attributes attrs, or nil if they lack its IDs or home
+// directory.
+func directoryServicesUser(name string, attrs map[string]string) *user.User {
+	uid, gid, home := attrs["UniqueID"], attrs["PrimaryGroupID"], attrs["NFSHomeDirectory"]
+	if _, err := strconv.ParseUint(uid, 10, 32); err != nil {
+		return nil
+	}
+	if _, err := strconv.ParseUint(gid, 10, 32); err != nil {
+		return nil
+	}
+	if !filepath.IsAbs(home) {
+		return nil
+	}
+	return &user.User{Uid: uid, Gid: gid, Username: name, Name: name, HomeDir: home}
+}
+
+// directoryServicesAttrs returns the UniqueID, PrimaryGroupID,
+// NFSHomeDirectory and UserShell attributes of the macOS user named
+// name, as far as Directory Services knows. It searches all of its
+// directories, not just the local one, so that network accounts are
+// found too.
+func directoryServicesAttrs(name string) map[string]string {
+	if name == "" || strings.ContainsAny(name, "/\x00") || strings.HasPrefix(name, "-") {
+		return nil
+	}
+	out, err := exec.Command("dscl", "/Search", "-read", "/Users/"+name, "UniqueID", "PrimaryGroupID", "NFSHomeDirectory", "UserShell").Output()
+	if err != nil {
+		return nil
+	}
+	return parseDSCLRead(out)
+}
+
+// parseDSCLRead parses the output of "dscl -read", which has a line
+// per attribute, "Name: value", with the value on the next line,
+// indented, if it has spaces. For attributes with several values,
+// only the first is returned.
+func parseDSCLRead(out []byte) map[string]string {
+	attrs := make(map[string]string)
+	lines := strings.Split(string(out), "\n")
+	for i := 0; i < len(lines); i++ {
+		name, v, ok := strings.Cut(lines[i], ":")
+		if !ok || name == "" || strings.HasPrefix(name, " ") || strings.Contains(name, " ") {
+			// Like "No such key: UserShell", or a continuation line.
+			continue
+		}
+		v = strings.TrimSpace(v)
+		if v == "" {
+			if i+1 < len(lines) && strings.HasPrefix(lines[i+1], " ") {
+				i++
+				v = strings.TrimSpace(lines[i])
+			}
+		} else if first, _, ok := strings.Cut(v, " "); ok {
+			v = first
+		}
+		if v != "" {
+			attrs[name] = v
+		}
+	}
+	return attrs
+}
+
 func envForUser(u *user.User) []string {
 	return []string{
-		fmt.Sprintf("SHELL=" + loginShell(u.Uid)),
+		fmt.Sprintf("SHELL=" + loginShell(u)),
 		fmt.Sprintf("USER=" + u.Username),
 		fmt.Sprintf("HOME=" + u.HomeDir),
 	}
@@ -8,20 +8,41 @@
 package tailssh
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"os"
+	"os/exec"
+	"os/user"
+	"strings"
 	"syscall"
 	"time"
 	"unsafe"
 
 	"github.com/godbus/dbus/v5"
 	"tailscale.com/types/logger"
+	"tailscale.com/util/lineread"
 )
 
 func init() {
 	ptyName = ptyNameLinux
 	maybeStartLoginSession = maybeStartLoginSessionLinux
+	resetSignal = resetSignalLinux
+	createEphemeralUser = createEphemeralUserLinux
+	removeEphemeralUser = removeEphemeralUserLinux
+	listEphemeralUsers = listEphemeralUsersLinux
+}
+
+func resetSignalLinux(sig syscall.Signal) error {
+	// A zeroed struct sigaction is SIG_DFL with no flags and an empty
+	// mask, whatever its layout on this architecture, which sa is
+	// larger than.
+	var sa [8]uint64
+	_, _, e := syscall.RawSyscall6(syscall.SYS_RT_SIGACTION, uintptr(sig), uintptr(unsafe.Pointer(&sa)), 0, 8, 0, 0)
+	if e != 0 {
+		return e
+	}
+	return nil
 }
 
 func ptyNameLinux(f *os.File) (string, error) {
@@ -173,3 +194,56 @@ func maybeStartLoginSessionLinux(logf logger.Logf, uid uint32, localUser, remote
 	}
 	return nil, nil
 }
+
+// createEphemeralUserLinux is the linux implementation of
+// createEphemeralUser.
+func createEphemeralUserLinux(name string) error {
+	out, err := exec.Command("useradd", "--create-home", "--user-group", "--comment", ephemeralUserComment, name).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("useradd: %v: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// removeEphemeralUserLinux is the linux implementation of
+// removeEphemeralUser.
+func removeEphemeralUserLinux(name string) error {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return err
+	}
+	// userdel refuses to remove users with processes left, such as
+	// ones started with nohup.
+	exec.Command("pkill", "-KILL", "-u", name).Run()
+	// userdel only removes their home directory and mail spool, and
+	// their uid may be reused for the next ephemeral user, who would
+	// then own what they left elsewhere.
+	for _, dir := range ephemeralUserScratchDirs {
+		exec.Command("find", dir, "-xdev", "-depth", "-uid", u.Uid, "-delete").Run()
+	}
+	out, err := exec.Command("userdel", "--remove", name).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("userdel: %v: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// ephemeralUserScratchDirs are the world-writable directories that
+// removeEphemeralUserLinux removes ephemeral users' files from.
+var ephemeralUserScratchDirs = []string{"/tmp", "/var/tmp", "/dev/shm"}
+
+// listEphemeralUsersLinux is the linux implementation of
+// listEphemeralUsers. useradd adds users to /etc/passwd, with the
+// comment (GECOS field) that createEphemeralUserLinux gives them.
+func listEphemeralUsersLinux() ([]string, error) {
+	var names []string
+	err := lineread.File("/etc/passwd", func(line []byte) error {
+		// name:password:uid:gid:gecos:home:shell
+		f := strings.Split(string(line), ":")
+		if len(f) == 7 && f[4] == ephemeralUserComment && strings.HasPrefix(f[0], "ts-") {
+			names = append(names, f[0])
+		}
+		return nil
+	})
+	return names, err
+}
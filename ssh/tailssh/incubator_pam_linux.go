@@ -0,0 +1,129 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux && cgo && ts_pam
+// +build linux,cgo,ts_pam
+
+package tailssh
+
+// This file runs PAM's account and session modules for the incubator.
+// It needs cgo and libpam's headers, so it's only built with the
+// ts_pam build tag.
+
+/*
+#cgo LDFLAGS: -lpam
+#include <stdlib.h>
+#include <security/pam_appl.h>
+
+// tsPAMConv is the PAM conversation function. Tailscale SSH has
+// nothing to answer modules' prompts with, so it refuses them, and
+// ignores their informational messages.
+static int tsPAMConv(int n, const struct pam_message **msg, struct pam_response **resp, void *data) {
+	int i;
+	for (i = 0; i < n; i++) {
+		if (msg[i]->msg_style == PAM_PROMPT_ECHO_OFF || msg[i]->msg_style == PAM_PROMPT_ECHO_ON) {
+			return PAM_CONV_ERR;
+		}
+	}
+	*resp = calloc(n, sizeof(struct pam_response));
+	return *resp ? PAM_SUCCESS : PAM_BUF_ERR;
+}
+
+static struct pam_conv tsPAMConvStruct = { tsPAMConv, NULL };
+
+static int tsPAMStart(const char *service, const char *user, pam_handle_t **pamh) {
+	return pam_start(service, user, &tsPAMConvStruct, pamh);
+}
+
+static int tsPAMSetItem(pam_handle_t *pamh, int item, const char *s) {
+	return pam_set_item(pamh, item, s);
+}
+*/
+import "C"
+
+import (
+	"fmt"
+	"unsafe"
+
+	"tailscale.com/types/logger"
+)
+
+func init() {
+	havePAM = true
+	maybeStartPAMSession = startPAMSessionLinux
+}
+
+// startPAMSessionLinux is the linux implementation of
+// maybeStartPAMSession. It has to be called as root.
+func startPAMSessionLinux(logf logger.Logf, service, localUser, remoteUser, remoteHost, tty string) (env []string, close func() error, err error) {
+	cService := C.CString(service)
+	defer C.free(unsafe.Pointer(cService))
+	cUser := C.CString(localUser)
+	defer C.free(unsafe.Pointer(cUser))
+
+	var h *C.pam_handle_t
+	if rc := C.tsPAMStart(cService, cUser, &h); rc != C.PAM_SUCCESS {
+		return nil, nil, fmt.Errorf("pam_start(%q): error %d", service, int(rc))
+	}
+	fail := func(what string, rc C.int) error {
+		err := fmt.Errorf("%s: %s", what, C.GoString(C.pam_strerror(h, rc)))
+		C.pam_end(h, rc)
+		return err
+	}
+
+	// Like OpenSSH, which names the tty "ssh" when there's none.
+	if tty == "" {
+		tty = "ssh"
+	} else {
+		tty = "/dev/" + tty
+	}
+	for _, it := range []struct {
+		item C.int
+		val  string
+	}{
+		{C.PAM_RHOST, remoteHost},
+		{C.PAM_RUSER, remoteUser},
+		{C.PAM_TTY, tty},
+	} {
+		cs := C.CString(it.val)
+		rc := C.tsPAMSetItem(h, it.item, cs)
+		C.free(unsafe.Pointer(cs))
+		if rc != C.PAM_SUCCESS {
+			return nil, nil, fail("pam_set_item", rc)
+		}
+	}
+
+	// The user's already authenticated by their Tailscale identity, so
+	// only the account modules run, to check that they may log in now.
+	if rc := C.pam_acct_mgmt(h, 0); rc != C.PAM_SUCCESS {
+		return nil, nil, fail("pam_acct_mgmt", rc)
+	}
+	if rc := C.pam_setcred(h, C.PAM_ESTABLISH_CRED); rc != C.PAM_SUCCESS {
+		return nil, nil, fail("pam_setcred", rc)
+	}
+	if rc := C.pam_open_session(h, 0); rc != C.PAM_SUCCESS {
+		C.pam_setcred(h, C.PAM_DELETE_CRED)
+		return nil, nil, fail("pam_open_session", rc)
+	}
+	logf("pam: opened %q session for %q", service, localUser)
+
+	if list := C.pam_getenvlist(h); list != nil {
+		for p := list; *p != nil; p = (**C.char)(unsafe.Add(unsafe.Pointer(p), unsafe.Sizeof(*p))) {
+			env = append(env, C.GoString(*p))
+			C.free(unsafe.Pointer(*p))
+		}
+		C.free(unsafe.Pointer(list))
+	}
+
+	close = func() error {
+		rc := C.pam_close_session(h, 0)
+		C.pam_setcred(h, C.PAM_DELETE_CRED)
+		if rc != C.PAM_SUCCESS {
+			return fail("pam_close_session", rc)
+		}
+		C.pam_end(h, rc)
+		return nil
+	}
+	return env, close, nil
+}
@@ -0,0 +1,397 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// This file contains the Windows code for starting sessions' processes.
+// Windows has no setuid, so tailscaled starts them with the local user's
+// token itself, rather than through an incubator that switches users.
+// The incubator, `tailscaled be-child ssh`, only serves SFTP and scp,
+// as the local user.
+
+package tailssh
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/user"
+	"strings"
+	"sync"
+	"syscall"
+	"unicode/utf16"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+	"tailscale.com/cmd/tailscaled/childproc"
+	"tailscale.com/tempfork/gliderlabs/ssh"
+)
+
+func init() {
+	childproc.Add("ssh", beIncubator)
+}
+
+// exitSignal reports the signal that terminated the process whose
+// state is ps. Windows processes aren't terminated by signals.
+func exitSignal(ps *os.ProcessState) (sig ssh.Signal, coreDumped, ok bool) {
+	return "", false, false
+}
+
+// beIncubator is the entrypoint to the `tailscaled be-child ssh`
+// subcommand, which tailscaled starts as the local user.
+func beIncubator(args []string) error {
+	var (
+		flags     = flag.NewFlagSet("", flag.ExitOnError)
+		sftpMode  = flags.Bool("sftp", false, "serve SFTP on stdin and stdout")
+		scpMode   = flags.Bool("scp", false, "serve scp with the args on stdin and stdout")
+		scpReport = flags.Uint64("scp-report-handle", 0, "the inherited handle to report scp's copies on")
+	)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	switch {
+	case *sftpMode:
+		return serveSFTP()
+	case *scpMode:
+		if err := serveSCP(flags.Args(), os.NewFile(uintptr(*scpReport), "scp-report")); err != nil {
+			// The client has been told what went wrong.
+			os.Exit(1)
+		}
+		return nil
+	}
+	return errors.New("the incubator only serves SFTP and scp on Windows")
+}
+
+// launchProcess launches the process for the provided session, as its
+// local user, with a pseudo console if it asked for a pty.
+// The caller can wait for the process to exit by calling cmd.Wait().
+//
+// It sets ss.cmd, stdin, stdout, and stderr.
+func (ss *sshSession) launchProcess(ctx context.Context) error {
+	if a := ss.action; a.Umask != "" || len(a.Ulimits) > 0 {
+		return errors.New("umask and ulimits aren't supported on Windows")
+	}
+	lu := ss.localUser
+	tok, err := userToken(lu)
+	if err != nil {
+		return fmt.Errorf("getting token for %q: %w", lu.Username, err)
+	}
+	if tok != 0 {
+		defer tok.Close()
+	}
+	env := os.Environ()
+	if tok != 0 {
+		if env, err = tok.Environ(false); err != nil {
+			return err
+		}
+	}
+	env = append(env, ss.clientEnv()...)
+	env = append(env, ss.connEnv()...)
+	if ss.agentListener != nil {
+		env = append(env, fmt.Sprintf("SSH_AUTH_SOCK=%s", ss.agentListener.Addr()))
+	}
+
+	var cmd *exec.Cmd
+	var scpReport *os.File // read end of the incubator's scp reports
+	scpArgs, isSCP := ss.scpArgs()
+	switch {
+	case ss.subsystem() == sftpSubsystem:
+		if ss.srv.tailscaledPath == "" {
+			return errors.New("SFTP needs the incubator")
+		}
+		cmd = exec.CommandContext(ctx, ss.srv.tailscaledPath, "be-child", "ssh", "--sftp")
+	case isSCP:
+		r, w, err := os.Pipe()
+		if err != nil {
+			return err
+		}
+		defer w.Close()
+		wh := windows.Handle(w.Fd())
+		if err := windows.SetHandleInformation(wh, windows.HANDLE_FLAG_INHERIT, windows.HANDLE_FLAG_INHERIT); err != nil {
+			r.Close()
+			return err
+		}
+		scpReport = r
+		args := []string{"be-child", "ssh", "--scp", fmt.Sprintf("--scp-report-handle=%d", wh), "--"}
+		cmd = exec.CommandContext(ctx, ss.srv.tailscaledPath, append(args, scpArgs...)...)
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			AdditionalInheritedHandles: []syscall.Handle{syscall.Handle(wh)},
+		}
+	default:
+		shell := loginShell()
+		cmd = exec.CommandContext(ctx, shell)
+		if rawCmd := ss.command(); rawCmd != "" {
+			// cmd.exe parses its command line itself, so rawCmd is
+			// passed through as is.
+			cmd.SysProcAttr = &syscall.SysProcAttr{
+				CmdLine: syscall.EscapeArg(shell) + " /c " + rawCmd,
+			}
+		}
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Token = syscall.Token(tok)
+	cmd.Dir = lu.HomeDir
+	cmd.Env = env
+	ss.cmd = cmd
+
+	ptyReq, winCh, isPty := ss.Pty()
+	if ss.subsystem() == sftpSubsystem {
+		ss.logf("starting SFTP server: %+v", cmd.Args)
+		return ss.startWithStdPipes()
+	}
+	if isSCP {
+		ss.logf("starting scp: %+v", cmd.Args)
+		if err := ss.startWithStdPipes(); err != nil {
+			scpReport.Close()
+			return err
+		}
+		go ss.logSCPTransfers(scpReport)
+		return nil
+	}
+	if !isPty {
+		ss.logf("starting non-pty command: %+v", cmd.Args)
+		return ss.startWithStdPipes()
+	}
+	ss.ptyReq = &ptyReq
+	cmd.Env = append(cmd.Env, "TERM="+ptyReq.Term)
+	ss.logf("starting pty command: %+v", cmd.Args)
+	return ss.startWithConPTY(ctx, ptyReq.Window, winCh)
+}
+
+// lookupLocalUser looks up the local user named name.
+func lookupLocalUser(name string) (*user.User, error) {
+	return user.Lookup(name)
+}
+
+// loginShell returns the shell to start sessions with.
+func loginShell() string {
+	if s := os.Getenv("ComSpec"); s != "" {
+		return s
+	}
+	return `C:\Windows\System32\cmd.exe`
+}
+
+var (
+	kernel32                = windows.NewLazySystemDLL("kernel32.dll")
+	procCreatePseudoConsole = kernel32.NewProc("CreatePseudoConsole")
+	procResizePseudoConsole = kernel32.NewProc("ResizePseudoConsole")
+	procClosePseudoConsole  = kernel32.NewProc("ClosePseudoConsole")
+)
+
+// procThreadAttributePseudoConsole is PROC_THREAD_ATTRIBUTE_PSEUDOCONSOLE.
+const procThreadAttributePseudoConsole = 0x20016
+
+// pseudoConsole is a Windows pseudo console (ConPTY).
+type pseudoConsole struct {
+	mu sync.Mutex
+	h  windows.Handle // 0 once closed
+}
+
+// newPseudoConsole returns a new pseudo console the size of win, which
+// reads its input from in and writes its output to out.
+func newPseudoConsole(win ssh.Window, in, out windows.Handle) (*pseudoConsole, error) {
+	if err := procCreatePseudoConsole.Find(); err != nil {
+		return nil, fmt.Errorf("pseudo consoles need Windows 10 1809 or later: %w", err)
+	}
+	var h windows.Handle
+	r, _, _ := procCreatePseudoConsole.Call(consoleSize(win), uintptr(in), uintptr(out), 0, uintptr(unsafe.Pointer(&h)))
+	if r != 0 {
+		return nil, fmt.Errorf("CreatePseudoConsole: HRESULT %#x", r)
+	}
+	return &pseudoConsole{h: h}, nil
+}
+
+// consoleSize returns win's size as the COORD that the pseudo console
+// functions take by value.
+func consoleSize(win ssh.Window) uintptr {
+	w, h := win.Width, win.Height
+	if w <= 0 || h <= 0 {
+		w, h = 80, 24
+	}
+	return uintptr(uint16(w)) | uintptr(uint16(h))<<16
+}
+
+func (pc *pseudoConsole) resize(win ssh.Window) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if pc.h != 0 {
+		procResizePseudoConsole.Call(uintptr(pc.h), consoleSize(win))
+	}
+}
+
+// close closes pc, which ends its output once it's all been read.
+func (pc *pseudoConsole) close() {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if pc.h != 0 {
+		procClosePseudoConsole.Call(uintptr(pc.h))
+		pc.h = 0
+	}
+}
+
+// startWithConPTY starts ss.cmd attached to a new pseudo console the
+// size of win, which it resizes as winCh says to.
+func (ss *sshSession) startWithConPTY(ctx context.Context, win ssh.Window, winCh <-chan ssh.Window) (err error) {
+	cmd := ss.cmd
+	var inR, inW, outR, outW windows.Handle
+	if err := windows.CreatePipe(&inR, &inW, nil, 0); err != nil {
+		return err
+	}
+	// The pseudo console gets its own handles to the far ends.
+	defer windows.CloseHandle(inR)
+	if err := windows.CreatePipe(&outR, &outW, nil, 0); err != nil {
+		windows.CloseHandle(inW)
+		return err
+	}
+	defer windows.CloseHandle(outW)
+	stdin := os.NewFile(uintptr(inW), "conpty-in")
+	out := os.NewFile(uintptr(outR), "conpty-out")
+
+	var pc *pseudoConsole
+	defer func() {
+		if err != nil {
+			// Closing out first keeps closing pc from waiting for
+			// its output to be read.
+			stdin.Close()
+			out.Close()
+			if pc != nil {
+				pc.close()
+			}
+		}
+	}()
+	pc, err = newPseudoConsole(win, inR, outW)
+	if err != nil {
+		return err
+	}
+
+	attrs, err := windows.NewProcThreadAttributeList(1)
+	if err != nil {
+		return err
+	}
+	defer attrs.Delete()
+	if err := attrs.Update(procThreadAttributePseudoConsole, *(*unsafe.Pointer)(unsafe.Pointer(&pc.h)), unsafe.Sizeof(pc.h)); err != nil {
+		return err
+	}
+	si := &windows.StartupInfoEx{ProcThreadAttributeList: attrs.List()}
+	si.Cb = uint32(unsafe.Sizeof(*si))
+	// Without this, the process would get tailscaled's standard
+	// handles rather than the pseudo console's.
+	si.Flags = windows.STARTF_USESTDHANDLES
+
+	cmdLine := cmd.SysProcAttr.CmdLine
+	if cmdLine == "" {
+		args := make([]string, len(cmd.Args))
+		for i, a := range cmd.Args {
+			args[i] = syscall.EscapeArg(a)
+		}
+		cmdLine = strings.Join(args, " ")
+	}
+	app16, err := windows.UTF16PtrFromString(cmd.Path)
+	if err != nil {
+		return err
+	}
+	cmdLine16, err := windows.UTF16PtrFromString(cmdLine)
+	if err != nil {
+		return err
+	}
+	dir16, err := windows.UTF16PtrFromString(cmd.Dir)
+	if err != nil {
+		return err
+	}
+	env16, err := envBlock(cmd.Env)
+	if err != nil {
+		return err
+	}
+	const flags = windows.EXTENDED_STARTUPINFO_PRESENT | windows.CREATE_UNICODE_ENVIRONMENT
+	var pi windows.ProcessInformation
+	if tok := windows.Token(cmd.SysProcAttr.Token); tok != 0 {
+		err = windows.CreateProcessAsUser(tok, app16, cmdLine16, nil, nil, false, flags, env16, dir16, &si.StartupInfo, &pi)
+	} else {
+		err = windows.CreateProcess(app16, cmdLine16, nil, nil, false, flags, env16, dir16, &si.StartupInfo, &pi)
+	}
+	if err != nil {
+		return err
+	}
+	windows.CloseHandle(pi.Thread)
+	p, err := os.FindProcess(int(pi.ProcessId))
+	if err != nil {
+		windows.TerminateProcess(pi.Process, 1)
+		windows.CloseHandle(pi.Process)
+		return err
+	}
+	cmd.Process = p // for cmd.Wait
+
+	go func() {
+		// The pseudo console's output only ends once it's closed.
+		windows.WaitForSingleObject(pi.Process, windows.INFINITE)
+		windows.CloseHandle(pi.Process)
+		pc.close()
+	}()
+	go func() {
+		for win := range winCh {
+			pc.resize(win)
+		}
+	}()
+	ss.stdin = stdin
+	ss.stdout = conPTYOutput(ctx, out) // no stderr for a pty
+	return nil
+}
+
+// conPTYOutput returns a reader of out, a pseudo console's output, that
+// keeps out being read once ctx is done. Until out is read to its end,
+// closing the pseudo console can block.
+func conPTYOutput(ctx context.Context, out *os.File) io.Reader {
+	pr, pw := io.Pipe()
+	go func() {
+		<-ctx.Done()
+		pr.Close()
+	}()
+	go func() {
+		defer out.Close()
+		if _, err := io.Copy(pw, out); err != nil {
+			io.Copy(io.Discard, out)
+		}
+		pw.Close()
+	}()
+	return pr
+}
+
+// envBlock returns env as an environment block for CreateProcess. Like
+// os/exec, it keeps the last of any variables that env sets twice,
+// ignoring case.
+func envBlock(env []string) (*uint16, error) {
+	seen := map[string]bool{}
+	var keep []string
+	for i := len(env) - 1; i >= 0; i-- {
+		kv := env[i]
+		if strings.IndexByte(kv, 0) != -1 {
+			return nil, errors.New("environment variable contains NUL")
+		}
+		if kv == "" {
+			continue
+		}
+		// Skip the first byte, as variables like "=C:" start with "=".
+		k, _, _ := strings.Cut(kv[1:], "=")
+		k = strings.ToUpper(kv[:1] + k)
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		keep = append(keep, kv)
+	}
+	var b []uint16
+	for i := len(keep) - 1; i >= 0; i-- {
+		b = append(b, utf16.Encode([]rune(keep[i]))...)
+		b = append(b, 0)
+	}
+	if len(b) == 0 {
+		b = append(b, 0)
+	}
+	b = append(b, 0)
+	return &b[0], nil
+}
@@ -0,0 +1,116 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux || (darwin && !ios) || windows
+// +build linux darwin,!ios windows
+
+package tailssh
+
+// This file implements following HoldAndDelegate actions during
+// keyboard-interactive authentication, for actions that set
+// InteractiveAuth, so that the SSH client shows their messages and
+// asks their prompts.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"strings"
+
+	"tailscale.com/tailcfg"
+	"tailscale.com/tempfork/gliderlabs/ssh"
+	gossh "tailscale.com/tempfork/golang-x-crypto/ssh"
+)
+
+// interactiveAuthActionKey is the ssh.Context key of the terminal
+// SSHAction that keyboard-interactive authentication arrived at.
+var interactiveAuthActionKey = &struct{ name string }{"interactive-auth-action"}
+
+// usesInteractiveAuth reports whether a is to be followed during
+// keyboard-interactive authentication.
+func usesInteractiveAuth(a *tailcfg.SSHAction) bool {
+	return a.HoldAndDelegate != "" && a.InteractiveAuth
+}
+
+// requiresInteractiveAuth reports whether the policy's action for a
+// connection from remoteAddr as sshUser is to be followed during
+// keyboard-interactive authentication, so that neither "none" nor
+// public key authentication can be accepted.
+func (srv *server) requiresInteractiveAuth(sshUser string, localAddr, remoteAddr netip.AddrPort) bool {
+	a, _, _, err := srv.evaluatePolicy(sshUser, localAddr, remoteAddr, nil)
+	return err == nil && usesInteractiveAuth(a)
+}
+
+// handleKeyboardInteractive is the ssh.KeyboardInteractiveHandler. It
+// follows the delegated actions of policies that use InteractiveAuth
+// with the client, and accepts it if they end in Accept.
+func (srv *server) handleKeyboardInteractive(ctx ssh.Context, challenge gossh.KeyboardInteractiveChallenge) bool {
+	sshUser := ctx.User()
+	action, ci, localUser, err := srv.evaluatePolicy(sshUser, toAddrPort(ctx.LocalAddr()), toAddrPort(ctx.RemoteAddr()), nil)
+	if err != nil || !usesInteractiveAuth(action) {
+		return false
+	}
+	action, err = srv.resolveInteractiveAction(ctx, ci, localUser, action, challenge)
+	if err != nil {
+		srv.logf("keyboard-interactive auth for %v (%v): %v", ci.uprof.LoginName, ci.src.Addr(), err)
+		return false
+	}
+	if action.Reject || !action.Accept {
+		srv.noteRejection(ci.src, sshUser, "access denied by delegated action for "+ci.uprof.LoginName)
+		return false
+	}
+	accept := *action
+	accept.Message = "" // already shown
+	ctx.SetValue(interactiveAuthActionKey, &accept)
+	return true
+}
+
+// resolveInteractiveAction is like sshSession.resolveTerminalAction,
+// but shows messages and asks prompts with challenge.
+func (srv *server) resolveInteractiveAction(ctx ssh.Context, ci *sshConnInfo, localUser string, action *tailcfg.SSHAction, challenge gossh.KeyboardInteractiveChallenge) (*tailcfg.SSHAction, error) {
+	for {
+		var questions []string
+		if action.Prompt != "" {
+			questions = []string{action.Prompt}
+		}
+		var answers []string
+		if action.Message != "" || len(questions) > 0 {
+			var err error
+			answers, err = challenge("", action.Message, questions, make([]bool, len(questions)))
+			if err != nil {
+				return nil, err
+			}
+			if len(answers) != len(questions) {
+				return nil, errors.New("client answered the wrong number of questions")
+			}
+		}
+		if action.Accept || action.Reject {
+			return action, nil
+		}
+		u := action.HoldAndDelegate
+		if u == "" {
+			return nil, errors.New("reached Action that lacked Accept, Reject, and HoldAndDelegate")
+		}
+		var body []byte
+		if action.HoldAndDelegatePOST {
+			dr := srv.delegateRequest(ci, localUser)
+			if len(answers) > 0 {
+				dr.PromptResponse = answers[0]
+			}
+			body, _ = json.Marshal(dr)
+		}
+		if len(answers) > 0 {
+			u = strings.ReplaceAll(u, "$PROMPT_RESPONSE", url.QueryEscape(answers[0]))
+		}
+		u = srv.expandDelegateURL(ci, localUser, u)
+		var err error
+		action, err = srv.fetchSSHAction(ctx, u, body)
+		if err != nil {
+			// Not u, which may have the answer in it.
+			return nil, fmt.Errorf("fetching SSHAction: %w", err)
+		}
+	}
+}
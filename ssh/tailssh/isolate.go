@@ -0,0 +1,767 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux || (darwin && !ios)
+// +build linux darwin,!ios
+
+package tailssh
+
+// This file implements handling each SSH connection in a child process,
+// "tailscaled be-child ssh-conn", if TS_SSH_ISOLATE_CONNS is set.
+//
+// The child runs the SSH protocol and the sessions. It talks to
+// tailscaled over a second socket, with JSON requests, for the little it needs from it:
+// the SSH policy, WhoIs lookups, check and delegate fetches from
+// control, and host key signatures. So a bug in the SSH stack
+// doesn't expose tailscaled's memory: the node's keys, its control
+// connection and the SSH host private keys stay in tailscaled.
+//
+// The child has to start sessions as any user, so it stays root, but
+// on Linux it first gives up what a connection handler and its
+// sessions don't need (see isolate_linux.go): it drops the
+// capabilities outside connChildCaps, so it can't ptrace tailscaled,
+// and tailscaled's state directory is hidden from it. Sessions of
+// isolated connections, even root's, are limited the same way. Of
+// control, it may only fetch the HoldAndDelegate URLs of its policy
+// and of the actions it was sent. Peer agent forwarding isn't
+// supported for isolated connections, nor are jump sessions, and the
+// child's health problems aren't reported.
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"os/exec"
+	"os/signal"
+	"regexp"
+	"sync"
+	"syscall"
+
+	"inet.af/netaddr"
+	"tailscale.com/cmd/tailscaled/childproc"
+	"tailscale.com/envknob"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+	gossh "tailscale.com/tempfork/golang-x-crypto/ssh"
+	"tailscale.com/types/netmap"
+)
+
+var isolateConns = envknob.Bool("TS_SSH_ISOLATE_CONNS")
+
+// dropConnChildPrivileges, if non-nil, gives up the privileges that a
+// connection child process doesn't need, hiding varRoot, tailscaled's
+// state directory, from it. Unless the process has none to give up, it
+// doesn't return on success, but runs "tailscaled be-child ssh-conn"
+// again with args and --privileges-dropped.
+// See dropConnChildPrivilegesLinux.
+var dropConnChildPrivileges func(varRoot string, args []string) error
+
+func init() {
+	childproc.Add("ssh-conn", beSSHConn)
+}
+
+// maxNoiseResponseSize bounds the size of control responses relayed to
+// connection child processes.
+const maxNoiseResponseSize = 1 << 20
+
+// addrConn is a net.Conn with the given addresses.
+type addrConn struct {
+	net.Conn
+	local, remote net.Addr
+}
+
+func (c addrConn) LocalAddr() net.Addr  { return c.local }
+func (c addrConn) RemoteAddr() net.Addr { return c.remote }
+
+// socketPair returns the two ends of a new Unix socket pair, the first
+// as a net.Conn for this process and the second as a file to pass to
+// a child.
+func socketPair() (net.Conn, *os.File, error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	f := os.NewFile(uintptr(fds[0]), "socketpair")
+	defer f.Close()
+	c, err := net.FileConn(f)
+	if err != nil {
+		syscall.Close(fds[1])
+		return nil, nil, err
+	}
+	return c, os.NewFile(uintptr(fds[1]), "socketpair"), nil
+}
+
+// handleConnIsolated handles c in a new "tailscaled be-child ssh-conn"
+// process, until the process exits.
+func (srv *server) handleConnIsolated(c net.Conn) error {
+	exe := srv.connChildPath
+	if exe == "" {
+		exe = srv.tailscaledPath
+	}
+	if exe == "" {
+		return errors.New("no tailscaled binary to isolate SSH connection in")
+	}
+	sshConn, sshFile, err := socketPair()
+	if err != nil {
+		return err
+	}
+	defer sshConn.Close()
+	rpcConn, rpcFile, err := socketPair()
+	if err != nil {
+		sshFile.Close()
+		return err
+	}
+	defer rpcConn.Close()
+
+	cmd := exec.Command(exe, "be-child", "ssh-conn",
+		"--local="+c.LocalAddr().String(),
+		"--remote="+c.RemoteAddr().String(),
+		"--tailscaled="+srv.tailscaledPath,
+		"--var-root="+srv.lb.TailscaleVarRoot(),
+	)
+	cmd.ExtraFiles = []*os.File{sshFile, rpcFile} // fds 3 and 4
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		sshFile.Close()
+		rpcFile.Close()
+		return err
+	}
+	err = cmd.Start()
+	sshFile.Close()
+	rpcFile.Close()
+	if err != nil {
+		return err
+	}
+	untrack := srv.trackConnChild(cmd.Process)
+	defer untrack()
+
+	parent := &connParent{srv: srv, sessions: map[string]ipnstate.SSHEvent{}}
+	defer parent.endSessions()
+	go serveRPC(rpcConn, parent.handle)
+	go func() {
+		io.Copy(sshConn, c)
+		sshConn.(*net.UnixConn).CloseWrite()
+	}()
+	go func() {
+		io.Copy(c, sshConn)
+		c.Close()
+	}()
+	logf := srv.logf
+	bs := bufio.NewScanner(stderr)
+	for bs.Scan() {
+		logf("ssh-conn[%d]: %s", cmd.Process.Pid, bs.Bytes())
+	}
+	if err := cmd.Wait(); err != nil {
+		logf("ssh-conn[%d]: %v", cmd.Process.Pid, err)
+	}
+	c.Close()
+	return nil
+}
+
+// trackConnChild registers p as a connection child process, for Stop
+// and OnPolicyChange to signal. The returned func unregisters it.
+func (srv *server) trackConnChild(p *os.Process) (untrack func()) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	mapSet(&srv.connChildren, p, true)
+	return func() {
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		delete(srv.connChildren, p)
+	}
+}
+
+// signalConnChildrenLocked sends sig to the connection child
+// processes. srv.mu must be held.
+func (srv *server) signalConnChildrenLocked(sig os.Signal) {
+	for p := range srv.connChildren {
+		p.Signal(sig)
+	}
+}
+
+// rpcRequest is a call from a connection child process to its parent.
+type rpcRequest struct {
+	ID     uint64
+	Method string
+	Args   json.RawMessage `json:",omitempty"`
+}
+
+// rpcResponse is the reply to the rpcRequest with the same ID.
+type rpcResponse struct {
+	ID     uint64
+	Result json.RawMessage `json:",omitempty"`
+	Error  string          `json:",omitempty"`
+}
+
+// serveRPC answers the requests read from c with handle, each in a
+// goroutine of its own, until c fails.
+func serveRPC(c net.Conn, handle func(method string, args json.RawMessage) (any, error)) {
+	var mu sync.Mutex // guards enc
+	enc := json.NewEncoder(c)
+	dec := json.NewDecoder(c)
+	for {
+		var req rpcRequest
+		if err := dec.Decode(&req); err != nil {
+			return
+		}
+		go func() {
+			res := rpcResponse{ID: req.ID}
+			result, err := handle(req.Method, req.Args)
+			if err == nil {
+				res.Result, err = json.Marshal(result)
+			}
+			if err != nil {
+				res.Error = err.Error()
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			enc.Encode(res)
+		}()
+	}
+}
+
+// rpcClient makes calls to the connParent of a connection child
+// process.
+type rpcClient struct {
+	c net.Conn
+
+	mu      sync.Mutex
+	enc     *json.Encoder
+	nextID  uint64
+	pending map[uint64]chan rpcResponse
+	err     error // non-nil once c has failed
+}
+
+func newRPCClient(c net.Conn) *rpcClient {
+	rc := &rpcClient{
+		c:       c,
+		enc:     json.NewEncoder(c),
+		pending: map[uint64]chan rpcResponse{},
+	}
+	go rc.readLoop()
+	return rc
+}
+
+func (rc *rpcClient) readLoop() {
+	dec := json.NewDecoder(rc.c)
+	for {
+		var res rpcResponse
+		if err := dec.Decode(&res); err != nil {
+			rc.mu.Lock()
+			defer rc.mu.Unlock()
+			rc.err = fmt.Errorf("connection to tailscaled: %w", err)
+			for id, ch := range rc.pending {
+				delete(rc.pending, id)
+				close(ch)
+			}
+			return
+		}
+		rc.mu.Lock()
+		ch, ok := rc.pending[res.ID]
+		delete(rc.pending, res.ID)
+		rc.mu.Unlock()
+		if ok {
+			ch <- res
+		}
+	}
+}
+
+// call calls the parent's method with args and unmarshals its result
+// into reply, unless reply is nil. It returns early if ctx is done.
+func (rc *rpcClient) call(ctx context.Context, method string, args, reply any) error {
+	req := rpcRequest{Method: method}
+	if args != nil {
+		var err error
+		if req.Args, err = json.Marshal(args); err != nil {
+			return err
+		}
+	}
+	ch := make(chan rpcResponse, 1)
+	rc.mu.Lock()
+	if rc.err != nil {
+		rc.mu.Unlock()
+		return rc.err
+	}
+	rc.nextID++
+	req.ID = rc.nextID
+	rc.pending[req.ID] = ch
+	err := rc.enc.Encode(req)
+	rc.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	var res rpcResponse
+	var ok bool
+	select {
+	case res, ok = <-ch:
+	case <-ctx.Done():
+		rc.mu.Lock()
+		delete(rc.pending, req.ID)
+		rc.mu.Unlock()
+		return ctx.Err()
+	}
+	if !ok {
+		rc.mu.Lock()
+		defer rc.mu.Unlock()
+		return rc.err
+	}
+	if res.Error != "" {
+		return fmt.Errorf("%s: %s", method, res.Error)
+	}
+	if reply == nil {
+		return nil
+	}
+	return json.Unmarshal(res.Result, reply)
+}
+
+// connParent is the RPC service tailscaled gives a connection child
+// process.
+type connParent struct {
+	srv *server
+
+	// RPC calls are served concurrently, so mu guards the following.
+	mu sync.Mutex
+
+	// hostKeys are the host keys at the time of the child's first
+	// HostKeys call. SignHostKey refers to them by index.
+	hostKeys []gossh.Signer
+
+	// sessions are the child's sessions that have started and not
+	// yet ended, keyed by session ID.
+	sessions map[string]ipnstate.SSHEvent
+
+	// delegateURLs are the HoldAndDelegate URLs of the actions
+	// NoiseGet relayed to the child, which it may fetch next.
+	delegateURLs map[string]bool
+}
+
+// handle answers the child's call of method with args.
+func (p *connParent) handle(method string, args json.RawMessage) (any, error) {
+	switch method {
+	case "HostKeys":
+		return p.hostKeysRPC()
+	case "SignHostKey":
+		var a signHostKeyArgs
+		if err := json.Unmarshal(args, &a); err != nil {
+			return nil, err
+		}
+		return p.signHostKeyRPC(a)
+	case "NetMap":
+		return p.netMapRPC(), nil
+	case "WhoIs":
+		var ipp netaddr.IPPort
+		if err := json.Unmarshal(args, &ipp); err != nil {
+			return nil, err
+		}
+		return p.whoIsRPC(ipp), nil
+	case "NoiseGet":
+		var url string
+		if err := json.Unmarshal(args, &url); err != nil {
+			return nil, err
+		}
+		return p.noiseGetRPC(url)
+	case "VarRoot":
+		return p.srv.lb.TailscaleVarRoot(), nil
+	case "PublishEvent":
+		var ev ipnstate.SSHEvent
+		if err := json.Unmarshal(args, &ev); err != nil {
+			return nil, err
+		}
+		p.publishEventRPC(ev)
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unknown method %q", method)
+}
+
+// hostKeysReply is the reply to HostKeys.
+type hostKeysReply struct {
+	PublicKeys [][]byte // in SSH wire format
+}
+
+func (p *connParent) hostKeysRPC() (*hostKeysReply, error) {
+	keys, err := p.srv.lb.GetSSH_HostKeys()
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.hostKeys == nil {
+		p.hostKeys = keys
+	}
+	reply := new(hostKeysReply)
+	for _, k := range p.hostKeys {
+		reply.PublicKeys = append(reply.PublicKeys, k.PublicKey().Marshal())
+	}
+	return reply, nil
+}
+
+// signHostKeyArgs are the arguments of SignHostKey.
+type signHostKeyArgs struct {
+	Index     int
+	Data      []byte
+	Algorithm string // or empty for the key's default
+}
+
+func (p *connParent) signHostKeyRPC(args signHostKeyArgs) (*gossh.Signature, error) {
+	p.mu.Lock()
+	keys := p.hostKeys
+	p.mu.Unlock()
+	if args.Index < 0 || args.Index >= len(keys) {
+		return nil, fmt.Errorf("no host key %d", args.Index)
+	}
+	k := keys[args.Index]
+	if as, ok := k.(gossh.AlgorithmSigner); ok && args.Algorithm != "" {
+		return as.SignWithAlgorithm(rand.Reader, args.Data, args.Algorithm)
+	}
+	return k.Sign(rand.Reader, args.Data)
+}
+
+// netMapReply is the reply to NetMap: the part of the netmap that the
+// SSH server uses.
+type netMapReply struct {
+	OK                  bool   // whether there's a netmap
+	Name                string // the node's FQDN, for its MagicDNS suffix
+	SelfNode            *tailcfg.Node
+	SSHPolicy           *tailcfg.SSHPolicy
+	SSHHostCertificates []string
+}
+
+func (p *connParent) netMapRPC() *netMapReply {
+	reply := new(netMapReply)
+	nm := p.srv.lb.NetMap()
+	if nm == nil {
+		return reply
+	}
+	reply.OK = true
+	reply.Name = nm.Name
+	reply.SSHPolicy = nm.SSHPolicy
+	reply.SSHHostCertificates = nm.SSHHostCertificates
+	if nm.SelfNode != nil {
+		reply.SelfNode = &tailcfg.Node{ID: nm.SelfNode.ID}
+	}
+	return reply
+}
+
+// whoIsReply is the reply to WhoIs.
+type whoIsReply struct {
+	OK          bool
+	Node        *tailcfg.Node
+	UserProfile tailcfg.UserProfile
+}
+
+func (p *connParent) whoIsRPC(ipp netaddr.IPPort) *whoIsReply {
+	reply := new(whoIsReply)
+	reply.Node, reply.UserProfile, reply.OK = p.srv.lb.WhoIs(ipp)
+	return reply
+}
+
+// noiseGetReply is the reply to NoiseGet.
+type noiseGetReply struct {
+	StatusCode int
+	Status     string
+	Body       []byte
+}
+
+// noiseGetRPC does a GET request of url to control. The child only
+// needs to fetch check and delegate URLs, so it can't make other
+// requests: url has to be the HoldAndDelegate URL of an action in the
+// SSH policy, or of one that a previous NoiseGet returned.
+func (p *connParent) noiseGetRPC(url string) (*noiseGetReply, error) {
+	if !p.delegateURLAllowed(url) {
+		return nil, fmt.Errorf("%q isn't a HoldAndDelegate URL", url)
+	}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := p.srv.lb.DoNoiseRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	reply := &noiseGetReply{
+		StatusCode: res.StatusCode,
+		Status:     res.Status,
+	}
+	reply.Body, err = io.ReadAll(io.LimitReader(res.Body, maxNoiseResponseSize))
+	if err != nil {
+		return nil, err
+	}
+	var next tailcfg.SSHAction
+	if res.StatusCode == 200 && json.Unmarshal(reply.Body, &next) == nil && next.HoldAndDelegate != "" {
+		p.mu.Lock()
+		mapSet(&p.delegateURLs, next.HoldAndDelegate, true)
+		p.mu.Unlock()
+	}
+	return reply, nil
+}
+
+// delegateURLAllowed reports whether url is, once expanded, the
+// HoldAndDelegate URL of an action in the SSH policy or of one relayed
+// to the child.
+func (p *connParent) delegateURLAllowed(url string) bool {
+	var templates []string
+	if pol, ok := p.srv.sshPolicy(); ok {
+		for _, r := range pol.Rules {
+			if r != nil && r.Action != nil && r.Action.HoldAndDelegate != "" {
+				templates = append(templates, r.Action.HoldAndDelegate)
+			}
+		}
+	}
+	p.mu.Lock()
+	for t := range p.delegateURLs {
+		templates = append(templates, t)
+	}
+	p.mu.Unlock()
+	for _, t := range templates {
+		if delegateURLPattern(t).MatchString(url) {
+			return true
+		}
+	}
+	return false
+}
+
+// delegateURLVar matches a variable of a HoldAndDelegate URL, such as
+// $SRC_NODE_IP, after regexp.QuoteMeta.
+var delegateURLVar = regexp.MustCompile(`\\\$[A-Z_]+`)
+
+// delegateURLPattern returns a regexp matching the expansions of the
+// HoldAndDelegate URL template, by expandDelegateURL. Variables expand
+// to query-escaped values, which have none of /?#&.
+func delegateURLPattern(template string) *regexp.Regexp {
+	re := delegateURLVar.ReplaceAllLiteralString(regexp.QuoteMeta(template), `[^/?#&]*`)
+	return regexp.MustCompile("^" + re + "$")
+}
+
+// publishEventRPC publishes the child's ev as tailscaled's.
+func (p *connParent) publishEventRPC(ev ipnstate.SSHEvent) {
+	p.mu.Lock()
+	switch ev.Type {
+	case ipnstate.SSHEventSessionStart:
+		p.sessions[ev.SessionID] = ev
+		p.srv.setConnChildSession(ev.SessionID, &ev)
+	case ipnstate.SSHEventSessionEnd:
+		delete(p.sessions, ev.SessionID)
+		p.srv.setConnChildSession(ev.SessionID, nil)
+	}
+	p.mu.Unlock()
+	p.srv.publishEvent(ev)
+}
+
+// endSessions publishes the end of the sessions the child started but
+// didn't say had ended before it exited.
+func (p *connParent) endSessions() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for id, ev := range p.sessions {
+		ev.Type = ipnstate.SSHEventSessionEnd
+		ev.Time = p.srv.now()
+		p.srv.setConnChildSession(id, nil)
+		p.srv.publishEvent(ev)
+	}
+}
+
+// setConnChildSession records that the session with id, started per
+// ev, is running in a connection child process, or if ev is nil, that
+// it has ended.
+func (srv *server) setConnChildSession(id string, ev *ipnstate.SSHEvent) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if ev == nil {
+		delete(srv.connChildSessions, id)
+		return
+	}
+	mapSet(&srv.connChildSessions, id, *ev)
+}
+
+// rpcBackend is the ipnLocalBackend of a connection child process,
+// implemented by calls to tailscaled's connParent.
+type rpcBackend struct {
+	c *rpcClient
+}
+
+func (b *rpcBackend) GetSSH_HostKeys() ([]gossh.Signer, error) {
+	var reply hostKeysReply
+	if err := b.c.call(context.Background(), "HostKeys", nil, &reply); err != nil {
+		return nil, err
+	}
+	var keys []gossh.Signer
+	for i, wire := range reply.PublicKeys {
+		pub, err := gossh.ParsePublicKey(wire)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, &rpcSigner{c: b.c, index: i, pub: pub})
+	}
+	return keys, nil
+}
+
+func (b *rpcBackend) NetMap() *netmap.NetworkMap {
+	var reply netMapReply
+	if err := b.c.call(context.Background(), "NetMap", nil, &reply); err != nil {
+		log.Printf("NetMap: %v", err)
+		return nil
+	}
+	if !reply.OK {
+		return nil
+	}
+	return &netmap.NetworkMap{
+		Name:                reply.Name,
+		SelfNode:            reply.SelfNode,
+		SSHPolicy:           reply.SSHPolicy,
+		SSHHostCertificates: reply.SSHHostCertificates,
+	}
+}
+
+func (b *rpcBackend) WhoIs(ipp netaddr.IPPort) (*tailcfg.Node, tailcfg.UserProfile, bool) {
+	var reply whoIsReply
+	if err := b.c.call(context.Background(), "WhoIs", ipp, &reply); err != nil {
+		log.Printf("WhoIs: %v", err)
+		return nil, tailcfg.UserProfile{}, false
+	}
+	return reply.Node, reply.UserProfile, reply.OK
+}
+
+// DoNoiseRequest only supports GET requests. Cancelling req's context
+// returns early but doesn't cancel the request in tailscaled.
+func (b *rpcBackend) DoNoiseRequest(req *http.Request) (*http.Response, error) {
+	if req.Method != "GET" {
+		return nil, fmt.Errorf("%s requests unsupported", req.Method)
+	}
+	var reply noiseGetReply
+	if err := b.c.call(req.Context(), "NoiseGet", req.URL.String(), &reply); err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		StatusCode: reply.StatusCode,
+		Status:     reply.Status,
+		Body:       io.NopCloser(bytes.NewReader(reply.Body)),
+		Request:    req,
+	}, nil
+}
+
+func (b *rpcBackend) TailscaleVarRoot() string {
+	var reply string
+	if err := b.c.call(context.Background(), "VarRoot", nil, &reply); err != nil {
+		log.Printf("VarRoot: %v", err)
+	}
+	return reply
+}
+
+func (b *rpcBackend) DialPeerSSHAgent(ctx context.Context, peer netaddr.IP, sport, dport uint16) (io.ReadWriteCloser, error) {
+	return nil, errors.New("peer agent forwarding unsupported for isolated SSH connections")
+}
+
+func (b *rpcBackend) DialPeerTCP(ctx context.Context, ipp netaddr.IPPort) (net.Conn, error) {
+	return nil, errors.New("jump sessions unsupported for isolated SSH connections")
+}
+
+func (b *rpcBackend) publishEvent(ev ipnstate.SSHEvent) {
+	if err := b.c.call(context.Background(), "PublishEvent", ev, nil); err != nil {
+		log.Printf("PublishEvent: %v", err)
+	}
+}
+
+// rpcSigner is a host key whose private key is in tailscaled.
+type rpcSigner struct {
+	c     *rpcClient
+	index int
+	pub   gossh.PublicKey
+}
+
+func (s *rpcSigner) PublicKey() gossh.PublicKey { return s.pub }
+
+func (s *rpcSigner) Sign(rand io.Reader, data []byte) (*gossh.Signature, error) {
+	return s.SignWithAlgorithm(rand, data, "")
+}
+
+func (s *rpcSigner) SignWithAlgorithm(_ io.Reader, data []byte, algorithm string) (*gossh.Signature, error) {
+	sig := new(gossh.Signature)
+	args := signHostKeyArgs{Index: s.index, Data: data, Algorithm: algorithm}
+	if err := s.c.call(context.Background(), "SignHostKey", args, sig); err != nil {
+		return nil, err
+	}
+	return sig, nil
+}
+
+// beSSHConn is the entrypoint of "tailscaled be-child ssh-conn". It
+// gives up its privileges, then handles the SSH connection on fd 3,
+// using the RPC socket on fd 4 to reach tailscaled. SIGHUP makes it
+// re-check its sessions against the policy, and SIGTERM stops it.
+func beSSHConn(args []string) error {
+	fs := flag.NewFlagSet("ssh-conn", flag.ExitOnError)
+	local := fs.String("local", "", "local address of the connection")
+	remote := fs.String("remote", "", "remote address of the connection")
+	tailscaledPath := fs.String("tailscaled", "", "tailscaled binary to run sessions with, or empty to run them directly")
+	varRoot := fs.String("var-root", "", "tailscaled's state directory, to hide")
+	privilegesDropped := fs.Bool("privileges-dropped", false, "whether the process has given up its privileges")
+	fs.Parse(args)
+	if !*privilegesDropped && dropConnChildPrivileges != nil {
+		if err := dropConnChildPrivileges(*varRoot, args); err != nil {
+			return fmt.Errorf("dropping privileges: %w", err)
+		}
+	}
+	localAddr, err := netip.ParseAddrPort(*local)
+	if err != nil {
+		return err
+	}
+	remoteAddr, err := netip.ParseAddrPort(*remote)
+	if err != nil {
+		return err
+	}
+	log.SetFlags(0)
+
+	// net.FileConn dups the fds with close-on-exec set. Close the
+	// originals, so sessions don't inherit the RPC socket.
+	sshFile, rpcFile := os.NewFile(3, "ssh"), os.NewFile(4, "rpc")
+	sc, err := net.FileConn(sshFile)
+	sshFile.Close()
+	if err != nil {
+		return err
+	}
+	rc, err := net.FileConn(rpcFile)
+	rpcFile.Close()
+	if err != nil {
+		return err
+	}
+	lb := &rpcBackend{c: newRPCClient(rc)}
+	srv := &server{
+		lb:             lb,
+		logf:           log.Printf,
+		tailscaledPath: *tailscaledPath,
+		isConnChild:    true,
+		onEvent:        lb.publishEvent,
+	}
+	srv.Start()
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGHUP, syscall.SIGTERM)
+	go func() {
+		for sig := range sigc {
+			if sig == syscall.SIGHUP {
+				srv.OnPolicyChange()
+			} else {
+				srv.Stop()
+			}
+		}
+	}()
+
+	return srv.HandleSSHConn(addrConn{
+		Conn:   sc,
+		local:  net.TCPAddrFromAddrPort(localAddr),
+		remote: net.TCPAddrFromAddrPort(remoteAddr),
+	})
+}
@@ -0,0 +1,117 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tailssh
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+func init() {
+	dropConnChildPrivileges = dropConnChildPrivilegesLinux
+}
+
+// connChildCaps are the capabilities a connection child process keeps,
+// for itself and its sessions: those to start sessions as any user,
+// with PAM and logind, make ephemeral users and their homes, write
+// recordings, and signal sessions. Without the others, and
+// CAP_SYS_PTRACE in particular, it can't get at tailscaled's memory,
+// nor load kernel modules, change the network or remount filesystems.
+var connChildCaps = []uintptr{
+	unix.CAP_AUDIT_CONTROL,
+	unix.CAP_AUDIT_WRITE,
+	unix.CAP_CHOWN,
+	unix.CAP_DAC_OVERRIDE,
+	unix.CAP_DAC_READ_SEARCH,
+	unix.CAP_FOWNER,
+	unix.CAP_FSETID,
+	unix.CAP_KILL,
+	unix.CAP_NET_BIND_SERVICE,
+	unix.CAP_SETGID,
+	unix.CAP_SETUID,
+	unix.CAP_SYS_RESOURCE,
+}
+
+// dropConnChildPrivilegesLinux implements dropConnChildPrivileges.
+//
+// Capabilities and mount namespaces belong to threads, and Go can't
+// change them for all of a process's threads in cgo builds. So this
+// thread moves to a new mount namespace, hides varRoot there behind
+// an empty tmpfs, except for its ssh-sessions directory of recordings,
+// and drops the capabilities outside connChildCaps from its bounding
+// set. Then it execs, making the process just this thread, which
+// can't regain the capabilities, even as root.
+func dropConnChildPrivilegesLinux(varRoot string, args []string) error {
+	if os.Geteuid() != 0 {
+		return nil // nothing to give up
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	// On failure, the thread is left in whatever state it got to, so
+	// it's not unlocked, and exits with its goroutine.
+	runtime.LockOSThread()
+	if err := unix.Unshare(unix.CLONE_NEWNS); err != nil {
+		return fmt.Errorf("unshare: %w", err)
+	}
+	// Keep the mounts made here out of tailscaled's namespace.
+	if err := unix.Mount("", "/", "", unix.MS_REC|unix.MS_SLAVE, ""); err != nil {
+		return fmt.Errorf("making mounts slaves: %w", err)
+	}
+	if varRoot != "" {
+		if err := hideVarRoot(varRoot); err != nil {
+			return fmt.Errorf("hiding %s: %w", varRoot, err)
+		}
+	}
+	keep := map[uintptr]bool{}
+	for _, c := range connChildCaps {
+		keep[c] = true
+	}
+	for c := uintptr(0); ; c++ {
+		if _, err := unix.PrctlRetInt(unix.PR_CAPBSET_READ, c, 0, 0, 0); err != nil {
+			if errors.Is(err, unix.EINVAL) {
+				break // past the last capability
+			}
+			return err
+		}
+		if keep[c] {
+			continue
+		}
+		if err := unix.Prctl(unix.PR_CAPBSET_DROP, c, 0, 0, 0); err != nil {
+			return fmt.Errorf("dropping capability %d: %w", c, err)
+		}
+	}
+	argv := append([]string{exe, "be-child", "ssh-conn", "--privileges-dropped"}, args...)
+	return syscall.Exec(exe, argv, os.Environ())
+}
+
+// hideVarRoot mounts an empty tmpfs on varRoot, with its ssh-sessions
+// directory bind-mounted back, in the calling thread's mount namespace.
+func hideVarRoot(varRoot string) error {
+	recDir := filepath.Join(varRoot, "ssh-sessions")
+	if err := os.MkdirAll(recDir, 0700); err != nil {
+		return err
+	}
+	// Opened before it's covered, to bind-mount it back from the fd.
+	d, err := os.Open(recDir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	if err := unix.Mount("tmpfs", varRoot, "tmpfs", unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, "mode=0700"); err != nil {
+		return err
+	}
+	if err := os.Mkdir(recDir, 0700); err != nil {
+		return err
+	}
+	return unix.Mount(fmt.Sprintf("/proc/self/fd/%d", d.Fd()), recDir, "", unix.MS_BIND, "")
+}
@@ -0,0 +1,166 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux || darwin
+// +build linux darwin
+
+package tailssh
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"tailscale.com/cmd/tailscaled/childproc"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/logger"
+)
+
+// TestMain lets isolated connection tests use the test binary as
+// tailscaled, running their child processes.
+func TestMain(m *testing.M) {
+	if len(os.Args) > 2 && os.Args[1] == "be-child" {
+		if dir := os.Getenv("TS_TEST_LOGIN_SESSION_CGROUP"); dir != "" {
+			// Move into dir when starting a login session, as
+			// logind moves processes into the session's scope.
+			maybeStartLoginSession = func(logger.Logf, uint32, string, string, string, string) (func() error, error) {
+				return nil, joinCgroup(dir, os.Getpid())
+			}
+		}
+		if err := childproc.Code[os.Args[2]](os.Args[3:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func TestIsolatedConn(t *testing.T) {
+	defer func(v bool) { isolateConns = v }(isolateConns)
+	isolateConns = true
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := newSSHHarness(t, nil)
+	h.srv.connChildPath = exe
+	h.lb.setPolicy(&tailcfg.SSHPolicy{Rules: []*tailcfg.SSHRule{
+		h.acceptRule(&tailcfg.SSHAction{Accept: true}),
+	}})
+	events := make(chan ipnstate.SSHEvent, 20)
+	defer h.srv.SubscribeEvents(false, func(ev ipnstate.SSHEvent) { events <- ev })()
+
+	c := h.mustDial()
+	out, _, err := run(t, c, "echo $PPID")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out == fmt.Sprintf("%d\n", os.Getpid()) {
+		t.Errorf("session is a child of the test process; want of a connection child")
+	}
+
+	var start ipnstate.SSHEvent
+	timeout := time.After(10 * time.Second)
+	for start.Type != ipnstate.SSHEventSessionStart {
+		select {
+		case start = <-events:
+		case <-timeout:
+			t.Fatal("no session-start event from the child")
+		}
+	}
+	if start.LoginName != "alice@example.com" || start.LocalUser != h.localUser.Username {
+		t.Errorf("start event = %+v", start)
+	}
+
+	if runtime.GOOS == "linux" && os.Geteuid() == 0 {
+		// The child can't read tailscaled's state, nor ptrace it.
+		state := filepath.Join(h.lb.varRoot, "tailscaled.state")
+		if err := os.WriteFile(state, []byte("secret"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if out, _, err := run(t, c, "cat "+state); err == nil || strings.Contains(out, "secret") {
+			t.Errorf("session read tailscaled's state: %q, %v", out, err)
+		}
+		out, _, err := run(t, c, "grep CapBnd /proc/self/status")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var bnd uint64
+		if _, err := fmt.Sscanf(out, "CapBnd: %x", &bnd); err != nil {
+			t.Fatalf("parsing %q: %v", out, err)
+		}
+		const capSysPtrace = 19
+		if bnd&(1<<capSysPtrace) != 0 {
+			t.Errorf("session's bounding set %x has CAP_SYS_PTRACE", bnd)
+		}
+	}
+
+	// Stopping the server ends the child's sessions.
+	s, err := c.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	stdout, err := s.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stderr bytes.Buffer
+	s.Stderr = &stderr
+	if err := s.Start("echo started; exec sleep 30"); err != nil {
+		t.Fatal(err)
+	}
+	if line, err := bufio.NewReader(stdout).ReadString('\n'); err != nil || line != "started\n" {
+		t.Fatalf("session output = %q, %v", line, err)
+	}
+	if n := len(h.srv.Status().Sessions); n != 1 {
+		t.Errorf("Status has %d sessions; want 1", n)
+	}
+	h.srv.Stop()
+	waitErr := make(chan error, 1)
+	go func() { waitErr <- s.Wait() }()
+	select {
+	case <-waitErr:
+	case <-time.After(10 * time.Second):
+		t.Fatal("session still running after Stop")
+	}
+	if !strings.Contains(stderr.String(), "Tailscale SSH was turned off") {
+		t.Errorf("stderr = %q; want the reason", stderr.String())
+	}
+}
+
+func TestConnParentDelegateURLs(t *testing.T) {
+	h := newSSHHarness(t, nil)
+	h.lb.setPolicy(&tailcfg.SSHPolicy{Rules: []*tailcfg.SSHRule{
+		h.acceptRule(&tailcfg.SSHAction{HoldAndDelegate: "https://unused/ssh-action/$SRC_NODE_ID/$SRC_NODE_IP"}),
+	}})
+	p := &connParent{srv: h.srv, sessions: map[string]ipnstate.SSHEvent{}}
+	for _, tt := range []struct {
+		url  string
+		want bool
+	}{
+		{"https://unused/ssh-action/1/100.64.0.1", true},
+		{"https://unused/ssh-action/1/fd7a%3A115c%3Aa1e0%3A%3A1", true},
+		{"https://unused/ssh-action/1/100.64.0.1/more", false},
+		{"https://unused/ssh-action/1/100.64.0.1?x=y", false},
+		{"https://unused/machine/register", false},
+		{"https://other/ssh-action/1/100.64.0.1", false},
+	} {
+		if got := p.delegateURLAllowed(tt.url); got != tt.want {
+			t.Errorf("delegateURLAllowed(%q) = %v; want %v", tt.url, got, tt.want)
+		}
+	}
+	if _, err := p.noiseGetRPC("https://unused/machine/register"); err == nil {
+		t.Error("NoiseGet of a non-delegate URL succeeded")
+	}
+}
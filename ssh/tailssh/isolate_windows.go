@@ -0,0 +1,21 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tailssh
+
+import (
+	"errors"
+	"net"
+	"os"
+)
+
+// isolateConns is always false on Windows, where a connection's socket
+// can't be handed to a child process as one of its files.
+const isolateConns = false
+
+func (srv *server) handleConnIsolated(c net.Conn) error {
+	return errors.New("isolating SSH connections isn't supported on Windows")
+}
+
+func (srv *server) signalConnChildrenLocked(sig os.Signal) {}
@@ -0,0 +1,258 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux || (darwin && !ios) || windows
+// +build linux darwin,!ios windows
+
+package tailssh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"tailscale.com/tempfork/gliderlabs/ssh"
+	gossh "tailscale.com/tempfork/golang-x-crypto/ssh"
+	"tailscale.com/types/netmap"
+	"tailscale.com/util/netconv"
+)
+
+// jumpDialTimeout bounds how long connecting to a jump target may take.
+const jumpDialTimeout = 30 * time.Second
+
+// resolveJumpTarget returns the address of the SSH server named by
+// target, an SSHAction.JumpTo value, which must be a peer in nm.
+func resolveJumpTarget(nm *netmap.NetworkMap, target string) (netip.AddrPort, error) {
+	host, port := target, uint16(22)
+	if h, p, err := net.SplitHostPort(target); err == nil {
+		port64, err := strconv.ParseUint(p, 10, 16)
+		if err != nil {
+			return netip.AddrPort{}, fmt.Errorf("bad port in jump target %q", target)
+		}
+		host, port = h, uint16(port64)
+	}
+	if nm == nil {
+		return netip.AddrPort{}, errors.New("no netmap")
+	}
+	ip, ipErr := netip.ParseAddr(host)
+	host = strings.TrimSuffix(host, ".")
+	for _, p := range nm.Peers {
+		if ipErr == nil {
+			for _, a := range p.Addresses {
+				pfx := netconv.AsPrefix(a)
+				if pfx.IsSingleIP() && pfx.Addr() == ip {
+					return netip.AddrPortFrom(ip, port), nil
+				}
+			}
+			continue
+		}
+		name := strings.TrimSuffix(p.Name, ".")
+		first, _, _ := strings.Cut(name, ".")
+		if !strings.EqualFold(host, name) && !strings.EqualFold(host, first) {
+			continue
+		}
+		// Prefer IPv4, which every node has.
+		var addr netip.Addr
+		for _, a := range p.Addresses {
+			pfx := netconv.AsPrefix(a)
+			if !pfx.IsSingleIP() {
+				continue
+			}
+			if !addr.IsValid() || (pfx.Addr().Is4() && !addr.Is4()) {
+				addr = pfx.Addr()
+			}
+		}
+		if addr.IsValid() {
+			return netip.AddrPortFrom(addr, port), nil
+		}
+	}
+	return netip.AddrPort{}, fmt.Errorf("jump target %q isn't in the tailnet", target)
+}
+
+// runJump runs ss on the SSH server of the node its action jumps to,
+// as ss.localUser, and proxies it there.
+func (ss *sshSession) runJump() {
+	target := ss.action.JumpTo
+	dst, err := resolveJumpTarget(ss.srv.lb.NetMap(), target)
+	if err != nil {
+		ss.logf("jump: %v", err)
+		fmt.Fprintf(ss.Stderr(), "Can't connect to %s.\r\n", target)
+		ss.Exit(1)
+		return
+	}
+	client, err := ss.dialJumpTarget(dst)
+	if err != nil {
+		ss.logf("jump to %v: %v", dst, err)
+		fmt.Fprintf(ss.Stderr(), "Can't connect to %s.\r\n", target)
+		ss.Exit(1)
+		return
+	}
+	defer client.Close()
+	ss.logf("jumping to %v as %q", dst, ss.localUser.Username)
+
+	// The target does the pty handling.
+	ss.DisablePTYEmulation()
+
+	rec, ok := ss.maybeStartRecording() // rec is nil if disabled
+	if !ok {
+		return
+	}
+	if rec != nil {
+		defer rec.Close()
+	}
+
+	rs, err := client.NewSession()
+	if err != nil {
+		ss.logf("jump: NewSession: %v", err)
+		ss.Exit(1)
+		return
+	}
+	defer rs.Close()
+	for _, kv := range ss.clientEnv() {
+		// Servers usually refuse most variables; that's fine.
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			rs.Setenv(k, v)
+		}
+	}
+	ptyReq, winCh, isPty := ss.Pty()
+	if isPty {
+		if err := rs.RequestPty(ptyReq.Term, ptyReq.Window.Height, ptyReq.Window.Width, ptyReq.Modes); err != nil {
+			ss.logf("jump: RequestPty: %v", err)
+			ss.Exit(1)
+			return
+		}
+		go func() {
+			for w := range winCh {
+				rs.WindowChange(w.Height, w.Width)
+			}
+		}()
+	}
+
+	stdin, err := rs.StdinPipe()
+	if err != nil {
+		ss.logf("jump: StdinPipe: %v", err)
+		ss.Exit(1)
+		return
+	}
+	stdout, err := rs.StdoutPipe()
+	if err != nil {
+		ss.logf("jump: StdoutPipe: %v", err)
+		ss.Exit(1)
+		return
+	}
+	stderr, err := rs.StderrPipe()
+	if err != nil {
+		ss.logf("jump: StderrPipe: %v", err)
+		ss.Exit(1)
+		return
+	}
+	switch {
+	case ss.subsystem() != "":
+		err = rs.RequestSubsystem(ss.subsystem())
+	case ss.command() != "":
+		err = rs.Start(ss.command())
+	default:
+		err = rs.Shell()
+	}
+	if err != nil {
+		ss.logf("jump: starting remote session: %v", err)
+		ss.Exit(1)
+		return
+	}
+	ss.srv.publishEvent(ss.execEvent())
+
+	go func() {
+		<-ss.ctx.Done()
+		if ss.ctx.Err() == errSessionDone {
+			return
+		}
+		if serr, ok := ss.ctx.Err().(SSHTerminationError); ok {
+			if msg := serr.SSHTerminationMessage(); msg != "" {
+				io.WriteString(ss.Stderr(), "\r\n\r\n"+msg+"\r\n\r\n")
+			}
+		}
+		ss.logf("terminating SSH session from %v: %v", ss.connInfo.src.Addr(), ss.ctx.Err())
+		client.Close()
+	}()
+	go func() {
+		_, err := io.Copy(rec.writer("i", stdin), ss)
+		if err != nil {
+			ss.logf("ssh: stdin copy: %v", err)
+		}
+		stdin.Close()
+	}()
+	var outputDone sync.WaitGroup
+	outputDone.Add(2)
+	go func() {
+		defer outputDone.Done()
+		if _, err := io.Copy(rec.writer("o", ss), stdout); err != nil {
+			ss.logf("ssh: stdout copy: %v", err)
+		}
+	}()
+	go func() {
+		defer outputDone.Done()
+		if _, err := io.Copy(rec.writer("o", ss.Stderr()), stderr); err != nil {
+			ss.logf("ssh: stderr copy: %v", err)
+		}
+	}()
+	outputDone.Wait()
+
+	if ss.subsystem() != "" {
+		// gossh doesn't report subsystems' exit statuses, and their
+		// clients don't look at them anyway.
+		ss.Exit(0)
+		return
+	}
+	err = rs.Wait()
+	var ee *gossh.ExitError
+	switch {
+	case err == nil:
+		ss.logf("jump: Wait: ok")
+		ss.Exit(0)
+	case errors.As(err, &ee) && ee.Signal() != "":
+		// gossh doesn't say whether the target's process dumped core.
+		ss.logf("jump: Wait: signal=%v", ee.Signal())
+		ss.ExitSignal(ssh.Signal(ee.Signal()), false, ee.Msg())
+	case errors.As(err, &ee):
+		ss.logf("jump: Wait: code=%v", ee.ExitStatus())
+		ss.Exit(ee.ExitStatus())
+	default:
+		ss.logf("jump: Wait: %v", err)
+		ss.Exit(1)
+	}
+}
+
+// dialJumpTarget connects to the SSH server at dst as ss.localUser.
+func (ss *sshSession) dialJumpTarget(dst netip.AddrPort) (*gossh.Client, error) {
+	ctx, cancel := context.WithTimeout(ss.ctx, jumpDialTimeout)
+	defer cancel()
+	c, err := ss.srv.lb.DialPeerTCP(ctx, netconv.AsIPPort(dst))
+	if err != nil {
+		return nil, err
+	}
+	c.SetDeadline(time.Now().Add(jumpDialTimeout)) // for the handshake
+	cc, chans, reqs, err := gossh.NewClientConn(c, dst.String(), &gossh.ClientConfig{
+		User: ss.localUser.Username,
+		// No auth methods means only "none", which Tailscale SSH
+		// servers accept based on the connection's Tailscale
+		// identity, which is this node's.
+		Auth: nil,
+		// The connection is over WireGuard to a node whose key
+		// control vouches for, so it's already authenticated.
+		HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	c.SetDeadline(time.Time{})
+	return gossh.NewClient(cc, chans, reqs), nil
+}
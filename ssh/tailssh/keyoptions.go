@@ -0,0 +1,198 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux || (darwin && !ios) || windows
+// +build linux darwin,!ios windows
+
+package tailssh
+
+// This file implements the options of authorized_keys lines, as in
+// sshd(8)'s AUTHORIZED_KEYS FILE FORMAT, for keys that principals
+// accept, whether from the policy, URLs or authorized_keys files.
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"tailscale.com/tailcfg"
+	"tailscale.com/tempfork/gliderlabs/ssh"
+	gossh "tailscale.com/tempfork/golang-x-crypto/ssh"
+)
+
+// keyOptions are the restrictions that an authorized key's options put
+// on the sessions it's used for, on top of their SSHAction's.
+type keyOptions struct {
+	command           string // if non-empty, run instead of what was asked for
+	noPortForwarding  bool
+	noAgentForwarding bool
+	noPty             bool
+
+	// For security keys (sk- key types), as sshd checks them: whether
+	// signatures need not show that the user touched the key, and
+	// whether they must show that the key verified the user, as by
+	// PIN.
+	noTouchRequired bool
+	verifyRequired  bool
+}
+
+// matchAuthorizedKey reports whether line, an authorized_keys line, is
+// for pubKey, returning the restrictions of its options, if it has any.
+// Lines whose options are unsupported or say the key has expired as of
+// now don't match.
+func matchAuthorizedKey(pubKey ssh.PublicKey, line string, now time.Time) (_ *keyOptions, ok bool) {
+	if pubKeyMatchesAuthorizedKey(pubKey, line) {
+		return nil, true
+	}
+	k, _, opts, _, err := gossh.ParseAuthorizedKey([]byte(line))
+	if err != nil || len(opts) == 0 || !bytes.Equal(k.Marshal(), pubKey.Marshal()) {
+		return nil, false
+	}
+	ko, err := parseKeyOptions(opts, now)
+	if err != nil {
+		return nil, false
+	}
+	return ko, true
+}
+
+// parseKeyOptions returns the restrictions of opts, the options of an
+// authorized key, as of now. Options that would restrict the key in
+// ways that aren't supported, like from=, are errors, so that keys
+// using them are refused rather than less restricted than intended.
+func parseKeyOptions(opts []string, now time.Time) (*keyOptions, error) {
+	ko := new(keyOptions)
+	for _, opt := range opts {
+		name, val, hasVal := strings.Cut(opt, "=")
+		if hasVal {
+			if len(val) < 2 || val[0] != '"' || val[len(val)-1] != '"' {
+				return nil, fmt.Errorf("option %q: value not quoted", name)
+			}
+			val = strings.ReplaceAll(val[1:len(val)-1], `\"`, `"`)
+		}
+		switch strings.ToLower(name) {
+		case "command":
+			ko.command = val
+		case "expiry-time":
+			exp, err := parseKeyExpiry(val)
+			if err != nil {
+				return nil, err
+			}
+			if !now.Before(exp) {
+				return nil, fmt.Errorf("key expired at %v", exp)
+			}
+		case "no-port-forwarding":
+			ko.noPortForwarding = true
+		case "no-agent-forwarding":
+			ko.noAgentForwarding = true
+		case "no-pty":
+			ko.noPty = true
+		case "restrict":
+			ko.noPortForwarding = true
+			ko.noAgentForwarding = true
+			ko.noPty = true
+		case "port-forwarding":
+			ko.noPortForwarding = false
+		case "agent-forwarding":
+			ko.noAgentForwarding = false
+		case "pty":
+			ko.noPty = false
+		case "no-x11-forwarding", "x11-forwarding", "no-user-rc", "user-rc":
+			// Tailscale SSH does neither.
+		case "no-touch-required":
+			ko.noTouchRequired = true
+		case "verify-required":
+			ko.verifyRequired = true
+		default:
+			return nil, fmt.Errorf("unsupported option %q", name)
+		}
+	}
+	return ko, nil
+}
+
+// parseKeyExpiry parses an expiry-time option's value: a date and
+// optional time, as YYYYMMDD[HHMM[SS]], in the local time zone, or in
+// UTC if followed by "Z".
+func parseKeyExpiry(v string) (time.Time, error) {
+	loc := time.Local
+	if strings.HasSuffix(v, "Z") {
+		v, loc = v[:len(v)-1], time.UTC
+	}
+	var layout string
+	switch len(v) {
+	case len("20060102"):
+		layout = "20060102"
+	case len("200601021504"):
+		layout = "200601021504"
+	case len("20060102150405"):
+		layout = "20060102150405"
+	default:
+		return time.Time{}, fmt.Errorf("invalid expiry-time %q", v)
+	}
+	return time.ParseInLocation(layout, v, loc)
+}
+
+// Flags of security key signatures, from openssh/PROTOCOL.u2f.
+const (
+	skFlagUserPresent  = 0x01
+	skFlagUserVerified = 0x04
+)
+
+// isSecurityKey reports whether key is a security key, or a
+// certificate of one.
+func isSecurityKey(key gossh.PublicKey) bool {
+	if cert, ok := key.(*gossh.Certificate); ok {
+		key = cert.Key
+	}
+	switch key.Type() {
+	case gossh.KeyAlgoSKED25519, gossh.KeyAlgoSKECDSA256:
+		return true
+	}
+	return false
+}
+
+// checkSecurityKeySignature checks the flags of sig, a verified
+// signature by a security key accepted with the options ko, as sshd
+// does: the user must have touched the key, unless no-touch-required,
+// and have been verified by it if verify-required. A nil ko has no
+// options.
+func (ko *keyOptions) checkSecurityKeySignature(sig *gossh.Signature) error {
+	if len(sig.Rest) < 1 {
+		return errors.New("security key signature without flags")
+	}
+	flags := sig.Rest[0]
+	if (ko == nil || !ko.noTouchRequired) && flags&skFlagUserPresent == 0 {
+		return errors.New("security key signature without user presence")
+	}
+	if ko != nil && ko.verifyRequired && flags&skFlagUserVerified == 0 {
+		return errors.New("security key signature without user verification")
+	}
+	return nil
+}
+
+// apply returns a with ko's restrictions applied. A nil ko has none.
+//
+// A command= option doesn't replace a's ForceCommand, if any: as in
+// OpenSSH, where sshd_config's ForceCommand wins over authorized_keys,
+// the policy's command is kept, so users can't get around it with
+// their own keys.
+func (ko *keyOptions) apply(a *tailcfg.SSHAction) *tailcfg.SSHAction {
+	if ko == nil || !a.Accept {
+		return a
+	}
+	a2 := *a
+	if ko.command != "" && a2.ForceCommand == "" {
+		a2.ForceCommand = ko.command
+	}
+	if ko.noPortForwarding {
+		a2.AllowLocalPortForwarding = false
+		a2.AllowDynamicPortForwarding = false
+		a2.AllowStreamLocalForwarding = false
+	}
+	if ko.noAgentForwarding {
+		a2.AllowAgentForwarding = false
+	}
+	return &a2
+}
@@ -0,0 +1,289 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux || (darwin && !ios) || windows
+// +build linux darwin,!ios windows
+
+package tailssh
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"time"
+
+	"tailscale.com/envknob"
+)
+
+// stopGracePeriod is how long Stop gives the sessions it ends to tell
+// their users why before it closes their connections.
+const stopGracePeriod = 2 * time.Second
+
+var (
+	// drainPeriodEnv, if non-empty, is how long (as a Go duration)
+	// Stop lets active sessions carry on after warning their users,
+	// rather than ending them right away. See drainPeriod.
+	drainPeriodEnv = envknob.String("TS_SSH_DRAIN_PERIOD")
+
+	// drainMessage, if non-empty, is added to the warning that Stop
+	// gives active sessions when draining.
+	drainMessage = envknob.String("TS_SSH_DRAIN_MESSAGE")
+
+	// maxConns, if positive, is the most connections the server
+	// handles at once, counting those still authenticating, so that
+	// a flood of them can't run a small device out of memory.
+	maxConns, _ = envknob.LookupInt("TS_SSH_MAX_CONNS")
+)
+
+// connSlotWait is how long a connection waits for one of the maxConns
+// others to end before it's refused. It's a var for tests.
+var connSlotWait = 5 * time.Second
+
+var errTooManyConns = errors.New("too many SSH connections")
+
+var errServerStopped = errors.New("SSH server is stopped")
+
+var errSessionTerminated = errors.New("session was terminated")
+
+// Start implements ipnlocal.SSHServer. The server refuses connections
+// until it's started.
+func (srv *server) Start() {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.running {
+		return
+	}
+	srv.running = true
+	srv.watchDebugPolicyFileLocked()
+	if !srv.isConnChild {
+		go srv.removeStaleEphemeralUsers()
+	}
+	if srv.drainTimer != nil {
+		srv.logf("ssh: server started while draining; keeping the active sessions")
+		srv.drainTimer.Stop()
+		srv.drainTimer = nil
+	} else {
+		srv.logf("ssh: server started")
+	}
+	srv.finishDrainLocked()
+}
+
+// isRunning reports whether the server is between Start and Stop.
+func (srv *server) isRunning() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.running
+}
+
+// Stop implements ipnlocal.SSHServer. It refuses new connections, ends
+// the active sessions, and closes the active connections, including
+// those without sessions, such as ones only forwarding ports.
+//
+// If there's a drain period, Stop instead warns the active sessions'
+// users and leaves them be until it's over, or until they've all
+// gone. See Wait. Either way, Stop doesn't block.
+func (srv *server) Stop() {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if !srv.running {
+		return
+	}
+	srv.running = false
+	srv.stopDebugPolicyWatchLocked()
+	period := srv.drainPeriod()
+	if period <= 0 || len(srv.activeConns) == 0 {
+		srv.logf("ssh: server stopped; closing %d connections", len(srv.activeConns))
+		srv.closeConnsLocked()
+		return
+	}
+	srv.logf("ssh: server stopped; draining %d connections for %v", len(srv.activeConns), period)
+	msg := fmt.Sprintf("\r\nTailscale SSH is shutting down on this machine; this session will end in %v.\r\n", period)
+	if drainMessage != "" {
+		msg += drainMessage + "\r\n"
+	}
+	for _, ss := range srv.activeSessionByH {
+		// Not with srv.mu held, as the write can block on the
+		// client.
+		go io.WriteString(ss.Stderr(), msg)
+	}
+	// Isolated connection processes drain their own sessions, as
+	// they have the same environment.
+	srv.signalConnChildrenLocked(syscall.SIGTERM)
+	srv.drained = make(chan struct{})
+	var t *time.Timer
+	t = time.AfterFunc(period, func() {
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		if srv.drainTimer != t {
+			return
+		}
+		srv.drainTimer = nil
+		srv.logf("ssh: drain period over; closing %d connections", len(srv.activeConns))
+		srv.closeConnsLocked()
+	})
+	srv.drainTimer = t
+}
+
+// closeConnsLocked ends the active sessions, telling their users why,
+// and closes the active connections after stopGracePeriod.
+// srv.mu must be held.
+func (srv *server) closeConnsLocked() {
+	for _, ss := range srv.activeSessionByH {
+		ss.ctx.CloseWithError(userVisibleError{
+			"Tailscale SSH was turned off on this machine.\n",
+			errServerStopped,
+		})
+	}
+	srv.signalConnChildrenLocked(syscall.SIGTERM)
+	if len(srv.activeConns) == 0 {
+		return
+	}
+	conns := make([]net.Conn, 0, len(srv.activeConns))
+	for c := range srv.activeConns {
+		conns = append(conns, c)
+	}
+	time.AfterFunc(stopGracePeriod, func() {
+		for _, c := range conns {
+			c.Close()
+		}
+	})
+}
+
+// Wait implements ipnlocal.SSHServer. If Stop is draining the active
+// connections, it waits until they're closed, for no longer than the
+// drain period and the time Stop gives sessions to say why they're
+// ending.
+func (srv *server) Wait() {
+	srv.mu.Lock()
+	drained := srv.drained
+	srv.mu.Unlock()
+	if drained == nil {
+		return
+	}
+	t := time.NewTimer(srv.drainPeriod() + 2*stopGracePeriod)
+	defer t.Stop()
+	select {
+	case <-drained:
+	case <-t.C:
+	}
+}
+
+// finishDrainLocked marks the end of draining the connections, if Stop
+// was. srv.mu must be held.
+func (srv *server) finishDrainLocked() {
+	if srv.drained == nil {
+		return
+	}
+	close(srv.drained)
+	srv.drained = nil
+}
+
+// drainPeriod returns how long Stop lets active sessions carry on,
+// or 0 if it ends them right away.
+func (srv *server) drainPeriod() time.Duration {
+	if drainPeriodEnv == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(drainPeriodEnv)
+	if err != nil || d < 0 {
+		srv.logf("ssh: ignoring invalid TS_SSH_DRAIN_PERIOD %q", drainPeriodEnv)
+		return 0
+	}
+	return d
+}
+
+// TerminateSession implements ipnlocal.SSHServer. It ends the active
+// session whose shared ID is id, telling its user msg, or a generic
+// message if msg is empty, without affecting the connection's other
+// sessions.
+func (srv *server) TerminateSession(id, msg string) error {
+	srv.mu.Lock()
+	ss, ok := srv.activeSessionBySharedID[id]
+	_, isolated := srv.connChildSessions[id]
+	srv.mu.Unlock()
+	if isolated {
+		return fmt.Errorf("session %s is in an isolated connection process, which can't be told to end it", id)
+	}
+	if !ok {
+		return fmt.Errorf("no active session %s", id)
+	}
+	if msg == "" {
+		msg = "This session was terminated by an administrator."
+	}
+	ss.logf("terminating session: %s", msg)
+	ss.ctx.CloseWithError(userVisibleError{msg + "\n", errSessionTerminated})
+	return nil
+}
+
+// acquireConnSlot waits, for no longer than connSlotWait, until there
+// are fewer than maxConns connections being handled, and then counts
+// one more until release is called.
+func (srv *server) acquireConnSlot() (release func(), ok bool) {
+	if maxConns <= 0 || srv.isConnChild {
+		return func() {}, true
+	}
+	srv.mu.Lock()
+	if srv.connSlots == nil {
+		srv.connSlots = make(chan struct{}, maxConns)
+	}
+	slots := srv.connSlots
+	srv.mu.Unlock()
+	release = func() { <-slots }
+	select {
+	case slots <- struct{}{}:
+		return release, true
+	default:
+	}
+	t := time.NewTimer(connSlotWait)
+	defer t.Stop()
+	select {
+	case slots <- struct{}{}:
+		return release, true
+	case <-t.C:
+		return nil, false
+	}
+}
+
+// refuseConn closes c, which there's no slot for, telling the client
+// why. As the SSH handshake hasn't started, the message goes before the
+// version exchange (RFC 4253, section 4.2), where OpenSSH's client
+// shows it when run with -v.
+func (srv *server) refuseConn(c net.Conn) {
+	src := toAddrPort(c.RemoteAddr())
+	srv.logf("ssh: refusing connection from %v: already handling %d connections", src, maxConns)
+	srv.noteRejection(src, "", errTooManyConns.Error())
+	c.SetWriteDeadline(time.Now().Add(time.Second))
+	io.WriteString(c, "Tailscale SSH: too many connections to this machine; try again later.\r\n")
+	c.Close()
+}
+
+// trackConn registers c as an active connection, unless the server is
+// stopped. The returned func unregisters it.
+func (srv *server) trackConn(c net.Conn) (untrack func(), err error) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if !srv.running {
+		return nil, errServerStopped
+	}
+	// mapSet can't be used, as interfaces aren't comparable type
+	// arguments until Go 1.20.
+	if srv.activeConns == nil {
+		srv.activeConns = make(map[net.Conn]bool)
+	}
+	srv.activeConns[c] = true
+	return func() {
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		delete(srv.activeConns, c)
+		if len(srv.activeConns) == 0 && !srv.running {
+			if srv.drainTimer != nil {
+				srv.drainTimer.Stop()
+				srv.drainTimer = nil
+			}
+			srv.finishDrainLocked()
+		}
+	}, nil
+}
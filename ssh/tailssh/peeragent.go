@@ -0,0 +1,175 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux || (darwin && !ios) || windows
+// +build linux darwin,!ios windows
+
+package tailssh
+
+// This file implements agent forwarding across Tailscale SSH nodes.
+//
+// Say a user's workstation W forwards its agent to a session on node
+// A, and that session opens an SSH connection to node B, without
+// forwarding the agent itself. If both nodes' policies set
+// AllowPeerAgentForwarding, B gives the new session an agent socket
+// whose connections B proxies to A's peerapi, and A then connects them
+// to the agent forwarded to its session. A only does so after checking
+// that B runs Tailscale SSH, and that the TCP connection B names goes
+// to B's SSH port and was made by a process of that session.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os/user"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/tempfork/gliderlabs/ssh"
+	"tailscale.com/util/netconv"
+)
+
+// tailscaleSSHPort is the port that peers serve Tailscale SSH on, the
+// only one whose connections OpenPeerAgent gives agents to. It's a
+// variable for tests.
+var tailscaleSSHPort uint16 = 22
+
+// sharedAgent is the agent forwarded to a session whose policy lets
+// peers use it.
+type sharedAgent struct {
+	pid  int    // of the session's process
+	sock string // path to the session's agent socket
+}
+
+// shareAgent lets peers use the agent forwarded to ss, whose process
+// is running, if its policy allows. The returned func stops sharing.
+func (srv *server) shareAgent(ss *sshSession) (unshare func()) {
+	if ss.agentListener == nil || !ss.action.AllowPeerAgentForwarding || !ss.action.AllowAgentForwarding {
+		return func() {}
+	}
+	sa := sharedAgent{
+		pid:  ss.cmd.Process.Pid,
+		sock: ss.agentListener.Addr().String(),
+	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	mapSet(&srv.sharedAgents, ss, sa)
+	return func() {
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		delete(srv.sharedAgents, ss)
+	}
+}
+
+// OpenPeerAgent implements ipnlocal.SSHServer. It connects to the agent
+// of the session whose process (or a descendant of it) made the TCP
+// connection from local port sport to peer:dport, if that's a
+// connection to peer's Tailscale SSH server.
+func (srv *server) OpenPeerAgent(peer netaddr.IP, sport, dport uint16) (io.ReadWriteCloser, error) {
+	if dport != tailscaleSSHPort {
+		return nil, fmt.Errorf("port %d isn't Tailscale SSH's", dport)
+	}
+	n, _, ok := srv.lb.WhoIs(netaddr.IPPortFrom(peer, 0))
+	if !ok || !n.Hostinfo.Valid() || n.Hostinfo.SSH_HostKeys().Len() == 0 {
+		return nil, fmt.Errorf("peer %v doesn't run Tailscale SSH", peer)
+	}
+	srv.mu.Lock()
+	agents := make([]sharedAgent, 0, len(srv.sharedAgents))
+	for _, sa := range srv.sharedAgents {
+		agents = append(agents, sa)
+	}
+	srv.mu.Unlock()
+	if len(agents) == 0 {
+		return nil, errors.New("no sessions share their agent")
+	}
+
+	remote := netip.AddrPortFrom(netconv.AsAddr(peer).Unmap(), dport)
+	pids, err := tcpConnPIDs(sport, remote)
+	if err != nil {
+		return nil, fmt.Errorf("finding owner of connection from port %d to %v: %w", sport, remote, err)
+	}
+	for _, pid := range pids {
+		for _, sa := range agents {
+			if isDescendant(pid, sa.pid) {
+				srv.logf("ssh: giving %v the agent of session process %d", peer, sa.pid)
+				return net.Dial("unix", sa.sock)
+			}
+		}
+	}
+	return nil, fmt.Errorf("connection from port %d to %v isn't from a session that shares its agent", sport, remote)
+}
+
+// isDescendant reports whether process pid is ancestor or one of its
+// descendants.
+func isDescendant(pid, ancestor int) bool {
+	for i := 0; i < 100 && pid > 1; i++ {
+		if pid == ancestor {
+			return true
+		}
+		var err error
+		pid, err = parentPID(pid)
+		if err != nil {
+			return false
+		}
+	}
+	return false
+}
+
+// peerAgentDialTimeout bounds how long connecting to a peer's agent
+// may take.
+const peerAgentDialTimeout = 10 * time.Second
+
+// handlePeerAgentForwarding gives ss an agent socket proxied to the
+// agent of the session on the node ss came from, if ss's client didn't
+// forward an agent and ss's policy allows it. On success, it assigns
+// ss.agentListener.
+func (ss *sshSession) handlePeerAgentForwarding(lu *user.User) error {
+	if ssh.AgentRequested(ss) || !ss.action.AllowAgentForwarding || !ss.action.AllowPeerAgentForwarding {
+		return nil
+	}
+	ln, err := ss.newUserAgentListener(lu)
+	if err != nil {
+		return err
+	}
+	ss.logf("ssh: proxying agent connections to %v", ss.connInfo.src.Addr())
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go ss.proxyPeerAgent(c)
+		}
+	}()
+	ss.agentListener = ln
+	return nil
+}
+
+// proxyPeerAgent proxies the agent connection c to the agent of the
+// session on the node that ss came from.
+func (ss *sshSession) proxyPeerAgent(c net.Conn) {
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(ss.ctx, peerAgentDialTimeout)
+	defer cancel()
+	src := ss.connInfo.src
+	agent, err := ss.srv.lb.DialPeerSSHAgent(ctx, netconv.AsIP(src.Addr()), src.Port(), ss.connInfo.dst.Port())
+	if err != nil {
+		ss.logf("ssh: peer agent: %v", err)
+		return
+	}
+	defer agent.Close()
+	errc := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(agent, c)
+		errc <- err
+	}()
+	go func() {
+		_, err := io.Copy(c, agent)
+		errc <- err
+	}()
+	<-errc
+}
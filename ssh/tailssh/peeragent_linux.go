@@ -0,0 +1,125 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tailssh
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+
+	"tailscale.com/util/endian"
+	"tailscale.com/util/lineread"
+)
+
+// tcpConnPIDs returns the IDs of the processes with a socket for the
+// established TCP connection from local port sport to remote.
+func tcpConnPIDs(sport uint16, remote netip.AddrPort) ([]int, error) {
+	// IPv4 connections of dual-stack sockets are in tcp6, with
+	// v4-mapped addresses, which parseProcNetAddr unmaps.
+	files := []string{"/proc/net/tcp6"}
+	if remote.Addr().Is4() {
+		files = append(files, "/proc/net/tcp")
+	}
+	var inode string
+	for _, file := range files {
+		err := lineread.File(file, func(line []byte) error {
+			// sl local_address rem_address st ... uid timeout inode
+			f := strings.Fields(string(line))
+			if len(f) < 10 || f[3] != "01" { // TCP_ESTABLISHED
+				return nil
+			}
+			local, err1 := parseProcNetAddr(f[1])
+			rem, err2 := parseProcNetAddr(f[2])
+			if err1 != nil || err2 != nil {
+				return nil
+			}
+			if local.Port() == sport && rem == remote {
+				inode = f[9]
+			}
+			return nil
+		})
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if inode != "" {
+			break
+		}
+	}
+	if inode == "" || inode == "0" {
+		return nil, fmt.Errorf("no such connection")
+	}
+
+	target := []byte("socket:[" + inode + "]")
+	var pids []int
+	des, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	for _, de := range des {
+		pid, err := strconv.Atoi(de.Name())
+		if err != nil {
+			continue
+		}
+		fds, err := os.ReadDir(fmt.Sprintf("/proc/%d/fd", pid))
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			link, err := os.Readlink(fmt.Sprintf("/proc/%d/fd/%s", pid, fd.Name()))
+			if err == nil && bytes.Equal([]byte(link), target) {
+				pids = append(pids, pid)
+				break
+			}
+		}
+	}
+	return pids, nil
+}
+
+// parseProcNetAddr parses an address from /proc/net/tcp{,6}, such as
+// "0100007F:0016": the address as 32-bit words in native byte order,
+// then the port, all in hex.
+func parseProcNetAddr(s string) (netip.AddrPort, error) {
+	ipHex, portHex, ok := strings.Cut(s, ":")
+	if !ok {
+		return netip.AddrPort{}, fmt.Errorf("bad address %q", s)
+	}
+	b, err := hex.DecodeString(ipHex)
+	if err != nil || (len(b) != 4 && len(b) != 16) {
+		return netip.AddrPort{}, fmt.Errorf("bad address %q", s)
+	}
+	port, err := strconv.ParseUint(portHex, 16, 16)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("bad port in %q", s)
+	}
+	for i := 0; i < len(b); i += 4 {
+		binary.BigEndian.PutUint32(b[i:], endian.Native.Uint32(b[i:]))
+	}
+	ip, _ := netip.AddrFromSlice(b)
+	return netip.AddrPortFrom(ip.Unmap(), uint16(port)), nil
+}
+
+// parentPID returns the parent process ID of pid.
+func parentPID(pid int) (int, error) {
+	b, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+	// The command name, in parens, may contain spaces and parens,
+	// so look after the last paren: " S ppid ...".
+	i := bytes.LastIndexByte(b, ')')
+	if i < 0 {
+		return 0, fmt.Errorf("bad /proc/%d/stat", pid)
+	}
+	f := strings.Fields(string(b[i+1:]))
+	if len(f) < 2 {
+		return 0, fmt.Errorf("bad /proc/%d/stat", pid)
+	}
+	return strconv.Atoi(f[1])
+}
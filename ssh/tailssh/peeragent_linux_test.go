@@ -0,0 +1,330 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tailssh
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tailscale/golang-x-crypto/ssh/agent"
+	"inet.af/netaddr"
+	"tailscale.com/tailcfg"
+	gossh "tailscale.com/tempfork/golang-x-crypto/ssh"
+)
+
+func TestParseProcNetAddr(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"0100007F:0016", "127.0.0.1:22"},
+		{"0A00400A:A2E9", "10.64.0.10:41705"},
+		{"00000000000000000000000001000000:0016", "[::1]:22"},
+		{"0000000000000000FFFF00000100007F:1F90", "127.0.0.1:8080"},
+	}
+	for _, tt := range tests {
+		got, err := parseProcNetAddr(tt.in)
+		if err != nil {
+			t.Errorf("parseProcNetAddr(%q): %v", tt.in, err)
+			continue
+		}
+		if got.String() != tt.want {
+			t.Errorf("parseProcNetAddr(%q) = %v; want %v", tt.in, got, tt.want)
+		}
+	}
+	for _, bad := range []string{"", "0100007F", "0100007F:", "01007F:0016", "zz00007F:0016"} {
+		if _, err := parseProcNetAddr(bad); err == nil {
+			t.Errorf("parseProcNetAddr(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestTCPConnPIDs(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	lport := ln.Addr().(*net.TCPAddr).Port
+
+	// A grandchild of the shell holds the connection.
+	cmd := exec.Command("/bin/bash", "-c", fmt.Sprintf("(exec 3<>/dev/tcp/127.0.0.1/%d; sleep 30) & wait", lport))
+	if err := cmd.Start(); err != nil {
+		t.Skipf("can't run bash: %v", err)
+	}
+	defer cmd.Wait()
+	defer cmd.Process.Kill()
+	c, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	sport := uint16(c.RemoteAddr().(*net.TCPAddr).Port)
+	remote := netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), uint16(lport))
+
+	pids, err := tcpConnPIDs(sport, remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pids) != 1 {
+		t.Fatalf("pids = %v; want one", pids)
+	}
+	if pids[0] == cmd.Process.Pid {
+		t.Errorf("connection attributed to the shell, not its child")
+	}
+	if !isDescendant(pids[0], cmd.Process.Pid) {
+		t.Errorf("pid %d not a descendant of %d", pids[0], cmd.Process.Pid)
+	}
+	if isDescendant(os.Getpid(), cmd.Process.Pid) {
+		t.Errorf("test process is a descendant of its child")
+	}
+
+	if _, err := tcpConnPIDs(sport+1, remote); err == nil {
+		t.Errorf("found a connection from the wrong port")
+	}
+
+	// An IPv4 connection accepted by a dual-stack listener is in
+	// tcp6, with v4-mapped addresses.
+	ln6, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Skipf("no IPv6: %v", err)
+	}
+	defer ln6.Close()
+	c4, err := net.Dial("tcp4", fmt.Sprintf("127.0.0.1:%d", ln6.Addr().(*net.TCPAddr).Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c4.Close()
+	c6, err := ln6.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c6.Close()
+	remote = c4.LocalAddr().(*net.TCPAddr).AddrPort()
+	pids, err = tcpConnPIDs(uint16(ln6.Addr().(*net.TCPAddr).Port), netip.AddrPortFrom(remote.Addr().Unmap(), remote.Port()))
+	if err != nil {
+		t.Fatalf("v4-mapped connection: %v", err)
+	}
+	if len(pids) != 1 || pids[0] != os.Getpid() {
+		t.Errorf("v4-mapped connection pids = %v; want [%d]", pids, os.Getpid())
+	}
+}
+
+func newTestKeyring(t *testing.T) agent.Agent {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kr := agent.NewKeyring()
+	if err := kr.Add(agent.AddedKey{PrivateKey: priv, Comment: "test key"}); err != nil {
+		t.Fatal(err)
+	}
+	return kr
+}
+
+// forwardAgent serves kr to agent channels opened by the server on c,
+// like agent.ForwardToAgent.
+func forwardAgent(t *testing.T, c *gossh.Client, kr agent.Agent) {
+	chans := c.HandleChannelOpen("auth-agent@openssh.com")
+	if chans == nil {
+		t.Fatal("agent channel already handled")
+	}
+	go func() {
+		for nc := range chans {
+			ch, reqs, err := nc.Accept()
+			if err != nil {
+				continue
+			}
+			go gossh.DiscardRequests(reqs)
+			go func() {
+				agent.ServeAgent(kr, ch)
+				ch.Close()
+			}()
+		}
+	}()
+}
+
+func listAgentKeys(t *testing.T, rwc io.ReadWriter) []string {
+	t.Helper()
+	keys, err := agent.NewClient(rwc).List()
+	if err != nil {
+		t.Fatalf("listing agent keys: %v", err)
+	}
+	var comments []string
+	for _, k := range keys {
+		comments = append(comments, k.Comment)
+	}
+	return comments
+}
+
+// TestOpenPeerAgent tests the side of peer agent forwarding on the
+// node a user hops from.
+func TestOpenPeerAgent(t *testing.T) {
+	for _, share := range []bool{false, true} {
+		t.Run(fmt.Sprintf("share=%v", share), func(t *testing.T) {
+			h := newSSHHarness(t, nil)
+			h.lb.setPolicy(&tailcfg.SSHPolicy{Rules: []*tailcfg.SSHRule{
+				h.acceptRule(&tailcfg.SSHAction{
+					Accept:                   true,
+					AllowAgentForwarding:     true,
+					AllowPeerAgentForwarding: share,
+				}),
+			}})
+			c := h.mustDial()
+			forwardAgent(t, c, newTestKeyring(t))
+			s, err := c.NewSession()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			if ok, err := s.SendRequest("auth-agent-req@openssh.com", true, nil); err != nil || !ok {
+				t.Fatalf("requesting agent forwarding: %v, %v", ok, err)
+			}
+
+			// Have the session connect to "the next hop".
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			lport := uint16(ln.Addr().(*net.TCPAddr).Port)
+			stdout, err := s.StdoutPipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Start(fmt.Sprintf("exec 3<>/dev/tcp/127.0.0.1/%d; echo connected; sleep 30", lport)); err != nil {
+				t.Fatal(err)
+			}
+			if line, err := bufio.NewReader(stdout).ReadString('\n'); err != nil || line != "connected\n" {
+				t.Fatalf("session output = %q, %v", line, err)
+			}
+			hop, err := ln.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer hop.Close()
+			sport := uint16(hop.RemoteAddr().(*net.TCPAddr).Port)
+			peer := netaddr.MustParseIP("127.0.0.1")
+
+			// As far as OpenPeerAgent knows, the session connected
+			// to peer's SSH server, once peer is one.
+			defer func(p uint16) { tailscaleSSHPort = p }(tailscaleSSHPort)
+			tailscaleSSHPort = lport
+			peerNode := &tailcfg.Node{ID: 3, StableID: "hop"}
+			h.lb.mu.Lock()
+			h.lb.peers[netip.MustParseAddr("127.0.0.1")] = testPeer{node: peerNode}
+			h.lb.mu.Unlock()
+			if _, err := h.srv.OpenPeerAgent(peer, sport, lport); err == nil {
+				t.Error("opened agent for a peer without Tailscale SSH")
+			}
+			peerNode.Hostinfo = (&tailcfg.Hostinfo{SSH_HostKeys: []string{"ssh-ed25519 AAAA"}}).View()
+
+			if _, err := h.srv.OpenPeerAgent(peer, sport+1, lport); err == nil {
+				t.Error("opened agent for the wrong connection")
+			}
+			tailscaleSSHPort = 22
+			if _, err := h.srv.OpenPeerAgent(peer, sport, lport); err == nil {
+				t.Error("opened agent for a connection to a port other than SSH's")
+			}
+			tailscaleSSHPort = lport
+
+			// The session shares its agent once its process has
+			// started, which may be just after it writes.
+			var rwc io.ReadWriteCloser
+			for deadline := time.Now().Add(5 * time.Second); ; {
+				rwc, err = h.srv.OpenPeerAgent(peer, sport, lport)
+				if err == nil || !share || time.Now().After(deadline) {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			if !share {
+				if err == nil {
+					rwc.Close()
+					t.Fatal("opened agent of a session that doesn't share it")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rwc.Close()
+			if got := listAgentKeys(t, rwc); len(got) != 1 || got[0] != "test key" {
+				t.Errorf("agent keys = %q; want the test key", got)
+			}
+		})
+	}
+}
+
+// TestPeerAgentForwarding tests the side of peer agent forwarding on
+// the node a user hops to.
+func TestPeerAgentForwarding(t *testing.T) {
+	h := newSSHHarness(t, nil)
+	h.lb.setPolicy(&tailcfg.SSHPolicy{Rules: []*tailcfg.SSHRule{
+		h.acceptRule(&tailcfg.SSHAction{
+			Accept:                   true,
+			AllowAgentForwarding:     true,
+			AllowPeerAgentForwarding: true,
+		}),
+	}})
+	kr := newTestKeyring(t)
+	type dial struct {
+		peer         netaddr.IP
+		sport, dport uint16
+	}
+	dials := make(chan dial, 1)
+	h.lb.dialPeerAgent = func(ctx context.Context, peer netaddr.IP, sport, dport uint16) (io.ReadWriteCloser, error) {
+		dials <- dial{peer, sport, dport}
+		c, s := net.Pipe()
+		go agent.ServeAgent(kr, s)
+		return c, nil
+	}
+
+	c := h.mustDial()
+	s, err := c.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	stdout, err := s.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start("echo $SSH_AUTH_SOCK; sleep 30"); err != nil {
+		t.Fatal(err)
+	}
+	sock, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	sock = strings.TrimSpace(sock)
+	if sock == "" {
+		t.Fatal("no SSH_AUTH_SOCK in session")
+	}
+
+	ac, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ac.Close()
+	if got := listAgentKeys(t, ac); len(got) != 1 || got[0] != "test key" {
+		t.Errorf("agent keys = %q; want the test key", got)
+	}
+	want := dial{netaddr.MustParseIP(testPeerIP.String()), 41641, 22}
+	if got := <-dials; got != want {
+		t.Errorf("dialed %+v; want %+v", got, want)
+	}
+}
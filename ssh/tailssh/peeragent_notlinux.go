@@ -0,0 +1,23 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build (darwin && !ios) || windows
+// +build darwin,!ios windows
+
+package tailssh
+
+import (
+	"errors"
+	"net/netip"
+)
+
+var errPeerAgentUnsupported = errors.New("sharing agents with peers isn't supported on this platform")
+
+func tcpConnPIDs(sport uint16, remote netip.AddrPort) ([]int, error) {
+	return nil, errPeerAgentUnsupported
+}
+
+func parentPID(pid int) (int, error) {
+	return 0, errPeerAgentUnsupported
+}
@@ -0,0 +1,138 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux || (darwin && !ios) || windows
+// +build linux darwin,!ios windows
+
+package tailssh
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// playbackSubsystem is the SSH subsystem that plays back a session
+// recording. Its name is followed by a space and the session ID.
+const playbackSubsystem = "tailscale-playback"
+
+// maxPlaybackIdle is the longest pause playback makes, however long
+// the recorded session sat idle.
+const maxPlaybackIdle = 2 * time.Second
+
+// findRecording returns the path of the recording of the session with
+// the given ID.
+func (srv *server) findRecording(id string) (string, error) {
+	if id == "" || strings.Trim(id, "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ-") != "" {
+		return "", fmt.Errorf("invalid session ID %q", id)
+	}
+	dir, err := srv.recordingsDir()
+	if err != nil {
+		return "", err
+	}
+	matches, err := filepath.Glob(filepath.Join(dir, "ssh-session-*-"+id+"-*.cast"))
+	if err != nil {
+		return "", err
+	}
+	gzipped, err := filepath.Glob(filepath.Join(dir, "ssh-session-*-"+id+"-*.cast.gz"))
+	if err != nil {
+		return "", err
+	}
+	matches = append(matches, gzipped...)
+	if len(matches) == 0 {
+		return "", fmt.Errorf("no recording of session %q", id)
+	}
+	return matches[0], nil
+}
+
+// runPlayback writes the output of the recording of the session with
+// the given ID to ss, with its original timing, except that pauses are
+// at most maxPlaybackIdle.
+func (ss *sshSession) runPlayback(id string) {
+	if !ss.action.AllowRecordingPlayback {
+		ss.logf("recording playback not allowed")
+		io.WriteString(ss.Stderr(), "Recording playback not allowed.\r\n")
+		ss.Exit(1)
+		return
+	}
+	path, err := ss.srv.findRecording(id)
+	if err != nil {
+		ss.logf("playback: %v", err)
+		fmt.Fprintf(ss.Stderr(), "No recording of session %q.\r\n", id)
+		ss.Exit(1)
+		return
+	}
+	ss.logf("playing back %s", path)
+	ss.srv.publishEvent(ss.execEvent())
+	if err := ss.playRecording(path); err != nil {
+		ss.logf("playback: %v", err)
+		ss.Exit(1)
+		return
+	}
+	ss.Exit(0)
+}
+
+// playRecording writes the output of the asciinema recording at path
+// to ss, until it's done or ss.ctx is.
+func (ss *sshSession) playRecording(path string) error {
+	f, err := openRecording(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	if _, err := br.ReadBytes('\n'); err != nil { // the header
+		return err
+	}
+	var last float64
+	for {
+		line, err := br.ReadBytes('\n')
+		if err == io.ErrUnexpectedEOF {
+			// A gzipped recording cut short.
+			err = io.EOF
+		}
+		if err == io.EOF && len(line) == 0 {
+			return nil
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+		var (
+			at   float64
+			dir  string
+			data string
+		)
+		if jerr := json.Unmarshal(line, &[]any{&at, &dir, &data}); jerr != nil {
+			// The last line may be cut short if tailscaled
+			// stopped while recording.
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("bad recording line %q: %w", line, jerr)
+		}
+		if dir != "o" {
+			continue
+		}
+		if d := time.Duration((at - last) * float64(time.Second)); d > 0 {
+			if d > maxPlaybackIdle {
+				d = maxPlaybackIdle
+			}
+			t := time.NewTimer(d)
+			select {
+			case <-t.C:
+			case <-ss.ctx.Done():
+				t.Stop()
+				return ss.ctx.Err()
+			}
+		}
+		last = at
+		if _, err := io.WriteString(ss, data); err != nil {
+			return err
+		}
+	}
+}
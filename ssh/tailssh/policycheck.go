@@ -0,0 +1,77 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux || (darwin && !ios) || windows
+// +build linux darwin,!ios windows
+
+package tailssh
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+
+	"inet.af/netaddr"
+	"tailscale.com/ipn/ipnstate"
+	gossh "tailscale.com/tempfork/golang-x-crypto/ssh"
+	"tailscale.com/util/netconv"
+)
+
+// CheckPolicy evaluates the SSH policy for a hypothetical connection
+// from src as sshUser, offering pubKey (in authorized_keys format) if
+// non-empty, and reports which rule would match and what it'd do. The
+// connection is taken to be to port 22 of this node's Tailscale address
+// of src's address family.
+// No connection or session is made and no events are published, but
+// public key URLs in the policy may be fetched.
+//
+// It returns an error only if the question can't be answered; a
+// connection that would be rejected is reported in the result.
+func (srv *server) CheckPolicy(sshUser string, src netaddr.IP, pubKey string) (*ipnstate.SSHPolicyCheck, error) {
+	if sshUser == "" {
+		return nil, errors.New("missing ssh user")
+	}
+	var pk gossh.PublicKey
+	if pubKey != "" {
+		var err error
+		pk, _, _, _, err = gossh.ParseAuthorizedKey([]byte(pubKey))
+		if err != nil {
+			return nil, fmt.Errorf("parsing public key: %w", err)
+		}
+	}
+	srcAddr := netconv.AsAddr(src)
+	dst, ok := srv.selfAddrLike(srcAddr)
+	if !ok {
+		return nil, fmt.Errorf("no Tailscale address of this node in the same family as %v", srcAddr)
+	}
+	res := new(ipnstate.SSHPolicyCheck)
+	a, ci, localUser, err := srv.evaluatePolicy(sshUser, netip.AddrPortFrom(dst, 22), netip.AddrPortFrom(srcAddr, 0), pk)
+	if ci != nil && ci.uprof != nil {
+		res.LoginName = ci.uprof.LoginName
+	}
+	if err != nil {
+		res.Error = err.Error()
+		return res, nil
+	}
+	res.Rule = ci.rule
+	res.Action = ci.keyOpts.apply(a)
+	res.LocalUser = localUser
+	return res, nil
+}
+
+// selfAddrLike returns this node's Tailscale address of the same
+// address family as ip.
+func (srv *server) selfAddrLike(ip netip.Addr) (_ netip.Addr, ok bool) {
+	nm := srv.lb.NetMap()
+	if nm == nil || nm.SelfNode == nil {
+		return netip.Addr{}, false
+	}
+	for _, pfx := range nm.SelfNode.Addresses {
+		a := netconv.AsAddr(pfx.IP())
+		if pfx.IsSingleIP() && a.Is4() == ip.Is4() {
+			return a, true
+		}
+	}
+	return netip.Addr{}, false
+}
@@ -0,0 +1,251 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux || (darwin && !ios) || windows
+// +build linux darwin,!ios windows
+
+package tailssh
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"tailscale.com/health"
+	"tailscale.com/tailcfg"
+)
+
+// debugPolicyReloadDelay is how long the debug policy file watcher
+// waits after a change for more before reloading, as editors often
+// write a file in several steps.
+const debugPolicyReloadDelay = 250 * time.Millisecond
+
+// debugPolicyState is the last load of the debug policy file by its
+// watcher.
+type debugPolicyState struct {
+	pol *tailcfg.SSHPolicy // or nil if err != nil
+	err error
+}
+
+// loadDebugPolicyFile reads and validates the SSH policy in the JSON
+// file path.
+func loadDebugPolicyFile(path string) (*tailcfg.SSHPolicy, error) {
+	f, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading debug policy file: %w", err)
+	}
+	pol, err := parseDebugPolicy(f)
+	if err != nil {
+		return nil, fmt.Errorf("debug policy file %v: %w", path, err)
+	}
+	return pol, nil
+}
+
+// parseDebugPolicy parses the JSON SSH policy in b, rejecting unknown
+// fields and rules that could never match, so that typos in a
+// hand-written policy are reported rather than silently ignored.
+func parseDebugPolicy(b []byte) (*tailcfg.SSHPolicy, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	pol := new(tailcfg.SSHPolicy)
+	if err := dec.Decode(pol); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %w", err)
+	}
+	for i, r := range pol.Rules {
+		if err := validateRule(r); err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i+1, err)
+		}
+	}
+	if pol.RecordingDir != "" && !filepath.IsAbs(pol.RecordingDir) {
+		return nil, fmt.Errorf("recordingDir %q is not an absolute path", pol.RecordingDir)
+	}
+	return pol, nil
+}
+
+// validateRule reports whether r is a well-formed SSH rule.
+func validateRule(r *tailcfg.SSHRule) error {
+	if r == nil {
+		return errors.New("null rule")
+	}
+	a := r.Action
+	if a == nil {
+		return errors.New("no action")
+	}
+	n := 0
+	for _, set := range []bool{a.Accept, a.Reject, a.HoldAndDelegate != ""} {
+		if set {
+			n++
+		}
+	}
+	if n != 1 {
+		return errors.New("action must have exactly one of accept, reject and holdAndDelegate")
+	}
+	if len(r.Principals) == 0 {
+		return errors.New("no principals")
+	}
+	for _, p := range r.Principals {
+		if p == nil {
+			return errors.New("nil principal")
+		}
+	}
+	switch a.RecordingFailure {
+	case "", recordingFailureTerminate, recordingFailureContinue, recordingFailurePause:
+	default:
+		return fmt.Errorf("unknown recordingFailure %q", a.RecordingFailure)
+	}
+	if !a.Reject && len(r.SSHUsers) == 0 {
+		return errors.New("no sshUsers")
+	}
+	for _, v := range r.SSHUsers {
+		if !strings.ContainsAny(v, "{}") {
+			continue
+		}
+		_, err := expandLocalUserTemplate(v, func(name string) (string, error) {
+			if !localUserTemplateNames[name] {
+				return "", fmt.Errorf("unknown placeholder {%s}", name)
+			}
+			return "", nil
+		})
+		if err != nil {
+			return fmt.Errorf("sshUsers: %w", err)
+		}
+	}
+	if l := a.SessionLimits; l != nil && (l.CPUPercent < 0 || l.MemoryMax < 0 || l.PidsMax < 0) {
+		return errors.New("negative sessionLimits")
+	}
+	switch a.EphemeralUser {
+	case "", ephemeralUserPerSession, ephemeralUserPerUser:
+	default:
+		return fmt.Errorf("unknown ephemeralUser %q", a.EphemeralUser)
+	}
+	if err := validateUlimits(a); err != nil {
+		return err
+	}
+	if s := r.Schedule; s != nil {
+		if err := validateSchedule(s); err != nil {
+			return fmt.Errorf("schedule: %w", err)
+		}
+	}
+	return nil
+}
+
+// validateSchedule reports whether s is a well-formed schedule.
+func validateSchedule(s *tailcfg.SSHSchedule) error {
+	if s.TimeZone != "" {
+		if _, err := time.LoadLocation(s.TimeZone); err != nil {
+			return err
+		}
+	}
+	for _, v := range []string{s.Start, s.End} {
+		if _, ok := parseTimeOfDay(v); !ok {
+			return fmt.Errorf("invalid time of day %q", v)
+		}
+	}
+	for _, d := range s.Days {
+		if _, ok := parseWeekday(d); !ok {
+			return fmt.Errorf("invalid day %q", d)
+		}
+	}
+	return nil
+}
+
+// debugPolicy returns the SSH policy in the debug policy file. If the
+// file is being watched, it's the policy from the last load.
+func (srv *server) debugPolicy() (*tailcfg.SSHPolicy, error) {
+	srv.mu.Lock()
+	st := srv.debugPolicyState
+	srv.mu.Unlock()
+	if st != nil {
+		return st.pol, st.err
+	}
+	return loadDebugPolicyFile(debugPolicyFile)
+}
+
+// reloadDebugPolicy loads the debug policy file for its watcher w, logs
+// the outcome, and re-evaluates the active sessions against the new
+// policy. It does nothing if w has been stopped.
+func (srv *server) reloadDebugPolicy(w *fsnotify.Watcher) {
+	pol, err := loadDebugPolicyFile(debugPolicyFile)
+	srv.mu.Lock()
+	if srv.debugPolicyWatcher != w {
+		srv.mu.Unlock()
+		return
+	}
+	srv.debugPolicyState = &debugPolicyState{pol: pol, err: err}
+	srv.mu.Unlock()
+
+	if err != nil {
+		srv.logf("ssh: %v; rejecting connections until it's fixed", err)
+		health.SetSSHPolicyHealth(err)
+	} else {
+		srv.logf("ssh: loaded debug policy file %v: %d rules", debugPolicyFile, len(pol.Rules))
+		health.SetSSHPolicyHealth(nil)
+	}
+	srv.OnPolicyChange()
+}
+
+// watchDebugPolicyFileLocked starts watching the debug policy file for
+// changes, if there is one, until stopDebugPolicyWatchLocked.
+// srv.mu must be held.
+func (srv *server) watchDebugPolicyFileLocked() {
+	if debugPolicyFile == "" || srv.isConnChild || srv.debugPolicyWatcher != nil {
+		return
+	}
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		srv.logf("ssh: can't watch debug policy file: %v", err)
+		return
+	}
+	// Watch the directory, as editors often replace the file by
+	// renaming a new one over it.
+	path := filepath.Clean(debugPolicyFile)
+	if err := w.Add(filepath.Dir(path)); err != nil {
+		w.Close()
+		srv.logf("ssh: can't watch debug policy file: %v", err)
+		return
+	}
+	srv.debugPolicyWatcher = w
+	go srv.runDebugPolicyWatcher(w, path)
+}
+
+// stopDebugPolicyWatchLocked stops watching the debug policy file and
+// forgets the last load of it. srv.mu must be held.
+func (srv *server) stopDebugPolicyWatchLocked() {
+	if srv.debugPolicyWatcher == nil {
+		return
+	}
+	srv.debugPolicyWatcher.Close()
+	srv.debugPolicyWatcher = nil
+	srv.debugPolicyState = nil
+}
+
+func (srv *server) runDebugPolicyWatcher(w *fsnotify.Watcher, path string) {
+	srv.reloadDebugPolicy(w)
+	var reload <-chan time.Time
+	for {
+		select {
+		case ev, ok := <-w.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(ev.Name) == path && reload == nil {
+				reload = time.After(debugPolicyReloadDelay)
+			}
+		case err, ok := <-w.Errors:
+			if !ok {
+				return
+			}
+			srv.logf("ssh: watching debug policy file: %v", err)
+		case <-reload:
+			reload = nil
+			srv.reloadDebugPolicy(w)
+		}
+	}
+}
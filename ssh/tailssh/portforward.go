@@ -0,0 +1,278 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux || (darwin && !ios) || windows
+// +build linux darwin,!ios windows
+
+package tailssh
+
+// This file implements local and dynamic TCP port forwarding ("ssh -L"
+// and "ssh -D") for sessions whose policy allows it, auditing each
+// forwarded connection.
+
+import (
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+	"tailscale.com/tempfork/gliderlabs/ssh"
+	gossh "tailscale.com/tempfork/golang-x-crypto/ssh"
+)
+
+const directTCPIPChannel = "direct-tcpip"
+
+// directTCPIPData is the extra data of a direct-tcpip channel, per
+// RFC 4254 section 7.2.
+type directTCPIPData struct {
+	DestAddr   string
+	DestPort   uint32
+	OriginAddr string
+	OriginPort uint32
+}
+
+// portForward is an open forwarded TCP connection of a session.
+type portForward struct {
+	host     string // as the client asked for it
+	port     uint32
+	dialHost string // host, or the address it resolved to
+	ch       gossh.Channel
+	conn     net.Conn
+}
+
+// close closes f, ending its proxying.
+func (f *portForward) close() {
+	f.ch.Close()
+	f.conn.Close()
+}
+
+// mayForwardLocalPortTo returns the session that ctx's connection is
+// running if its policy allows forwarding to the specified host and
+// port, along with the address to dial.
+func (srv *server) mayForwardLocalPortTo(ctx ssh.Context, destinationHost string, destinationPort uint32) (_ *sshSession, dialAddr string, ok bool) {
+	ss, ok := srv.getSessionForContext(ctx)
+	if !ok {
+		return nil, "", false
+	}
+	a := ss.currentForwardAction()
+	if !(a.AllowLocalPortForwarding || a.AllowDynamicPortForwarding) {
+		return nil, "", false
+	}
+	if a.Record {
+		ss.logf("refusing to forward to %s: the session must be recorded, and forwarded connections aren't", net.JoinHostPort(destinationHost, strconv.FormatUint(uint64(destinationPort), 10)))
+		return nil, "", false
+	}
+	port := strconv.FormatUint(uint64(destinationPort), 10)
+	dests := a.LocalPortForwardingDestinations
+	if portForwardDestAllowed(dests, destinationHost, destinationPort) {
+		return ss, net.JoinHostPort(destinationHost, port), true
+	}
+	if _, err := netip.ParseAddr(destinationHost); err != nil && a.AllowDynamicPortForwarding {
+		// SOCKS clients mostly ask for names. Resolve them here, and
+		// dial the allowed address found rather than the name, so it
+		// can't resolve differently by the time it's dialed.
+		ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", destinationHost)
+		if err != nil {
+			ss.logf("refusing to forward to %s: %v", net.JoinHostPort(destinationHost, port), err)
+			return nil, "", false
+		}
+		for _, ip := range ips {
+			if portForwardDestAllowed(dests, ip.Unmap().String(), destinationPort) {
+				return ss, net.JoinHostPort(ip.Unmap().String(), port), true
+			}
+		}
+	}
+	ss.logf("refusing to forward to %s: not an allowed destination", net.JoinHostPort(destinationHost, port))
+	return nil, "", false
+}
+
+// currentForwardAction returns the action that ss's port forwarding is
+// currently subject to.
+func (ss *sshSession) currentForwardAction() *tailcfg.SSHAction {
+	ss.forwardsMu.Lock()
+	defer ss.forwardsMu.Unlock()
+	if ss.forwardAction != nil {
+		return ss.forwardAction
+	}
+	return ss.action
+}
+
+// updateForwardAction makes ss's port forwarding subject to a, from a
+// new policy that still accepts ss, closing its open forwards that a
+// doesn't allow.
+func (ss *sshSession) updateForwardAction(a *tailcfg.SSHAction) {
+	ss.forwardsMu.Lock()
+	defer ss.forwardsMu.Unlock()
+	ss.forwardAction = a
+	for f := range ss.forwards {
+		if forwardStillAllowed(a, f) {
+			continue
+		}
+		ss.logf("forward to %s no longer allowed per new SSH policy; closing", net.JoinHostPort(f.host, strconv.FormatUint(uint64(f.port), 10)))
+		f.close()
+		delete(ss.forwards, f)
+	}
+}
+
+// forwardStillAllowed reports whether a allows the open forward f.
+func forwardStillAllowed(a *tailcfg.SSHAction, f *portForward) bool {
+	if !(a.AllowLocalPortForwarding || a.AllowDynamicPortForwarding) || a.Record {
+		return false
+	}
+	dests := a.LocalPortForwardingDestinations
+	if portForwardDestAllowed(dests, f.host, f.port) {
+		return true
+	}
+	return a.AllowDynamicPortForwarding && portForwardDestAllowed(dests, f.dialHost, f.port)
+}
+
+// addForward records f as open, reporting false, having closed it,
+// if ss's forwards were revoked while it was being opened.
+func (ss *sshSession) addForward(f *portForward) bool {
+	ss.forwardsMu.Lock()
+	defer ss.forwardsMu.Unlock()
+	if ss.forwardAction != nil && !forwardStillAllowed(ss.forwardAction, f) {
+		f.close()
+		return false
+	}
+	mapSet(&ss.forwards, f, true)
+	return true
+}
+
+// removeForward forgets the closed forward f.
+func (ss *sshSession) removeForward(f *portForward) {
+	ss.forwardsMu.Lock()
+	defer ss.forwardsMu.Unlock()
+	delete(ss.forwards, f)
+}
+
+// portForwardDestAllowed reports whether host and port match one of
+// dests, from SSHAction.LocalPortForwardingDestinations. A nil dests
+// allows any destination.
+func portForwardDestAllowed(dests []string, host string, port uint32) bool {
+	if dests == nil {
+		return true
+	}
+	ip, ipErr := netip.ParseAddr(host)
+	for _, d := range dests {
+		dhost, dport, err := net.SplitHostPort(d)
+		if err != nil || !portMatches(dport, port) {
+			continue
+		}
+		if pfx, err := netip.ParsePrefix(dhost); err == nil {
+			if ipErr == nil && pfx.Contains(ip.Unmap()) {
+				return true
+			}
+			continue
+		}
+		if dip, err := netip.ParseAddr(dhost); err == nil {
+			if ipErr == nil && dip == ip.Unmap() {
+				return true
+			}
+			continue
+		}
+		// A hostname, matched only by name and not by what it
+		// resolves to, as the client asks for a name or an address.
+		if ipErr != nil && strings.EqualFold(dhost, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// portMatches reports whether port matches pat, which is "*", a port
+// number, or an inclusive range like "8000-8999".
+func portMatches(pat string, port uint32) bool {
+	if pat == "*" {
+		return true
+	}
+	lo, hi, isRange := strings.Cut(pat, "-")
+	if !isRange {
+		hi = lo
+	}
+	l, err := strconv.ParseUint(lo, 10, 16)
+	if err != nil {
+		return false
+	}
+	h, err := strconv.ParseUint(hi, 10, 16)
+	if err != nil {
+		return false
+	}
+	return uint64(port) >= l && uint64(port) <= h
+}
+
+// handleDirectTCPIP is the ssh.ChannelHandler for direct-tcpip
+// channels, which connect to a TCP port reachable from this node. It
+// publishes a forward event when the connection opens and a forward
+// end event, with how much it carried, when it closes.
+func (srv *server) handleDirectTCPIP(_ *ssh.Server, _ *gossh.ServerConn, newChan gossh.NewChannel, ctx ssh.Context) {
+	var d directTCPIPData
+	if err := gossh.Unmarshal(newChan.ExtraData(), &d); err != nil {
+		newChan.Reject(gossh.ConnectionFailed, "error parsing forward data: "+err.Error())
+		return
+	}
+	ss, dialAddr, ok := srv.mayForwardLocalPortTo(ctx, d.DestAddr, d.DestPort)
+	if !ok {
+		newChan.Reject(gossh.Prohibited, "port forwarding is disabled")
+		return
+	}
+	dest := net.JoinHostPort(d.DestAddr, strconv.FormatUint(uint64(d.DestPort), 10))
+	var dialer net.Dialer
+	dconn, err := dialer.DialContext(ctx, "tcp", dialAddr)
+	if err != nil {
+		newChan.Reject(gossh.ConnectionFailed, err.Error())
+		return
+	}
+	ch, reqs, err := newChan.Accept()
+	if err != nil {
+		dconn.Close()
+		return
+	}
+	go gossh.DiscardRequests(reqs)
+	dialHost, _, _ := net.SplitHostPort(dialAddr)
+	f := &portForward{host: d.DestAddr, port: d.DestPort, dialHost: dialHost, ch: ch, conn: dconn}
+	if !ss.addForward(f) {
+		return
+	}
+	ev := ss.sessionEvent(ipnstate.SSHEventForward)
+	ev.ForwardTo = dest
+	srv.publishEvent(ev)
+	if dialAddr != dest {
+		ss.logf("forwarding to %s (%s)", dest, dialAddr)
+	} else {
+		ss.logf("forwarding to %s", dest)
+	}
+
+	go func() {
+		start := srv.now()
+		sent, received := proxyTCP(ch, dconn)
+		ss.removeForward(f)
+		ev := ss.sessionEvent(ipnstate.SSHEventForwardEnd)
+		ev.ForwardTo = dest
+		ev.BytesSent = sent
+		ev.BytesReceived = received
+		ev.Duration = srv.now().Sub(start)
+		srv.publishEvent(ev)
+		ss.logf("forward to %s done: %d bytes sent, %d received in %v", dest, sent, received, ev.Duration)
+	}()
+}
+
+// proxyTCP copies between ch and c until both directions are done,
+// returning how many bytes were sent to c and received from it.
+func proxyTCP(ch gossh.Channel, c net.Conn) (sent, received int64) {
+	recv := make(chan int64, 1)
+	go func() {
+		defer ch.Close()
+		defer c.Close()
+		n, _ := io.Copy(ch, c)
+		recv <- n
+	}()
+	sent, _ = io.Copy(c, ch)
+	ch.Close()
+	c.Close()
+	return sent, <-recv
+}
@@ -0,0 +1,135 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux || (darwin && !ios) || windows
+// +build linux darwin,!ios windows
+
+package tailssh
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/ipn/ipnstate"
+)
+
+// Recordings implements ipnlocal.SSHServer. Recordings kept by a
+// recording store other than the node's disk aren't listed.
+func (srv *server) Recordings(f ipnstate.SSHRecordingFilter) ([]*ipnstate.SSHRecording, error) {
+	dir, err := srv.recordingsDir()
+	if err != nil {
+		return nil, err
+	}
+	des, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var recs []*ipnstate.SSHRecording
+	for _, de := range des {
+		rec, ok := parseRecordingName(de.Name())
+		if !ok {
+			continue
+		}
+		if f.SessionID != "" && rec.SessionID != f.SessionID ||
+			!f.Since.IsZero() && rec.Start.Before(f.Since) ||
+			!f.Until.IsZero() && !rec.Start.Before(f.Until) {
+			continue
+		}
+		fi, err := de.Info()
+		if err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		rec.Size = fi.Size()
+		readRecordingHeader(filepath.Join(dir, de.Name()), rec)
+		if f.User != "" && !strings.EqualFold(f.User, rec.LoginName) && f.User != rec.LocalUser {
+			continue
+		}
+		recs = append(recs, rec)
+	}
+	sort.Slice(recs, func(i, j int) bool { return recs[i].Start.Before(recs[j].Start) })
+	return recs, nil
+}
+
+// OpenRecording implements ipnlocal.SSHServer.
+func (srv *server) OpenRecording(id string) (io.ReadCloser, error) {
+	path, err := srv.findRecording(id)
+	if err != nil {
+		return nil, err
+	}
+	return openRecording(path)
+}
+
+// parseRecordingName parses the name of a recording file, as made by
+// startNewRecording: ssh-session-<unixnano>-<session-id>-<random>.cast,
+// optionally followed by .gz.
+func parseRecordingName(name string) (_ *ipnstate.SSHRecording, ok bool) {
+	if !strings.HasPrefix(name, "ssh-session-") {
+		return nil, false
+	}
+	rest := strings.TrimPrefix(name, "ssh-session-")
+	rec := new(ipnstate.SSHRecording)
+	if strings.HasSuffix(rest, ".gz") {
+		rest = strings.TrimSuffix(rest, ".gz")
+		rec.Compressed = true
+	}
+	if !strings.HasSuffix(rest, ".cast") {
+		return nil, false
+	}
+	rest = strings.TrimSuffix(rest, ".cast")
+	ns, rest, ok := strings.Cut(rest, "-")
+	if !ok {
+		return nil, false
+	}
+	i := strings.LastIndexByte(rest, '-')
+	if i <= 0 {
+		return nil, false
+	}
+	n, err := strconv.ParseInt(ns, 10, 64)
+	if err != nil {
+		return nil, false
+	}
+	rec.SessionID = rest[:i]
+	rec.Start = time.Unix(0, n)
+	return rec, true
+}
+
+// readRecordingHeader fills in rec with what the header of the
+// recording at path says about the session, if anything.
+func readRecordingHeader(path string, rec *ipnstate.SSHRecording) {
+	r, err := openRecording(path)
+	if err != nil {
+		return
+	}
+	defer r.Close()
+	line, err := bufio.NewReader(r).ReadBytes('\n')
+	if err != nil {
+		return
+	}
+	var hdr struct {
+		LoginName string `json:"loginName"`
+		SSHUser   string `json:"sshUser"`
+		LocalUser string `json:"localUser"`
+		SrcNodeIP string `json:"srcNodeIP"`
+		Command   string `json:"command"`
+	}
+	if json.Unmarshal(line, &hdr) != nil {
+		return
+	}
+	rec.LoginName = hdr.LoginName
+	rec.SSHUser = hdr.SSHUser
+	rec.LocalUser = hdr.LocalUser
+	rec.SrcNodeIP, _ = netaddr.ParseIP(hdr.SrcNodeIP)
+	rec.Command = hdr.Command
+}
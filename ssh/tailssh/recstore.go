@@ -0,0 +1,235 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux || (darwin && !ios) || windows
+// +build linux darwin,!ios windows
+
+package tailssh
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"tailscale.com/envknob"
+	"tailscale.com/health"
+	"tailscale.com/types/logger"
+)
+
+// recordingStoreURL, if non-empty, is where session recordings are
+// stored instead of the node's disk, as a URL whose scheme is that of
+// a registered recording store, such as
+// "s3://bucket/prefix?region=us-east-1" on Linux builds with the ts_s3
+// build tag. See recordingStores.
+var recordingStoreURL = envknob.String("TS_SSH_RECORDING_STORE")
+
+// recordingDir, if non-empty, is the absolute path of the directory
+// session recordings are stored in, such as a dedicated audit volume
+// or a tmpfs, in place of $TAILSCALE_VAR_ROOT/ssh-sessions. See
+// recordingsDir.
+var recordingDir = envknob.String("TS_SSH_RECORDING_DIR")
+
+// recordGzip, if true, compresses new session recordings with gzip,
+// naming them *.cast.gz. Terminal output typically shrinks by an order
+// of magnitude.
+var recordGzip = envknob.Bool("TS_SSH_RECORDING_GZIP")
+
+// gzipFlushInterval is how often a compressed recording is flushed,
+// bounding how much of it is lost if tailscaled dies mid-session.
+// Flushing after every write would undo much of the compression.
+const gzipFlushInterval = time.Second
+
+// recordingStore is where session recordings are stored.
+type recordingStore interface {
+	// Create starts a new recording, named by replacing the last
+	// "*" in pattern with a random string, as with ioutil.TempFile.
+	// The recording is stored once w is closed. The name is for
+	// logs.
+	Create(pattern string) (w io.WriteCloser, name string, err error)
+
+	// String describes where the store keeps recordings.
+	String() string
+}
+
+// recordingStores are the recording stores that recordingStoreURL
+// may name, by URL scheme. Each makes a store from the URL, spooling
+// recordings to spoolDir as needed.
+var recordingStores = map[string]func(logf logger.Logf, u *url.URL, spoolDir string) (recordingStore, error){}
+
+// recordingStore returns where srv stores session recordings.
+func (srv *server) recordingStore() (recordingStore, error) {
+	dir, err := srv.recordingsDir()
+	if err != nil {
+		return nil, err
+	}
+	if recordingStoreURL == "" {
+		return diskRecordingStore{dir}, nil
+	}
+	u, err := url.Parse(recordingStoreURL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing TS_SSH_RECORDING_STORE: %w", err)
+	}
+	newStore, ok := recordingStores[u.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("unsupported recording store %q", u.Scheme)
+	}
+	return newStore(srv.logf, u, dir)
+}
+
+// diskRecordingStore stores recordings as files in a local directory.
+type diskRecordingStore struct {
+	dir string
+}
+
+func (s diskRecordingStore) Create(pattern string) (io.WriteCloser, string, error) {
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return nil, "", err
+	}
+	f, err := ioutil.TempFile(s.dir, pattern)
+	if err != nil {
+		return nil, "", err
+	}
+	return f, f.Name(), nil
+}
+
+func (s diskRecordingStore) String() string { return s.dir }
+
+// The values of SSHAction.RecordingFailure.
+const (
+	recordingFailureTerminate = "terminate"
+	recordingFailureContinue  = "continue"
+	recordingFailurePause     = "pause"
+)
+
+// minRecordingFreeSpace is how much free space the disk recordings are
+// written to must have for new ones to be started.
+const minRecordingFreeSpace = 64 << 20
+
+// recordingRetryInterval is how often a paused recording tries to
+// continue.
+const recordingRetryInterval = 5 * time.Second
+
+// checkRecordingSpace returns an error if the disk that recordings are
+// written to (or spooled on, for other stores) is nearly full.
+func (srv *server) checkRecordingSpace() error {
+	dir, err := srv.recordingsDir()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	free, err := diskFree(dir)
+	if err != nil {
+		// Not knowing isn't a reason not to record.
+		srv.logf("ssh: checking free space for recordings: %v", err)
+		return nil
+	}
+	if free < minRecordingFreeSpace {
+		return fmt.Errorf("only %d bytes free in %s for recording", free, dir)
+	}
+	return nil
+}
+
+// pausingWriter is where a session recording is written for the
+// "pause" RecordingFailure: it retries failed writes until they succeed
+// or the session ends, holding up the session's output meanwhile.
+type pausingWriter struct {
+	io.WriteCloser
+	ss *sshSession
+}
+
+func (w pausingWriter) Write(p []byte) (written int, err error) {
+	paused := false
+	for {
+		n, err := w.WriteCloser.Write(p[written:])
+		written += n
+		if err == nil {
+			if paused {
+				w.ss.logf("recording resumed")
+				health.SetSSHRecordingHealth(nil)
+			}
+			return written, nil
+		}
+		if !paused {
+			w.ss.logf("recording failed: %v; pausing session output until it can continue", err)
+			health.SetSSHRecordingHealth(err)
+			paused = true
+		}
+		t := time.NewTimer(recordingRetryInterval)
+		select {
+		case <-t.C:
+		case <-w.ss.ctx.Done():
+			t.Stop()
+			return written, err
+		}
+	}
+}
+
+// gzipWriteCloser gzips what's written to a recording. It's not safe
+// for concurrent use.
+type gzipWriteCloser struct {
+	zw        *gzip.Writer
+	w         io.WriteCloser
+	lastFlush time.Time
+}
+
+func newGzipWriteCloser(w io.WriteCloser) *gzipWriteCloser {
+	return &gzipWriteCloser{
+		zw:        gzip.NewWriter(w),
+		w:         w,
+		lastFlush: time.Now(),
+	}
+}
+
+func (g *gzipWriteCloser) Write(p []byte) (int, error) {
+	n, err := g.zw.Write(p)
+	if err == nil && time.Since(g.lastFlush) >= gzipFlushInterval {
+		err = g.zw.Flush()
+		g.lastFlush = time.Now()
+	}
+	return n, err
+}
+
+func (g *gzipWriteCloser) Close() error {
+	err := g.zw.Close()
+	if err2 := g.w.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// openRecording opens the recording at path for reading, decompressing
+// it if it's gzipped.
+func openRecording(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(path, ".gz") {
+		return f, nil
+	}
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return gzipReadCloser{zr, f}, nil
+}
+
+// gzipReadCloser is a gzip.Reader that also closes the file it reads.
+type gzipReadCloser struct {
+	*gzip.Reader
+	f *os.File
+}
+
+func (r gzipReadCloser) Close() error {
+	r.Reader.Close()
+	return r.f.Close()
+}
@@ -0,0 +1,192 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux && ts_s3
+// +build linux,ts_s3
+
+package tailssh
+
+// This file stores recordings in S3. It links the AWS SDK's config
+// loader, so it's only built with the ts_s3 build tag.
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"tailscale.com/health"
+	"tailscale.com/types/logger"
+)
+
+func init() {
+	recordingStores["s3"] = newS3RecordingStore
+}
+
+// s3UploadTimeout is how long uploading a recording may take.
+const s3UploadTimeout = 10 * time.Minute
+
+// s3RecordingStore stores recordings as objects in an S3 bucket, or
+// one of an S3-compatible object store. Recordings are spooled to disk
+// and uploaded once they're complete; the spooled copy is removed once
+// it's uploaded, and kept if it can't be.
+//
+// It's configured by a URL of the form
+// "s3://bucket/prefix?region=r&endpoint=https://host:port". The
+// region defaults to that of the local AWS config, and the endpoint to
+// AWS's for the region. Buckets at other endpoints are addressed
+// path-style. Credentials come from the local AWS config: the usual
+// AWS_* environment variables, shared credentials files, or the
+// instance's role.
+type s3RecordingStore struct {
+	logf     logger.Logf
+	spoolDir string
+	bucket   string
+	prefix   string // of object keys
+	endpoint string // URL that objects' keys are appended to
+	region   string
+	creds    aws.CredentialsProvider
+}
+
+func newS3RecordingStore(logf logger.Logf, u *url.URL, spoolDir string) (recordingStore, error) {
+	if u.Host == "" {
+		return nil, errors.New("s3 recording store URL has no bucket")
+	}
+	q := u.Query()
+	var opts []func(*config.LoadOptions) error
+	if r := q.Get("region"); r != "" {
+		opts = append(opts, config.WithRegion(r))
+	}
+	cfg, err := config.LoadDefaultConfig(context.Background(), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("loading AWS config: %w", err)
+	}
+	if cfg.Region == "" {
+		return nil, errors.New("s3 recording store has no region; set one in its URL or the AWS config")
+	}
+	s := &s3RecordingStore{
+		logf:     logf,
+		spoolDir: spoolDir,
+		bucket:   u.Host,
+		prefix:   strings.TrimPrefix(u.Path, "/"),
+		region:   cfg.Region,
+		creds:    cfg.Credentials,
+	}
+	if ep := q.Get("endpoint"); ep != "" {
+		s.endpoint = strings.TrimSuffix(ep, "/") + "/" + s.bucket + "/"
+	} else {
+		s.endpoint = fmt.Sprintf("https://%s.s3.%s.amazonaws.com/", s.bucket, s.region)
+	}
+	return s, nil
+}
+
+func (s *s3RecordingStore) String() string {
+	return "s3://" + path.Join(s.bucket, s.prefix)
+}
+
+func (s *s3RecordingStore) Create(pattern string) (io.WriteCloser, string, error) {
+	if err := os.MkdirAll(s.spoolDir, 0700); err != nil {
+		return nil, "", err
+	}
+	f, err := ioutil.TempFile(s.spoolDir, pattern)
+	if err != nil {
+		return nil, "", err
+	}
+	// The object is named like the spooled file.
+	key := strings.TrimPrefix(path.Join(s.prefix, filepath.Base(f.Name())), "/")
+	return &s3RecordingWriter{File: f, s: s, key: key}, "s3://" + path.Join(s.bucket, key), nil
+}
+
+// s3RecordingWriter spools a recording, and starts uploading it to
+// its store when closed.
+type s3RecordingWriter struct {
+	*os.File
+	s   *s3RecordingStore
+	key string
+}
+
+func (w *s3RecordingWriter) Close() error {
+	if err := w.File.Close(); err != nil {
+		return err
+	}
+	go func() {
+		spool := w.File.Name()
+		err := w.s.upload(w.key, spool)
+		health.SetSSHRecordingHealth(err)
+		if err != nil {
+			w.s.logf("ssh: uploading recording to %s: %v; kept at %s", w.s, err, spool)
+			return
+		}
+		os.Remove(spool)
+	}()
+	return nil
+}
+
+// upload uploads the file at name as the object key.
+func (s *s3RecordingStore) upload(key, name string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s3UploadTimeout)
+	defer cancel()
+
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	payloadHash := hex.EncodeToString(h.Sum(nil))
+
+	u := s.endpoint + (&url.URL{Path: key}).EscapedPath()
+	req, err := http.NewRequestWithContext(ctx, "PUT", u, f)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	if strings.HasSuffix(key, ".gz") {
+		req.Header.Set("Content-Type", "application/gzip")
+	} else {
+		req.Header.Set("Content-Type", "application/x-asciicast")
+	}
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.creds == nil {
+		return errors.New("no AWS credentials")
+	}
+	creds, err := s.creds.Retrieve(ctx)
+	if err != nil {
+		return fmt.Errorf("getting AWS credentials: %w", err)
+	}
+	if err := v4.NewSigner().SignHTTP(ctx, creds, req, payloadHash, "s3", s.region, time.Now()); err != nil {
+		return err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1<<10))
+		return fmt.Errorf("PUT %s: %s: %s", key, res.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
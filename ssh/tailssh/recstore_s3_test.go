@@ -0,0 +1,96 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux && ts_s3
+// +build linux,ts_s3
+
+package tailssh
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestS3RecordingStore(t *testing.T) {
+	// Only use these credentials, whatever the local AWS config.
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDTEST")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(t.TempDir(), "none"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(t.TempDir(), "none"))
+
+	type put struct {
+		path, auth, body string
+	}
+	puts := make(chan put, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		if r.Method != "PUT" {
+			http.Error(w, "not a PUT", http.StatusMethodNotAllowed)
+			return
+		}
+		puts <- put{r.URL.Path, r.Header.Get("Authorization"), string(b)}
+	}))
+	defer ts.Close()
+
+	u, err := url.Parse("s3://bucket/casts?region=us-test-1&endpoint=" + url.QueryEscape(ts.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	spoolDir := t.TempDir()
+	store, err := newS3RecordingStore(t.Logf, u, spoolDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := store.String(), "s3://bucket/casts"; got != want {
+		t.Errorf("String = %q; want %q", got, want)
+	}
+	w, name, err := store.Create("ssh-session-1-id-*.cast")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(name, "s3://bucket/casts/ssh-session-1-id-") {
+		t.Errorf("name = %q", name)
+	}
+	io.WriteString(w, "recorded\n")
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case p := <-puts:
+		if !strings.HasPrefix(p.path, "/bucket/casts/ssh-session-1-id-") || !strings.HasSuffix(p.path, ".cast") {
+			t.Errorf("PUT path = %q", p.path)
+		}
+		if !strings.HasPrefix(p.auth, "AWS4-HMAC-SHA256 Credential=AKIDTEST/") || !strings.Contains(p.auth, "/us-test-1/s3/aws4_request") {
+			t.Errorf("Authorization = %q", p.auth)
+		}
+		if p.body != "recorded\n" {
+			t.Errorf("body = %q", p.body)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout waiting for upload")
+	}
+
+	// The spooled copy is removed once uploaded.
+	for i := 0; ; i++ {
+		des, err := os.ReadDir(spoolDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(des) == 0 {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("spool dir still has %v", des[0].Name())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux || (darwin && !ios) || windows
+// +build linux darwin,!ios windows
+
+package tailssh
+
+import (
+	"strings"
+	"time"
+
+	"tailscale.com/tailcfg"
+)
+
+// scheduleOpen reports whether s's window is open at now, and whether s
+// parses at all. A schedule that doesn't parse is never open.
+func scheduleOpen(s *tailcfg.SSHSchedule, now time.Time) (open, ok bool) {
+	loc := time.UTC
+	if s.TimeZone != "" {
+		var err error
+		loc, err = time.LoadLocation(s.TimeZone)
+		if err != nil {
+			return false, false
+		}
+	}
+	start, ok := parseTimeOfDay(s.Start)
+	if !ok {
+		return false, false
+	}
+	end, ok := parseTimeOfDay(s.End)
+	if !ok {
+		return false, false
+	}
+	days := make(map[time.Weekday]bool)
+	for _, d := range s.Days {
+		wd, ok := parseWeekday(d)
+		if !ok {
+			return false, false
+		}
+		days[wd] = true
+	}
+	now = now.In(loc)
+	mins := now.Hour()*60 + now.Minute()
+	day := now.Weekday()
+	switch {
+	case start == end:
+		// Open all day.
+	case start < end:
+		if mins < start || mins >= end {
+			return false, true
+		}
+	case mins >= start:
+		// Opened today, closes tomorrow.
+	case mins < end:
+		// Opened yesterday.
+		day = (day + 6) % 7
+	default:
+		return false, true
+	}
+	return len(days) == 0 || days[day], true
+}
+
+// parseTimeOfDay parses v, an "HH:MM" time of day, as minutes since
+// midnight. The empty string is midnight.
+func parseTimeOfDay(v string) (mins int, ok bool) {
+	if v == "" {
+		return 0, true
+	}
+	t, err := time.Parse("15:04", v)
+	if err != nil {
+		return 0, false
+	}
+	return t.Hour()*60 + t.Minute(), true
+}
+
+// parseWeekday parses a day of the week abbreviated as in "Mon".
+func parseWeekday(v string) (time.Weekday, bool) {
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if strings.EqualFold(v, d.String()[:3]) {
+			return d, true
+		}
+	}
+	return 0, false
+}
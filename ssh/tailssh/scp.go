@@ -0,0 +1,573 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux || (darwin && !ios) || windows
+// +build linux darwin,!ios windows
+
+package tailssh
+
+// This file implements the server side of the original scp protocol,
+// which clients use by running "scp -t" (to copy to the node) or
+// "scp -f" (from it). The incubator serves it itself, as the local
+// user, so scp works without an scp binary on the host, and reports
+// each file copied to tailscaled for its audit log. Newer scp clients
+// use SFTP instead; see sftp.go.
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"tailscale.com/ipn/ipnstate"
+)
+
+// scpCommand is a parsed server side scp command line.
+type scpCommand struct {
+	sink      bool // -t: copy to the node; else -f: from it
+	recursive bool // -r
+	targetDir bool // -d: the sink's target must be a directory
+	preserve  bool // -p: preserve modification and access times
+	paths     []string
+}
+
+// parseSCPCommand parses cmd, the command an SSH client asked to
+// run, as a server side scp command. It only reports ok if it's one
+// that scp clients run and that doesn't need a shell to interpret,
+// which the built-in scp couldn't; other commands run as usual.
+func parseSCPCommand(cmd string) (_ scpCommand, ok bool) {
+	argv, ok := splitSCPCommand(cmd)
+	if !ok || len(argv) == 0 || (argv[0] != "scp" && !strings.HasSuffix(argv[0], "/scp")) {
+		return scpCommand{}, false
+	}
+	return parseSCPArgs(argv[1:])
+}
+
+// parseSCPArgs parses the arguments of a server side scp command.
+func parseSCPArgs(args []string) (c scpCommand, ok bool) {
+	var source bool
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		if a == "--" {
+			c.paths = args[i+1:]
+			break
+		}
+		if !strings.HasPrefix(a, "-") || a == "-" {
+			c.paths = args[i:]
+			break
+		}
+		for _, f := range a[1:] {
+			switch f {
+			case 't':
+				c.sink = true
+			case 'f':
+				source = true
+			case 'r':
+				c.recursive = true
+			case 'd':
+				c.targetDir = true
+			case 'p':
+				c.preserve = true
+			case 'v', 'q':
+			default:
+				return scpCommand{}, false
+			}
+		}
+	}
+	if c.sink == source || len(c.paths) == 0 || (c.sink && len(c.paths) != 1) {
+		return scpCommand{}, false
+	}
+	return c, true
+}
+
+// args returns the arguments that parseSCPArgs parses as c.
+func (c scpCommand) args() []string {
+	args := []string{"-f"}
+	if c.sink {
+		args[0] = "-t"
+	}
+	if c.recursive {
+		args = append(args, "-r")
+	}
+	if c.targetDir {
+		args = append(args, "-d")
+	}
+	if c.preserve {
+		args = append(args, "-p")
+	}
+	args = append(args, "--")
+	return append(args, c.paths...)
+}
+
+// splitSCPCommand splits cmd into words as a POSIX shell would, with
+// quotes and backslashes. It fails if cmd has anything else a shell
+// would interpret, such as globs, variables or redirections.
+func splitSCPCommand(cmd string) (argv []string, ok bool) {
+	var (
+		word    strings.Builder
+		inWord  bool
+		quote   byte // the open quote, if any
+		escaped bool
+	)
+	for i := 0; i < len(cmd); i++ {
+		ch := cmd[i]
+		switch {
+		case escaped:
+			if quote == '"' && !strings.ContainsRune("\"\\$`\n", rune(ch)) {
+				word.WriteByte('\\')
+			}
+			word.WriteByte(ch)
+			escaped = false
+		case quote == '\'':
+			if ch == '\'' {
+				quote = 0
+			} else {
+				word.WriteByte(ch)
+			}
+		case quote == '"':
+			switch ch {
+			case '"':
+				quote = 0
+			case '\\':
+				escaped = true
+			case '$', '`':
+				return nil, false
+			default:
+				word.WriteByte(ch)
+			}
+		case ch == '\\':
+			escaped, inWord = true, true
+		case ch == '\'' || ch == '"':
+			quote, inWord = ch, true
+		case ch == ' ' || ch == '\t':
+			if inWord {
+				argv = append(argv, word.String())
+				word.Reset()
+				inWord = false
+			}
+		case strings.IndexByte("|&;<>()$`*?[]{}~#\n", ch) >= 0:
+			return nil, false
+		default:
+			word.WriteByte(ch)
+			inWord = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, false
+	}
+	if inWord {
+		argv = append(argv, word.String())
+	}
+	return argv, true
+}
+
+// scpArgs returns the arguments for the incubator to serve ss's
+// command with the built-in scp, if it should.
+func (ss *sshSession) scpArgs() (_ []string, ok bool) {
+	if ss.srv.tailscaledPath == "" {
+		return nil, false
+	}
+	if _, _, isPty := ss.Pty(); isPty {
+		return nil, false
+	}
+	c, ok := parseSCPCommand(ss.command())
+	if !ok {
+		return nil, false
+	}
+	return c.args(), true
+}
+
+// scpTransfer is the incubator's report of a file copied by scp.
+type scpTransfer struct {
+	Upload bool
+	Path   string // absolute
+	Size   int64
+}
+
+// logSCPTransfers logs and publishes the transfers the incubator
+// reports on r, until it's closed.
+func (ss *sshSession) logSCPTransfers(r io.ReadCloser) {
+	defer r.Close()
+	dec := json.NewDecoder(r)
+	for {
+		var t scpTransfer
+		if err := dec.Decode(&t); err != nil {
+			return
+		}
+		typ := ipnstate.SSHEventDownload
+		if t.Upload {
+			typ = ipnstate.SSHEventUpload
+		}
+		ss.logf("scp: %s %s (%d bytes)", typ, t.Path, t.Size)
+		ev := ss.sessionEvent(typ)
+		ev.Path = t.Path
+		ev.Size = t.Size
+		ss.srv.publishEvent(ev)
+	}
+}
+
+// errSCPFailed is returned by serveSCP if it failed to copy some file,
+// after telling the client why.
+var errSCPFailed = errors.New("scp failed")
+
+// scpServer is the state of the built-in scp in the incubator.
+type scpServer struct {
+	scpCommand
+	r      *bufio.Reader // from the client
+	w      io.Writer     // to the client
+	report *json.Encoder // of scpTransfers, to tailscaled
+	failed bool          // whether any file failed to copy
+}
+
+// serveSCP serves the scp command with the given args on the
+// incubator's stdin and stdout, reporting each file copied to report.
+func serveSCP(args []string, report io.Writer) error {
+	c, ok := parseSCPArgs(args)
+	if !ok {
+		return fmt.Errorf("bad scp arguments %q", args)
+	}
+	s := &scpServer{
+		scpCommand: c,
+		r:          bufio.NewReader(os.Stdin),
+		w:          os.Stdout,
+		report:     json.NewEncoder(report),
+	}
+	var err error
+	if c.sink {
+		err = s.receive(c.paths[0])
+	} else {
+		err = s.sendAll(c.paths)
+	}
+	if err != nil {
+		s.fatal(err)
+		return errSCPFailed
+	}
+	if s.failed {
+		return errSCPFailed
+	}
+	return nil
+}
+
+// ack tells the client that all's well.
+func (s *scpServer) ack() error {
+	_, err := s.w.Write([]byte{0})
+	return err
+}
+
+// warn tells the client that copying a file failed with err.
+func (s *scpServer) warn(err error) {
+	s.failed = true
+	fmt.Fprintf(s.w, "\x01scp: %v\n", err)
+}
+
+// fatal tells the client that the copy has failed with err.
+func (s *scpServer) fatal(err error) {
+	fmt.Fprintf(s.w, "\x02scp: %v\n", err)
+}
+
+// scpClientError is an error the scp client reported.
+type scpClientError struct {
+	msg   string
+	fatal bool
+}
+
+func (e scpClientError) Error() string { return e.msg }
+
+// readAck reads the client's response to what was last sent.
+func (s *scpServer) readAck() error {
+	b, err := s.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if b == 0 {
+		return nil
+	}
+	msg, err := s.r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	return scpClientError{strings.TrimSuffix(msg, "\n"), b != 1}
+}
+
+// receive receives files from the client into target.
+func (s *scpServer) receive(target string) error {
+	fi, err := os.Stat(target)
+	targetIsDir := err == nil && fi.IsDir()
+	if s.targetDir && !targetIsDir {
+		return fmt.Errorf("%s: not a directory", target)
+	}
+	if err := s.ack(); err != nil {
+		return err
+	}
+
+	var dirs []string // the directories being received into
+	var times []time.Time
+	for {
+		line, err := s.r.ReadString('\n')
+		if err == io.EOF && line == "" {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return errors.New("protocol error: empty line")
+		}
+		switch line[0] {
+		case 1:
+			s.failed = true
+			continue
+		case 2:
+			return scpClientError{line[1:], true}
+		case 'T':
+			times, err = parseSCPTimes(line[1:])
+			if err != nil {
+				return err
+			}
+		case 'E':
+			if len(dirs) == 0 {
+				return errors.New("protocol error: unexpected E")
+			}
+			dirs = dirs[:len(dirs)-1]
+		case 'C', 'D':
+			mode, size, name, err := parseSCPFileLine(line[1:])
+			if err != nil {
+				return err
+			}
+			path := target
+			if len(dirs) > 0 {
+				path = filepath.Join(dirs[len(dirs)-1], name)
+			} else if targetIsDir {
+				path = filepath.Join(target, name)
+			}
+			if line[0] == 'D' {
+				if !s.recursive {
+					return errors.New("received a directory without -r")
+				}
+				if err := os.Mkdir(path, mode|0700); err != nil && !os.IsExist(err) {
+					return err
+				}
+				dirs = append(dirs, path)
+				times = nil // directories' times aren't preserved
+				break
+			}
+			if err := s.ack(); err != nil {
+				return err
+			}
+			if err := s.receiveFile(path, mode, size, times); err != nil {
+				s.warn(fmt.Errorf("%s: %w", path, err))
+				times = nil
+				continue
+			}
+			times = nil
+		default:
+			return fmt.Errorf("protocol error: unexpected %q", line)
+		}
+		if err := s.ack(); err != nil {
+			return err
+		}
+	}
+}
+
+// receiveFile writes the size bytes of a file from the client to
+// path. It consumes them even if it fails.
+func (s *scpServer) receiveFile(path string, mode os.FileMode, size int64, times []time.Time) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	var n int64
+	if err == nil {
+		n, err = io.CopyN(f, s.r, size)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if n < size {
+		if _, derr := io.CopyN(io.Discard, s.r, size-n); derr != nil {
+			return derr
+		}
+	}
+	if aerr := s.readAck(); err == nil {
+		err = aerr
+	}
+	if err != nil {
+		return err
+	}
+	if s.preserve && times != nil {
+		os.Chtimes(path, times[1], times[0])
+	}
+	abs, _ := filepath.Abs(path)
+	s.report.Encode(scpTransfer{Upload: true, Path: abs, Size: size})
+	return nil
+}
+
+// parseSCPFileLine parses the rest of a C or D line: "<mode> <size> <name>".
+func parseSCPFileLine(line string) (mode os.FileMode, size int64, name string, err error) {
+	parts := strings.SplitN(line, " ", 3)
+	if len(parts) != 3 {
+		return 0, 0, "", fmt.Errorf("protocol error: bad file line %q", line)
+	}
+	m, err := strconv.ParseUint(parts[0], 8, 32)
+	if err != nil {
+		return 0, 0, "", fmt.Errorf("protocol error: bad mode %q", parts[0])
+	}
+	size, err = strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || size < 0 {
+		return 0, 0, "", fmt.Errorf("protocol error: bad size %q", parts[1])
+	}
+	name = parts[2]
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return 0, 0, "", fmt.Errorf("protocol error: bad file name %q", name)
+	}
+	return os.FileMode(m) & os.ModePerm, size, name, nil
+}
+
+// parseSCPTimes parses the rest of a T line: "<mtime> 0 <atime> 0".
+// It returns the access and modification times, in that order.
+func parseSCPTimes(line string) ([]time.Time, error) {
+	f := strings.Fields(line)
+	if len(f) != 4 {
+		return nil, fmt.Errorf("protocol error: bad times %q", line)
+	}
+	mtime, err1 := strconv.ParseInt(f[0], 10, 64)
+	atime, err2 := strconv.ParseInt(f[2], 10, 64)
+	if err1 != nil || err2 != nil {
+		return nil, fmt.Errorf("protocol error: bad times %q", line)
+	}
+	return []time.Time{time.Unix(atime, 0), time.Unix(mtime, 0)}, nil
+}
+
+// sendAll sends the files at paths to the client.
+func (s *scpServer) sendAll(paths []string) error {
+	if err := s.readAck(); err != nil {
+		return err
+	}
+	for _, p := range paths {
+		if err := s.sendOrWarn(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scpFileError is an error with a file being sent, which doesn't stop
+// the others being sent.
+type scpFileError struct{ error }
+
+// sendOrWarn is like send, but only returns errors that stop the
+// copy, and tells the client of those that don't.
+func (s *scpServer) sendOrWarn(path string) error {
+	err := s.send(path)
+	switch e := err.(type) {
+	case scpFileError:
+		s.warn(e.error)
+		return nil
+	case scpClientError:
+		if !e.fatal {
+			// The client has reported it.
+			s.failed = true
+			return nil
+		}
+	}
+	return err
+}
+
+// send sends the file or, if recursive, the directory at path to the
+// client.
+func (s *scpServer) send(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return scpFileError{err}
+	}
+	if s.preserve {
+		atime := fi.ModTime() // the access time isn't portably available
+		if _, err := fmt.Fprintf(s.w, "T%d 0 %d 0\n", fi.ModTime().Unix(), atime.Unix()); err != nil {
+			return err
+		}
+		if err := s.readAck(); err != nil {
+			return err
+		}
+	}
+	name := filepath.Base(path)
+	if fi.IsDir() {
+		if !s.recursive {
+			return scpFileError{fmt.Errorf("%s: not a regular file", path)}
+		}
+		des, err := os.ReadDir(path)
+		if err != nil {
+			return scpFileError{err}
+		}
+		if _, err := fmt.Fprintf(s.w, "D%04o 0 %s\n", fi.Mode().Perm(), name); err != nil {
+			return err
+		}
+		if err := s.readAck(); err != nil {
+			return err
+		}
+		for _, de := range des {
+			if err := s.sendOrWarn(filepath.Join(path, de.Name())); err != nil {
+				return err
+			}
+		}
+		if _, err := io.WriteString(s.w, "E\n"); err != nil {
+			return err
+		}
+		return s.readAck()
+	}
+	if !fi.Mode().IsRegular() {
+		return scpFileError{fmt.Errorf("%s: not a regular file", path)}
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return scpFileError{err}
+	}
+	defer f.Close()
+	size := fi.Size()
+	if _, err := fmt.Fprintf(s.w, "C%04o %d %s\n", fi.Mode().Perm(), size, name); err != nil {
+		return err
+	}
+	if err := s.readAck(); err != nil {
+		return err
+	}
+	// Once the client expects size bytes, they must be sent, so if
+	// the file can't be read, they're padded, and the client is told
+	// after, as OpenSSH's scp does.
+	n, rerr := io.Copy(s.w, io.LimitReader(f, size))
+	if rerr == nil && n < size {
+		rerr = errors.New("file shrank")
+	}
+	if n < size {
+		if _, err := io.CopyN(s.w, zeroReader{}, size-n); err != nil {
+			return err
+		}
+	}
+	if rerr != nil {
+		s.warn(fmt.Errorf("%s: %w", path, rerr))
+	} else if err := s.ack(); err != nil {
+		return err
+	}
+	if err := s.readAck(); err != nil {
+		return err
+	}
+	if rerr != nil {
+		return nil
+	}
+	abs, _ := filepath.Abs(path)
+	s.report.Encode(scpTransfer{Path: abs, Size: size})
+	return nil
+}
+
+// zeroReader reads zeros.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
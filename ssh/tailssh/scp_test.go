@@ -0,0 +1,57 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux || darwin
+// +build linux darwin
+
+package tailssh
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSCPCommand(t *testing.T) {
+	tests := []struct {
+		cmd  string
+		want []string // args; nil if not ok
+	}{
+		{"scp -t -- /tmp", []string{"-t", "--", "/tmp"}},
+		{"scp -t .", []string{"-t", "--", "."}},
+		{"/usr/bin/scp -v -r -d -t -- 'a dir'", []string{"-t", "-r", "-d", "--", "a dir"}},
+		{"scp -pf a\\ b \"c \\\"d\\\"\" e", []string{"-f", "-p", "--", "a b", `c "d"`, "e"}},
+		{"scp -f -- -dash", []string{"-f", "--", "-dash"}},
+		{"scp -t a b", nil},         // one target only
+		{"scp -t -f a", nil},        // both directions
+		{"scp -r a", nil},           // no direction
+		{"scp -t", nil},             // no target
+		{"scp -x -t a", nil},        // unknown flag
+		{"scp -f *.txt", nil},       // glob
+		{"scp -f ~/a", nil},         // tilde
+		{"scp -f a; rm -rf b", nil}, // more than scp
+		{"scp -f \"$HOME\"", nil},   // variable
+		{"scp -f 'a", nil},          // unterminated quote
+		{"rsync -t a", nil},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		c, ok := parseSCPCommand(tt.cmd)
+		if tt.want == nil {
+			if ok {
+				t.Errorf("%q: got %q; want not ok", tt.cmd, c.args())
+			}
+			continue
+		}
+		if !ok {
+			t.Errorf("%q: not ok; want %q", tt.cmd, tt.want)
+			continue
+		}
+		if got := c.args(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got %q; want %q", tt.cmd, got, tt.want)
+		}
+		if c2, ok := parseSCPArgs(c.args()); !ok || !reflect.DeepEqual(c2, c) {
+			t.Errorf("%q: args don't round trip: %+v, %v", tt.cmd, c2, ok)
+		}
+	}
+}
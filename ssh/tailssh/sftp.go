@@ -0,0 +1,189 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux || (darwin && !ios) || windows
+// +build linux darwin,!ios windows
+
+package tailssh
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pkg/sftp"
+)
+
+// sftpSubsystem is the SSH subsystem for file transfers. The incubator
+// serves it itself, as the local user, so it works without an
+// sftp-server binary on the host.
+const sftpSubsystem = "sftp"
+
+// stdio is the incubator's stdin and stdout as an io.ReadWriteCloser.
+type stdio struct{}
+
+func (stdio) Read(p []byte) (int, error)  { return os.Stdin.Read(p) }
+func (stdio) Write(p []byte) (int, error) { return os.Stdout.Write(p) }
+func (stdio) Close() error {
+	os.Stdin.Close()
+	return os.Stdout.Close()
+}
+
+// serveSFTP serves SFTP on the incubator's stdin and stdout, relative
+// to its working directory, until the client is done.
+func serveSFTP() error {
+	srv, err := sftp.NewServer(stdio{})
+	if err != nil {
+		return err
+	}
+	if err := srv.Serve(); err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// SFTP request packet types, from draft-ietf-secsh-filexfer-02.
+const (
+	sftpOpen    = 3
+	sftpSetstat = 9
+	sftpOpendir = 11
+	sftpRemove  = 13
+	sftpMkdir   = 14
+	sftpRmdir   = 15
+	sftpRename  = 18
+	sftpSymlink = 20
+)
+
+// sftpMaxHead is how much of each SFTP packet sftpRequestLogger
+// looks at, which is plenty for the paths in requests.
+const sftpMaxHead = 8 << 10
+
+// sftpRequestLogger is an io.Writer that's written what an SFTP client
+// sends, and describes the requests that open files or change the
+// file system, such as "open /etc/motd (read)", to logf.
+type sftpRequestLogger struct {
+	logf func(request string)
+
+	buf  []byte // the current packet's length, and up to sftpMaxHead bytes of it
+	left uint32 // how much of the current packet is still to come
+}
+
+func (l *sftpRequestLogger) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		if len(l.buf) < 4 {
+			take := 4 - len(l.buf)
+			if take > len(p) {
+				take = len(p)
+			}
+			l.buf = append(l.buf, p[:take]...)
+			p = p[take:]
+			if len(l.buf) == 4 {
+				l.left = binary.BigEndian.Uint32(l.buf)
+			}
+			continue
+		}
+		take := len(p)
+		if uint32(take) > l.left {
+			take = int(l.left)
+		}
+		if room := sftpMaxHead + 4 - len(l.buf); room > 0 {
+			if room > take {
+				room = take
+			}
+			l.buf = append(l.buf, p[:room]...)
+		}
+		p = p[take:]
+		l.left -= uint32(take)
+		if l.left == 0 {
+			if desc := describeSFTPRequest(l.buf[4:]); desc != "" {
+				l.logf(desc)
+			}
+			l.buf = l.buf[:0]
+		}
+	}
+	return n, nil
+}
+
+// describeSFTPRequest returns a description of the SFTP request pkt if
+// it opens a file or changes the file system, or else "".
+func describeSFTPRequest(pkt []byte) string {
+	if len(pkt) < 5 {
+		return ""
+	}
+	typ := pkt[0]
+	r := sftpReader(pkt[5:]) // after the type and request ID
+	switch typ {
+	case sftpOpen:
+		path, ok := r.string()
+		if !ok {
+			return ""
+		}
+		flags, ok := r.uint32()
+		if !ok {
+			return ""
+		}
+		var modes []string
+		for _, f := range []struct {
+			bit  uint32
+			name string
+		}{{0x01, "read"}, {0x02, "write"}, {0x04, "append"}, {0x08, "create"}, {0x10, "truncate"}, {0x20, "excl"}} {
+			if flags&f.bit != 0 {
+				modes = append(modes, f.name)
+			}
+		}
+		return fmt.Sprintf("open %s (%s)", path, strings.Join(modes, ","))
+	case sftpSetstat, sftpOpendir, sftpRemove, sftpMkdir, sftpRmdir:
+		path, ok := r.string()
+		if !ok {
+			return ""
+		}
+		name := map[byte]string{
+			sftpSetstat: "setstat",
+			sftpOpendir: "opendir",
+			sftpRemove:  "remove",
+			sftpMkdir:   "mkdir",
+			sftpRmdir:   "rmdir",
+		}[typ]
+		return name + " " + path
+	case sftpRename, sftpSymlink:
+		a, ok := r.string()
+		if !ok {
+			return ""
+		}
+		b, ok := r.string()
+		if !ok {
+			return ""
+		}
+		if typ == sftpRename {
+			return fmt.Sprintf("rename %s %s", a, b)
+		}
+		return fmt.Sprintf("symlink %s %s", a, b)
+	}
+	return ""
+}
+
+// sftpReader reads the fields of an SFTP packet.
+type sftpReader []byte
+
+func (r *sftpReader) uint32() (uint32, bool) {
+	if len(*r) < 4 {
+		return 0, false
+	}
+	v := binary.BigEndian.Uint32(*r)
+	*r = (*r)[4:]
+	return v, true
+}
+
+func (r *sftpReader) string() (string, bool) {
+	n, ok := r.uint32()
+	if !ok || uint32(len(*r)) < n {
+		return "", false
+	}
+	s := string((*r)[:n])
+	*r = (*r)[n:]
+	return s, true
+}
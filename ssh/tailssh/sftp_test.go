@@ -0,0 +1,64 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux || darwin
+// +build linux darwin
+
+package tailssh
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+func TestSFTPRequestLogger(t *testing.T) {
+	u32 := func(v uint32) []byte {
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, v)
+		return b
+	}
+	str := func(s string) []byte { return append(u32(uint32(len(s))), s...) }
+	packet := func(typ byte, fields ...[]byte) []byte {
+		body := []byte{typ, 0, 0, 0, 7} // type and request ID
+		for _, f := range fields {
+			body = append(body, f...)
+		}
+		return append(u32(uint32(len(body))), body...)
+	}
+
+	var stream []byte
+	stream = append(stream, packet(1, u32(3))...) // init
+	stream = append(stream, packet(sftpOpen, str("/etc/motd"), u32(0x01), u32(0))...)
+	stream = append(stream, packet(17, str("/tmp"))...)                       // stat; not logged
+	stream = append(stream, packet(6, str("handle"), make([]byte, 20000))...) // write
+	stream = append(stream, packet(sftpRename, str("/a"), str("/b"))...)
+	stream = append(stream, packet(sftpMkdir, str("/d"), u32(0))...)
+	stream = append(stream, packet(sftpRemove)...) // truncated; not logged
+
+	want := []string{
+		"open /etc/motd (read)",
+		"rename /a /b",
+		"mkdir /d",
+	}
+	// Feed the stream in chunks of various sizes, which split
+	// packets anywhere.
+	for _, chunk := range []int{1, 3, 7, 4096, len(stream)} {
+		var got []string
+		l := &sftpRequestLogger{logf: func(req string) { got = append(got, req) }}
+		for p := stream; len(p) > 0; {
+			n := chunk
+			if n > len(p) {
+				n = len(p)
+			}
+			if m, err := l.Write(p[:n]); m != n || err != nil {
+				t.Fatalf("Write = %v, %v", m, err)
+			}
+			p = p[n:]
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("chunk %d: got %q; want %q", chunk, got, want)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux || (darwin && !ios) || windows
+// +build linux darwin,!ios windows
+
+package tailssh
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// joinSubsystem is the SSH subsystem that joins another active pty
+// session on the node, to watch its output and, if allowed, type into
+// it. Its name is followed by a space and the session ID, and then
+// " rw" to join read-write rather than read-only.
+const joinSubsystem = "tailscale-join"
+
+// watcherBuffer is how many writes of a shared session's output may be
+// queued for one of its watchers before the watcher is dropped for
+// being too slow.
+const watcherBuffer = 256
+
+var errNotJoinable = errors.New("session can't be joined")
+
+// sessionShare is the state of a session that others may join. Its
+// zero value isn't joinable until open is called.
+type sessionShare struct {
+	mu       sync.Mutex
+	joinable bool      // between open and close
+	input    io.Writer // to the session's process
+	watchers map[*sessionWatcher]bool
+}
+
+// sessionWatcher is a session that has joined another.
+type sessionWatcher struct {
+	out chan []byte // the joined session's output; closed when it ends
+}
+
+// open makes sh joinable, with input being where read-write watchers'
+// input goes.
+func (sh *sessionShare) open(input io.Writer) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	sh.joinable = true
+	sh.input = input
+}
+
+// close makes sh unjoinable and drops its watchers.
+func (sh *sessionShare) close() {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	sh.joinable = false
+	for w := range sh.watchers {
+		close(w.out)
+		delete(sh.watchers, w)
+	}
+}
+
+// Write sends a copy of p to each watcher, dropping those that are too
+// far behind. It never fails.
+func (sh *sessionShare) Write(p []byte) (int, error) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	for w := range sh.watchers {
+		select {
+		case w.out <- append([]byte(nil), p...):
+		default:
+			close(w.out)
+			delete(sh.watchers, w)
+		}
+	}
+	return len(p), nil
+}
+
+// join adds a watcher to sh, returning it and where its input, if
+// any, goes.
+func (sh *sessionShare) join() (*sessionWatcher, io.Writer, error) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if !sh.joinable {
+		return nil, nil, errNotJoinable
+	}
+	w := &sessionWatcher{out: make(chan []byte, watcherBuffer)}
+	mapSet(&sh.watchers, w, true)
+	return w, sh.input, nil
+}
+
+// leave removes w from sh, if it's still there.
+func (sh *sessionShare) leave(w *sessionWatcher) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if sh.watchers[w] {
+		close(w.out)
+		delete(sh.watchers, w)
+	}
+}
+
+// runJoin serves the join subsystem with the given arguments, joining
+// ss to the session they name, which must be of the same local user,
+// until either ends.
+func (ss *sshSession) runJoin(args string) {
+	id, mode, _ := strings.Cut(args, " ")
+	rw := mode == "rw"
+	switch {
+	case !ss.action.AllowSessionJoin:
+		ss.logf("joining sessions not allowed")
+		io.WriteString(ss.Stderr(), "Joining sessions not allowed.\r\n")
+		ss.Exit(1)
+		return
+	case mode != "" && !rw:
+		fmt.Fprintf(ss.Stderr(), "Unknown join mode %q.\r\n", mode)
+		ss.Exit(1)
+		return
+	case rw && !ss.action.AllowSessionJoinWrite:
+		ss.logf("joining sessions read-write not allowed")
+		io.WriteString(ss.Stderr(), "Joining sessions read-write not allowed.\r\n")
+		ss.Exit(1)
+		return
+	}
+
+	ss.srv.mu.Lock()
+	target, ok := ss.srv.activeSessionBySharedID[id]
+	ss.srv.mu.Unlock()
+	if !ok || target == ss {
+		fmt.Fprintf(ss.Stderr(), "No active session %q.\r\n", id)
+		ss.Exit(1)
+		return
+	}
+	if target.localUser.Uid != ss.localUser.Uid {
+		// Watching, let alone typing into, another user's session
+		// would give the joiner that user's access.
+		ss.logf("refusing to join session %s of local user %q", id, target.localUser.Username)
+		fmt.Fprintf(ss.Stderr(), "Session %q is another local user's.\r\n", id)
+		ss.Exit(1)
+		return
+	}
+	w, input, err := target.share.join()
+	if err != nil {
+		fmt.Fprintf(ss.Stderr(), "Session %q can't be joined, as it has no pty.\r\n", id)
+		ss.Exit(1)
+		return
+	}
+	defer target.share.leave(w)
+
+	how := "read-only"
+	if rw {
+		how = "read-write"
+	}
+	who := ss.connInfo.uprof.LoginName
+	ss.logf("joined session %s %s", id, how)
+	target.logf("joined %s by %s (%v)", how, who, ss.connInfo.src.Addr())
+	fmt.Fprintf(target, "\r\n[%s joined this session %s.]\r\n", who, how)
+	defer fmt.Fprintf(target, "\r\n[%s left this session.]\r\n", who)
+
+	// The watcher's input is discarded unless it joined read-write,
+	// but is still read, to see when it leaves.
+	left := make(chan struct{})
+	go func() {
+		defer close(left)
+		dst := io.Discard
+		if rw {
+			dst = input
+		}
+		io.Copy(dst, ss)
+	}()
+	for {
+		select {
+		case b, ok := <-w.out:
+			if !ok {
+				io.WriteString(ss, "\r\n[The session ended, or this one fell too far behind.]\r\n")
+				ss.Exit(0)
+				return
+			}
+			if _, err := ss.Write(b); err != nil {
+				return
+			}
+		case <-left:
+			ss.Exit(0)
+			return
+		case <-ss.ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,213 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux || (darwin && !ios) || windows
+// +build linux darwin,!ios windows
+
+package tailssh
+
+// This file implements OpenSSH's Unix socket ("streamlocal")
+// forwarding, in both directions, for sessions whose policy allows it
+// for the sockets involved. The sockets are opened as the session's
+// local user; see streamlocal_unix.go.
+
+import (
+	"io"
+	"net"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tempfork/gliderlabs/ssh"
+	gossh "tailscale.com/tempfork/golang-x-crypto/ssh"
+)
+
+const (
+	directStreamLocalChannel    = "direct-streamlocal@openssh.com"
+	forwardedStreamLocalChannel = "forwarded-streamlocal@openssh.com"
+	streamLocalForwardRequest   = "streamlocal-forward@openssh.com"
+	cancelStreamLocalForward    = "cancel-streamlocal-forward@openssh.com"
+)
+
+// directStreamLocalData is the extra data of a direct-streamlocal
+// channel, per OpenSSH's PROTOCOL file.
+type directStreamLocalData struct {
+	SocketPath string
+	Reserved0  string
+	Reserved1  uint32
+}
+
+// streamLocalForwardData is the payload of streamlocal-forward and
+// cancel-streamlocal-forward requests.
+type streamLocalForwardData struct {
+	SocketPath string
+}
+
+// forwardedStreamLocalData is the extra data of a forwarded-streamlocal
+// channel.
+type forwardedStreamLocalData struct {
+	SocketPath string
+	Reserved   string
+}
+
+// streamLocalListener is a Unix socket listening on behalf of an SSH
+// client that asked for it to be forwarded to it.
+type streamLocalListener struct {
+	connID string // ssh.Context.SessionID of the connection it's for
+	ln     net.Listener
+}
+
+// mayForwardStreamLocal returns the session that ctx's connection is
+// running if its policy allows forwarding the Unix socket at socketPath.
+func (srv *server) mayForwardStreamLocal(ctx ssh.Context, socketPath string) (_ *sshSession, ok bool) {
+	ss, ok := srv.getSessionForContext(ctx)
+	if !ok || !ss.action.AllowStreamLocalForwarding {
+		return nil, false
+	}
+	if ss.action.Record {
+		ss.logf("refusing to forward Unix socket %q: the session must be recorded, and forwarded connections aren't", socketPath)
+		return nil, false
+	}
+	if !streamLocalPathAllowed(ss.action.StreamLocalForwardingPaths, socketPath, ss.localUser.HomeDir) {
+		ss.logf("refusing to forward Unix socket %q: not an allowed path", socketPath)
+		return nil, false
+	}
+	return ss, true
+}
+
+// streamLocalPathAllowed reports whether socketPath matches one of
+// patterns, from SSHAction.StreamLocalForwardingPaths, where "~/"
+// expands to home.
+func streamLocalPathAllowed(patterns []string, socketPath, home string) bool {
+	if !filepath.IsAbs(socketPath) || filepath.Clean(socketPath) != socketPath {
+		return false
+	}
+	for _, pat := range patterns {
+		if strings.HasPrefix(pat, "~/") {
+			if home == "" {
+				continue
+			}
+			pat = filepath.Join(home, pat[len("~/"):])
+		}
+		if !filepath.IsAbs(pat) {
+			continue
+		}
+		if ok, _ := path.Match(pat, socketPath); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// handleDirectStreamLocal is the ssh.ChannelHandler for
+// direct-streamlocal channels, which connect to a Unix socket on this
+// node.
+func (srv *server) handleDirectStreamLocal(_ *ssh.Server, _ *gossh.ServerConn, newChan gossh.NewChannel, ctx ssh.Context) {
+	var d directStreamLocalData
+	if err := gossh.Unmarshal(newChan.ExtraData(), &d); err != nil {
+		newChan.Reject(gossh.ConnectionFailed, "error parsing forward data: "+err.Error())
+		return
+	}
+	ss, ok := srv.mayForwardStreamLocal(ctx, d.SocketPath)
+	if !ok {
+		newChan.Reject(gossh.Prohibited, "Unix socket forwarding is disabled")
+		return
+	}
+	dconn, err := ss.dialStreamLocal(ctx, d.SocketPath)
+	if err != nil {
+		newChan.Reject(gossh.ConnectionFailed, err.Error())
+		return
+	}
+	ch, reqs, err := newChan.Accept()
+	if err != nil {
+		dconn.Close()
+		return
+	}
+	go gossh.DiscardRequests(reqs)
+	ev := ss.sessionEvent(ipnstate.SSHEventForward)
+	ev.ForwardTo = d.SocketPath
+	srv.publishEvent(ev)
+	go proxyStreamLocal(ch, dconn)
+}
+
+// handleStreamLocalForward is the ssh.RequestHandler for
+// streamlocal-forward and cancel-streamlocal-forward requests, which
+// start and stop listening on a Unix socket on this node and
+// forwarding its connections to the client.
+func (srv *server) handleStreamLocalForward(ctx ssh.Context, _ *ssh.Server, req *gossh.Request) (bool, []byte) {
+	var d streamLocalForwardData
+	if err := gossh.Unmarshal(req.Payload, &d); err != nil {
+		return false, nil
+	}
+	if req.Type == cancelStreamLocalForward {
+		srv.mu.Lock()
+		sl, ok := srv.streamLocalListeners[d.SocketPath]
+		srv.mu.Unlock()
+		if !ok || sl.connID != ctx.SessionID() {
+			return false, nil
+		}
+		sl.ln.Close()
+		return true, nil
+	}
+
+	ss, ok := srv.mayForwardStreamLocal(ctx, d.SocketPath)
+	if !ok {
+		return false, nil
+	}
+	ln, err := ss.listenStreamLocal(d.SocketPath)
+	if err != nil {
+		ss.logf("listening on Unix socket %q: %v", d.SocketPath, err)
+		return false, nil
+	}
+	ss.logf("forwarding Unix socket %q to the client", d.SocketPath)
+	sl := streamLocalListener{connID: ctx.SessionID(), ln: ln}
+	srv.mu.Lock()
+	mapSet(&srv.streamLocalListeners, d.SocketPath, sl)
+	srv.mu.Unlock()
+
+	conn := ctx.Value(ssh.ContextKeyConn).(*gossh.ServerConn)
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+	go func() {
+		defer func() {
+			srv.mu.Lock()
+			defer srv.mu.Unlock()
+			if srv.streamLocalListeners[d.SocketPath] == sl {
+				delete(srv.streamLocalListeners, d.SocketPath)
+			}
+		}()
+		payload := gossh.Marshal(&forwardedStreamLocalData{SocketPath: d.SocketPath})
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				ch, reqs, err := conn.OpenChannel(forwardedStreamLocalChannel, payload)
+				if err != nil {
+					c.Close()
+					return
+				}
+				go gossh.DiscardRequests(reqs)
+				proxyStreamLocal(ch, c)
+			}()
+		}
+	}()
+	return true, nil
+}
+
+// proxyStreamLocal copies between ch and c until either is done.
+func proxyStreamLocal(ch gossh.Channel, c net.Conn) {
+	go func() {
+		defer ch.Close()
+		defer c.Close()
+		io.Copy(ch, c)
+	}()
+	defer ch.Close()
+	defer c.Close()
+	io.Copy(c, ch)
+}
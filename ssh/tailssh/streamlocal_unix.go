@@ -0,0 +1,256 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux || (darwin && !ios)
+// +build linux darwin,!ios
+
+package tailssh
+
+// This file does the socket operations of Unix socket forwarding as
+// the session's local user, in a "tailscaled be-child ssh-streamlocal"
+// process that hands the socket back to tailscaled, so that forwarding
+// gives the client no more access to sockets, or to the directories
+// they're in, than the user has.
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"tailscale.com/cmd/tailscaled/childproc"
+)
+
+func init() {
+	childproc.Add("ssh-streamlocal", beStreamLocal)
+}
+
+// Operations of "tailscaled be-child ssh-streamlocal".
+const (
+	streamLocalDial   = "dial"
+	streamLocalListen = "listen"
+	streamLocalUnlink = "unlink"
+)
+
+// streamLocalChildTimeout bounds how long a ssh-streamlocal child may
+// take, as it may block on a socket that nothing accepts on.
+const streamLocalChildTimeout = 10 * time.Second
+
+// runsAsLocalUser reports whether this process already is ss's local
+// user, so it can do what the user can without a child process.
+func (ss *sshSession) runsAsLocalUser() bool {
+	return ss.localUser.Uid == strconv.Itoa(os.Geteuid())
+}
+
+// dialStreamLocal connects to the Unix socket at socketPath as ss's
+// local user.
+func (ss *sshSession) dialStreamLocal(ctx context.Context, socketPath string) (net.Conn, error) {
+	if ss.runsAsLocalUser() {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", socketPath)
+	}
+	f, err := ss.streamLocalAsUser(ctx, streamLocalDial, socketPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return net.FileConn(f)
+}
+
+// listenStreamLocal listens on a new Unix socket at socketPath that ss's
+// local user creates, and that only it can use. Closing the listener
+// removes the socket, as the user too.
+func (ss *sshSession) listenStreamLocal(socketPath string) (net.Listener, error) {
+	if ss.runsAsLocalUser() {
+		ln, err := net.Listen("unix", socketPath)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.Chmod(socketPath, 0600); err != nil {
+			ln.Close()
+			return nil, err
+		}
+		return ln, nil
+	}
+	f, err := ss.streamLocalAsUser(context.Background(), streamLocalListen, socketPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	ln, err := net.FileListener(f)
+	if err != nil {
+		ss.streamLocalAsUser(context.Background(), streamLocalUnlink, socketPath)
+		return nil, err
+	}
+	return &userSocketListener{
+		Listener: ln,
+		unlink: func() {
+			if _, err := ss.streamLocalAsUser(context.Background(), streamLocalUnlink, socketPath); err != nil {
+				ss.logf("removing Unix socket %q: %v", socketPath, err)
+			}
+		},
+	}, nil
+}
+
+// userSocketListener is a listener on a Unix socket that a
+// ssh-streamlocal child made, which its Close has another remove.
+type userSocketListener struct {
+	net.Listener
+	unlinkOnce sync.Once
+	unlink     func()
+}
+
+func (l *userSocketListener) Close() error {
+	err := l.Listener.Close()
+	l.unlinkOnce.Do(l.unlink)
+	return err
+}
+
+// streamLocalAsUser does the operation op on the Unix socket at
+// socketPath as ss's local user, in a ssh-streamlocal child, and
+// returns the socket it made, if any.
+func (ss *sshSession) streamLocalAsUser(ctx context.Context, op, socketPath string) (*os.File, error) {
+	if ss.srv.tailscaledPath == "" {
+		return nil, errors.New("forwarding another user's Unix sockets needs the incubator")
+	}
+	ctx, cancel := context.WithTimeout(ctx, streamLocalChildTimeout)
+	defer cancel()
+	pc, pf, err := socketPair()
+	if err != nil {
+		return nil, err
+	}
+	defer pc.Close()
+	cmd := exec.CommandContext(ctx, ss.srv.tailscaledPath, "be-child", "ssh-streamlocal",
+		"--uid="+ss.localUser.Uid,
+		"--op="+op,
+		"--", socketPath)
+	cmd.ExtraFiles = []*os.File{pf} // fd 3
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err = cmd.Start()
+	pf.Close()
+	if err != nil {
+		return nil, err
+	}
+	var f *os.File
+	var recvErr error
+	if op != streamLocalUnlink {
+		// Until the child exits, closing its end, if it fails.
+		f, recvErr = recvFile(pc.(*net.UnixConn))
+	}
+	if err := cmd.Wait(); err != nil {
+		if f != nil {
+			f.Close()
+		}
+		if msg := bytes.TrimSpace(stderr.Bytes()); len(msg) > 0 {
+			return nil, errors.New(string(msg))
+		}
+		return nil, err
+	}
+	return f, recvErr
+}
+
+// beStreamLocal is the entrypoint of "tailscaled be-child
+// ssh-streamlocal". As the user with the given --uid, it dials or
+// listens on the Unix socket at its path argument, sending the socket
+// over the Unix socket on fd 3, or removes it.
+func beStreamLocal(args []string) error {
+	flags := flag.NewFlagSet("ssh-streamlocal", flag.ExitOnError)
+	uid := flags.Uint64("uid", 0, "the uid of the user to act as")
+	op := flags.String("op", "", "dial, listen or unlink")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("want one socket path")
+	}
+	socketPath := flags.Arg(0)
+	if uint64(os.Geteuid()) != *uid {
+		if err := dropPrivileges(*uid); err != nil {
+			return err
+		}
+	}
+	switch *op {
+	case streamLocalDial:
+		c, err := net.Dial("unix", socketPath)
+		if err != nil {
+			return err
+		}
+		f, err := c.(*net.UnixConn).File()
+		if err != nil {
+			return err
+		}
+		return sendFile(os.NewFile(3, "parent"), f)
+	case streamLocalListen:
+		// So the socket is the user's only from the start, rather
+		// than chmodded afterwards.
+		syscall.Umask(0177)
+		ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: socketPath, Net: "unix"})
+		if err != nil {
+			return err
+		}
+		ln.SetUnlinkOnClose(false)
+		f, err := ln.File()
+		if err != nil {
+			return err
+		}
+		return sendFile(os.NewFile(3, "parent"), f)
+	case streamLocalUnlink:
+		fi, err := os.Lstat(socketPath)
+		if err != nil {
+			return err
+		}
+		if fi.Mode().Type() != fs.ModeSocket {
+			return fmt.Errorf("%s isn't a socket", socketPath)
+		}
+		return os.Remove(socketPath)
+	}
+	return fmt.Errorf("unknown operation %q", *op)
+}
+
+// sendFile sends f over the Unix socket conn.
+func sendFile(conn, f *os.File) error {
+	c, err := net.FileConn(conn)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	_, _, err = c.(*net.UnixConn).WriteMsgUnix([]byte{0}, syscall.UnixRights(int(f.Fd())), nil)
+	return err
+}
+
+// recvFile receives a file that sendFile sent over c.
+func recvFile(c *net.UnixConn) (*os.File, error) {
+	buf := make([]byte, 1)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	_, oobn, _, _, err := c.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, err
+	}
+	if len(msgs) != 1 {
+		return nil, errors.New("no file received")
+	}
+	fds, err := syscall.ParseUnixRights(&msgs[0])
+	if err != nil {
+		return nil, err
+	}
+	if len(fds) != 1 {
+		for _, fd := range fds {
+			syscall.Close(fd)
+		}
+		return nil, errors.New("no file received")
+	}
+	return os.NewFile(uintptr(fds[0]), "streamlocal"), nil
+}
@@ -0,0 +1,24 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tailssh
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// errStreamLocalUnsupported is returned on Windows, where tailscaled
+// can't open Unix sockets as the session's local user, and so doesn't
+// open them at all.
+var errStreamLocalUnsupported = errors.New("Unix socket forwarding isn't supported on Windows")
+
+func (ss *sshSession) dialStreamLocal(ctx context.Context, socketPath string) (net.Conn, error) {
+	return nil, errStreamLocalUnsupported
+}
+
+func (ss *sshSession) listenStreamLocal(socketPath string) (net.Listener, error) {
+	return nil, errStreamLocalUnsupported
+}
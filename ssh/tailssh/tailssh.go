@@ -2,8 +2,8 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-//go:build linux || (darwin && !ios)
-// +build linux darwin,!ios
+//go:build linux || (darwin && !ios) || windows
+// +build linux darwin,!ios windows
 
 // Package tailssh is an SSH server integrated into Tailscale.
 package tailssh
@@ -17,50 +17,122 @@
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net"
 	"net/http"
+	"net/netip"
 	"net/url"
 	"os"
 	"os/exec"
 	"os/user"
+	"path"
 	"path/filepath"
 	"runtime"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
+	"unicode"
 
-	gossh "github.com/tailscale/golang-x-crypto/ssh"
+	"github.com/fsnotify/fsnotify"
+	"golang.org/x/sync/singleflight"
 	"inet.af/netaddr"
 	"tailscale.com/envknob"
+	"tailscale.com/health"
 	"tailscale.com/ipn/ipnlocal"
+	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/logtail/backoff"
+	"tailscale.com/net/netns"
+	"tailscale.com/net/tlsdial"
 	"tailscale.com/net/tsaddr"
+	"tailscale.com/net/tshttpproxy"
 	"tailscale.com/tailcfg"
 	"tailscale.com/tempfork/gliderlabs/ssh"
+	gossh "tailscale.com/tempfork/golang-x-crypto/ssh"
 	"tailscale.com/types/logger"
+	"tailscale.com/types/netmap"
+	"tailscale.com/util/clientmetric"
+	"tailscale.com/util/netconv"
 )
 
 var (
 	debugPolicyFile             = envknob.String("TS_DEBUG_SSH_POLICY_FILE")
 	debugIgnoreTailnetSSHPolicy = envknob.Bool("TS_DEBUG_SSH_IGNORE_TAILNET_POLICY")
 	sshVerboseLogging           = envknob.Bool("TS_DEBUG_SSH_VLOG")
+
+	// bannerFile, if non-empty, is a file whose contents are shown to
+	// SSH clients before they authenticate, unless the SSH policy has
+	// a Banner. See authBanner.
+	bannerFile = envknob.String("TS_SSH_BANNER_FILE")
 )
 
+// ipnLocalBackend is the subset of ipnlocal.LocalBackend that the SSH
+// server uses, so tests can fake it.
+type ipnLocalBackend interface {
+	GetSSH_HostKeys() ([]gossh.Signer, error)
+	NetMap() *netmap.NetworkMap
+	WhoIs(netaddr.IPPort) (_ *tailcfg.Node, _ tailcfg.UserProfile, ok bool)
+	DoNoiseRequest(*http.Request) (*http.Response, error)
+	TailscaleVarRoot() string
+	DialPeerSSHAgent(ctx context.Context, peer netaddr.IP, sport, dport uint16) (io.ReadWriteCloser, error)
+	DialPeerTCP(ctx context.Context, ipp netaddr.IPPort) (net.Conn, error)
+}
+
 type server struct {
-	lb             *ipnlocal.LocalBackend
+	lb             ipnLocalBackend
 	logf           logger.Logf
 	tailscaledPath string
 
-	pubKeyHTTPClient *http.Client     // or nil for http.DefaultClient
+	pubKeyHTTPClient *http.Client     // or nil for the default client
 	timeNow          func() time.Time // or nil for time.Now
 
+	// connChildPath, if non-empty, is the binary to run isolated
+	// connection child processes with, instead of tailscaledPath.
+	// It's for tests.
+	connChildPath string
+
+	// isConnChild is whether the server is handling a single
+	// connection in an isolated child process.
+	isConnChild bool
+
+	// onEvent, if non-nil, is also called with each published
+	// event. Connection child processes use it to send their events
+	// to tailscaled.
+	onEvent func(ipnstate.SSHEvent)
+
+	defaultPubKeyClientOnce sync.Once
+	defaultPubKeyClient     *http.Client
+
+	// ephemeralUsersMu serializes the creation and removal of
+	// ephemeral users, and guards ephemeralUsers, their number of
+	// sessions by name. It's not mu, as useradd can be slow.
+	ephemeralUsersMu sync.Mutex
+	ephemeralUsers   map[string]int
+
+	// userResolves deduplicates concurrent runs of the user resolver
+	// for the same login name; see resolveDirectoryUser.
+	userResolves singleflight.Group
+
 	// mu protects the following
 	mu                      sync.Mutex
+	running                 bool                        // between Start and Stop
+	activeConns             map[net.Conn]bool           // conns being handled
 	activeSessionByH        map[string]*sshSession      // ssh.SessionID (DH H) => session
 	activeSessionBySharedID map[string]*sshSession      // yyymmddThhmmss-XXXXX => session
 	fetchPublicKeysCache    map[string]pubKeyCacheEntry // by https URL
+	recentRejections        []rejection                 // oldest first; at most maxRecentRejections
+	sharedAgents            map[*sshSession]sharedAgent // sessions whose agent peers may use
+	recentEvents            []ipnstate.SSHEvent         // oldest first; at most maxRecentEvents
+	eventSubscribers        map[*eventSubscriber]bool
+	connChildren            map[*os.Process]bool           // isolated connection child processes
+	connChildSessions       map[string]ipnstate.SSHEvent   // by session ID; their start events
+	streamLocalListeners    map[string]streamLocalListener // by socket path
+	debugPolicyWatcher      *fsnotify.Watcher              // of debugPolicyFile's directory, while running
+	debugPolicyState        *debugPolicyState              // last load by debugPolicyWatcher
+	resolvedUsers           map[string]resolvedUser        // by login name; see resolveDirectoryUser
+	drainTimer              *time.Timer                    // ends the drain Stop started, if non-nil
+	drained                 chan struct{}                  // closed when Stop's drain is over; nil if not draining
+	connSlots               chan struct{}                  // one value per connection being handled, if maxConns > 0
 }
 
 func (srv *server) now() time.Time {
@@ -85,10 +157,32 @@ func init() {
 	})
 }
 
-// HandleSSHConn handles a Tailscale SSH connection from c.
+// HandleSSHConn handles a Tailscale SSH connection from c. If the
+// server is stopped, or it's handling maxConns connections already
+// and none end soon, it closes c and returns an error.
 func (srv *server) HandleSSHConn(c net.Conn) error {
+	release, ok := srv.acquireConnSlot()
+	if !ok {
+		srv.refuseConn(c)
+		return errTooManyConns
+	}
+	defer release()
+	untrack, err := srv.trackConn(c)
+	if err != nil {
+		c.Close()
+		return err
+	}
+	defer untrack()
+	if isolateConns && !srv.isConnChild {
+		if err := srv.handleConnIsolated(c); err != nil {
+			c.Close()
+			return err
+		}
+		return nil
+	}
 	ss, err := srv.newSSHServer()
 	if err != nil {
+		c.Close()
 		return err
 	}
 	ss.HandleConn(c)
@@ -107,6 +201,7 @@ func (srv *server) OnPolicyChange() {
 	for _, s := range srv.activeSessionByH {
 		go s.checkStillValid()
 	}
+	srv.signalConnChildrenLocked(syscall.SIGHUP)
 }
 
 func (srv *server) newSSHServer() (*ssh.Server, error) {
@@ -114,26 +209,65 @@ func (srv *server) newSSHServer() (*ssh.Server, error) {
 		Handler:           srv.handleSSH,
 		RequestHandlers:   map[string]ssh.RequestHandler{},
 		SubsystemHandlers: map[string]ssh.SubsystemHandler{},
-		// Note: the direct-tcpip channel handler and LocalPortForwardingCallback
-		// only adds support for forwarding ports from the local machine.
+		// Note: the direct-tcpip channel handler only adds support for
+		// forwarding ports from the local machine.
 		// TODO(maisem/bradfitz): add remote port forwarding support.
 		ChannelHandlers: map[string]ssh.ChannelHandler{
-			"direct-tcpip": ssh.DirectTCPIPHandler,
+			directTCPIPChannel:       srv.handleDirectTCPIP,
+			directStreamLocalChannel: srv.handleDirectStreamLocal,
 		},
-		Version:                     "SSH-2.0-Tailscale",
-		LocalPortForwardingCallback: srv.mayForwardLocalPortTo,
+		Version: "SSH-2.0-Tailscale",
 		NoClientAuthCallback: func(m gossh.ConnMetadata) (*gossh.Permissions, error) {
-			if srv.requiresPubKey(m.User(), toIPPort(m.LocalAddr()), toIPPort(m.RemoteAddr())) {
+			srv.publishEvent(ipnstate.SSHEvent{
+				Type:    ipnstate.SSHEventAuthAttempt,
+				Src:     netconv.AsIPPort(toAddrPort(m.RemoteAddr())),
+				SSHUser: m.User(),
+			})
+			if srv.requiresPubKey(m.User(), toAddrPort(m.LocalAddr()), toAddrPort(m.RemoteAddr())) {
 				return nil, errors.New("public key required") // any non-nil error will do
 			}
+			if srv.requiresInteractiveAuth(m.User(), toAddrPort(m.LocalAddr()), toAddrPort(m.RemoteAddr())) {
+				return nil, errors.New("keyboard-interactive auth required")
+			}
 			return nil, nil
 		},
+		KeyboardInteractiveHandler: srv.handleKeyboardInteractive,
+		BannerHandler:              srv.authBanner,
+		ServerConfigCallback: func(ssh.Context) *gossh.ServerConfig {
+			cfg := new(gossh.ServerConfig)
+			if pol, ok := srv.sshPolicy(); ok && len(pol.PubKeyAlgorithms) > 0 {
+				// So that gossh also refuses signatures with other
+				// algorithms, like SHA-1 ones with "ssh-rsa" keys.
+				cfg.PublicKeyAuthAlgorithms = pol.PubKeyAlgorithms
+			}
+			cfg.PublicKeySignatureCallback = srv.checkPubKeySignature
+			return cfg
+		},
 		PublicKeyHandler: func(ctx ssh.Context, key ssh.PublicKey) bool {
-			if srv.acceptPubKey(ctx.User(), toIPPort(ctx.LocalAddr()), toIPPort(ctx.RemoteAddr()), key) {
+			srv.publishEvent(ipnstate.SSHEvent{
+				Type:    ipnstate.SSHEventAuthAttempt,
+				Src:     netconv.AsIPPort(toAddrPort(ctx.RemoteAddr())),
+				SSHUser: ctx.User(),
+				PubKey:  gossh.FingerprintSHA256(key),
+			})
+			if pol, ok := srv.sshPolicy(); ok {
+				if err := pubKeyAlgorithmAllowed(pol, key); err != nil {
+					srv.logf("rejecting SSH public key %s: %v", bytes.TrimSpace(gossh.MarshalAuthorizedKey(key)), err)
+					srv.noteRejection(toAddrPort(ctx.RemoteAddr()), ctx.User(), err.Error())
+					return false
+				}
+			}
+			if srv.requiresInteractiveAuth(ctx.User(), toAddrPort(ctx.LocalAddr()), toAddrPort(ctx.RemoteAddr())) {
+				// Not a rejection; the client needs to move on to
+				// keyboard-interactive auth.
+				return false
+			}
+			if srv.acceptPubKey(ctx.User(), toAddrPort(ctx.LocalAddr()), toAddrPort(ctx.RemoteAddr()), key) {
 				srv.logf("accepting SSH public key %s", bytes.TrimSpace(gossh.MarshalAuthorizedKey(key)))
 				return true
 			}
 			srv.logf("rejecting SSH public key %s", bytes.TrimSpace(gossh.MarshalAuthorizedKey(key)))
+			srv.noteRejection(toAddrPort(ctx.RemoteAddr()), ctx.User(), "public key "+gossh.FingerprintSHA256(key)+" not accepted")
 			return false
 		},
 	}
@@ -146,35 +280,69 @@ func (srv *server) newSSHServer() (*ssh.Server, error) {
 	for k, v := range ssh.DefaultSubsystemHandlers {
 		ss.SubsystemHandlers[k] = v
 	}
+	ss.RequestHandlers[streamLocalForwardRequest] = srv.handleStreamLocalForward
+	ss.RequestHandlers[cancelStreamLocalForward] = srv.handleStreamLocalForward
+	// Subsystems are sessions like any other, subject to the policy.
+	// run decides which it supports.
+	ss.SubsystemHandlers["default"] = srv.handleSSH
 	keys, err := srv.lb.GetSSH_HostKeys()
+	if err == nil && len(keys) == 0 {
+		err = errors.New("no host keys")
+	}
+	health.SetSSHHostKeysHealth(err)
 	if err != nil {
 		return nil, err
 	}
 	for _, signer := range keys {
 		ss.AddHostKey(signer)
 	}
+	for _, signer := range srv.hostCertSigners(keys) {
+		ss.AddHostKey(signer)
+	}
 	return ss, nil
 }
 
-// mayForwardLocalPortTo reports whether the ctx should be allowed to port forward
-// to the specified host and port.
-// TODO(bradfitz/maisem): should we have more checks on host/port?
-func (srv *server) mayForwardLocalPortTo(ctx ssh.Context, destinationHost string, destinationPort uint32) bool {
-	ss, ok := srv.getSessionForContext(ctx)
-	if !ok {
-		return false
+// authBanner returns the banner to show SSH clients before they
+// authenticate: the SSH policy's Banner if it has one, else the
+// contents of bannerFile, if any. It's read anew for each connection,
+// so that edits apply without a restart.
+//
+// If the policy restricts public key algorithms, the banner ends
+// with which ones, as clients are told no more than "permission
+// denied" when they use others.
+func (srv *server) authBanner(ctx ssh.Context) string {
+	pol, ok := srv.sshPolicy()
+	var banner string
+	if ok && pol.Banner != "" {
+		banner = pol.Banner
+	} else if bannerFile != "" {
+		b, err := os.ReadFile(bannerFile)
+		if err != nil {
+			srv.logf("ssh: reading banner file: %v", err)
+		}
+		banner = string(b)
+	}
+	if ok && len(pol.PubKeyAlgorithms) > 0 {
+		if banner != "" && !strings.HasSuffix(banner, "\n") {
+			banner += "\n"
+		}
+		banner += "This server only accepts public keys using: " + strings.Join(pol.PubKeyAlgorithms, ", ") + "\n"
 	}
-	return ss.action.AllowLocalPortForwarding
+	return banner
 }
 
 // requiresPubKey reports whether the SSH server, during the auth negotiation
 // phase, should requires that the client send an SSH public key. (or, more
 // specifically, that "none" auth isn't acceptable)
-func (srv *server) requiresPubKey(sshUser string, localAddr, remoteAddr netaddr.IPPort) bool {
+func (srv *server) requiresPubKey(sshUser string, localAddr, remoteAddr netip.AddrPort) bool {
 	pol, ok := srv.sshPolicy()
 	if !ok {
 		return false
 	}
+	if len(pol.PubKeyAlgorithms) > 0 {
+		// Only keys of those algorithms may authenticate.
+		return true
+	}
 	a, ci, _, err := srv.evaluatePolicy(sshUser, localAddr, remoteAddr, nil)
 	if err == nil && (a.Accept || a.HoldAndDelegate != "") {
 		// Policy doesn't require a public key.
@@ -190,10 +358,10 @@ func (srv *server) requiresPubKey(sshUser string, localAddr, remoteAddr netaddr.
 	// Is there any rule that looks like it'd require a public key for this
 	// sshUser?
 	for _, r := range pol.Rules {
-		if ci.ruleExpired(r) {
+		if ci.ruleExpired(r) || !ci.ruleScheduled(r) {
 			continue
 		}
-		if mapLocalUser(r.SSHUsers, sshUser) == "" {
+		if mapLocalUser(r.SSHUsers, ci) == "" {
 			continue
 		}
 		for _, p := range r.Principals {
@@ -205,7 +373,7 @@ func (srv *server) requiresPubKey(sshUser string, localAddr, remoteAddr netaddr.
 	return false
 }
 
-func (srv *server) acceptPubKey(sshUser string, localAddr, remoteAddr netaddr.IPPort, pubKey ssh.PublicKey) bool {
+func (srv *server) acceptPubKey(sshUser string, localAddr, remoteAddr netip.AddrPort, pubKey ssh.PublicKey) bool {
 	a, _, _, err := srv.evaluatePolicy(sshUser, localAddr, remoteAddr, pubKey)
 	if err != nil {
 		return false
@@ -217,40 +385,41 @@ func (srv *server) acceptPubKey(sshUser string, localAddr, remoteAddr netaddr.IP
 // If there is no SSHPolicy in the netmap, it returns a debugPolicy
 // if one is defined.
 func (srv *server) sshPolicy() (_ *tailcfg.SSHPolicy, ok bool) {
+	pol, _, ok := srv.sshPolicyAndSource()
+	return pol, ok
+}
+
+// sshPolicyAndSource is like sshPolicy but also returns where the
+// policy came from: "tailnet" or "debug file <path>".
+func (srv *server) sshPolicyAndSource() (_ *tailcfg.SSHPolicy, source string, ok bool) {
 	lb := srv.lb
 	nm := lb.NetMap()
 	if nm == nil {
-		return nil, false
+		return nil, "", false
 	}
 	if pol := nm.SSHPolicy; pol != nil && !debugIgnoreTailnetSSHPolicy {
-		return pol, true
+		health.SetSSHPolicyHealth(nil)
+		return pol, "tailnet", true
 	}
 	if debugPolicyFile != "" {
-		f, err := os.ReadFile(debugPolicyFile)
+		p, err := srv.debugPolicy()
 		if err != nil {
-			srv.logf("error reading debug SSH policy file: %v", err)
-			return nil, false
-		}
-		p := new(tailcfg.SSHPolicy)
-		if err := json.Unmarshal(f, p); err != nil {
-			srv.logf("invalid JSON in %v: %v", debugPolicyFile, err)
-			return nil, false
+			health.SetSSHPolicyHealth(err)
+			return nil, "", false
 		}
-		return p, true
+		health.SetSSHPolicyHealth(nil)
+		return p, "debug file " + debugPolicyFile, true
 	}
-	return nil, false
+	return nil, "", false
 }
 
-func toIPPort(a net.Addr) (ipp netaddr.IPPort) {
+func toAddrPort(a net.Addr) (ipp netip.AddrPort) {
 	ta, ok := a.(*net.TCPAddr)
 	if !ok {
 		return
 	}
-	tanetaddr, ok := netaddr.FromStdIP(ta.IP)
-	if !ok {
-		return
-	}
-	return netaddr.IPPortFrom(tanetaddr, uint16(ta.Port))
+	ap := ta.AddrPort()
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
 }
 
 // evaluatePolicy returns the SSHAction, sshConnInfo and localUser after
@@ -259,24 +428,25 @@ func toIPPort(a net.Addr) (ipp netaddr.IPPort) {
 //
 // The return sshConnInfo will be non-nil, even on some errors, if the
 // evaluation made it far enough to resolve the remoteAddr to a Tailscale IP.
-func (srv *server) evaluatePolicy(sshUser string, localAddr, remoteAddr netaddr.IPPort, pubKey ssh.PublicKey) (_ *tailcfg.SSHAction, _ *sshConnInfo, localUser string, _ error) {
+func (srv *server) evaluatePolicy(sshUser string, localAddr, remoteAddr netip.AddrPort, pubKey ssh.PublicKey) (_ *tailcfg.SSHAction, _ *sshConnInfo, localUser string, _ error) {
 	pol, ok := srv.sshPolicy()
 	if !ok {
 		return nil, nil, "", fmt.Errorf("tailssh: rejecting connection; no SSH policy")
 	}
-	if !tsaddr.IsTailscaleIP(remoteAddr.IP()) {
+	if !tsaddr.IsTailscaleIP(netconv.AsIP(remoteAddr.Addr())) {
 		return nil, nil, "", fmt.Errorf("tailssh: rejecting non-Tailscale remote address %v", remoteAddr)
 	}
-	if !tsaddr.IsTailscaleIP(localAddr.IP()) {
+	if !tsaddr.IsTailscaleIP(netconv.AsIP(localAddr.Addr())) {
 		return nil, nil, "", fmt.Errorf("tailssh: rejecting non-Tailscale remote address %v", localAddr)
 	}
-	node, uprof, ok := srv.lb.WhoIs(remoteAddr)
+	node, uprof, ok := srv.lb.WhoIs(netconv.AsIPPort(remoteAddr))
 	if !ok {
 		return nil, nil, "", fmt.Errorf("unknown Tailscale identity from src %v", remoteAddr)
 	}
 	ci := &sshConnInfo{
 		now:                srv.now(),
 		fetchPublicKeysURL: srv.fetchPublicKeysURL,
+		readAuthorizedKeys: readAuthorizedKeys,
 		sshUser:            sshUser,
 		src:                remoteAddr,
 		dst:                localAddr,
@@ -284,24 +454,86 @@ func (srv *server) evaluatePolicy(sshUser string, localAddr, remoteAddr netaddr.
 		uprof:              &uprof,
 		pubKey:             pubKey,
 	}
-	a, localUser, ok := evalSSHPolicy(pol, ci)
+	ci.resolveLocalUser = func(loginName string) (string, error) {
+		name, err := srv.resolveDirectoryUser(loginName)
+		if errors.Is(err, errUserResolverFailing) {
+			ci.userResolverFailed = true
+		}
+		return name, err
+	}
+	if nm := srv.lb.NetMap(); nm != nil {
+		ci.dnsSuffix = nm.MagicDNSSuffix()
+	}
+	if err := pubKeyAlgorithmAllowed(pol, pubKey); err != nil {
+		return nil, ci, "", err
+	}
+	a, localUser, rule, ok := evalSSHPolicy(pol, ci)
 	if !ok {
-		return nil, ci, "", fmt.Errorf("ssh: access denied for %q from %v", uprof.LoginName, ci.src.IP())
+		return nil, ci, "", fmt.Errorf("ssh: access denied for %q from %v", uprof.LoginName, ci.src.Addr())
 	}
+	ci.rule = rule
 	return a, ci, localUser, nil
 }
 
+// checkPubKeySignature refuses signatures by security keys whose flags
+// don't show what the options of the authorized key they were accepted
+// as require: user presence unless no-touch-required, and user
+// verification if verify-required.
+func (srv *server) checkPubKeySignature(conn gossh.ConnMetadata, key gossh.PublicKey, sig *gossh.Signature) error {
+	if !isSecurityKey(key) {
+		return nil
+	}
+	_, ci, _, err := srv.evaluatePolicy(conn.User(), toAddrPort(conn.LocalAddr()), toAddrPort(conn.RemoteAddr()), key)
+	if err != nil {
+		return err
+	}
+	if err := ci.keyOpts.checkSecurityKeySignature(sig); err != nil {
+		srv.noteRejection(ci.src, conn.User(), err.Error())
+		return err
+	}
+	return nil
+}
+
+// pubKeyAlgorithmAllowed reports whether pol allows clients to
+// authenticate with pubKey, by whether any of its algorithms are
+// allowed. If pol restricts algorithms at all, a nil pubKey, for a
+// client that offered none, isn't allowed.
+//
+// Only gossh knows which algorithm a client signed with, so it
+// enforces the rest, through ServerConfig.PublicKeyAuthAlgorithms.
+func pubKeyAlgorithmAllowed(pol *tailcfg.SSHPolicy, pubKey ssh.PublicKey) error {
+	if len(pol.PubKeyAlgorithms) == 0 {
+		return nil
+	}
+	if pubKey == nil {
+		return fmt.Errorf("the SSH policy requires a public key using: %s",
+			strings.Join(pol.PubKeyAlgorithms, ", "))
+	}
+	for _, algo := range pol.PubKeyAlgorithms {
+		if pubKey.Type() == algo {
+			return nil
+		}
+		if pubKey.Type() == gossh.KeyAlgoRSA && (algo == gossh.KeyAlgoRSASHA256 || algo == gossh.KeyAlgoRSASHA512) {
+			return nil
+		}
+	}
+	return fmt.Errorf("public key algorithm %s not allowed by the SSH policy; allowed: %s",
+		pubKey.Type(), strings.Join(pol.PubKeyAlgorithms, ", "))
+}
+
 // pubKeyCacheEntry is the cache value for an HTTPS URL of public keys (like
 // "https://github.com/foo.keys")
 type pubKeyCacheEntry struct {
-	lines []string
-	etag  string // if sent by server
-	at    time.Time
+	lines   []string
+	etag    string // if sent by server
+	at      time.Time
+	retryAt time.Time // if rate limited, when to ask again
 }
 
 const (
 	pubKeyCacheDuration      = time.Minute      // how long to cache non-empty public keys
 	pubKeyCacheEmptyDuration = 15 * time.Second // how long to cache empty responses
+	pubKeyMaxRateLimitWait   = time.Hour        // most a rate limit makes us wait
 )
 
 func (srv *server) fetchPublicKeysURLCached(url string) (ce pubKeyCacheEntry, ok bool) {
@@ -320,6 +552,10 @@ func (srv *server) fetchPublicKeysURLCached(url string) (ce pubKeyCacheEntry, ok
 	if !ok {
 		return ce, false
 	}
+	if srv.now().Before(ce.retryAt) {
+		// Rate limited; the last keys fetched are all we have.
+		return ce, true
+	}
 	maxAge := pubKeyCacheDuration
 	if len(ce.lines) == 0 {
 		maxAge = pubKeyCacheEmptyDuration
@@ -331,7 +567,26 @@ func (srv *server) pubKeyClient() *http.Client {
 	if srv.pubKeyHTTPClient != nil {
 		return srv.pubKeyHTTPClient
 	}
-	return http.DefaultClient
+	srv.defaultPubKeyClientOnce.Do(func() {
+		srv.defaultPubKeyClient = &http.Client{Transport: newPubKeyTransport(srv.logf)}
+	})
+	return srv.defaultPubKeyClient
+}
+
+// newPubKeyTransport returns the transport for fetching public keys
+// from HTTPS URLs. Like control connections, it dials outside of
+// Tailscale, honors the system's proxy settings, and verifies certs
+// with tlsdial, which falls back to baked-in roots on devices whose
+// trust store is broken or stale.
+func newPubKeyTransport(logf logger.Logf) *http.Transport {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.Proxy = tshttpproxy.ProxyFromEnvironment
+	tshttpproxy.SetTransportGetProxyConnectHeader(tr)
+	tr.DialContext = netns.NewDialer(logf).DialContext
+	// The keys can be on any host, so leave the ServerName empty for
+	// the transport to fill in per connection.
+	tr.TLSClientConfig = tlsdial.Config("", tr.TLSClientConfig)
+	return tr
 }
 
 func (srv *server) fetchPublicKeysURL(url string) ([]string, error) {
@@ -360,14 +615,29 @@ func (srv *server) fetchPublicKeysURL(url string) ([]string, error) {
 	defer res.Body.Close()
 	var lines []string
 	var etag string
-	switch res.StatusCode {
+	var retryAt time.Time
+	// GitHub says it's rate limiting with a 403 and no requests
+	// remaining, rather than a 429.
+	rateLimited := res.StatusCode == http.StatusTooManyRequests ||
+		res.StatusCode == http.StatusForbidden && res.Header.Get("X-Ratelimit-Remaining") == "0"
+	switch {
 	default:
 		err = fmt.Errorf("unexpected status %v", res.Status)
 		srv.logf("fetching public keys from %s: %v", url, err)
-	case http.StatusNotModified:
+	case rateLimited:
+		// Keep using the keys we last got, if any, until we may
+		// ask again.
 		lines = ce.lines
 		etag = ce.etag
-	case http.StatusOK:
+		retryAt = rateLimitRetryAt(res.Header, srv.now())
+		srv.logf("fetching public keys from %s: rate limited until %v", url, retryAt.Format(time.RFC3339))
+		if len(lines) == 0 {
+			err = fmt.Errorf("rate limited: %v", res.Status)
+		}
+	case res.StatusCode == http.StatusNotModified:
+		lines = ce.lines
+		etag = ce.etag
+	case res.StatusCode == http.StatusOK:
 		var all []byte
 		all, err = io.ReadAll(io.LimitReader(res.Body, 4<<10))
 		if s := strings.TrimSpace(string(all)); s != "" {
@@ -379,36 +649,119 @@ func (srv *server) fetchPublicKeysURL(url string) ([]string, error) {
 	srv.mu.Lock()
 	defer srv.mu.Unlock()
 	mapSet(&srv.fetchPublicKeysCache, url, pubKeyCacheEntry{
-		at:    srv.now(),
-		lines: lines,
-		etag:  etag,
+		at:      srv.now(),
+		lines:   lines,
+		etag:    etag,
+		retryAt: retryAt,
 	})
 	return lines, err
 }
 
+// rateLimitRetryAt returns when a server that rate limited a request,
+// responding with h, may be asked again, going by its Retry-After or
+// X-Ratelimit-Reset (as sent by GitHub and GitLab) headers.
+func rateLimitRetryAt(h http.Header, now time.Time) time.Time {
+	at := now.Add(pubKeyCacheDuration)
+	if secs, err := strconv.ParseInt(h.Get("Retry-After"), 10, 64); err == nil {
+		at = now.Add(time.Duration(secs) * time.Second)
+	} else if unix, err := strconv.ParseInt(h.Get("X-Ratelimit-Reset"), 10, 64); err == nil {
+		at = time.Unix(unix, 0)
+	}
+	if max := now.Add(pubKeyMaxRateLimitWait); at.After(max) {
+		return max
+	}
+	if at.Before(now) {
+		return now
+	}
+	return at
+}
+
+// pubKeySourceURL returns the URL to fetch public keys from for k, an
+// element of SSHPrincipal.PubKeys, if it's not a literal key: k itself
+// if it's an "https://" URL, or that of a "github:username" or
+// "gitlab:username" shorthand.
+func pubKeySourceURL(k string) (url string, ok bool) {
+	if strings.HasPrefix(k, "https://") {
+		return k, true
+	}
+	forge, user, ok := strings.Cut(k, ":")
+	if !ok {
+		return "", false
+	}
+	var host string
+	switch forge {
+	case "github":
+		host = "github.com"
+	case "gitlab":
+		host = "gitlab.com"
+	default:
+		return "", false
+	}
+	if !validForgeUsername(user) {
+		return "", false
+	}
+	// Usernames are case-insensitive; lowercase them so each user's
+	// keys are cached once.
+	return "https://" + host + "/" + strings.ToLower(user) + ".keys", true
+}
+
+// validForgeUsername reports whether u is safe to use as a GitHub or
+// GitLab username in a URL path.
+func validForgeUsername(u string) bool {
+	if u == "" || u[0] == '.' || u[0] == '-' || len(u) > 255 {
+		return false
+	}
+	for _, r := range u {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9':
+		case r == '-', r == '_', r == '.':
+		default:
+			return false
+		}
+	}
+	return !strings.Contains(u, "..")
+}
+
 // handleSSH is invoked when a new SSH connection attempt is made.
 func (srv *server) handleSSH(s ssh.Session) {
 	logf := srv.logf
+	if !srv.isRunning() {
+		// The connection is being drained; see Stop.
+		io.WriteString(s.Stderr(), "Tailscale SSH is shutting down on this machine.\r\n")
+		s.Exit(1)
+		return
+	}
 
 	sshUser := s.User()
-	action, ci, localUser, err := srv.evaluatePolicy(sshUser, toIPPort(s.LocalAddr()), toIPPort(s.RemoteAddr()), s.PublicKey())
+	action, ci, localUser, err := srv.evaluatePolicy(sshUser, toAddrPort(s.LocalAddr()), toAddrPort(s.RemoteAddr()), s.PublicKey())
 	if err != nil {
 		logf(err.Error())
+		srv.noteRejection(toAddrPort(s.RemoteAddr()), sshUser, err.Error())
 		s.Exit(1)
 		return
 	}
 	var lu *user.User
 	if localUser != "" {
-		lu, err = user.Lookup(localUser)
+		lu, err = lookupLocalUser(localUser)
+		if err != nil && (action.JumpTo != "" || action.EphemeralUser != "") {
+			// Jump sessions don't run anything locally; the user
+			// only names who to be on the target. Ephemeral users
+			// are only made once access is granted.
+			lu, err = &user.User{Username: localUser}, nil
+		}
 		if err != nil {
 			logf("ssh: user Lookup %q: %v", localUser, err)
 			s.Exit(1)
 			return
 		}
 	}
+	if a, ok := s.Context().Value(interactiveAuthActionKey).(*tailcfg.SSHAction); ok {
+		// Already followed during keyboard-interactive auth.
+		action = a
+	}
 	ss := srv.newSSHSession(s, ci, lu)
-	ss.logf("handling new SSH connection from %v (%v) to ssh-user %q", ci.uprof.LoginName, ci.src.IP(), sshUser)
-	action, err = ss.resolveTerminalAction(action)
+	ss.logf("handling new SSH connection from %v (%v) to ssh-user %q", ci.uprof.LoginName, ci.src.Addr(), sshUser)
+	action, err = ss.resolveTerminalAction(ss.Context(), action)
 	if err != nil {
 		ss.logf("resolveTerminalAction: %v", err)
 		io.WriteString(s.Stderr(), "Access denied: failed to resolve SSHAction.\n")
@@ -416,12 +769,38 @@ func (srv *server) handleSSH(s ssh.Session) {
 		return
 	}
 	if action.Reject || !action.Accept {
-		ss.logf("access denied for %v (%v)", ci.uprof.LoginName, ci.src.IP())
+		ss.logf("access denied for %v (%v)", ci.uprof.LoginName, ci.src.Addr())
+		srv.noteRejection(ci.src, sshUser, "access denied by policy for "+ci.uprof.LoginName)
 		s.Exit(1)
 		return
 	}
-	ss.logf("access granted for %v (%v) to ssh-user %q", ci.uprof.LoginName, ci.src.IP(), sshUser)
-	ss.action = action
+	if g := action.RequireLocalGroup; g != "" && action.JumpTo == "" && action.EphemeralUser == "" {
+		if err := checkLocalGroup(lu, g); err != nil {
+			ss.logf("access denied for %v (%v): %v", ci.uprof.LoginName, ci.src.Addr(), err)
+			srv.noteRejection(ci.src, sshUser, err.Error())
+			fmt.Fprintf(s.Stderr(), "Access denied: local user %q isn't in group %q.\r\n", lu.Username, g)
+			s.Exit(1)
+			return
+		}
+	}
+	if mode := action.EphemeralUser; mode != "" && action.JumpTo == "" {
+		name := ephemeralUserName(mode, ci, ss.sharedID)
+		release, err := srv.acquireEphemeralUser(name)
+		if err == nil {
+			defer release()
+			lu, err = lookupLocalUser(name)
+		}
+		if err != nil {
+			ss.logf("ephemeral user: %v", err)
+			io.WriteString(s.Stderr(), "Can't create a local user for this session.\r\n")
+			s.Exit(1)
+			return
+		}
+		ss.localUser = lu
+	}
+	ss.logf("access granted for %v (%v) to ssh-user %q", ci.uprof.LoginName, ci.src.Addr(), sshUser)
+	ss.action = ci.keyOpts.apply(action)
+	srv.publishEvent(ss.sessionEvent(ipnstate.SSHEventAccept))
 	ss.run()
 }
 
@@ -431,7 +810,7 @@ func (srv *server) handleSSH(s ssh.Session) {
 // Any action with a Message in the chain will be printed to ss.
 //
 // The returned SSHAction will be either Reject or Accept.
-func (ss *sshSession) resolveTerminalAction(action *tailcfg.SSHAction) (*tailcfg.SSHAction, error) {
+func (ss *sshSession) resolveTerminalAction(ctx context.Context, action *tailcfg.SSHAction) (*tailcfg.SSHAction, error) {
 	// Loop processing/fetching Actions until one reaches a
 	// terminal state (Accept, Reject, or invalid Action), or
 	// until fetchSSHAction times out due to the context being
@@ -449,31 +828,67 @@ func (ss *sshSession) resolveTerminalAction(action *tailcfg.SSHAction) (*tailcfg
 		if url == "" {
 			return nil, errors.New("reached Action that lacked Accept, Reject, and HoldAndDelegate")
 		}
-		url = ss.expandDelegateURL(url)
+		if action.Prompt != "" {
+			return nil, errors.New("reached Action with a Prompt outside of keyboard-interactive auth")
+		}
+		url = ss.srv.expandDelegateURL(ss.connInfo, ss.mappedUser, url)
+		var body []byte
+		if action.HoldAndDelegatePOST {
+			dr := ss.srv.delegateRequest(ss.connInfo, ss.mappedUser)
+			dr.SessionID = ss.sharedID
+			dr.Command = ss.RawCommand()
+			dr.Subsystem = ss.Subsystem()
+			body, _ = json.Marshal(dr)
+		}
 		var err error
-		action, err = ss.srv.fetchSSHAction(ss.Context(), url)
+		action, err = ss.srv.fetchSSHAction(ctx, url, body)
 		if err != nil {
 			return nil, fmt.Errorf("fetching SSHAction from %s: %w", url, err)
 		}
 	}
 }
 
-func (ss *sshSession) expandDelegateURL(actionURL string) string {
-	nm := ss.srv.lb.NetMap()
+// expandDelegateURL expands the variables in actionURL, a
+// HoldAndDelegate URL, for the connection ci as localUser.
+func (srv *server) expandDelegateURL(ci *sshConnInfo, localUser, actionURL string) string {
+	nm := srv.lb.NetMap()
 	var dstNodeID string
 	if nm != nil {
 		dstNodeID = fmt.Sprint(int64(nm.SelfNode.ID))
 	}
 	return strings.NewReplacer(
-		"$SRC_NODE_IP", url.QueryEscape(ss.connInfo.src.IP().String()),
-		"$SRC_NODE_ID", fmt.Sprint(int64(ss.connInfo.node.ID)),
-		"$DST_NODE_IP", url.QueryEscape(ss.connInfo.dst.IP().String()),
+		"$SRC_NODE_IP", url.QueryEscape(ci.src.Addr().String()),
+		"$SRC_NODE_ID", fmt.Sprint(int64(ci.node.ID)),
+		"$DST_NODE_IP", url.QueryEscape(ci.dst.Addr().String()),
 		"$DST_NODE_ID", dstNodeID,
-		"$SSH_USER", url.QueryEscape(ss.connInfo.sshUser),
-		"$LOCAL_USER", url.QueryEscape(ss.localUser.Username),
+		"$SSH_USER", url.QueryEscape(ci.sshUser),
+		"$LOCAL_USER", url.QueryEscape(localUser),
 	).Replace(actionURL)
 }
 
+// delegateRequest returns the body of a HoldAndDelegatePOST request
+// for the connection ci as localUser, with what's known of it before a
+// session is asked for.
+func (srv *server) delegateRequest(ci *sshConnInfo, localUser string) *tailcfg.SSHDelegateRequest {
+	dr := &tailcfg.SSHDelegateRequest{
+		SrcNode:   ci.node,
+		SrcAddr:   netconv.AsIPPort(ci.src),
+		DstAddr:   netconv.AsIPPort(ci.dst),
+		SSHUser:   ci.sshUser,
+		LocalUser: localUser,
+	}
+	if ci.uprof != nil {
+		dr.User = *ci.uprof
+	}
+	if nm := srv.lb.NetMap(); nm != nil && nm.SelfNode != nil {
+		dr.DstNodeID = nm.SelfNode.ID
+	}
+	if ci.pubKey != nil {
+		dr.PubKeyFingerprint = gossh.FingerprintSHA256(ci.pubKey)
+	}
+	return dr
+}
+
 // sshSession is an accepted Tailscale SSH session.
 type sshSession struct {
 	ssh.Session
@@ -486,7 +901,9 @@ type sshSession struct {
 	connInfo      *sshConnInfo
 	action        *tailcfg.SSHAction
 	localUser     *user.User
+	mappedUser    string       // local user the policy maps to, unlike localUser for ephemeral users
 	agentListener net.Listener // non-nil if agent-forwarding requested+allowed
+	cgroupDir     string       // the session's cgroup, if it has SessionLimits
 
 	// initialized by launchProcess:
 	cmd    *exec.Cmd
@@ -495,6 +912,14 @@ type sshSession struct {
 	stderr io.Reader // nil for pty sessions
 	ptyReq *ssh.Pty  // non-nil for pty sessions
 
+	share sessionShare // for other sessions joining this one
+
+	// forwardsMu guards the port forwarding state below, which
+	// OnPolicyChange updates while the session stays valid.
+	forwardsMu    sync.Mutex
+	forwardAction *tailcfg.SSHAction    // latest action for forwards; nil means action
+	forwards      map[*portForward]bool // open forwarded TCP connections
+
 	// We use this sync.Once to ensure that we only terminate the process once,
 	// either it exits itself or is terminated
 	exitOnce sync.Once
@@ -508,24 +933,51 @@ func (ss *sshSession) vlogf(format string, args ...interface{}) {
 
 func (srv *server) newSSHSession(s ssh.Session, ci *sshConnInfo, lu *user.User) *sshSession {
 	sharedID := fmt.Sprintf("%s-%02x", ci.now.UTC().Format("20060102T150405"), randBytes(5))
+	var mappedUser string
+	if lu != nil {
+		mappedUser = lu.Username
+	}
 	return &sshSession{
-		Session:   s,
-		idH:       s.Context().(ssh.Context).SessionID(),
-		sharedID:  sharedID,
-		ctx:       newSSHContext(),
-		srv:       srv,
-		localUser: lu,
-		connInfo:  ci,
-		logf:      logger.WithPrefix(srv.logf, "ssh-session("+sharedID+"): "),
+		Session:    s,
+		idH:        s.Context().(ssh.Context).SessionID(),
+		sharedID:   sharedID,
+		ctx:        newSSHContext(),
+		srv:        srv,
+		localUser:  lu,
+		mappedUser: mappedUser,
+		connInfo:   ci,
+		logf:       sessionLogf(srv.logf, sharedID),
 	}
 }
 
+// sessionLogf returns the logger for the session with the given shared
+// ID. It's rate limited and drops repeated lines, since things like the
+// stdin/stdout copy goroutines can fail over and over on flaky
+// connections and would otherwise flood the logs.
+func sessionLogf(logf logger.Logf, sharedID string) logger.Logf {
+	logf = logger.WithPrefix(logf, "ssh-session("+sharedID+"): ")
+	logf = logger.RateLimitedFn(logf, time.Second, 10, 50)
+	return logger.Deduplicated(logf, time.Minute, time.Now)
+}
+
 // checkStillValid checks that the session is still valid per the latest SSHPolicy.
 // If not, it terminates the session.
 func (ss *sshSession) checkStillValid() {
 	ci := ss.connInfo
-	a, _, lu, err := ss.srv.evaluatePolicy(ci.sshUser, ci.src, ci.dst, ci.pubKey)
-	if err == nil && (a.Accept || a.HoldAndDelegate != "") && lu == ss.localUser.Username {
+	a, newCI, lu, err := ss.srv.evaluatePolicy(ci.sshUser, ci.dst, ci.src, ci.pubKey)
+	if err != nil && newCI != nil && newCI.userResolverFailed {
+		// The session may well still be valid; it's re-checked
+		// on the next policy change.
+		ss.logf("can't re-check session against new SSH policy, as the user resolver is failing; keeping it")
+		return
+	}
+	if err == nil && (a.Accept || a.HoldAndDelegate != "") && lu == ss.mappedUser {
+		if a.Accept {
+			// The session's forwarding permissions may have
+			// changed even so. (Delegated ones are only known
+			// once they're followed, so they're left alone.)
+			ss.updateForwardAction(newCI.keyOpts.apply(a))
+		}
 		return
 	}
 	ss.logf("session no longer valid per new SSH policy; closing")
@@ -535,21 +987,109 @@ func (ss *sshSession) checkStillValid() {
 	})
 }
 
-func (srv *server) fetchSSHAction(ctx context.Context, url string) (*tailcfg.SSHAction, error) {
+// runCheckPeriod re-authorizes ss every period until it ends, closing
+// it if re-authorization fails. See SSHAction.CheckPeriod.
+func (ss *sshSession) runCheckPeriod(period time.Duration) {
+	t := time.NewTimer(period)
+	defer t.Stop()
+	for {
+		select {
+		case <-ss.ctx.Done():
+			return
+		case <-t.C:
+		}
+		if err := ss.reauthorize(); err != nil {
+			if ss.ctx.Err() != nil {
+				return
+			}
+			ss.logf("re-authorization failed: %v; closing", err)
+			ss.ctx.CloseWithError(userVisibleError{
+				"Re-authorization failed; session closed.\n",
+				err,
+			})
+			return
+		}
+		ss.logf("re-authorized")
+		t.Reset(period)
+	}
+}
+
+// reauthorize evaluates the policy for ss again, following any
+// HoldAndDelegate URL, and reports whether the session may continue.
+func (ss *sshSession) reauthorize() error {
+	ci := ss.connInfo
+	a, newCI, lu, err := ss.srv.evaluatePolicy(ci.sshUser, ci.dst, ci.src, ci.pubKey)
+	if err != nil {
+		return err
+	}
+	if lu != ss.mappedUser {
+		return fmt.Errorf("local user is now %q", lu)
+	}
+	a, err = ss.resolveTerminalAction(ss.ctx, a)
+	if err != nil {
+		return err
+	}
+	if a.Reject || !a.Accept {
+		return errors.New("access denied")
+	}
+	ss.updateForwardAction(newCI.keyOpts.apply(a))
+	return nil
+}
+
+// fetchSSHActionMaxFailing is how long fetchSSHAction keeps retrying
+// while every attempt fails, as opposed to the delegate endpoint
+// holding the request open while it waits for approval.
+const fetchSSHActionMaxFailing = 5 * time.Minute
+
+// fetchSSHAction fetches the next SSHAction from url, a HoldAndDelegate
+// URL, with a GET, or with a POST of body if it's non-nil.
+func (srv *server) fetchSSHAction(ctx context.Context, url string, body []byte) (*tailcfg.SSHAction, error) {
 	ctx, cancel := context.WithTimeout(ctx, 30*time.Minute)
 	defer cancel()
 	bo := backoff.NewBackoff("fetch-ssh-action", srv.logf, 10*time.Second)
+	// Many nodes may be polling the same delegate endpoint at
+	// once, so spread their retries out.
+	bo.FullJitter = true
+	bo.MaxElapsed = fetchSSHActionMaxFailing
+	bo.OnAttempt = func(attempt int, err error, delay time.Duration) {
+		srv.logf("[v1] fetch of %v: attempt %d failed: %v; retrying in %v", url, attempt, err, delay.Round(time.Millisecond))
+	}
+	// retry backs off after err, or returns a non-nil error if it's
+	// time to give up.
+	retry := func(err error) error {
+		if ctx.Err() == nil {
+			health.SetSSHDelegateHealth(fmt.Errorf("check endpoint: %w", err))
+		}
+		bo.BackOff(ctx, err)
+		if bo.Exhausted() {
+			return fmt.Errorf("giving up after %v of failures: %w", fetchSSHActionMaxFailing, err)
+		}
+		return nil
+	}
 	for {
 		if err := ctx.Err(); err != nil {
 			return nil, err
 		}
-		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		var req *http.Request
+		var err error
+		if body != nil {
+			req, err = http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+			if err == nil {
+				req.Header.Set("Content-Type", "application/json")
+			}
+		} else {
+			req, err = http.NewRequestWithContext(ctx, "GET", url, nil)
+		}
 		if err != nil {
 			return nil, err
 		}
+		start := time.Now()
 		res, err := srv.lb.DoNoiseRequest(req)
 		if err != nil {
-			bo.BackOff(ctx, err)
+			metricActionFetchErrors.Add(1)
+			if err := retry(err); err != nil {
+				return nil, err
+			}
 			continue
 		}
 		if res.StatusCode != 200 {
@@ -559,7 +1099,10 @@ func (srv *server) fetchSSHAction(ctx context.Context, url string) (*tailcfg.SSH
 				body = body[:1<<10]
 			}
 			srv.logf("fetch of %v: %s, %s", url, res.Status, body)
-			bo.BackOff(ctx, fmt.Errorf("unexpected status: %v", res.Status))
+			metricActionFetchErrors.Add(1)
+			if err := retry(fmt.Errorf("unexpected status: %v", res.Status)); err != nil {
+				return nil, err
+			}
 			continue
 		}
 		a := new(tailcfg.SSHAction)
@@ -567,9 +1110,15 @@ func (srv *server) fetchSSHAction(ctx context.Context, url string) (*tailcfg.SSH
 		res.Body.Close()
 		if err != nil {
 			srv.logf("invalid next SSHAction JSON from %v: %v", url, err)
-			bo.BackOff(ctx, err)
+			metricActionFetchErrors.Add(1)
+			if err := retry(err); err != nil {
+				return nil, err
+			}
 			continue
 		}
+		metricActionFetches.Add(1)
+		metricActionFetchMillis.Add(time.Since(start).Milliseconds())
+		health.SetSSHDelegateHealth(nil)
 		return a, nil
 	}
 }
@@ -588,11 +1137,73 @@ func (ss *sshSession) killProcessOnContextDone() {
 				io.WriteString(ss.Stderr(), "\r\n\r\n"+msg+"\r\n\r\n")
 			}
 		}
-		ss.logf("terminating SSH session from %v: %v", ss.connInfo.src.IP(), err)
-		ss.cmd.Process.Kill()
+		ss.logf("terminating SSH session from %v: %v", ss.connInfo.src.Addr(), err)
+		ss.terminateProcess()
 	})
 }
 
+// incubatorTermTimeout is how long an incubator has to end its command
+// and close its login or PAM session once sent SIGTERM, before it's
+// killed.
+const incubatorTermTimeout = 5 * time.Second
+
+// terminateProcess ends ss's process. An incubator is sent SIGTERM, so
+// that it ends its command and closes the sessions it opened, rather
+// than leave them and the command behind, and is only killed if it
+// hasn't exited within incubatorTermTimeout.
+func (ss *sshSession) terminateProcess() {
+	p := ss.cmd.Process
+	if ss.srv.tailscaledPath == "" || p.Signal(syscall.SIGTERM) != nil {
+		p.Kill()
+		return
+	}
+	time.AfterFunc(incubatorTermTimeout, func() { p.Kill() })
+}
+
+// startWithStdPipes starts cmd with os.Pipe for Stdin, Stdout and Stderr.
+// Unlike those of cmd.StdoutPipe and cmd.StderrPipe, the output pipes
+// stay open after cmd.Wait, for run to drain.
+func (ss *sshSession) startWithStdPipes() (err error) {
+	var closers []io.Closer // on error
+	defer func() {
+		if err != nil {
+			for _, c := range closers {
+				c.Close()
+			}
+		}
+	}()
+	cmd := ss.cmd
+	if cmd == nil {
+		return errors.New("nil cmd")
+	}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	closers = append(closers, stdin)
+	stdout, stdoutW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer stdoutW.Close() // the child's
+	closers = append(closers, stdout)
+	stderr, stderrW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer stderrW.Close() // the child's
+	closers = append(closers, stderr)
+	cmd.Stdout = stdoutW
+	cmd.Stderr = stderrW
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	ss.stdin = stdin
+	ss.stdout = stdout
+	ss.stderr = stderr
+	return nil
+}
+
 // sessionAction returns the SSHAction associated with the session.
 func (srv *server) getSessionForContext(sctx ssh.Context) (ss *sshSession, ok bool) {
 	srv.mu.Lock()
@@ -639,78 +1250,98 @@ func (ss *sshSession) handleSSHAgentForwarding(s ssh.Session, lu *user.User) err
 		return nil
 	}
 	ss.logf("ssh: agent forwarding requested")
-	ln, err := ssh.NewAgentListener()
-	if err != nil {
-		return err
-	}
-	defer func() {
-		if err != nil && ln != nil {
-			ln.Close()
-		}
-	}()
-
-	uid, err := strconv.ParseUint(lu.Uid, 10, 32)
+	ln, err := ss.newUserAgentListener(lu)
 	if err != nil {
 		return err
 	}
-	gid, err := strconv.ParseUint(lu.Gid, 10, 32)
-	if err != nil {
-		return err
-	}
-	socket := ln.Addr().String()
-	dir := filepath.Dir(socket)
-	// Make sure the socket is accessible by the user.
-	if err := os.Chown(socket, int(uid), int(gid)); err != nil {
-		return err
-	}
-	if err := os.Chmod(dir, 0755); err != nil {
-		return err
-	}
-
 	go ssh.ForwardAgentConnections(ln, s)
 	ss.agentListener = ln
 	return nil
 }
 
-// recordSSH is a temporary dev knob to test the SSH recording
-// functionality and support off-node streaming.
-//
-// TODO(bradfitz,maisem): move this to SSHPolicy.
+// recordSSH is a dev knob that records every session that can be
+// recorded, whether or not its action sets SSHAction.Record.
 var recordSSH = envknob.Bool("TS_DEBUG_LOG_SSH")
 
 // run is the entrypoint for a newly accepted SSH session.
 //
 // It handles ss once it's been accepted and determined
 // that it should run.
+// sessionDuration returns how long a session with action a may stay
+// open, or zero for no limit. It's taken from the deprecated
+// SesssionDuration if SessionDuration isn't set, for Go callers that
+// still set that.
+func sessionDuration(a *tailcfg.SSHAction) time.Duration {
+	if a.SessionDuration != 0 {
+		return a.SessionDuration
+	}
+	return a.SesssionDuration
+}
+
 func (ss *sshSession) run() {
 	srv := ss.srv
 	srv.startSession(ss)
 	defer srv.endSession(ss)
+	srv.publishEvent(ss.sessionEvent(ipnstate.SSHEventSessionStart))
+	defer func() { srv.publishEvent(ss.sessionEvent(ipnstate.SSHEventSessionEnd)) }()
 
 	defer ss.ctx.CloseWithError(errSessionDone)
 
-	if ss.action.SesssionDuration != 0 {
-		t := time.AfterFunc(ss.action.SesssionDuration, func() {
+	if d := sessionDuration(ss.action); d != 0 {
+		t := time.AfterFunc(d, func() {
 			ss.ctx.CloseWithError(userVisibleError{
-				fmt.Sprintf("Session timeout of %v elapsed.", ss.action.SesssionDuration),
+				fmt.Sprintf("Session timeout of %v elapsed.", d),
 				context.DeadlineExceeded,
 			})
 		})
 		defer t.Stop()
 	}
+	if p := ss.action.CheckPeriod; p > 0 {
+		go ss.runCheckPeriod(p)
+	}
 
-	logf := srv.logf
-	lu := ss.localUser
-	localUser := lu.Username
-
-	if euid := os.Geteuid(); euid != 0 {
-		if lu.Uid != fmt.Sprint(euid) {
-			ss.logf("can't switch to user %q from process euid %v", localUser, euid)
-			fmt.Fprintf(ss, "can't switch user\n")
+	if ko := ss.connInfo.keyOpts; ko != nil && ko.noPty {
+		if _, _, isPty := ss.Pty(); isPty {
+			ss.logf("refusing pty session for no-pty key")
+			fmt.Fprintf(ss.Stderr(), "PTY allocation disabled for this key.\r\n")
 			ss.Exit(1)
 			return
 		}
 	}
+	if ss.action.SFTPOnly && ss.subsystem() != sftpSubsystem {
+		ss.logf("refusing non-SFTP session to SFTP-only user")
+		fmt.Fprintf(ss.Stderr(), "This account is restricted to SFTP.\r\n")
+		ss.Exit(1)
+		return
+	}
+	if name, id, _ := strings.Cut(ss.subsystem(), " "); name == playbackSubsystem {
+		ss.runPlayback(id)
+		return
+	}
+	if name, args, _ := strings.Cut(ss.subsystem(), " "); name == joinSubsystem {
+		ss.runJoin(args)
+		return
+	}
+	if ss.action.JumpTo != "" {
+		ss.runJump()
+		return
+	}
+	if sub := ss.subsystem(); sub != "" && sub != sftpSubsystem {
+		ss.logf("unsupported subsystem %q", sub)
+		fmt.Fprintf(ss.Stderr(), "Unsupported subsystem %q.\r\n", sub)
+		ss.Exit(1)
+		return
+	}
+
+	logf := ss.logf
+	lu := ss.localUser
+
+	if err := canRunAs(lu); err != nil {
+		ss.logf("%v", err)
+		fmt.Fprintf(ss, "can't switch user\n")
+		ss.Exit(1)
+		return
+	}
 
 	// Take control of the PTY so that we can configure it below.
 	// See https://github.com/tailscale/tailscale/issues/4146
@@ -718,58 +1349,102 @@ func (ss *sshSession) run() {
 
 	if err := ss.handleSSHAgentForwarding(ss, lu); err != nil {
 		ss.logf("agent forwarding failed: %v", err)
+	} else if err := ss.handlePeerAgentForwarding(lu); err != nil {
+		ss.logf("peer agent forwarding failed: %v", err)
 	} else if ss.agentListener != nil {
 		// TODO(maisem/bradfitz): add a way to close all session resources
 		defer ss.agentListener.Close()
 	}
 
-	var rec *recording // or nil if disabled
-	if ss.shouldRecord() {
-		var err error
-		rec, err = ss.startNewRecording()
-		if err != nil {
-			fmt.Fprintf(ss, "can't start new recording\n")
-			ss.logf("startNewRecording: %v", err)
-			ss.Exit(1)
-			return
-		}
+	rec, ok := ss.maybeStartRecording() // rec is nil if disabled
+	if !ok {
+		return
+	}
+	if rec != nil {
 		defer rec.Close()
 	}
 
+	if !ss.maybeStartCgroup() {
+		return
+	}
+	if ss.cgroupDir != "" {
+		defer func() {
+			// It fails if processes of the session are still
+			// running, such as ones started with nohup.
+			if err := os.Remove(ss.cgroupDir); err != nil {
+				logf("removing session cgroup: %v", err)
+			}
+		}()
+	}
+
 	err := ss.launchProcess(ss.ctx)
 	if err != nil {
 		logf("start failed: %v", err.Error())
 		ss.Exit(1)
 		return
 	}
+	srv.publishEvent(ss.execEvent())
 	go ss.killProcessOnContextDone()
-
+	defer ss.srv.shareAgent(ss)()
+
+	// SFTP sessions' streams are binary, so what's recorded of them
+	// is a description of each request that changes anything.
+	isSFTP := ss.subsystem() == sftpSubsystem
+	stdin, stdout := rec.writer("i", ss.stdin), rec.writer("o", ss)
+	if isSFTP {
+		stdin = io.MultiWriter(&sftpRequestLogger{logf: func(req string) {
+			logf("sftp: %s", req)
+			rec.writer("i", io.Discard).Write([]byte(req + "\n"))
+		}}, ss.stdin)
+		stdout = ss
+	}
+	isPty := ss.stderr == nil
+	if isPty {
+		// Other sessions may join pty sessions; see runJoin.
+		ss.share.open(stdin)
+		defer ss.share.close()
+		stdout = io.MultiWriter(stdout, &ss.share)
+	}
 	go func() {
-		_, err := io.Copy(rec.writer("i", ss.stdin), ss)
+		_, err := io.Copy(stdin, ss)
 		if err != nil {
 			// TODO: don't log in the success case.
 			logf("ssh: stdin copy: %v", err)
 		}
 		ss.stdin.Close()
 	}()
+	// Output pipes are drained after Wait, which doesn't close them;
+	// see startWithStdPipes. That doesn't apply to ptys, whose output
+	// doesn't end while we hold the tty open anyway.
+	var pipesDone sync.WaitGroup
+	if !isPty {
+		pipesDone.Add(2)
+	}
 	go func() {
-		_, err := io.Copy(rec.writer("o", ss), ss.stdout)
+		_, err := io.Copy(stdout, ss.stdout)
 		if err != nil {
 			// TODO: don't log in the success case.
 			logf("ssh: stdout copy: %v", err)
 		}
+		if !isPty {
+			pipesDone.Done()
+		}
 	}()
 	// stderr is nil for ptys.
 	if ss.stderr != nil {
 		go func() {
-			_, err := io.Copy(ss.Stderr(), ss.stderr)
+			_, err := io.Copy(rec.writer("o", ss.Stderr()), ss.stderr)
 			if err != nil {
 				// TODO: don't log in the success case.
 				logf("ssh: stderr copy: %v", err)
 			}
+			pipesDone.Done()
 		}()
 	}
 	err = ss.cmd.Wait()
+	if !isPty {
+		ss.drainOutput(&pipesDone)
+	}
 	// This will either make the SSH Termination goroutine be a no-op,
 	// or itself will be a no-op because the process was killed by the
 	// aforementioned goroutine.
@@ -781,6 +1456,11 @@ func (ss *sshSession) run() {
 		return
 	}
 	if ee, ok := err.(*exec.ExitError); ok {
+		if sig, core, ok := exitSignal(ee.ProcessState); ok {
+			ss.logf("Wait: signal=%v core=%v", sig, core)
+			ss.ExitSignal(sig, core, "")
+			return
+		}
 		code := ee.ProcessState.ExitCode()
 		ss.logf("Wait: code=%v", code)
 		ss.Exit(code)
@@ -792,12 +1472,88 @@ func (ss *sshSession) run() {
 	return
 }
 
+// outputDrainTimeout is how long sessions' output is still read for
+// once their process has exited, for what's left in the pipes, or
+// what the process's background children write meanwhile.
+const outputDrainTimeout = 2 * time.Second
+
+// drainOutput waits for the copies of ss's output pipes, which pipesDone
+// tracks, to finish, for up to outputDrainTimeout. Background processes
+// that the session's process left may hold the pipes open forever, so
+// it then closes them, abandoning the copies.
+func (ss *sshSession) drainOutput(pipesDone *sync.WaitGroup) {
+	done := make(chan struct{})
+	go func() {
+		pipesDone.Wait()
+		close(done)
+	}()
+	t := time.NewTimer(outputDrainTimeout)
+	defer t.Stop()
+	select {
+	case <-done:
+		return
+	case <-t.C:
+	}
+	ss.logf("output still open %v after the process exited; closing it", outputDrainTimeout)
+	for _, r := range []io.Reader{ss.stdout, ss.stderr} {
+		if c, ok := r.(io.Closer); ok {
+			c.Close()
+		}
+	}
+}
+
+// maybeStartCgroup makes ss a cgroup limited to its action's
+// SessionLimits, if it has any, and sets ss.cgroupDir. If it fails, it
+// ends ss and returns ok false.
+func (ss *sshSession) maybeStartCgroup() (ok bool) {
+	lim := ss.action.SessionLimits
+	if lim == nil {
+		return true
+	}
+	var err error
+	if ss.srv.tailscaledPath == "" {
+		// It's the incubator that joins the cgroup, before it
+		// starts anything.
+		err = errors.New("session limits need the incubator")
+	} else {
+		ss.cgroupDir, err = newSessionCgroup(ss.sharedID, lim)
+	}
+	if err != nil {
+		ss.logf("can't limit session: %v", err)
+		io.WriteString(ss.Stderr(), "Can't apply this session's resource limits.\r\n")
+		ss.Exit(1)
+		return false
+	}
+	return true
+}
+
+// maybeStartRecording starts recording ss if it should be recorded. The
+// returned recording is nil if not. If it fails, it ends ss and
+// returns ok false.
+func (ss *sshSession) maybeStartRecording() (_ *recording, ok bool) {
+	if !ss.shouldRecord() {
+		return nil, true
+	}
+	rec, err := ss.startNewRecording()
+	health.SetSSHRecordingHealth(err)
+	if err != nil && ss.action.RecordingFailure == recordingFailureContinue {
+		ss.logf("startNewRecording: %v; continuing unrecorded", err)
+		return nil, true
+	}
+	if err != nil {
+		fmt.Fprintf(ss, "can't start new recording\n")
+		ss.logf("startNewRecording: %v", err)
+		ss.Exit(1)
+		return nil, false
+	}
+	return rec, true
+}
+
+// shouldRecord reports whether ss should be recorded, which is up to
+// its action. Sessions of every kind are: pty ones, commands run
+// without a pty (such as scp), and SFTP ones.
 func (ss *sshSession) shouldRecord() bool {
-	// for now only record pty sessions
-	// TODO(bradfitz,maisem): make configurable on SSHPolicy and
-	// support recording non-pty stuff too.
-	_, _, isPtyReq := ss.Pty()
-	return recordSSH && isPtyReq
+	return recordSSH || ss.action.Record
 }
 
 type sshConnInfo struct {
@@ -808,15 +1564,27 @@ type sshConnInfo struct {
 	// keys of a URL. The strings are in the the typical public
 	// key "type base64-string [comment]" format seen at e.g. https://github.com/USER.keys
 	fetchPublicKeysURL func(url string) ([]string, error)
+	// readAuthorizedKeys, if non-nil, is a func to read the public
+	// keys in a local user's ~/.ssh/authorized_keys file, in the same
+	// format as fetchPublicKeysURL's.
+	readAuthorizedKeys func(localUser string) ([]string, error)
+	// resolveLocalUser, if non-nil, is a func to map a login name to a
+	// local user name with the node's user resolver, for the
+	// {directoryuser} placeholder of SSHUsers templates.
+	resolveLocalUser func(loginName string) (string, error)
+	// userResolverFailed is whether resolveLocalUser failed as the
+	// user resolver couldn't answer, rather than as it said there's
+	// no such user.
+	userResolverFailed bool
 
 	// sshUser is the requested local SSH username ("root", "alice", etc).
 	sshUser string
 
 	// src is the Tailscale IP and port that the connection came from.
-	src netaddr.IPPort
+	src netip.AddrPort
 
 	// dst is the Tailscale IP and port that the connection came for.
-	dst netaddr.IPPort
+	dst netip.AddrPort
 
 	// node is srcIP's node.
 	node *tailcfg.Node
@@ -824,10 +1592,23 @@ type sshConnInfo struct {
 	// uprof is node's UserProfile.
 	uprof *tailcfg.UserProfile
 
+	// dnsSuffix is this node's MagicDNS suffix, like
+	// "example.ts.net", which qualifies bare SSHPrincipal.NodeName
+	// patterns. It's empty without a netmap.
+	dnsSuffix string
+
 	// pubKey is the public key presented by the client, or nil
 	// if they haven't yet sent one (as in the early "none" phase
 	// of authentication negotiation).
 	pubKey ssh.PublicKey
+
+	// rule is the 1-based number of the policy rule that matched,
+	// or 0 if none has yet.
+	rule int
+
+	// keyOpts are the restrictions of the options of the authorized
+	// key that the matched rule accepted pubKey as, if any.
+	keyOpts *keyOptions
 }
 
 func (ci *sshConnInfo) ruleExpired(r *tailcfg.SSHRule) bool {
@@ -837,13 +1618,29 @@ func (ci *sshConnInfo) ruleExpired(r *tailcfg.SSHRule) bool {
 	return r.RuleExpires.Before(ci.now)
 }
 
-func evalSSHPolicy(pol *tailcfg.SSHPolicy, ci *sshConnInfo) (a *tailcfg.SSHAction, localUser string, ok bool) {
-	for _, r := range pol.Rules {
+// ruleScheduled reports whether r's Schedule, if any, is open now. A
+// schedule that doesn't parse is never open, except for Reject rules,
+// which then always apply, to fail closed.
+func (ci *sshConnInfo) ruleScheduled(r *tailcfg.SSHRule) bool {
+	if r.Schedule == nil {
+		return true
+	}
+	open, ok := scheduleOpen(r.Schedule, ci.now)
+	if !ok {
+		return r.Action != nil && r.Action.Reject
+	}
+	return open
+}
+
+// evalSSHPolicy returns the action of the first rule of pol that
+// matches ci, the local user it maps to, and the rule's 1-based number.
+func evalSSHPolicy(pol *tailcfg.SSHPolicy, ci *sshConnInfo) (a *tailcfg.SSHAction, localUser string, rule int, ok bool) {
+	for i, r := range pol.Rules {
 		if a, localUser, err := matchRule(r, ci); err == nil {
-			return a, localUser, true
+			return a, localUser, i + 1, true
 		}
 	}
-	return nil, "", false
+	return nil, "", 0, false
 }
 
 // internal errors for testing; they don't escape to callers or logs.
@@ -851,6 +1648,7 @@ func evalSSHPolicy(pol *tailcfg.SSHPolicy, ci *sshConnInfo) (a *tailcfg.SSHActio
 	errNilRule        = errors.New("nil rule")
 	errNilAction      = errors.New("nil action")
 	errRuleExpired    = errors.New("rule expired")
+	errRuleSchedule   = errors.New("rule not scheduled now")
 	errPrincipalMatch = errors.New("principal didn't match")
 	errUserMatch      = errors.New("user didn't match")
 )
@@ -865,48 +1663,177 @@ func matchRule(r *tailcfg.SSHRule, ci *sshConnInfo) (a *tailcfg.SSHAction, local
 	if ci.ruleExpired(r) {
 		return nil, "", errRuleExpired
 	}
+	if !ci.ruleScheduled(r) {
+		return nil, "", errRuleSchedule
+	}
 	if !r.Action.Reject || r.SSHUsers != nil {
-		localUser = mapLocalUser(r.SSHUsers, ci.sshUser)
+		localUser = mapLocalUser(r.SSHUsers, ci)
 		if localUser == "" {
 			return nil, "", errUserMatch
 		}
 	}
-	if !anyPrincipalMatches(r.Principals, ci) {
+	ko, ok := anyPrincipalMatches(r.Principals, ci, localUser)
+	if !ok {
 		return nil, "", errPrincipalMatch
 	}
+	ci.keyOpts = ko
 	return r.Action, localUser, nil
 }
 
-func mapLocalUser(ruleSSHUsers map[string]string, reqSSHUser string) (localUser string) {
-	v, ok := ruleSSHUsers[reqSSHUser]
+func mapLocalUser(ruleSSHUsers map[string]string, ci *sshConnInfo) (localUser string) {
+	v, ok := ruleSSHUsers[ci.sshUser]
 	if !ok {
 		v = ruleSSHUsers["*"]
 	}
 	if v == "=" {
-		return reqSSHUser
+		return ci.sshUser
+	}
+	if strings.ContainsAny(v, "{}") {
+		lu, err := expandLocalUserTemplate(v, ci.localUserTemplateValue)
+		if err != nil || !validLocalUserName(lu) || isSystemAccount(lu) {
+			return ""
+		}
+		return lu
 	}
 	return v
 }
 
-func anyPrincipalMatches(ps []*tailcfg.SSHPrincipal, ci *sshConnInfo) bool {
+// isSystemAccount reports whether the local user name exists and is
+// root or another system account, below the first uid of regular
+// users, which SSHUsers templates mustn't make. Names that can't be
+// looked up aren't.
+func isSystemAccount(name string) bool {
+	u, err := lookupLocalUser(name)
+	if err != nil {
+		return false
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return false // a Windows SID
+	}
+	firstRegularUID := 1000
+	if runtime.GOOS == "darwin" {
+		firstRegularUID = 500
+	}
+	return uid < firstRegularUID
+}
+
+// expandLocalUserTemplate expands the placeholders in tmpl, an SSHUsers
+// value like "ts-{loginlocalpart}", with value.
+func expandLocalUserTemplate(tmpl string, value func(name string) (string, error)) (string, error) {
+	var b strings.Builder
+	rest := tmpl
+	for {
+		i := strings.IndexAny(rest, "{}")
+		if i < 0 {
+			b.WriteString(rest)
+			return b.String(), nil
+		}
+		j := strings.IndexByte(rest[i:], '}')
+		if rest[i] == '}' || j < 0 {
+			return "", fmt.Errorf("unbalanced braces in %q", tmpl)
+		}
+		v, err := value(rest[i+1 : i+j])
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(rest[:i])
+		b.WriteString(v)
+		rest = rest[i+j+1:]
+	}
+}
+
+// localUserTemplateNames are the placeholders of SSHUsers templates.
+var localUserTemplateNames = map[string]bool{
+	"loginlocalpart": true,
+	"sshuser":        true,
+	"directoryuser":  true,
+}
+
+// localUserTemplateValue returns the value of the placeholder name in
+// an SSHUsers template for ci, in characters fit for a user name.
+func (ci *sshConnInfo) localUserTemplateValue(name string) (string, error) {
+	var v string
+	switch name {
+	case "loginlocalpart":
+		if ci.uprof == nil || ci.node != nil && len(ci.node.Tags) > 0 {
+			return "", errors.New("no login name")
+		}
+		local, _, _ := strings.Cut(ci.uprof.LoginName, "@")
+		local = sanitizeLocalUserPart(local)
+		if local == "" {
+			return "", fmt.Errorf("empty {%s}", name)
+		}
+		if len(local) > 16 {
+			local = local[:16]
+		}
+		// Other logins have the same local part in other domains,
+		// or once sanitized, so the hash tells them apart, as
+		// ephemeralUserName's does.
+		return local + "-" + shortHash(strings.ToLower(ci.uprof.LoginName), 8), nil
+	case "sshuser":
+		v = ci.sshUser
+	case "directoryuser":
+		// The resolver's answer is used as is.
+		if ci.uprof == nil || ci.node != nil && len(ci.node.Tags) > 0 || ci.resolveLocalUser == nil {
+			return "", errors.New("no login name")
+		}
+		return ci.resolveLocalUser(ci.uprof.LoginName)
+	default:
+		return "", fmt.Errorf("unknown placeholder {%s}", name)
+	}
+	v = sanitizeLocalUserPart(v)
+	if v == "" {
+		return "", fmt.Errorf("empty {%s}", name)
+	}
+	return v, nil
+}
+
+// sanitizeLocalUserPart returns v lowercased and without the
+// characters other than letters, digits, '.', '_' and '-', for part of
+// a user name.
+func sanitizeLocalUserPart(v string) string {
+	return strings.Map(func(r rune) rune {
+		r = unicode.ToLower(r)
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '.' || r == '_' || r == '-' {
+			return r
+		}
+		return -1
+	}, v)
+}
+
+// validLocalUserName reports whether name, made from an SSHUsers
+// template, is a user name that's safe to look up.
+func validLocalUserName(name string) bool {
+	return name != "" && len(name) <= 32 && name[0] != '-' && name != "." && name != ".."
+}
+
+// anyPrincipalMatches reports whether any of ps matches ci, for a rule
+// that maps it to localUser, along with the options of the authorized
+// key it matched by, if any.
+func anyPrincipalMatches(ps []*tailcfg.SSHPrincipal, ci *sshConnInfo, localUser string) (_ *keyOptions, ok bool) {
 	for _, p := range ps {
 		if p == nil {
 			continue
 		}
-		if principalMatches(p, ci) {
-			return true
+		if ko, ok := principalMatches(p, ci, localUser); ok {
+			return ko, true
 		}
 	}
-	return false
+	return nil, false
 }
 
-func principalMatches(p *tailcfg.SSHPrincipal, ci *sshConnInfo) bool {
-	return principalMatchesTailscaleIdentity(p, ci) &&
-		principalMatchesPubKey(p, ci)
+func principalMatches(p *tailcfg.SSHPrincipal, ci *sshConnInfo, localUser string) (_ *keyOptions, ok bool) {
+	if !principalMatchesTailscaleIdentity(p, ci) {
+		return nil, false
+	}
+	return principalMatchesPubKey(p, ci, localUser)
 }
 
-// principalMatchesTailscaleIdentity reports whether one of p's four fields
-// that match the Tailscale identity match (Node, NodeIP, UserLogin, Any).
+// principalMatchesTailscaleIdentity reports whether one of p's six fields
+// that match the Tailscale identity match (Node, NodeIP, NodeTag, NodeName,
+// UserLogin, Any). NodeName is compared with the source node's name in
+// the netmap; nothing is looked up in DNS.
 // This function does not consider PubKeys.
 func principalMatchesTailscaleIdentity(p *tailcfg.SSHPrincipal, ci *sshConnInfo) bool {
 	if p.Any {
@@ -915,43 +1842,124 @@ func principalMatchesTailscaleIdentity(p *tailcfg.SSHPrincipal, ci *sshConnInfo)
 	if !p.Node.IsZero() && ci.node != nil && p.Node == ci.node.StableID {
 		return true
 	}
-	if p.NodeIP != "" {
-		if ip, _ := netaddr.ParseIP(p.NodeIP); ip == ci.src.IP() {
-			return true
+	if p.NodeIP != "" && nodeIPMatches(p.NodeIP, ci.src.Addr()) {
+		return true
+	}
+	if p.NodeTag != "" && ci.node != nil {
+		for _, tag := range ci.node.Tags {
+			if tag == p.NodeTag {
+				return true
+			}
 		}
 	}
-	if p.UserLogin != "" && ci.uprof != nil && ci.uprof.LoginName == p.UserLogin {
+	if p.NodeName != "" && ci.node != nil && nodeNameMatches(p.NodeName, ci.node.Name, ci.dnsSuffix) {
+		return true
+	}
+	if p.UserLogin != "" && ci.uprof != nil && userLoginMatches(p.UserLogin, ci.uprof.LoginName) {
 		return true
 	}
 	return false
 }
 
-func principalMatchesPubKey(p *tailcfg.SSHPrincipal, ci *sshConnInfo) bool {
-	if len(p.PubKeys) == 0 {
-		return true
+// nodeIPMatches reports whether ip matches pattern, which is either a
+// single IP address or a CIDR prefix. An IPv4 prefix matches only IPv4
+// addresses, and a pattern that doesn't parse matches nothing.
+func nodeIPMatches(pattern string, ip netip.Addr) bool {
+	if strings.Contains(pattern, "/") {
+		pfx, err := netip.ParsePrefix(pattern)
+		return err == nil && pfx.Contains(ip)
 	}
-	if ci.pubKey == nil {
+	want, err := netip.ParseAddr(pattern)
+	return err == nil && want == ip
+}
+
+// nodeNameMatches reports whether the MagicDNS name pattern refers to
+// the node whose netmap FQDN is name. A pattern without dots is a name
+// in this node's tailnet, whose MagicDNS suffix is dnsSuffix, so that
+// nodes shared in from other tailnets with the same hostname don't
+// match it; otherwise the whole FQDN must match. Comparisons are
+// case-insensitive and ignore any trailing dot.
+func nodeNameMatches(pattern, name, dnsSuffix string) bool {
+	pattern = strings.TrimSuffix(pattern, ".")
+	name = strings.TrimSuffix(name, ".")
+	if pattern == "" || name == "" {
 		return false
 	}
-	pubKeys := p.PubKeys
-	if len(pubKeys) == 1 && strings.HasPrefix(pubKeys[0], "https://") {
-		if ci.fetchPublicKeysURL == nil {
-			// TODO: log?
+	if !strings.Contains(pattern, ".") {
+		if dnsSuffix == "" {
 			return false
 		}
+		pattern += "." + dnsSuffix
+	}
+	return strings.EqualFold(pattern, name)
+}
+
+// userLoginMatches reports whether login matches pattern, which is
+// either a login name, which must match exactly, or "*@domain" to match
+// every login in domain. Only the domain is compared case-insensitively,
+// as domain names are.
+func userLoginMatches(pattern, login string) bool {
+	if login == "" {
+		return false
+	}
+	if !strings.HasPrefix(pattern, "*@") {
+		return pattern == login
+	}
+	domain := strings.TrimPrefix(pattern, "*@")
+	if domain == "" || strings.Contains(domain, "@") {
+		return false
+	}
+	// Require exactly one '@' so "eve@evil.com@example.com"-style
+	// logins can't claim to be in example.com.
+	i := strings.IndexByte(login, '@')
+	if i <= 0 || strings.Count(login, "@") != 1 {
+		return false
+	}
+	return strings.EqualFold(login[i+1:], domain)
+}
+
+// principalMatchesPubKey reports whether ci's public key is one of
+// p's PubKeys, for a rule that maps ci to localUser, along with the
+// options of the authorized key it matched, if any.
+func principalMatchesPubKey(p *tailcfg.SSHPrincipal, ci *sshConnInfo, localUser string) (_ *keyOptions, ok bool) {
+	if len(p.PubKeys) == 0 {
+		return nil, true
+	}
+	if ci.pubKey == nil {
+		return nil, false
+	}
+	for _, pubKey := range p.PubKeys {
+		var keys []string
 		var err error
-		pubKeys, err = ci.fetchPublicKeysURL(pubKeys[0])
+		switch url, isURL := pubKeySourceURL(pubKey); {
+		case pubKey == authorizedKeysSource:
+			if ci.readAuthorizedKeys == nil || localUser == "" {
+				continue
+			}
+			keys, err = ci.readAuthorizedKeys(localUser)
+		case isURL:
+			if ci.fetchPublicKeysURL == nil {
+				// TODO: log?
+				continue
+			}
+			keys, err = ci.fetchPublicKeysURL(url)
+		default:
+			keys = []string{pubKey}
+		}
 		if err != nil {
+			// A source that can't be read only means its keys
+			// don't match; the principal's other sources may
+			// still.
 			// TODO: log?
-			return false
+			continue
 		}
-	}
-	for _, pubKey := range pubKeys {
-		if pubKeyMatchesAuthorizedKey(ci.pubKey, pubKey) {
-			return true
+		for _, k := range keys {
+			if ko, ok := matchAuthorizedKey(ci.pubKey, k, ci.now); ok {
+				return ko, true
+			}
 		}
 	}
-	return false
+	return nil, false
 }
 
 func pubKeyMatchesAuthorizedKey(pubKey ssh.PublicKey, wantKey string) bool {
@@ -975,10 +1983,41 @@ func randBytes(n int) []byte {
 	return b
 }
 
+// recordingsDir returns the directory session recordings are stored
+// in: the one named by TS_SSH_RECORDING_DIR if set, else the SSH
+// policy's RecordingDir if set, else $TAILSCALE_VAR_ROOT/ssh-sessions.
+// The local setting wins so that a node's owner can keep recordings on
+// a volume of their choosing whatever the tailnet's policy says.
+func (srv *server) recordingsDir() (string, error) {
+	if recordingDir != "" {
+		return recordingDirOrErr(recordingDir, "TS_SSH_RECORDING_DIR")
+	}
+	if pol, ok := srv.sshPolicy(); ok && pol.RecordingDir != "" {
+		return recordingDirOrErr(pol.RecordingDir, "SSH policy recordingDir")
+	}
+	varRoot := srv.lb.TailscaleVarRoot()
+	if varRoot == "" {
+		return "", errors.New("no var root for recording storage")
+	}
+	return filepath.Join(varRoot, "ssh-sessions"), nil
+}
+
+// recordingDirOrErr returns dir, cleaned, if it's an absolute path.
+// what names where dir came from, for the error.
+func recordingDirOrErr(dir, what string) (string, error) {
+	if !filepath.IsAbs(dir) {
+		return "", fmt.Errorf("%s %q is not an absolute path", what, dir)
+	}
+	return filepath.Clean(dir), nil
+}
+
 // startNewRecording starts a new SSH session recording.
 //
-// It writes an asciinema file to
-// $TAILSCALE_VAR_ROOT/ssh-sessions/ssh-session-<unixtime>-*.cast.
+// It writes an asciinema file named
+// ssh-session-<unixtime>-<session-id>-*.cast to srv.recordingsDir,
+// or one named like it to the store named by TS_SSH_RECORDING_STORE.
+// If TS_SSH_RECORDING_GZIP is set, the file is gzipped and its name
+// ends in .cast.gz instead.
 func (ss *sshSession) startNewRecording() (*recording, error) {
 	var w ssh.Window
 	if ptyReq, _, isPtyReq := ss.Pty(); isPtyReq {
@@ -995,33 +2034,63 @@ func (ss *sshSession) startNewRecording() (*recording, error) {
 		ss:    ss,
 		start: now,
 	}
-	varRoot := ss.srv.lb.TailscaleVarRoot()
-	if varRoot == "" {
-		return nil, errors.New("no var root for recording storage")
+	store, err := ss.srv.recordingStore()
+	if err != nil {
+		return nil, err
 	}
-	dir := filepath.Join(varRoot, "ssh-sessions")
-	if err := os.MkdirAll(dir, 0700); err != nil {
+	if err := ss.srv.checkRecordingSpace(); err != nil {
 		return nil, err
 	}
-	f, err := ioutil.TempFile(dir, fmt.Sprintf("ssh-session-%v-*.cast", now.UnixNano()))
+	ext := ".cast"
+	if recordGzip {
+		ext = ".cast.gz"
+	}
+	f, name, err := store.Create(fmt.Sprintf("ssh-session-%v-%s-*%s", now.UnixNano(), ss.sharedID, ext))
 	if err != nil {
 		return nil, err
 	}
+	if ss.action.RecordingFailure == recordingFailurePause {
+		f = pausingWriter{f, ss}
+	}
 	rec.out = f
+	if recordGzip {
+		rec.out = newGzipWriteCloser(f)
+	}
 
 	// {"version": 2, "width": 221, "height": 84, "timestamp": 1647146075, "env": {"SHELL": "/bin/bash", "TERM": "screen"}}
+	//
+	// The fields after Env aren't asciinema's, which players ignore,
+	// except for Command. They make the file self-describing for audits.
 	type CastHeader struct {
 		Version   int               `json:"version"`
 		Width     int               `json:"width"`
 		Height    int               `json:"height"`
 		Timestamp int64             `json:"timestamp"`
 		Env       map[string]string `json:"env"`
+
+		Command   string `json:"command,omitempty"`   // the command run, if not a shell
+		Subsystem string `json:"subsystem,omitempty"` // the subsystem run, like "sftp"
+
+		SessionID   string               `json:"sessionID"`             // as in logs and events
+		SrcNode     tailcfg.StableNodeID `json:"srcNode,omitempty"`     // of the client
+		SrcNodeID   tailcfg.NodeID       `json:"srcNodeID,omitempty"`   // of the client
+		SrcNodeIP   string               `json:"srcNodeIP"`             // the client's Tailscale IP
+		SrcNodeTags []string             `json:"srcNodeTags,omitempty"` // of the client
+		LoginName   string               `json:"loginName,omitempty"`   // of the user connecting
+		SSHUser     string               `json:"sshUser"`               // as requested by the client
+		LocalUser   string               `json:"localUser"`             // the session runs as
 	}
-	j, err := json.Marshal(CastHeader{
+	ci := ss.connInfo
+	hdr := CastHeader{
 		Version:   2,
 		Width:     w.Width,
 		Height:    w.Height,
 		Timestamp: now.Unix(),
+		Command:   ss.command(),
+		Subsystem: ss.subsystem(),
+		SessionID: ss.sharedID,
+		SrcNodeIP: ci.src.Addr().String(),
+		SSHUser:   ci.sshUser,
 		Env: map[string]string{
 			"TERM": term,
 			// TODO(bradiftz): anything else important?
@@ -1033,15 +2102,29 @@ type CastHeader struct {
 			// it. Then we can (1) make the cmd, (2) start the
 			// recording, (3) start the process.
 		},
-	})
+	}
+	if ci.node != nil {
+		hdr.SrcNode = ci.node.StableID
+		hdr.SrcNodeID = ci.node.ID
+		hdr.SrcNodeTags = ci.node.Tags
+	}
+	if ci.uprof != nil {
+		hdr.LoginName = ci.uprof.LoginName
+	}
+	if ss.localUser != nil {
+		hdr.LocalUser = ss.localUser.Username
+	}
+	j, err := json.Marshal(hdr)
 	if err != nil {
-		f.Close()
+		rec.out.Close()
 		return nil, err
 	}
-	ss.logf("starting asciinema recording to %s", f.Name())
+	ss.logf("starting asciinema recording to %s", name)
 	j = append(j, '\n')
-	if _, err := f.Write(j); err != nil {
-		f.Close()
+	n, err := rec.out.Write(j)
+	metricRecordingBytes.Add(int64(n))
+	if err != nil {
+		rec.out.Close()
 		return nil, err
 	}
 	return rec, nil
@@ -1052,8 +2135,9 @@ type recording struct {
 	ss    *sshSession
 	start time.Time
 
-	mu  sync.Mutex // guards writes to, close of out
-	out *os.File   // nil if closed
+	mu     sync.Mutex     // guards writes to, close of out
+	out    io.WriteCloser // nil if closed
+	failed bool           // whether writing failed and the session continued unrecorded
 }
 
 func (r *recording) Close() error {
@@ -1098,24 +2182,180 @@ func (w loggingWriter) Write(p []byte) (n int, err error) {
 	}
 	j = append(j, '\n')
 	if err := w.writeCastLine(j); err != nil {
-		return 0, nil
+		if err == errRecordingClosed {
+			return 0, nil
+		}
+		return 0, err
 	}
 	return w.w.Write(p)
 }
 
+var errRecordingClosed = errors.New("logger closed")
+
 func (w loggingWriter) writeCastLine(j []byte) error {
 	w.r.mu.Lock()
 	defer w.r.mu.Unlock()
+	if w.r.failed {
+		return nil
+	}
 	if w.r.out == nil {
-		return errors.New("logger closed")
+		return errRecordingClosed
 	}
-	_, err := w.r.out.Write(j)
+	n, err := w.r.out.Write(j)
+	metricRecordingBytes.Add(int64(n))
 	if err != nil {
-		return fmt.Errorf("logger Write: %w", err)
+		health.SetSSHRecordingHealth(err)
+		return w.r.failLocked(fmt.Errorf("logger Write: %w", err))
 	}
 	return nil
 }
 
+// failLocked handles the failure err to write to the recording, as its
+// session's action says to, returning an error if the session's
+// output should stop. r.mu must be held.
+func (r *recording) failLocked(err error) error {
+	ss := r.ss
+	if ss.action.RecordingFailure == recordingFailureContinue {
+		ss.logf("recording failed: %v; continuing unrecorded", err)
+		r.out.Close()
+		r.out = nil
+		r.failed = true
+		return nil
+	}
+	ss.logf("recording failed: %v; closing session", err)
+	ss.ctx.CloseWithError(userVisibleError{
+		"Session recording failed; session closed.\n",
+		err,
+	})
+	return err
+}
+
+// checkLocalGroup returns an error unless lu is a member of the local
+// group named group, as their primary group or a supplementary one.
+func checkLocalGroup(lu *user.User, group string) error {
+	g, err := user.LookupGroup(group)
+	if err != nil {
+		return fmt.Errorf("required group: %w", err)
+	}
+	if lu.Gid == g.Gid {
+		return nil
+	}
+	gids, err := lu.GroupIds()
+	if err != nil {
+		return fmt.Errorf("groups of %q: %w", lu.Username, err)
+	}
+	for _, gid := range gids {
+		if gid == g.Gid {
+			return nil
+		}
+	}
+	return fmt.Errorf("local user %q isn't in group %q", lu.Username, group)
+}
+
+// command returns the command ss runs: its action's ForceCommand if
+// set, or else the one the client asked for, if any.
+func (ss *sshSession) command() string {
+	if ss.action.ForceCommand != "" {
+		return ss.action.ForceCommand
+	}
+	return ss.RawCommand()
+}
+
+// subsystem returns the subsystem ss serves, if any. It's always
+// empty if ss's action has a ForceCommand, which runs instead.
+func (ss *sshSession) subsystem() string {
+	if ss.action.ForceCommand != "" {
+		return ""
+	}
+	return ss.Subsystem()
+}
+
+// clientEnv returns the environment variables the client asked for
+// that ss's action accepts, logging those it doesn't. If the action
+// forces a command, it also sets SSH_ORIGINAL_COMMAND to what the
+// client asked to run, overriding any the client sent.
+func (ss *sshSession) clientEnv() []string {
+	forced := ss.action.ForceCommand != ""
+	var accepted []string
+	for _, kv := range ss.Environ() {
+		k, _, _ := strings.Cut(kv, "=")
+		if forced && envEq(k, "SSH_ORIGINAL_COMMAND") {
+			continue
+		}
+		if isConnEnvName(k) {
+			// The client can't pass for anyone else.
+			ss.logf("rejecting client environment variable %q", k)
+			continue
+		}
+		if ss.action.AcceptEnv == nil || envNameAccepted(ss.action.AcceptEnv, k) {
+			accepted = append(accepted, kv)
+		} else {
+			ss.logf("rejecting client environment variable %q", k)
+		}
+	}
+	if forced {
+		orig := ss.RawCommand()
+		if orig == "" {
+			orig = ss.Subsystem()
+		}
+		if orig != "" {
+			accepted = append(accepted, "SSH_ORIGINAL_COMMAND="+orig)
+		}
+	}
+	return accepted
+}
+
+// connEnv returns the environment variables that tell ss's processes
+// about its connection: OpenSSH's SSH_CLIENT and SSH_CONNECTION, and
+// who connected over the tailnet, so that scripts and shell prompts
+// needn't ask tailscaled:
+//
+//   - TAILSCALE_USER: the login name of the connecting user, unless
+//     the node is tagged, in which case
+//   - TAILSCALE_TAGS has its tags, comma-separated.
+//   - TAILSCALE_NODE: the connecting node's name.
+//   - TAILSCALE_SRC_IP: its Tailscale IP.
+//   - TAILSCALE_SESSION_ID: the session's ID, as in its recording's.
+func (ss *sshSession) connEnv() []string {
+	ci := ss.connInfo
+	env := []string{
+		fmt.Sprintf("SSH_CLIENT=%s %d %d", ci.src.Addr(), ci.src.Port(), ci.dst.Port()),
+		fmt.Sprintf("SSH_CONNECTION=%s %d %s %d", ci.src.Addr(), ci.src.Port(), ci.dst.Addr(), ci.dst.Port()),
+		"TAILSCALE_SRC_IP=" + ci.src.Addr().String(),
+		"TAILSCALE_SESSION_ID=" + ss.sharedID,
+	}
+	if ci.node != nil {
+		if len(ci.node.Tags) > 0 {
+			env = append(env, "TAILSCALE_TAGS="+strings.Join(ci.node.Tags, ","))
+		}
+		if name := strings.TrimSuffix(ci.node.Name, "."); name != "" {
+			env = append(env, "TAILSCALE_NODE="+name)
+		}
+	}
+	if ci.uprof != nil && (ci.node == nil || len(ci.node.Tags) == 0) {
+		env = append(env, "TAILSCALE_USER="+ci.uprof.LoginName)
+	}
+	return env
+}
+
+// isConnEnvName reports whether name is one of the environment
+// variables that connEnv sets, or may.
+func isConnEnvName(name string) bool {
+	return envEq(name, "SSH_CLIENT") || envEq(name, "SSH_CONNECTION") ||
+		strings.HasPrefix(strings.ToUpper(name), "TAILSCALE_")
+}
+
+// envNameAccepted reports whether the environment variable name
+// matches one of patterns, from SSHAction.AcceptEnv.
+func envNameAccepted(patterns []string, name string) bool {
+	for _, pat := range patterns {
+		if ok, _ := path.Match(pat, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
 func envValFromList(env []string, wantKey string) (v string) {
 	for _, kv := range env {
 		if thisKey, v, ok := strings.Cut(kv, "="); ok && envEq(thisKey, wantKey) {
@@ -1141,3 +2381,23 @@ func mapSet[K comparable, V any](m *map[K]V, k K, v V) {
 	}
 	(*m)[k] = v
 }
+
+var (
+	// Session and connection metrics. They're derived from published
+	// events, so that they include those of isolated connection
+	// children.
+	metricSessions       = clientmetric.NewCounter("ssh_sessions")
+	metricActiveSessions = clientmetric.NewGauge("ssh_sessions_active")
+	metricRejections     = clientmetric.NewCounter("ssh_rejections")
+	metricForwards       = clientmetric.NewCounter("ssh_forwards")
+	metricForwardBytes   = clientmetric.NewCounter("ssh_forward_bytes")
+
+	// Delegated action fetches (see SSHAction.HoldAndDelegate): how
+	// many succeeded, how long they took in total, and how many
+	// attempts failed.
+	metricActionFetches     = clientmetric.NewCounter("ssh_action_fetch")
+	metricActionFetchMillis = clientmetric.NewCounter("ssh_action_fetch_ms")
+	metricActionFetchErrors = clientmetric.NewCounter("ssh_action_fetch_error")
+
+	metricRecordingBytes = clientmetric.NewCounter("ssh_recording_bytes")
+)
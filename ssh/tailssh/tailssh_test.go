@@ -8,33 +8,44 @@
 package tailssh
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
 	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
 	"os"
 	"os/exec"
 	"os/user"
+	"path/filepath"
 	"reflect"
 	"strings"
+	"sync"
 	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
-	"inet.af/netaddr"
+	"tailscale.com/health"
 	"tailscale.com/ipn/ipnlocal"
+	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/ipn/store/mem"
 	"tailscale.com/net/tsdial"
 	"tailscale.com/tailcfg"
 	"tailscale.com/tempfork/gliderlabs/ssh"
+	gossh "tailscale.com/tempfork/golang-x-crypto/ssh"
 	"tailscale.com/tstest"
 	"tailscale.com/types/logger"
 	"tailscale.com/util/cibuild"
 	"tailscale.com/util/lineread"
+	"tailscale.com/util/netconv"
 	"tailscale.com/wgengine"
 )
 
@@ -66,6 +77,15 @@ func TestMatchRule(t *testing.T) {
 			ci:      &sshConnInfo{now: time.Unix(200, 0)},
 			wantErr: errRuleExpired,
 		},
+		{
+			name: "out-of-schedule",
+			rule: &tailcfg.SSHRule{
+				Action:   someAction,
+				Schedule: &tailcfg.SSHSchedule{Start: "09:00", End: "17:00"},
+			},
+			ci:      &sshConnInfo{now: time.Date(2022, 6, 1, 8, 0, 0, 0, time.UTC)},
+			wantErr: errRuleSchedule,
+		},
 		{
 			name: "no-principal",
 			rule: &tailcfg.SSHRule{
@@ -140,9 +160,29 @@ func TestMatchRule(t *testing.T) {
 				Principals: []*tailcfg.SSHPrincipal{{NodeIP: "1.2.3.4"}},
 				SSHUsers:   map[string]string{"*": "ubuntu"},
 			},
-			ci:       &sshConnInfo{src: netaddr.MustParseIPPort("1.2.3.4:30343")},
+			ci:       &sshConnInfo{src: netip.MustParseAddrPort("1.2.3.4:30343")},
 			wantUser: "ubuntu",
 		},
+		{
+			name: "match-principal-node-ip-cidr",
+			rule: &tailcfg.SSHRule{
+				Action:     someAction,
+				Principals: []*tailcfg.SSHPrincipal{{NodeIP: "1.2.3.0/24"}},
+				SSHUsers:   map[string]string{"*": "ubuntu"},
+			},
+			ci:       &sshConnInfo{src: netip.MustParseAddrPort("1.2.3.4:30343")},
+			wantUser: "ubuntu",
+		},
+		{
+			name: "no-match-principal-node-ip-cidr",
+			rule: &tailcfg.SSHRule{
+				Action:     someAction,
+				Principals: []*tailcfg.SSHPrincipal{{NodeIP: "1.2.4.0/24"}},
+				SSHUsers:   map[string]string{"*": "ubuntu"},
+			},
+			ci:      &sshConnInfo{src: netip.MustParseAddrPort("1.2.3.4:30343")},
+			wantErr: errPrincipalMatch,
+		},
 		{
 			name: "match-principal-node-id",
 			rule: &tailcfg.SSHRule{
@@ -153,6 +193,26 @@ func TestMatchRule(t *testing.T) {
 			ci:       &sshConnInfo{node: &tailcfg.Node{StableID: "some-node-ID"}},
 			wantUser: "ubuntu",
 		},
+		{
+			name: "match-principal-node-tag",
+			rule: &tailcfg.SSHRule{
+				Action:     someAction,
+				Principals: []*tailcfg.SSHPrincipal{{NodeTag: "tag:ci"}},
+				SSHUsers:   map[string]string{"*": "ubuntu"},
+			},
+			ci:       &sshConnInfo{node: &tailcfg.Node{Tags: []string{"tag:server", "tag:ci"}}},
+			wantUser: "ubuntu",
+		},
+		{
+			name: "no-match-principal-node-tag",
+			rule: &tailcfg.SSHRule{
+				Action:     someAction,
+				Principals: []*tailcfg.SSHPrincipal{{NodeTag: "tag:ci"}},
+				SSHUsers:   map[string]string{"*": "ubuntu"},
+			},
+			ci:      &sshConnInfo{node: &tailcfg.Node{Tags: []string{"tag:server"}}},
+			wantErr: errPrincipalMatch,
+		},
 		{
 			name: "match-principal-userlogin",
 			rule: &tailcfg.SSHRule{
@@ -227,8 +287,8 @@ func TestSSH(t *testing.T) {
 
 	ci := &sshConnInfo{
 		sshUser: "test",
-		src:     netaddr.MustParseIPPort("1.2.3.4:32342"),
-		dst:     netaddr.MustParseIPPort("1.2.3.5:22"),
+		src:     netip.MustParseAddrPort("1.2.3.4:32342"),
+		dst:     netip.MustParseAddrPort("1.2.3.5:22"),
 		node:    &tailcfg.Node{},
 		uprof:   &tailcfg.UserProfile{},
 	}
@@ -403,3 +463,1243 @@ func TestPublicKeyFetching(t *testing.T) {
 	}
 
 }
+
+func TestPublicKeyFetchingRateLimited(t *testing.T) {
+	var reqs, limited int32
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&reqs, 1)
+		if atomic.LoadInt32(&limited) != 0 {
+			w.Header().Set("X-Ratelimit-Remaining", "0")
+			w.Header().Set("X-Ratelimit-Reset", fmt.Sprint(time.Unix(1000, 0).Add(30*time.Minute).Unix()))
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		io.WriteString(w, "foo\n")
+	}))
+	ts.StartTLS()
+	defer ts.Close()
+
+	clock := &tstest.Clock{Start: time.Unix(1000, 0)}
+	srv := &server{
+		logf:             t.Logf,
+		pubKeyHTTPClient: ts.Client(),
+		timeNow:          clock.Now,
+	}
+	fetch := func() {
+		t.Helper()
+		got, err := srv.fetchPublicKeysURL(ts.URL + "/alice.keys")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{"foo"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("got %q; want %q", got, want)
+		}
+	}
+	fetch()
+
+	// Once rate limited, the last keys are used without asking again
+	// until the limit resets.
+	atomic.StoreInt32(&limited, 1)
+	clock.Advance(5 * time.Minute)
+	fetch()
+	clock.Advance(20 * time.Minute)
+	fetch()
+	if got, want := atomic.LoadInt32(&reqs), int32(2); got != want {
+		t.Errorf("got %d requests; want %d", got, want)
+	}
+	atomic.StoreInt32(&limited, 0)
+	clock.Advance(10 * time.Minute)
+	fetch()
+	if got, want := atomic.LoadInt32(&reqs), int32(3); got != want {
+		t.Errorf("got %d requests; want %d", got, want)
+	}
+}
+
+func TestPubKeySourceURL(t *testing.T) {
+	tests := []struct {
+		in     string
+		want   string
+		wantOK bool
+	}{
+		{"https://example.com/keys", "https://example.com/keys", true},
+		{"github:Alice", "https://github.com/alice.keys", true},
+		{"gitlab:bob.smith", "https://gitlab.com/bob.smith.keys", true},
+		{"github:", "", false},
+		{"github:../orgs", "", false},
+		{"github:a/b", "", false},
+		{"github:a?b", "", false},
+		{"bitbucket:alice", "", false},
+		{"ssh-ed25519 AAAA alice@example.com", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := pubKeySourceURL(tt.in)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("pubKeySourceURL(%q) = %q, %v; want %q, %v", tt.in, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestNodeNameMatches(t *testing.T) {
+	const suffix = "example.ts.net"
+	tests := []struct {
+		pattern string
+		name    string
+		suffix  string
+		want    bool
+	}{
+		{"build-runner-3", "build-runner-3.example.ts.net.", suffix, true},
+		{"Build-Runner-3", "build-runner-3.example.ts.net.", suffix, true},
+		{"build-runner-3.example.ts.net", "build-runner-3.example.ts.net.", suffix, true},
+		{"build-runner-3.example.ts.net.", "build-runner-3.example.ts.net.", suffix, true},
+		{"build-runner-3.other.ts.net", "build-runner-3.example.ts.net.", suffix, false},
+		{"build-runner", "build-runner-3.example.ts.net.", suffix, false},
+		{"example", "build-runner-3.example.ts.net.", suffix, false},
+		{"build-runner-3", "", suffix, false},
+		{".", "build-runner-3.example.ts.net.", suffix, false},
+		// A node shared in from another tailnet, with the same
+		// hostname, doesn't match a bare name.
+		{"build-runner-3", "build-runner-3.other.ts.net.", suffix, false},
+		{"build-runner-3.other.ts.net", "build-runner-3.other.ts.net.", suffix, true},
+		// Nor does anything without a netmap to qualify it with.
+		{"build-runner-3", "build-runner-3.example.ts.net.", "", false},
+	}
+	for _, tt := range tests {
+		if got := nodeNameMatches(tt.pattern, tt.name, tt.suffix); got != tt.want {
+			t.Errorf("nodeNameMatches(%q, %q, %q) = %v; want %v", tt.pattern, tt.name, tt.suffix, got, tt.want)
+		}
+	}
+}
+
+func TestUserLoginMatches(t *testing.T) {
+	tests := []struct {
+		pattern string
+		login   string
+		want    bool
+	}{
+		{"alice@example.com", "alice@example.com", true},
+		{"alice@example.com", "Alice@example.com", false},
+		{"alice@example.com", "alice@Example.com", false},
+		{"alice@example.com", " alice@example.com", false},
+		{"alice@example.com", "bob@example.com", false},
+		{"*@example.com", "alice@example.com", true},
+		{"*@example.com", "alice@EXAMPLE.com", true},
+		{"*@Example.com", "Alice@example.com", true},
+		{"*@example.com ", "alice@example.com", false},
+		{"*@example.com", "alice@sub.example.com", false},
+		{"*@example.com", "alice@notexample.com", false},
+		{"*@example.com", "eve@evil.com@example.com", false},
+		{"*@example.com", "@example.com", false},
+		{"*@example.com", "", false},
+		{"*@", "alice@", false},
+		{"*@github", "bar@github", true},
+	}
+	for _, tt := range tests {
+		if got := userLoginMatches(tt.pattern, tt.login); got != tt.want {
+			t.Errorf("userLoginMatches(%q, %q) = %v; want %v", tt.pattern, tt.login, got, tt.want)
+		}
+	}
+}
+
+func TestPublicKeyFetchingVerifiesCerts(t *testing.T) {
+	var reqs int32
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&reqs, 1)
+		io.WriteString(w, "foo\n")
+	}))
+	ts.Config.ErrorLog = log.New(io.Discard, "", 0)
+	ts.StartTLS()
+	defer ts.Close()
+
+	// The default client must not trust httptest's self-signed cert.
+	srv := &server{logf: t.Logf}
+	_, err := srv.fetchPublicKeysURL(ts.URL + "/alice.keys")
+	if err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Errorf("err = %v; want a certificate error", err)
+	}
+	if n := atomic.LoadInt32(&reqs); n != 0 {
+		t.Errorf("got %d requests; want 0", n)
+	}
+}
+
+func TestBugReport(t *testing.T) {
+	h := newSSHHarness(t, &tailcfg.SSHPolicy{})
+	c := h.mustDial()
+	if _, _, err := run(t, c, "true"); exitStatus(err) != 1 {
+		t.Fatalf("run = %v; want exit status 1", err)
+	}
+
+	got := h.srv.BugReport()
+	for _, want := range []string{
+		"policy: from tailnet, 0 rules\n",
+		"active sessions: 0\n",
+		"recording: disabled\n",
+		"host key: ssh-ed25519 SHA256:",
+		`: 100.64.0.2 as "testuser": ssh: access denied for "alice@example.com" from 100.64.0.2` + "\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("missing %q in:\n%s", want, got)
+		}
+	}
+
+	for i := 0; i < maxRecentRejections+5; i++ {
+		h.srv.noteRejection(netip.AddrPortFrom(testPeerIP, 1), "u", fmt.Sprint(i))
+	}
+	rs := h.srv.recentRejections
+	if len(rs) != maxRecentRejections || rs[0].reason != "5" || rs[len(rs)-1].reason != "14" {
+		t.Errorf("recentRejections = %+v; want the last %d", rs, maxRecentRejections)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	h := newSSHHarness(t, nil)
+	h.lb.setPolicy(&tailcfg.SSHPolicy{Rules: []*tailcfg.SSHRule{
+		h.acceptRule(&tailcfg.SSHAction{Accept: true}),
+	}})
+	sessions0, rejections0 := metricSessions.Value(), metricRejections.Value()
+	h.srv.noteRejection(netip.AddrPortFrom(testPeerIP, 1), "before", "too early")
+
+	// Events are also logged as structured records.
+	var (
+		recordsMu sync.Mutex
+		records   []string
+	)
+	logf := h.srv.logf
+	h.srv.logf = func(format string, args ...any) {
+		if strings.HasPrefix(format, "[v\x00JSON]") {
+			recordsMu.Lock()
+			records = append(records, fmt.Sprintf(format, args...))
+			recordsMu.Unlock()
+		}
+		logf(format, args...)
+	}
+
+	events := make(chan ipnstate.SSHEvent, 10)
+	unsubscribe := h.srv.SubscribeEvents(true, func(ev ipnstate.SSHEvent) { events <- ev })
+	next := func(want ipnstate.SSHEventType) ipnstate.SSHEvent {
+		t.Helper()
+		select {
+		case ev := <-events:
+			if ev.Type != want {
+				t.Fatalf("got %+v; want %s event", ev, want)
+			}
+			return ev
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timeout waiting for %s event", want)
+		}
+		panic("unreachable")
+	}
+
+	if ev := next(ipnstate.SSHEventReject); ev.SSHUser != "before" {
+		t.Errorf("recent event = %+v; want the earlier rejection", ev)
+	}
+
+	c := h.mustDial()
+	if _, _, err := run(t, c, "true"); err != nil {
+		t.Fatal(err)
+	}
+	if ev := next(ipnstate.SSHEventAuthAttempt); ev.SSHUser != "testuser" || ev.PubKey != "" {
+		t.Errorf("auth attempt = %+v; want testuser with none auth", ev)
+	}
+	accept := next(ipnstate.SSHEventAccept)
+	start := next(ipnstate.SSHEventSessionStart)
+	execEv := next(ipnstate.SSHEventExec)
+	end := next(ipnstate.SSHEventSessionEnd)
+	if start.SessionID == "" || start.SessionID != end.SessionID || accept.SessionID != start.SessionID {
+		t.Errorf("session IDs = %q, %q, %q; want the same non-empty ID", accept.SessionID, start.SessionID, end.SessionID)
+	}
+	if start.LoginName != "alice@example.com" || start.LocalUser != h.localUser.Username || start.Src.IP() != netconv.AsIP(testPeerIP) {
+		t.Errorf("start event = %+v", start)
+	}
+	if accept.Rule != 1 || execEv.Rule != 1 || execEv.Command != "true" || execEv.Subsystem != "" {
+		t.Errorf("exec event = %+v; want command \"true\" by rule 1", execEv)
+	}
+	recordsMu.Lock()
+	logged := strings.Join(records, "\n")
+	recordsMu.Unlock()
+	for _, want := range []string{`{"SSHEvent":{`, `"Type":"accept"`, `"Type":"exec"`, `"Command":"true"`, `"Type":"session-end"`} {
+		if !strings.Contains(logged, want) {
+			t.Errorf("missing %s in logged records:\n%s", want, logged)
+		}
+	}
+
+	h.lb.setPolicy(&tailcfg.SSHPolicy{})
+	if _, _, err := run(t, c, "true"); exitStatus(err) != 1 {
+		t.Fatalf("run = %v; want exit status 1", err)
+	}
+	if ev := next(ipnstate.SSHEventReject); !strings.Contains(ev.Reason, "access denied") {
+		t.Errorf("event = %+v; want access denied rejection", ev)
+	}
+	// Sessions of earlier tests may still be ending, so the metrics
+	// are only checked for having counted this test's.
+	if d := metricSessions.Value() - sessions0; d < 1 {
+		t.Errorf("ssh_sessions grew by %d; want at least 1", d)
+	}
+	if d := metricRejections.Value() - rejections0; d < 2 {
+		t.Errorf("ssh_rejections grew by %d; want at least 2", d)
+	}
+
+	unsubscribe()
+	unsubscribe()
+	if len(h.srv.eventSubscribers) != 0 {
+		t.Errorf("%d event subscribers left", len(h.srv.eventSubscribers))
+	}
+
+	st := h.srv.Status()
+	if !st.Supported || st.PolicySource != "tailnet" || len(st.Sessions) != 0 || len(st.HostKeys) == 0 {
+		t.Errorf("Status = %+v", st)
+	}
+}
+
+func TestStartStop(t *testing.T) {
+	h := newSSHHarness(t, nil)
+	h.lb.setPolicy(&tailcfg.SSHPolicy{Rules: []*tailcfg.SSHRule{
+		h.acceptRule(&tailcfg.SSHAction{Accept: true}),
+	}})
+	c := h.mustDial()
+	s, err := c.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	stdout, err := s.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stderr bytes.Buffer
+	s.Stderr = &stderr
+	if err := s.Start("echo started; exec sleep 30"); err != nil {
+		t.Fatal(err)
+	}
+	if line, err := bufio.NewReader(stdout).ReadString('\n'); err != nil || line != "started\n" {
+		t.Fatalf("session output = %q, %v", line, err)
+	}
+
+	h.srv.Stop()
+	waitErr := make(chan error, 1)
+	go func() { waitErr <- s.Wait() }()
+	select {
+	case err := <-waitErr:
+		if err == nil {
+			t.Error("session succeeded; want failure")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("session still running after Stop")
+	}
+	if !strings.Contains(stderr.String(), "Tailscale SSH was turned off") {
+		t.Errorf("stderr = %q; want the reason", stderr.String())
+	}
+
+	// The connection is closed after the grace period.
+	closed := make(chan error, 1)
+	go func() { closed <- c.Wait() }()
+	select {
+	case <-closed:
+	case <-time.After(stopGracePeriod + 10*time.Second):
+		t.Fatal("connection still open after Stop")
+	}
+
+	if c, err := h.dial(testPeerIP); err == nil {
+		c.Close()
+		t.Fatal("dial succeeded while stopped")
+	}
+	h.srv.Start()
+	c = h.mustDial()
+	if out, _, err := run(t, c, "echo back"); err != nil || out != "back\n" {
+		t.Errorf("after Start: %q, %v", out, err)
+	}
+}
+
+func TestTerminateSession(t *testing.T) {
+	h := newSSHHarness(t, nil)
+	h.lb.setPolicy(&tailcfg.SSHPolicy{Rules: []*tailcfg.SSHRule{
+		h.acceptRule(&tailcfg.SSHAction{Accept: true}),
+	}})
+	c := h.mustDial()
+	s, err := c.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	stdout, err := s.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stderr bytes.Buffer
+	s.Stderr = &stderr
+	if err := s.Start("echo started; exec sleep 30"); err != nil {
+		t.Fatal(err)
+	}
+	if line, err := bufio.NewReader(stdout).ReadString('\n'); err != nil || line != "started\n" {
+		t.Fatalf("session output = %q, %v", line, err)
+	}
+
+	if err := h.srv.TerminateSession("no-such-session", ""); err == nil {
+		t.Error("terminating unknown session succeeded")
+	}
+	st := h.srv.Status()
+	if len(st.Sessions) != 1 {
+		t.Fatalf("sessions = %+v; want 1", st.Sessions)
+	}
+	if err := h.srv.TerminateSession(st.Sessions[0].ID, "Kicked by the admin."); err != nil {
+		t.Fatal(err)
+	}
+	waitErr := make(chan error, 1)
+	go func() { waitErr <- s.Wait() }()
+	select {
+	case err := <-waitErr:
+		if err == nil {
+			t.Error("session succeeded; want failure")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("session still running after TerminateSession")
+	}
+	if !strings.Contains(stderr.String(), "Kicked by the admin.") {
+		t.Errorf("stderr = %q; want the message", stderr.String())
+	}
+
+	// The connection's other sessions are unaffected.
+	if out, _, err := run(t, c, "echo still here"); err != nil || out != "still here\n" {
+		t.Errorf("after TerminateSession: %q, %v", out, err)
+	}
+}
+
+func TestHostKeysHealth(t *testing.T) {
+	changes := make(chan error, 10)
+	unregister := health.RegisterWatcher(func(sys health.Subsystem, err error) {
+		if sys == health.SysSSHHostKeys {
+			changes <- err
+		}
+	})
+	defer unregister()
+	defer health.SetSSHHostKeysHealth(nil)
+
+	h := newSSHHarness(t, &tailcfg.SSHPolicy{})
+	keys := h.lb.hostKeys
+	h.lb.hostKeys = nil
+	if _, err := h.dial(testPeerIP); err == nil {
+		t.Fatal("dial without host keys succeeded")
+	}
+	h.lb.hostKeys = keys
+	h.mustDial()
+
+	// Watchers run concurrently, so the changes may arrive in
+	// either order.
+	var errs, oks int
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-changes:
+			if err != nil {
+				errs++
+			} else {
+				oks++
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for health change")
+		}
+	}
+	if errs != 1 || oks != 1 {
+		t.Errorf("got %d errors and %d recoveries; want 1 of each", errs, oks)
+	}
+}
+
+func TestStreamLocalPathAllowed(t *testing.T) {
+	patterns := []string{"/var/run/docker.sock", "~/.gnupg/S.*", "relative.sock"}
+	tests := []struct {
+		path string
+		home string
+		want bool
+	}{
+		{"/var/run/docker.sock", "/home/a", true},
+		{"/home/a/.gnupg/S.gpg-agent", "/home/a", true},
+		{"/home/a/.gnupg/sub/S.gpg-agent", "/home/a", false},
+		{"/home/a/.gnupg/S.gpg-agent", "", false},
+		{"/home/b/.gnupg/S.gpg-agent", "/home/a", false},
+		{"/var/run/../run/docker.sock", "/home/a", false},
+		{"relative.sock", "/home/a", false},
+		{"/var/run/other.sock", "/home/a", false},
+	}
+	for _, tt := range tests {
+		if got := streamLocalPathAllowed(patterns, tt.path, tt.home); got != tt.want {
+			t.Errorf("streamLocalPathAllowed(%q, home %q) = %v; want %v", tt.path, tt.home, got, tt.want)
+		}
+	}
+}
+
+func TestPortForwardDestAllowed(t *testing.T) {
+	dests := []string{"127.0.0.1:5432", "10.0.0.0/8:8000-8999", "[::1]:*", "DB.internal:6379", "bad"}
+	tests := []struct {
+		host string
+		port uint32
+		want bool
+	}{
+		{"127.0.0.1", 5432, true},
+		{"127.0.0.1", 5433, false},
+		{"::ffff:127.0.0.1", 5432, true},
+		{"localhost", 5432, false},
+		{"10.1.2.3", 8080, true},
+		{"10.1.2.3", 9000, false},
+		{"11.1.2.3", 8080, false},
+		{"::1", 22, true},
+		{"db.internal", 6379, true},
+		{"db.internal", 5432, false},
+		{"bad", 0, false},
+	}
+	for _, tt := range tests {
+		if got := portForwardDestAllowed(dests, tt.host, tt.port); got != tt.want {
+			t.Errorf("portForwardDestAllowed(%q, %d) = %v; want %v", tt.host, tt.port, got, tt.want)
+		}
+	}
+	if !portForwardDestAllowed(nil, "example.com", 443) {
+		t.Error("nil destinations refused forwarding; want allowed")
+	}
+	if portForwardDestAllowed([]string{}, "127.0.0.1", 5432) {
+		t.Error("empty destinations allowed forwarding; want refused")
+	}
+}
+
+func TestPrincipalMatchesPubKey(t *testing.T) {
+	newKey := func() (ssh.PublicKey, string) {
+		pub, _, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		k, err := gossh.NewPublicKey(pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return k, strings.TrimSpace(string(gossh.MarshalAuthorizedKey(k)))
+	}
+	literal, literalLine := newKey()
+	github, githubLine := newKey()
+	internal, internalLine := newKey()
+	other, _ := newKey()
+
+	fetch := func(url string) ([]string, error) {
+		switch url {
+		case "https://github.com/alice.keys":
+			return []string{githubLine}, nil
+		case "https://keys.example.com/alice":
+			return []string{"# comment", internalLine}, nil
+		}
+		return nil, errors.New("not found")
+	}
+	p := &tailcfg.SSHPrincipal{PubKeys: []string{
+		"https://down.example.com/alice",
+		"https://github.com/alice.keys",
+		literalLine,
+		"https://keys.example.com/alice",
+	}}
+	for _, tt := range []struct {
+		name string
+		key  ssh.PublicKey
+		want bool
+	}{
+		{"literal", literal, true},
+		{"first-url", github, true},
+		{"second-url", internal, true},
+		{"other", other, false},
+		{"none", nil, false},
+	} {
+		ci := &sshConnInfo{pubKey: tt.key, fetchPublicKeysURL: fetch}
+		if _, got := principalMatchesPubKey(p, ci, "alice"); got != tt.want {
+			t.Errorf("%s: principalMatchesPubKey = %v; want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAuthorizedKeysOf(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := gossh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := strings.TrimSpace(string(gossh.MarshalAuthorizedKey(k)))
+
+	cur, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lu := *cur
+	lu.HomeDir = t.TempDir()
+	dir := lu.HomeDir + "/.ssh"
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	path := dir + "/authorized_keys"
+	line := `no-pty,command="echo hi" ` + key + " alice@example.com"
+	contents := "# comment\n\nnot a key\n" + line + "\n"
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	got, err := authorizedKeysOf(&lu)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{line}; !reflect.DeepEqual(got, want) {
+		t.Errorf("keys = %q; want %q", got, want)
+	}
+
+	// Files others could have written to are refused.
+	if err := os.Chmod(path, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := authorizedKeysOf(&lu); err == nil {
+		t.Error("read world-writable authorized_keys; want error")
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(path, path+".real"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(path+".real", path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := authorizedKeysOf(&lu); err == nil {
+		t.Error("followed authorized_keys symlink; want error")
+	}
+}
+
+func TestParseKeyOptions(t *testing.T) {
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		opts    []string
+		want    *keyOptions
+		wantErr bool
+	}{
+		{opts: []string{`command="echo \"hi\""`}, want: &keyOptions{command: `echo "hi"`}},
+		{opts: []string{"no-port-forwarding", "No-Agent-Forwarding"}, want: &keyOptions{noPortForwarding: true, noAgentForwarding: true}},
+		{opts: []string{"restrict", "pty"}, want: &keyOptions{noPortForwarding: true, noAgentForwarding: true}},
+		{opts: []string{"no-X11-forwarding", "no-user-rc"}, want: &keyOptions{}},
+		{opts: []string{`expiry-time="20220602"`}, want: &keyOptions{}},
+		{opts: []string{`expiry-time="202206011100Z"`}, wantErr: true},
+		{opts: []string{`expiry-time="2022"`}, wantErr: true},
+		{opts: []string{`from="10.0.0.0/8"`}, wantErr: true},
+		{opts: []string{`command=echo`}, wantErr: true},
+		{opts: []string{"no-touch-required"}, want: &keyOptions{noTouchRequired: true}},
+		{opts: []string{"verify-required"}, want: &keyOptions{verifyRequired: true}},
+	}
+	for _, tt := range tests {
+		got, err := parseKeyOptions(tt.opts, now)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseKeyOptions(%q) = %+v; want error", tt.opts, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseKeyOptions(%q): %v", tt.opts, err)
+			continue
+		}
+		if *got != *tt.want {
+			t.Errorf("parseKeyOptions(%q) = %+v; want %+v", tt.opts, got, tt.want)
+		}
+	}
+}
+
+func TestKeyOptionsApply(t *testing.T) {
+	a := &tailcfg.SSHAction{
+		Accept:                     true,
+		AllowAgentForwarding:       true,
+		AllowLocalPortForwarding:   true,
+		AllowStreamLocalForwarding: true,
+	}
+	var none *keyOptions
+	if got := none.apply(a); got != a {
+		t.Errorf("nil options changed the action")
+	}
+	ko := &keyOptions{command: "backup", noPortForwarding: true, noAgentForwarding: true}
+	got := ko.apply(a)
+	want := &tailcfg.SSHAction{Accept: true, ForceCommand: "backup"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("apply = %+v; want %+v", got, want)
+	}
+	if !a.AllowAgentForwarding {
+		t.Error("apply modified its argument")
+	}
+
+	// The policy's ForceCommand wins over the key's command=.
+	a = &tailcfg.SSHAction{Accept: true, ForceCommand: "git-shell"}
+	if got := (&keyOptions{command: "/bin/sh"}).apply(a); got.ForceCommand != "git-shell" {
+		t.Errorf("ForceCommand = %q; want the policy's git-shell", got.ForceCommand)
+	}
+}
+
+func TestScheduleOpen(t *testing.T) {
+	// 2022-06-01 is a Wednesday.
+	at := func(day int, hhmm string) time.Time {
+		tod, _ := time.Parse("15:04", hhmm)
+		return time.Date(2022, 6, day, tod.Hour(), tod.Minute(), 0, 0, time.UTC)
+	}
+	weekdays := []string{"Mon", "Tue", "Wed", "Thu", "Fri"}
+	tests := []struct {
+		name string
+		s    tailcfg.SSHSchedule
+		now  time.Time
+		want bool
+	}{
+		{"business-hours", tailcfg.SSHSchedule{Days: weekdays, Start: "09:00", End: "17:00"}, at(1, "10:30"), true},
+		{"before-open", tailcfg.SSHSchedule{Days: weekdays, Start: "09:00", End: "17:00"}, at(1, "08:59"), false},
+		{"at-close", tailcfg.SSHSchedule{Days: weekdays, Start: "09:00", End: "17:00"}, at(1, "17:00"), false},
+		{"weekend", tailcfg.SSHSchedule{Days: weekdays, Start: "09:00", End: "17:00"}, at(4, "10:30"), false},
+		{"all-day", tailcfg.SSHSchedule{Days: []string{"sat"}}, at(4, "23:59"), true},
+		{"every-day", tailcfg.SSHSchedule{Start: "09:00", End: "17:00"}, at(5, "12:00"), true},
+		{"overnight-evening", tailcfg.SSHSchedule{Days: []string{"Fri"}, Start: "22:00", End: "06:00"}, at(3, "23:00"), true},
+		{"overnight-morning", tailcfg.SSHSchedule{Days: []string{"Fri"}, Start: "22:00", End: "06:00"}, at(4, "05:00"), true},
+		{"overnight-wrong-day", tailcfg.SSHSchedule{Days: []string{"Fri"}, Start: "22:00", End: "06:00"}, at(3, "05:00"), false},
+		{"overnight-midday", tailcfg.SSHSchedule{Start: "22:00", End: "06:00"}, at(3, "12:00"), false},
+		{"time-zone", tailcfg.SSHSchedule{TimeZone: "America/New_York", Start: "09:00", End: "17:00"}, at(1, "14:00"), true},
+		{"time-zone-closed", tailcfg.SSHSchedule{TimeZone: "America/New_York", Start: "09:00", End: "17:00"}, at(1, "22:00"), false},
+		{"bad-zone", tailcfg.SSHSchedule{TimeZone: "Nowhere/Special"}, at(1, "12:00"), false},
+		{"bad-day", tailcfg.SSHSchedule{Days: []string{"Someday"}}, at(1, "12:00"), false},
+		{"bad-time", tailcfg.SSHSchedule{Start: "9am", End: "17:00"}, at(1, "12:00"), false},
+	}
+	for _, tt := range tests {
+		if got, _ := scheduleOpen(&tt.s, tt.now); got != tt.want {
+			t.Errorf("%s: scheduleOpen at %v = %v; want %v", tt.name, tt.now, got, tt.want)
+		}
+	}
+}
+
+func TestRuleScheduledBadSchedule(t *testing.T) {
+	ci := &sshConnInfo{now: time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)}
+	bad := &tailcfg.SSHSchedule{TimeZone: "Nowhere/Special"}
+	if ci.ruleScheduled(&tailcfg.SSHRule{Schedule: bad, Action: &tailcfg.SSHAction{Accept: true}}) {
+		t.Error("accept rule with a bad schedule applies; want never")
+	}
+	if !ci.ruleScheduled(&tailcfg.SSHRule{Schedule: bad, Action: &tailcfg.SSHAction{Reject: true}}) {
+		t.Error("reject rule with a bad schedule doesn't apply; want always")
+	}
+}
+
+func TestMapLocalUserTemplate(t *testing.T) {
+	alice := &sshConnInfo{
+		sshUser: "Deploy",
+		node:    &tailcfg.Node{},
+		uprof:   &tailcfg.UserProfile{LoginName: "Alice.Smith+x@example.com"},
+	}
+	aliceHash := shortHash("alice.smith+x@example.com", 8)
+	long := &sshConnInfo{
+		node:  &tailcfg.Node{},
+		uprof: &tailcfg.UserProfile{LoginName: "a.very.long.local.part@example.com"},
+	}
+	tagged := &sshConnInfo{
+		sshUser: "deploy",
+		node:    &tailcfg.Node{Tags: []string{"tag:ci"}},
+		uprof:   &tailcfg.UserProfile{LoginName: "tagged-devices"},
+	}
+	tests := []struct {
+		users map[string]string
+		ci    *sshConnInfo
+		want  string
+	}{
+		{map[string]string{"*": "ts-{loginlocalpart}"}, alice, "ts-alice.smithx-" + aliceHash},
+		{map[string]string{"*": "{sshuser}-{loginlocalpart}"}, alice, "deploy-alice.smithx-" + aliceHash},
+		{map[string]string{"*": "{loginlocalpart}"}, long, "a.very.long.loca-" + shortHash("a.very.long.local.part@example.com", 8)},
+		{map[string]string{"*": "ts-{loginlocalpart}"}, tagged, ""},
+		{map[string]string{"*": "{sshuser}"}, tagged, "deploy"},
+		{map[string]string{"*": "{nope}"}, alice, ""},
+		{map[string]string{"*": "ts-{loginlocalpart"}, alice, ""},
+		{map[string]string{"*": "{loginlocalpart}"}, &sshConnInfo{uprof: &tailcfg.UserProfile{LoginName: "-rf@example.com"}}, ""},
+		{map[string]string{"Deploy": "root", "*": "ts-{loginlocalpart}"}, alice, "root"},
+		{map[string]string{"*": "{directoryuser}"}, alice, ""},
+		// Templates can't make root, unlike plain mappings.
+		{map[string]string{"*": "{sshuser}"}, &sshConnInfo{sshUser: "root", uprof: &tailcfg.UserProfile{}}, ""},
+	}
+	for _, tt := range tests {
+		if got := mapLocalUser(tt.users, tt.ci); got != tt.want {
+			t.Errorf("mapLocalUser(%v) for %q = %q; want %q", tt.users, tt.ci.uprof.LoginName, got, tt.want)
+		}
+	}
+
+	// Logins that differ only in their domain, or in characters that
+	// aren't kept, map to different users.
+	users := map[string]string{"*": "{loginlocalpart}"}
+	seen := map[string]string{}
+	for _, login := range []string{"alice@a.com", "alice@b.com", "al+ice@x.com", "alice@x.com"} {
+		lu := mapLocalUser(users, &sshConnInfo{node: &tailcfg.Node{}, uprof: &tailcfg.UserProfile{LoginName: login}})
+		if other, ok := seen[lu]; ok {
+			t.Errorf("%s and %s both map to %q", login, other, lu)
+		}
+		seen[lu] = login
+	}
+}
+
+func TestRunUserResolver(t *testing.T) {
+	prog := filepath.Join(t.TempDir(), "resolver")
+	script := `#!/bin/sh
+case "$1" in
+alice@example.com) echo ASmith ;;
+bob@example.com) echo "-rf" ;;
+nobody@example.com) ;;
+*) exit 1 ;;
+esac
+`
+	if err := os.WriteFile(prog, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := runUserResolver(prog, "alice@example.com"); got != "ASmith" || err != nil {
+		t.Errorf("alice: got %q, %v; want ASmith", got, err)
+	}
+	for _, login := range []string{"bob@example.com", "nobody@example.com", "carol@example.com"} {
+		if got, err := runUserResolver(prog, login); err == nil {
+			t.Errorf("%s: got %q; want error", login, got)
+		}
+	}
+
+	defer func(v string) { userResolverCommand = v }(userResolverCommand)
+	userResolverCommand = prog
+	srv := &server{logf: t.Logf}
+	ci := &sshConnInfo{
+		sshUser:          "x",
+		node:             &tailcfg.Node{},
+		uprof:            &tailcfg.UserProfile{LoginName: "alice@example.com"},
+		resolveLocalUser: srv.resolveDirectoryUser,
+	}
+	if got := mapLocalUser(map[string]string{"*": "{directoryuser}"}, ci); got != "ASmith" {
+		t.Errorf("mapLocalUser = %q; want ASmith", got)
+	}
+}
+
+func TestResolveDirectoryUserFailing(t *testing.T) {
+	dir := t.TempDir()
+	prog := filepath.Join(dir, "resolver")
+	// It logs its runs, and fails while the file "down" exists.
+	script := `#!/bin/sh
+echo "$1" >> "$0.log"
+sleep 0.2
+[ -e "$0.down" ] && exit 1
+case "$1" in
+alice@example.com) echo ASmith ;;
+esac
+`
+	if err := os.WriteFile(prog, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	runs := func() int {
+		b, _ := os.ReadFile(prog + ".log")
+		return bytes.Count(b, []byte("\n"))
+	}
+	defer func(v string) { userResolverCommand = v }(userResolverCommand)
+	userResolverCommand = prog
+	now := time.Unix(1e9, 0)
+	srv := &server{logf: t.Logf, timeNow: func() time.Time { return now }}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if got, err := srv.resolveDirectoryUser("alice@example.com"); got != "ASmith" || err != nil {
+				t.Errorf("got %q, %v; want ASmith", got, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := runs(); n != 1 {
+		t.Errorf("resolver ran %d times for concurrent lookups; want 1", n)
+	}
+
+	if err := os.WriteFile(prog+".down", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(userResolverCacheTTL)
+	if got, err := srv.resolveDirectoryUser("alice@example.com"); got != "ASmith" || err != nil {
+		t.Errorf("while failing: got %q, %v; want the last answer, ASmith", got, err)
+	}
+	if _, err := srv.resolveDirectoryUser("bob@example.com"); !errors.Is(err, errUserResolverFailing) {
+		t.Errorf("while failing, without a last answer: got %v; want errUserResolverFailing", err)
+	}
+	now = now.Add(userResolverStaleTTL)
+	if _, err := srv.resolveDirectoryUser("alice@example.com"); !errors.Is(err, errUserResolverFailing) {
+		t.Errorf("while failing, past userResolverStaleTTL: got %v; want errUserResolverFailing", err)
+	}
+
+	if err := os.Remove(prog + ".down"); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(userResolverCacheTTL)
+	if _, err := srv.resolveDirectoryUser("bob@example.com"); !errors.Is(err, errNoDirectoryUser) {
+		t.Errorf("bob: got %v; want errNoDirectoryUser", err)
+	}
+}
+
+func TestEphemeralUserName(t *testing.T) {
+	alice := &sshConnInfo{node: &tailcfg.Node{}, uprof: &tailcfg.UserProfile{LoginName: "Alice.Smith+ci@example.com"}}
+	tagged := &sshConnInfo{node: &tailcfg.Node{Tags: []string{"tag:ci"}}, uprof: &tailcfg.UserProfile{LoginName: "tagged-devices"}}
+	tests := []struct {
+		mode string
+		ci   *sshConnInfo
+		want string
+	}{
+		{"user", alice, "ts-alicesmithci-" + shortHash("Alice.Smith+ci@example.com", 8)},
+		{"user", tagged, "ts-ci-" + shortHash("tag:ci", 8)},
+		{"session", alice, "ts-" + shortHash("sess1", 12)},
+		{"bogus", alice, ""},
+	}
+	for _, tt := range tests {
+		got := ephemeralUserName(tt.mode, tt.ci, "sess1")
+		if got != tt.want {
+			t.Errorf("ephemeralUserName(%q, %v) = %q; want %q", tt.mode, tt.ci.uprof.LoginName, got, tt.want)
+		}
+		if len(got) > 32 {
+			t.Errorf("%q is too long for a user name", got)
+		}
+	}
+}
+
+func TestAcquireEphemeralUser(t *testing.T) {
+	defer func(c, r func(string) error) { createEphemeralUser, removeEphemeralUser = c, r }(createEphemeralUser, removeEphemeralUser)
+	var ops []string
+	createEphemeralUser = func(name string) error {
+		ops = append(ops, "create "+name)
+		return nil
+	}
+	removeEphemeralUser = func(name string) error {
+		ops = append(ops, "remove "+name)
+		return nil
+	}
+	srv := &server{logf: t.Logf}
+	release1, err := srv.acquireEphemeralUser("ts-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release2, err := srv.acquireEphemeralUser("ts-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release1()
+	if want := []string{"create ts-a"}; !reflect.DeepEqual(ops, want) {
+		t.Errorf("with a session left, ops = %q; want %q", ops, want)
+	}
+	release2()
+	if want := []string{"create ts-a", "remove ts-a"}; !reflect.DeepEqual(ops, want) {
+		t.Errorf("ops = %q; want %q", ops, want)
+	}
+}
+
+func TestRemoveStaleEphemeralUsers(t *testing.T) {
+	defer func(r func(string) error, l func() ([]string, error)) {
+		removeEphemeralUser, listEphemeralUsers = r, l
+	}(removeEphemeralUser, listEphemeralUsers)
+	var removed []string
+	removeEphemeralUser = func(name string) error {
+		removed = append(removed, name)
+		return nil
+	}
+	listEphemeralUsers = func() ([]string, error) {
+		return []string{"ts-inuse", "ts-stale"}, nil
+	}
+	srv := &server{logf: t.Logf, ephemeralUsers: map[string]int{"ts-inuse": 1}}
+	srv.removeStaleEphemeralUsers()
+	if want := []string{"ts-stale"}; !reflect.DeepEqual(removed, want) {
+		t.Errorf("removed %q; want %q", removed, want)
+	}
+}
+
+func TestUserGroupIDs(t *testing.T) {
+	u, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gids, err := userGroupIDs(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, g := range gids {
+		if g == u.Gid {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("groups %q don't include the primary group %v", gids, u.Gid)
+	}
+}
+
+func TestParseDSCLRead(t *testing.T) {
+	out := "NFSHomeDirectory:\n /Users/Jane Doe\nUserShell: /bin/zsh\n"
+	got := parseDSCLRead([]byte(out))
+	want := map[string]string{"NFSHomeDirectory": "/Users/Jane Doe", "UserShell": "/bin/zsh"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q; want %q", got, want)
+	}
+
+	out = "NFSHomeDirectory: /Users/jane /Network/Servers/dc/Users/jane\nNo such key: UserShell\n"
+	got = parseDSCLRead([]byte(out))
+	want = map[string]string{"NFSHomeDirectory": "/Users/jane"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q; want %q", got, want)
+	}
+}
+
+func TestDirectoryServicesUser(t *testing.T) {
+	out := "UniqueID: 1234567\nPrimaryGroupID: 20\nNFSHomeDirectory: /Users/jane\nNo such key: UserShell\n"
+	got := directoryServicesUser("jane", parseDSCLRead([]byte(out)))
+	want := &user.User{Uid: "1234567", Gid: "20", Username: "jane", Name: "jane", HomeDir: "/Users/jane"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v; want %+v", got, want)
+	}
+
+	for _, out := range []string{
+		"",
+		"PrimaryGroupID: 20\nNFSHomeDirectory: /Users/jane\n",
+		"UniqueID: 1234567\nPrimaryGroupID: staff\nNFSHomeDirectory: /Users/jane\n",
+		"UniqueID: 1234567\nPrimaryGroupID: 20\nNFSHomeDirectory: jane\n",
+	} {
+		if got := directoryServicesUser("jane", parseDSCLRead([]byte(out))); got != nil {
+			t.Errorf("%q: got %+v; want nil", out, got)
+		}
+	}
+}
+
+func TestParseUlimit(t *testing.T) {
+	tests := []struct {
+		in         string
+		soft, hard uint64
+		wantErr    bool
+	}{
+		{in: "1024", soft: 1024, hard: 1024},
+		{in: "1024:4096", soft: 1024, hard: 4096},
+		{in: "0", soft: 0, hard: 0},
+		{in: "unlimited", soft: rlimUnlimited, hard: rlimUnlimited},
+		{in: "1024:unlimited", soft: 1024, hard: rlimUnlimited},
+		{in: "4096:1024", wantErr: true},
+		{in: "unlimited:0", wantErr: true},
+		{in: "", wantErr: true},
+		{in: "-1", wantErr: true},
+		{in: "1k", wantErr: true},
+	}
+	for _, tt := range tests {
+		soft, hard, err := parseUlimit(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseUlimit(%q) error = %v; want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if err == nil && (soft != tt.soft || hard != tt.hard) {
+			t.Errorf("parseUlimit(%q) = %v, %v; want %v, %v", tt.in, soft, hard, tt.soft, tt.hard)
+		}
+	}
+}
+
+func TestSessionDuration(t *testing.T) {
+	tests := []struct {
+		a    tailcfg.SSHAction
+		want time.Duration
+	}{
+		{tailcfg.SSHAction{}, 0},
+		{tailcfg.SSHAction{SessionDuration: time.Minute}, time.Minute},
+		{tailcfg.SSHAction{SesssionDuration: time.Hour}, time.Hour},
+		{tailcfg.SSHAction{SessionDuration: time.Minute, SesssionDuration: time.Hour}, time.Minute},
+	}
+	for _, tt := range tests {
+		if got := sessionDuration(&tt.a); got != tt.want {
+			t.Errorf("sessionDuration(%+v) = %v; want %v", tt.a, got, tt.want)
+		}
+	}
+}
+
+func TestParseDebugPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		wantErr string // substring; empty means no error
+	}{
+		{
+			name: "ok",
+			in:   `{"rules": [{"principals": [{"any": true}], "sshUsers": {"*": "ubuntu"}, "action": {"accept": true}}]}`,
+		},
+		{
+			name: "ok-reject-without-users",
+			in:   `{"rules": [{"principals": [{"any": true}], "action": {"reject": true}}]}`,
+		},
+		{
+			name:    "bad-json",
+			in:      `{"rules": [`,
+			wantErr: "invalid JSON",
+		},
+		{
+			name:    "unknown-field",
+			in:      `{"rules": [{"principals": [{"anyone": true}], "sshUsers": {"*": "ubuntu"}, "action": {"accept": true}}]}`,
+			wantErr: "unknown field",
+		},
+		{
+			name:    "unknown-action-field",
+			in:      `{"rules": [{"principals": [{"any": true}], "sshUsers": {"*": "ubuntu"}, "action": {"accept": true, "sesssionDuration": 60000000000}}]}`,
+			wantErr: "unknown field",
+		},
+		{
+			name:    "no-action",
+			in:      `{"rules": [{"principals": [{"any": true}], "sshUsers": {"*": "ubuntu"}}]}`,
+			wantErr: "rule 1: no action",
+		},
+		{
+			name:    "two-verdicts",
+			in:      `{"rules": [{"principals": [{"any": true}], "sshUsers": {"*": "ubuntu"}, "action": {"accept": true, "reject": true}}]}`,
+			wantErr: "exactly one",
+		},
+		{
+			name:    "no-principals",
+			in:      `{"rules": [{"sshUsers": {"*": "ubuntu"}, "action": {"accept": true}}]}`,
+			wantErr: "no principals",
+		},
+		{
+			name:    "no-users",
+			in:      `{"rules": [{"principals": [{"any": true}], "action": {"accept": true}}]}`,
+			wantErr: "no sshUsers",
+		},
+		{
+			name:    "bad-schedule",
+			in:      `{"rules": [{"principals": [{"any": true}], "sshUsers": {"*": "ubuntu"}, "action": {"accept": true}, "schedule": {"days": ["Someday"]}}]}`,
+			wantErr: `invalid day "Someday"`,
+		},
+		{
+			name:    "negative-session-limits",
+			in:      `{"rules": [{"principals": [{"any": true}], "sshUsers": {"*": "ubuntu"}, "action": {"accept": true, "sessionLimits": {"pidsMax": -1}}}]}`,
+			wantErr: "negative sessionLimits",
+		},
+		{
+			name:    "bad-umask",
+			in:      `{"rules": [{"principals": [{"any": true}], "sshUsers": {"*": "ubuntu"}, "action": {"accept": true, "umask": "099"}}]}`,
+			wantErr: `invalid umask "099"`,
+		},
+		{
+			name:    "unknown-ulimit",
+			in:      `{"rules": [{"principals": [{"any": true}], "sshUsers": {"*": "ubuntu"}, "action": {"accept": true, "ulimits": {"stack": "1"}}}]}`,
+			wantErr: `unknown ulimit "stack"`,
+		},
+		{
+			name:    "bad-user-template",
+			in:      `{"rules": [{"principals": [{"any": true}], "sshUsers": {"*": "ts-{loginname}"}, "action": {"accept": true}}]}`,
+			wantErr: "unknown placeholder {loginname}",
+		},
+		{
+			name:    "unknown-ephemeral-user-mode",
+			in:      `{"rules": [{"principals": [{"any": true}], "sshUsers": {"*": "ci"}, "action": {"accept": true, "ephemeralUser": "connection"}}]}`,
+			wantErr: `unknown ephemeralUser "connection"`,
+		},
+		{
+			name:    "relative-recording-dir",
+			in:      `{"rules": [], "recordingDir": "audit/ssh"}`,
+			wantErr: "not an absolute path",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseDebugPolicy([]byte(tt.in))
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Fatalf("error = %v; want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseRecordingName(t *testing.T) {
+	tests := []struct {
+		name           string
+		wantOK         bool
+		wantID         string
+		wantStart      int64
+		wantCompressed bool
+	}{
+		{"ssh-session-1654000000000000000-20220531T123456-abcdef1234-98765.cast", true, "20220531T123456-abcdef1234", 1654000000000000000, false},
+		{"ssh-session-1654000000000000000-20220531T123456-abcdef1234-98765.cast.gz", true, "20220531T123456-abcdef1234", 1654000000000000000, true},
+		{"ssh-session-1654000000000000000-20220531T123456-abcdef1234-98765.txt", false, "", 0, false},
+		{"ssh-session-x-20220531T123456-abcdef1234-98765.cast", false, "", 0, false},
+		{"ssh-session-1654000000000000000-98765.cast", false, "", 0, false},
+		{"other.cast", false, "", 0, false},
+	}
+	for _, tt := range tests {
+		rec, ok := parseRecordingName(tt.name)
+		if ok != tt.wantOK {
+			t.Errorf("parseRecordingName(%q) ok = %v; want %v", tt.name, ok, tt.wantOK)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if rec.SessionID != tt.wantID || rec.Start.UnixNano() != tt.wantStart || rec.Compressed != tt.wantCompressed {
+			t.Errorf("parseRecordingName(%q) = %+v", tt.name, rec)
+		}
+	}
+}
+
+// failingWriteCloser is an io.WriteCloser whose writes fail, as on a
+// full disk.
+type failingWriteCloser struct{}
+
+func (failingWriteCloser) Write([]byte) (int, error) { return 0, syscall.ENOSPC }
+func (failingWriteCloser) Close() error              { return nil }
+
+func TestRecordingFailure(t *testing.T) {
+	defer health.SetSSHRecordingHealth(nil)
+	newRecording := func(policy string) (*recording, *sshSession) {
+		ss := &sshSession{
+			logf:   t.Logf,
+			ctx:    newSSHContext(),
+			action: &tailcfg.SSHAction{Record: true, RecordingFailure: policy},
+		}
+		var out io.WriteCloser = failingWriteCloser{}
+		if policy == recordingFailurePause {
+			out = pausingWriter{out, ss}
+		}
+		return &recording{ss: ss, start: time.Now(), out: out}, ss
+	}
+
+	t.Run("terminate", func(t *testing.T) {
+		r, ss := newRecording("")
+		var buf bytes.Buffer
+		if n, err := r.writer("o", &buf).Write([]byte("hi")); err == nil || n != 0 {
+			t.Errorf("Write = %v, %v; want an error", n, err)
+		}
+		if buf.Len() != 0 {
+			t.Errorf("output %q got through", buf.Bytes())
+		}
+		if ss.ctx.Err() == nil {
+			t.Error("session not closed")
+		}
+	})
+	t.Run("continue", func(t *testing.T) {
+		r, ss := newRecording(recordingFailureContinue)
+		var buf bytes.Buffer
+		w := r.writer("o", &buf)
+		for i := 0; i < 2; i++ {
+			if _, err := w.Write([]byte("hi")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if buf.String() != "hihi" {
+			t.Errorf("output = %q; want hihi", buf.Bytes())
+		}
+		if ss.ctx.Err() != nil {
+			t.Errorf("session closed: %v", ss.ctx.Err())
+		}
+	})
+	t.Run("pause", func(t *testing.T) {
+		r, ss := newRecording(recordingFailurePause)
+		var buf bytes.Buffer
+		errc := make(chan error, 1)
+		go func() {
+			_, err := r.writer("o", &buf).Write([]byte("hi"))
+			errc <- err
+		}()
+		select {
+		case err := <-errc:
+			t.Fatalf("Write returned %v while paused", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+		ss.ctx.CloseWithError(errSessionDone)
+		if err := <-errc; err == nil {
+			t.Error("Write succeeded after the session ended")
+		}
+		if buf.Len() != 0 {
+			t.Errorf("output %q got through", buf.Bytes())
+		}
+	})
+}
@@ -0,0 +1,91 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux || (darwin && !ios) || windows
+// +build linux darwin,!ios windows
+
+package tailssh
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"tailscale.com/tailcfg"
+)
+
+// rlimUnlimited is what parseUlimit returns for "unlimited". The
+// incubator makes it the platform's RLIM_INFINITY.
+const rlimUnlimited = math.MaxUint64
+
+// ulimitResources are the resources that SSHAction.Ulimits may limit.
+var ulimitResources = map[string]bool{
+	"nofile": true,
+	"nproc":  true,
+	"core":   true,
+}
+
+// parseUmask parses an SSHAction.Umask.
+func parseUmask(s string) (uint32, error) {
+	m, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || m > 0777 {
+		return 0, fmt.Errorf("invalid umask %q", s)
+	}
+	return uint32(m), nil
+}
+
+// parseUlimit parses a value of SSHAction.Ulimits: a limit, or
+// "unlimited", for both the soft and hard limits, or "soft:hard".
+func parseUlimit(v string) (soft, hard uint64, err error) {
+	parse := func(s string) (uint64, error) {
+		if s == "unlimited" {
+			return rlimUnlimited, nil
+		}
+		return strconv.ParseUint(s, 10, 64)
+	}
+	softStr, hardStr, ok := strings.Cut(v, ":")
+	if !ok {
+		hardStr = softStr
+	}
+	soft, err1 := parse(softStr)
+	hard, err2 := parse(hardStr)
+	if err1 != nil || err2 != nil {
+		return 0, 0, fmt.Errorf("invalid limit %q", v)
+	}
+	if soft > hard {
+		return 0, 0, fmt.Errorf("soft limit of %q is over its hard limit", v)
+	}
+	return soft, hard, nil
+}
+
+// validateUlimits reports whether a's Umask and Ulimits are well-formed.
+func validateUlimits(a *tailcfg.SSHAction) error {
+	if a.Umask != "" {
+		if _, err := parseUmask(a.Umask); err != nil {
+			return err
+		}
+	}
+	for name, v := range a.Ulimits {
+		if !ulimitResources[name] {
+			return fmt.Errorf("unknown ulimit %q", name)
+		}
+		if _, _, err := parseUlimit(v); err != nil {
+			return fmt.Errorf("ulimit %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// ulimitsArg formats ulimits for the incubator's --ulimits flag, as
+// comma-separated name=value pairs.
+func ulimitsArg(ulimits map[string]string) string {
+	pairs := make([]string, 0, len(ulimits))
+	for name, v := range ulimits {
+		pairs = append(pairs, name+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
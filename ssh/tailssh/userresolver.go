@@ -0,0 +1,130 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux || (darwin && !ios) || windows
+// +build linux darwin,!ios windows
+
+package tailssh
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"tailscale.com/envknob"
+)
+
+// userResolverCommand, if non-empty, is a program that maps Tailscale
+// login names to local user names, for the {directoryuser} placeholder
+// of SSHUsers templates, as for orgs whose Unix user names, as in LDAP,
+// differ from their identity provider's. It's run with the login name
+// as its argument and prints the user name, or nothing if there isn't
+// one. If it fails, as when its directory is unreachable, its last
+// answer is used instead, for up to userResolverStaleTTL.
+var userResolverCommand = envknob.String("TS_SSH_USER_RESOLVER")
+
+const (
+	// userResolverTimeout is how long userResolverCommand may take.
+	userResolverTimeout = 5 * time.Second
+
+	// userResolverCacheTTL is how long userResolverCommand's answers
+	// are reused for, as a policy is evaluated several times per
+	// connection, and again for each session on policy changes.
+	userResolverCacheTTL = time.Minute
+
+	// userResolverStaleTTL is how long a user name userResolverCommand
+	// answered with is still used for while it's failing.
+	userResolverStaleTTL = time.Hour
+)
+
+var (
+	// errNoDirectoryUser is the user resolver's answer that a login
+	// name has no local user.
+	errNoDirectoryUser = errors.New("no user")
+
+	// errUserResolverFailing is returned when the user resolver
+	// fails without a recent enough answer to use instead.
+	errUserResolverFailing = errors.New("user resolver failing")
+)
+
+// resolvedUser is an answer of userResolverCommand.
+type resolvedUser struct {
+	name string // or empty if err != nil
+	err  error
+	at   time.Time // when the resolver was last run
+
+	// goodAt is when the resolver last answered with name. While it's
+	// failing, name is still used until userResolverStaleTTL after.
+	goodAt time.Time
+}
+
+// resolveDirectoryUser returns the local user name that
+// userResolverCommand maps loginName to. Concurrent calls for the same
+// login name share a run of the resolver.
+func (srv *server) resolveDirectoryUser(loginName string) (string, error) {
+	if userResolverCommand == "" {
+		return "", errors.New("no user resolver")
+	}
+	now := srv.now()
+	srv.mu.Lock()
+	ru, ok := srv.resolvedUsers[loginName]
+	srv.mu.Unlock()
+	if ok && now.Sub(ru.at) < userResolverCacheTTL {
+		return ru.name, ru.err
+	}
+	v, _, _ := srv.userResolves.Do(loginName, func() (any, error) {
+		return srv.runDirectoryUserResolver(loginName, ru, now), nil
+	})
+	ru = v.(resolvedUser)
+	return ru.name, ru.err
+}
+
+// runDirectoryUserResolver runs userResolverCommand for loginName and
+// caches its answer, or if it fails, prev's, the previous one, if it's
+// recent enough. It returns the answer.
+func (srv *server) runDirectoryUserResolver(loginName string, prev resolvedUser, now time.Time) resolvedUser {
+	name, err := runUserResolver(userResolverCommand, loginName)
+	ru := resolvedUser{name: name, err: err, at: now}
+	switch {
+	case err == nil:
+		ru.goodAt = now
+	case errors.Is(err, errNoDirectoryUser):
+	case prev.name != "" && now.Sub(prev.goodAt) < userResolverStaleTTL:
+		srv.logf("ssh: resolving local user of %q: %v; using its last answer, %q", loginName, err, prev.name)
+		ru.name, ru.err, ru.goodAt = prev.name, nil, prev.goodAt
+	default:
+		srv.logf("ssh: resolving local user of %q: %v", loginName, err)
+		ru.err = fmt.Errorf("%w: %v", errUserResolverFailing, err)
+	}
+	srv.mu.Lock()
+	mapSet(&srv.resolvedUsers, loginName, ru)
+	srv.mu.Unlock()
+	return ru
+}
+
+// runUserResolver runs the user resolver program prog for loginName
+// and returns the user name it prints. If it prints none, or one that
+// isn't a valid user name, the error is errNoDirectoryUser.
+func runUserResolver(prog, loginName string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), userResolverTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, prog, loginName).Output()
+	if err != nil {
+		return "", err
+	}
+	line, _, _ := bufio.NewReader(bytes.NewReader(out)).ReadLine()
+	name := strings.TrimSpace(string(line))
+	if name == "" {
+		return "", errNoDirectoryUser
+	}
+	if !validLocalUserName(name) || strings.ContainsAny(name, "/: \t") {
+		return "", fmt.Errorf("%w: invalid user name %q", errNoDirectoryUser, name)
+	}
+	return name, nil
+}
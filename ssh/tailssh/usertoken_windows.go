@@ -0,0 +1,215 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tailssh
+
+// This file gets the tokens that sessions' processes run with, which
+// make them the local user's. Tailscale SSH users don't give a
+// password, so it uses a Service-for-User (S4U) logon, as Windows'
+// own OpenSSH server does for public key logins. That needs
+// tailscaled to be running as LocalSystem.
+
+import (
+	"fmt"
+	"os/user"
+	"strings"
+	"unicode/utf16"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	secur32                            = windows.NewLazySystemDLL("secur32.dll")
+	procLsaRegisterLogonProcess        = secur32.NewProc("LsaRegisterLogonProcess")
+	procLsaDeregisterLogonProcess      = secur32.NewProc("LsaDeregisterLogonProcess")
+	procLsaLookupAuthenticationPackage = secur32.NewProc("LsaLookupAuthenticationPackage")
+	procLsaLogonUser                   = secur32.NewProc("LsaLogonUser")
+	procLsaFreeReturnBuffer            = secur32.NewProc("LsaFreeReturnBuffer")
+
+	advapi32                    = windows.NewLazySystemDLL("advapi32.dll")
+	procAllocateLocallyUniqueId = advapi32.NewProc("AllocateLocallyUniqueId")
+)
+
+const (
+	msv1_0PackageName = "MICROSOFT_AUTHENTICATION_PACKAGE_V1_0"
+	kerberosName      = "Kerberos"
+
+	// s4uLogonType is both MsV1_0S4ULogon and KerbS4ULogon.
+	s4uLogonType = 12
+
+	// logonTypeNetwork is SECURITY_LOGON_TYPE's Network, the type of
+	// logon that doesn't cache the user's credentials.
+	logonTypeNetwork = 3
+)
+
+// lsaString is an LSA_STRING.
+type lsaString struct {
+	Length        uint16
+	MaximumLength uint16
+	Buffer        *byte
+}
+
+func newLSAString(s string) *lsaString {
+	b := append([]byte(s), 0)
+	return &lsaString{
+		Length:        uint16(len(s)),
+		MaximumLength: uint16(len(b)),
+		Buffer:        &b[0],
+	}
+}
+
+// s4uLogon is both an MSV1_0_S4U_LOGON and a KERB_S4U_LOGON, which
+// have the same layout.
+type s4uLogon struct {
+	MessageType uint32
+	Flags       uint32
+	User        windows.NTUnicodeString
+	Domain      windows.NTUnicodeString
+}
+
+// tokenSource is a TOKEN_SOURCE.
+type tokenSource struct {
+	SourceName       [8]byte
+	SourceIdentifier windows.LUID
+}
+
+// quotaLimits is a QUOTA_LIMITS.
+type quotaLimits struct {
+	PagedPoolLimit        uintptr
+	NonPagedPoolLimit     uintptr
+	MinimumWorkingSetSize uintptr
+	MaximumWorkingSetSize uintptr
+	PagefileLimit         uintptr
+	TimeLimit             int64
+}
+
+// canRunAs returns an error if this process can't start processes as
+// lu. It can if it's running as lu or as LocalSystem.
+func canRunAs(lu *user.User) error {
+	cur, err := user.Current()
+	if err != nil {
+		return err
+	}
+	if cur.Uid == lu.Uid {
+		return nil
+	}
+	system, err := windows.CreateWellKnownSid(windows.WinLocalSystemSid)
+	if err != nil {
+		return err
+	}
+	if cur.Uid != system.String() {
+		return fmt.Errorf("can't switch to user %q from %q, which isn't LocalSystem", lu.Username, cur.Username)
+	}
+	return nil
+}
+
+// userToken returns the token to start lu's processes with, or 0 if
+// they should run as this process's user. The caller must close it.
+func userToken(lu *user.User) (windows.Token, error) {
+	cur, err := user.Current()
+	if err != nil {
+		return 0, err
+	}
+	if cur.Uid == lu.Uid {
+		return 0, nil
+	}
+	domain, name, ok := strings.Cut(lu.Username, `\`)
+	if !ok {
+		domain, name = ".", lu.Username
+	}
+	computer, err := windows.ComputerName()
+	if err != nil {
+		return 0, err
+	}
+	pkgName := kerberosName
+	if domain == "." || strings.EqualFold(domain, computer) {
+		domain, pkgName = computer, msv1_0PackageName
+	}
+	return s4uLogonUser(pkgName, domain, name)
+}
+
+// s4uLogonUser logs on the user name of domain, using the
+// authentication package pkgName, and returns the logon's token.
+func s4uLogonUser(pkgName, domain, name string) (windows.Token, error) {
+	var lsa windows.Handle
+	var mode uint32
+	r, _, _ := procLsaRegisterLogonProcess.Call(
+		uintptr(unsafe.Pointer(newLSAString("tailscaled"))),
+		uintptr(unsafe.Pointer(&lsa)),
+		uintptr(unsafe.Pointer(&mode)))
+	if r != 0 {
+		return 0, fmt.Errorf("LsaRegisterLogonProcess: %w", windows.NTStatus(r))
+	}
+	defer procLsaDeregisterLogonProcess.Call(uintptr(lsa))
+
+	var pkg uint32
+	r, _, _ = procLsaLookupAuthenticationPackage.Call(
+		uintptr(lsa),
+		uintptr(unsafe.Pointer(newLSAString(pkgName))),
+		uintptr(unsafe.Pointer(&pkg)))
+	if r != 0 {
+		return 0, fmt.Errorf("LsaLookupAuthenticationPackage(%q): %w", pkgName, windows.NTStatus(r))
+	}
+
+	// The logon's strings go in the same buffer as it, after it.
+	name16 := utf16.Encode([]rune(name))
+	domain16 := utf16.Encode([]rune(domain))
+	hdr := unsafe.Sizeof(s4uLogon{})
+	buf := make([]byte, hdr+2*uintptr(len(name16)+len(domain16)))
+	info := (*s4uLogon)(unsafe.Pointer(&buf[0]))
+	info.MessageType = s4uLogonType
+	off := hdr
+	for _, f := range []struct {
+		dst *windows.NTUnicodeString
+		s   []uint16
+	}{{&info.User, name16}, {&info.Domain, domain16}} {
+		if len(f.s) == 0 {
+			continue
+		}
+		p := (*uint16)(unsafe.Pointer(&buf[off]))
+		copy(unsafe.Slice(p, len(f.s)), f.s)
+		*f.dst = windows.NTUnicodeString{
+			Length:        uint16(2 * len(f.s)),
+			MaximumLength: uint16(2 * len(f.s)),
+			Buffer:        p,
+		}
+		off += 2 * uintptr(len(f.s))
+	}
+
+	var src tokenSource
+	copy(src.SourceName[:], "tailscal")
+	procAllocateLocallyUniqueId.Call(uintptr(unsafe.Pointer(&src.SourceIdentifier)))
+
+	var (
+		profile    uintptr
+		profileLen uint32
+		logonID    windows.LUID
+		token      windows.Token
+		quotas     quotaLimits
+		subStatus  windows.NTStatus
+	)
+	r, _, _ = procLsaLogonUser.Call(
+		uintptr(lsa),
+		uintptr(unsafe.Pointer(newLSAString("tailscaled"))),
+		logonTypeNetwork,
+		uintptr(pkg),
+		uintptr(unsafe.Pointer(&buf[0])),
+		uintptr(len(buf)),
+		0, // no extra groups
+		uintptr(unsafe.Pointer(&src)),
+		uintptr(unsafe.Pointer(&profile)),
+		uintptr(unsafe.Pointer(&profileLen)),
+		uintptr(unsafe.Pointer(&logonID)),
+		uintptr(unsafe.Pointer(&token)),
+		uintptr(unsafe.Pointer(&quotas)),
+		uintptr(unsafe.Pointer(&subStatus)))
+	if profile != 0 {
+		procLsaFreeReturnBuffer.Call(profile)
+	}
+	if r != 0 {
+		return 0, fmt.Errorf("LsaLogonUser(%s\\%s): %w (substatus %#x)", domain, name, windows.NTStatus(r), uint32(subStatus))
+	}
+	return token, nil
+}
@@ -69,7 +69,21 @@
 //    30: 2022-03-22: client can request id tokens.
 //    31: 2022-04-15: PingRequest & PingResponse TSMP & disco support
 //    32: 2022-04-17: client knows FilterRule.CapMatch
-const CurrentCapabilityVersion CapabilityVersion = 32
+//    33: 2022-05-10: client serves MapResponse.SSHHostCertificates
+//    34: 2022-05-12: client handles MapResponse.SSHTerminateSessions
+//    35: 2022-05-13: client honors SSHAction.AcceptEnv
+//    36: 2022-05-13: client honors SSHAction.ForceCommand
+//    37: 2022-05-13: client honors SSHAction.SFTPOnly
+//    38: 2022-05-13: client honors SSHAction.RequireLocalGroup
+//    39: 2022-05-13: client honors SSHAction.LocalPortForwardingDestinations
+//    40: 2022-05-13: client honors SSHRule.Schedule
+//    41: 2022-05-13: client matches SSHPrincipal.NodeTag
+//    42: 2022-05-13: client matches CIDR prefixes in SSHPrincipal.NodeIP
+//    43: 2022-05-13: client matches "*@domain" in SSHPrincipal.UserLogin
+//    44: 2022-05-13: client matches SSHPrincipal.NodeName
+//    45: 2022-05-13: client honors SSHPolicy.PubKeyAlgorithms
+//    46: 2022-05-13: client matches bare SSHPrincipal.NodeName only in its own tailnet
+const CurrentCapabilityVersion CapabilityVersion = 46
 
 type StableID string
 
@@ -1292,7 +1306,8 @@ type PingResponse struct {
 type MapResponse struct {
 	// KeepAlive, if set, represents an empty message just to keep
 	// the connection alive. When true, all other fields except
-	// PingRequest, ControlTime, and PopBrowserURL are ignored.
+	// PingRequest, ControlTime, PopBrowserURL, and
+	// SSHTerminateSessions are ignored.
 	KeepAlive bool `json:",omitempty"`
 
 	// PingRequest, if non-empty, is a request to the client to
@@ -1307,6 +1322,12 @@ type MapResponse struct {
 	// identical URLs and only open it once for the same URL.
 	PopBrowserURL string
 
+	// SSHTerminateSessions, if non-empty, are Tailscale SSH sessions
+	// on the node that control wants ended now, such as ones an
+	// admin kicked out. They may be sent on any MapResponse (ones
+	// with KeepAlive true or false).
+	SSHTerminateSessions []*SSHTerminateSession `json:",omitempty"`
+
 	// Networking
 
 	// Node describes the node making the map request.
@@ -1393,6 +1414,14 @@ type MapResponse struct {
 	// SSH connections should be handled.
 	SSHPolicy *SSHPolicy `json:",omitempty"`
 
+	// SSHHostCertificates, if non-nil, replaces the SSH host
+	// certificates control has issued for the node's advertised
+	// Hostinfo.SSH_HostKeys, signed by the tailnet's SSH host CA so
+	// that clients trusting it needn't trust each host key on first
+	// use. Each is in authorized_keys format, as in
+	// "ssh-ed25519-cert-v01@openssh.com AAAA...".
+	SSHHostCertificates []string `json:",omitempty"`
+
 	// ControlTime, if non-zero, is the current timestamp according to the control server.
 	ControlTime *time.Time `json:",omitempty"`
 
@@ -1633,6 +1662,18 @@ type SetDNSRequest struct {
 // SetDNSResponse is the response to a SetDNSRequest.
 type SetDNSResponse struct{}
 
+// SSHTerminateSession is a request from control to end an active
+// Tailscale SSH session.
+type SSHTerminateSession struct {
+	// SessionID is the session's ID, as in its events and in the
+	// SSH server's status.
+	SessionID string
+
+	// Message, if non-empty, is shown to the session's user as
+	// the reason it ended. Otherwise, a generic one is.
+	Message string `json:",omitempty"`
+}
+
 // SSHPolicy is the policy for how to handle incoming SSH connections
 // over Tailscale.
 type SSHPolicy struct {
@@ -1652,6 +1693,27 @@ type SSHPolicy struct {
 	// public key authentication and the rules are evaluated again for each of
 	// the client's present keys.
 	Rules []*SSHRule `json:"rules"`
+
+	// RecordingDir, if non-empty, is the absolute path of the directory
+	// on the node in which session recordings are stored, instead of
+	// "ssh-sessions" in tailscaled's state directory. A directory set
+	// locally on the node with TS_SSH_RECORDING_DIR takes precedence.
+	RecordingDir string `json:"recordingDir,omitempty"`
+
+	// Banner, if non-empty, is text such as a legal notice that's shown
+	// to SSH clients before they authenticate. It replaces any banner
+	// set locally on the node with TS_SSH_BANNER_FILE.
+	Banner string `json:"banner,omitempty"`
+
+	// PubKeyAlgorithms, if non-empty, are the only public key
+	// algorithms that clients may authenticate with, as named by
+	// OpenSSH's PubkeyAcceptedAlgorithms, such as "ssh-ed25519" or
+	// "sk-ssh-ed25519@openssh.com". Both the key and the signature
+	// the client makes with it must use one of them, so for RSA keys
+	// "rsa-sha2-256" and "rsa-sha2-512" allow SHA-2 signatures and
+	// "ssh-rsa" allows SHA-1 ones. Clients that offer no public key,
+	// or another kind, are rejected whatever the rules say.
+	PubKeyAlgorithms []string `json:"pubKeyAlgorithms,omitempty"`
 }
 
 // An SSH rule is a match predicate and associated action for an incoming SSH connection.
@@ -1668,6 +1730,11 @@ type SSHRule struct {
 	// is subject to the SSHAction.SessionExpires time, if any.
 	RuleExpires *time.Time `json:"ruleExpires,omitempty"`
 
+	// Schedule, if non-nil, limits the rule to recurring windows of
+	// time, like business hours. Outside of them, the rule doesn't
+	// match.
+	Schedule *SSHSchedule `json:"schedule,omitempty"`
+
 	// Principals matches an incoming connection. If the connection
 	// matches anything in this list and also matches SSHUsers,
 	// then Action is applied.
@@ -1682,6 +1749,19 @@ type SSHRule struct {
 	// requested SSH user or "*"), the rule doesn't match.
 	// If the map value is "=", it means the ssh-user should map
 	// directly to the local-user.
+	// If the map value has placeholders in braces, like
+	// "ts-{loginlocalpart}", it's a template for the local-user:
+	// {loginlocalpart} is the part before the "@" of the connecting
+	// user's login name, up to 16 characters of it, followed by "-"
+	// and a hash of the whole login name, so that different users
+	// never map to the same local-user. {sshuser} is the ssh-user.
+	// Both are lowercased and without the characters other than
+	// letters, digits, ".", "_" and "-". {directoryuser} is the user
+	// name that the node's user resolver, if it has one, maps the
+	// login name to, as from LDAP. The rule doesn't match if a
+	// placeholder has no value, as the login name ones don't for
+	// tagged nodes, or if the template makes root or another system
+	// account.
 	// It may be nil if the Action is reject.
 	SSHUsers map[string]string `json:"sshUsers"`
 
@@ -1690,22 +1770,66 @@ type SSHRule struct {
 	Action *SSHAction `json:"action"`
 }
 
+// SSHSchedule is a recurring window of time during which an SSHRule
+// applies, such as 09:00 to 17:00 on weekdays in a given time zone.
+//
+// It's checked when connections are made, and when the policy
+// changes. Sessions aren't ended just because their window closes;
+// use SSHAction.SessionDuration to limit them. A schedule that
+// doesn't parse, including for a time zone the node doesn't know,
+// never matches, unless the rule's action is Reject, in which case it
+// always does, to fail closed.
+type SSHSchedule struct {
+	// TimeZone is the IANA name of the time zone that Days, Start
+	// and End are in, like "America/New_York". If empty, it's UTC.
+	// Nodes look it up in their system's time zone database, which
+	// Windows and minimal containers may lack.
+	TimeZone string `json:"timeZone,omitempty"`
+
+	// Days are the days of the week that the window opens on, as
+	// "Mon", "Tue", "Wed", "Thu", "Fri", "Sat" or "Sun". If empty,
+	// it opens every day.
+	Days []string `json:"days,omitempty"`
+
+	// Start and End are the times of day, as "HH:MM", that the
+	// window opens and closes at. If End isn't after Start, the
+	// window closes the next day, as in "22:00" to "06:00"; if
+	// they're equal, including both being empty, it's open all day.
+	Start string `json:"start,omitempty"`
+	End   string `json:"end,omitempty"`
+}
+
 // SSHPrincipal is either a particular node or a user on any node.
 type SSHPrincipal struct {
-	// Matching any one of the following four field causes a match.
+	// Matching any one of the following six field causes a match.
 	// It must also match Certs, if non-empty.
 
 	Node      StableNodeID `json:"node,omitempty"`
-	NodeIP    string       `json:"nodeIP,omitempty"`
-	UserLogin string       `json:"userLogin,omitempty"` // email-ish: foo@example.com, bar@github
+	NodeIP    string       `json:"nodeIP,omitempty"`    // IP address or CIDR prefix, like "100.64.0.0/10"
+	NodeTag   string       `json:"nodeTag,omitempty"`   // like "tag:ci"; matches nodes with exactly that ACL tag
+	NodeName  string       `json:"nodeName,omitempty"`  // MagicDNS name: "build-runner-3", in this node's tailnet, or any FQDN
+	UserLogin string       `json:"userLogin,omitempty"` // email-ish: foo@example.com, bar@github, or *@example.com for a whole domain
 	Any       bool         `json:"any,omitempty"`       // if true, match any connection
 	// TODO(bradfitz): add StableUserID, once that exists
 
 	// PubKeys, if non-empty, means that this SSHPrincipal only
 	// matches if one of these public keys is presented by the user.
 	//
-	// As a special case, if len(PubKeys) == 1 and PubKeys[0] starts
-	// with "https://", then it's fetched (like https://github.com/username.keys).
+	// Elements starting with "https://" are instead URLs to fetch
+	// more such keys from, one per line (like
+	// https://github.com/username.keys). They may be mixed with
+	// literal keys and each other, in which case the keys from all
+	// of them are accepted. "github:username" and "gitlab:username"
+	// are shorthand for the URLs of those users' keys on GitHub and
+	// GitLab. "authorized_keys" stands for the keys in the
+	// ~/.ssh/authorized_keys file of the local user that the rule
+	// maps to, as OpenSSH would accept.
+	//
+	// Keys, from wherever, may be preceded by authorized_keys options
+	// (see sshd(8)). The command=, no-port-forwarding,
+	// no-agent-forwarding, no-pty, restrict and expiry-time= options
+	// further restrict the sessions the key is used for. Keys with
+	// other restricting options, like from=, aren't accepted.
 	PubKeys []string `json:"pubKeys,omitempty"`
 }
 
@@ -1726,14 +1850,42 @@ type SSHAction struct {
 	// without further prompts.
 	Accept bool `json:"accept,omitempty"`
 
-	// SesssionDuration, if non-zero, is how long the session can stay open
+	// SessionDuration, if non-zero, is how long the session can stay open
 	// before being forcefully terminated.
-	SesssionDuration time.Duration `json:"sessionDuration,omitempty"`
+	SessionDuration time.Duration `json:"sessionDuration,omitempty"`
+
+	// SesssionDuration is the old, misspelled name of SessionDuration,
+	// for Go code that still sets it. It's not encoded in JSON; tailssh
+	// uses it if SessionDuration isn't set.
+	//
+	// Deprecated: use SessionDuration.
+	SesssionDuration time.Duration `json:"-"`
+
+	// CheckPeriod, if non-zero in an action that accepts a session,
+	// is how often the session must be re-authorized while it's
+	// open. Each time, tailscaled evaluates the policy again and
+	// follows its HoldAndDelegate URL, if any, in the background,
+	// showing the user any Messages on the way, and ends the session
+	// if the outcome isn't Accept. Unlike the re-evaluation when the
+	// policy changes, this asks the delegate again even if nothing
+	// changed. Delegated actions with a Prompt can't be followed
+	// mid-session, so sessions that need one end at the first check.
+	CheckPeriod time.Duration `json:"checkPeriod,omitempty"`
 
 	// AllowAgentForwarding, if true, allows accepted connections to forward
 	// the ssh agent if requested.
 	AllowAgentForwarding bool `json:"allowAgentForwarding,omitempty"`
 
+	// AllowPeerAgentForwarding, if true along with
+	// AllowAgentForwarding, lets the agent be reached across
+	// Tailscale SSH nodes, for jump host style workflows. On the
+	// node a user hops from, it lets Tailscale SSH nodes that the
+	// user's session connects to use the agent forwarded to the
+	// session. On the node a user hops to, it gives sessions whose
+	// SSH client didn't forward an agent the agent of the session
+	// on the node they came from, if that node allows it.
+	AllowPeerAgentForwarding bool `json:"allowPeerAgentForwarding,omitempty"`
+
 	// HoldAndDelegate, if non-empty, is a URL that serves an
 	// outcome verdict.  The connection will be accepted and will
 	// block until the provided long-polling URL serves a new
@@ -1751,11 +1903,256 @@ type SSHAction struct {
 	//   * $DST_NODE_ID (Node.ID as int64 string)
 	//   * $SSH_USER (URL escaped, ssh user requested)
 	//   * $LOCAL_USER (URL escaped, local user mapped)
+	//   * $PROMPT_RESPONSE (URL escaped, the user's answer to Prompt)
 	HoldAndDelegate string `json:"holdAndDelegate,omitempty"`
 
+	// HoldAndDelegatePOST, if true along with HoldAndDelegate, makes
+	// tailscaled fetch the HoldAndDelegate URL with a POST whose
+	// body is an SSHDelegateRequest, as JSON, describing the
+	// connection in more detail than the URL's variables can,
+	// rather than with a GET. The variables are still expanded.
+	HoldAndDelegatePOST bool `json:"holdAndDelegatePOST,omitempty"`
+
+	// InteractiveAuth, if true along with HoldAndDelegate, makes
+	// tailscaled follow the delegated actions while the SSH client
+	// authenticates, with keyboard-interactive authentication,
+	// rather than once the session has started. That way their
+	// Messages are shown, and their Prompts asked, by the SSH client
+	// itself, which lets MFA flows work for users without a
+	// browser. Clients that don't do keyboard-interactive
+	// authentication can't connect, and it can't be used with
+	// principals that require public keys.
+	InteractiveAuth bool `json:"interactiveAuth,omitempty"`
+
+	// Prompt, if non-empty in an action with HoldAndDelegate that's
+	// being followed during keyboard-interactive authentication (see
+	// InteractiveAuth), is a question to ask the user before
+	// fetching the HoldAndDelegate URL, such as "Verification code: ".
+	// The answer isn't echoed, and is expanded as $PROMPT_RESPONSE
+	// in the URL.
+	Prompt string `json:"prompt,omitempty"`
+
 	// AllowLocalPortForwarding, if true, allows accepted connections
 	// to use local port forwarding if requested.
 	AllowLocalPortForwarding bool `json:"allowLocalPortForwarding,omitempty"`
+
+	// LocalPortForwardingDestinations, if non-nil, limits the
+	// destinations that AllowLocalPortForwarding permits forwarding
+	// to. Each is a "host:port", where host is an IP address, a CIDR
+	// prefix or a hostname (matched exactly, case-insensitively) and
+	// port is a port number, a range like "8000-8999", or "*" for any,
+	// as in "127.0.0.1:5432", "10.0.0.0/8:*" or "[::1]:6379". If nil
+	// (JSON null or absent), any destination is allowed; if empty but
+	// non-nil (JSON []), none is. It's encoded even when empty, for
+	// that difference to survive.
+	LocalPortForwardingDestinations []string `json:"localPortForwardingDestinations"`
+
+	// AllowDynamicPortForwarding, if true, allows accepted
+	// connections to use the node as a SOCKS proxy, as with "ssh -D".
+	// SSH clients serve SOCKS themselves and forward each of its
+	// connections as they do for local port forwarding, so this
+	// implies AllowLocalPortForwarding. In addition, hostnames asked
+	// for are resolved by the node, and the connection is allowed if
+	// one of their addresses is in LocalPortForwardingDestinations,
+	// rather than only if the name itself is.
+	AllowDynamicPortForwarding bool `json:"allowDynamicPortForwarding,omitempty"`
+
+	// AllowStreamLocalForwarding, if true, allows accepted
+	// connections to forward Unix sockets if requested, in either
+	// direction (as with "ssh -L" and "ssh -R" given socket paths),
+	// but only for the paths in StreamLocalForwardingPaths.
+	AllowStreamLocalForwarding bool `json:"allowStreamLocalForwarding,omitempty"`
+
+	// StreamLocalForwardingPaths are the Unix socket paths that
+	// AllowStreamLocalForwarding permits forwarding. Each is an
+	// absolute path or one starting with "~/", for the local user's
+	// home directory, and may use path.Match patterns, as in
+	// "/var/run/docker.sock" or "~/.gnupg/S.*".
+	StreamLocalForwardingPaths []string `json:"streamLocalForwardingPaths,omitempty"`
+
+	// JumpTo, if non-empty along with Accept, makes the node a jump
+	// host for accepted sessions: instead of running them locally,
+	// it proxies them to the SSH server of another node in the
+	// tailnet, as the mapped local user, and records them there if
+	// recording is on. It's the node's MagicDNS name (full, or just
+	// its first label) or Tailscale IP, with an optional ":port",
+	// which defaults to 22. The node connects to it as itself, so
+	// the target's policy must accept this node's identity.
+	JumpTo string `json:"jumpTo,omitempty"`
+
+	// AllowRecordingPlayback, if true, lets accepted connections
+	// play back the node's session recordings with the
+	// "tailscale-playback <session-id>" subsystem, as in
+	// "ssh -s node tailscale-playback <session-id>".
+	AllowRecordingPlayback bool `json:"allowRecordingPlayback,omitempty"`
+
+	// Record, if true, records accepted sessions to the node's disk:
+	// pty sessions, commands run without a pty (such as scp), and
+	// SFTP sessions. Recording is then required: if it can't be
+	// started, the session is ended rather than run unrecorded, and
+	// port and Unix socket forwarding, which can't be recorded, is
+	// refused.
+	Record bool `json:"record,omitempty"`
+
+	// RecordingFailure is what happens to a recorded session when its
+	// recording fails mid-session, as when the disk fills up:
+	//
+	//   * "terminate" (or empty) ends the session.
+	//   * "continue" lets it go on unrecorded, logging a warning.
+	//     Sessions whose recording can't be started at all also
+	//     start unrecorded.
+	//   * "pause" holds up the session's output, retrying the
+	//     recording every few seconds, until it can continue.
+	//
+	// Recordings also aren't started unless the disk they're
+	// written to has some space left.
+	RecordingFailure string `json:"recordingFailure,omitempty"`
+
+	// AcceptEnv, if non-nil, limits the environment variables that
+	// clients may set for accepted sessions (with "env" requests, as
+	// with OpenSSH's SendEnv) to those whose names match one of its
+	// path.Match patterns, like "LANG" or "LC_*". The rest are dropped.
+	// If nil (JSON null or absent), all are accepted; if empty but
+	// non-nil (JSON []), none are. It's encoded even when empty, for
+	// that difference to survive.
+	AcceptEnv []string `json:"acceptEnv"`
+
+	// ForceCommand, if non-empty, is the command that accepted
+	// sessions run, with the local user's shell, whatever the client
+	// asked for: a shell, a command, or a subsystem such as SFTP. As
+	// with OpenSSH's ForceCommand, what the client asked for is in
+	// the command's SSH_ORIGINAL_COMMAND environment variable (the
+	// subsystem's name, for subsystems), so that restricted gateways,
+	// like git-only or backup-only access, can check it.
+	ForceCommand string `json:"forceCommand,omitempty"`
+
+	// SFTPOnly, if true, limits accepted sessions to the SFTP
+	// subsystem, for file transfer access without a shell: requests
+	// for a shell, a command (including scp) or any other subsystem
+	// are refused. It can't be used with ForceCommand.
+	SFTPOnly bool `json:"sftpOnly,omitempty"`
+
+	// RequireLocalGroup, if non-empty, is the name of a group on the
+	// node, such as "tailscale-ssh", that the local user must be a
+	// member of (as their primary group, or a supplementary one) for
+	// accepted connections to proceed. It lets the node's owner veto
+	// access independently of the tailnet's policy. It doesn't apply
+	// to JumpTo actions, which don't run anything on the node.
+	RequireLocalGroup string `json:"requireLocalGroup,omitempty"`
+
+	// AllowSessionJoin, if true, lets accepted connections join the
+	// node's other active pty sessions of the same local user, to
+	// watch their output live, with the "tailscale-join <session-id>"
+	// subsystem, as in "ssh -t -s node tailscale-join <session-id>".
+	// The joined session's user is told who joined. Sessions of other
+	// local users can't be joined.
+	AllowSessionJoin bool `json:"allowSessionJoin,omitempty"`
+
+	// AllowSessionJoinWrite, if true along with AllowSessionJoin,
+	// also lets them type into the sessions they join, if they join
+	// with "tailscale-join <session-id> rw".
+	AllowSessionJoinWrite bool `json:"allowSessionJoinWrite,omitempty"`
+
+	// SessionLimits, if non-nil, limits the resources that accepted
+	// sessions' processes may use together, so that a runaway
+	// command can't take down the node. It's enforced with a cgroup
+	// (v2) per session, so is only supported on Linux; elsewhere,
+	// and on nodes that can't make the cgroups, sessions it applies
+	// to are refused rather than run unlimited. It doesn't apply to
+	// JumpTo actions, which don't run anything on the node.
+	SessionLimits *SSHSessionLimits `json:"sessionLimits,omitempty"`
+
+	// Umask, if non-empty, is the file mode creation mask, in octal
+	// like "027", that accepted sessions' processes start with,
+	// instead of the system's default (as from pam_umask).
+	Umask string `json:"umask,omitempty"`
+
+	// Ulimits, if non-empty, are resource limits that accepted
+	// sessions' processes start with, instead of the system's
+	// defaults (as from pam_limits), by resource: "nofile" (open
+	// files), "nproc" (processes of the local user) or "core" (core
+	// dump size, in bytes). Each is a number, or "unlimited", for
+	// both the soft and hard limits, or "soft:hard" to set them
+	// apart, as with systemd's LimitNOFILE and the like.
+	//
+	// Neither Umask nor Ulimits is supported on Windows, where
+	// sessions they apply to are refused.
+	Ulimits map[string]string `json:"ulimits,omitempty"`
+
+	// EphemeralUser, if non-empty, makes accepted sessions run as a
+	// throwaway local user, created for them, instead of the one
+	// that the rule maps the SSH user to, as on CI nodes. The user
+	// is removed, with their home directory and any processes they
+	// have left, once their last session ends. It's one of:
+	//
+	//   * "session": each session gets a user of its own.
+	//   * "user": the sessions of each Tailscale user (or tagged
+	//     node) share one, named after them.
+	//
+	// It's only supported on Linux, where the users are made with
+	// useradd, and not for isolated connections. RequireLocalGroup
+	// doesn't apply to ephemeral users, and EphemeralUser doesn't
+	// apply to JumpTo actions.
+	EphemeralUser string `json:"ephemeralUser,omitempty"`
+}
+
+// SSHSessionLimits are resource limits for the processes of an SSH
+// session. Zero values mean no limit.
+type SSHSessionLimits struct {
+	// CPUPercent is how much CPU time the processes may use, as a
+	// percentage of one CPU: 50 is half of one, 200 two whole ones.
+	CPUPercent int `json:"cpuPercent,omitempty"`
+
+	// MemoryMax is the most memory, in bytes, that the processes may
+	// use before the kernel reclaims it from them and, failing that,
+	// kills one of them.
+	MemoryMax int64 `json:"memoryMax,omitempty"`
+
+	// PidsMax is the most processes (and threads) there may be.
+	PidsMax int `json:"pidsMax,omitempty"`
+}
+
+// SSHDelegateRequest is the JSON body of the POST request to an
+// SSHAction.HoldAndDelegate URL, if its SSHAction.HoldAndDelegatePOST
+// is set.
+type SSHDelegateRequest struct {
+	// SrcNode is the node connecting, and SrcAddr the Tailscale IP
+	// and port it's connecting from.
+	SrcNode *Node          `json:"srcNode"`
+	SrcAddr netaddr.IPPort `json:"srcAddr"`
+
+	// User is the profile of SrcNode's user.
+	User UserProfile `json:"user"`
+
+	// DstNodeID is the ID of the node being connected to, and
+	// DstAddr the Tailscale IP and port it's being connected to on.
+	DstNodeID NodeID         `json:"dstNodeID"`
+	DstAddr   netaddr.IPPort `json:"dstAddr"`
+
+	// SSHUser is the SSH user asked for, and LocalUser the local
+	// user the policy maps it to.
+	SSHUser   string `json:"sshUser"`
+	LocalUser string `json:"localUser"`
+
+	// PubKeyFingerprint is the SHA256 fingerprint of the public key
+	// the client authenticated with, if any, as in
+	// "SHA256:0w6z...".
+	PubKeyFingerprint string `json:"pubKeyFingerprint,omitempty"`
+
+	// SessionID is the ID of the session, once one has been asked
+	// for. It's empty during keyboard-interactive authentication
+	// (see SSHAction.InteractiveAuth).
+	SessionID string `json:"sessionID,omitempty"`
+
+	// Command and Subsystem are what the session asked to run: a
+	// command, or a subsystem such as "sftp". Both are empty for a
+	// shell, or before a session has been asked for.
+	Command   string `json:"command,omitempty"`
+	Subsystem string `json:"subsystem,omitempty"`
+
+	// PromptResponse is the user's answer to the SSHAction's
+	// Prompt, if it had one.
+	PromptResponse string `json:"promptResponse,omitempty"`
 }
 
 // OverTLSPublicKeyResponse is the JSON response to /key?v=<n>
@@ -622,3 +622,48 @@ func TestRegisterRequestNilClone(t *testing.T) {
 		t.Errorf("got = %v; want nil", got)
 	}
 }
+
+func TestSSHActionSessionDurationJSON(t *testing.T) {
+	var a SSHAction
+	if err := json.Unmarshal([]byte(`{"sessionDuration":60000000000}`), &a); err != nil {
+		t.Fatal(err)
+	}
+	if a.SessionDuration != time.Minute {
+		t.Errorf("SessionDuration = %v; want 1m", a.SessionDuration)
+	}
+
+	// The misspelling was only ever in Go, not on the wire, and
+	// decoders that reject unknown fields still see it as one.
+	d := json.NewDecoder(strings.NewReader(`{"accept":true,"sesssionDuration":60000000000}`))
+	d.DisallowUnknownFields()
+	if err := d.Decode(new(SSHAction)); err == nil {
+		t.Error("decoding the misspelled key with DisallowUnknownFields succeeded; want error")
+	}
+}
+
+// TestSSHActionEmptyListsJSON tests that SSHAction's lists where empty
+// and nil differ stay so through JSON.
+func TestSSHActionEmptyListsJSON(t *testing.T) {
+	for _, in := range []SSHAction{
+		{},
+		{AcceptEnv: []string{}},
+		{AcceptEnv: []string{"LANG"}},
+		{LocalPortForwardingDestinations: []string{}},
+		{LocalPortForwardingDestinations: []string{"127.0.0.1:5432"}},
+	} {
+		j, err := json.Marshal(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got SSHAction
+		if err := json.Unmarshal(j, &got); err != nil {
+			t.Fatal(err)
+		}
+		if (got.AcceptEnv == nil) != (in.AcceptEnv == nil) || len(got.AcceptEnv) != len(in.AcceptEnv) {
+			t.Errorf("%s: AcceptEnv = %#v; want %#v", j, got.AcceptEnv, in.AcceptEnv)
+		}
+		if (got.LocalPortForwardingDestinations == nil) != (in.LocalPortForwardingDestinations == nil) || len(got.LocalPortForwardingDestinations) != len(in.LocalPortForwardingDestinations) {
+			t.Errorf("%s: LocalPortForwardingDestinations = %#v; want %#v", j, got.LocalPortForwardingDestinations, in.LocalPortForwardingDestinations)
+		}
+	}
+}
@@ -7,7 +7,7 @@
 	"path"
 	"sync"
 
-	gossh "github.com/tailscale/golang-x-crypto/ssh"
+	gossh "tailscale.com/tempfork/golang-x-crypto/ssh"
 )
 
 const (
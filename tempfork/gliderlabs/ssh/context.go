@@ -6,7 +6,7 @@
 	"net"
 	"sync"
 
-	gossh "github.com/tailscale/golang-x-crypto/ssh"
+	gossh "tailscale.com/tempfork/golang-x-crypto/ssh"
 )
 
 // contextKey is a value for use with context.WithValue. It's used as
@@ -3,7 +3,7 @@
 import (
 	"io/ioutil"
 
-	gossh "github.com/tailscale/golang-x-crypto/ssh"
+	gossh "tailscale.com/tempfork/golang-x-crypto/ssh"
 )
 
 // PasswordAuth returns a functional option that sets PasswordHandler on the server.
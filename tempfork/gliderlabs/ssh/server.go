@@ -6,9 +6,10 @@
 	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	gossh "github.com/tailscale/golang-x-crypto/ssh"
+	gossh "tailscale.com/tempfork/golang-x-crypto/ssh"
 )
 
 // ErrServerClosed is returned by the Server's Serve, ListenAndServe,
@@ -49,6 +50,7 @@ type Server struct {
 	ReversePortForwardingCallback ReversePortForwardingCallback // callback for allowing reverse port forwarding, denies all if nil
 	ServerConfigCallback          ServerConfigCallback          // callback for configuring detailed SSH options
 	SessionRequestCallback        SessionRequestCallback        // callback for allowing or denying SSH sessions
+	BannerHandler                 BannerHandler                 // banner to send before authentication, none if nil
 
 	ConnectionFailedCallback ConnectionFailedCallback // callback to report connection failures
 
@@ -166,6 +168,12 @@ func (srv *Server) config(ctx Context) *gossh.ServerConfig {
 			return ctx.Permissions().Permissions, nil
 		}
 	}
+	if srv.BannerHandler != nil {
+		config.BannerCallback = func(conn gossh.ConnMetadata) string {
+			applyConnMetadata(ctx, conn)
+			return srv.BannerHandler(ctx)
+		}
+	}
 	return config
 }
 
@@ -298,8 +306,16 @@ func (srv *Server) HandleConn(newConn net.Conn) {
 	ctx.SetValue(ContextKeyConn, sshConn)
 	applyConnMetadata(ctx, sshConn)
 	//go gossh.DiscardRequests(reqs)
-	go srv.handleRequests(ctx, reqs)
+	var noMoreSessions int32 // atomic; set by a no-more-sessions request
+	go srv.handleRequests(ctx, reqs, &noMoreSessions)
 	for ch := range chans {
+		// The request and channels arrive on separate Go channels, so a
+		// session opened right after a no-more-sessions request whose
+		// reply the client didn't wait for may still be accepted.
+		if ch.ChannelType() == "session" && atomic.LoadInt32(&noMoreSessions) != 0 {
+			ch.Reject(gossh.Prohibited, "no more sessions")
+			continue
+		}
 		handler := srv.ChannelHandlers[ch.ChannelType()]
 		if handler == nil {
 			handler = srv.ChannelHandlers["default"]
@@ -312,8 +328,29 @@ func (srv *Server) HandleConn(newConn net.Conn) {
 	}
 }
 
-func (srv *Server) handleRequests(ctx Context, in <-chan *gossh.Request) {
+const (
+	// keepaliveRequestType is the global request OpenSSH clients send
+	// to check that the server's still there.
+	keepaliveRequestType = "keepalive@openssh.com"
+
+	// noMoreSessionsRequestType is the global request OpenSSH clients
+	// send to have the server refuse any more session channels on the
+	// connection, such as once a ControlMaster's own session is open.
+	noMoreSessionsRequestType = "no-more-sessions@openssh.com"
+)
+
+func (srv *Server) handleRequests(ctx Context, in <-chan *gossh.Request, noMoreSessions *int32) {
 	for req := range in {
+		switch req.Type {
+		case keepaliveRequestType:
+			// Any reply will do. Like OpenSSH's sshd, fail it.
+			req.Reply(false, nil)
+			continue
+		case noMoreSessionsRequestType:
+			atomic.StoreInt32(noMoreSessions, 1)
+			req.Reply(true, nil)
+			continue
+		}
 		handler := srv.RequestHandlers[req.Type]
 		if handler == nil {
 			handler = srv.RequestHandlers["default"]
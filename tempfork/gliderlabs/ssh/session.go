@@ -9,7 +9,8 @@
 	"sync"
 
 	"github.com/anmitsu/go-shlex"
-	gossh "github.com/tailscale/golang-x-crypto/ssh"
+
+	gossh "tailscale.com/tempfork/golang-x-crypto/ssh"
 )
 
 // Session provides access to information about an SSH session and methods
@@ -39,6 +40,11 @@ type Session interface {
 	// Exit sends an exit status and then closes the session.
 	Exit(code int) error
 
+	// ExitSignal reports that the process was terminated by signal sig,
+	// whether it dumped core and an optional error message, as in RFC
+	// 4254 section 6.10, and then closes the session.
+	ExitSignal(sig Signal, coreDumped bool, msg string) error
+
 	// Command returns a shell parsed slice of arguments that were provided by the
 	// user. Shell parsing splits the command string according to POSIX shell rules,
 	// which considers quoting not just whitespace.
@@ -191,6 +197,27 @@ func (sess *session) Exit(code int) error {
 	return sess.Close()
 }
 
+func (sess *session) ExitSignal(sig Signal, coreDumped bool, msg string) error {
+	sess.Lock()
+	defer sess.Unlock()
+	if sess.exited {
+		return errors.New("Session.Exit called multiple times")
+	}
+	sess.exited = true
+
+	exitSignal := struct {
+		Signal     string
+		CoreDumped bool
+		Msg        string
+		Lang       string
+	}{string(sig), coreDumped, msg, ""}
+	_, err := sess.SendRequest("exit-signal", false, gossh.Marshal(&exitSignal))
+	if err != nil {
+		return err
+	}
+	return sess.Close()
+}
+
 func (sess *session) User() string {
 	return sess.conn.User()
 }
@@ -10,7 +10,7 @@
 	"net"
 	"testing"
 
-	gossh "github.com/tailscale/golang-x-crypto/ssh"
+	gossh "tailscale.com/tempfork/golang-x-crypto/ssh"
 )
 
 func (srv *Server) serveOnce(l net.Listener) error {
@@ -4,7 +4,7 @@
 	"crypto/subtle"
 	"net"
 
-	gossh "github.com/tailscale/golang-x-crypto/ssh"
+	gossh "tailscale.com/tempfork/golang-x-crypto/ssh"
 )
 
 type Signal string
@@ -64,6 +64,10 @@
 // ServerConfigCallback is a hook for creating custom default server configs
 type ServerConfigCallback func(ctx Context) *gossh.ServerConfig
 
+// BannerHandler is a hook for the banner to send clients before they
+// authenticate. No banner is sent if it returns the empty string.
+type BannerHandler func(ctx Context) string
+
 // ConnectionFailedCallback is a hook for reporting failed connections
 // Please note: the net.Conn is likely to be closed at this point
 type ConnectionFailedCallback func(conn net.Conn, err error)
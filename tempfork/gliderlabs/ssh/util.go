@@ -5,7 +5,7 @@
 	"crypto/rsa"
 	"encoding/binary"
 
-	"github.com/tailscale/golang-x-crypto/ssh"
+	"tailscale.com/tempfork/golang-x-crypto/ssh"
 )
 
 func generateSigner() (ssh.Signer, error) {
@@ -258,6 +258,42 @@ func LogOnChange(logf Logf, maxInterval time.Duration, timeNow func() time.Time)
 	}
 }
 
+// Deduplicated returns a Logf that drops a log line identical to the
+// last one it logged if it comes within window of it, as happens when
+// something fails repeatedly in a loop. When a different line is
+// next logged, it's preceded by a count of the lines dropped.
+//
+// Unlike RateLimitedFn, which limits lines by their format string,
+// it only drops exact repeats, so it's suitable for logs whose lines
+// share a format but differ in detail.
+func Deduplicated(logf Logf, window time.Duration, timeNow func() time.Time) Logf {
+	var (
+		mu      sync.Mutex
+		last    string    // last line logged
+		lastAt  time.Time // when last was logged
+		dropped int       // repeats of last dropped since
+	)
+	return func(format string, args ...any) {
+		s := fmt.Sprintf(format, args...)
+		now := timeNow()
+
+		mu.Lock()
+		if s == last && now.Sub(lastAt) < window {
+			dropped++
+			mu.Unlock()
+			return
+		}
+		n := dropped
+		last, lastAt, dropped = s, now, 0
+		mu.Unlock()
+
+		if n > 0 {
+			logf("[DEDUP] previous line repeated %d more times", n)
+		}
+		logf(format, args...)
+	}
+}
+
 // ArgWriter is a fmt.Formatter that can be passed to any Logf func to
 // efficiently write to a %v argument without allocations.
 type ArgWriter func(*bufio.Writer)
@@ -134,6 +134,33 @@ func TestLogOnChange(t *testing.T) {
 	}
 }
 
+func TestDeduplicated(t *testing.T) {
+	want := []string{
+		"copy: broken pipe",
+		"[DEDUP] previous line repeated 4 more times",
+		"copy: broken pipe",
+		"copy: EOF",
+		"copy: broken pipe",
+	}
+
+	timeNow := testTimer(1 * time.Second)
+
+	testsRun := 0
+	lgtest := logTester(want, t, &testsRun)
+	lg := Deduplicated(lgtest, 5*time.Second, timeNow)
+
+	// Repeats are logged once per window.
+	for i := 0; i < 6; i++ {
+		lg("copy: %v", "broken pipe")
+	}
+	lg("copy: %v", "EOF")
+	lg("copy: %v", "broken pipe")
+
+	if testsRun < len(want) {
+		t.Fatalf("'Wanted' lines including and after [%s] weren't logged.", want[testsRun])
+	}
+}
+
 func TestArgWriter(t *testing.T) {
 	got := new(bytes.Buffer)
 	fmt.Fprintf(got, "Greeting: %v", ArgWriter(func(bw *bufio.Writer) {
@@ -42,6 +42,10 @@ type NetworkMap struct {
 	PacketFilter []filter.Match
 	SSHPolicy    *tailcfg.SSHPolicy // or nil, if not enabled/allowed
 
+	// SSHHostCertificates are the SSH host certificates control has
+	// issued for the node's host keys, in authorized_keys format.
+	SSHHostCertificates []string
+
 	// CollectServices reports whether this node's Tailnet has
 	// requested that info about services be included in HostInfo.
 	// If set, Hostinfo.ShieldsUp blocks services collection; that
@@ -12,9 +12,6 @@
 	"io"
 	"log"
 	"net"
-	"os"
-	"os/exec"
-	"runtime"
 	"strconv"
 	"strings"
 	"sync"
@@ -38,6 +35,7 @@
 	"tailscale.com/envknob"
 	"tailscale.com/ipn/ipnlocal"
 	"tailscale.com/net/packet"
+	"tailscale.com/net/ping"
 	"tailscale.com/net/tsaddr"
 	"tailscale.com/net/tsdial"
 	"tailscale.com/net/tstun"
@@ -45,7 +43,6 @@
 	"tailscale.com/types/ipproto"
 	"tailscale.com/types/logger"
 	"tailscale.com/types/netmap"
-	"tailscale.com/version/distro"
 	"tailscale.com/wgengine"
 	"tailscale.com/wgengine/filter"
 	"tailscale.com/wgengine/magicsock"
@@ -143,6 +140,7 @@ func Create(logf logger.Logf, tundev *tstun.Wrapper, e wgengine.Engine, mc *magi
 	if dialer == nil {
 		return nil, errors.New("nil Dialer")
 	}
+	ping.SetLogf(logf)
 	ipstack := stack.New(stack.Options{
 		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
 		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol, icmp.NewProtocol4, icmp.NewProtocol6},
@@ -473,76 +471,54 @@ func (ns *Impl) shouldProcessInbound(p *packet.Parsed, t *tstun.Wrapper) bool {
 	return false
 }
 
-// setAmbientCapsRaw is non-nil on Linux for Synology, to run ping with
-// CAP_NET_RAW from tailscaled's binary.
-var setAmbientCapsRaw func(*exec.Cmd)
+var (
+	userPingSem = syncs.NewSemaphore(20) // 20 pings at once
 
-var userPingSem = syncs.NewSemaphore(20) // 20 child ping processes at once
-
-var isSynology = runtime.GOOS == "linux" && distro.Get() == distro.Synology
+	userPingCapsOnce sync.Once
+)
 
 // userPing tried to ping dstIP and if it succeeds, injects pingResPkt
 // into the tundev.
 //
 // It's used in userspace/netstack mode when we don't have kernel
-// support or raw socket access. As such, this does the dumbest thing
-// that can work: runs the ping command. It's not super efficient, so
-// it bounds the number of pings going on at once. The idea is that
-// people only use ping occasionally to see if their internet's working
-// so this doesn't need to be great.
-//
-// TODO(bradfitz): when we're running on Windows as the system user, use
-// raw socket APIs instead of ping child processes.
+// support. Depending on our privileges, package ping may have to run
+// child ping processes, which isn't super efficient, so this bounds
+// the number of pings going on at once. The idea is that people only
+// use ping occasionally to see if their internet's working so this
+// doesn't need to be great.
 func (ns *Impl) userPing(dstIP netaddr.IP, pingResPkt []byte) {
 	if !userPingSem.TryAcquire() {
 		return
 	}
 	defer userPingSem.Release()
 
-	t0 := time.Now()
-	var err error
-	switch runtime.GOOS {
-	case "windows":
-		err = exec.Command("ping", "-n", "1", "-w", "3000", dstIP.String()).Run()
-	case "darwin":
-		// Note: 2000 ms is actually 1 second + 2,000
-		// milliseconds extra for 3 seconds total.
-		// See https://github.com/tailscale/tailscale/pull/3753 for details.
-		err = exec.Command("ping", "-c", "1", "-W", "2000", dstIP.String()).Run()
-	case "android":
-		ping := "/system/bin/ping"
-		if dstIP.Is6() {
-			ping = "/system/bin/ping6"
-		}
-		err = exec.Command(ping, "-c", "1", "-w", "3", dstIP.String()).Run()
-	default:
-		ping := "ping"
-		if isSynology {
-			ping = "/bin/ping"
+	userPingCapsOnce.Do(func() {
+		if err := ping.Selected().Err(); err != nil {
+			ns.logf("%v", err)
 		}
-		cmd := exec.Command(ping, "-c", "1", "-W", "3", dstIP.String())
-		if isSynology && os.Getuid() != 0 {
-			// On DSM7 we run as non-root and need to pass
-			// CAP_NET_RAW if our binary has it.
-			setAmbientCapsRaw(cmd)
-		}
-		err = cmd.Run()
-	}
-	d := time.Since(t0)
+	})
+	// Ping fails rather than falling back to TCP probes when ICMP
+	// isn't possible, so a peer's ping is never answered for a host
+	// that merely refused or accepted a TCP connection.
+	d, err := ping.Ping(context.Background(), ping.ClassOther, dstIP)
 	if err != nil {
+		var ce *ping.CapabilityError
+		if errors.As(err, &ce) {
+			return // logged once above
+		}
 		if d < time.Second/2 {
 			// If it failed quicker than the 3 second
-			// timeout we gave above (500 ms is a
+			// timeout package ping uses (500 ms is a
 			// reasonable threshold), then assume the ping
 			// failed for problems finding/running
 			// ping. We don't want to log if the host is
 			// just down.
-			ns.logf("exec ping of %v failed in %v: %v", dstIP, d, err)
+			ns.logf("ping of %v failed in %v: %v", dstIP, d, err)
 		}
 		return
 	}
 	if debugNetstack {
-		ns.logf("exec pinged %v in %v", dstIP, time.Since(t0))
+		ns.logf("pinged %v in %v", dstIP, d)
 	}
 	if err := ns.tundev.InjectOutbound(pingResPkt); err != nil {
 		ns.logf("InjectOutbound ping response: %v", err)